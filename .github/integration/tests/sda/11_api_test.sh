@@ -3,7 +3,7 @@ set -e
 
 # Test the API files endpoint
 token="$(curl -s http://oidc:8080/tokens | jq -r '.[0]')"
-response="$(curl -s -k -L "http://api:8080/files" -H "Authorization: Bearer $token" | jq -r 'sort_by(.inboxPath)|.[-1].fileStatus')"
+response="$(curl -s -k -L "http://api:8080/files" -H "Authorization: Bearer $token" | jq -r '.data|sort_by(.inboxPath)|.[-1].fileStatus')"
 if [ "$response" != "uploaded" ]; then
 	echo "API returned incorrect value, expected ready got: $response"
 	exit 1
@@ -53,21 +53,21 @@ if [ "$resp" != "200" ]; then
 fi
 
 ts=$(date +"%F %T")
-depr="$(curl -s -k -L -H "Authorization: Bearer $token" -X GET "http://api:8080/c4gh-keys/list" | jq -r .[1].deprecated_at)"
+depr="$(curl -s -k -L -H "Authorization: Bearer $token" -X GET "http://api:8080/c4gh-keys/list" | jq -r .data[1].deprecated_at)"
 if [ "$depr" != "$ts" ]; then
 	echo "Error when listing key hash, expected $ts got: $depr"
 	exit 1
 fi
 
 # list key hashes
-resp="$(curl -s -k -L -H "Authorization: Bearer $token" -X GET "http://api:8080/c4gh-keys/list" | jq '. | length')"
+resp="$(curl -s -k -L -H "Authorization: Bearer $token" -X GET "http://api:8080/c4gh-keys/list" | jq '.data | length')"
 if [ "$resp" -ne 2 ]; then
 	echo "Error when listing key hash, expected 2 entries got: $resp"
 	exit 1
 fi
 
 manual_hash=$(sed -n '2p' /shared/c4gh.pub.pem | base64 -d -w0 | xxd -c64 -ps)
-resp="$(curl -s -k -L -H "Authorization: Bearer $token" -X GET "http://api:8080/c4gh-keys/list" | jq -r .[0].hash)"
+resp="$(curl -s -k -L -H "Authorization: Bearer $token" -X GET "http://api:8080/c4gh-keys/list" | jq -r .data[0].hash)"
 if [ "$resp" != "$manual_hash" ]; then
 	echo "Error when listing key hash, expected $manual_hash got: $resp"
 	exit 1
@@ -3,7 +3,7 @@ CREATE SCHEMA sda;
 SET search_path TO sda;
 
 -- ENUMS
-CREATE TYPE checksum_algorithm AS ENUM ('MD5', 'SHA256', 'SHA384', 'SHA512');
+CREATE TYPE checksum_algorithm AS ENUM ('MD5', 'SHA256', 'SHA384', 'SHA512', 'SHA3-256', 'CRC32C');
 CREATE TYPE checksum_source AS ENUM ('UPLOADED', 'ARCHIVED', 'UNENCRYPTED');
 
 -- The schema_version table is used to keep track of migrations
@@ -30,7 +30,38 @@ VALUES (0, now(), 'Created with version'),
        (13, now(), 'Create API user'),
        (14, now(), 'Create Auth user'),
        (15, now(), 'Give API user insert priviledge in logs table'),
-       (16, now(), 'Give ingest user select priviledge in encryption_keys table');
+       (16, now(), 'Give ingest user select priviledge in encryption_keys table'),
+       (17, now(), 'Add submission freeze table'),
+       (18, now(), 'Add user quota table'),
+       (19, now(), 'Add file access grants table'),
+       (20, now(), 'Add projects to files and project scoped admins'),
+       (21, now(), 'Track storage quota warnings'),
+       (22, now(), 'Add upload sessions'),
+       (23, now(), 'Add sequence for minting dataset IDs'),
+       (24, now(), 'Add external archive replicas table'),
+       (25, now(), 'Allow api to backfill correlation IDs'),
+       (26, now(), 'Notify listeners of new file and dataset events'),
+       (27, now(), 'Add expected files for pre-registered submissions'),
+       (28, now(), 'Soft delete files'),
+       (29, now(), 'Add SHA3-256 and CRC32C checksums'),
+       (30, now(), 'Add deletion requests'),
+       (31, now(), 'Add submission metadata to files and datasets'),
+       (32, now(), 'Add duplicate file event'),
+       (33, now(), 'Allow api to purge old file events'),
+       (34, now(), 'Add user usage accounting'),
+       (35, now(), 'Add trigram indexes for file search'),
+       (36, now(), 'Add summary tables for statistics'),
+       (37, now(), 'Add file status transitions'),
+       (38, now(), 'Add dataset mapping provenance'),
+       (39, now(), 'Add processed messages'),
+       (40, now(), 'Add refresh tokens'),
+       (41, now(), 'Add claims of refresh tokens'),
+       (42, now(), 'Add WebAuthn credentials'),
+       (43, now(), 'Add S3 credentials of the inbox'),
+       (44, now(), 'Add login sessions and revoked tokens'),
+       (45, now(), 'Add TOTP second factor'),
+       (46, now(), 'Add audit log of auth'),
+       (47, now(), 'Check the status transitions of archived and verified files');
 
 -- Datasets are used to group files, and permissions are set on the dataset
 -- level
@@ -39,6 +70,7 @@ CREATE TABLE datasets (
     stable_id           TEXT UNIQUE,
     title               TEXT,
     description         TEXT,
+    metadata            JSONB, -- Submission metadata, e.g. sample IDs
     created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
 );
 
@@ -67,6 +99,9 @@ CREATE TABLE files (
     header               TEXT,
     encryption_method    TEXT,
     key_hash             TEXT REFERENCES encryption_keys(key_hash),
+    project              TEXT,
+    deleted_at           TIMESTAMP WITH TIME ZONE,
+    metadata             JSONB, -- Submission metadata, e.g. instrument
 
     -- Table Audit / Logs
     created_by           NAME DEFAULT CURRENT_USER, -- Postgres users
@@ -120,6 +155,12 @@ CREATE TABLE file_dataset (
     id                  SERIAL PRIMARY KEY,
     file_id             UUID REFERENCES files(id) NOT NULL,
     dataset_id          INT REFERENCES datasets(id) NOT NULL,
+    mapped_by           TEXT,
+    mapped_at           TIMESTAMP WITH TIME ZONE,
+    source              TEXT CHECK (source IN ('api', 'sync')), -- where the latest change was requested
+    correlation_id      TEXT,                                   -- of the latest mapping message
+    modified_by         TEXT,
+    modified_at         TIMESTAMP WITH TIME ZONE,
     CONSTRAINT unique_file_dataset UNIQUE(file_id, dataset_id)
 );
 
@@ -138,6 +179,7 @@ VALUES ( 5, 'registered'  , 'Upload to the inbox has started'),
        (30, 'ingested'    , 'File information has been added to the database'),
        (40, 'archived'    , 'File has been moved to the archive'),
        (50, 'verified'    , 'Checksums have been verified in the archived file'),
+       (51, 'duplicate'   , 'The decrypted file is identical to another file of the same user'),
        (60, 'backed up'   , 'File has been backed up'),
        (70, 'ready'       , 'File is ready for access requests'),
        (80, 'downloaded'  , 'Downloaded by user'),
@@ -146,6 +188,35 @@ VALUES ( 5, 'registered'  , 'Upload to the inbox has started'),
        ( 2, 'enabled'     , 'Reenables a disabled file');
 
 
+-- The status changes allowed by set_file_status, from the latest event of a
+-- file to the new one
+CREATE TABLE file_event_transitions (
+    from_event TEXT REFERENCES file_events(title),
+    to_event   TEXT REFERENCES file_events(title),
+    PRIMARY KEY (from_event, to_event)
+);
+
+INSERT INTO file_event_transitions(from_event, to_event)
+VALUES ('registered', 'registered'), ('registered', 'uploaded'), ('registered', 'submitted'),
+       ('uploaded', 'registered'), ('uploaded', 'uploaded'), ('uploaded', 'submitted'),
+       ('submitted', 'submitted'), ('submitted', 'ingested'), ('submitted', 'archived'),
+       ('ingested', 'archived'),
+       ('archived', 'submitted'), ('archived', 'archived'), ('archived', 'verified'), ('archived', 'duplicate'),
+       ('verified', 'verified'), ('verified', 'duplicate'), ('verified', 'backed up'), ('verified', 'ready'),
+       ('duplicate', 'verified'), ('duplicate', 'duplicate'), ('duplicate', 'backed up'), ('duplicate', 'ready'),
+       ('backed up', 'verified'), ('backed up', 'backed up'), ('backed up', 'ready'),
+       ('ready', 'verified'), ('ready', 'backed up'), ('ready', 'ready'), ('ready', 'downloaded'),
+       ('downloaded', 'verified'), ('downloaded', 'ready'), ('downloaded', 'downloaded'),
+       ('error', 'registered'), ('error', 'uploaded'), ('error', 'submitted'), ('error', 'archived'), ('error', 'verified'),
+       ('enabled', 'registered'), ('enabled', 'uploaded'), ('enabled', 'submitted'), ('enabled', 'archived'), ('enabled', 'verified'), ('enabled', 'backed up'), ('enabled', 'ready'),
+       ('disabled', 'enabled');
+
+-- any file can be disabled, and get an error unless it is disabled
+INSERT INTO file_event_transitions(from_event, to_event)
+SELECT title, 'disabled' FROM file_events
+UNION SELECT title, 'error' FROM file_events WHERE title <> 'disabled'
+ON CONFLICT DO NOTHING;
+
 -- Keeps track of all events for the files, with timestamps and user_ids.
 CREATE TABLE file_event_log (
     id                  SERIAL PRIMARY KEY,
@@ -165,6 +236,7 @@ CREATE TABLE file_event_log (
     success             BOOLEAN,
     error               TEXT
 );
+CREATE INDEX file_event_log_started_at ON file_event_log(started_at);
 
 -- This table is used to define events for dataset event logging.
 CREATE TABLE dataset_events (
@@ -188,3 +260,248 @@ CREATE TABLE dataset_event_log (
     message    JSONB, -- The rabbitMQ message that initiated the dataset event
     event_date TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
 );
+
+-- Admin controlled freezes that block new submissions for a user or a project.
+-- Rows are never deleted, lifting a freeze sets lifted_at and lifted_by so that
+-- the table also serves as the audit trail of freezes.
+CREATE TABLE submission_freeze (
+    id          SERIAL PRIMARY KEY,
+    scope       TEXT NOT NULL CHECK (scope IN ('user', 'project')),
+    name        TEXT NOT NULL,
+    reason      TEXT,
+    frozen_by   TEXT NOT NULL,
+    frozen_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    lifted_by   TEXT,
+    lifted_at   TIMESTAMP WITH TIME ZONE
+);
+CREATE UNIQUE INDEX unique_active_freeze ON submission_freeze(scope, name) WHERE lifted_at IS NULL;
+
+-- Storage quota per submission user, a quota of 0 means no limit.
+-- Usage is computed from the file sizes in the files table.
+CREATE TABLE user_quota (
+    user_id       TEXT PRIMARY KEY,
+    quota_bytes   BIGINT NOT NULL CHECK (quota_bytes >= 0),
+    set_by        TEXT NOT NULL,
+    last_modified TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    -- highest warning threshold, in percent, the user has been notified about
+    warned_at     INTEGER NOT NULL DEFAULT 0
+);
+
+-- Totals of the files of each submission user, summarised periodically for
+-- usage statistics. All submitted files count as uploaded, archived files
+-- also as archived and files mapped to a dataset also as in a dataset.
+CREATE TABLE user_usage (
+    user_id        TEXT PRIMARY KEY,
+    uploaded_files BIGINT NOT NULL,
+    uploaded_bytes BIGINT NOT NULL,
+    archived_files BIGINT NOT NULL,
+    archived_bytes BIGINT NOT NULL,
+    dataset_files  BIGINT NOT NULL,
+    dataset_bytes  BIGINT NOT NULL,
+    summarised_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+-- Number of files and datasets by their latest status, summarised
+-- periodically so that statistics do not scan the files and event logs.
+CREATE TABLE file_stats (
+    status         TEXT PRIMARY KEY,
+    files          BIGINT NOT NULL,
+    uploaded_bytes BIGINT NOT NULL,
+    archived_bytes BIGINT NOT NULL,
+    summarised_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+CREATE TABLE dataset_stats (
+    status        TEXT PRIMARY KEY,
+    datasets      BIGINT NOT NULL,
+    files         BIGINT NOT NULL,
+    summarised_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+-- Access to single files, for data access decisions that only cover part of
+-- a dataset. Revoked grants are kept for auditing.
+CREATE TABLE file_access_grants (
+    id          SERIAL PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    file_id     UUID REFERENCES files(id) NOT NULL,
+    granted_by  TEXT NOT NULL,
+    granted_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    revoked_by  TEXT,
+    revoked_at  TIMESTAMP WITH TIME ZONE
+);
+CREATE UNIQUE INDEX unique_active_file_grant ON file_access_grants(user_id, file_id) WHERE revoked_at IS NULL;
+
+CREATE INDEX files_project_idx ON files(project);
+
+-- Admins scoped to a project, they can only act on files and datasets
+-- belonging to the project
+CREATE TABLE project_admins (
+    project     TEXT NOT NULL,
+    user_id     TEXT NOT NULL,
+    added_by    TEXT NOT NULL,
+    added_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    PRIMARY KEY (project, user_id)
+);
+
+-- Uploads made in the same session, e.g. one run of an upload client, so
+-- that a submission can be followed from upload to dataset
+CREATE TABLE upload_sessions (
+    id            TEXT PRIMARY KEY,
+    user_id       TEXT NOT NULL,
+    started_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    last_activity TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+ALTER TABLE files ADD COLUMN session_id TEXT REFERENCES upload_sessions(id);
+CREATE INDEX files_session_idx ON files(session_id);
+
+-- Trigram indexes so that files can be searched by partial user and path
+CREATE EXTENSION pg_trgm WITH SCHEMA sda;
+CREATE INDEX files_submission_user_trgm ON files USING gin (submission_user gin_trgm_ops);
+CREATE INDEX files_submission_file_path_trgm ON files USING gin (submission_file_path gin_trgm_ops);
+
+-- Numbers for dataset IDs minted by the api
+CREATE SEQUENCE dataset_stable_id_seq;
+
+-- Copies of archived files kept by external long-term preservation
+-- services, e.g. a national tape store, one per file and service
+CREATE TABLE replicas (
+    id              SERIAL PRIMARY KEY,
+    file_id         UUID REFERENCES files(id) NOT NULL,
+    service         TEXT NOT NULL,
+    location        TEXT NOT NULL,
+    checksum        TEXT,
+    checksum_type   checksum_algorithm,
+    registered_by   TEXT NOT NULL,
+    registered_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    UNIQUE (file_id, service)
+);
+
+-- Files that a submitter is expected to upload, registered ahead of the
+-- upload by a submission portal to follow the completeness of a submission
+CREATE TABLE expected_files (
+    id                    SERIAL PRIMARY KEY,
+    submission_user       TEXT NOT NULL,
+    submission_file_path  TEXT NOT NULL,
+    file_size             BIGINT,
+    checksum              TEXT,
+    checksum_type         checksum_algorithm,
+    registered_by         TEXT NOT NULL,
+    registered_at         TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    reminded_at           TIMESTAMP WITH TIME ZONE,
+    UNIQUE (submission_user, submission_file_path)
+);
+
+-- Deletion requests made by submitters, reviewed by admins before the file
+-- is deleted
+CREATE TABLE deletion_requests (
+    id              SERIAL PRIMARY KEY,
+    file_id         UUID NOT NULL REFERENCES files(id),
+    submission_user TEXT NOT NULL,
+    reason          TEXT,
+    requested_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    status          TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    reviewed_by     TEXT,
+    reviewed_at     TIMESTAMP WITH TIME ZONE,
+    review_reason   TEXT
+);
+CREATE UNIQUE INDEX unique_pending_deletion ON deletion_requests(file_id) WHERE status = 'pending';
+
+-- Messages processed by the services, by queue, correlation ID and body, so
+-- that redelivered messages are not processed again
+CREATE TABLE processed_messages (
+    message_key  TEXT PRIMARY KEY,
+    processed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+CREATE INDEX processed_messages_processed_at_idx ON processed_messages(processed_at);
+
+-- Refresh tokens handed out by auth, by the SHA-256 hash of the token, so
+-- that clients can get new access tokens without logging in again
+CREATE TABLE refresh_tokens (
+    token_hash  TEXT PRIMARY KEY,
+    subject     TEXT NOT NULL,
+    claims      JSONB,
+    session_id  TEXT,
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    expires_at  TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX refresh_tokens_expires_at_idx ON refresh_tokens(expires_at);
+
+-- WebAuthn credentials (passkeys, security keys) that users log in with as
+-- a second factor, by the base64url encoded credential ID. The public key
+-- is a COSE key.
+CREATE TABLE webauthn_credentials (
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    public_key  BYTEA NOT NULL,
+    sign_count  BIGINT NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    last_used   TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials(user_id);
+
+-- S3 credentials that users manage themselves and upload to the inbox
+-- with. The secret key is needed to check the signatures of the requests,
+-- so it is stored as is.
+CREATE TABLE s3_credentials (
+    access_key  TEXT PRIMARY KEY,
+    secret_key  TEXT NOT NULL,
+    user_id     TEXT NOT NULL,
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+CREATE INDEX s3_credentials_user_id_idx ON s3_credentials(user_id);
+
+-- Logins to auth, that the access and refresh tokens handed out belong to
+-- until the session expires or is revoked by the user
+CREATE TABLE sessions (
+    id          TEXT PRIMARY KEY,
+    subject     TEXT NOT NULL,
+    user_agent  TEXT,
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    expires_at  TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX sessions_subject_idx ON sessions(subject);
+
+-- IDs of revoked tokens and sessions (the jti and sid claims), that the
+-- services refuse tokens with until the tokens have expired
+CREATE TABLE revoked_tokens (
+    token_id    TEXT PRIMARY KEY,
+    subject     TEXT NOT NULL,
+    revoked_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    expires_at  TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- TOTP (authenticator app) secrets of the users that log in with a
+-- password, the secret is needed to check the codes so it is stored as is.
+-- A secret is not used until the user has confirmed it with a code, and
+-- last_step keeps codes from being used twice.
+CREATE TABLE totp_secrets (
+    user_id       TEXT PRIMARY KEY,
+    secret        TEXT NOT NULL,
+    last_step     BIGINT NOT NULL DEFAULT 0,
+    created_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    confirmed_at  TIMESTAMP WITH TIME ZONE
+);
+
+-- One-time recovery codes for users that have lost their TOTP device, by
+-- the SHA-256 hash of the code
+CREATE TABLE totp_recovery_codes (
+    code_hash   TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL
+);
+CREATE INDEX totp_recovery_codes_user_id_idx ON totp_recovery_codes(user_id);
+
+-- Audit log of auth: the logins, second factors, token refreshes and
+-- revoked sessions, with who they were made by, from where and how they
+-- went. Entries older than the retention of auth are deleted.
+CREATE TABLE auth_events (
+    event        TEXT NOT NULL,
+    subject      TEXT,
+    provider     TEXT,
+    outcome      TEXT NOT NULL,
+    remote_addr  TEXT,
+    user_agent   TEXT,
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+CREATE INDEX auth_events_subject_idx ON auth_events(subject, created_at);
+CREATE INDEX auth_events_created_at_idx ON auth_events(created_at);
@@ -44,22 +44,27 @@ BEGIN
 END;
 $register_file$ LANGUAGE plpgsql;
 
+-- Files are archived once they have been submitted
 CREATE FUNCTION set_archived(file_uuid UUID, corr_id UUID, file_path TEXT, file_size BIGINT, inbox_checksum_value TEXT, inbox_checksum_type TEXT)
 RETURNS void AS $set_archived$
 BEGIN
+    PERFORM sda.set_file_status(file_uuid, 'submitted', 'archived', corr_id, NULL, NULL, NULL);
+
     UPDATE sda.files SET archive_file_path = file_path, archive_file_size = file_size WHERE id = file_uuid;
 
     INSERT INTO sda.checksums(file_id, checksum, type, source)
     VALUES(file_uuid, inbox_checksum_value, upper(inbox_checksum_type)::sda.checksum_algorithm, upper('UPLOADED')::sda.checksum_source);
-
-    INSERT INTO sda.file_event_log(file_id, event, correlation_id) VALUES(file_uuid, 'archived', corr_id);
 END;
 
 $set_archived$ LANGUAGE plpgsql;
 
-CREATE FUNCTION set_verified(file_uuid UUID, corr_id UUID, archive_checksum TEXT, archive_checksum_type TEXT, decrypted_size BIGINT, decrypted_checksum TEXT, decrypted_checksum_type TEXT)
+-- The status a file is verified from is given by the caller, since the file
+-- may have been flagged as a duplicate or enabled again
+CREATE FUNCTION set_verified(file_uuid UUID, corr_id UUID, archive_checksum TEXT, archive_checksum_type TEXT, decrypted_size BIGINT, decrypted_checksum TEXT, decrypted_checksum_type TEXT, expected_status TEXT)
 RETURNS void AS $set_verified$
 BEGIN
+    PERFORM sda.set_file_status(file_uuid, expected_status, 'verified', corr_id, NULL, NULL, NULL);
+
     UPDATE sda.files SET decrypted_file_size = decrypted_size WHERE id = file_uuid;
 
     INSERT INTO sda.checksums(file_id, checksum, type, source)
@@ -67,8 +72,76 @@ BEGIN
 
     INSERT INTO sda.checksums(file_id, checksum, type, source)
     VALUES(file_uuid, decrypted_checksum, upper(decrypted_checksum_type)::sda.checksum_algorithm, upper('UNENCRYPTED')::sda.checksum_source);
+END;
 
-    INSERT INTO sda.file_event_log(file_id, event, correlation_id) VALUES(file_uuid, 'verified', corr_id);
+$set_verified$ LANGUAGE plpgsql;
+-- Announce new file and dataset events to the services listening on the
+-- sda_file_events and sda_dataset_events channels.
+CREATE FUNCTION notify_file_event()
+RETURNS TRIGGER AS $notify_file_event$
+BEGIN
+    PERFORM pg_notify('sda_file_events', json_build_object(
+        'id', NEW.id,
+        'fileID', NEW.file_id,
+        'event', NEW.event,
+        'correlationID', NEW.correlation_id,
+        'user', NEW.user_id,
+        'timestamp', NEW.started_at
+    )::text);
+    RETURN NULL;
 END;
+$notify_file_event$ LANGUAGE plpgsql;
 
-$set_verified$ LANGUAGE plpgsql;
\ No newline at end of file
+CREATE TRIGGER file_event_notify
+    AFTER INSERT ON sda.file_event_log
+    FOR EACH ROW
+    EXECUTE PROCEDURE notify_file_event();
+
+CREATE FUNCTION notify_dataset_event()
+RETURNS TRIGGER AS $notify_dataset_event$
+BEGIN
+    PERFORM pg_notify('sda_dataset_events', json_build_object(
+        'id', NEW.id,
+        'datasetID', NEW.dataset_id,
+        'event', NEW.event,
+        'timestamp', NEW.event_date
+    )::text);
+    RETURN NULL;
+END;
+$notify_dataset_event$ LANGUAGE plpgsql;
+
+CREATE TRIGGER dataset_event_notify
+    AFTER INSERT ON sda.dataset_event_log
+    FOR EACH ROW
+    EXECUTE PROCEDURE notify_dataset_event();
+
+-- Change the status of a file by logging the new event, unless the status
+-- is not the expected one or the transition is not allowed
+CREATE FUNCTION set_file_status(file_uuid UUID, expected_status TEXT, new_status TEXT, corr_id UUID, user_name TEXT, event_details JSONB, event_message JSONB)
+RETURNS void AS $set_file_status$
+DECLARE
+    current_status TEXT;
+BEGIN
+    -- the status of a file is changed by one caller at a time
+    PERFORM pg_advisory_xact_lock(hashtext(file_uuid::TEXT));
+    PERFORM 1 FROM sda.files WHERE id = file_uuid;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'file % not found', file_uuid USING ERRCODE = 'no_data_found';
+    END IF;
+
+    SELECT event INTO current_status FROM sda.file_event_log WHERE file_id = file_uuid ORDER BY id DESC LIMIT 1;
+    IF expected_status <> '' AND current_status IS DISTINCT FROM expected_status THEN
+        RAISE EXCEPTION 'file % is %, not %', file_uuid, current_status, expected_status
+            USING ERRCODE = 'SD001', DETAIL = COALESCE(current_status, '');
+    END IF;
+    IF current_status IS NOT NULL AND NOT EXISTS (
+        SELECT 1 FROM sda.file_event_transitions WHERE from_event = current_status AND to_event = new_status
+    ) THEN
+        RAISE EXCEPTION 'file % can not go from % to %', file_uuid, current_status, new_status
+            USING ERRCODE = 'SD002', DETAIL = current_status;
+    END IF;
+
+    INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id, details, message)
+    VALUES(file_uuid, new_status, corr_id, user_name, event_details, event_message);
+END;
+$set_file_status$ LANGUAGE plpgsql;
@@ -22,7 +22,12 @@ CREATE ROLE inbox;
 GRANT USAGE ON SCHEMA sda TO inbox;
 GRANT SELECT, INSERT, UPDATE ON sda.files TO inbox;
 GRANT SELECT, INSERT ON sda.file_event_log TO inbox;
+GRANT SELECT ON sda.file_event_transitions TO inbox;
 GRANT USAGE, SELECT ON SEQUENCE sda.file_event_log_id_seq TO inbox;
+GRANT SELECT ON sda.submission_freeze TO inbox;
+GRANT SELECT ON sda.userinfo TO inbox;
+GRANT SELECT, INSERT, UPDATE ON sda.upload_sessions TO inbox;
+GRANT SELECT ON sda.s3_credentials TO inbox;
 
 -- legacy schema
 GRANT USAGE ON SCHEMA local_ega TO inbox;
@@ -35,6 +40,7 @@ GRANT USAGE ON SCHEMA sda TO ingest;
 GRANT INSERT ON sda.files TO ingest;
 GRANT SELECT ON sda.files TO ingest;
 GRANT UPDATE ON sda.files TO ingest;
+GRANT SELECT ON sda.userinfo TO ingest;
 GRANT INSERT ON sda.checksums TO ingest;
 GRANT UPDATE ON sda.checksums TO ingest;
 GRANT SELECT ON sda.checksums TO ingest;
@@ -42,6 +48,7 @@ GRANT INSERT ON sda.file_events TO ingest;
 GRANT USAGE, SELECT ON SEQUENCE sda.checksums_id_seq TO ingest;
 GRANT INSERT ON sda.file_event_log TO ingest;
 GRANT SELECT ON sda.file_event_log TO ingest;
+GRANT SELECT ON sda.file_event_transitions TO ingest;
 GRANT USAGE, SELECT ON SEQUENCE sda.file_event_log_id_seq TO ingest;
 GRANT SELECT ON sda.encryption_keys TO ingest;
 
@@ -66,6 +73,7 @@ GRANT INSERT ON sda.checksums TO verify;
 GRANT USAGE, SELECT ON SEQUENCE sda.checksums_id_seq TO verify;
 GRANT INSERT ON sda.file_event_log TO verify;
 GRANT SELECT ON sda.file_event_log TO verify;
+GRANT SELECT ON sda.file_event_transitions TO verify;
 GRANT USAGE, SELECT ON SEQUENCE sda.file_event_log_id_seq TO verify;
 
 -- legacy schema
@@ -88,6 +96,8 @@ GRANT SELECT ON sda.files TO finalize;
 GRANT SELECT ON sda.checksums TO finalize;
 GRANT INSERT ON sda.file_event_log TO finalize;
 GRANT SELECT ON sda.file_event_log TO finalize;
+GRANT SELECT ON sda.file_event_transitions TO finalize;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.processed_messages TO finalize;
 GRANT USAGE, SELECT ON SEQUENCE sda.file_event_log_id_seq TO finalize;
 
 -- legacy schema
@@ -109,11 +119,12 @@ GRANT SELECT ON sda.datasets TO mapper;
 GRANT USAGE, SELECT ON SEQUENCE sda.datasets_id_seq TO mapper;
 GRANT SELECT ON sda.files TO mapper;
 GRANT INSERT ON sda.file_event_log TO mapper;
-GRANT INSERT ON sda.file_dataset TO mapper;
+GRANT SELECT, INSERT, UPDATE ON sda.file_dataset TO mapper;
 GRANT INSERT ON sda.dataset_event_log TO mapper;
 GRANT USAGE, SELECT ON SEQUENCE sda.file_dataset_id_seq TO mapper;
 GRANT USAGE, SELECT ON SEQUENCE sda.file_event_log_id_seq TO mapper;
 GRANT USAGE, SELECT ON SEQUENCE sda.dataset_event_log_id_seq TO mapper;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.processed_messages TO mapper;
 
 -- legacy schema
 GRANT USAGE ON SCHEMA local_ega TO mapper;
@@ -149,6 +160,7 @@ GRANT SELECT ON sda.checksums TO download;
 GRANT SELECT ON sda.datasets TO download;
 GRANT SELECT ON sda.file_event_log TO download;
 GRANT SELECT ON sda.dataset_event_log TO download;
+GRANT SELECT ON sda.file_access_grants TO download;
 
 -- legacy schema
 GRANT USAGE ON SCHEMA local_ega TO download;
@@ -163,15 +175,40 @@ CREATE ROLE api;
 
 GRANT USAGE ON SCHEMA sda TO api;
 GRANT SELECT ON sda.files TO api;
+GRANT UPDATE (deleted_at) ON sda.files TO api;
+GRANT UPDATE (metadata) ON sda.files TO api;
 GRANT SELECT ON sda.file_dataset TO api;
 GRANT SELECT ON sda.checksums TO api;
 GRANT SELECT, INSERT ON sda.file_event_log TO api;
+GRANT SELECT ON sda.file_event_transitions TO api;
 GRANT SELECT ON sda.encryption_keys TO api;
 GRANT SELECT ON sda.datasets TO api;
+GRANT UPDATE (metadata) ON sda.datasets TO api;
 GRANT SELECT ON sda.dataset_event_log TO api;
 GRANT INSERT ON sda.encryption_keys TO api;
 GRANT UPDATE ON sda.encryption_keys TO api;
 GRANT USAGE, SELECT ON SEQUENCE sda.file_event_log_id_seq TO api;
+GRANT SELECT, INSERT, UPDATE ON sda.submission_freeze TO api;
+GRANT USAGE, SELECT ON SEQUENCE sda.submission_freeze_id_seq TO api;
+GRANT SELECT ON sda.userinfo TO api;
+GRANT SELECT, INSERT, UPDATE ON sda.user_quota TO api;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.user_usage TO api;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.file_stats TO api;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.dataset_stats TO api;
+GRANT SELECT, INSERT, UPDATE ON sda.file_access_grants TO api;
+GRANT USAGE, SELECT ON SEQUENCE sda.file_access_grants_id_seq TO api;
+GRANT SELECT, INSERT, DELETE ON sda.project_admins TO api;
+GRANT SELECT ON sda.upload_sessions TO api;
+GRANT USAGE, SELECT ON SEQUENCE sda.dataset_stable_id_seq TO api;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.replicas TO api;
+GRANT USAGE, SELECT ON SEQUENCE sda.replicas_id_seq TO api;
+GRANT UPDATE (correlation_id) ON sda.file_event_log TO api;
+GRANT DELETE ON sda.file_event_log TO api;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.expected_files TO api;
+GRANT USAGE, SELECT ON SEQUENCE sda.expected_files_id_seq TO api;
+GRANT SELECT, INSERT, UPDATE ON sda.deletion_requests TO api;
+GRANT USAGE, SELECT ON SEQUENCE sda.deletion_requests_id_seq TO api;
+GRANT SELECT ON sda.revoked_tokens TO api;
 
 -- legacy schema
 GRANT USAGE ON SCHEMA local_ega TO api;
@@ -184,6 +221,14 @@ GRANT SELECT ON local_ega_ebi.file_dataset TO api;
 CREATE ROLE auth;
 GRANT USAGE ON SCHEMA sda TO auth;
 GRANT SELECT, INSERT, UPDATE ON sda.userinfo TO auth;
+GRANT SELECT, INSERT, DELETE ON sda.refresh_tokens TO auth;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.webauthn_credentials TO auth;
+GRANT SELECT, INSERT, DELETE ON sda.s3_credentials TO auth;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.sessions TO auth;
+GRANT SELECT, INSERT, DELETE ON sda.revoked_tokens TO auth;
+GRANT SELECT, INSERT, UPDATE, DELETE ON sda.totp_secrets TO auth;
+GRANT SELECT, INSERT, DELETE ON sda.totp_recovery_codes TO auth;
+GRANT SELECT, INSERT, DELETE ON sda.auth_events TO auth;
 --------------------------------------------------------------------------------
 
 -- lega_in permissions
@@ -0,0 +1,37 @@
+
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 16;
+  changes VARCHAR := 'Add submission freeze table';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.submission_freeze (
+        id          SERIAL PRIMARY KEY,
+        scope       TEXT NOT NULL CHECK (scope IN ('user', 'project')),
+        name        TEXT NOT NULL,
+        reason      TEXT,
+        frozen_by   TEXT NOT NULL,
+        frozen_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        lifted_by   TEXT,
+        lifted_at   TIMESTAMP WITH TIME ZONE
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS unique_active_freeze ON sda.submission_freeze(scope, name) WHERE lifted_at IS NULL;
+
+    GRANT SELECT, INSERT, UPDATE ON sda.submission_freeze TO api;
+    GRANT USAGE, SELECT ON SEQUENCE sda.submission_freeze_id_seq TO api;
+    GRANT SELECT ON sda.userinfo TO api;
+    GRANT SELECT ON sda.submission_freeze TO inbox;
+    GRANT SELECT ON sda.userinfo TO inbox;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,28 @@
+
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 17;
+  changes VARCHAR := 'Add user quota table';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.user_quota (
+        user_id       TEXT PRIMARY KEY,
+        quota_bytes   BIGINT NOT NULL CHECK (quota_bytes >= 0),
+        set_by        TEXT NOT NULL,
+        last_modified TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+    );
+
+    GRANT SELECT, INSERT, UPDATE ON sda.user_quota TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,34 @@
+
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 18;
+  changes VARCHAR := 'Add file access grants table';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.file_access_grants (
+        id          SERIAL PRIMARY KEY,
+        user_id     TEXT NOT NULL,
+        file_id     UUID REFERENCES sda.files(id) NOT NULL,
+        granted_by  TEXT NOT NULL,
+        granted_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        revoked_by  TEXT,
+        revoked_at  TIMESTAMP WITH TIME ZONE
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS unique_active_file_grant ON sda.file_access_grants(user_id, file_id) WHERE revoked_at IS NULL;
+
+    GRANT SELECT, INSERT, UPDATE ON sda.file_access_grants TO api;
+    GRANT USAGE, SELECT ON SEQUENCE sda.file_access_grants_id_seq TO api;
+    GRANT SELECT ON sda.file_access_grants TO download;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
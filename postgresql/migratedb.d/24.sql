@@ -0,0 +1,33 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 23;
+  changes VARCHAR := 'Add external archive replicas table';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.replicas (
+        id              SERIAL PRIMARY KEY,
+        file_id         UUID REFERENCES sda.files(id) NOT NULL,
+        service         TEXT NOT NULL,
+        location        TEXT NOT NULL,
+        checksum        TEXT,
+        checksum_type   sda.checksum_algorithm,
+        registered_by   TEXT NOT NULL,
+        registered_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        UNIQUE (file_id, service)
+    );
+
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.replicas TO api;
+    GRANT USAGE, SELECT ON SEQUENCE sda.replicas_id_seq TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
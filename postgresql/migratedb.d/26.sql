@@ -0,0 +1,58 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 25;
+  changes VARCHAR := 'Notify listeners of new file and dataset events';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE OR REPLACE FUNCTION sda.notify_file_event()
+    RETURNS TRIGGER AS $notify_file_event$
+    BEGIN
+        PERFORM pg_notify('sda_file_events', json_build_object(
+            'id', NEW.id,
+            'fileID', NEW.file_id,
+            'event', NEW.event,
+            'correlationID', NEW.correlation_id,
+            'user', NEW.user_id,
+            'timestamp', NEW.started_at
+        )::text);
+        RETURN NULL;
+    END;
+    $notify_file_event$ LANGUAGE plpgsql;
+
+    DROP TRIGGER IF EXISTS file_event_notify ON sda.file_event_log;
+    CREATE TRIGGER file_event_notify
+        AFTER INSERT ON sda.file_event_log
+        FOR EACH ROW
+        EXECUTE PROCEDURE sda.notify_file_event();
+
+    CREATE OR REPLACE FUNCTION sda.notify_dataset_event()
+    RETURNS TRIGGER AS $notify_dataset_event$
+    BEGIN
+        PERFORM pg_notify('sda_dataset_events', json_build_object(
+            'id', NEW.id,
+            'datasetID', NEW.dataset_id,
+            'event', NEW.event,
+            'timestamp', NEW.event_date
+        )::text);
+        RETURN NULL;
+    END;
+    $notify_dataset_event$ LANGUAGE plpgsql;
+
+    DROP TRIGGER IF EXISTS dataset_event_notify ON sda.dataset_event_log;
+    CREATE TRIGGER dataset_event_notify
+        AFTER INSERT ON sda.dataset_event_log
+        FOR EACH ROW
+        EXECUTE PROCEDURE sda.notify_dataset_event();
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,34 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 29;
+  changes VARCHAR := 'Add deletion requests';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.deletion_requests (
+        id              SERIAL PRIMARY KEY,
+        file_id         UUID NOT NULL REFERENCES sda.files(id),
+        submission_user TEXT NOT NULL,
+        reason          TEXT,
+        requested_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        status          TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+        reviewed_by     TEXT,
+        reviewed_at     TIMESTAMP WITH TIME ZONE,
+        review_reason   TEXT
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS unique_pending_deletion ON sda.deletion_requests(file_id) WHERE status = 'pending';
+
+    GRANT SELECT, INSERT, UPDATE ON sda.deletion_requests TO api;
+    GRANT USAGE, SELECT ON SEQUENCE sda.deletion_requests_id_seq TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
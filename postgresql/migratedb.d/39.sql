@@ -0,0 +1,27 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 38;
+  changes VARCHAR := 'Add processed messages';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.processed_messages (
+        message_key  TEXT PRIMARY KEY,
+        processed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+    );
+    CREATE INDEX IF NOT EXISTS processed_messages_processed_at_idx ON sda.processed_messages(processed_at);
+
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.processed_messages TO finalize;
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.processed_messages TO mapper;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
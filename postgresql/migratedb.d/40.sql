@@ -0,0 +1,28 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 39;
+  changes VARCHAR := 'Add refresh tokens';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.refresh_tokens (
+        token_hash  TEXT PRIMARY KEY,
+        subject     TEXT NOT NULL,
+        created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        expires_at  TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS refresh_tokens_expires_at_idx ON sda.refresh_tokens(expires_at);
+
+    GRANT SELECT, INSERT, DELETE ON sda.refresh_tokens TO auth;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
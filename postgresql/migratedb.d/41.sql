@@ -0,0 +1,22 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 40;
+  changes VARCHAR := 'Add claims of refresh tokens';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    -- the claims of the user, e.g. the groups, that the access tokens
+    -- handed out for a refresh token get
+    ALTER TABLE sda.refresh_tokens ADD COLUMN IF NOT EXISTS claims JSONB;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,30 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 41;
+  changes VARCHAR := 'Add WebAuthn credentials';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.webauthn_credentials (
+        id          TEXT PRIMARY KEY,
+        user_id     TEXT NOT NULL,
+        public_key  BYTEA NOT NULL,
+        sign_count  BIGINT NOT NULL DEFAULT 0,
+        created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        last_used   TIMESTAMP WITH TIME ZONE
+    );
+    CREATE INDEX IF NOT EXISTS webauthn_credentials_user_id_idx ON sda.webauthn_credentials(user_id);
+
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.webauthn_credentials TO auth;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
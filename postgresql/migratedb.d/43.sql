@@ -0,0 +1,29 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 42;
+  changes VARCHAR := 'Add S3 credentials of the inbox';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.s3_credentials (
+        access_key  TEXT PRIMARY KEY,
+        secret_key  TEXT NOT NULL,
+        user_id     TEXT NOT NULL,
+        created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+    );
+    CREATE INDEX IF NOT EXISTS s3_credentials_user_id_idx ON sda.s3_credentials(user_id);
+
+    GRANT SELECT, INSERT, DELETE ON sda.s3_credentials TO auth;
+    GRANT SELECT ON sda.s3_credentials TO inbox;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,35 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 44;
+  changes VARCHAR := 'Add TOTP second factor';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.totp_secrets (
+        user_id       TEXT PRIMARY KEY,
+        secret        TEXT NOT NULL,
+        last_step     BIGINT NOT NULL DEFAULT 0,
+        created_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        confirmed_at  TIMESTAMP WITH TIME ZONE
+    );
+
+    CREATE TABLE IF NOT EXISTS sda.totp_recovery_codes (
+        code_hash   TEXT PRIMARY KEY,
+        user_id     TEXT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS totp_recovery_codes_user_id_idx ON sda.totp_recovery_codes(user_id);
+
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.totp_secrets TO auth;
+    GRANT SELECT, INSERT, DELETE ON sda.totp_recovery_codes TO auth;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,51 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 46;
+  changes VARCHAR := 'Check the status transitions of archived and verified files';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    -- files are archived once they have been submitted
+    CREATE OR REPLACE FUNCTION sda.set_archived(file_uuid UUID, corr_id UUID, file_path TEXT, file_size BIGINT, inbox_checksum_value TEXT, inbox_checksum_type TEXT)
+    RETURNS void AS $set_archived$
+    BEGIN
+        PERFORM sda.set_file_status(file_uuid, 'submitted', 'archived', corr_id, NULL, NULL, NULL);
+
+        UPDATE sda.files SET archive_file_path = file_path, archive_file_size = file_size WHERE id = file_uuid;
+
+        INSERT INTO sda.checksums(file_id, checksum, type, source)
+        VALUES(file_uuid, inbox_checksum_value, upper(inbox_checksum_type)::sda.checksum_algorithm, upper('UPLOADED')::sda.checksum_source);
+    END;
+
+    $set_archived$ LANGUAGE plpgsql;
+
+    -- the status a file is verified from is given by the caller, since the
+    -- file may have been flagged as a duplicate or enabled again
+    DROP FUNCTION IF EXISTS sda.set_verified(UUID, UUID, TEXT, TEXT, BIGINT, TEXT, TEXT);
+    CREATE FUNCTION sda.set_verified(file_uuid UUID, corr_id UUID, archive_checksum TEXT, archive_checksum_type TEXT, decrypted_size BIGINT, decrypted_checksum TEXT, decrypted_checksum_type TEXT, expected_status TEXT)
+    RETURNS void AS $set_verified$
+    BEGIN
+        PERFORM sda.set_file_status(file_uuid, expected_status, 'verified', corr_id, NULL, NULL, NULL);
+
+        UPDATE sda.files SET decrypted_file_size = decrypted_size WHERE id = file_uuid;
+
+        INSERT INTO sda.checksums(file_id, checksum, type, source)
+        VALUES(file_uuid, archive_checksum, upper(archive_checksum_type)::sda.checksum_algorithm, upper('ARCHIVED')::sda.checksum_source);
+
+        INSERT INTO sda.checksums(file_id, checksum, type, source)
+        VALUES(file_uuid, decrypted_checksum, upper(decrypted_checksum_type)::sda.checksum_algorithm, upper('UNENCRYPTED')::sda.checksum_source);
+    END;
+
+    $set_verified$ LANGUAGE plpgsql;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
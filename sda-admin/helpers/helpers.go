@@ -5,10 +5,20 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// MaxRetries is how many times a request is resent when the server responds
+// with a Retry-After header
+var MaxRetries = 3
+
+// MaxRetryAfter caps the time to wait before resending a request
+var MaxRetryAfter = 5 * time.Minute
+
 // necessary for mocking in unit tests
 var GetResponseBody = GetBody
 
@@ -23,26 +33,7 @@ func GetBody(url, token string) ([]byte, error) {
 	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Add("Content-Type", "application/json")
 
-	// Send the request
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get response, reason: %v", err)
-	}
-	defer res.Body.Close()
-
-	// Read the response body
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body, reason: %v", err)
-	}
-
-	// Check the status code
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d: %s", res.StatusCode, string(resBody))
-	}
-
-	return resBody, nil
+	return sendRequest(req)
 }
 
 // necessary for mocking in unit tests
@@ -60,26 +51,7 @@ func PostReq(url, token string, jsonBody []byte) ([]byte, error) {
 	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Add("Content-Type", "application/json")
 
-	// Send the request
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request, reason: %v", err)
-	}
-	defer res.Body.Close()
-
-	// Read the response body
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body, reason: %v", err)
-	}
-
-	// Check the status code
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d: %s", res.StatusCode, string(resBody))
-	}
-
-	return resBody, nil
+	return sendRequest(req)
 }
 
 // Check for invalid characters for filepath
@@ -109,24 +81,77 @@ func GetReq(url, token string, jsonBody []byte) ([]byte, error) {
 	// Add headers
 	req.Header.Add("Authorization", "Bearer "+token)
 
-	// Send the request
+	return sendRequest(req)
+}
+
+// sendRequest sends the request and returns the response body. Idempotent
+// requests rejected with a Retry-After header are resent after the requested
+// delay, at most MaxRetries times. Other requests, such as ingesting a file or
+// creating a dataset, are never resent since the server may have acted on
+// them already.
+func sendRequest(req *http.Request) ([]byte, error) {
 	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request, reason: %v", err)
+	for attempt := 0; ; attempt++ {
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request, reason: %v", err)
+		}
+
+		// Read the response body
+		resBody, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body, reason: %v", err)
+		}
+
+		if res.StatusCode == http.StatusOK {
+			return resBody, nil
+		}
+
+		delay, ok := retryAfter(res.Header.Get("Retry-After"))
+		if !ok || !idempotent(req.Method) || attempt >= MaxRetries {
+			return nil, fmt.Errorf("server returned status %d: %s", res.StatusCode, string(resBody))
+		}
+
+		// The request body has been consumed, get a fresh copy before resending
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to create the request, reason: %v", err)
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "server returned status %d, retrying in %s\n", res.StatusCode, delay)
+		time.Sleep(delay)
 	}
-	defer res.Body.Close()
+}
 
-	// Read the response body
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body, reason: %v", err)
+// idempotent reports whether requests with the method can safely be sent
+// more than once
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter parses the value of a Retry-After header, given either as
+// seconds or as an HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
 	}
 
-	// Check the status code
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d: %s", res.StatusCode, string(resBody))
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
 	}
 
-	return resBody, nil
+	return min(max(delay, 0), MaxRetryAfter), true
 }
@@ -2,9 +2,11 @@ package helpers
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -66,6 +68,93 @@ func TestPostReq(t *testing.T) {
 	assert.Nil(t, body)
 }
 
+func TestGetBody_RetryAfter(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		attempts++
+		if attempts < 3 {
+			rw.Header().Set("Retry-After", "0")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		_, _ = rw.Write([]byte(`{"key": "value"}`))
+	}))
+	defer server.Close()
+
+	body, err := GetBody(server.URL, "mock_token")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"key": "value"}`, string(body))
+	assert.Equal(t, 3, attempts)
+
+	// Give up after MaxRetries
+	attempts = 0
+	MaxRetries = 1
+	defer func() { MaxRetries = 3 }()
+	_, err = GetBody(server.URL, "mock_token")
+	assert.ErrorContains(t, err, "server returned status 503")
+	assert.Equal(t, 2, attempts)
+}
+
+func TestGetReq_RetryAfter(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		assert.JSONEq(t, `{"name":"test"}`, string(body))
+
+		attempts++
+		if attempts < 2 {
+			rw.Header().Set("Retry-After", "0")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		_, _ = rw.Write([]byte(`{"key": "value"}`))
+	}))
+	defer server.Close()
+
+	body, err := GetReq(server.URL, "mock_token", []byte(`{"name":"test"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"key": "value"}`, string(body))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestPostReq_NoRetry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		attempts++
+		rw.Header().Set("Retry-After", "0")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// The server may have acted on the request, so it is not resent
+	_, err := PostReq(server.URL, "mock_token", []byte(`{"name":"test"}`))
+	assert.ErrorContains(t, err, "server returned status 503")
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryAfter(t *testing.T) {
+	delay, ok := retryAfter("")
+	assert.False(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+
+	delay, ok = retryAfter("30")
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, delay)
+
+	delay, ok = retryAfter("100000")
+	assert.True(t, ok)
+	assert.Equal(t, MaxRetryAfter, delay)
+
+	delay, ok = retryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+
+	_, ok = retryAfter("soon")
+	assert.False(t, ok)
+}
+
 func TestInvalidCharacters(t *testing.T) {
 	// Test that file paths with invalid characters trigger errors
 	for _, badc := range "\x00\x7F\x1A:*?\\<>\"|!'();@&=+$,%#[]" {
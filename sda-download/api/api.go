@@ -40,8 +40,13 @@ func Setup() *http.Server {
 
 	router.HandleMethodNotAllowed = true
 
+	dbBreaker = newCircuitBreaker("database", config.Config.App.BreakerThreshold, config.Config.App.BreakerCooldown)
+	archiveBreaker = newCircuitBreaker("archive", config.Config.App.BreakerThreshold, config.Config.App.BreakerCooldown)
+	router.Use(requestTimeout, dependencyGuard)
+
 	router.GET("/metadata/datasets", SelectedMiddleware(), sda.Datasets)
 	router.GET("/metadata/datasets/*dataset", SelectedMiddleware(), sda.Files)
+	router.POST("/metadata/datasets/*dataset", SelectedMiddleware(), sda.SelectFiles)
 	router.GET("/files/:fileid", SelectedMiddleware(), sda.Download)
 	router.GET("/s3/*path", SelectedMiddleware(), s3.Download)
 	router.HEAD("/s3/*path", SelectedMiddleware(), s3.Download)
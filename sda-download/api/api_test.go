@@ -1,9 +1,14 @@
 package api
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSetup(t *testing.T) {
@@ -19,3 +24,52 @@ func TestSetup(t *testing.T) {
 		t.Errorf("server address was not correctly formed, expected=%s, received=%s", expectedAddress, server.Addr)
 	}
 }
+
+func TestDependencyGuard(t *testing.T) {
+	dbBreaker = newCircuitBreaker("database", 1, time.Minute)
+	archiveBreaker = newCircuitBreaker("archive", 1, time.Minute)
+	defer func() { dbBreaker, archiveBreaker = nil, nil }()
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(requestTimeout, dependencyGuard)
+	router.GET("/files/:fileid", func(c *gin.Context) { c.String(http.StatusInternalServerError, "archive error") })
+	router.GET("/metadata/datasets", func(c *gin.Context) { c.JSON(http.StatusOK, []string{}) })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/file-id", http.NoBody))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// both breakers of the download route are now open
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/file-id", http.NoBody))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metadata/datasets", http.NoBody))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "database is unavailable", w.Body.String())
+
+	// a successful trial request closes the breaker
+	dbBreaker.openUntil = time.Now()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metadata/datasets", http.NoBody))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, dbBreaker.allow())
+}
+
+func TestRequestTimeout(t *testing.T) {
+	config.Config.App.EndpointTimeouts = map[string]time.Duration{"/metadata/datasets": 10 * time.Millisecond}
+	defer func() { config.Config.App.EndpointTimeouts = nil }()
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(requestTimeout)
+	router.GET("/metadata/datasets", func(c *gin.Context) { <-c.Request.Context().Done() })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metadata/datasets", http.NoBody))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "request timed out", w.Body.String())
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// circuitBreaker stops requests to a degraded dependency after a number of
+// consecutive failures. Once the cooldown has passed a single trial request
+// is let through, and the breaker closes again if it succeeds.
+type circuitBreaker struct {
+	sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+var (
+	dbBreaker      *circuitBreaker
+	archiveBreaker *circuitBreaker
+)
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may use the dependency
+func (b *circuitBreaker) allow() bool {
+	if b == nil || b.threshold <= 0 {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+	// Let one trial request through per cooldown period
+	b.openUntil = time.Now().Add(b.cooldown)
+
+	return true
+}
+
+// record feeds the outcome of a request to the breaker, server errors and
+// timeouts count as failures while client errors are ignored.
+func (b *circuitBreaker) record(status int, timedOut bool) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	switch {
+	case timedOut || status >= http.StatusInternalServerError:
+		b.failures++
+		if b.failures == b.threshold {
+			log.Warnf("circuit breaker for %s opened after %d failed requests", b.name, b.failures)
+		}
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	case status < http.StatusBadRequest:
+		if b.failures >= b.threshold {
+			log.Infof("circuit breaker for %s closed", b.name)
+		}
+		b.failures = 0
+	}
+}
+
+// routeBreakers returns the breakers for the dependencies used by a route
+func routeBreakers(path string) []*circuitBreaker {
+	switch {
+	case path == "", path == "/health", path == "/":
+		return nil
+	case strings.HasPrefix(path, "/metadata/"):
+		return []*circuitBreaker{dbBreaker}
+	default:
+		return []*circuitBreaker{dbBreaker, archiveBreaker}
+	}
+}
+
+// dependencyGuard fails fast when a dependency of the route is degraded,
+// and feeds the outcome of the request back to the circuit breakers.
+func dependencyGuard(c *gin.Context) {
+	breakers := routeBreakers(c.FullPath())
+	for _, b := range breakers {
+		if !b.allow() {
+			c.Header("Retry-After", strconv.Itoa(int(b.cooldown.Seconds())))
+			c.String(http.StatusServiceUnavailable, b.name+" is unavailable")
+			c.Abort()
+
+			return
+		}
+	}
+
+	c.Next()
+
+	timedOut := errors.Is(c.Request.Context().Err(), context.DeadlineExceeded)
+	for _, b := range breakers {
+		b.record(c.Writer.Status(), timedOut)
+	}
+}
+
+// requestTimeout sets a deadline on the request context, taken from the
+// endpoint specific timeouts or the default request timeout.
+func requestTimeout(c *gin.Context) {
+	timeout := config.Config.App.RequestTimeout
+	if t, ok := config.Config.App.EndpointTimeouts[c.FullPath()]; ok {
+		timeout = t
+	}
+	if timeout <= 0 {
+		c.Next()
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+		c.String(http.StatusServiceUnavailable, "request timed out")
+		c.Abort()
+	}
+}
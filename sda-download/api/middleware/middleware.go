@@ -62,6 +62,7 @@ func TokenMiddleware() gin.HandlerFunc {
 			// 404 dataset not found, when listing files from a dataset
 			// 401 unauthorised, when downloading a file
 			cache.Datasets = auth.GetPermissions(*visas)
+			cache.User = visas.Subject
 
 			// Start a new session and store datasets under the session key
 			key := session.NewSessionKey()
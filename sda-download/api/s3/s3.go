@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -77,10 +78,32 @@ func GetBucketLocation(c *gin.Context) {
 	})
 }
 
+// accessibleDatasets returns the datasets the user has access to, either to
+// the whole dataset or to some of its files through file grants
+func accessibleDatasets(c *gin.Context) ([]string, error) {
+	cache := middleware.GetCacheFromContext(c)
+	if cache.User == "" {
+		return cache.Datasets, nil
+	}
+
+	granted, err := database.GetGrantedDatasets(cache.User)
+	if err != nil {
+		return nil, err
+	}
+	datasets := append([]string{}, cache.Datasets...)
+	for _, dataset := range granted {
+		if !slices.Contains(datasets, dataset) {
+			datasets = append(datasets, dataset)
+		}
+	}
+
+	return datasets, nil
+}
+
 // ListBuckets respondes to an S3 ListBuckets request. This request returns the
 // available S3 buckets. We use this to list accessible datasets.
 // https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListBuckets.html
-func ListBuckets(c *gin.Context) {
+func ListBuckets(c *gin.Context, datasets []string) {
 	log.Debug("S3 ListBuckets request")
 
 	// Gin doesn't write the xml header when using c.XML, so we add it manually
@@ -93,8 +116,7 @@ func ListBuckets(c *gin.Context) {
 	}
 
 	buckets := []Bucket{}
-	cache := middleware.GetCacheFromContext(c)
-	for _, dataset := range cache.Datasets {
+	for _, dataset := range datasets {
 		datasetInfo, err := database.GetDatasetInfo(dataset)
 		if err != nil {
 			log.Errorf("Failed to get dataset information: %v", err)
@@ -121,17 +143,11 @@ func ListObjects(c *gin.Context) {
 
 	dataset := c.Param("dataset")
 
-	allowed := false
-	cache := middleware.GetCacheFromContext(c)
-	for _, known := range cache.Datasets {
-		if dataset == known {
-			allowed = true
-
-			break
-		}
-	}
-	if !allowed {
-		c.AbortWithStatus(http.StatusNotFound)
+	// Only the granted files are listed from datasets the user has not been
+	// given access to as a whole
+	permitted, code, err := sda.PermittedFiles(dataset, c)
+	if err != nil {
+		c.AbortWithStatus(code)
 
 		return
 	}
@@ -147,6 +163,9 @@ func ListObjects(c *gin.Context) {
 	// We return the full upload path, as file key
 	objects := []Object{}
 	for _, file := range files {
+		if !permitted(file.FileID) {
+			continue
+		}
 		key := strings.TrimSuffix(file.FilePath, ".c4gh")
 		// The first part of the upload path is the user id, which should be
 		// removed
@@ -258,7 +277,7 @@ func GetEcnryptedObject(c *gin.Context) {
 // name and file path. This is non-trivial as the dataset name is often a url
 // which can include slashes, so finding the separation between filename and
 // dataset name is done by comparing to accessible datasets.
-func parseParams(c *gin.Context) *gin.Context {
+func parseParams(c *gin.Context, datasets []string) *gin.Context {
 
 	// When doing list requests from s3cmd, the tool will assume that the first
 	// slash delimits the bucket, and the rest is the prefix. We use this to
@@ -280,8 +299,7 @@ func parseParams(c *gin.Context) *gin.Context {
 		path = string(protocolPattern.ReplaceAll([]byte(path), []byte("$1/$2")))
 	}
 
-	cache := middleware.GetCacheFromContext(c)
-	for _, dataset := range cache.Datasets {
+	for _, dataset := range datasets {
 		// check that the path starts with the dataset name, but also that the
 		// path is only the dataset, or that the following character is a slash.
 		// This prevents wrong matches in cases like when one dataset name is a
@@ -312,8 +330,16 @@ func parseParams(c *gin.Context) *gin.Context {
 func Download(c *gin.Context) {
 	log.Debugf("S3 request: %v", c.Request)
 
+	datasets, err := accessibleDatasets(c)
+	if err != nil {
+		log.Errorf("Failed to get granted datasets: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+
+		return
+	}
+
 	// Parses the request path into a dataset and a filename
-	c = parseParams(c)
+	c = parseParams(c, datasets)
 
 	// Try to figure out what kind of request we're getting.
 	// S3 request types are described here:
@@ -327,7 +353,7 @@ func Download(c *gin.Context) {
 		ListObjects(c)
 
 	case c.Param("dataset") == "":
-		ListBuckets(c)
+		ListBuckets(c, datasets)
 
 	case c.Param("filename") != "":
 		if config.Config.C4GH.PublicKeyB64 == "" {
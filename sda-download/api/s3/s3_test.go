@@ -3,14 +3,18 @@ package s3
 import (
 	"database/sql"
 	"encoding/xml"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
 	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
 	"github.com/neicnordic/sda-download/internal/database"
 	"github.com/neicnordic/sda-download/internal/session"
 	"github.com/neicnordic/sda-download/pkg/auth"
@@ -116,6 +120,160 @@ func (suite *S3TestSuite) TestListBuckets() {
 	assert.Nilf(suite.T(), err, "there were unfulfilled expectations: %s", err)
 }
 
+func (suite *S3TestSuite) TestListBuckets_FileGrants() {
+
+	// Save original to-be-mocked functions
+	originalGetVisas := auth.GetVisas
+	originalGetGrantedDatasets := database.GetGrantedDatasets
+
+	// Substitute mock functions
+	auth.GetVisas = func(_ auth.OIDCDetails, _ string) (*auth.Visas, error) {
+		return &auth.Visas{Subject: "user1"}, nil
+	}
+	database.GetGrantedDatasets = func(_ string) ([]string, error) {
+		return []string{"dataset1", "dataset2"}, nil
+	}
+
+	// Datasets with granted files are listed once, after the permitted ones
+	query := `SELECT stable_id, created_at FROM sda.datasets WHERE stable_id = \$1`
+	for _, dataset := range []string{"dataset1", "dataset10", "https://url/dataset", "dataset2"} {
+		suite.Mock.ExpectQuery(query).WithArgs(dataset).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "created_at"}).AddRow(dataset, "nyss"))
+	}
+
+	w := httptest.NewRecorder()
+	_, router := gin.CreateTestContext(w)
+	router.GET("/*path", middleware.TokenMiddleware(), Download)
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	response := w.Result()
+	body, err := io.ReadAll(response.Body)
+	assert.Nil(suite.T(), err, "failed to parse body from location response")
+	defer response.Body.Close()
+
+	assert.Contains(suite.T(), string(body), "<Bucket><CreationDate>nyss</CreationDate><Name>dataset2</Name></Bucket>")
+
+	err = suite.Mock.ExpectationsWereMet()
+	assert.Nilf(suite.T(), err, "there were unfulfilled expectations: %s", err)
+
+	// Return mock functions to originals
+	auth.GetVisas = originalGetVisas
+	database.GetGrantedDatasets = originalGetGrantedDatasets
+}
+
+func (suite *S3TestSuite) TestListObjects_FileGrants() {
+
+	// Save original to-be-mocked functions
+	originalGetVisas := auth.GetVisas
+	originalGetGrantedDatasets := database.GetGrantedDatasets
+	originalGetFileGrants := database.GetFileGrants
+	originalGetFiles := database.GetFiles
+
+	// Substitute mock functions
+	auth.GetVisas = func(_ auth.OIDCDetails, _ string) (*auth.Visas, error) {
+		return &auth.Visas{Subject: "user1"}, nil
+	}
+	database.GetGrantedDatasets = func(_ string) ([]string, error) {
+		return []string{"dataset2"}, nil
+	}
+	database.GetFileGrants = func(_, _ string) ([]string, error) {
+		return []string{"file2"}, nil
+	}
+	database.GetFiles = func(_ string) ([]*database.FileInfo, error) {
+		return []*database.FileInfo{
+			{FileID: "file1", FilePath: "user1/dir/file1.txt.c4gh", DecryptedFileSize: 32},
+			{FileID: "file2", FilePath: "user1/dir/file2.txt.c4gh", DecryptedFileSize: 64},
+		}, nil
+	}
+
+	// Only the granted file is listed
+	w := httptest.NewRecorder()
+	_, router := gin.CreateTestContext(w)
+	router.GET("/*path", middleware.TokenMiddleware(), Download)
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/dataset2", nil))
+
+	response := w.Result()
+	body, err := io.ReadAll(response.Body)
+	assert.Nil(suite.T(), err, "failed to parse body from location response")
+	defer response.Body.Close()
+
+	expected := xml.Header +
+		"<ListBucketResult><CommonPrefixes></CommonPrefixes><Contents>" +
+		"<Key>dir/file2.txt</Key>" +
+		"<Owner></Owner>" +
+		"<Size>64</Size>" +
+		"</Contents>" +
+		"<Name>dataset2</Name>" +
+		"</ListBucketResult>"
+	assert.Equal(suite.T(), expected, string(body), "Wrong object list from S3")
+
+	// Return mock functions to originals
+	auth.GetVisas = originalGetVisas
+	database.GetGrantedDatasets = originalGetGrantedDatasets
+	database.GetFileGrants = originalGetFileGrants
+	database.GetFiles = originalGetFiles
+}
+
+func (suite *S3TestSuite) TestGetObject_FileGrants() {
+
+	// Save original to-be-mocked functions
+	originalGetVisas := auth.GetVisas
+	originalGetGrantedDatasets := database.GetGrantedDatasets
+	originalGetFileGrants := database.GetFileGrants
+	originalGetDatasetFileInfo := database.GetDatasetFileInfo
+	originalCheckFilePermission := database.CheckFilePermission
+	originalGetFile := database.GetFile
+	originalPublicKey := config.Config.C4GH.PublicKeyB64
+
+	// Substitute mock functions
+	config.Config.C4GH.PublicKeyB64 = ""
+	auth.GetVisas = func(_ auth.OIDCDetails, _ string) (*auth.Visas, error) {
+		return &auth.Visas{Subject: "user1"}, nil
+	}
+	database.GetGrantedDatasets = func(_ string) ([]string, error) {
+		return []string{"dataset2"}, nil
+	}
+	database.GetFileGrants = func(_, _ string) ([]string, error) {
+		return []string{"file2"}, nil
+	}
+	database.GetDatasetFileInfo = func(_, filePath string) (*database.FileInfo, error) {
+		return &database.FileInfo{FileID: strings.TrimSuffix(path.Base(filePath), ".txt.c4gh")}, nil
+	}
+	database.CheckFilePermission = func(_ string) (string, error) {
+		return "dataset2", nil
+	}
+	database.GetFile = func(_ string) (*database.FileDownload, error) {
+		return nil, errors.New("file download failed")
+	}
+
+	download := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		_, router := gin.CreateTestContext(w)
+		router.GET("/*path", middleware.TokenMiddleware(), Download)
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+		return w
+	}
+
+	// The granted file passes the permission check and is looked up
+	w := download("/dataset2/dir/file2.txt")
+	assert.Equal(suite.T(), http.StatusInternalServerError, w.Code)
+	assert.Equal(suite.T(), "database error", w.Body.String())
+
+	// Other files in the dataset are refused
+	w = download("/dataset2/dir/file1.txt")
+	assert.Equal(suite.T(), http.StatusUnauthorized, w.Code)
+
+	// Return mock functions to originals
+	auth.GetVisas = originalGetVisas
+	database.GetGrantedDatasets = originalGetGrantedDatasets
+	database.GetFileGrants = originalGetFileGrants
+	database.GetDatasetFileInfo = originalGetDatasetFileInfo
+	database.CheckFilePermission = originalCheckFilePermission
+	database.GetFile = originalGetFile
+	config.Config.C4GH.PublicKeyB64 = originalPublicKey
+}
+
 func (suite *S3TestSuite) TestListByPrefix() {
 
 	// Setup a mock database to handle queries
@@ -289,12 +447,13 @@ func (suite *S3TestSuite) TestParseParams() {
 		{Path: "/https%3A%2F%2Furl%2Fdataset/file.txt", Dataset: "https://url/dataset", Filename: "file.txt"},
 		{Path: "/https%3A%2Furl%2Fdataset/file.txt", Dataset: "https://url/dataset", Filename: "file.txt"},
 	}
+	datasets := []string{"dataset1", "dataset10", "https://url/dataset"}
 
 	for _, params := range testParams {
 
 		// response function to check parameter parsing
 		testParseParams := func(c *gin.Context) {
-			parseParams(c)
+			parseParams(c, datasets)
 
 			assert.Equal(suite.T(), params.Dataset, c.Param("dataset"), "Failed to parse dataset name")
 			assert.Equal(suite.T(), params.Filename, c.Param("filename"), "Failed to parse file name")
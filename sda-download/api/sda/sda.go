@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -134,8 +135,10 @@ func find(datasetID string, datasets []string) bool {
 	return found
 }
 
-// getFiles returns files belonging to a dataset
-var getFiles = func(datasetID string, ctx *gin.Context) ([]*database.FileInfo, int, error) {
+// PermittedFiles returns a check of which files of the dataset the user may
+// access, either all of them when the dataset is permitted or the ones the
+// user has been granted access to
+func PermittedFiles(datasetID string, ctx *gin.Context) (func(fileID string) bool, int, error) {
 
 	// Retrieve dataset list from request context
 	// generated by the authentication middleware
@@ -144,23 +147,54 @@ var getFiles = func(datasetID string, ctx *gin.Context) ([]*database.FileInfo, i
 	log.Debugf("request to process files for dataset %s", sanitizeString(datasetID))
 
 	if find(datasetID, cache.Datasets) {
-		// Get file metadata
-		files, err := database.GetFiles(datasetID)
+		return func(string) bool { return true }, 200, nil
+	}
+
+	// Users may have been granted access to some of the files in the dataset
+	if cache.User != "" {
+		granted, err := database.GetFileGrants(cache.User, datasetID)
 		if err != nil {
-			// something went wrong with querying or parsing rows
-			log.Errorf("database query failed for dataset %s, reason %s", sanitizeString(datasetID), err)
+			log.Errorf("database query failed for file grants in dataset %s, reason %s", sanitizeString(datasetID), err)
 
 			return nil, 500, errors.New("database error")
 		}
-
-		return files, 200, nil
+		if len(granted) > 0 {
+			return func(fileID string) bool { return find(fileID, granted) }, 200, nil
+		}
 	}
 
 	return nil, 404, errors.New("dataset not found")
 }
 
-// Files serves a list of files belonging to a dataset
-func Files(c *gin.Context) {
+// getFiles returns files belonging to a dataset
+var getFiles = func(datasetID string, ctx *gin.Context) ([]*database.FileInfo, int, error) {
+	permitted, code, err := PermittedFiles(datasetID, ctx)
+	if err != nil {
+		return nil, code, err
+	}
+
+	// Get file metadata
+	files, err := database.GetFiles(datasetID)
+	if err != nil {
+		// something went wrong with querying or parsing rows
+		log.Errorf("database query failed for dataset %s, reason %s", sanitizeString(datasetID), err)
+
+		return nil, 500, errors.New("database error")
+	}
+
+	permittedList := []*database.FileInfo{}
+	for _, file := range files {
+		if permitted(file.FileID) {
+			permittedList = append(permittedList, file)
+		}
+	}
+
+	return permittedList, 200, nil
+}
+
+// datasetParam returns the dataset of a /metadata/datasets/<dataset>/files
+// request, it responds with 404 and returns false for other paths
+func datasetParam(c *gin.Context) (string, bool) {
 
 	// get dataset parameter
 	dataset := c.Param("dataset")
@@ -168,7 +202,7 @@ func Files(c *gin.Context) {
 	if !strings.HasSuffix(dataset, "/files") {
 		c.String(http.StatusNotFound, "API path not found, maybe /files is missing")
 
-		return
+		return "", false
 	}
 
 	// remove / prefix and /files suffix
@@ -193,6 +227,16 @@ func Files(c *gin.Context) {
 		log.Debugf("new dataset=%s", datasetLogs)
 	}
 
+	return dataset, true
+}
+
+// Files serves a list of files belonging to a dataset
+func Files(c *gin.Context) {
+	dataset, ok := datasetParam(c)
+	if !ok {
+		return
+	}
+
 	// Get dataset files
 	files, code, err := getFiles(dataset, c)
 	if err != nil {
@@ -205,6 +249,64 @@ func Files(c *gin.Context) {
 	c.JSON(http.StatusOK, files)
 }
 
+// SelectFiles streams the files of a dataset that match the filter given as
+// JSON in the request body, one JSON object per line, so that clients can
+// pick a few files from a large dataset without fetching the full list
+func SelectFiles(c *gin.Context) {
+	dataset, ok := datasetParam(c)
+	if !ok {
+		return
+	}
+
+	var filter database.FileFilter
+	if err := c.ShouldBindJSON(&filter); err != nil {
+		c.String(http.StatusBadRequest, "invalid filter: "+err.Error())
+
+		return
+	}
+	if filter.MinSize < 0 || filter.MaxSize < 0 || (filter.MaxSize > 0 && filter.MinSize > filter.MaxSize) {
+		c.String(http.StatusBadRequest, "invalid size range")
+
+		return
+	}
+
+	permitted, code, err := PermittedFiles(dataset, c)
+	if err != nil {
+		c.String(code, err.Error())
+
+		return
+	}
+
+	started := false
+	encoder := json.NewEncoder(c.Writer)
+	err = database.SelectFiles(c.Request.Context(), dataset, filter, func(file *database.FileInfo) error {
+		if !permitted(file.FileID) {
+			return nil
+		}
+		if !started {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(http.StatusOK)
+			started = true
+		}
+
+		return encoder.Encode(file)
+	})
+	if err != nil {
+		log.Errorf("failed to select files of dataset %s, reason %s", sanitizeString(dataset), err)
+		// the response can not be changed once files have been sent, the
+		// client sees the stream end early
+		if !started {
+			c.String(http.StatusInternalServerError, "database error")
+		}
+
+		return
+	}
+	if !started {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+	}
+}
+
 // Download serves file contents as bytes
 func Download(c *gin.Context) {
 	// This conditional should always be satisfied for /s3 since the c.Param is set to  encrypted
@@ -248,6 +350,16 @@ func Download(c *gin.Context) {
 			break
 		}
 	}
+	// Access may also have been granted to the file alone
+	if !permission && cache.User != "" {
+		granted, err := database.GetFileGrants(cache.User, dataset)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "database error")
+
+			return
+		}
+		permission = find(fileID, granted)
+	}
 	if !permission {
 		log.Debugf("user requested to view file, but does not have permissions for dataset %s", dataset)
 		c.String(http.StatusUnauthorized, "unauthorised")
@@ -2,6 +2,7 @@ package sda
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
@@ -232,6 +233,44 @@ func TestGetFiles_Success(t *testing.T) {
 
 }
 
+func TestGetFiles_Success_FileGrants(t *testing.T) {
+
+	// Save original to-be-mocked functions
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	originalGetFilesDB := database.GetFiles
+	originalGetFileGrants := database.GetFileGrants
+
+	// Substitute mock functions
+	middleware.GetCacheFromContext = func(_ *gin.Context) session.Cache {
+		return session.Cache{
+			Datasets: []string{"dataset1"},
+			User:     "user1",
+		}
+	}
+	database.GetFileGrants = func(_, _ string) ([]string, error) {
+		return []string{"file2"}, nil
+	}
+	database.GetFiles = func(_ string) ([]*database.FileInfo, error) {
+		return []*database.FileInfo{{FileID: "file1"}, {FileID: "file2"}}, nil
+	}
+
+	// Run test target
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	fileInfo, statusCode, err := getFiles("dataset2", c)
+
+	// Only the granted file is returned
+	assert.NoError(t, err)
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, 1, len(fileInfo))
+	assert.Equal(t, "file2", fileInfo[0].FileID)
+
+	// Return mock functions to originals
+	middleware.GetCacheFromContext = originalGetCacheFromContext
+	database.GetFiles = originalGetFilesDB
+	database.GetFileGrants = originalGetFileGrants
+}
+
 func TestFiles_Fail(t *testing.T) {
 
 	// Save original to-be-mocked functions
@@ -338,6 +377,89 @@ func TestFiles_Success(t *testing.T) {
 
 }
 
+func TestSelectFiles(t *testing.T) {
+
+	// Save original to-be-mocked functions
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	originalSelectFiles := database.SelectFiles
+	originalGetFileGrants := database.GetFileGrants
+
+	// Substitute mock functions
+	middleware.GetCacheFromContext = func(_ *gin.Context) session.Cache {
+		return session.Cache{
+			Datasets: []string{"dataset1"},
+			User:     "user1",
+		}
+	}
+	database.GetFileGrants = func(_, _ string) ([]string, error) {
+		return []string{"file2"}, nil
+	}
+	var filter database.FileFilter
+	database.SelectFiles = func(_ context.Context, _ string, f database.FileFilter, fn func(*database.FileInfo) error) error {
+		filter = f
+		for _, id := range []string{"file1", "file2"} {
+			if err := fn(&database.FileInfo{FileID: id}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	selectFiles := func(dataset, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/metadata/datasets/"+dataset, strings.NewReader(body))
+		c.Params = []gin.Param{{Key: "dataset", Value: dataset}}
+		SelectFiles(c)
+
+		return w
+	}
+
+	// All files of a permitted dataset are passed on
+	w := selectFiles("dataset1/files", `{"path": "*.bam", "minSize": 10, "checksums": ["abc"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], `"fileId":"file1"`)
+	assert.Equal(t, database.FileFilter{Path: "*.bam", MinSize: 10, Checksums: []string{"abc"}}, filter)
+
+	// Only granted files are passed on from other datasets
+	w = selectFiles("dataset2/files", `{}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	assert.Contains(t, lines[0], `"fileId":"file2"`)
+
+	w = selectFiles("dataset1/files", `{"minSize": 100, "maxSize": 10}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = selectFiles("dataset1/files", `{"path": 42}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = selectFiles("dataset1", `{}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	database.GetFileGrants = func(_, _ string) ([]string, error) {
+		return nil, nil
+	}
+	w = selectFiles("dataset2/files", `{}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	database.SelectFiles = func(_ context.Context, _ string, _ database.FileFilter, _ func(*database.FileInfo) error) error {
+		return errors.New("something went wrong")
+	}
+	w = selectFiles("dataset1/files", `{}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "database error", w.Body.String())
+
+	// Return mock functions to originals
+	middleware.GetCacheFromContext = originalGetCacheFromContext
+	database.SelectFiles = originalSelectFiles
+	database.GetFileGrants = originalGetFileGrants
+}
+
 func TestDownload_Fail_UnencryptedDownloadNotAllowed(t *testing.T) {
 
 	// Save original to-be-mocked config
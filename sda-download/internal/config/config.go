@@ -60,6 +60,29 @@ type AppConfig struct {
 	// Selected middleware for authentication and authorizaton
 	// Optional. Default value is "default" for TokenMiddleware
 	Middleware string
+
+	// Deadline for handling a request, 0 disables it.
+	// Optional. Default value 0, since downloads of large files take time
+	RequestTimeout time.Duration
+
+	// Request timeouts for single routes, overriding RequestTimeout
+	// Optional. Defaults to empty
+	EndpointTimeouts map[string]time.Duration
+
+	// Number of consecutive failed requests before the circuit breaker
+	// for a dependency opens, 0 disables the breakers.
+	// Optional. Default value 5
+	BreakerThreshold int
+
+	// Time before a request is let through to a dependency with an open breaker
+	// Optional. Default value 30 seconds
+	BreakerCooldown time.Duration
+}
+
+// EndpointTimeoutConf sets the request timeout, in seconds, for a route
+type EndpointTimeoutConf struct {
+	Path    string `mapstructure:"path"`
+	Timeout int    `mapstructure:"timeout"`
 }
 
 // Stores the Crypt4GH private key used internally
@@ -243,6 +266,8 @@ func (c *Map) applyDefaults() {
 	viper.SetDefault("app.host", "0.0.0.0")
 	viper.SetDefault("app.port", 8080)
 	viper.SetDefault("app.middleware", "default")
+	viper.SetDefault("app.breakerThreshold", 5)
+	viper.SetDefault("app.breakerCooldown", 30)
 	viper.SetDefault("session.expiration", -1)
 	viper.SetDefault("session.secure", true)
 	viper.SetDefault("session.httponly", true)
@@ -371,6 +396,21 @@ func (c *Map) appConfig() error {
 	c.App.ServerCert = viper.GetString("app.servercert")
 	c.App.ServerKey = viper.GetString("app.serverkey")
 	c.App.Middleware = viper.GetString("app.middleware")
+	c.App.RequestTimeout = time.Duration(viper.GetInt("app.requestTimeout")) * time.Second
+	c.App.BreakerThreshold = viper.GetInt("app.breakerThreshold")
+	c.App.BreakerCooldown = time.Duration(viper.GetInt("app.breakerCooldown")) * time.Second
+
+	var endpointTimeouts []EndpointTimeoutConf
+	if err := viper.UnmarshalKey("app.endpointTimeouts", &endpointTimeouts); err != nil {
+		return fmt.Errorf("failed to parse app.endpointTimeouts: %v", err)
+	}
+	c.App.EndpointTimeouts = map[string]time.Duration{}
+	for _, e := range endpointTimeouts {
+		if e.Path == "" || e.Timeout < 0 {
+			return errors.New("app.endpointTimeouts requires a path and a non negative timeout")
+		}
+		c.App.EndpointTimeouts[e.Path] = time.Duration(e.Timeout) * time.Second
+	}
 
 	if c.App.Port != 443 && c.App.Port != 8080 {
 		c.App.Port = viper.GetInt("app.port")
@@ -127,6 +127,22 @@ func (suite *TestSuite) TestAppConfig() {
 	assert.ErrorContains(suite.T(), err, "chacha20poly1305: message authentication failed")
 }
 
+func (suite *TestSuite) TestAppConfig_Timeouts() {
+	viper.Set("app.middleware", "default")
+	viper.Set("app.requestTimeout", 120)
+	viper.Set("app.breakerThreshold", 3)
+	viper.Set("app.endpointTimeouts", []map[string]any{{"path": "/metadata/datasets", "timeout": 10}})
+
+	c := &Map{}
+	assert.NoError(suite.T(), c.appConfig())
+	assert.Equal(suite.T(), 120*time.Second, c.App.RequestTimeout)
+	assert.Equal(suite.T(), 3, c.App.BreakerThreshold)
+	assert.Equal(suite.T(), 10*time.Second, c.App.EndpointTimeouts["/metadata/datasets"])
+
+	viper.Set("app.endpointTimeouts", []map[string]any{{"timeout": 10}})
+	assert.ErrorContains(suite.T(), c.appConfig(), "requires a path")
+}
+
 func (suite *TestSuite) TestArchiveConfig() {
 	viper.Set("archive.type", POSIX)
 	viper.Set("archive.location", "/test")
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
@@ -8,11 +9,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/neicnordic/sda-download/internal/config"
 	log "github.com/sirupsen/logrus"
-
-	// enables postgres driver
-	_ "github.com/lib/pq"
 )
 
 // DB is exported for other packages
@@ -171,14 +170,9 @@ func processFileInfo(fi *FileInfo, userID string) error {
 	return nil
 }
 
-// getFiles is the actual function performing work for GetFile
-func (dbs *SQLdb) getFiles(datasetID string) ([]*FileInfo, error) {
-	dbs.checkAndReconnectIfNeeded()
-
-	files := []*FileInfo{}
-	db := dbs.DB
-
-	const query = `
+// datasetFilesQuery selects the files of the dataset given as $1, more
+// conditions can be appended
+const datasetFilesQuery = `
 		SELECT files.stable_id AS id,
 			datasets.stable_id AS dataset_id,
 			reverse(split_part(reverse(files.submission_file_path::text), '/'::text, 1)) AS display_file_name,
@@ -196,8 +190,16 @@ func (dbs *SQLdb) getFiles(datasetID string) ([]*FileInfo, error) {
 		LEFT JOIN local_ega.files lef ON files.stable_id = lef.stable_id
 		LEFT JOIN (SELECT file_id, (ARRAY_AGG(event ORDER BY started_at DESC))[1] AS event FROM sda.file_event_log GROUP BY file_id) log ON files.id = log.file_id
 		LEFT JOIN (SELECT file_id, checksum, type FROM sda.checksums WHERE source = 'UNENCRYPTED') sha ON files.id = sha.file_id
-		WHERE datasets.stable_id = $1;
-	  	`
+		WHERE datasets.stable_id = $1`
+
+// getFiles is the actual function performing work for GetFile
+func (dbs *SQLdb) getFiles(datasetID string) ([]*FileInfo, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	files := []*FileInfo{}
+	db := dbs.DB
+
+	const query = datasetFilesQuery + ";"
 
 	// nolint:rowserrcheck
 	rows, err := db.Query(query, datasetID)
@@ -250,6 +252,117 @@ func (dbs *SQLdb) getFiles(datasetID string) ([]*FileInfo, error) {
 	return files, nil
 }
 
+// FileFilter selects files of a dataset, unset fields match all files. Path
+// is a glob on the file path where * matches any characters, including /,
+// and ? matches a single character. The sizes are decrypted sizes in bytes
+// and the checksums are matched against both the decrypted and encrypted
+// checksums of the files.
+type FileFilter struct {
+	Path      string   `json:"path"`
+	MinSize   int64    `json:"minSize"`
+	MaxSize   int64    `json:"maxSize"`
+	Checksums []string `json:"checksums"`
+}
+
+// globPattern translates a path glob to an anchored regular expression
+func globPattern(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	pattern.WriteString("$")
+
+	return regexp.MustCompile(pattern.String())
+}
+
+// SelectFiles calls fn for each file of the dataset that matches the filter,
+// the files are passed on as they are read from the database so that large
+// datasets are not held in memory
+var SelectFiles = func(ctx context.Context, datasetID string, filter FileFilter, fn func(*FileInfo) error) error {
+	var (
+		err    error
+		passed bool
+	)
+
+	for count := 0; count < dbRetryTimes; count++ {
+		err = DB.selectFiles(ctx, datasetID, filter, func(fi *FileInfo) error {
+			passed = true
+
+			return fn(fi)
+		})
+		// files that have been passed on can not be taken back, so only
+		// failures before the first file are retried
+		if err == nil || passed || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return err
+}
+
+// selectFiles is the actual function performing work for SelectFiles
+func (dbs *SQLdb) selectFiles(ctx context.Context, datasetID string, filter FileFilter, fn func(*FileInfo) error) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = datasetFilesQuery + `
+		AND ($2::bigint = 0 OR files.decrypted_file_size >= $2::bigint)
+		AND ($3::bigint = 0 OR files.decrypted_file_size <= $3::bigint)
+		AND (cardinality($4::text[]) = 0 OR lower(sha.checksum) = ANY($4::text[]) OR lower(lef.archive_file_checksum) = ANY($4::text[]))
+		ORDER BY files.submission_file_path;`
+
+	checksums := make([]string, 0, len(filter.Checksums))
+	for _, c := range filter.Checksums {
+		checksums = append(checksums, strings.ToLower(c))
+	}
+	var pattern *regexp.Regexp
+	if filter.Path != "" {
+		pattern = globPattern(filter.Path)
+	}
+
+	rows, err := dbs.DB.QueryContext(ctx, query, datasetID, filter.MinSize, filter.MaxSize, pq.Array(checksums))
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+	defer rows.Close()
+
+	var userID string
+	for rows.Next() {
+		fi := &FileInfo{}
+		err := rows.Scan(&fi.FileID, &fi.DatasetID, &fi.DisplayFileName,
+			&userID, &fi.FilePath,
+			&fi.EncryptedFileSize, &fi.EncryptedFileChecksum, &fi.EncryptedFileChecksumType,
+			&fi.DecryptedFileSize, &fi.DecryptedFileChecksum, &fi.DecryptedFileChecksumType)
+		if err != nil {
+			log.Error(err)
+
+			return err
+		}
+		if err := processFileInfo(fi, userID); err != nil {
+			return err
+		}
+		// the glob is matched against the path as presented to the user
+		if pattern != nil && !pattern.MatchString(fi.FilePath) {
+			continue
+		}
+
+		if err := fn(fi); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 // CheckDataset checks if dataset name exists
 var CheckDataset = func(dataset string) (bool, error) {
 	var (
@@ -454,6 +567,122 @@ func (dbs *SQLdb) checkFilePermission(fileID string) (string, error) {
 	return datasetName, nil
 }
 
+// GetFileGrants returns the files in a dataset that a user has been granted
+// access to on file level
+var GetFileGrants = func(user, datasetID string) ([]string, error) {
+	var (
+		r     []string
+		err   error
+		count int
+	)
+
+	for count < dbRetryTimes {
+		r, err = DB.getFileGrants(user, datasetID)
+		if err != nil {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return r, err
+}
+
+// getFileGrants is the actual function performing work for GetFileGrants
+func (dbs *SQLdb) getFileGrants(user, datasetID string) ([]string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.DB
+	const query = `
+		SELECT files.stable_id FROM sda.file_access_grants
+		JOIN sda.files ON file_access_grants.file_id = files.id
+		JOIN sda.file_dataset ON file_dataset.file_id = files.id
+		JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
+		WHERE file_access_grants.user_id = $1 AND datasets.stable_id = $2 AND file_access_grants.revoked_at IS NULL;
+	`
+
+	files := []string{}
+	rows, err := db.Query(query, user, datasetID)
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		files = append(files, fileID)
+	}
+
+	return files, rows.Err()
+}
+
+// GetGrantedDatasets returns the datasets in which a user has been granted
+// access to some of the files
+var GetGrantedDatasets = func(user string) ([]string, error) {
+	var (
+		r     []string
+		err   error
+		count int
+	)
+
+	for count < dbRetryTimes {
+		r, err = DB.getGrantedDatasets(user)
+		if err != nil {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return r, err
+}
+
+// getGrantedDatasets is the actual function performing work for GetGrantedDatasets
+func (dbs *SQLdb) getGrantedDatasets(user string) ([]string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.DB
+	const query = `
+		SELECT DISTINCT datasets.stable_id FROM sda.file_access_grants
+		JOIN sda.file_dataset ON file_dataset.file_id = file_access_grants.file_id
+		JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
+		WHERE file_access_grants.user_id = $1 AND file_access_grants.revoked_at IS NULL
+		ORDER BY datasets.stable_id;
+	`
+
+	datasets := []string{}
+	rows, err := db.Query(query, user)
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var dataset string
+		if err := rows.Scan(&dataset); err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		datasets = append(datasets, dataset)
+	}
+
+	return datasets, rows.Err()
+}
+
 // FileDownload details are used for downloading a file
 type FileDownload struct {
 	ArchivePath       string
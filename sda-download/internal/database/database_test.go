@@ -2,6 +2,7 @@ package database
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -197,6 +198,41 @@ func TestClose(t *testing.T) {
 	assert.Nil(t, r, "Close failed unexpectedly")
 }
 
+func TestSelectFiles(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		query := `AND \(\$2::bigint = 0 OR files.decrypted_file_size >= \$2::bigint\)`
+		mock.ExpectQuery(query).
+			WithArgs("dataset1", int64(10), int64(0), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"file_id", "dataset_id",
+				"display_file_name", "user_id", "file_path", "file_size", "encrypted_file_checksum",
+				"encrypted_file_checksum_type", "decrypted_file_size", "decrypted_file_checksum", "decrypted_file_checksum_type"}).
+				AddRow("file1", "dataset1", "a.bam", "user1", "user1/dir/a.bam", 60, "hash", "sha256", 32, "hash", "sha256").
+				AddRow("file2", "dataset1", "b.txt", "user1", "user1/dir/b.txt", 60, "hash", "sha256", 32, "hash", "sha256"))
+
+		var files []*FileInfo
+		err := testDb.selectFiles(context.TODO(), "dataset1", FileFilter{Path: "dir/*.bam", MinSize: 10, Checksums: []string{"HASH"}}, func(fi *FileInfo) error {
+			files = append(files, fi)
+
+			return nil
+		})
+		assert.Equal(t, 1, len(files))
+		assert.Equal(t, "file1", files[0].FileID)
+		assert.Equal(t, "dir/a.bam", files[0].FilePath)
+
+		return err
+	})
+
+	assert.Nil(t, r, "selectFiles failed unexpectedly")
+}
+
+func TestGlobPattern(t *testing.T) {
+	assert.True(t, globPattern("*.bam").MatchString("dir/sample.bam"))
+	assert.True(t, globPattern("sample-0?.bam").MatchString("sample-01.bam"))
+	assert.False(t, globPattern("sample-0?.bam").MatchString("sample-10.bam"))
+	assert.False(t, globPattern("*.bam").MatchString("sample.bam.bai"))
+	assert.True(t, globPattern("[x].bam").MatchString("[x].bam"))
+}
+
 func TestCheckFilePermission(t *testing.T) {
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
@@ -228,6 +264,56 @@ func TestCheckFilePermission(t *testing.T) {
 	log.SetOutput(os.Stdout)
 }
 
+func TestGetFileGrants(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		expected := []string{"file1", "file2"}
+		query := `
+			SELECT files.stable_id FROM sda.file_access_grants
+			JOIN sda.files ON file_access_grants.file_id = files.id
+			JOIN sda.file_dataset ON file_dataset.file_id = files.id
+			JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
+			WHERE file_access_grants.user_id = \$1 AND datasets.stable_id = \$2 AND file_access_grants.revoked_at IS NULL;
+		`
+		mock.ExpectQuery(strings.ReplaceAll(strings.ReplaceAll(query, "\t", ""), "\n", " ")).
+			WithArgs("user1", "dataset1").
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id"}).AddRow("file1").AddRow("file2"))
+
+		x, err := testDb.getFileGrants("user1", "dataset1")
+
+		assert.Equal(t, expected, x, "did not get expected file grants")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getFileGrants failed unexpectedly")
+}
+
+func TestGetGrantedDatasets(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		expected := []string{"dataset1", "dataset2"}
+		query := `
+			SELECT DISTINCT datasets.stable_id FROM sda.file_access_grants
+			JOIN sda.file_dataset ON file_dataset.file_id = file_access_grants.file_id
+			JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
+			WHERE file_access_grants.user_id = \$1 AND file_access_grants.revoked_at IS NULL
+			ORDER BY datasets.stable_id;
+		`
+		mock.ExpectQuery(strings.ReplaceAll(strings.ReplaceAll(query, "\t", ""), "\n", " ")).
+			WithArgs("user1").
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id"}).AddRow("dataset1").AddRow("dataset2"))
+
+		x, err := testDb.getGrantedDatasets("user1")
+
+		assert.Equal(t, expected, x, "did not get expected granted datasets")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getGrantedDatasets failed unexpectedly")
+}
+
 func TestCheckDataset(t *testing.T) {
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
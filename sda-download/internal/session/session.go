@@ -18,8 +18,11 @@ var SessionCache *ristretto.Cache[string, Cache]
 // Cache==nil, session doesn't exist
 // Cache.Datasets==nil, session exists, user has no permissions (this case is not used in middleware.go)
 // Cache.Datasets==[]string{...}, session exists, user has permissions
+// Cache.User is the subject of the token, used to look up access granted
+// to single files
 type Cache struct {
 	Datasets []string
+	User     string
 }
 
 // InitialiseSessionCache creates a cache manager that stores keys and values in memory
@@ -141,7 +141,8 @@ type JKU struct {
 
 // Visas is used to draw the response bytes to a struct
 type Visas struct {
-	Visa []string `json:"ga4gh_passport_v1"`
+	Subject string   `json:"sub"`
+	Visa    []string `json:"ga4gh_passport_v1"`
 }
 
 // Visa is used to draw the dataset name out of the visa
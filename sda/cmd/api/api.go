@@ -4,33 +4,146 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
-	"os"
-	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/neicnordic/crypt4gh/keys"
-	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/events"
 	"github.com/neicnordic/sensitive-data-archive/internal/jsonadapter"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	"github.com/neicnordic/sensitive-data-archive/internal/schema"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 	"github.com/neicnordic/sensitive-data-archive/internal/userauth"
 	log "github.com/sirupsen/logrus"
 )
 
+// listResponse is the envelope returned by all endpoints listing items,
+// next is the continuation for paginated lists and null otherwise.
+type listResponse struct {
+	Data  any     `json:"data"`
+	Total int     `json:"total"`
+	Next  *string `json:"next"`
+}
+
+// newListResponse wraps a list in the response envelope, an empty list is
+// returned as [] rather than null
+func newListResponse[T any](data []T, total int) listResponse {
+	if data == nil {
+		data = []T{}
+	}
+
+	return listResponse{Data: data, Total: total}
+}
+
+// withNext sets the continuation of a paginated list, an empty cursor means
+// that this is the last page
+func (r listResponse) withNext(next string) listResponse {
+	if next != "" {
+		r.Next = &next
+	}
+
+	return r
+}
+
+// pageParams reads the limit and next query parameters of a paginated list,
+// the whole list is selected when no limit is given
+func pageParams(c *gin.Context) (database.Page, bool) {
+	page := database.Page{After: c.Query("next")}
+	if l, ok := c.GetQuery("limit"); ok {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "limit must be a positive integer")
+
+			return page, false
+		}
+		page.Limit = limit
+	}
+
+	return page, true
+}
+
+// retryError is the error envelope returned when a request is rejected due to
+// a temporary condition, such as an unavailable broker.
+type retryError struct {
+	Error      string `json:"error"`
+	Status     int    `json:"status"`
+	Retryable  bool   `json:"retryable"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+// abortWithRetry aborts the request with a Retry-After header and a
+// retryable error, telling clients how many seconds to back off.
+func abortWithRetry(c *gin.Context, code int, msg string) {
+	retryAfter := int(Conf.API.RetryAfter.Seconds())
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(code, retryError{Error: msg, Status: code, Retryable: true, RetryAfter: retryAfter})
+}
+
+type freeze struct {
+	Scope  string `json:"scope"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type accessionFile struct {
+	AccessionID string             `json:"accessionID"`
+	InboxPath   string             `json:"inboxPath"`
+	ArchivePath string             `json:"archivePath"`
+	Datasets    []string           `json:"datasets"`
+	Status      string             `json:"fileStatus"`
+	Replicas    []database.Replica `json:"replicas"`
+}
+
+type fileGrant struct {
+	User         string   `json:"user"`
+	AccessionIDs []string `json:"accession_ids"`
+}
+
+// replicaRegistration lists copies of archived files kept by an external
+// long-term preservation service
+type replicaRegistration struct {
+	Service  string         `json:"service"`
+	Replicas []replicaEntry `json:"replicas"`
+}
+
+type replicaEntry struct {
+	AccessionID  string `json:"accession_id"`
+	Location     string `json:"location"`
+	Checksum     string `json:"checksum"`
+	ChecksumType string `json:"checksum_type"`
+}
+
+type quota struct {
+	Quota int64 `json:"quota"`
+}
+
+// userUsage is the storage usage of a user together with the quota warning state
+type userUsage struct {
+	database.UserQuota
+	UsagePercent     float64 `json:"usagePercent"`
+	Exceeded         bool    `json:"exceeded"`
+	WarningThreshold int     `json:"warningThreshold"`
+	Notified         int     `json:"notifiedThreshold"`
+	Thresholds       []int   `json:"thresholds"`
+}
+
 type dataset struct {
 	AccessionIDs []string `json:"accession_ids"`
 	DatasetID    string   `json:"dataset_id"`
@@ -41,6 +154,9 @@ var (
 	Conf *config.Config
 	err  error
 	auth *userauth.ValidateFromToken
+	// enforcer holds the RBAC policy, it is replaced on reload
+	enforcer *casbin.SyncedEnforcer
+	app      *lifecycle.Manager
 )
 
 func main() {
@@ -48,61 +164,97 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	Conf.API.MQ, err = broker.NewMQ(Conf.Broker)
-	if err != nil {
-		log.Fatal(err)
-	}
-	Conf.API.DB, err = database.NewSDAdb(Conf.Database)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	if err := setupJwtAuth(); err != nil {
 		log.Fatalf("error when setting up JWT auth, reason %s", err.Error())
 	}
 
-	sigc := make(chan os.Signal, 5)
-	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		<-sigc
-		shutdown()
-		os.Exit(0)
-	}()
+	// The broker connection is re-established by the readiness checks, so
+	// the service is not stopped when it is lost.
+	mq := lifecycle.Broker(Conf.Broker, &Conf.API.MQ)
+	mq.Run = nil
 
 	srv := setup(Conf)
+	api := lifecycle.HTTPServer("server", srv, Conf.API.ServerCert, Conf.API.ServerKey)
+	api.DependsOn = []string{"broker", "database"}
+
+	Conf.Database.RequiredVersion = 13
+	app = lifecycle.New()
+	app.Add(lifecycle.Config("api", applyConfig), mq, lifecycle.Database(Conf.Database, &Conf.API.DB), lifecycle.Metrics(Conf.Metrics.Address), lifecycle.Tracing(Conf.Tracing.Endpoint, Conf.Tracing.Service), eventsComponent(), remindersComponent(), eventPurgeComponent(), usageSummaryComponent(), statsRefreshComponent(), api)
+
 	if Conf.API.ServerCert != "" && Conf.API.ServerKey != "" {
 		log.Infof("Starting web server at https://%s:%d", Conf.API.Host, Conf.API.Port)
-		if err := srv.ListenAndServeTLS(Conf.API.ServerCert, Conf.API.ServerKey); err != nil {
-			shutdown()
-			log.Fatalln(err)
-		}
 	} else {
 		log.Infof("Starting web server at http://%s:%d", Conf.API.Host, Conf.API.Port)
-		if err := srv.ListenAndServe(); err != nil {
-			shutdown()
-			log.Fatalln(err)
-		}
 	}
-
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func setup(config *config.Config) *http.Server {
 	model, _ := model.NewModelFromString(jsonadapter.Model)
-	e, err := casbin.NewEnforcer(model, jsonadapter.NewAdapter(&Conf.API.RBACpolicy))
+	e, err := casbin.NewSyncedEnforcer(model, jsonadapter.NewAdapter(&Conf.API.RBACpolicy))
 	if err != nil {
-		shutdown()
 		log.Fatalf("error when setting up RBAC enforcer, reason %s", err.Error())
 	}
+	enforcer = e
 
 	r := gin.Default()
+	if config.API.ReadOnly {
+		log.Info("running as a read-only mirror, mutating requests are refused")
+		r.Use(readOnlyGuard)
+	}
+	dbBreaker = newCircuitBreaker("database", config.API.BreakerThreshold, config.API.BreakerCooldown)
+	mqBreaker = newCircuitBreaker("broker", config.API.BreakerThreshold, config.API.BreakerCooldown)
+	r.Use(traceRequests, requestTimeout, dependencyGuard)
 	r.GET("/ready", readinessResponse)
+	r.GET("/health", healthStatus)
 	r.GET("/files", rbac(e), getFiles)
 	r.GET("/datasets", rbac(e), listDatasets)
+	r.POST("/files/deletion-requests", rbac(e), requestDeletion)        // Request deletion of one of the user's files
+	r.GET("/files/deletion-requests", rbac(e), listOwnDeletionRequests) // Lists the user's deletion requests
+	if config.API.ReleaseFeed {
+		r.GET("/datasets/feed", releaseFeed) // Public Atom feed of released datasets
+	}
 	// admin endpoints below here
 	r.POST("/c4gh-keys/add", rbac(e), addC4ghHash)                      // Adds a key hash to the database
 	r.GET("/c4gh-keys/list", rbac(e), listC4ghHashes)                   // Lists key hashes in the database
 	r.POST("/c4gh-keys/deprecate/*keyHash", rbac(e), deprecateC4ghHash) // Deprecate a given key hash
+	r.GET("/c4gh-keys/files/*keyHash", rbac(e), listKeyHashFiles)       // Lists the files encrypted with a given key
 	r.DELETE("/file/:username/:fileid", rbac(e), deleteFile)            // Delete a file from inbox
+	r.GET("/files/by-accession/:stableID", rbac(e), getFileByAccession) // Look up a file by its accession ID
+	r.GET("/sessions/:id", rbac(e), getUploadSession)                   // Follow the files of an upload session to their datasets
+
+	r.POST("/submission/freeze", rbac(e), freezeSubmission)                  // Block new submissions for a user or project
+	r.DELETE("/submission/freeze/:scope/:name", rbac(e), unfreezeSubmission) // Lift a submission freeze
+	r.GET("/submission/freeze", rbac(e), listSubmissionFreezes)              // Lists active submission freezes
+	r.POST("/submission/expected", rbac(e), registerExpectedFiles)           // Pre-register the files a user is expected to upload
+	r.DELETE("/submission/expected/:username", rbac(e), removeExpectedFile)  // Remove a pre-registered file
+	r.GET("/submission/status/:username", rbac(e), getSubmissionStatus)      // Expected, missing and unexpected files of a user
+
+	r.POST("/grants/files", rbac(e), grantFileAccess)                         // Give a user access to single files
+	r.DELETE("/grants/files/:username/:accession", rbac(e), revokeFileAccess) // Revoke access to a file
+	r.GET("/grants/files/:username", rbac(e), listFileGrants)                 // Lists active file grants for a user
+
+	r.GET("/deletion-requests", rbac(e), listDeletionRequests)                // Lists deletion requests of users in the admin's projects
+	r.POST("/deletion-requests/:id/approve", rbac(e), approveDeletionRequest) // Approve a deletion request and delete the file
+	r.POST("/deletion-requests/:id/reject", rbac(e), rejectDeletionRequest)   // Reject a deletion request with a reason
+
+	r.POST("/replicas", rbac(e), registerReplicas)                    // Record copies of files kept by external archives
+	r.DELETE("/replicas/:service/:accession", rbac(e), removeReplica) // Remove the record of an external copy
+
+	r.GET("/projects/:project/admins", rbac(e), listProjectAdmins)               // Lists the admins of a project
+	r.PUT("/projects/:project/admins/:username", rbac(e), addProjectAdmin)       // Make a user admin of a project
+	r.DELETE("/projects/:project/admins/:username", rbac(e), removeProjectAdmin) // Remove a user as admin of a project
+
+	r.GET("/admin/config", rbac(e), getEffectiveConfig)                      // Resolved configuration without secrets
+	r.POST("/admin/reload", rbac(e), reloadConfig)                           // Reload the log level, RBAC policy and token settings
+	r.GET("/system/queues", rbac(e), listQueues)                             // Backlog and consumers of the broker queues
+	r.GET("/correlation-ids/check", rbac(e), checkCorrelationIDs)            // Files with missing or conflicting correlation IDs
+	r.POST("/correlation-ids/backfill", rbac(e), startCorrelationIDBackfill) // Set the canonical correlation ID on all events
+	r.GET("/correlation-ids/backfill", rbac(e), getCorrelationIDBackfill)    // State of the last backfill
+	r.GET("/events", rbac(e), streamEvents)                                  // Stream of new file and dataset events
 	// submission endpoints below here
 	r.POST("/file/ingest", rbac(e), ingestFile)                  // start ingestion of a file
 	r.POST("/file/accession", rbac(e), setAccession)             // assign accession ID to a file
@@ -114,6 +266,21 @@ func setup(config *config.Config) *http.Server {
 	r.GET("/datasets/list/:username", rbac(e), listUserDatasets) // Lists datasets with their status for a specififc user
 	r.GET("/users", rbac(e), listActiveUsers)                    // Lists all users
 	r.GET("/users/:username/files", rbac(e), listUserFiles)      // Lists all unmapped files for a user
+	r.GET("/users/:username/quota", rbac(e), getUserQuota)       // Storage quota and usage for a user
+	r.PUT("/users/:username/quota", rbac(e), setUserQuota)       // Set the storage quota for a user
+	r.GET("/users/:username/usage", rbac(e), getUserUsage)       // Storage usage and quota warnings for a user
+
+	r.PUT("/file/metadata/:accession", rbac(e), setFileMetadata)     // Store submission metadata for a file
+	r.GET("/file/metadata/:accession", rbac(e), getFileMetadata)     // Get the submission metadata of a file
+	r.PUT("/dataset/metadata/*dataset", rbac(e), setDatasetMetadata) // Store submission metadata for a dataset
+	r.GET("/dataset/metadata/*dataset", rbac(e), getDatasetMetadata) // Get the submission metadata of a dataset
+
+	r.GET("/usage/users", rbac(e), listUsageSummaries) // File totals of all users as of the latest summary
+	r.GET("/files/search", rbac(e), searchFiles)       // Find files of all users by user and path patterns
+	r.GET("/stats", rbac(e), getStats)                 // Number of files and datasets by status as of the latest refresh
+
+	r.GET("/dataset/info/*dataset", rbac(e), getDatasetInfo) // Status, events and file mappings of a dataset
+
 	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
 
 	srv := &http.Server{
@@ -131,10 +298,19 @@ func setup(config *config.Config) *http.Server {
 
 func setupJwtAuth() error {
 	auth = userauth.NewValidateFromToken(jwk.NewSet())
+	auth.Issuers = Conf.Server.JwtIssuers
+	auth.Audiences = Conf.Server.JwtAudiences
+	auth.Algorithms = Conf.Server.JwtAlgorithms
+	auth.ClockSkew = Conf.Server.JwtClockSkew
+	// tokens of sessions that users have logged out of are refused
+	if Conf.API.DB != nil {
+		auth.Revocations = Conf.API.DB
+	}
 	if Conf.Server.Jwtpubkeyurl != "" {
 		if err := auth.FetchJwtPubKeyURL(Conf.Server.Jwtpubkeyurl); err != nil {
 			return err
 		}
+		auth.RefreshJwtPubKeyURL(context.Background(), Conf.Server.JwksRefresh)
 	}
 	if Conf.Server.Jwtpubkeypath != "" {
 		if err := auth.ReadJwtPubKeyPath(Conf.Server.Jwtpubkeypath); err != nil {
@@ -145,40 +321,60 @@ func setupJwtAuth() error {
 	return nil
 }
 
+// applyConfig applies the settings that can change while the service runs
+// from a configuration read again on reload, the log level is set by
+// reading it. The RBAC policy is kept when the new one can not be loaded.
+func applyConfig(conf *config.Config) error {
+	policy := Conf.API.RBACpolicy
+	Conf.API.RBACpolicy = conf.API.RBACpolicy
+	if enforcer != nil {
+		if err := enforcer.LoadPolicy(); err != nil {
+			Conf.API.RBACpolicy = policy
+			if err := enforcer.LoadPolicy(); err != nil {
+				log.Errorf("failed to restore the RBAC policy, reason: %v", err)
+			}
+
+			return fmt.Errorf("failed to load the RBAC policy: %w", err)
+		}
+	}
+	auth.SetClaimsPolicy(conf.Server.JwtIssuers, conf.Server.JwtAudiences, conf.Server.JwtAlgorithms, conf.Server.JwtClockSkew)
+	log.Info("reloaded the RBAC policy and token settings")
+
+	return nil
+}
+
 func shutdown() {
-	defer Conf.API.MQ.Channel.Close()
-	defer Conf.API.MQ.Connection.Close()
+	defer Conf.API.MQ.Close()
 	defer Conf.API.DB.Close()
 }
 
+// readOnlyGuard refuses all mutating requests when the api runs as a
+// read-only mirror of another site.
+func readOnlyGuard(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+	default:
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, "this site is a read-only mirror, changes must be made at the primary site")
+	}
+}
+
 func readinessResponse(c *gin.Context) {
 	statusCode := http.StatusOK
 
-	if Conf.API.MQ.Connection.IsClosed() {
+	if err := checkBroker(); err != nil {
 		statusCode = http.StatusServiceUnavailable
-		newConn, err := broker.NewMQ(Conf.Broker)
-		if err != nil {
-			log.Errorf("failed to reconnect to MQ, reason: %v", err)
-		} else {
-			Conf.API.MQ = newConn
-		}
+		reconnectBroker()
 	}
 
-	if Conf.API.MQ.Channel.IsClosed() {
+	if err := checkDB(Conf.API.DB, 5*time.Millisecond); err != nil {
+		log.Debugf("DB connection error :%v", err)
+		Conf.API.DB.Reconnect()
 		statusCode = http.StatusServiceUnavailable
-		Conf.API.MQ.Connection.Close()
-		newConn, err := broker.NewMQ(Conf.Broker)
-		if err != nil {
-			log.Errorf("failed to reconnect to MQ, reason: %v", err)
-		} else {
-			Conf.API.MQ = newConn
-		}
 	}
 
-	if DBRes := checkDB(Conf.API.DB, 5*time.Millisecond); DBRes != nil {
-		log.Debugf("DB connection error :%v", DBRes)
-		Conf.API.DB.Reconnect()
-		statusCode = http.StatusServiceUnavailable
+	if statusCode != http.StatusOK {
+		c.Header("Retry-After", strconv.Itoa(int(Conf.API.RetryAfter.Seconds())))
 	}
 
 	c.JSON(statusCode, "")
@@ -194,7 +390,12 @@ func checkDB(database *database.SDAdb, timeout time.Duration) error {
 	return database.DB.PingContext(ctx)
 }
 
-func rbac(e *casbin.Enforcer) gin.HandlerFunc {
+// policyEnforcer decides whether a subject may make a request
+type policyEnforcer interface {
+	Enforce(rvals ...any) (bool, error)
+}
+
+func rbac(e policyEnforcer) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token, err := auth.Authenticate(c.Request)
 		if err != nil {
@@ -232,16 +433,32 @@ func getFiles(c *gin.Context) {
 		return
 	}
 
-	files, err := Conf.API.DB.GetUserFiles(token.Subject())
+	page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	files, next, err := Conf.API.DB.GetUserFilesPage(token.Subject(), page)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, err.Error())
+
+		return
+	}
 	if err != nil {
 		// something went wrong with querying or parsing rows
 		c.JSON(502, err.Error())
 
 		return
 	}
+	total, err := Conf.API.DB.CountUserFiles(token.Subject())
+	if err != nil {
+		c.JSON(502, err.Error())
+
+		return
+	}
 
 	// Return response
-	c.JSON(200, files)
+	c.JSON(200, submissionFiles{listResponse: newListResponse(files, total).withNext(next), Completeness: submissionCompleteness(token.Subject())})
 }
 
 func ingestFile(c *gin.Context) {
@@ -257,6 +474,48 @@ func ingestFile(c *gin.Context) {
 
 		return
 	}
+	if !submissionFileInScope(c, ingest.User, ingest.FilePath) {
+		return
+	}
+	// urgent submissions are ingested ahead of the others
+	var priority uint64
+	if p, ok := c.GetQuery("priority"); ok {
+		var err error
+		if priority, err = strconv.ParseUint(p, 10, 8); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "priority must be an integer between 0 and 255")
+
+			return
+		}
+	}
+	// trace the queries as part of the request
+	db := Conf.API.DB.WithContext(c.Request.Context())
+
+	frozen, err := db.GetSubmissionFreeze(ingest.User)
+	if err != nil {
+		log.Errorf("failed to check submission freeze, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	if frozen != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, frozen.Message())
+
+		return
+	}
+
+	userQuota, err := db.GetUserQuota(ingest.User)
+	if err != nil {
+		log.Errorf("failed to get quota for user %s, reason: %v", ingest.User, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	if userQuota.Exceeded() {
+		c.AbortWithStatusJSON(http.StatusForbidden, fmt.Sprintf("storage quota exceeded for user %s", ingest.User))
+
+		return
+	}
+	checkQuotaWarning(userQuota)
 
 	ingest.Type = "ingest"
 	marshaledMsg, _ := json.Marshal(&ingest)
@@ -266,7 +525,7 @@ func ingestFile(c *gin.Context) {
 		return
 	}
 
-	corrID, err := Conf.API.DB.GetCorrID(ingest.User, ingest.FilePath, "")
+	corrID, err := db.GetCorrID(ingest.User, ingest.FilePath, "")
 	if err != nil {
 		switch {
 		case corrID == "":
@@ -278,9 +537,9 @@ func ingestFile(c *gin.Context) {
 		return
 	}
 
-	err = Conf.API.MQ.SendMessage(corrID, Conf.Broker.Exchange, "ingest", marshaledMsg)
+	err = Conf.API.MQ.SendPriorityMessage(c.Request.Context(), corrID, Conf.Broker.Exchange, "ingest", uint8(priority), marshaledMsg)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		abortWithRetry(c, http.StatusServiceUnavailable, err.Error())
 
 		return
 	}
@@ -310,6 +569,9 @@ func deleteFile(c *gin.Context) {
 
 		return
 	}
+	if !inboxFileInScope(c, submissionUser, fileID) {
+		return
+	}
 
 	// Get the file path from the fileID and submission user
 	filePath, err := Conf.API.DB.GetInboxFilePathFromID(submissionUser, fileID)
@@ -320,6 +582,19 @@ func deleteFile(c *gin.Context) {
 		return
 	}
 
+	if err := removeInboxFile(inbox, fileID, filePath, "api"); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// removeInboxFile removes a file from the inbox and marks it as deleted in
+// the db, with the user recorded as the one deleting it.
+func removeInboxFile(inbox storage.Backend, fileID, filePath, user string) error {
+	var err error
 	var RetryTimes = 5
 	for count := 1; count <= RetryTimes; count++ {
 		err = inbox.RemoveFile(filePath)
@@ -328,21 +603,24 @@ func deleteFile(c *gin.Context) {
 		}
 		log.Errorf("Remove file from inbox failed, reason: %v", err)
 		if count == 5 {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, ("remove file from inbox failed"))
-
-			return
+			return errors.New("remove file from inbox failed")
 		}
 		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
 	}
 
-	if err := Conf.API.DB.UpdateFileEventLog(fileID, "disabled", fileID, "api", "{}", "{}"); err != nil {
+	// files are soft deleted from schema v28, keeping their records for the audit trail
+	if Conf.API.DB.Version >= 28 {
+		err = Conf.API.DB.SetFileDeleted(fileID, user)
+	} else {
+		err = Conf.API.DB.SetFileStatus(fileID, "", "disabled", fileID, user, "{}", "{}")
+	}
+	if err != nil {
 		log.Errorf("set status deleted failed, reason: (%v)", err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
 
-		return
+		return err
 	}
 
-	c.Status(http.StatusOK)
+	return nil
 }
 
 func setAccession(c *gin.Context) {
@@ -358,8 +636,13 @@ func setAccession(c *gin.Context) {
 
 		return
 	}
+	if !submissionFileInScope(c, accession.User, accession.FilePath) {
+		return
+	}
+	// trace the queries as part of the request
+	db := Conf.API.DB.WithContext(c.Request.Context())
 
-	corrID, err := Conf.API.DB.GetCorrID(accession.User, accession.FilePath, "")
+	corrID, err := db.GetCorrID(accession.User, accession.FilePath, "")
 	if err != nil {
 		switch {
 		case corrID == "":
@@ -371,7 +654,7 @@ func setAccession(c *gin.Context) {
 		return
 	}
 
-	fileInfo, err := Conf.API.DB.GetFileInfo(corrID)
+	fileInfo, err := db.GetFileInfo(corrID)
 	if err != nil {
 		log.Debugln(err.Error())
 		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
@@ -380,6 +663,9 @@ func setAccession(c *gin.Context) {
 	}
 
 	accession.DecryptedChecksums = []schema.Checksums{{Type: "sha256", Value: fileInfo.DecryptedChecksum}}
+	if md5sum, ok := fileInfo.DecryptedChecksums["md5"]; ok {
+		accession.DecryptedChecksums = append(accession.DecryptedChecksums, schema.Checksums{Type: "md5", Value: md5sum})
+	}
 	accession.Type = "accession"
 	marshaledMsg, _ := json.Marshal(&accession)
 	if err := schema.ValidateJSON(fmt.Sprintf("%s/ingestion-accession.json", Conf.Broker.SchemasPath), marshaledMsg); err != nil {
@@ -389,10 +675,25 @@ func setAccession(c *gin.Context) {
 		return
 	}
 
-	err = Conf.API.MQ.SendMessage(corrID, Conf.Broker.Exchange, "accession", marshaledMsg)
+	// the file is marked as ready once the accession ID is set, which is
+	// refused unless the file has been verified
+	if err := db.CheckFileStatus(corrID, "ready"); err != nil {
+		var transitionErr *database.TransitionError
+		if errors.As(err, &transitionErr) {
+			c.AbortWithStatusJSON(http.StatusConflict, err.Error())
+
+			return
+		}
+		log.Errorf("failed to check the status of file %s, reason: %v", corrID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	err = Conf.API.MQ.SendMessageContext(c.Request.Context(), corrID, Conf.Broker.Exchange, "accession", marshaledMsg)
 	if err != nil {
 		log.Debugln(err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		abortWithRetry(c, http.StatusServiceUnavailable, err.Error())
 
 		return
 	}
@@ -421,6 +722,9 @@ func createDataset(c *gin.Context) {
 	}
 
 	for _, stableID := range dataset.AccessionIDs {
+		if !fileInScope(c, stableID) {
+			return
+		}
 		inboxPath, err := Conf.API.DB.GetInboxPath(stableID)
 		if err != nil {
 			switch {
@@ -453,10 +757,32 @@ func createDataset(c *gin.Context) {
 		}
 	}
 
+	// mint the dataset ID when none is given, so that concurrent admins can
+	// not end up creating the same dataset
+	if dataset.DatasetID == "" && Conf.API.DatasetPrefix != "" {
+		dataset.DatasetID, err = Conf.API.DB.MintDatasetID(Conf.API.DatasetPrefix, Conf.API.DatasetDigits)
+		if err != nil {
+			log.Errorf("failed to mint dataset ID, reason: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+			return
+		}
+		log.Infof("minted dataset ID %s", dataset.DatasetID)
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
 	mapping := schema.DatasetMapping{
 		Type:         "mapping",
 		AccessionIDs: dataset.AccessionIDs,
 		DatasetID:    dataset.DatasetID,
+		Actor:        token.Subject(),
+		Source:       "api",
 	}
 	marshaledMsg, _ := json.Marshal(&mapping)
 	if err := schema.ValidateJSON(fmt.Sprintf("%s/dataset-mapping.json", Conf.Broker.SchemasPath), marshaledMsg); err != nil {
@@ -466,19 +792,23 @@ func createDataset(c *gin.Context) {
 		return
 	}
 
-	err = Conf.API.MQ.SendMessage("", Conf.Broker.Exchange, "mappings", marshaledMsg)
+	// the correlation ID is recorded with the mappings to trace them back to the request
+	err = Conf.API.MQ.SendMessageContext(c.Request.Context(), uuid.New().String(), Conf.Broker.Exchange, "mappings", marshaledMsg)
 	if err != nil {
 		log.Debugln(err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		abortWithRetry(c, http.StatusServiceUnavailable, err.Error())
 
 		return
 	}
 
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusOK, gin.H{"dataset_id": dataset.DatasetID})
 }
 
 func releaseDataset(c *gin.Context) {
 	datasetID := strings.TrimPrefix(c.Param("dataset"), "/")
+	if !datasetInScope(c, datasetID) {
+		return
+	}
 	ok, err := Conf.API.DB.CheckIfDatasetExists(datasetID)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
@@ -515,10 +845,10 @@ func releaseDataset(c *gin.Context) {
 		return
 	}
 
-	err = Conf.API.MQ.SendMessage("", Conf.Broker.Exchange, "mappings", marshaledMsg)
+	err = Conf.API.MQ.SendMessageContext(c.Request.Context(), "", Conf.Broker.Exchange, "mappings", marshaledMsg)
 	if err != nil {
 		log.Debugln(err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		abortWithRetry(c, http.StatusServiceUnavailable, err.Error())
 
 		return
 	}
@@ -526,15 +856,57 @@ func releaseDataset(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+// listActiveUsers returns the users with active uploads, with the number of
+// files, total bytes and last upload of each user when detailed=true
 func listActiveUsers(c *gin.Context) {
-	users, err := Conf.API.DB.ListActiveUsers()
+	detailed, err := strconv.ParseBool(c.DefaultQuery("detailed", "false"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "invalid detailed parameter")
+
+		return
+	}
+	if detailed {
+		sendActiveUsers(c, Conf.API.DB.ListActiveUsersDetailedPage, func(u *database.ActiveUser) string { return u.User })
+
+		return
+	}
+	sendActiveUsers(c, Conf.API.DB.ListActiveUsersPage, func(u string) string { return u })
+}
+
+// sendActiveUsers responds with the page of active users returned by list,
+// limited to the admin's projects
+func sendActiveUsers[T any](c *gin.Context, list func(database.Page) ([]T, string, error), name func(T) string) {
+	page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	users, next, err := list(page)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+
+		return
+	}
 	if err != nil {
 		log.Debugln("ListActiveUsers failed")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
 
 		return
 	}
-	c.JSON(http.StatusOK, users)
+	total, err := Conf.API.DB.CountActiveUsers()
+	if err != nil {
+		log.Debugln("CountActiveUsers failed")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	scoped, ok := filterInScope(c, users, false, func(u T) ([]string, error) { return Conf.API.DB.GetUserProjects(name(u)) })
+	if !ok {
+		return
+	}
+	if len(scoped) != len(users) {
+		total = len(scoped)
+	}
+	c.JSON(http.StatusOK, newListResponse(scoped, total).withNext(next))
 }
 
 // listUserFiles returns a list of files for a specific user
@@ -544,7 +916,25 @@ func listUserFiles(c *gin.Context) {
 	username = strings.TrimPrefix(username, "/")
 	username = strings.TrimSuffix(username, "/files")
 	log.Debugln(username)
-	files, err := Conf.API.DB.GetUserFiles(username)
+	if !userInScope(c, username) {
+		return
+	}
+	page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	files, next, err := Conf.API.DB.GetUserFilesPage(username, page)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	total, err := Conf.API.DB.CountUserFiles(username)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
 
@@ -552,7 +942,7 @@ func listUserFiles(c *gin.Context) {
 	}
 
 	c.Writer.Header().Set("Content-Type", "application/json")
-	c.JSON(200, files)
+	c.JSON(200, submissionFiles{listResponse: newListResponse(files, total).withNext(next), Completeness: submissionCompleteness(username)})
 }
 
 // addC4ghHash handles the addition of a hashed public key to the database.
@@ -562,6 +952,9 @@ func listUserFiles(c *gin.Context) {
 // If the database insertion fails, it responds with a 500 Internal Server Error status.
 // On success, it responds with a 200 OK status.
 func addC4ghHash(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
 	var c4gh schema.C4ghPubKey
 	if err := c.BindJSON(&c4gh); err != nil {
 		c.AbortWithStatusJSON(
@@ -653,10 +1046,31 @@ func listC4ghHashes(c *gin.Context) {
 		}
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
-	c.JSON(200, hashes)
+	c.JSON(200, newListResponse(hashes, len(hashes)))
+}
+
+// listKeyHashFiles lists the files encrypted with a key, so that they can be
+// re-encrypted when the key is compromised or rotated
+func listKeyHashFiles(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+	keyHash := strings.TrimPrefix(c.Param("keyHash"), "/")
+	files, err := Conf.API.DB.GetFilesByKeyHash(keyHash)
+	if err != nil {
+		log.Errorf("failed to list files for key hash, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(files, len(files)))
 }
 
 func deprecateC4ghHash(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
 	keyHash := strings.TrimPrefix(c.Param("keyHash"), "/")
 	err = Conf.API.DB.DeprecateKeyHash(keyHash)
 	if err != nil {
@@ -674,11 +1088,20 @@ func listAllDatasets(c *gin.Context) {
 
 		return
 	}
-	c.JSON(http.StatusOK, datasets)
+	datasets, ok := filterInScope(c, datasets, true, func(d *database.DatasetInfo) ([]string, error) {
+		return Conf.API.DB.GetDatasetProjects(d.DatasetID)
+	})
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, newListResponse(datasets, len(datasets)))
 }
 
 func listUserDatasets(c *gin.Context) {
 	username := strings.TrimPrefix(c.Param("username"), "/")
+	if !userInScope(c, username) {
+		return
+	}
 	datasets, err := Conf.API.DB.ListUserDatasets(username)
 	if err != nil {
 		log.Errorf("ListUserDatasets failed, reason: %s", err.Error())
@@ -686,7 +1109,7 @@ func listUserDatasets(c *gin.Context) {
 
 		return
 	}
-	c.JSON(http.StatusOK, datasets)
+	c.JSON(http.StatusOK, newListResponse(datasets, len(datasets)))
 }
 
 func listDatasets(c *gin.Context) {
@@ -703,7 +1126,7 @@ func listDatasets(c *gin.Context) {
 
 		return
 	}
-	c.JSON(http.StatusOK, datasets)
+	c.JSON(http.StatusOK, newListResponse(datasets, len(datasets)))
 }
 
 func reVerify(c *gin.Context, accessionID string) (*gin.Context, error) {
@@ -734,9 +1157,9 @@ func reVerify(c *gin.Context, accessionID string) (*gin.Context, error) {
 		return c, err
 	}
 
-	err = Conf.API.MQ.SendMessage(corrID, Conf.Broker.Exchange, "archived", marshaledMsg)
+	err = Conf.API.MQ.SendMessageContext(c.Request.Context(), corrID, Conf.Broker.Exchange, "archived", marshaledMsg)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		abortWithRetry(c, http.StatusServiceUnavailable, err.Error())
 
 		return c, err
 	}
@@ -746,6 +1169,9 @@ func reVerify(c *gin.Context, accessionID string) (*gin.Context, error) {
 
 func reVerifyFile(c *gin.Context) {
 	accessionID := strings.TrimPrefix(c.Param("accession"), "/")
+	if !fileInScope(c, accessionID) {
+		return
+	}
 	c, err = reVerify(c, accessionID)
 	if err != nil {
 		return
@@ -756,20 +1182,23 @@ func reVerifyFile(c *gin.Context) {
 
 func reVerifyDataset(c *gin.Context) {
 	dataset := strings.TrimPrefix(c.Param("dataset"), "/")
-	accessions, err := Conf.API.DB.GetDatasetFiles(dataset)
+	if !datasetInScope(c, dataset) {
+		return
+	}
+	files, err := Conf.API.DB.GetDatasetFiles(dataset)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
 
 		return
 	}
-	if accessions == nil {
+	if files == nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, "dataset not found")
 
 		return
 	}
 
-	for _, accession := range accessions {
-		c, err = reVerify(c, accession)
+	for _, file := range files {
+		c, err = reVerify(c, file.AccessionID)
 		if err != nil {
 			return
 		}
@@ -777,3 +1206,491 @@ func reVerifyDataset(c *gin.Context) {
 
 	c.Status(http.StatusOK)
 }
+
+// getFileByAccession returns the location, dataset membership and status
+// of the file with the given accession ID.
+func getFileByAccession(c *gin.Context) {
+	stableID := c.Param("stableID")
+	if !fileInScope(c, stableID) {
+		return
+	}
+
+	inboxPath, err := Conf.API.DB.GetInboxPath(stableID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, "accession ID not found")
+
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	archivePath, err := Conf.API.DB.GetArchivePath(stableID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	datasets, err := Conf.API.DB.GetFileDatasets(stableID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	status, err := Conf.API.DB.GetFileStatusByStableID(stableID)
+	if err != nil && err != sql.ErrNoRows {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	replicas, err := Conf.API.DB.GetFileReplicas(stableID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, accessionFile{
+		AccessionID: stableID,
+		InboxPath:   inboxPath,
+		ArchivePath: archivePath,
+		Datasets:    datasets,
+		Status:      status,
+		Replicas:    replicas,
+	})
+}
+
+// freezeSubmission blocks new uploads and ingestion for a user or a project,
+// files already being processed are not affected.
+func freezeSubmission(c *gin.Context) {
+	var f freeze
+	if err := c.BindJSON(&f); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				"error":  "json decoding : " + err.Error(),
+				"status": http.StatusBadRequest,
+			},
+		)
+
+		return
+	}
+
+	if f.Scope != "user" && f.Scope != "project" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "scope must be one of user or project")
+
+		return
+	}
+	if f.Name == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "name is required")
+
+		return
+	}
+	if !freezeInScope(c, f.Scope, f.Name) {
+		return
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	if err := Conf.API.DB.FreezeSubmission(f.Scope, f.Name, f.Reason, token.Subject()); err != nil {
+		if strings.Contains(err.Error(), "already frozen") {
+			c.AbortWithStatusJSON(http.StatusConflict, err.Error())
+
+			return
+		}
+		log.Errorf("failed to freeze submissions, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	log.Infof("submissions for %s %s frozen by %s", f.Scope, f.Name, token.Subject())
+
+	c.Status(http.StatusOK)
+}
+
+func unfreezeSubmission(c *gin.Context) {
+	scope := c.Param("scope")
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	if !freezeInScope(c, scope, name) {
+		return
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	if err := Conf.API.DB.UnfreezeSubmission(scope, name, token.Subject()); err != nil {
+		if strings.Contains(err.Error(), "no active freeze") {
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+
+			return
+		}
+		log.Errorf("failed to lift submission freeze, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	log.Infof("submission freeze for %s %s lifted by %s", scope, name, token.Subject())
+
+	c.Status(http.StatusOK)
+}
+
+func listSubmissionFreezes(c *gin.Context) {
+	freezes, err := Conf.API.DB.ListSubmissionFreezes()
+	if err != nil {
+		log.Errorf("ListSubmissionFreezes failed, reason: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	freezes, ok := filterInScope(c, freezes, false, func(f database.SubmissionFreeze) ([]string, error) {
+		if f.Scope == "project" {
+			return []string{f.Name}, nil
+		}
+
+		return Conf.API.DB.GetUserProjects(f.Name)
+	})
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, newListResponse(freezes, len(freezes)))
+}
+
+func getUserQuota(c *gin.Context) {
+	username := strings.TrimPrefix(c.Param("username"), "/")
+	if !userInScope(c, username) {
+		return
+	}
+	userQuota, err := Conf.API.DB.GetUserQuota(username)
+	if err != nil {
+		log.Errorf("GetUserQuota failed, reason: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, userQuota)
+}
+
+// getUploadSession summarizes how far the files uploaded in a session have
+// come, from the inbox to the datasets they belong to
+func getUploadSession(c *gin.Context) {
+	session, err := Conf.API.DB.GetUploadSession(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.AbortWithStatusJSON(http.StatusNotFound, "upload session not found")
+
+			return
+		}
+		log.Errorf("GetUploadSession failed, reason: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	if !userInScope(c, session.User) {
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// getUserUsage returns the storage usage of a user together with the highest
+// quota warning threshold reached and the one the user was last notified about
+func getUserUsage(c *gin.Context) {
+	username := strings.TrimPrefix(c.Param("username"), "/")
+	if !userInScope(c, username) {
+		return
+	}
+	userQuota, err := Conf.API.DB.GetUserQuota(username)
+	if err != nil {
+		log.Errorf("GetUserQuota failed, reason: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, userUsage{
+		UserQuota:        userQuota,
+		UsagePercent:     math.Round(userQuota.UsagePercent()*100) / 100,
+		Exceeded:         userQuota.Exceeded(),
+		WarningThreshold: userQuota.WarningThreshold(Conf.API.QuotaWarnings),
+		Notified:         userQuota.Warned,
+		Thresholds:       Conf.API.QuotaWarnings,
+	})
+}
+
+// checkQuotaWarning sends a quota warning to the notify service when the
+// user has reached a new warning threshold. Failures are only logged since
+// they should not block the ingestion.
+func checkQuotaWarning(q database.UserQuota) {
+	if Conf.API.DB.Version < 21 {
+		return
+	}
+
+	threshold := q.WarningThreshold(Conf.API.QuotaWarnings)
+	if threshold == q.Warned {
+		return
+	}
+
+	if threshold > q.Warned {
+		warning, err := events.Marshal(Conf.Broker.SchemasPath, events.QuotaWarning{User: q.User, Quota: q.Quota, Used: q.Used, Threshold: threshold})
+		if err != nil {
+			log.Errorf("quota warning for %s failed validation, reason: %v", q.User, err)
+
+			return
+		}
+		if err := Conf.API.MQ.SendMessage("", Conf.Broker.Exchange, "quota", warning); err != nil {
+			log.Errorf("failed to send quota warning for %s, reason: %v", q.User, err)
+
+			return
+		}
+		log.Infof("user %s has used %d%% of the storage quota", q.User, threshold)
+	}
+
+	// a lower threshold means the usage has dropped, the user will be warned again when it grows
+	if err := Conf.API.DB.SetQuotaWarning(q.User, threshold); err != nil {
+		log.Errorf("failed to record quota warning for %s, reason: %v", q.User, err)
+	}
+}
+
+// setUserQuota sets the storage quota in bytes for a user, a quota of 0
+// removes the limit.
+func setUserQuota(c *gin.Context) {
+	var q quota
+	if err := c.BindJSON(&q); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				"error":  "json decoding : " + err.Error(),
+				"status": http.StatusBadRequest,
+			},
+		)
+
+		return
+	}
+	if q.Quota < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "quota can not be negative")
+
+		return
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	username := strings.TrimPrefix(c.Param("username"), "/")
+	if !userInScope(c, username) {
+		return
+	}
+	if err := Conf.API.DB.SetUserQuota(username, q.Quota, token.Subject()); err != nil {
+		log.Errorf("failed to set quota for user %s, reason: %v", username, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	log.Infof("storage quota for %s set to %d bytes by %s", username, q.Quota, token.Subject())
+
+	c.Status(http.StatusOK)
+}
+
+// grantFileAccess gives a user access to a subset of the files in a dataset,
+// used when a data access decision does not cover the entire dataset.
+func grantFileAccess(c *gin.Context) {
+	var grant fileGrant
+	if err := c.BindJSON(&grant); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				"error":  "json decoding : " + err.Error(),
+				"status": http.StatusBadRequest,
+			},
+		)
+
+		return
+	}
+	if grant.User == "" || len(grant.AccessionIDs) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "user and accession_ids are required")
+
+		return
+	}
+	for _, accessionID := range grant.AccessionIDs {
+		if !fileInScope(c, accessionID) {
+			return
+		}
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	if err := Conf.API.DB.GrantFileAccess(grant.User, grant.AccessionIDs, token.Subject()); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+
+			return
+		}
+		log.Errorf("failed to grant file access, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	log.Infof("access to %d files granted to %s by %s", len(grant.AccessionIDs), grant.User, token.Subject())
+
+	c.Status(http.StatusOK)
+}
+
+func revokeFileAccess(c *gin.Context) {
+	username := c.Param("username")
+	accession := c.Param("accession")
+	if !fileInScope(c, accession) {
+		return
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	if err := Conf.API.DB.RevokeFileAccess(username, accession, token.Subject()); err != nil {
+		if strings.Contains(err.Error(), "no active grant") {
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+
+			return
+		}
+		log.Errorf("failed to revoke file access, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	log.Infof("access to %s for %s revoked by %s", accession, username, token.Subject())
+
+	c.Status(http.StatusOK)
+}
+
+func listFileGrants(c *gin.Context) {
+	grants, err := Conf.API.DB.ListFileGrants(c.Param("username"))
+	if err != nil {
+		log.Errorf("ListFileGrants failed, reason: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	grants, ok := filterInScope(c, grants, true, func(g database.FileGrant) ([]string, error) {
+		project, err := Conf.API.DB.GetFileProject(g.AccessionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return []string{project}, err
+	})
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(grants, len(grants)))
+}
+
+// registerReplicas records where an external long-term preservation service,
+// e.g. a national tape store, keeps copies of archived files.
+func registerReplicas(c *gin.Context) {
+	var reg replicaRegistration
+	if err := c.BindJSON(&reg); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				"error":  "json decoding : " + err.Error(),
+				"status": http.StatusBadRequest,
+			},
+		)
+
+		return
+	}
+	if reg.Service == "" || len(reg.Replicas) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "service and replicas are required")
+
+		return
+	}
+
+	replicas := make([]database.Replica, 0, len(reg.Replicas))
+	for _, r := range reg.Replicas {
+		if r.AccessionID == "" || r.Location == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "accession_id and location are required for each replica")
+
+			return
+		}
+		if r.Checksum != "" && !slices.Contains(database.ChecksumAlgorithms, strings.ToLower(r.ChecksumType)) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "checksum_type must be one of "+strings.Join(database.ChecksumAlgorithms, ", "))
+
+			return
+		}
+		if !fileInScope(c, r.AccessionID) {
+			return
+		}
+		replicas = append(replicas, database.Replica{AccessionID: r.AccessionID, Service: reg.Service, Location: r.Location, Checksum: r.Checksum, ChecksumType: r.ChecksumType})
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	if err := Conf.API.DB.RegisterReplicas(replicas, token.Subject()); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+
+			return
+		}
+		log.Errorf("failed to register replicas, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	log.Infof("%d replicas at %s registered by %s", len(replicas), reg.Service, token.Subject())
+
+	c.Status(http.StatusOK)
+}
+
+func removeReplica(c *gin.Context) {
+	service := c.Param("service")
+	accession := c.Param("accession")
+	if !fileInScope(c, accession) {
+		return
+	}
+
+	if err := Conf.API.DB.RemoveReplica(service, accession); err != nil {
+		if strings.Contains(err.Error(), "no replica") {
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+
+			return
+		}
+		log.Errorf("failed to remove replica, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
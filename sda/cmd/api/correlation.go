@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// backfillJob is the state of the correlation ID backfill, only one can run
+// at a time
+type backfillJob struct {
+	Running   bool   `json:"running"`
+	StartedBy string `json:"startedBy,omitempty"`
+	Started   string `json:"started,omitempty"`
+	Finished  string `json:"finished,omitempty"`
+	Updated   int64  `json:"updated"`
+	Error     string `json:"error,omitempty"`
+}
+
+var (
+	backfillMu sync.Mutex
+	backfill   backfillJob
+)
+
+// checkCorrelationIDs reports files whose events are missing their
+// canonical correlation ID or carry conflicting ones
+func checkCorrelationIDs(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "limit must be a positive integer")
+
+		return
+	}
+
+	issues, err := Conf.API.DB.CheckCorrelationIDs(limit)
+	if err != nil {
+		log.Errorf("failed to check correlation IDs, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(issues, len(issues)))
+}
+
+// startCorrelationIDBackfill starts setting the canonical correlation ID on
+// all events in the background, the progress is followed with
+// getCorrelationIDBackfill
+func startCorrelationIDBackfill(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	backfillMu.Lock()
+	defer backfillMu.Unlock()
+	if backfill.Running {
+		c.AbortWithStatusJSON(http.StatusConflict, "a correlation ID backfill is already running")
+
+		return
+	}
+	backfill = backfillJob{Running: true, StartedBy: token.Subject(), Started: time.Now().UTC().Format(time.RFC3339)}
+	log.Infof("correlation ID backfill started by %s", token.Subject())
+
+	go func() {
+		updated, err := Conf.API.DB.BackfillCorrelationIDs()
+
+		backfillMu.Lock()
+		defer backfillMu.Unlock()
+		backfill.Running = false
+		backfill.Finished = time.Now().UTC().Format(time.RFC3339)
+		backfill.Updated = updated
+		if err != nil {
+			log.Errorf("correlation ID backfill failed, reason: %v", err)
+			backfill.Error = err.Error()
+
+			return
+		}
+		log.Infof("correlation ID backfill done, %d events updated", updated)
+	}()
+
+	c.JSON(http.StatusAccepted, backfill)
+}
+
+// getCorrelationIDBackfill returns the state of the last backfill
+func getCorrelationIDBackfill(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	backfillMu.Lock()
+	defer backfillMu.Unlock()
+
+	c.JSON(http.StatusOK, backfill)
+}
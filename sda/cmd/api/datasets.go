@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// datasetDetail is the status and event log of a dataset together with the
+// files mapped to it and who mapped them
+type datasetDetail struct {
+	DatasetID string                  `json:"datasetID"`
+	Status    string                  `json:"status"`
+	Events    []database.DatasetEvent `json:"events"`
+	Files     []database.FileMapping  `json:"files"`
+}
+
+// getDatasetInfo returns the details of a dataset, including the provenance
+// of the mappings of its files
+func getDatasetInfo(c *gin.Context) {
+	datasetID := strings.TrimPrefix(c.Param("dataset"), "/")
+	if !datasetInScope(c, datasetID) {
+		return
+	}
+
+	ok, err := Conf.API.DB.CheckIfDatasetExists(datasetID)
+	if err != nil {
+		log.Errorf("failed to look up dataset %s, reason: %v", datasetID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, "dataset not found")
+
+		return
+	}
+
+	detail := datasetDetail{DatasetID: datasetID}
+	if detail.Status, err = Conf.API.DB.GetDatasetStatus(datasetID); err == nil {
+		detail.Events, err = Conf.API.DB.GetDatasetEvents(datasetID)
+	}
+	if err == nil {
+		detail.Files, err = Conf.API.DB.GetDatasetMappings(datasetID)
+	}
+	if err != nil {
+		log.Errorf("failed to get details of dataset %s, reason: %v", datasetID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, detail)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// deletionRequest is a submitter's request to delete one of their files
+// from the inbox
+type deletionRequest struct {
+	FileID string `json:"file_id"`
+	Reason string `json:"reason"`
+}
+
+// deletionReview is an admin's decision on a deletion request
+type deletionReview struct {
+	Reason string `json:"reason"`
+}
+
+// requestDeletion queues a deletion request for a file of the submitter,
+// the file is deleted once an admin approves the request
+func requestDeletion(c *gin.Context) {
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	var request deletionRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				"error":  "json decoding : " + err.Error(),
+				"status": http.StatusBadRequest,
+			},
+		)
+
+		return
+	}
+	if request.FileID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "file_id is required")
+
+		return
+	}
+
+	id, err := Conf.API.DB.RequestDeletion(request.FileID, token.Subject(), request.Reason)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "already requested"):
+			c.AbortWithStatusJSON(http.StatusConflict, err.Error())
+		case strings.Contains(err.Error(), "not found"):
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+		default:
+			log.Errorf("failed to request deletion, reason: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		}
+
+		return
+	}
+	log.Infof("deletion of file %s requested by %s", request.FileID, token.Subject())
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// listOwnDeletionRequests lists the deletion requests made by the submitter
+func listOwnDeletionRequests(c *gin.Context) {
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	requests, err := Conf.API.DB.ListDeletionRequests(token.Subject(), "")
+	if err != nil {
+		log.Errorf("ListDeletionRequests failed, reason: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(requests, len(requests)))
+}
+
+// listDeletionRequests lists the deletion requests of the users in the
+// admin's projects, optionally filtered on status
+func listDeletionRequests(c *gin.Context) {
+	status := c.Query("status")
+	if status != "" && !slices.Contains([]string{"pending", "approved", "rejected"}, status) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "status must be one of pending, approved or rejected")
+
+		return
+	}
+
+	requests, err := Conf.API.DB.ListDeletionRequests("", status)
+	if err != nil {
+		log.Errorf("ListDeletionRequests failed, reason: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	requests, ok := filterInScope(c, requests, false, func(r database.DeletionRequest) ([]string, error) {
+		return Conf.API.DB.GetUserProjects(r.User)
+	})
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(requests, len(requests)))
+}
+
+// approveDeletionRequest approves a pending deletion request and deletes
+// the file from the inbox
+func approveDeletionRequest(c *gin.Context) {
+	request, reviewer, ok := pendingDeletionRequest(c)
+	if !ok {
+		return
+	}
+
+	var review deletionReview
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&review); err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusBadRequest,
+				gin.H{
+					"error":  "json decoding : " + err.Error(),
+					"status": http.StatusBadRequest,
+				},
+			)
+
+			return
+		}
+	}
+
+	inbox, err := storage.NewBackend(Conf.Inbox)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	// the file may have been ingested since the request was made
+	filePath, err := Conf.API.DB.GetInboxFilePathFromID(request.User, request.FileID)
+	if err != nil {
+		log.Errorf("getting file from fileID failed, reason: (%v)", err)
+		c.AbortWithStatusJSON(http.StatusConflict, "file is no longer in the inbox, the request can only be rejected")
+
+		return
+	}
+
+	request, err = Conf.API.DB.ReviewDeletionRequest(request.ID, true, reviewer, review.Reason)
+	if err != nil {
+		reviewFailed(c, err)
+
+		return
+	}
+	log.Infof("deletion request %d for file %s approved by %s", request.ID, request.FileID, reviewer)
+
+	if err := removeInboxFile(inbox, request.FileID, filePath, reviewer); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, "request approved but deleting the file failed, retry with DELETE /file/"+request.User+"/"+request.FileID+": "+err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// rejectDeletionRequest rejects a pending deletion request, a reason is
+// required so that the submitter knows why the file was kept
+func rejectDeletionRequest(c *gin.Context) {
+	request, reviewer, ok := pendingDeletionRequest(c)
+	if !ok {
+		return
+	}
+
+	var review deletionReview
+	if err := c.BindJSON(&review); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				"error":  "json decoding : " + err.Error(),
+				"status": http.StatusBadRequest,
+			},
+		)
+
+		return
+	}
+	if review.Reason == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "reason is required")
+
+		return
+	}
+
+	request, err := Conf.API.DB.ReviewDeletionRequest(request.ID, false, reviewer, review.Reason)
+	if err != nil {
+		reviewFailed(c, err)
+
+		return
+	}
+	log.Infof("deletion request %d for file %s rejected by %s", request.ID, request.FileID, reviewer)
+
+	c.JSON(http.StatusOK, request)
+}
+
+// pendingDeletionRequest looks up the deletion request in the path and
+// checks that it is pending and that its user is in the admin's projects
+func pendingDeletionRequest(c *gin.Context) (*database.DeletionRequest, string, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "id must be a number")
+
+		return nil, "", false
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return nil, "", false
+	}
+
+	request, err := Conf.API.DB.GetDeletionRequest(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+
+			return nil, "", false
+		}
+		log.Errorf("GetDeletionRequest failed, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return nil, "", false
+	}
+	if !userInScope(c, request.User) {
+		return nil, "", false
+	}
+	if request.Status != "pending" {
+		c.AbortWithStatusJSON(http.StatusConflict, "deletion request is already "+request.Status)
+
+		return nil, "", false
+	}
+
+	return request, token.Subject(), true
+}
+
+func reviewFailed(c *gin.Context, err error) {
+	if strings.Contains(err.Error(), "no pending") {
+		c.AbortWithStatusJSON(http.StatusConflict, err.Error())
+
+		return
+	}
+	log.Errorf("failed to review deletion request, reason: %v", err)
+	c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	log "github.com/sirupsen/logrus"
+)
+
+// eventHub passes the file and dataset events announced by the database on
+// to the clients of the /events stream, so that they share one listening
+// connection
+type eventHub struct {
+	mu      sync.Mutex
+	running bool
+	clients map[chan database.Event]struct{}
+}
+
+var hub = &eventHub{clients: map[chan database.Event]struct{}{}}
+
+// run forwards the events of sub until ctx is cancelled or sub is closed.
+// Clients that do not keep up miss events rather than holding up the others.
+func (h *eventHub) run(ctx context.Context, sub *database.Subscriber) error {
+	h.mu.Lock()
+	h.running = true
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.running = false
+		for ch := range h.clients {
+			close(ch)
+			delete(h.clients, ch)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				return nil
+			}
+			h.mu.Lock()
+			for ch := range h.clients {
+				select {
+				case ch <- e:
+				default:
+					log.Warnf("event stream client is not keeping up, dropping event %d", e.ID)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// eventsComponent listens for database events once the database is
+// connected. The api runs without the event stream on older schemas.
+func eventsComponent() lifecycle.Component {
+	var sub *database.Subscriber
+
+	return lifecycle.Component{
+		Name:      "events",
+		DependsOn: []string{"database"},
+		Start: func(context.Context) error {
+			var err error
+			sub, err = Conf.API.DB.Subscribe(database.FileEventsChannel, database.DatasetEventsChannel)
+			if err != nil {
+				log.Warnf("event stream disabled, reason: %v", err)
+			}
+
+			return nil
+		},
+		Run: func(ctx context.Context) error {
+			if sub == nil {
+				<-ctx.Done()
+
+				return nil
+			}
+
+			return hub.run(ctx, sub)
+		},
+		Stop: func(context.Context) error {
+			if sub == nil {
+				return nil
+			}
+
+			return sub.Close()
+		},
+	}
+}
+
+// subscribe adds a client, it returns false when no events are forwarded
+func (h *eventHub) subscribe() (chan database.Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.running {
+		return nil, false
+	}
+
+	ch := make(chan database.Event, 100)
+	h.clients[ch] = struct{}{}
+
+	return ch, true
+}
+
+func (h *eventHub) unsubscribe(ch chan database.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[ch]; ok {
+		close(ch)
+		delete(h.clients, ch)
+	}
+}
+
+// streamEvents sends new file and dataset events to the client as server-sent
+// events, named "file" or "dataset" after the kind of event.
+func streamEvents(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	ch, ok := hub.subscribe()
+	if !ok {
+		abortWithRetry(c, http.StatusServiceUnavailable, "event stream not available")
+
+		return
+	}
+	defer hub.unsubscribe(ch)
+
+	// the stream is kept open for as long as the client wants it
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Debugf("failed to clear write deadline for event stream, reason: %v", err)
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			_, _ = w.Write([]byte(": keep-alive\n\n"))
+
+			return true
+		case e, ok := <-ch:
+			if !ok {
+				return false
+			}
+			name := "file"
+			if e.Channel == database.DatasetEventsChannel {
+				name = "dataset"
+			}
+			data, _ := json.Marshal(e)
+			c.SSEvent(name, string(data))
+
+			return true
+		}
+	})
+}
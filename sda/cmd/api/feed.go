@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// atomFeed is an Atom (RFC 4287) feed of released datasets
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomEntry struct {
+	ID      string `xml:"id"`
+	Title   string `xml:"title"`
+	Updated string `xml:"updated"`
+	Summary string `xml:"summary"`
+}
+
+// releaseFeed serves the most recently released datasets as an Atom feed,
+// so that downstream users can subscribe to new data becoming available.
+func releaseFeed(c *gin.Context) {
+	datasets, err := Conf.API.DB.ListReleasedDatasets(Conf.API.ReleaseFeedSize)
+	if err != nil {
+		log.Errorf("failed to list released datasets, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, "failed to list released datasets")
+
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	self := scheme + "://" + c.Request.Host + c.Request.URL.Path
+
+	feed := atomFeed{
+		ID:      self,
+		Title:   "Released datasets",
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		Link:    atomLink{Href: self, Rel: "self"},
+		Entries: make([]atomEntry, 0, len(datasets)),
+	}
+	if len(datasets) > 0 {
+		feed.Updated = datasets[0].Timestamp
+	}
+	for _, d := range datasets {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      "urn:dataset:" + d.DatasetID,
+			Title:   d.DatasetID,
+			Updated: d.Timestamp,
+			Summary: "Dataset " + d.DatasetID + " has been released and is available for access.",
+		})
+	}
+
+	c.Header("Content-Type", "application/atom+xml; charset=utf-8")
+	c.Status(http.StatusOK)
+	_, _ = c.Writer.WriteString(xml.Header)
+	if err := xml.NewEncoder(c.Writer).Encode(feed); err != nil {
+		log.Errorf("failed to encode release feed, reason: %v", err)
+	}
+}
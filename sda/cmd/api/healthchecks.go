@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/broker"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// healthCheckTimeout is how long to wait for a single dependency to respond
+var healthCheckTimeout = 5 * time.Second
+
+// componentHealth is the state of a single dependency as reported by /health
+type componentHealth struct {
+	Status      string `json:"status"`
+	LatencyMs   int64  `json:"latencyMs"`
+	LastError   string `json:"lastError,omitempty"`
+	LastErrorAt string `json:"lastErrorAt,omitempty"`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components"`
+}
+
+// lastErrors keeps the most recent error for each component, so that
+// intermittent failures are visible even after the dependency recovered.
+var lastErrors = struct {
+	sync.Mutex
+	errors map[string]componentHealth
+}{errors: map[string]componentHealth{}}
+
+// errNotConfigured is returned by checks for dependencies the service is not
+// configured to use
+var errNotConfigured = errors.New("not configured")
+
+// Reasons of failed checks that are reported as they are by /health
+var (
+	errConnectionClosed = errors.New("connection to broker was closed")
+	errChannelClosed    = errors.New("channel to broker was closed")
+	errNotDirectory     = errors.New("not a directory")
+	errUnexpectedStatus = errors.New("unexpected status")
+)
+
+// healthClient is the client of the checks of HTTP endpoints
+var healthClient = &http.Client{Timeout: healthCheckTimeout}
+
+// storageClients are the S3 clients of the storage checks, by storage. They
+// are created at the first check and reused by the following ones.
+var storageClients = struct {
+	sync.Mutex
+	clients map[string]*s3.Client
+}{clients: map[string]*s3.Client{}}
+
+// healthStatus reports the state of each dependency, the status code is
+// 503 if any of the configured dependencies fails its check. /health is not
+// authenticated, so the errors are redacted and only logged in full, and the
+// checks only look at the dependencies without trying to reconnect to them.
+func healthStatus(c *gin.Context) {
+	statusCode, components := checkHealth()
+
+	status := "ok"
+	if statusCode != http.StatusOK {
+		status = "failing"
+		c.Header("Retry-After", strconv.Itoa(int(Conf.API.RetryAfter.Seconds())))
+	}
+
+	c.JSON(statusCode, healthResponse{Status: status, Components: components})
+}
+
+// checkHealth runs all health checks and returns the resulting status code
+// together with the state of each dependency.
+func checkHealth() (int, map[string]componentHealth) {
+	checks := map[string]func() error{
+		"database":       checkDatabase,
+		"broker":         checkBroker,
+		"inboxStorage":   func() error { return checkStorage("inbox", Conf.Inbox) },
+		"archiveStorage": func() error { return checkStorage("archive", Conf.Archive) },
+		"jwks":           checkJWKS,
+	}
+
+	statusCode := http.StatusOK
+	components := map[string]componentHealth{}
+	for name, check := range checks {
+		start := time.Now()
+		err := check()
+		health := componentHealth{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+
+		lastErrors.Lock()
+		switch {
+		case errors.Is(err, errNotConfigured):
+			health = componentHealth{Status: "not configured"}
+		case err != nil:
+			log.Warnf("health check for %s failed, reason: %v", name, err)
+			statusCode = http.StatusServiceUnavailable
+			health.Status = "error"
+			lastErrors.errors[name] = componentHealth{LastError: redactError(err), LastErrorAt: time.Now().UTC().Format(time.RFC3339)}
+		}
+		if last, ok := lastErrors.errors[name]; ok {
+			health.LastError = last.LastError
+			health.LastErrorAt = last.LastErrorAt
+		}
+		lastErrors.Unlock()
+
+		components[name] = health
+	}
+
+	return statusCode, components
+}
+
+// redactError describes why a check failed without the addresses, paths and
+// credentials that the error may contain.
+func redactError(err error) string {
+	var netErr net.Error
+	var pathErr *fs.PathError
+	var apiErr smithy.APIError
+	for _, reported := range []error{errConnectionClosed, errChannelClosed, errNotDirectory, errUnexpectedStatus} {
+		if errors.Is(err, reported) {
+			return reported.Error()
+		}
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timed out"
+	case errors.As(err, &apiErr):
+		return "storage returned " + apiErr.ErrorCode()
+	case errors.As(err, &pathErr):
+		return pathErr.Err.Error()
+	case errors.As(err, &netErr):
+		return "connection failed"
+	default:
+		return "check failed"
+	}
+}
+
+// checkBroker verifies that the connection and channel to the broker are
+// open
+func checkBroker() error {
+	if Conf.API.MQ.IsConnClosed() {
+		return errConnectionClosed
+	}
+	if Conf.API.MQ.IsChannelClosed() {
+		return errChannelClosed
+	}
+
+	return nil
+}
+
+// reconnectBroker replaces the connection to the broker when it or its
+// channel has been closed
+func reconnectBroker() {
+	if !Conf.API.MQ.IsConnClosed() {
+		Conf.API.MQ.Close()
+	}
+	newConn, err := broker.NewMQ(Conf.Broker)
+	if err != nil {
+		log.Errorf("failed to reconnect to MQ, reason: %v", err)
+
+		return
+	}
+	Conf.API.MQ = newConn
+}
+
+// checkDatabase pings the database
+func checkDatabase() error {
+	return checkDB(Conf.API.DB, healthCheckTimeout)
+}
+
+// checkStorage verifies that a storage backend is reachable, for S3 the
+// bucket has to exist and for POSIX the location has to be a directory.
+func checkStorage(name string, conf storage.Conf) error {
+	switch conf.Type {
+	case config.S3:
+		client, err := storageClient(name, conf.S3)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+		_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &conf.S3.Bucket})
+
+		return err
+	case config.POSIX:
+		if conf.Posix.Location == "" {
+			return errNotConfigured
+		}
+		info, err := os.Stat(conf.Posix.Location)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is %w", conf.Posix.Location, errNotDirectory)
+		}
+
+		return nil
+	default:
+		return errNotConfigured
+	}
+}
+
+// storageClient returns the S3 client of the checks of a storage, creating
+// it at the first check
+func storageClient(name string, conf storage.S3Conf) (*s3.Client, error) {
+	storageClients.Lock()
+	defer storageClients.Unlock()
+
+	if client, ok := storageClients.clients[name]; ok {
+		return client, nil
+	}
+	client, err := storage.NewS3Client(conf)
+	if err != nil {
+		return nil, err
+	}
+	storageClients.clients[name] = client
+
+	return client, nil
+}
+
+// checkJWKS verifies that the JWKS endpoint used to validate tokens responds
+func checkJWKS() error {
+	if Conf.Server.Jwtpubkeyurl == "" {
+		return errNotConfigured
+	}
+
+	res, err := healthClient.Get(Conf.Server.Jwtpubkeyurl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w %d", errUnexpectedStatus, res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxMetadataSize is the largest metadata document accepted for a file or dataset
+const maxMetadataSize = 1 << 20
+
+// setFileMetadata stores the JSON object in the request body as the
+// submission metadata of the file
+func setFileMetadata(c *gin.Context) {
+	accessionID := strings.TrimPrefix(c.Param("accession"), "/")
+	if !fileInScope(c, accessionID) {
+		return
+	}
+
+	storeMetadata(c, "accession ID not found", func(metadata json.RawMessage) error {
+		return Conf.API.DB.SetFileMetadata(accessionID, metadata)
+	})
+}
+
+// getFileMetadata returns the submission metadata of the file
+func getFileMetadata(c *gin.Context) {
+	accessionID := strings.TrimPrefix(c.Param("accession"), "/")
+	if !fileInScope(c, accessionID) {
+		return
+	}
+
+	metadata, err := Conf.API.DB.GetFileMetadata(accessionID)
+	sendMetadata(c, metadata, err, "accession ID not found")
+}
+
+// setDatasetMetadata stores the JSON object in the request body as the
+// submission metadata of the dataset
+func setDatasetMetadata(c *gin.Context) {
+	dataset := strings.TrimPrefix(c.Param("dataset"), "/")
+	if !datasetInScope(c, dataset) {
+		return
+	}
+
+	storeMetadata(c, "dataset not found", func(metadata json.RawMessage) error {
+		return Conf.API.DB.SetDatasetMetadata(dataset, metadata)
+	})
+}
+
+// getDatasetMetadata returns the submission metadata of the dataset
+func getDatasetMetadata(c *gin.Context) {
+	dataset := strings.TrimPrefix(c.Param("dataset"), "/")
+	if !datasetInScope(c, dataset) {
+		return
+	}
+
+	metadata, err := Conf.API.DB.GetDatasetMetadata(dataset)
+	sendMetadata(c, metadata, err, "dataset not found")
+}
+
+// storeMetadata reads the metadata from the request body and stores it with set
+func storeMetadata(c *gin.Context, notFound string, set func(json.RawMessage) error) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxMetadataSize))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "failed to read metadata: "+err.Error())
+
+		return
+	}
+
+	err = set(body)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.AbortWithStatusJSON(http.StatusNotFound, notFound)
+	case err != nil && strings.Contains(err.Error(), "JSON object"):
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+	case err != nil:
+		log.Errorf("failed to store metadata, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+	default:
+		c.Status(http.StatusOK)
+	}
+}
+
+// sendMetadata responds with the metadata, or the error from reading it
+func sendMetadata(c *gin.Context, metadata json.RawMessage, err error, notFound string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.AbortWithStatusJSON(http.StatusNotFound, notFound)
+	case err != nil:
+		log.Errorf("failed to get metadata, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+	default:
+		c.Data(http.StatusOK, "application/json", metadata)
+	}
+}
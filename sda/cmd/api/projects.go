@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminScope holds the projects an admin may act on, a global admin is not
+// limited to any project.
+type adminScope struct {
+	global   bool
+	projects []string
+}
+
+// getAdminScope resolves the projects of the calling admin from the token
+// claim and the project admins in the database. Without project scoping, or
+// when the admin belongs to the "*" project, the admin is global.
+func getAdminScope(c *gin.Context) (adminScope, error) {
+	if !Conf.API.ProjectScoping {
+		return adminScope{global: true}, nil
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		return adminScope{}, err
+	}
+
+	projects, err := Conf.API.DB.GetAdminProjects(token.Subject())
+	if err != nil {
+		return adminScope{}, fmt.Errorf("failed to get projects for %s, reason: %v", token.Subject(), err)
+	}
+
+	switch claim := token.PrivateClaims()[Conf.API.ProjectClaim].(type) {
+	case string:
+		projects = append(projects, strings.Fields(claim)...)
+	case []any:
+		for _, p := range claim {
+			if project, ok := p.(string); ok {
+				projects = append(projects, project)
+			}
+		}
+	}
+
+	return adminScope{global: slices.Contains(projects, "*"), projects: projects}, nil
+}
+
+// allowsAll reports whether all projects are in scope. Files that are not
+// assigned to a project, listed as an empty project, are only in scope for
+// global admins.
+func (s adminScope) allowsAll(projects []string) bool {
+	if s.global {
+		return true
+	}
+	for _, p := range projects {
+		if p == "" || !slices.Contains(s.projects, p) {
+			return false
+		}
+	}
+
+	return len(projects) > 0
+}
+
+// allowsAny reports whether at least one of the projects is in scope
+func (s adminScope) allowsAny(projects []string) bool {
+	if s.global {
+		return true
+	}
+
+	return slices.ContainsFunc(projects, func(p string) bool { return p != "" && slices.Contains(s.projects, p) })
+}
+
+// inScope checks that the calling admin may act on the projects returned by
+// lookup, aborting the request otherwise. Lookups returning no projects
+// refer to things that don't exist yet and are left to the handler.
+func inScope(c *gin.Context, requireAll bool, lookup func() ([]string, error)) bool {
+	scope, err := getAdminScope(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return false
+	}
+	if scope.global {
+		return true
+	}
+
+	projects, err := lookup()
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return true
+	case err != nil:
+		log.Errorf("failed to get projects, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return false
+	case len(projects) == 0:
+		return true
+	}
+
+	allowed := scope.allowsAny(projects)
+	if requireAll {
+		allowed = scope.allowsAll(projects)
+	}
+	if !allowed {
+		c.AbortWithStatusJSON(http.StatusForbidden, "not allowed to act outside of your projects")
+
+		return false
+	}
+
+	return true
+}
+
+// filterInScope keeps the items the calling admin may see, the projects of
+// each item are returned by lookup
+func filterInScope[T any](c *gin.Context, items []T, requireAll bool, lookup func(T) ([]string, error)) ([]T, bool) {
+	scope, err := getAdminScope(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return nil, false
+	}
+	if scope.global {
+		return items, true
+	}
+
+	filtered := []T{}
+	for _, item := range items {
+		projects, err := lookup(item)
+		if err != nil {
+			log.Errorf("failed to get projects, reason: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+			return nil, false
+		}
+		if (requireAll && scope.allowsAll(projects)) || (!requireAll && scope.allowsAny(projects)) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered, true
+}
+
+// userInScope checks that the submission user has files in, or is a member
+// of, one of the admin's projects
+func userInScope(c *gin.Context, user string) bool {
+	return inScope(c, false, func() ([]string, error) { return Conf.API.DB.GetUserProjects(user) })
+}
+
+// fileProjectInScope checks that the file whose project is returned by
+// lookup belongs to one of the admin's projects. Unlike inScope it fails
+// closed: files that can not be found, or that are not assigned to a
+// project, are only in scope for global admins.
+func fileProjectInScope(c *gin.Context, lookup func() (string, error)) bool {
+	scope, err := getAdminScope(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return false
+	}
+	if scope.global {
+		return true
+	}
+
+	project, err := lookup()
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.AbortWithStatusJSON(http.StatusForbidden, "not allowed to act outside of your projects")
+
+		return false
+	case err != nil:
+		log.Errorf("failed to get the project of the file, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return false
+	}
+	if !scope.allowsAll([]string{project}) {
+		c.AbortWithStatusJSON(http.StatusForbidden, "not allowed to act outside of your projects")
+
+		return false
+	}
+
+	return true
+}
+
+// fileInScope checks that the file with the accession ID belongs to one of
+// the admin's projects
+func fileInScope(c *gin.Context, accessionID string) bool {
+	return fileProjectInScope(c, func() (string, error) { return Conf.API.DB.GetFileProject(accessionID) })
+}
+
+// submissionFileInScope checks that the file the user uploaded to the path
+// belongs to one of the admin's projects
+func submissionFileInScope(c *gin.Context, user, filePath string) bool {
+	return fileProjectInScope(c, func() (string, error) { return Conf.API.DB.GetSubmissionFileProject(user, filePath) })
+}
+
+// inboxFileInScope checks that the file of the user with the file ID
+// belongs to one of the admin's projects
+func inboxFileInScope(c *gin.Context, user, fileID string) bool {
+	return fileProjectInScope(c, func() (string, error) { return Conf.API.DB.GetFileProjectByID(user, fileID) })
+}
+
+// datasetInScope checks that all files of the dataset belong to the admin's projects
+func datasetInScope(c *gin.Context, datasetID string) bool {
+	return inScope(c, true, func() ([]string, error) { return Conf.API.DB.GetDatasetProjects(datasetID) })
+}
+
+// projectInScope checks that the admin belongs to the project
+func projectInScope(c *gin.Context, project string) bool {
+	return inScope(c, true, func() ([]string, error) { return []string{project}, nil })
+}
+
+// freezeInScope checks that the admin may freeze submissions for the user or project
+func freezeInScope(c *gin.Context, scope, name string) bool {
+	if scope == "project" {
+		return projectInScope(c, name)
+	}
+
+	return userInScope(c, name)
+}
+
+// isGlobalAdmin checks that the admin is not limited to any projects, used
+// for operations affecting the whole instance
+func isGlobalAdmin(c *gin.Context) bool {
+	scope, err := getAdminScope(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return false
+	}
+	if !scope.global {
+		c.AbortWithStatusJSON(http.StatusForbidden, "only allowed for admins not limited to projects")
+
+		return false
+	}
+
+	return true
+}
+
+func listProjectAdmins(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	admins, err := Conf.API.DB.ListProjectAdmins(c.Param("project"))
+	if err != nil {
+		log.Errorf("failed to list project admins, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(admins, len(admins)))
+}
+
+func addProjectAdmin(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	project := c.Param("project")
+	user := c.Param("username")
+	if err := Conf.API.DB.AddProjectAdmin(project, user, token.Subject()); err != nil {
+		log.Errorf("failed to add admin to project, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	log.Infof("%s made %s admin of project %s", token.Subject(), user, project)
+	c.Status(http.StatusOK)
+}
+
+func removeProjectAdmin(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	project := c.Param("project")
+	user := c.Param("username")
+	if err := Conf.API.DB.RemoveProjectAdmin(project, user); err != nil {
+		if strings.Contains(err.Error(), "is not an admin") {
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+
+			return
+		}
+		log.Errorf("failed to remove admin from project, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	log.Infof("%s removed %s as admin of project %s", token.Subject(), user, project)
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/broker"
+	log "github.com/sirupsen/logrus"
+)
+
+// queueStatus is the backlog of a single queue as reported by /system/queues
+type queueStatus struct {
+	Name      string `json:"name"`
+	Ready     int    `json:"ready"`
+	Unacked   int    `json:"unacked"`
+	Consumers int    `json:"consumers"`
+}
+
+// managementQueue is the part of the RabbitMQ management API queue object we use
+type managementQueue struct {
+	Name                   string `json:"name"`
+	MessagesReady          int    `json:"messages_ready"`
+	MessagesUnacknowledged int    `json:"messages_unacknowledged"`
+	Consumers              int    `json:"consumers"`
+}
+
+// listQueues reports the ready and unacked message counts together with the
+// number of consumers for the queues in the sda vhost, by proxying the
+// RabbitMQ management API.
+func listQueues(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+	if Conf.Broker.ManagementURL == "" {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, "broker management API not configured")
+
+		return
+	}
+
+	queues, err := getQueueStatus()
+	if err != nil {
+		log.Errorf("failed to get queue status, reason: %v", err)
+		abortWithRetry(c, http.StatusBadGateway, "failed to get queue status from broker")
+
+		return
+	}
+
+	c.JSON(http.StatusOK, queues)
+}
+
+// getQueueStatus fetches the queues of the configured vhost from the management API
+func getQueueStatus() ([]queueStatus, error) {
+	vhost := strings.TrimPrefix(Conf.Broker.Vhost, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/queues/%s", strings.TrimSuffix(Conf.Broker.ManagementURL, "/"), url.PathEscape(vhost)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(Conf.Broker.User, Conf.Broker.Password)
+
+	client := http.Client{Timeout: healthCheckTimeout}
+	if strings.HasPrefix(Conf.Broker.ManagementURL, "https") {
+		tlsConfig, err := broker.TLSConfigBroker(Conf.Broker)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("management API returned status %d", res.StatusCode)
+	}
+
+	var mqQueues []managementQueue
+	if err := json.NewDecoder(res.Body).Decode(&mqQueues); err != nil {
+		return nil, err
+	}
+
+	queues := make([]queueStatus, 0, len(mqQueues))
+	for _, q := range mqQueues {
+		queues = append(queues, queueStatus{Name: q.Name, Ready: q.MessagesReady, Unacked: q.MessagesUnacknowledged, Consumers: q.Consumers})
+	}
+
+	return queues, nil
+}
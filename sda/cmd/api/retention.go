@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	log "github.com/sirupsen/logrus"
+)
+
+// eventPurgeComponent deletes file events older than api.eventRetentionDays
+// at the times given by api.eventPurgeSchedule, so that the event log does
+// not grow without bounds
+func eventPurgeComponent() lifecycle.Component {
+	return scheduledComponent("eventPurge", Conf.API.EventPurge, purgeEvents)
+}
+
+// purgeEvents runs one purge of the file event log. Failures are only
+// logged, the events are purged at the next scheduled run instead.
+func purgeEvents() {
+	if Conf.API.DB.Version < 33 {
+		log.Warnf("database schema v33 required to purge file events")
+
+		return
+	}
+
+	purged, err := Conf.API.DB.PurgeEvents(Conf.API.EventRetention, Conf.API.EventKeepLatest)
+	if err != nil {
+		log.Errorf("failed to purge file events, reason: %v", err)
+
+		return
+	}
+	log.Infof("purged %d file events older than %v", purged, Conf.API.EventRetention)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	"github.com/neicnordic/sensitive-data-archive/internal/schedule"
+	log "github.com/sirupsen/logrus"
+)
+
+// scheduledComponent runs job at the times given by sched, the component
+// idles when sched is nil
+func scheduledComponent(name string, sched *schedule.Schedule, job func()) lifecycle.Component {
+	return lifecycle.Component{
+		Name:      name,
+		DependsOn: []string{"database"},
+		Run: func(ctx context.Context) error {
+			if sched == nil {
+				<-ctx.Done()
+
+				return nil
+			}
+
+			for {
+				next := sched.Next(time.Now())
+				if next.IsZero() {
+					log.Warnf("%s schedule never matches, the job is not run", name)
+					<-ctx.Done()
+
+					return nil
+				}
+
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+
+					return nil
+				case <-timer.C:
+					job()
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// The searches are paged, since a broad pattern may match a large part of
+// the archive
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// searchFiles lists a page of the files of all users matching the user and
+// path glob patterns and status given as query parameters
+func searchFiles(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	user, path, status := c.Query("user"), c.Query("path"), c.Query("status")
+	if user == "" && path == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "a user or path pattern is required")
+
+		return
+	}
+	page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	if page.Limit == 0 {
+		page.Limit = defaultSearchLimit
+	}
+	page.Limit = min(page.Limit, maxSearchLimit)
+
+	files, next, err := Conf.API.DB.SearchFiles(user, path, status, page)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to search files, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	total, err := Conf.API.DB.CountSearchFiles(user, path, status)
+	if err != nil {
+		log.Errorf("failed to count files, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(files, total).withNext(next))
+}
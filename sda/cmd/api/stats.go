@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	log "github.com/sirupsen/logrus"
+)
+
+// statsRefreshComponent counts the files and datasets by status at the
+// times given by api.statsRefreshSchedule, so that /stats does not have to
+// scan the files and event logs
+func statsRefreshComponent() lifecycle.Component {
+	return scheduledComponent("statsRefresh", Conf.API.StatsRefresh, refreshStats)
+}
+
+// refreshStats runs one refresh of the statistics. Failures are only
+// logged, the statistics are refreshed at the next scheduled run instead.
+func refreshStats() {
+	if Conf.API.DB.Version < 36 {
+		log.Warnf("database schema v36 required to refresh statistics")
+
+		return
+	}
+
+	if err := Conf.API.DB.RefreshStats(); err != nil {
+		log.Errorf("failed to refresh statistics, reason: %v", err)
+
+		return
+	}
+	log.Debug("refreshed statistics")
+}
+
+// getStats returns the number of files and datasets by status as of the
+// latest refresh
+func getStats(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	stats, err := Conf.API.DB.GetStats()
+	if err != nil {
+		log.Errorf("failed to get statistics, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
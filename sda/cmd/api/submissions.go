@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/events"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	log "github.com/sirupsen/logrus"
+)
+
+// reminderInterval is how often the expected files are checked for ones
+// that are overdue
+const reminderInterval = time.Hour
+
+// expectedFiles lists the files that a user is expected to upload, as
+// registered ahead of the upload by a submission portal
+type expectedFiles struct {
+	User  string          `json:"user"`
+	Files []expectedEntry `json:"files"`
+}
+
+type expectedEntry struct {
+	FilePath     string `json:"filepath"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum"`
+	ChecksumType string `json:"checksum_type"`
+}
+
+// submissionStatus is the status of a pre-registered submission together
+// with the arrived files in percent of the expected ones
+type submissionStatus struct {
+	*database.SubmissionStatus
+	Completeness float64 `json:"completeness"`
+}
+
+// submissionFiles is the list of files of a submitter, the completeness is
+// only given when files have been pre-registered for the user
+type submissionFiles struct {
+	listResponse
+	Completeness *float64 `json:"completeness,omitempty"`
+}
+
+// registerExpectedFiles records the files that a user is expected to
+// upload, so that missing and unexpected uploads can be found
+func registerExpectedFiles(c *gin.Context) {
+	var expected expectedFiles
+	if err := c.BindJSON(&expected); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				"error":  "json decoding : " + err.Error(),
+				"status": http.StatusBadRequest,
+			},
+		)
+
+		return
+	}
+	if expected.User == "" || len(expected.Files) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "user and files are required")
+
+		return
+	}
+	if !userInScope(c, expected.User) {
+		return
+	}
+
+	files := make([]database.ExpectedFile, 0, len(expected.Files))
+	for _, f := range expected.Files {
+		if f.FilePath == "" || f.Size < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "filepath is required and size must not be negative for each file")
+
+			return
+		}
+		if f.Checksum != "" && !slices.Contains(database.ChecksumAlgorithms, strings.ToLower(f.ChecksumType)) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "checksum_type must be one of "+strings.Join(database.ChecksumAlgorithms, ", "))
+
+			return
+		}
+		files = append(files, database.ExpectedFile{FilePath: f.FilePath, Size: f.Size, Checksum: f.Checksum, ChecksumType: f.ChecksumType})
+	}
+
+	token, err := auth.Authenticate(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	if err := Conf.API.DB.RegisterExpectedFiles(expected.User, files, token.Subject()); err != nil {
+		log.Errorf("failed to register expected files, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	log.Infof("%d expected files for %s registered by %s", len(files), expected.User, token.Subject())
+
+	c.Status(http.StatusOK)
+}
+
+// removeExpectedFile removes a file, given by the filepath query parameter,
+// from the files that a user is expected to upload
+func removeExpectedFile(c *gin.Context) {
+	username := c.Param("username")
+	filePath := c.Query("filepath")
+	if filePath == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "filepath is required")
+
+		return
+	}
+	if !userInScope(c, username) {
+		return
+	}
+
+	if err := Conf.API.DB.RemoveExpectedFile(username, filePath); err != nil {
+		if strings.Contains(err.Error(), "no expected file") {
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+
+			return
+		}
+		log.Errorf("failed to remove expected file, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// getSubmissionStatus compares the files that a user is expected to upload
+// with the files in the inbox
+func getSubmissionStatus(c *gin.Context) {
+	username := c.Param("username")
+	if !userInScope(c, username) {
+		return
+	}
+
+	status, err := Conf.API.DB.GetSubmissionStatus(username)
+	if err != nil {
+		log.Errorf("GetSubmissionStatus failed, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, submissionStatus{SubmissionStatus: status, Completeness: math.Round(status.Completeness()*100) / 100})
+}
+
+// submissionCompleteness returns the arrived files in percent of the ones
+// pre-registered for the user, or nil when none are. Failures are only
+// logged since they should not block listing the files.
+func submissionCompleteness(user string) *float64 {
+	if Conf.API.DB.Version < 27 {
+		return nil
+	}
+
+	status, err := Conf.API.DB.GetSubmissionStatus(user)
+	if err != nil {
+		log.Errorf("failed to get submission status for %s, reason: %v", user, err)
+
+		return nil
+	}
+	if status.Expected == 0 {
+		return nil
+	}
+	completeness := math.Round(status.Completeness()*100) / 100
+
+	return &completeness
+}
+
+// remindersComponent reminds submitters about pre-registered files that
+// have not been uploaded within api.missingFilesReminder
+func remindersComponent() lifecycle.Component {
+	return lifecycle.Component{
+		Name:      "reminders",
+		DependsOn: []string{"broker", "database"},
+		Run: func(ctx context.Context) error {
+			if Conf.API.MissingReminder == 0 {
+				<-ctx.Done()
+
+				return nil
+			}
+
+			ticker := time.NewTicker(reminderInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+					sendMissingFilesReminders()
+				}
+			}
+		},
+	}
+}
+
+// sendMissingFilesReminders sends a missing-files message to the notify
+// service for each user with overdue expected files. Failures are only
+// logged, the user is reminded at the next check instead.
+func sendMissingFilesReminders() {
+	if Conf.API.DB.Version < 27 {
+		return
+	}
+
+	overdue, err := Conf.API.DB.GetOverdueExpectedFiles(Conf.API.MissingReminder)
+	if err != nil {
+		log.Errorf("failed to get overdue expected files, reason: %v", err)
+
+		return
+	}
+
+	for _, m := range overdue {
+		reminder, err := events.Marshal(Conf.Broker.SchemasPath, events.MissingFiles{User: m.User, Files: m.FilePaths})
+		if err != nil {
+			log.Errorf("missing files reminder for %s failed validation, reason: %v", m.User, err)
+
+			continue
+		}
+		if err := Conf.API.MQ.SendMessage("", Conf.Broker.Exchange, "missing", reminder); err != nil {
+			log.Errorf("failed to send missing files reminder for %s, reason: %v", m.User, err)
+
+			continue
+		}
+		if err := Conf.API.DB.SetExpectedFilesReminded(m.User, m.FilePaths); err != nil {
+			log.Errorf("failed to record missing files reminder for %s, reason: %v", m.User, err)
+		}
+		log.Infof("reminded %s about %d missing files", m.User, len(m.FilePaths))
+	}
+}
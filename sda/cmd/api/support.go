@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// effectiveConfig is the resolved configuration of the running service as
+// reported by /admin/config. Only settings that are safe to share are
+// listed, credentials are reported as set or not.
+type effectiveConfig struct {
+	DeploymentMode string         `json:"deploymentMode"`
+	SchemasPath    string         `json:"schemasPath"`
+	Features       featureConfig  `json:"features"`
+	Inbox          storageConfig  `json:"inbox"`
+	Archive        storageConfig  `json:"archive"`
+	Broker         brokerConfig   `json:"broker"`
+	Database       databaseConfig `json:"database"`
+	Timeouts       timeoutConfig  `json:"timeouts"`
+	Auth           authConfig     `json:"auth"`
+	// Settings lists every resolved setting and where it was taken from
+	Settings []config.Setting `json:"settings"`
+}
+
+type featureConfig struct {
+	ReadOnly        bool   `json:"readOnly"`
+	ReleaseFeed     bool   `json:"releaseFeed"`
+	ReleaseFeedSize int    `json:"releaseFeedSize"`
+	ProjectScoping  bool   `json:"projectScoping"`
+	ProjectClaim    string `json:"projectClaim"`
+	QuotaWarnings   []int  `json:"quotaWarnings"`
+	MissingReminder string `json:"missingFilesReminder"`
+	DatasetPrefix   string `json:"datasetIDPrefix"`
+	DatasetDigits   int    `json:"datasetIDDigits"`
+}
+
+type storageConfig struct {
+	Type        string `json:"type"`
+	Location    string `json:"location,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Port        int    `json:"port,omitempty"`
+	Bucket      string `json:"bucket,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Credentials string `json:"credentials,omitempty"`
+	Host        string `json:"host,omitempty"`
+}
+
+type brokerConfig struct {
+	Host             string   `json:"host"`
+	Port             int      `json:"port"`
+	Vhost            string   `json:"vhost"`
+	Exchange         string   `json:"exchange"`
+	Ssl              bool     `json:"ssl"`
+	VerifyPeer       bool     `json:"verifyPeer"`
+	StandbyHosts     []string `json:"standbyHosts"`
+	FailbackInterval string   `json:"failbackInterval"`
+	OnStandby        bool     `json:"onStandby"`
+	ManagementAPI    bool     `json:"managementAPI"`
+	PasswordSet      bool     `json:"passwordSet"`
+}
+
+type databaseConfig struct {
+	Host          string `json:"host"`
+	Port          int    `json:"port"`
+	Database      string `json:"database"`
+	SslMode       string `json:"sslMode"`
+	SchemaVersion int    `json:"schemaVersion"`
+	Replica       bool   `json:"replica"`
+	PasswordSet   bool   `json:"passwordSet"`
+}
+
+type timeoutConfig struct {
+	Request          string            `json:"request"`
+	Endpoints        map[string]string `json:"endpoints"`
+	BreakerThreshold int               `json:"breakerThreshold"`
+	BreakerCooldown  string            `json:"breakerCooldown"`
+	RetryAfter       string            `json:"retryAfter"`
+}
+
+type authConfig struct {
+	JwtIssuers    []string `json:"jwtIssuers"`
+	JwtAudiences  []string `json:"jwtAudiences"`
+	JwtAlgorithms []string `json:"jwtAlgorithms"`
+	JwksURL       string   `json:"jwksURL"`
+	JwtKeyPath    string   `json:"jwtKeyPath"`
+}
+
+// getEffectiveConfig returns the configuration the service is running with,
+// so that misconfigurations can be found without access to the deployment
+func getEffectiveConfig(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	endpoints := map[string]string{}
+	for path, timeout := range Conf.API.EndpointTimeouts {
+		endpoints[path] = timeout.String()
+	}
+
+	effective := effectiveConfig{
+		DeploymentMode: Conf.SchemaType,
+		SchemasPath:    Conf.Broker.SchemasPath,
+		Features: featureConfig{
+			ReadOnly:        Conf.API.ReadOnly,
+			ReleaseFeed:     Conf.API.ReleaseFeed,
+			ReleaseFeedSize: Conf.API.ReleaseFeedSize,
+			ProjectScoping:  Conf.API.ProjectScoping,
+			ProjectClaim:    Conf.API.ProjectClaim,
+			QuotaWarnings:   Conf.API.QuotaWarnings,
+			MissingReminder: Conf.API.MissingReminder.String(),
+			DatasetPrefix:   Conf.API.DatasetPrefix,
+			DatasetDigits:   Conf.API.DatasetDigits,
+		},
+		Inbox:   storageSettings(Conf.Inbox),
+		Archive: storageSettings(Conf.Archive),
+		Broker: brokerConfig{
+			Host:             Conf.Broker.Host,
+			Port:             Conf.Broker.Port,
+			Vhost:            Conf.Broker.Vhost,
+			Exchange:         Conf.Broker.Exchange,
+			Ssl:              Conf.Broker.Ssl,
+			VerifyPeer:       Conf.Broker.VerifyPeer,
+			StandbyHosts:     Conf.Broker.StandbyHosts,
+			FailbackInterval: Conf.Broker.FailbackInterval.String(),
+			OnStandby:        Conf.API.MQ != nil && Conf.API.MQ.OnStandby(),
+			ManagementAPI:    Conf.Broker.ManagementURL != "",
+			PasswordSet:      Conf.Broker.Password != "",
+		},
+		Database: databaseConfig{
+			Host:        Conf.Database.Host,
+			Port:        Conf.Database.Port,
+			Database:    Conf.Database.Database,
+			SslMode:     Conf.Database.SslMode,
+			Replica:     Conf.Database.ReplicaDSN != "",
+			PasswordSet: Conf.Database.Password != "",
+		},
+		Timeouts: timeoutConfig{
+			Request:          Conf.API.RequestTimeout.String(),
+			Endpoints:        endpoints,
+			BreakerThreshold: Conf.API.BreakerThreshold,
+			BreakerCooldown:  Conf.API.BreakerCooldown.String(),
+			RetryAfter:       Conf.API.RetryAfter.String(),
+		},
+		Auth: authConfig{
+			JwtIssuers:    Conf.Server.JwtIssuers,
+			JwtAudiences:  Conf.Server.JwtAudiences,
+			JwtAlgorithms: Conf.Server.JwtAlgorithms,
+			JwksURL:       Conf.Server.Jwtpubkeyurl,
+			JwtKeyPath:    Conf.Server.Jwtpubkeypath,
+		},
+		Settings: Conf.Settings,
+	}
+	if Conf.API.DB != nil {
+		effective.Database.SchemaVersion = Conf.API.DB.Version
+	}
+
+	c.JSON(http.StatusOK, effective)
+}
+
+// storageSettings lists the settings of a storage without its keys, only
+// the provider used for the keys is given
+func storageSettings(conf storage.Conf) storageConfig {
+	settings := storageConfig{Type: conf.Type}
+	switch conf.Type {
+	case "s3":
+		settings.URL = conf.S3.URL
+		settings.Port = conf.S3.Port
+		settings.Bucket = conf.S3.Bucket
+		settings.Region = conf.S3.Region
+		settings.Credentials = conf.S3.Credentials.Provider
+		if settings.Credentials == "" {
+			settings.Credentials = storage.StaticCredentials
+		}
+	case "posix":
+		settings.Location = conf.Posix.Location
+	case "sftp":
+		settings.Host = conf.SFTP.Host
+	}
+
+	return settings
+}
+
+// reloadConfig reads the configuration again and applies the log level, the
+// RBAC policy and the token validation settings, like SIGHUP does
+func reloadConfig(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+	if app == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, "the service is not running")
+
+		return
+	}
+
+	if err := app.Reload(); err != nil {
+		log.Errorf("failed to reload the configuration, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
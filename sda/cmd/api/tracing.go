@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/tracing"
+)
+
+// traceRequests records a span for each request, continuing the trace of
+// the caller when the request carries a traceparent header. Handlers trace
+// their queries as part of the request with Conf.API.DB.WithContext.
+func traceRequests(c *gin.Context) {
+	ctx := c.Request.Context()
+	if sc, ok := tracing.ParseTraceparent(c.GetHeader("traceparent")); ok {
+		ctx = tracing.ContextWithRemote(ctx, sc)
+	}
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	ctx, span := tracing.Start(ctx, tracing.Server, c.Request.Method+" "+route)
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttribute("http.request.method", c.Request.Method)
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("http.response.status_code", strconv.Itoa(status))
+	var err error
+	if status >= http.StatusInternalServerError {
+		err = errors.New(http.StatusText(status))
+	}
+	span.End(err)
+}
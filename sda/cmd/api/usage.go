@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	log "github.com/sirupsen/logrus"
+)
+
+// usageSummaryComponent stores the file totals of all users at the times
+// given by api.usageSummarySchedule, for usage statistics
+func usageSummaryComponent() lifecycle.Component {
+	return scheduledComponent("usageSummary", Conf.API.UsageSummary, summariseUsage)
+}
+
+// summariseUsage runs one summary of the user totals. Failures are only
+// logged, the totals are summarised at the next scheduled run instead.
+func summariseUsage() {
+	if Conf.API.DB.Version < 34 {
+		log.Warnf("database schema v34 required to summarise user usage")
+
+		return
+	}
+
+	users, err := Conf.API.DB.SummariseUserUsage()
+	if err != nil {
+		log.Errorf("failed to summarise user usage, reason: %v", err)
+
+		return
+	}
+	log.Infof("summarised the usage of %d users", users)
+}
+
+// listUsageSummaries returns the file totals of all users as of the latest
+// summary
+func listUsageSummaries(c *gin.Context) {
+	if !isGlobalAdmin(c) {
+		return
+	}
+
+	summaries, err := Conf.API.DB.GetUserUsageSummaries()
+	if err != nil {
+		log.Errorf("failed to get user usage summaries, reason: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	c.JSON(http.StatusOK, newListResponse(summaries, len(summaries)))
+}
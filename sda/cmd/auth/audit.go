@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// The logins are counted and timed in the metrics that are served on the
+// metrics address. Logins, second factors, token refreshes and revoked
+// sessions are also written to the audit log, both as log entries with the
+// audit field set and to the auth_events table of the database, where they
+// can be queried by user and time.
+
+var (
+	loginsTotal = metrics.NewCounter("sda_auth_logins_total",
+		"Logins by provider and outcome.", "provider", "outcome")
+	loginDuration = metrics.NewHistogram("sda_auth_login_duration_seconds",
+		"Time taken to check the credentials of a login with the provider, by provider.", metrics.DefaultBuckets, "provider")
+	secondFactorsTotal = metrics.NewCounter("sda_auth_second_factors_total",
+		"Second factors checked at login by factor and outcome.", "factor", "outcome")
+	tokensIssuedTotal = metrics.NewCounter("sda_auth_tokens_issued_total",
+		"Tokens handed out by type, access or refresh.", "type")
+)
+
+// Outcomes of the audited events: the user succeeded, the credentials of
+// the user were refused, or they could not be checked
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeError   = "error"
+)
+
+// observeLogin counts and times a login with the provider, whose
+// credentials were sent at start, and writes it to the audit log. The user
+// is empty when it is not known.
+func (auth AuthHandler) observeLogin(ctx iris.Context, provider, user, outcome string, start time.Time) {
+	loginsTotal.Inc(provider, outcome)
+	loginDuration.Observe(time.Since(start).Seconds(), provider)
+	auth.audit(ctx, "login", user, provider, outcome)
+}
+
+// observeSecondFactor counts a check of the second factor of a login and
+// writes it to the audit log
+func (auth AuthHandler) observeSecondFactor(ctx iris.Context, factor, user, outcome string) {
+	secondFactorsTotal.Inc(factor, outcome)
+	auth.audit(ctx, "second_factor", user, factor, outcome)
+}
+
+// audit writes an event of the user, from the address of the request, to
+// the audit log. Failing to store it in the database does not stop the
+// request.
+func (auth AuthHandler) audit(ctx iris.Context, event, user, provider, outcome string) {
+	entry := database.AuthEvent{
+		Event:      event,
+		Subject:    user,
+		Provider:   provider,
+		Outcome:    outcome,
+		RemoteAddr: ctx.RemoteAddr(),
+		UserAgent:  ctx.Request().UserAgent(),
+	}
+	log.WithFields(log.Fields{
+		"audit":       true,
+		"event":       entry.Event,
+		"user":        entry.Subject,
+		"provider":    entry.Provider,
+		"outcome":     entry.Outcome,
+		"remote_addr": entry.RemoteAddr,
+		"user_agent":  entry.UserAgent,
+	}).Info("Audit event")
+
+	if auth.Config.DB == nil {
+		return
+	}
+	if err := auth.Config.DB.AddAuthEvent(entry, auth.Config.AuditRetention); err != nil {
+		log.Warnf("failed to store audit event: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kataras/iris/v12"
+	irishttptest "github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditTests struct {
+	suite.Suite
+}
+
+func TestAuditTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditTests))
+}
+
+func (suite *AuditTests) TestEGALoginIsObserved() {
+	status := http.StatusNotFound
+	cega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer cega.Close()
+
+	var logs bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&logs)
+	defer log.SetOutput(out)
+
+	auth := AuthHandler{Config: config.AuthConf{Cega: config.CegaConfig{AuthURL: cega.URL, ID: "id", Secret: "secret"}}}
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Post("/ega", auth.postEGA)
+	e := irishttptest.New(suite.T(), app)
+
+	e.POST("/ega").WithHeader("User-Agent", "audit-test").WithFormField("username", "audit-user").WithFormField("password", "wrong").
+		Expect()
+	status = http.StatusInternalServerError
+	e.POST("/ega").WithFormField("username", "audit-user").WithFormField("password", "wrong").
+		Expect()
+
+	var buf bytes.Buffer
+	assert.NoError(suite.T(), metrics.Write(&buf))
+	assert.Contains(suite.T(), buf.String(), `sda_auth_logins_total{provider="ega",outcome="failure"} 1`)
+	assert.Contains(suite.T(), buf.String(), `sda_auth_logins_total{provider="ega",outcome="error"} 1`)
+	assert.Contains(suite.T(), buf.String(), `sda_auth_login_duration_seconds_count{provider="ega"} 2`)
+
+	assert.Contains(suite.T(), logs.String(), "audit=true")
+	assert.Contains(suite.T(), logs.String(), "event=login")
+	assert.Contains(suite.T(), logs.String(), "user=audit-user")
+	assert.Contains(suite.T(), logs.String(), "user_agent=audit-test")
+}
+
+func (suite *AuditTests) TestSecondFactorIsObserved() {
+	auth := AuthHandler{}
+	app := iris.New()
+	app.Get("/", func(ctx iris.Context) {
+		auth.observeSecondFactor(ctx, "totp", "audit-user", outcomeSuccess)
+	})
+	irishttptest.New(suite.T(), app).GET("/").Expect().Status(iris.StatusOK)
+
+	var buf bytes.Buffer
+	assert.NoError(suite.T(), metrics.Write(&buf))
+	assert.Contains(suite.T(), buf.String(), `sda_auth_second_factors_total{factor="totp",outcome="success"} 1`)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CBORTests struct {
+	suite.Suite
+}
+
+func TestCBORTestSuite(t *testing.T) {
+	suite.Run(t, new(CBORTests))
+}
+
+func (suite *CBORTests) TestDecodeCBOR() {
+	for _, test := range []struct {
+		data     []byte
+		expected any
+	}{
+		{[]byte{0x00}, int64(0)},
+		{[]byte{0x17}, int64(23)},
+		{[]byte{0x18, 0x18}, int64(24)},
+		{[]byte{0x19, 0x01, 0x00}, int64(256)},
+		{[]byte{0x20}, int64(-1)},
+		{[]byte{0x39, 0x01, 0x00}, int64(-257)},
+		{[]byte{0x43, 0x01, 0x02, 0x03}, []byte{1, 2, 3}},
+		{[]byte{0x63, 'f', 'm', 't'}, "fmt"},
+		{[]byte{0x82, 0x01, 0xf5}, []any{int64(1), true}},
+		{[]byte{0xa2, 0x01, 0x02, 0x20, 0xf6}, map[any]any{int64(1): int64(2), int64(-1): nil}},
+	} {
+		item, rest, err := decodeCBOR(append(test.data, 0xff))
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), test.expected, item)
+		assert.Equal(suite.T(), []byte{0xff}, rest, "the bytes after the item should be returned")
+	}
+}
+
+func (suite *CBORTests) TestDecodeCBORErrors() {
+	for _, data := range [][]byte{
+		{},
+		{0x18},
+		{0x43, 0x01},
+		{0x9f, 0x01, 0xff},
+		{0xa1, 0x43, 0x01, 0x02, 0x03, 0x01},
+		{0xfb, 0x3f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x9a, 0xff, 0xff, 0xff, 0xff},
+		append(bytes.Repeat([]byte{0x81}, 20), 0x00),
+	} {
+		_, _, err := decodeCBOR(data)
+		assert.Error(suite.T(), err, "%x should not be decoded", data)
+	}
+}
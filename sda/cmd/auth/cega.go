@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
 	log "github.com/sirupsen/logrus"
 	bcrypt "golang.org/x/crypto/bcrypt"
 )
@@ -44,7 +45,7 @@ func verifyPassword(password, hash string) bool {
 
 // Authenticate against CEGA
 func authenticateWithCEGA(conf config.CegaConfig, username string) (*http.Response, error) {
-	client := &http.Client{}
+	client := outbound.Client(0)
 	payload := strings.NewReader("")
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", strings.TrimSuffix(conf.AuthURL, "/"), username), payload)
 
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// The OAuth 2.0 device authorization grant of RFC 8628 lets command line
+// tools that can not open a browser, e.g. on HPC login nodes, get a token:
+// the tool asks for a code at /device/code and polls /device/token while
+// the user enters the short user code at /device on another device and
+// logs in there. Anyone may ask for a code, so the pending authorizations
+// are capped and the codes an address asks for are limited.
+
+// deviceGrantType is the grant_type of the token requests of the flow
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// userCodeChars are the characters of the user codes, without vowels and
+// look-alikes so that the codes are easy to type and never form words
+const userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+
+// maxDeviceRequests caps the pending device authorizations kept in memory
+const maxDeviceRequests = 10000
+
+// errTooManyDeviceRequests is returned when no more device authorizations
+// can be kept until some have expired
+var errTooManyDeviceRequests = errors.New("too many pending device authorizations")
+
+// deviceRequest is a pending device authorization
+type deviceRequest struct {
+	userCode string
+	expires  time.Time
+	lastPoll time.Time
+	// token is set once the user has logged in, with a refresh token when
+	// these are handed out
+	token        string
+	refreshToken string
+	user         string
+}
+
+// deviceFlow keeps the pending device authorizations in memory, by device
+// code
+type deviceFlow struct {
+	mu       sync.Mutex
+	requests map[string]*deviceRequest
+	ttl      time.Duration
+	interval time.Duration
+}
+
+func newDeviceFlow(ttl, interval time.Duration) *deviceFlow {
+	return &deviceFlow{requests: map[string]*deviceRequest{}, ttl: ttl, interval: interval}
+}
+
+// newDeviceCodeLimiter limits the device codes that an address may ask for
+// to limit per minute, with the limiter of the failed logins. There is no
+// limit when it is 0.
+func newDeviceCodeLimiter(limit int) *loginLimiter {
+	return newLoginLimiter(config.LoginLimitConfig{AddressFailures: limit, Window: time.Minute, Lockout: time.Minute})
+}
+
+// start registers a new device authorization and returns its device and
+// user codes. The expired authorizations are dropped first.
+func (d *deviceFlow) start() (deviceCode, userCode string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	deviceCode = base64.RawURLEncoding.EncodeToString(b)
+
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeChars))))
+		if err != nil {
+			return "", "", err
+		}
+		code[i] = userCodeChars[n.Int64()]
+	}
+	userCode = string(code[:4]) + "-" + string(code[4:])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for c, r := range d.requests {
+		if now.After(r.expires) {
+			delete(d.requests, c)
+		}
+	}
+	if len(d.requests) >= maxDeviceRequests {
+		return "", "", errTooManyDeviceRequests
+	}
+	d.requests[deviceCode] = &deviceRequest{userCode: userCode, expires: now.Add(d.ttl)}
+
+	return deviceCode, userCode, nil
+}
+
+// lookup returns the device code of a pending authorization, and when it
+// expires, by the user code the user entered, ignoring case, spaces and
+// dashes
+func (d *deviceFlow) lookup(userCode string) (string, time.Time, bool) {
+	normalize := strings.NewReplacer("-", "", " ", "")
+	userCode = strings.ToUpper(normalize.Replace(userCode))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for deviceCode, r := range d.requests {
+		if normalize.Replace(r.userCode) == userCode && r.token == "" && time.Now().Before(r.expires) {
+			return deviceCode, r.expires, true
+		}
+	}
+
+	return "", time.Time{}, false
+}
+
+// approve hands the token of the user that logged in to the authorization
+func (d *deviceFlow) approve(deviceCode, token, refreshToken, user string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r, ok := d.requests[deviceCode]
+	if !ok || time.Now().After(r.expires) {
+		return fmt.Errorf("the code has expired")
+	}
+	r.token, r.refreshToken, r.user = token, refreshToken, user
+
+	return nil
+}
+
+// poll returns the tokens of the authorization once the user has logged
+// in, or the error code of RFC 8628 telling the tool what to do
+func (d *deviceFlow) poll(deviceCode string) (token, refreshToken, errCode string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r, ok := d.requests[deviceCode]
+	now := time.Now()
+	switch {
+	case !ok:
+		return "", "", "invalid_grant"
+	case now.After(r.expires):
+		delete(d.requests, deviceCode)
+
+		return "", "", "expired_token"
+	case r.token != "":
+		delete(d.requests, deviceCode)
+
+		return r.token, r.refreshToken, ""
+	case now.Sub(r.lastPoll) < d.interval:
+		r.lastPoll = now
+
+		return "", "", "slow_down"
+	}
+	r.lastPoll = now
+
+	return "", "", "authorization_pending"
+}
+
+// postDeviceCode starts a device authorization for a command line tool
+func (auth AuthHandler) postDeviceCode(ctx iris.Context) {
+	now := time.Now()
+	if !auth.deviceLimiter.lockedUntil(ctx.RemoteAddr(), "", now).IsZero() {
+		ctx.StopWithJSON(iris.StatusTooManyRequests, iris.Map{"error": "slow_down"})
+
+		return
+	}
+	// every code asked for counts towards the limit of the address
+	auth.deviceLimiter.fail(ctx.RemoteAddr(), "", now)
+
+	deviceCode, userCode, err := auth.device.start()
+	if errors.Is(err, errTooManyDeviceRequests) {
+		log.Warn("Too many pending device authorizations, refusing new ones")
+		ctx.StopWithJSON(iris.StatusServiceUnavailable, iris.Map{"error": "slow_down"})
+
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to create device code: %v", err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+
+	verificationURI := auth.Config.PublicURL + "/device"
+	err = ctx.JSON(iris.Map{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + userCode,
+		"expires_in":                int(auth.device.ttl.Seconds()),
+		"interval":                  int(auth.device.interval.Seconds()),
+	})
+	if err != nil {
+		log.Error("Failed to write device code response: ", err)
+	}
+}
+
+// postDeviceToken returns the token of a device authorization once the user
+// has logged in
+func (auth AuthHandler) postDeviceToken(ctx iris.Context) {
+	if ctx.FormValue("grant_type") != deviceGrantType {
+		ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"error": "unsupported_grant_type"})
+
+		return
+	}
+
+	token, refreshToken, errCode := auth.device.poll(ctx.FormValue("device_code"))
+	if errCode != "" {
+		ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"error": errCode})
+
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	res := iris.Map{"access_token": token, "token_type": "Bearer"}
+	if refreshToken != "" {
+		res["refresh_token"] = refreshToken
+	}
+	err := ctx.JSON(res)
+	if err != nil {
+		log.Error("Failed to write device token response: ", err)
+	}
+}
+
+// getDevice returns the form where the user enters the code shown by the
+// command line tool
+func (auth AuthHandler) getDevice(ctx iris.Context) {
+	auth.viewDevice(ctx, iris.Map{"UserCode": ctx.URLParam("user_code")})
+}
+
+// postDevice checks the code entered by the user and offers the login
+// options, the authorization is completed by the login
+func (auth AuthHandler) postDevice(ctx iris.Context) {
+	userCode := ctx.FormValue("user_code")
+	deviceCode, expires, ok := auth.device.lookup(userCode)
+	if !ok {
+		clearDevice(sessions.Get(ctx))
+		auth.viewDevice(ctx, iris.Map{"UserCode": userCode, "Reason": "The code is not valid or has expired"})
+
+		return
+	}
+
+	s := sessions.Get(ctx)
+	s.Set("device", deviceCode)
+	s.Set("device_expires", expires.Unix())
+	auth.viewDevice(ctx, iris.Map{"Login": true, "OIDC": auth.Config.OIDC.Enabled, "EGA": auth.Config.Cega.Enabled})
+}
+
+// completeDevice hands the tokens to the device authorization that the
+// user logged in for, if any, and tells the user to return to the command
+// line tool. It reports whether there was such an authorization, one that
+// has expired is forgotten and the login goes on as usual.
+func (auth AuthHandler) completeDevice(ctx iris.Context, token, refreshToken, user string) bool {
+	s := sessions.Get(ctx)
+	deviceCode := s.GetString("device")
+	expires := time.Unix(s.GetInt64Default("device_expires", 0), 0)
+	clearDevice(s)
+	if deviceCode == "" || time.Now().After(expires) {
+		return false
+	}
+
+	if err := auth.device.approve(deviceCode, token, refreshToken, user); err != nil {
+		auth.viewDevice(ctx, iris.Map{"Reason": "The code has expired, start again from the command line tool"})
+
+		return true
+	}
+	log.WithFields(log.Fields{"user": user}).Info("Device was authorized")
+	auth.viewDevice(ctx, iris.Map{"Approved": true, "User": user})
+
+	return true
+}
+
+// clearDevice forgets the device authorization of the session
+func clearDevice(s *sessions.Session) {
+	s.Delete("device")
+	s.Delete("device_expires")
+}
+
+func (auth AuthHandler) viewDevice(ctx iris.Context, data iris.Map) {
+	data["infoUrl"] = auth.Config.InfoURL
+	data["infoText"] = auth.Config.InfoText
+	if err := ctx.View("device.html", data); err != nil {
+		log.Error("Failed to view device form: ", err)
+	}
+}
+
+// requestBaseURL returns the scheme and host the request was made to
+func requestBaseURL(ctx iris.Context) string {
+	scheme := "https"
+	if proto := ctx.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	} else if ctx.Request().TLS == nil {
+		scheme = "http"
+	}
+
+	return scheme + "://" + ctx.Host()
+}
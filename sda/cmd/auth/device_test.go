@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeviceTests struct {
+	suite.Suite
+}
+
+func TestDeviceTestSuite(t *testing.T) {
+	suite.Run(t, new(DeviceTests))
+}
+
+func (suite *DeviceTests) TestDeviceFlow() {
+	d := newDeviceFlow(time.Minute, 0)
+	deviceCode, userCode, err := d.start()
+	assert.NoError(suite.T(), err)
+	assert.Regexp(suite.T(), "^[B-Z]{4}-[B-Z]{4}$", userCode)
+
+	token, _, errCode := d.poll(deviceCode)
+	assert.Empty(suite.T(), token)
+	assert.Equal(suite.T(), "authorization_pending", errCode)
+
+	found, expires, ok := d.lookup(" " + userCode[:4] + userCode[5:] + " ")
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), deviceCode, found)
+	assert.WithinDuration(suite.T(), time.Now().Add(time.Minute), expires, time.Second)
+	assert.NoError(suite.T(), d.approve(deviceCode, "token", "refresh", "dummy@example.org"))
+
+	token, refreshToken, errCode := d.poll(deviceCode)
+	assert.Equal(suite.T(), "token", token)
+	assert.Equal(suite.T(), "refresh", refreshToken)
+	assert.Empty(suite.T(), errCode)
+
+	// the token is handed out once
+	_, _, errCode = d.poll(deviceCode)
+	assert.Equal(suite.T(), "invalid_grant", errCode)
+	_, _, ok = d.lookup(userCode)
+	assert.False(suite.T(), ok)
+}
+
+func (suite *DeviceTests) TestDeviceFlowPolling() {
+	d := newDeviceFlow(time.Minute, time.Hour)
+	deviceCode, _, err := d.start()
+	assert.NoError(suite.T(), err)
+
+	_, _, errCode := d.poll(deviceCode)
+	assert.Equal(suite.T(), "authorization_pending", errCode)
+	_, _, errCode = d.poll(deviceCode)
+	assert.Equal(suite.T(), "slow_down", errCode)
+
+	d.requests[deviceCode].expires = time.Now().Add(-time.Second)
+	_, _, errCode = d.poll(deviceCode)
+	assert.Equal(suite.T(), "expired_token", errCode)
+	assert.Error(suite.T(), d.approve(deviceCode, "token", "", "dummy@example.org"))
+}
+
+func (suite *DeviceTests) TestDeviceFlowCap() {
+	d := newDeviceFlow(time.Minute, 0)
+	for range maxDeviceRequests {
+		_, _, err := d.start()
+		assert.NoError(suite.T(), err)
+	}
+	_, _, err := d.start()
+	assert.ErrorIs(suite.T(), err, errTooManyDeviceRequests)
+
+	// the expired authorizations make room for new ones
+	for _, r := range d.requests {
+		r.expires = time.Now().Add(-time.Second)
+	}
+	_, _, err = d.start()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), d.requests, 1)
+}
+
+func (suite *DeviceTests) TestDeviceCodeLimit() {
+	auth := AuthHandler{
+		Config:        config.AuthConf{PublicURL: "https://auth.example.org"},
+		device:        newDeviceFlow(time.Minute, 0),
+		deviceLimiter: newDeviceCodeLimiter(2),
+	}
+	app := iris.New()
+	app.Post("/device/code", auth.postDeviceCode)
+	e := httptest.New(suite.T(), app)
+
+	e.POST("/device/code").Expect().Status(iris.StatusOK)
+	e.POST("/device/code").Expect().Status(iris.StatusOK)
+	e.POST("/device/code").Expect().Status(iris.StatusTooManyRequests).JSON().Object().Value("error").IsEqual("slow_down")
+	assert.Len(suite.T(), auth.device.requests, 2)
+}
+
+func (suite *DeviceTests) TestDeviceSessionExpires() {
+	auth := AuthHandler{device: newDeviceFlow(time.Minute, 0)}
+	deviceCode, _, err := auth.device.start()
+	assert.NoError(suite.T(), err)
+
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Get("/device", func(ctx iris.Context) {
+		s := sessions.Get(ctx)
+		s.Set("device", deviceCode)
+		s.Set("device_expires", time.Now().Add(-time.Second).Unix())
+	})
+	app.Get("/login", func(ctx iris.Context) {
+		// the expired authorization is forgotten and the login goes on
+		assert.False(suite.T(), auth.completeDevice(ctx, "token", "", "dummy@example.org"))
+		assert.Empty(suite.T(), sessions.Get(ctx).GetString("device"))
+	})
+	e := httptest.New(suite.T(), app)
+
+	e.GET("/device").Expect().Status(iris.StatusOK)
+	e.GET("/login").Expect().Status(iris.StatusOK)
+
+	_, _, errCode := auth.device.poll(deviceCode)
+	assert.Equal(suite.T(), "authorization_pending", errCode)
+}
+
+func (suite *DeviceTests) TestDeviceEndpoints() {
+	auth := AuthHandler{Config: config.AuthConf{PublicURL: "https://auth.example.org"}, device: newDeviceFlow(time.Minute, 0)}
+	app := iris.New()
+	app.Post("/device/code", auth.postDeviceCode)
+	app.Post("/device/token", auth.postDeviceToken)
+	e := httptest.New(suite.T(), app)
+
+	res := e.POST("/device/code").Expect().Status(iris.StatusOK).JSON().Object()
+	res.Value("verification_uri").IsEqual("https://auth.example.org/device")
+	res.Value("expires_in").Number().IsEqual(60)
+	deviceCode := res.Value("device_code").String().Raw()
+
+	e.POST("/device/token").WithFormField("grant_type", "authorization_code").WithFormField("device_code", deviceCode).
+		Expect().Status(iris.StatusBadRequest).JSON().Object().Value("error").IsEqual("unsupported_grant_type")
+	e.POST("/device/token").WithFormField("grant_type", deviceGrantType).WithFormField("device_code", deviceCode).
+		Expect().Status(iris.StatusBadRequest).JSON().Object().Value("error").IsEqual("authorization_pending")
+
+	assert.NoError(suite.T(), auth.device.approve(deviceCode, "token", "", "dummy@example.org"))
+	token := e.POST("/device/token").WithFormField("grant_type", deviceGrantType).WithFormField("device_code", deviceCode).
+		Expect().Status(iris.StatusOK).JSON().Object()
+	token.Value("access_token").IsEqual("token")
+	token.Value("token_type").IsEqual("Bearer")
+}
@@ -0,0 +1,53 @@
+// Binary values are exchanged with the service as base64url strings
+const fromBase64URL = (value) => Uint8Array.from(atob(value.replace(/-/g, '+').replace(/_/g, '/')), c => c.charCodeAt(0))
+const toBase64URL = (buffer) => btoa(String.fromCharCode(...new Uint8Array(buffer))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+
+const post = async (url, body) => {
+    const response = await fetch(url, {
+        method: 'POST',
+        credentials: 'same-origin',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body || {}),
+    })
+    const result = await response.json()
+    if (!response.ok) {
+        throw new Error(result.error || response.statusText)
+    }
+
+    return result
+}
+
+$("#webauthn-start").on("click", async () => {
+    $("#error").addClass("d-none")
+    try {
+        const options = await post('/webauthn/options')
+        const publicKey = options.publicKey
+        publicKey.challenge = fromBase64URL(publicKey.challenge)
+
+        let body
+        if (options.mode === 'register') {
+            publicKey.user.id = fromBase64URL(publicKey.user.id)
+            publicKey.excludeCredentials.forEach(c => c.id = fromBase64URL(c.id))
+            const credential = await navigator.credentials.create({ publicKey })
+            body = {
+                id: credential.id,
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                attestationObject: toBase64URL(credential.response.attestationObject),
+            }
+        } else {
+            publicKey.allowCredentials.forEach(c => c.id = fromBase64URL(c.id))
+            const credential = await navigator.credentials.get({ publicKey })
+            body = {
+                id: credential.id,
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                authenticatorData: toBase64URL(credential.response.authenticatorData),
+                signature: toBase64URL(credential.response.signature),
+            }
+        }
+
+        const result = await post('/webauthn/verify', body)
+        window.location = result.next
+    } catch (err) {
+        $("#error").text(err.message).removeClass("d-none")
+    }
+})
@@ -1,20 +1,38 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/kataras/iris/v12"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	log "github.com/sirupsen/logrus"
 )
 
 type Info struct {
-	ClientID  string `json:"client_id"`
-	OidcURI   string `json:"oidc_uri"`
-	PublicKey string `json:"public_key"`
-	InboxURI  string `json:"inbox_uri"`
+	ClientID string `json:"client_id"`
+	OidcURI  string `json:"oidc_uri"`
+	// PublicKey is the key that clients should encrypt with, PublicKeys
+	// lists all keys that are or will become valid
+	PublicKey  string          `json:"public_key"`
+	PublicKeys []PublicKeyInfo `json:"public_keys"`
+	InboxURI   string          `json:"inbox_uri"`
+}
+
+// PublicKeyInfo is a crypt4gh public key with the period it is valid in
+type PublicKeyInfo struct {
+	Key        string     `json:"key"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	Preferred  bool       `json:"preferred"`
 }
 
 // Reads the public key file and returns the public key
@@ -34,9 +52,140 @@ func readPublicKeyFile(filename string) (string, error) {
 	return base64.StdEncoding.EncodeToString(data), err
 }
 
+// publicKeySet holds the crypt4gh public keys of the archive that are
+// handed to clients. The keys are read when their files change, so that
+// keys can be rotated without restarting the service.
+type publicKeySet struct {
+	mu   sync.RWMutex
+	conf []config.C4GHPublicKey
+	// keys are the base64 encoded contents of the files in conf
+	keys []string
+}
+
+func newPublicKeySet(conf []config.C4GHPublicKey) (*publicKeySet, error) {
+	s := &publicKeySet{conf: conf}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load reads all key files, the keys are kept as they were if any of them
+// can not be read or is empty, e.g. while it is being written
+func (s *publicKeySet) load() error {
+	keys := make([]string, len(s.conf))
+	for i, c := range s.conf {
+		key, err := readPublicKeyFile(c.FilePath)
+		if err != nil {
+			return fmt.Errorf("failed to read public key %s: %v", c.FilePath, err)
+		}
+		if key == "" {
+			return fmt.Errorf("public key %s is empty", c.FilePath)
+		}
+		keys[i] = key
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	return nil
+}
+
+// watch reads the keys again whenever something changes in the directories
+// of the key files, until the context is cancelled. Directories are watched
+// rather than the files, since mounted secrets are replaced by swapping a
+// symlink.
+func (s *publicKeySet) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var dirs []string
+	for _, c := range s.conf {
+		dir := filepath.Dir(filepath.Clean(c.FilePath))
+		if slices.Contains(dirs, dir) {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %v", dir, err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			if err := s.load(); err != nil {
+				log.Errorf("failed to reload the public keys after %s changed, keeping the old keys: %v", event.Name, err)
+
+				continue
+			}
+			log.Infof("Reloaded the public keys after %s changed", event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warnf("error while watching the public keys: %v", err)
+		}
+	}
+}
+
+// current returns the keys that are valid at now or later, and the key to
+// encrypt with: the preferred key if it is valid, otherwise the valid key
+// that became valid last
+func (s *publicKeySet) current(now time.Time) (string, []PublicKeyInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	infos := []PublicKeyInfo{}
+	var listed []int
+	encryptWith := -1
+	for i, c := range s.conf {
+		if !c.ValidUntil.IsZero() && !now.Before(c.ValidUntil) {
+			continue
+		}
+		info := PublicKeyInfo{Key: s.keys[i]}
+		if !c.ValidFrom.IsZero() {
+			info.ValidFrom = &c.ValidFrom
+		}
+		if !c.ValidUntil.IsZero() {
+			info.ValidUntil = &c.ValidUntil
+		}
+		infos = append(infos, info)
+		listed = append(listed, i)
+
+		if now.Before(c.ValidFrom) {
+			continue
+		}
+		if encryptWith == -1 || c.Preferred || (!s.conf[encryptWith].Preferred && c.ValidFrom.After(s.conf[encryptWith].ValidFrom)) {
+			encryptWith = i
+		}
+	}
+	if encryptWith == -1 {
+		return "", infos
+	}
+
+	infos[slices.Index(listed, encryptWith)].Preferred = true
+
+	return s.keys[encryptWith], infos
+}
+
 // getInfo returns information needed by the client to authenticate
 func (auth AuthHandler) getInfo(ctx iris.Context) {
-	info := Info{ClientID: auth.OAuth2Config.ClientID, OidcURI: auth.Config.OIDC.Provider, PublicKey: auth.pubKey, InboxURI: auth.Config.S3Inbox}
+	publicKey, publicKeys := auth.publicKeys.current(time.Now())
+	info := Info{ClientID: auth.OAuth2Config.ClientID, OidcURI: auth.Config.OIDC.Provider, PublicKey: publicKey, PublicKeys: publicKeys, InboxURI: auth.Config.S3Inbox}
 
 	err := ctx.JSON(info)
 	if err != nil {
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -53,6 +56,66 @@ func (suite *InfoTests) TestReadPublicKeyFile() {
 	assert.Equal(suite.T(), suite.pubKeyb64, pubKey)
 }
 
+func (suite *InfoTests) TestPublicKeyRotation() {
+	assert.NoError(suite.T(), os.WriteFile(suite.TempDir+"/old.key", []byte("old"), 0600))
+	assert.NoError(suite.T(), os.WriteFile(suite.TempDir+"/new.key", []byte("new"), 0600))
+	old := base64.StdEncoding.EncodeToString([]byte("old"))
+	current := base64.StdEncoding.EncodeToString([]byte("new"))
+
+	rotation := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	keySet, err := newPublicKeySet([]config.C4GHPublicKey{
+		{FilePath: suite.TempDir + "/old.key", ValidUntil: rotation.AddDate(0, 1, 0)},
+		{FilePath: suite.TempDir + "/new.key", ValidFrom: rotation},
+	})
+	assert.NoError(suite.T(), err)
+
+	// the new key is announced before the rotation
+	publicKey, publicKeys := keySet.current(rotation.Add(-time.Hour))
+	assert.Equal(suite.T(), old, publicKey)
+	assert.Len(suite.T(), publicKeys, 2)
+	assert.True(suite.T(), publicKeys[0].Preferred)
+	assert.Equal(suite.T(), rotation, *publicKeys[1].ValidFrom)
+
+	// and used from the rotation on, while the old key is still valid
+	publicKey, publicKeys = keySet.current(rotation)
+	assert.Equal(suite.T(), current, publicKey)
+	assert.Len(suite.T(), publicKeys, 2)
+	assert.True(suite.T(), publicKeys[1].Preferred)
+
+	// the old key is no longer listed once it has expired
+	publicKey, publicKeys = keySet.current(rotation.AddDate(0, 2, 0))
+	assert.Equal(suite.T(), current, publicKey)
+	assert.Equal(suite.T(), []PublicKeyInfo{{Key: current, ValidFrom: &rotation, Preferred: true}}, publicKeys)
+
+	// a preferred key is used while it is valid
+	keySet.conf[0].Preferred = true
+	publicKey, _ = keySet.current(rotation)
+	assert.Equal(suite.T(), old, publicKey)
+}
+
+func (suite *InfoTests) TestPublicKeyReload() {
+	keySet, err := newPublicKeySet([]config.C4GHPublicKey{{FilePath: suite.TempDir + "/pub.key"}})
+	assert.NoError(suite.T(), err)
+	publicKey, _ := keySet.current(time.Now())
+	assert.Equal(suite.T(), suite.pubKeyb64, publicKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- keySet.watch(ctx) }()
+	defer func() {
+		cancel()
+		assert.NoError(suite.T(), <-done)
+	}()
+
+	assert.Eventually(suite.T(), func() bool {
+		// the file is written until the watcher has picked it up
+		_ = os.WriteFile(suite.TempDir+"/pub.key", []byte("rotated"), 0600)
+		publicKey, _ := keySet.current(time.Now())
+
+		return publicKey == base64.StdEncoding.EncodeToString([]byte("rotated"))
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
 func (suite *InfoTests) TearDownTest() {
 	os.RemoveAll(suite.TempDir)
 }
@@ -1,32 +1,28 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/kataras/iris/v12"
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/userauth"
+	log "github.com/sirupsen/logrus"
 )
 
 func generateJwtToken(tokenClaims map[string]interface{}, keyPath, alg string) (string, string, error) {
-	prKey, err := os.ReadFile(filepath.Clean(keyPath))
+	jwtKey, err := readSigningKey(keyPath, alg)
 	if err != nil {
 		return "", "", err
 	}
 
-	jwtKey, err := jwk.ParseKey(prKey, jwk.WithPEM(true))
-	if err != nil {
-		return "", "", err
-	}
-	if err := jwtKey.Set(jwk.AlgorithmKey, alg); err != nil {
-		return "", "", err
-	}
-	if err := jwk.AssignKeyID(jwtKey); err != nil {
-		return "", "", err
-	}
-
 	token := jwt.New()
 	for key, value := range tokenClaims {
 		if err := token.Set(key, value); err != nil {
@@ -42,3 +38,149 @@ func generateJwtToken(tokenClaims map[string]interface{}, keyPath, alg string) (
 
 	return string(tokenString), expireDate.(time.Time).Format("2006-01-02 15:04:05"), nil
 }
+
+// readSigningKey reads the private key in keyPath, with the key ID that
+// the tokens signed with it get in their kid header
+func readSigningKey(keyPath, alg string) (jwk.Key, error) {
+	prKey, err := os.ReadFile(filepath.Clean(keyPath))
+	if err != nil {
+		return nil, err
+	}
+
+	jwtKey, err := jwk.ParseKey(prKey, jwk.WithPEM(true))
+	if err != nil {
+		return nil, err
+	}
+	if err := jwtKey.Set(jwk.AlgorithmKey, alg); err != nil {
+		return nil, err
+	}
+	if err := jwk.AssignKeyID(jwtKey); err != nil {
+		return nil, err
+	}
+
+	return jwtKey, nil
+}
+
+// publicSigningKeys returns the public keys of all keys that auth signs
+// tokens with, so that the tokens signed with a key that is no longer
+// primary can be validated until they expire
+func publicSigningKeys(keys []config.JwtSigningKey) (jwk.Set, error) {
+	set := jwk.NewSet()
+	for _, key := range keys {
+		jwtKey, err := readSigningKey(key.FilePath, key.SignatureAlg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key %s: %v", key.FilePath, err)
+		}
+		pubKey, err := jwtKey.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := pubKey.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+			return nil, err
+		}
+		if _, found := set.LookupKeyID(pubKey.KeyID()); found {
+			continue
+		}
+		if err := set.AddKey(pubKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return set, nil
+}
+
+// jwksMaxAge is how long the services may cache the signing keys, the
+// services fetch them again anyway when a token has an unknown key ID
+const jwksMaxAge = 5 * time.Minute
+
+// getJwks serves the public keys of the signing keys as a JWK set, so that
+// the services can validate the tokens of auth with the keys at its URL
+func (auth AuthHandler) getJwks(ctx iris.Context) {
+	set, err := publicSigningKeys(auth.Config.JwtSigningKeys)
+	if err != nil {
+		log.Errorf("failed to get the signing keys: %v", err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+
+	ctx.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	if err := ctx.JSON(set); err != nil {
+		log.Error("Failed to write the signing keys: ", err)
+	}
+}
+
+// newAccessToken returns a token for subject signed by auth, and its
+// expiration date. The token gets the configured audience and claims
+// together with the claims of the user, see userClaims, a unique ID and the
+// ID of the session it belongs to, if any.
+func (auth AuthHandler) newAccessToken(subject, sessionID string, userClaims map[string]any) (string, string, error) {
+	claims := map[string]interface{}{}
+	for key, value := range auth.Config.JwtClaims {
+		claims[key] = value
+	}
+	for key, value := range userClaims {
+		claims[key] = value
+	}
+	claims[jwt.ExpirationKey] = time.Now().UTC().Add(time.Duration(auth.Config.JwtTTL) * time.Hour)
+	claims[jwt.IssuedAtKey] = time.Now().UTC()
+	claims[jwt.IssuerKey] = auth.Config.JwtIssuer
+	claims[jwt.SubjectKey] = subject
+	claims[jwt.JwtIDKey] = uuid.NewString()
+	if sessionID != "" {
+		claims[userauth.SessionIDClaim] = sessionID
+	}
+	if len(auth.Config.JwtAudience) > 0 {
+		claims[jwt.AudienceKey] = auth.Config.JwtAudience
+	}
+
+	token, expDate, err := generateJwtToken(claims, auth.Config.JwtPrivateKey, auth.Config.JwtSignatureAlg)
+	if err == nil {
+		tokensIssuedTotal.Inc("access")
+	}
+
+	return token, expDate, err
+}
+
+// projectsClaim is the claim with the projects of the user, as read by the
+// api by default
+const projectsClaim = "projects"
+
+// userClaims returns the claims that the tokens of a user get from the
+// login, i.e. the groups of the user when a groups claim is configured and
+// the inbox prefixes and projects assigned to the groups
+func (auth AuthHandler) userClaims(groups []string) map[string]any {
+	claims := map[string]any{}
+	if auth.Config.JwtGroupsClaim != "" && len(groups) > 0 {
+		claims[auth.Config.JwtGroupsClaim] = groups
+	}
+
+	var prefixes, projects []string
+	for _, m := range auth.Config.GroupMappings {
+		if !slices.Contains(groups, m.Group) {
+			continue
+		}
+		for _, prefix := range m.InboxPrefixes {
+			if !slices.Contains(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		for _, project := range m.Projects {
+			if !slices.Contains(projects, project) {
+				projects = append(projects, project)
+			}
+		}
+	}
+	if len(prefixes) > 0 {
+		claims[userauth.InboxPrefixesClaim] = prefixes
+	}
+	if len(projects) > 0 {
+		claims[projectsClaim] = projects
+	}
+
+	if len(claims) == 0 {
+		return nil
+	}
+
+	return claims
+}
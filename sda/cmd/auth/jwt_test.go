@@ -9,9 +9,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -98,3 +101,128 @@ func (suite *JWTTests) TestGenerateJwtToken() {
 		assert.Nil(suite.T(), err, "Couldn't parse expiration date for jwt")
 	}
 }
+
+func (suite *JWTTests) TestNewAccessToken() {
+	auth := AuthHandler{Config: config.AuthConf{
+		JwtIssuer:       "http://local.issuer",
+		JwtPrivateKey:   suite.TempDir + "/ec",
+		JwtSignatureAlg: "ES256",
+		JwtTTL:          2,
+		JwtAudience:     []string{"s3inbox", "api"},
+		JwtClaims:       map[string]any{"project": "sda", "sub": "overridden"},
+		JwtGroupsClaim:  "groups",
+	}}
+
+	ts, _, err := auth.newAccessToken("test@foo.bar", "session-1", auth.userClaims([]string{"group-a", "group-b"}))
+	assert.NoError(suite.T(), err)
+
+	token, err := jwt.Parse([]byte(ts), jwt.WithVerify(false))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "test@foo.bar", token.Subject())
+	assert.Equal(suite.T(), []string{"s3inbox", "api"}, token.Audience())
+	assert.WithinDuration(suite.T(), time.Now().Add(2*time.Hour), token.Expiration(), time.Minute)
+	assert.Equal(suite.T(), "sda", token.PrivateClaims()["project"])
+	assert.Equal(suite.T(), []any{"group-a", "group-b"}, token.PrivateClaims()["groups"])
+	assert.Equal(suite.T(), "session-1", token.PrivateClaims()["sid"])
+	assert.NotEmpty(suite.T(), token.JwtID())
+
+	// every token gets its own ID
+	ts, _, err = auth.newAccessToken("test@foo.bar", "", nil)
+	assert.NoError(suite.T(), err)
+	other, err := jwt.Parse([]byte(ts), jwt.WithVerify(false))
+	assert.NoError(suite.T(), err)
+	assert.NotEqual(suite.T(), token.JwtID(), other.JwtID())
+	assert.NotContains(suite.T(), other.PrivateClaims(), "sid")
+
+	// no groups claim without groups
+	assert.Nil(suite.T(), auth.userClaims(nil))
+	auth.Config.JwtGroupsClaim = ""
+	assert.Nil(suite.T(), auth.userClaims([]string{"group-a"}))
+}
+
+func (suite *JWTTests) TestUserClaims_GroupMappings() {
+	auth := AuthHandler{Config: config.AuthConf{
+		GroupMappings: []config.GroupMapping{
+			{Group: "group-a", InboxPrefixes: []string{"project-a"}, Projects: []string{"a"}},
+			{Group: "group-b", InboxPrefixes: []string{"project-b", "project-a"}},
+			{Group: "group-c", Projects: []string{"c"}},
+		},
+	}}
+
+	claims := auth.userClaims([]string{"group-a", "group-b", "group-d"})
+	assert.Equal(suite.T(), []string{"project-a", "project-b"}, claims["inbox_prefixes"])
+	assert.Equal(suite.T(), []string{"a"}, claims["projects"])
+	assert.NotContains(suite.T(), claims, "groups")
+
+	// groups without mappings give no claims
+	assert.Nil(suite.T(), auth.userClaims([]string{"group-d"}))
+}
+
+func (suite *JWTTests) TestSigningKeyRotation() {
+	keys := []config.JwtSigningKey{
+		{FilePath: suite.TempDir + "/ec", SignatureAlg: "ES256"},
+		{FilePath: suite.TempDir + "/rsa", SignatureAlg: "RS256", Primary: true},
+	}
+	auth := AuthHandler{Config: config.AuthConf{
+		JwtIssuer:       "http://local.issuer",
+		JwtPrivateKey:   suite.TempDir + "/rsa",
+		JwtSignatureAlg: "RS256",
+		JwtTTL:          2,
+		JwtSigningKeys:  keys,
+	}}
+
+	set, err := publicSigningKeys(keys)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, set.Len())
+	for i := range set.Len() {
+		key, _ := set.Key(i)
+		assert.NotEmpty(suite.T(), key.KeyID())
+		assert.Equal(suite.T(), "sig", key.KeyUsage())
+		_, private := key.(jwk.RSAPrivateKey)
+		assert.False(suite.T(), private)
+	}
+
+	// new tokens are signed with the primary key, whose ID is in the header
+	ts, _, err := auth.newAccessToken("test@foo.bar", "", nil)
+	assert.NoError(suite.T(), err)
+	msg, err := jws.Parse([]byte(ts))
+	assert.NoError(suite.T(), err)
+	rsaKey, _ := set.Key(1)
+	assert.Equal(suite.T(), rsaKey.KeyID(), msg.Signatures()[0].ProtectedHeaders().KeyID())
+	_, err = jwt.Parse([]byte(ts), jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true)))
+	assert.NoError(suite.T(), err)
+
+	// tokens signed with the old key are still valid
+	ts, _, err = generateJwtToken(map[string]any{jwt.SubjectKey: "test@foo.bar", jwt.ExpirationKey: time.Now().Add(time.Hour)}, keys[0].FilePath, keys[0].SignatureAlg)
+	assert.NoError(suite.T(), err)
+	_, err = jwt.Parse([]byte(ts), jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true)))
+	assert.NoError(suite.T(), err)
+
+	// a key listed twice is published once
+	set, err = publicSigningKeys(append(keys, keys[0]))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, set.Len())
+
+	_, err = publicSigningKeys([]config.JwtSigningKey{{FilePath: suite.TempDir + "/missing", SignatureAlg: "ES256"}})
+	assert.Error(suite.T(), err)
+}
+
+func (suite *JWTTests) TestGetJwks() {
+	auth := AuthHandler{Config: config.AuthConf{JwtSigningKeys: []config.JwtSigningKey{
+		{FilePath: suite.TempDir + "/ec", SignatureAlg: "ES256", Primary: true},
+	}}}
+	app := iris.New()
+	app.Get("/jwks.json", auth.getJwks)
+	e := httptest.New(suite.T(), app)
+
+	res := e.GET("/jwks.json").Expect().Status(iris.StatusOK)
+	res.Header("Cache-Control").IsEqual("public, max-age=300")
+	body := res.Body().Raw()
+	set, err := jwk.Parse([]byte(body))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, set.Len())
+	key, _ := set.Key(0)
+	assert.Equal(suite.T(), "ES256", key.Algorithm().String())
+	_, private := key.(jwk.ECDSAPrivateKey)
+	assert.False(suite.T(), private)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,9 +15,8 @@ import (
 	"github.com/iris-contrib/middleware/cors"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/sessions"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
-	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
@@ -29,6 +29,8 @@ type LoginOption struct {
 type OIDCData struct {
 	S3Conf map[string]string
 	OIDCID OIDCIdentity
+	// SessionID is the session of the tokens signed by auth, if any
+	SessionID string `json:"-"`
 }
 
 type AuthHandler struct {
@@ -37,7 +39,11 @@ type AuthHandler struct {
 	OIDCProvider *oidc.Provider
 	htmlDir      string
 	staticDir    string
-	pubKey       string
+	publicKeys   *publicKeySet
+	device       *deviceFlow
+	limiter      *loginLimiter
+	// deviceLimiter limits the device codes asked for by an address
+	deviceLimiter *loginLimiter
 }
 
 func (auth AuthHandler) getInboxConfig(ctx iris.Context, authType string) {
@@ -85,13 +91,11 @@ func (auth AuthHandler) getMain(ctx iris.Context) {
 func (auth AuthHandler) getLoginOptions(ctx iris.Context) {
 
 	var response []LoginOption
-	// Only add the OIDC option if it has both id and secret
-	if auth.Config.OIDC.ID != "" && auth.Config.OIDC.Secret != "" {
+	if auth.Config.OIDC.Enabled {
 		response = append(response, LoginOption{Name: "Lifescience-RI", URL: "/oidc"})
 	}
 
-	// Only add the CEGA option if it has both id and secret
-	if auth.Config.Cega.ID != "" && auth.Config.Cega.Secret != "" {
+	if auth.Config.Cega.Enabled {
 		response = append(response, LoginOption{Name: "EGA", URL: "/ega/login"})
 	}
 	err := ctx.JSON(response)
@@ -111,10 +115,25 @@ func (auth AuthHandler) postEGA(ctx iris.Context) {
 	username := userform["username"][0]
 	password := userform["password"][0]
 
-	res, err := authenticateWithCEGA(auth.Config.Cega, username)
+	if auth.loginLocked(ctx, username) {
+		log.WithFields(log.Fields{"authType": "cega", "user": username}).Warn("Login refused, too many failed logins")
+		loginsTotal.Inc("ega", outcomeLocked)
+		auth.audit(ctx, "login", username, "ega", outcomeLocked)
+		s.SetFlash("message", "Too many failed logins, try again later")
+		ctx.Redirect("/ega/login", iris.StatusSeeOther)
+
+		return
+	}
 
+	start := time.Now()
+	res, err := authenticateWithCEGA(auth.Config.Cega, username)
 	if err != nil {
-		log.Error(err)
+		log.WithFields(log.Fields{"authType": "cega", "user": username}).Errorf("Failed to contact EGA: %v", err)
+		auth.observeLogin(ctx, "ega", username, outcomeError, start)
+		s.SetFlash("message", "EGA authentication server could not be contacted")
+		ctx.Redirect("/ega/login", iris.StatusSeeOther)
+
+		return
 	}
 
 	defer res.Body.Close()
@@ -132,6 +151,7 @@ func (auth AuthHandler) postEGA(ctx iris.Context) {
 
 		if err != nil {
 			log.Error("Failed to parse response: ", err)
+			auth.observeLogin(ctx, "ega", username, outcomeError, start)
 
 			return
 		}
@@ -142,45 +162,48 @@ func (auth AuthHandler) postEGA(ctx iris.Context) {
 
 		if ok {
 			log.WithFields(log.Fields{"authType": "cega", "user": username}).Info("Valid password entered by user")
-			claims := map[string]interface{}{
-				jwt.ExpirationKey: time.Now().UTC().Add(time.Duration(auth.Config.JwtTTL) * time.Hour),
-				jwt.IssuedAtKey:   time.Now().UTC(),
-				jwt.IssuerKey:     auth.Config.JwtIssuer,
-				jwt.SubjectKey:    username,
-			}
-			token, expDate, err := generateJwtToken(claims, auth.Config.JwtPrivateKey, auth.Config.JwtSignatureAlg)
+			auth.observeLogin(ctx, "ega", username, outcomeSuccess, start)
+			sessionID := auth.startSession(ctx, username)
+			token, expDate, err := auth.newAccessToken(username, sessionID, nil)
 			if err != nil {
 				log.Errorf("error when generating token: %v", err)
 			}
-
-			s3conf := getS3ConfigMap(token, auth.Config.S3Inbox, username)
-			s.SetFlash("ega", s3conf)
-			ctx.ViewData("infoUrl", auth.Config.InfoURL)
-			ctx.ViewData("infoText", auth.Config.InfoText)
-			ctx.ViewData("User", username)
-			ctx.ViewData("Token", token)
-			ctx.ViewData("ExpDate", expDate)
-
-			err = ctx.View("ega.html")
-			if err != nil {
-				log.Error("Failed to parse response: ", err)
-
-				return
-			}
+			auth.finishLogin(ctx, loginResult{
+				AuthType:     "ega",
+				User:         username,
+				SessionID:    sessionID,
+				Token:        token,
+				ExpDate:      expDate,
+				RefreshToken: auth.newRefreshToken(username, sessionID, nil),
+				S3Conf:       getS3ConfigMap(token, auth.Config.S3Inbox, username),
+			})
 
 		} else {
 			log.WithFields(log.Fields{"authType": "cega", "user": username}).Error("Invalid password entered by user")
+			auth.observeLogin(ctx, "ega", username, outcomeFailure, start)
+			auth.loginFailed(ctx, "ega", username)
 			s.SetFlash("message", "Provided credentials are not valid")
 			ctx.Redirect("/ega/login", iris.StatusSeeOther)
 		}
 
 	case 404:
+		// EGA does not know the user
 		log.WithFields(log.Fields{"authType": "cega", "user": username}).Error("Failed to authenticate user")
+		auth.observeLogin(ctx, "ega", username, outcomeFailure, start)
+		auth.loginFailed(ctx, "ega", username)
 		s.SetFlash("message", "EGA authentication server could not be contacted")
 		ctx.Redirect("/ega/login", iris.StatusSeeOther)
 
 	default:
 		log.WithFields(log.Fields{"authType": "cega", "user": username}).Error("Failed to authenticate user")
+		outcome := outcomeFailure
+		if res.StatusCode >= 500 {
+			outcome = outcomeError
+		}
+		auth.observeLogin(ctx, "ega", username, outcome, start)
+		if outcome == outcomeFailure {
+			auth.loginFailed(ctx, "ega", username)
+		}
 		s.SetFlash("message", "Provided credentials are not valid")
 		ctx.Redirect("/ega/login", iris.StatusSeeOther)
 	}
@@ -241,6 +264,8 @@ func (auth AuthHandler) elixirLogin(ctx iris.Context) *OIDCData {
 
 	if state != sessionState {
 		log.Errorf("State of incoming request (%s) does not match with your session's state (%s)", state, sessionState)
+		loginsTotal.Inc("oidc", outcomeFailure)
+		auth.audit(ctx, "login", "", "oidc", outcomeFailure)
 		_, err := ctx.Writef("Authentication failed. You may need to clear your session cookies and try again.")
 		if err != nil {
 			log.Error("Failed to write response: ", err)
@@ -252,9 +277,11 @@ func (auth AuthHandler) elixirLogin(ctx iris.Context) *OIDCData {
 	}
 
 	code := ctx.Request().URL.Query().Get("code")
+	start := time.Now()
 	idStruct, err := authenticateWithOidc(auth.OAuth2Config, auth.OIDCProvider, code, auth.Config.OIDC.JwkURL)
 	if err != nil {
 		log.WithFields(log.Fields{"authType": "oidc"}).Errorf("authentication failed: %s", err)
+		auth.observeLogin(ctx, "oidc", "", outcomeError, start)
 		_, err := ctx.Writef("Authentication failed. You may need to clear your session cookies and try again.")
 		if err != nil {
 			log.Error("Failed to write response: ", err)
@@ -264,30 +291,29 @@ func (auth AuthHandler) elixirLogin(ctx iris.Context) *OIDCData {
 
 		return nil
 	}
+	auth.observeLogin(ctx, "oidc", idStruct.User, outcomeSuccess, start)
 	err = auth.Config.DB.UpdateUserInfo(idStruct.User, idStruct.Profile, idStruct.Email, idStruct.EdupersonEntitlement)
 	if err != nil {
 		log.Warn("Could not log user info.")
 	}
 
+	var sessionID string
 	if auth.Config.ResignJwt {
-		claims := map[string]interface{}{
-			jwt.ExpirationKey: time.Now().UTC().Add(time.Duration(auth.Config.JwtTTL) * time.Hour),
-			jwt.IssuedAtKey:   time.Now().UTC(),
-			jwt.IssuerKey:     auth.Config.JwtIssuer,
-			jwt.SubjectKey:    idStruct.Profile,
-		}
-		token, expDate, err := generateJwtToken(claims, auth.Config.JwtPrivateKey, auth.Config.JwtSignatureAlg)
+		userClaims := auth.userClaims(idStruct.EdupersonEntitlement)
+		sessionID = auth.startSession(ctx, idStruct.Profile)
+		token, expDate, err := auth.newAccessToken(idStruct.Profile, sessionID, userClaims)
 		if err != nil {
 			log.Errorf("error when generating token: %v", err)
 		}
 		idStruct.Token = token
 		idStruct.ExpDate = expDate
+		idStruct.RefreshToken = auth.newRefreshToken(idStruct.Profile, sessionID, userClaims)
 	}
 
 	log.WithFields(log.Fields{"authType": "oidc", "user": idStruct.User}).Infof("User was authenticated")
 	s3conf := getS3ConfigMap(idStruct.Token, auth.Config.S3Inbox, idStruct.User)
 
-	return &OIDCData{S3Conf: s3conf, OIDCID: idStruct}
+	return &OIDCData{S3Conf: s3conf, OIDCID: idStruct, SessionID: sessionID}
 }
 
 // getOIDCLogin renders the `oidc.html` template to the given iris context
@@ -298,21 +324,17 @@ func (auth AuthHandler) getOIDCLogin(ctx iris.Context) {
 		return
 	}
 
-	s := sessions.Get(ctx)
-	s.SetFlash("oidc", oidcData.S3Conf)
-	ctx.ViewData("infoUrl", auth.Config.InfoURL)
-	ctx.ViewData("infoText", auth.Config.InfoText)
-	ctx.ViewData("User", oidcData.OIDCID.User)
-	ctx.ViewData("Passport", oidcData.OIDCID.Passport)
-	ctx.ViewData("Token", oidcData.OIDCID.Token)
-	ctx.ViewData("ExpDate", oidcData.OIDCID.ExpDate)
-
-	err := ctx.View("oidc.html")
-	if err != nil {
-		log.Error("Failed to view login form: ", err)
-
-		return
-	}
+	auth.finishLogin(ctx, loginResult{
+		AuthType:     "oidc",
+		User:         oidcData.OIDCID.User,
+		SessionID:    oidcData.SessionID,
+		Groups:       oidcData.OIDCID.EdupersonEntitlement,
+		Passport:     oidcData.OIDCID.Passport,
+		Token:        oidcData.OIDCID.Token,
+		ExpDate:      oidcData.OIDCID.ExpDate,
+		RefreshToken: oidcData.OIDCID.RefreshToken,
+		S3Conf:       oidcData.S3Conf,
+	})
 }
 
 // getOIDCCORSLogin returns the oidc data as JSON to the given iris context
@@ -322,6 +344,18 @@ func (auth AuthHandler) getOIDCCORSLogin(ctx iris.Context) {
 	if oidcData == nil {
 		return
 	}
+	if auth.secondFactorRequired(loginResult{User: oidcData.OIDCID.User, Groups: oidcData.OIDCID.EdupersonEntitlement}) {
+		ctx.StopWithJSON(iris.StatusForbidden, iris.Map{"error": "a second factor is required, log in at " + requestBaseURL(ctx) + "/"})
+
+		return
+	}
+
+	if oidcData.OIDCID.RefreshToken != "" {
+		sessions.Get(ctx).Set("refresh_token", oidcData.OIDCID.RefreshToken)
+	}
+	if oidcData.SessionID != "" {
+		sessions.Get(ctx).Set("session_id", oidcData.SessionID)
+	}
 
 	err := ctx.JSON(oidcData)
 	if err != nil {
@@ -369,19 +403,21 @@ func main() {
 	var oauth2Config oauth2.Config
 	var provider *oidc.Provider
 
-	if config.Auth.OIDC.ID != "" && config.Auth.OIDC.Secret != "" {
+	if config.Auth.OIDC.Enabled {
 		// Initialise OIDC client
 		oauth2Config, provider = getOidcClient(config.Auth.OIDC)
 	}
 
 	// Create handler struct for the web server
 	authHandler := AuthHandler{
-		Config:       config.Auth,
-		OAuth2Config: oauth2Config,
-		OIDCProvider: provider,
-		htmlDir:      "./frontend/templates",
-		staticDir:    "./frontend/static",
-		pubKey:       "",
+		Config:        config.Auth,
+		OAuth2Config:  oauth2Config,
+		OIDCProvider:  provider,
+		htmlDir:       "./frontend/templates",
+		staticDir:     "./frontend/static",
+		device:        newDeviceFlow(config.Auth.DeviceCodeTTL, config.Auth.DevicePollInterval),
+		limiter:       newLoginLimiter(config.Auth.LoginLimit),
+		deviceLimiter: newDeviceCodeLimiter(config.Auth.DeviceCodeLimit),
 	}
 
 	// Initialise web server
@@ -402,18 +438,6 @@ func main() {
 
 	app.Use(sess.Handler())
 
-	// Connect to DB
-	authHandler.Config.DB, err = database.NewSDAdb(config.Database)
-	if err != nil {
-		log.Error(err)
-		panic(err)
-	}
-	if authHandler.Config.DB.Version < 14 {
-		log.Error("database schema v14 is required")
-		panic(err)
-	}
-	defer authHandler.Config.DB.Close()
-
 	app.RegisterView(iris.HTML(authHandler.htmlDir, ".html"))
 	app.HandleDir("/public", iris.Dir(authHandler.staticDir))
 
@@ -421,32 +445,87 @@ func main() {
 	app.Get("/login-options", authHandler.getLoginOptions)
 
 	// EGA endpoints
-	app.Post("/ega", authHandler.postEGA)
-	app.Get("/ega/s3conf", authHandler.getEGAConf)
-	app.Get("/ega/login", addCSPheaders, authHandler.getEGALogin)
+	if config.Auth.Cega.Enabled {
+		app.Post("/ega", authHandler.postEGA)
+		app.Get("/ega/s3conf", authHandler.getEGAConf)
+		app.Get("/ega/login", addCSPheaders, authHandler.getEGALogin)
+	}
 
 	// OIDC endpoints
-	app.Get("/oidc", authHandler.getOIDC)
-	app.Get("/oidc/s3conf", authHandler.getOIDCConf)
-	app.Get("/oidc/login", authHandler.getOIDCLogin)
-	app.Get("/oidc/cors_login", authHandler.getOIDCCORSLogin)
+	if config.Auth.OIDC.Enabled {
+		app.Get("/oidc", authHandler.getOIDC)
+		app.Get("/oidc/s3conf", authHandler.getOIDCConf)
+		app.Get("/oidc/login", authHandler.getOIDCLogin)
+		app.Get("/oidc/cors_login", authHandler.getOIDCCORSLogin)
+	}
+
+	// Device authorization endpoints, for command line tools, that send
+	// the users to the public URL of auth
+	if config.Auth.PublicURL != "" {
+		app.Post("/device/code", authHandler.postDeviceCode)
+		app.Post("/device/token", authHandler.postDeviceToken)
+		app.Get("/device", addCSPheaders, authHandler.getDevice)
+		app.Post("/device", authHandler.postDevice)
+	} else {
+		log.Info("auth.publicUrl is not set, the device flow is turned off")
+	}
 
-	authHandler.pubKey, err = readPublicKeyFile(authHandler.Config.PublicFile)
+	// WebAuthn second factor endpoints
+	if config.Auth.WebAuthn.Enabled {
+		app.Get("/webauthn", addCSPheaders, authHandler.getWebAuthn)
+		app.Post("/webauthn/options", authHandler.postWebAuthnOptions)
+		app.Post("/webauthn/verify", authHandler.postWebAuthnVerify)
+		app.Get("/webauthn/done", authHandler.getSecondFactorDone)
+	}
+
+	// TOTP second factor of the logins with a password
+	if authHandler.Config.TOTP.Enabled {
+		app.Get("/totp", addCSPheaders, authHandler.getTOTP)
+		app.Post("/totp", addCSPheaders, authHandler.postTOTP)
+		app.Post("/totp/enroll", addCSPheaders, authHandler.postTOTPEnroll)
+		app.Post("/totp/recovery-codes", addCSPheaders, authHandler.postTOTPRecoveryCodes)
+		app.Post("/totp/disable", addCSPheaders, authHandler.postTOTPDisable)
+		app.Get("/totp/done", authHandler.getSecondFactorDone)
+	}
+
+	// Self-service S3 credentials of the inbox
+	app.Get("/s3credentials", addCSPheaders, authHandler.getS3Credentials)
+	app.Post("/s3credentials", addCSPheaders, authHandler.postS3Credentials)
+	app.Post("/s3credentials/regenerate", addCSPheaders, authHandler.postS3CredentialsRegenerate)
+	app.Post("/s3credentials/revoke", addCSPheaders, authHandler.postS3CredentialsRevoke)
+	app.Get("/s3credentials/s3conf", authHandler.getS3CredentialsConf)
+
+	// Endpoint for getting a new access token with a refresh token
+	app.Post("/token/refresh", authHandler.postTokenRefresh)
+
+	// Listing and revoking the sessions of the user that is logged in
+	app.Get("/sessions", authHandler.getSessions)
+	app.Delete("/sessions", authHandler.deleteSessions)
+	app.Delete("/sessions/{id}", authHandler.deleteSession)
+
+	authHandler.publicKeys, err = newPublicKeySet(authHandler.Config.PublicKeys)
 	if err != nil {
-		log.Panicf("Failed to read public key: %s", err.Error())
+		log.Panicf("Failed to read public keys: %s", err.Error())
 	}
 
 	// Endpoint for client login info
 	app.Get("/info", authHandler.getInfo)
 
+	// Public keys of the keys that auth signs tokens with
+	if authHandler.Config.ResignJwt {
+		if _, err := publicSigningKeys(authHandler.Config.JwtSigningKeys); err != nil {
+			log.Panicf("Failed to read signing keys: %s", err.Error())
+		}
+		app.Get("/jwks.json", authHandler.getJwks)
+	}
+
 	app.UseGlobal(globalHeaders)
 
+	var runner iris.Runner
 	if config.Server.Cert != "" && config.Server.Key != "" {
-
 		log.Infoln("Serving content using https")
-		err = app.Run(iris.TLS("0.0.0.0:8080", config.Server.Cert, config.Server.Key))
+		runner = iris.TLS("0.0.0.0:8080", config.Server.Cert, config.Server.Key)
 	} else {
-
 		log.Infoln("Serving content using http")
 		server := &http.Server{
 			Addr:              "0.0.0.0:8080",
@@ -455,9 +534,34 @@ func main() {
 			IdleTimeout:       30 * time.Second,
 			ReadHeaderTimeout: 3 * time.Second,
 		}
-		err = app.Run(iris.Server(server))
+		runner = iris.Server(server)
 	}
-	if err != nil {
-		log.Error("Failed to start server:", err)
+
+	config.Database.RequiredVersion = 14
+	service := lifecycle.New()
+	service.Add(
+		lifecycle.Config("auth", nil),
+		lifecycle.Database(config.Database, &authHandler.Config.DB),
+		lifecycle.Metrics(config.Metrics.Address),
+		lifecycle.Component{
+			Name:   "publicKeys",
+			Run:    authHandler.publicKeys.watch,
+			Reload: authHandler.publicKeys.load,
+		},
+		lifecycle.Component{
+			Name:      "server",
+			DependsOn: []string{"database"},
+			Run: func(context.Context) error {
+				// the address of the user is taken from the headers of the
+				// proxy in front of auth, when they are configured
+				return app.Run(runner, iris.WithoutInterruptHandler, iris.WithoutServerError(iris.ErrServerClosed), iris.WithRemoteAddrHeader(config.Auth.RemoteAddrHeaders...))
+			},
+			Stop: func(ctx context.Context) error {
+				return app.Shutdown(ctx)
+			},
+		},
+	)
+	if err := service.Run(); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// loginResult is what a login hands to the user once the user has passed
+// the second factor, if one is needed
+type loginResult struct {
+	// AuthType is "ega" or "oidc", naming the view and the s3conf flash
+	AuthType     string
+	User         string
+	SessionID    string
+	Groups       []string
+	Passport     []string
+	Token        string
+	ExpDate      string
+	RefreshToken string
+	S3Conf       map[string]string
+}
+
+// finishLogin shows the result of the login, or keeps it in the session
+// and sends the user to the second factor first when that is needed
+func (auth AuthHandler) finishLogin(ctx iris.Context, login loginResult) {
+	if factor := auth.secondFactor(login); factor != "" {
+		s := sessions.Get(ctx)
+		s.Set("pending_login", login)
+		// only the second factor that is asked for can finish the login
+		s.Set("pending_factor", factor)
+		s.Delete("second_factor")
+		ctx.Redirect("/"+factor, iris.StatusSeeOther)
+
+		return
+	}
+
+	auth.showLogin(ctx, login)
+}
+
+// secondFactor returns the second factor that the user must log in with,
+// "webauthn" or "totp", or an empty string when none is needed. Passkeys
+// are asked for rather than TOTP codes when the user has both.
+func (auth AuthHandler) secondFactor(login loginResult) string {
+	switch {
+	case auth.secondFactorRequired(login):
+		return "webauthn"
+	case auth.totpRequired(login):
+		return "totp"
+	default:
+		return ""
+	}
+}
+
+// pendingLogin returns the user of the session that the second factor is
+// used for, and whether the user is in the middle of a login with that
+// factor rather than managing it after having logged in
+func pendingLogin(ctx iris.Context, factor string) (user string, pending bool) {
+	s := sessions.Get(ctx)
+	if login, ok := s.Get("pending_login").(loginResult); ok && s.GetString("pending_factor") == factor {
+		return login.User, true
+	}
+
+	return s.GetString("user"), false
+}
+
+// secondFactorRequired reports whether the user must log in with a second
+// factor, because of one of the groups of the user or because the user has
+// registered a credential. When the credentials can not be looked up the
+// second factor is required.
+func (auth AuthHandler) secondFactorRequired(login loginResult) bool {
+	if !auth.Config.WebAuthn.Enabled {
+		return false
+	}
+	for _, role := range auth.Config.WebAuthn.Roles {
+		if role == "*" || slices.Contains(login.Groups, role) {
+			return true
+		}
+	}
+
+	creds, err := auth.Config.DB.GetWebAuthnCredentials(login.User)
+	if err != nil {
+		log.Errorf("failed to get the WebAuthn credentials of %s: %v", login.User, err)
+
+		return true
+	}
+
+	return len(creds) > 0
+}
+
+// showLogin hands the tokens to the device flow that the user logged in
+// for, or shows them to the user. The failed logins of the user are only
+// forgotten here, once the second factor has been passed as well.
+func (auth AuthHandler) showLogin(ctx iris.Context, login loginResult) {
+	auth.limiter.succeed(login.User)
+	if auth.completeDevice(ctx, login.Token, login.RefreshToken, login.User) {
+		return
+	}
+
+	s := sessions.Get(ctx)
+	s.SetFlash(login.AuthType, login.S3Conf)
+	if login.RefreshToken != "" {
+		s.Set("refresh_token", login.RefreshToken)
+	}
+	if login.SessionID != "" {
+		s.Set("session_id", login.SessionID)
+	}
+	// the user can add a second factor from now on
+	s.Set("user", login.User)
+	s.Set("auth_type", login.AuthType)
+
+	ctx.ViewData("infoUrl", auth.Config.InfoURL)
+	ctx.ViewData("infoText", auth.Config.InfoText)
+	ctx.ViewData("User", login.User)
+	ctx.ViewData("Passport", login.Passport)
+	ctx.ViewData("Token", login.Token)
+	ctx.ViewData("ExpDate", login.ExpDate)
+	ctx.ViewData("RefreshToken", login.RefreshToken)
+	ctx.ViewData("WebAuthn", auth.Config.WebAuthn.Enabled)
+	ctx.ViewData("TOTP", auth.Config.TOTP.Enabled && login.AuthType == "ega")
+
+	if err := ctx.View(login.AuthType + ".html"); err != nil {
+		log.Error("Failed to view login result: ", err)
+	}
+}
+
+// getSecondFactorDone shows the result of the login once the user has
+// passed the second factor
+func (auth AuthHandler) getSecondFactorDone(ctx iris.Context) {
+	s := sessions.Get(ctx)
+	login, ok := s.Get("pending_login").(loginResult)
+	if !ok || !s.GetBooleanDefault("second_factor", false) {
+		ctx.Redirect("/")
+
+		return
+	}
+	s.Delete("pending_login")
+	s.Delete("pending_factor")
+	s.Delete("second_factor")
+
+	auth.showLogin(ctx, login)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
@@ -23,11 +24,13 @@ type OIDCIdentity struct {
 	Email                string
 	EdupersonEntitlement []string
 	ExpDate              string
+	// RefreshToken is only set when auth re-signs the token
+	RefreshToken string
 }
 
 // Configure an OpenID Connect aware OAuth2 client.
 func getOidcClient(conf config.OIDCConfig) (oauth2.Config, *oidc.Provider) {
-	contx := context.Background()
+	contx := oidc.ClientContext(context.Background(), outbound.Client(30*time.Second))
 	provider, err := oidc.NewProvider(contx, conf.Provider)
 	if err != nil {
 		log.Fatal(err)
@@ -46,7 +49,7 @@ func getOidcClient(conf config.OIDCConfig) (oauth2.Config, *oidc.Provider) {
 
 // Authenticate with an Oidc client.against OIDC AAI
 func authenticateWithOidc(oauth2Config oauth2.Config, provider *oidc.Provider, code, jwkURL string) (OIDCIdentity, error) {
-	contx := context.Background()
+	contx := oidc.ClientContext(context.Background(), outbound.Client(30*time.Second))
 	defer contx.Done()
 	var idStruct OIDCIdentity
 
@@ -117,7 +120,7 @@ func authenticateWithOidc(oauth2Config oauth2.Config, provider *oidc.Provider, c
 
 // Validate raw (OIDC) jwt against public key from jwk. Return parsed jwt and its expiration date.
 func validateToken(rawJwt, jwksURL string) (*jwt.Token, string, error) {
-	set, err := jwk.Fetch(context.Background(), jwksURL)
+	set, err := jwk.Fetch(context.Background(), jwksURL, jwk.WithHTTPClient(outbound.Client(30*time.Second)))
 	if err != nil {
 		return nil, "", fmt.Errorf("%s", err.Error())
 	}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// The failed logins with a password or a TOTP code are counted by the
+// address of the user and by account. An address or account with too many
+// failures within the window is locked out for a while, so that passwords
+// and codes can not be guessed, and the lockout is raised as an alert. The
+// counts are kept in memory, by each instance of auth.
+
+var lockoutsTotal = metrics.NewCounter("sda_auth_lockouts_total",
+	"Lockouts after too many failed logins by scope, address or account.", "scope")
+
+// outcomeLocked is the outcome of a login that was refused because the
+// address or the account was locked out
+const outcomeLocked = "locked"
+
+// Scopes of the limits of failed logins
+const (
+	scopeAddress = "address"
+	scopeAccount = "account"
+)
+
+// failedLogins are the failures of an address or an account within the
+// window that started at start
+type failedLogins struct {
+	start       time.Time
+	failures    int
+	lockedUntil time.Time
+}
+
+// loginLimiter keeps the failed logins in memory, by scope and address or
+// account
+type loginLimiter struct {
+	mu      sync.Mutex
+	logins  map[string]*failedLogins
+	limits  config.LoginLimitConfig
+	enabled bool
+}
+
+func newLoginLimiter(limits config.LoginLimitConfig) *loginLimiter {
+	return &loginLimiter{
+		logins:  map[string]*failedLogins{},
+		limits:  limits,
+		enabled: limits.AddressFailures > 0 || limits.AccountFailures > 0,
+	}
+}
+
+// limitKey is the key of the failures of an address or an account, user
+// names are matched regardless of case
+func limitKey(scope, value string) string {
+	if scope == scopeAccount {
+		value = strings.ToLower(value)
+	}
+
+	return scope + ":" + value
+}
+
+// keys returns the keys of the address and the account that are limited,
+// by scope
+func (l *loginLimiter) keys(addr, user string) map[string]string {
+	keys := map[string]string{}
+	if l.limits.AddressFailures > 0 && addr != "" {
+		keys[scopeAddress] = limitKey(scopeAddress, addr)
+	}
+	if l.limits.AccountFailures > 0 && user != "" {
+		keys[scopeAccount] = limitKey(scopeAccount, user)
+	}
+
+	return keys
+}
+
+// lockedUntil returns when the lockout of the address or the account ends,
+// or the zero time when neither is locked out at now
+func (l *loginLimiter) lockedUntil(addr, user string, now time.Time) time.Time {
+	if l == nil || !l.enabled {
+		return time.Time{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var until time.Time
+	for _, key := range l.keys(addr, user) {
+		if f, ok := l.logins[key]; ok && f.lockedUntil.After(now) && f.lockedUntil.After(until) {
+			until = f.lockedUntil
+		}
+	}
+
+	return until
+}
+
+// fail records a failed login of the user from the address at now, and
+// returns the scopes that were locked out by it
+func (l *loginLimiter) fail(addr, user string, now time.Time) []string {
+	if l == nil || !l.enabled {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, f := range l.logins {
+		if now.Sub(f.start) >= l.limits.Window && !f.lockedUntil.After(now) {
+			delete(l.logins, key)
+		}
+	}
+
+	var locked []string
+	for _, scope := range []string{scopeAddress, scopeAccount} {
+		key, ok := l.keys(addr, user)[scope]
+		if !ok {
+			continue
+		}
+		f, ok := l.logins[key]
+		if !ok {
+			f = &failedLogins{start: now}
+			l.logins[key] = f
+		}
+		if f.lockedUntil.After(now) {
+			continue
+		}
+		f.failures++
+
+		limit := l.limits.AddressFailures
+		if scope == scopeAccount {
+			limit = l.limits.AccountFailures
+		}
+		if f.failures >= limit {
+			f.lockedUntil = now.Add(l.limits.Lockout)
+			f.start = f.lockedUntil
+			f.failures = 0
+			locked = append(locked, scope)
+		}
+	}
+
+	return locked
+}
+
+// succeed forgets the failed logins of the account, after the user has
+// logged in. The failures of the address are kept, since it may be used to
+// guess the passwords of other accounts.
+func (l *loginLimiter) succeed(user string) {
+	if l == nil || !l.enabled {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.logins, limitKey(scopeAccount, user))
+}
+
+// loginLocked reports whether the logins of the user from the address of
+// the request are locked out
+func (auth AuthHandler) loginLocked(ctx iris.Context, user string) bool {
+	return !auth.limiter.lockedUntil(ctx.RemoteAddr(), user, time.Now()).IsZero()
+}
+
+// loginFailed records a failed login of the user with the provider, and
+// raises an alert when the address or the account is locked out by it
+func (auth AuthHandler) loginFailed(ctx iris.Context, provider, user string) {
+	for _, scope := range auth.limiter.fail(ctx.RemoteAddr(), user, time.Now()) {
+		lockoutsTotal.Inc(scope)
+		log.WithFields(log.Fields{
+			"alert":       true,
+			"scope":       scope,
+			"user":        user,
+			"provider":    provider,
+			"remote_addr": ctx.RemoteAddr(),
+		}).Warnf("Too many failed logins, the %s is locked out for %s", scope, auth.Config.LoginLimit.Lockout)
+		auth.audit(ctx, "lockout", user, provider, scope)
+	}
+}
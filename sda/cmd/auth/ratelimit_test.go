@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	irishttptest "github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LoginLimitTests struct {
+	suite.Suite
+	limits config.LoginLimitConfig
+}
+
+func TestLoginLimitTestSuite(t *testing.T) {
+	suite.Run(t, new(LoginLimitTests))
+}
+
+func (suite *LoginLimitTests) SetupTest() {
+	suite.limits = config.LoginLimitConfig{AddressFailures: 4, AccountFailures: 2, Window: time.Minute, Lockout: 5 * time.Minute}
+}
+
+func (suite *LoginLimitTests) TestAccountLockout() {
+	l := newLoginLimiter(suite.limits)
+	now := time.Now()
+
+	assert.Empty(suite.T(), l.fail("10.0.0.1", "dummy", now))
+	assert.True(suite.T(), l.lockedUntil("10.0.0.1", "dummy", now).IsZero())
+	assert.Equal(suite.T(), []string{scopeAccount}, l.fail("10.0.0.2", "Dummy", now.Add(time.Second)))
+
+	// the account is locked out from every address
+	assert.True(suite.T(), now.Add(time.Second+5*time.Minute).Equal(l.lockedUntil("10.0.0.3", "dummy", now.Add(2*time.Second))))
+	assert.True(suite.T(), l.lockedUntil("10.0.0.3", "other", now.Add(2*time.Second)).IsZero())
+	assert.True(suite.T(), l.lockedUntil("10.0.0.3", "dummy", now.Add(6*time.Minute)).IsZero())
+}
+
+func (suite *LoginLimitTests) TestAddressLockout() {
+	l := newLoginLimiter(suite.limits)
+	now := time.Now()
+
+	for _, user := range []string{"a", "b", "c"} {
+		assert.Empty(suite.T(), l.fail("10.0.0.1", user, now))
+	}
+	assert.Equal(suite.T(), []string{scopeAddress}, l.fail("10.0.0.1", "d", now))
+
+	assert.False(suite.T(), l.lockedUntil("10.0.0.1", "e", now).IsZero())
+	assert.True(suite.T(), l.lockedUntil("10.0.0.2", "e", now).IsZero())
+}
+
+func (suite *LoginLimitTests) TestFailuresExpire() {
+	l := newLoginLimiter(suite.limits)
+	now := time.Now()
+
+	assert.Empty(suite.T(), l.fail("10.0.0.1", "dummy", now))
+	assert.Empty(suite.T(), l.fail("10.0.0.1", "dummy", now.Add(2*time.Minute)))
+	assert.True(suite.T(), l.lockedUntil("10.0.0.1", "dummy", now.Add(2*time.Minute)).IsZero())
+}
+
+func (suite *LoginLimitTests) TestSucceedClearsAccount() {
+	l := newLoginLimiter(suite.limits)
+	now := time.Now()
+
+	assert.Empty(suite.T(), l.fail("10.0.0.1", "dummy", now))
+	l.succeed("DUMMY")
+	assert.Empty(suite.T(), l.fail("10.0.0.1", "dummy", now))
+	assert.True(suite.T(), l.lockedUntil("10.0.0.1", "dummy", now).IsZero())
+}
+
+func (suite *LoginLimitTests) TestDisabled() {
+	l := newLoginLimiter(config.LoginLimitConfig{Window: time.Minute, Lockout: time.Minute})
+	now := time.Now()
+
+	for range 10 {
+		assert.Empty(suite.T(), l.fail("10.0.0.1", "dummy", now))
+	}
+	assert.True(suite.T(), l.lockedUntil("10.0.0.1", "dummy", now).IsZero())
+
+	var none *loginLimiter
+	assert.Empty(suite.T(), none.fail("10.0.0.1", "dummy", now))
+	assert.True(suite.T(), none.lockedUntil("10.0.0.1", "dummy", now).IsZero())
+}
+
+func (suite *LoginLimitTests) TestEGALoginLockout() {
+	requests := 0
+	cega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer cega.Close()
+
+	var logs bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&logs)
+	defer log.SetOutput(out)
+
+	auth := AuthHandler{
+		Config:  config.AuthConf{Cega: config.CegaConfig{AuthURL: cega.URL, ID: "id", Secret: "secret"}, LoginLimit: suite.limits},
+		limiter: newLoginLimiter(suite.limits),
+	}
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Post("/ega", auth.postEGA)
+	e := irishttptest.New(suite.T(), app)
+
+	for range 3 {
+		e.POST("/ega").WithFormField("username", "locked-user").WithFormField("password", "wrong").
+			Expect()
+	}
+	// the account was locked out by the second failure, so CEGA is not
+	// asked about the third login
+	assert.Equal(suite.T(), 2, requests)
+
+	var buf bytes.Buffer
+	assert.NoError(suite.T(), metrics.Write(&buf))
+	assert.Contains(suite.T(), buf.String(), `sda_auth_lockouts_total{scope="account"} 1`)
+	assert.Contains(suite.T(), buf.String(), `sda_auth_logins_total{provider="ega",outcome="locked"} 1`)
+
+	assert.Contains(suite.T(), logs.String(), "alert=true")
+	assert.Contains(suite.T(), logs.String(), "event=lockout")
+	assert.Contains(suite.T(), logs.String(), "outcome=locked")
+}
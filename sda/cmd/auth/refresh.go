@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// Refresh tokens let clients, e.g. command line tools doing long uploads,
+// get new access tokens without logging in again. They are random strings
+// stored by their hash in the database, since they must not be accepted as
+// access tokens by the other services, and each can be used once: a new
+// refresh token is handed out with every new access token, in the same
+// session as the old one.
+
+// newRefreshToken returns a refresh token for subject in the session, whose
+// access tokens get the user claims, or an empty string when refresh tokens
+// are disabled or the token could not be stored
+func (auth AuthHandler) newRefreshToken(subject, sessionID string, userClaims map[string]any) string {
+	if auth.Config.RefreshTTL == 0 || auth.Config.DB == nil {
+		return ""
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("failed to create refresh token: %v", err)
+
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	stored := database.RefreshToken{Subject: subject, SessionID: sessionID, Claims: userClaims}
+	if err := auth.Config.DB.AddRefreshToken(hashToken(token), stored, time.Now().Add(auth.Config.RefreshTTL)); err != nil {
+		log.Errorf("failed to store refresh token: %v", err)
+
+		return ""
+	}
+	tokensIssuedTotal.Inc("refresh")
+
+	return token
+}
+
+// hashToken returns the hash that a refresh token is stored by
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// postTokenRefresh returns a new access token, and a new refresh token, for
+// the refresh token in the request or, when there is none, the one from the
+// login of the session
+func (auth AuthHandler) postTokenRefresh(ctx iris.Context) {
+	if grantType := ctx.FormValue("grant_type"); grantType != "" && grantType != "refresh_token" {
+		ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"error": "unsupported_grant_type"})
+
+		return
+	}
+
+	s := sessions.Get(ctx)
+	refreshToken := ctx.FormValue("refresh_token")
+	if refreshToken == "" {
+		refreshToken = s.GetString("refresh_token")
+	}
+	if refreshToken == "" || auth.Config.RefreshTTL == 0 {
+		ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"error": "invalid_request"})
+
+		return
+	}
+
+	used, err := auth.Config.DB.UseRefreshToken(hashToken(refreshToken))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		auth.audit(ctx, "token_refresh", "", "", outcomeFailure)
+		ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"error": "invalid_grant"})
+
+		return
+	case err != nil:
+		log.Errorf("failed to look up refresh token: %v", err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+
+	token, _, err := auth.newAccessToken(used.Subject, used.SessionID, used.Claims)
+	if err != nil {
+		log.Errorf("error when generating token: %v", err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+	log.WithFields(log.Fields{"user": used.Subject}).Info("Token was refreshed")
+	auth.audit(ctx, "token_refresh", used.Subject, "", outcomeSuccess)
+
+	res := iris.Map{"access_token": token, "token_type": "Bearer", "expires_in": auth.Config.JwtTTL * 3600}
+	if used.SessionID != "" {
+		if err := auth.Config.DB.ExtendSession(used.SessionID, time.Now().Add(auth.sessionTTL())); err != nil {
+			log.Warnf("failed to extend session %s: %v", used.SessionID, err)
+		}
+	}
+	if refreshToken = auth.newRefreshToken(used.Subject, used.SessionID, used.Claims); refreshToken != "" {
+		res["refresh_token"] = refreshToken
+		s.Set("refresh_token", refreshToken)
+	} else {
+		s.Delete("refresh_token")
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	if err := ctx.JSON(res); err != nil {
+		log.Error("Failed to write token response: ", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RefreshTests struct {
+	suite.Suite
+}
+
+func TestRefreshTestSuite(t *testing.T) {
+	suite.Run(t, new(RefreshTests))
+}
+
+func (suite *RefreshTests) TestHashToken() {
+	assert.Equal(suite.T(), hashToken("token"), hashToken("token"))
+	assert.NotEqual(suite.T(), hashToken("token"), hashToken("other"))
+	assert.Len(suite.T(), hashToken("token"), 64)
+}
+
+func (suite *RefreshTests) TestNewRefreshTokenDisabled() {
+	auth := AuthHandler{}
+	assert.Empty(suite.T(), auth.newRefreshToken("dummy@example.org", "", nil))
+}
+
+func (suite *RefreshTests) TestPostTokenRefresh() {
+	auth := AuthHandler{}
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Post("/token/refresh", auth.postTokenRefresh)
+	e := httptest.New(suite.T(), app)
+
+	e.POST("/token/refresh").WithFormField("grant_type", "password").
+		Expect().Status(iris.StatusBadRequest).JSON().Object().Value("error").IsEqual("unsupported_grant_type")
+	e.POST("/token/refresh").WithFormField("grant_type", "refresh_token").
+		Expect().Status(iris.StatusBadRequest).JSON().Object().Value("error").IsEqual("invalid_request")
+	// refresh tokens are disabled
+	e.POST("/token/refresh").WithFormField("grant_type", "refresh_token").WithFormField("refresh_token", "token").
+		Expect().Status(iris.StatusBadRequest).JSON().Object().Value("error").IsEqual("invalid_request")
+}
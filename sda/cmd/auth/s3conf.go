@@ -1,6 +1,10 @@
 package main
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+)
 
 // Retrieve a config map containing s3cmd configuration values
 func getS3ConfigMap(token, inboxHost, user string) map[string]string {
@@ -25,3 +29,13 @@ func getS3ConfigMap(token, inboxHost, user string) map[string]string {
 
 	return s3conf
 }
+
+// Retrieve a config map with the S3 credentials of the user instead of a
+// token
+func getS3CredentialConfigMap(cred database.S3Credential, inboxHost string) map[string]string {
+	s3conf := getS3ConfigMap("", inboxHost, cred.AccessKey)
+	s3conf["secret_key"] = cred.SecretKey
+	delete(s3conf, "access_token")
+
+	return s3conf
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -61,3 +62,13 @@ func (suite *S3ConfTests) TestGetS3ConfigMap() {
 	assert.Equal(suite.T(), fmt.Sprintf("%v", socketTimeout), s3conf["socket_timeout"], fmt.Sprintf("socket_timeout should be %v", socketTimeout))
 
 }
+
+func (suite *S3ConfTests) TestGetS3CredentialConfigMap() {
+	cred := database.S3Credential{AccessKey: "ACCESSKEY", SecretKey: "secret", UserID: "dummy@example.org"}
+	s3conf := getS3CredentialConfigMap(cred, "inboxHost")
+
+	assert.Equal(suite.T(), "ACCESSKEY", s3conf["access_key"])
+	assert.Equal(suite.T(), "secret", s3conf["secret_key"])
+	assert.Equal(suite.T(), "inboxHost", s3conf["host_base"])
+	assert.NotContains(suite.T(), s3conf, "access_token")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// Users that have logged in can create S3 credentials for the inbox at
+// /s3credentials, as an alternative to the s3cmd configuration holding a
+// token. The credentials do not expire, but the user can regenerate or
+// revoke them, and the inbox checks them against the database at every
+// request.
+
+// maxS3Credentials is how many credentials a user can have at a time
+const maxS3Credentials = 5
+
+// newS3Credential returns a new credential of the user, with a random
+// access key and secret key
+func newS3Credential(user string) (database.S3Credential, error) {
+	accessKey := make([]byte, 15)
+	if _, err := rand.Read(accessKey); err != nil {
+		return database.S3Credential{}, err
+	}
+	secretKey := make([]byte, 30)
+	if _, err := rand.Read(secretKey); err != nil {
+		return database.S3Credential{}, err
+	}
+
+	return database.S3Credential{
+		AccessKey: base32.StdEncoding.EncodeToString(accessKey),
+		SecretKey: base64.RawURLEncoding.EncodeToString(secretKey),
+		UserID:    user,
+	}, nil
+}
+
+// getS3Credentials lists the credentials of the user that is logged in
+func (auth AuthHandler) getS3Credentials(ctx iris.Context) {
+	user := sessions.Get(ctx).GetString("user")
+	if user == "" {
+		ctx.Redirect("/")
+
+		return
+	}
+
+	auth.viewS3Credentials(ctx, user, iris.Map{})
+}
+
+// postS3Credentials creates a new credential for the user, that is shown
+// once together with an s3cmd configuration to download
+func (auth AuthHandler) postS3Credentials(ctx iris.Context) {
+	user := sessions.Get(ctx).GetString("user")
+	if user == "" {
+		ctx.StopWithStatus(iris.StatusUnauthorized)
+
+		return
+	}
+
+	creds, err := auth.Config.DB.GetS3Credentials(user)
+	if err != nil {
+		log.Errorf("failed to get the S3 credentials of %s: %v", user, err)
+		auth.viewS3Credentials(ctx, user, iris.Map{"Reason": "The credentials could not be created, try again later"})
+
+		return
+	}
+	if len(creds) >= maxS3Credentials {
+		auth.viewS3Credentials(ctx, user, iris.Map{"Reason": "You can not have more credentials, revoke one first"})
+
+		return
+	}
+
+	cred, err := newS3Credential(user)
+	if err == nil {
+		err = auth.Config.DB.AddS3Credential(cred)
+	}
+	if err != nil {
+		log.Errorf("failed to create S3 credentials for %s: %v", user, err)
+		auth.viewS3Credentials(ctx, user, iris.Map{"Reason": "The credentials could not be created, try again later"})
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user, "access_key": cred.AccessKey}).Info("S3 credentials were created")
+
+	auth.showNewS3Credential(ctx, cred)
+}
+
+// postS3CredentialsRegenerate replaces a credential of the user with a new
+// one, the old one stops working at once
+func (auth AuthHandler) postS3CredentialsRegenerate(ctx iris.Context) {
+	user := sessions.Get(ctx).GetString("user")
+	if user == "" {
+		ctx.StopWithStatus(iris.StatusUnauthorized)
+
+		return
+	}
+
+	oldAccessKey := ctx.FormValue("access_key")
+	cred, err := newS3Credential(user)
+	if err == nil {
+		err = auth.Config.DB.WithTransaction(func(tx *database.Tx) error {
+			if err := tx.RevokeS3Credential(oldAccessKey, user); err != nil {
+				return err
+			}
+
+			return tx.AddS3Credential(cred)
+		})
+	}
+	if err != nil {
+		log.Errorf("failed to regenerate S3 credentials %s of %s: %v", oldAccessKey, user, err)
+		auth.viewS3Credentials(ctx, user, iris.Map{"Reason": "The credentials could not be regenerated"})
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user, "access_key": cred.AccessKey, "revoked": oldAccessKey}).Info("S3 credentials were regenerated")
+
+	auth.showNewS3Credential(ctx, cred)
+}
+
+// postS3CredentialsRevoke revokes a credential of the user
+func (auth AuthHandler) postS3CredentialsRevoke(ctx iris.Context) {
+	user := sessions.Get(ctx).GetString("user")
+	if user == "" {
+		ctx.StopWithStatus(iris.StatusUnauthorized)
+
+		return
+	}
+
+	accessKey := ctx.FormValue("access_key")
+	if err := auth.Config.DB.RevokeS3Credential(accessKey, user); err != nil {
+		log.Errorf("failed to revoke S3 credentials %s of %s: %v", accessKey, user, err)
+		auth.viewS3Credentials(ctx, user, iris.Map{"Reason": "The credentials could not be revoked"})
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user, "access_key": accessKey}).Info("S3 credentials were revoked")
+
+	auth.viewS3Credentials(ctx, user, iris.Map{"Revoked": accessKey})
+}
+
+// getS3CredentialsConf returns the s3cmd configuration of the credential
+// that was just created
+func (auth AuthHandler) getS3CredentialsConf(ctx iris.Context) {
+	auth.getInboxConfig(ctx, "s3credentials")
+}
+
+// showNewS3Credential shows the secret key of a new credential, which can
+// not be seen again
+func (auth AuthHandler) showNewS3Credential(ctx iris.Context, cred database.S3Credential) {
+	sessions.Get(ctx).SetFlash("s3credentials", getS3CredentialConfigMap(cred, auth.Config.S3Inbox))
+	auth.viewS3Credentials(ctx, cred.UserID, iris.Map{"New": cred})
+}
+
+func (auth AuthHandler) viewS3Credentials(ctx iris.Context, user string, data iris.Map) {
+	creds, err := auth.Config.DB.GetS3Credentials(user)
+	if err != nil {
+		log.Errorf("failed to get the S3 credentials of %s: %v", user, err)
+		data["Reason"] = "The credentials could not be listed, try again later"
+	}
+
+	data["infoUrl"] = auth.Config.InfoURL
+	data["infoText"] = auth.Config.InfoText
+	data["User"] = user
+	data["Credentials"] = creds
+	data["Max"] = maxS3Credentials
+	if err := ctx.View("s3credentials.html", data); err != nil {
+		log.Error("Failed to view S3 credentials: ", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type S3CredentialsTests struct {
+	suite.Suite
+}
+
+func TestS3CredentialsTestSuite(t *testing.T) {
+	suite.Run(t, new(S3CredentialsTests))
+}
+
+func (suite *S3CredentialsTests) TestNewS3Credential() {
+	cred, err := newS3Credential("dummy@example.org")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "dummy@example.org", cred.UserID)
+	assert.Regexp(suite.T(), "^[A-Z2-7]{24}$", cred.AccessKey)
+	assert.Regexp(suite.T(), "^[A-Za-z0-9_-]{40}$", cred.SecretKey)
+
+	other, err := newS3Credential("dummy@example.org")
+	assert.NoError(suite.T(), err)
+	assert.NotEqual(suite.T(), cred.AccessKey, other.AccessKey)
+	assert.NotEqual(suite.T(), cred.SecretKey, other.SecretKey)
+}
+
+func (suite *S3CredentialsTests) TestEndpointsNeedLogin() {
+	auth := AuthHandler{}
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Post("/s3credentials", auth.postS3Credentials)
+	app.Post("/s3credentials/regenerate", auth.postS3CredentialsRegenerate)
+	app.Post("/s3credentials/revoke", auth.postS3CredentialsRevoke)
+	e := httptest.New(suite.T(), app)
+
+	e.POST("/s3credentials").Expect().Status(iris.StatusUnauthorized)
+	e.POST("/s3credentials/regenerate").WithFormField("access_key", "ACCESSKEY").Expect().Status(iris.StatusUnauthorized)
+	e.POST("/s3credentials/revoke").WithFormField("access_key", "ACCESSKEY").Expect().Status(iris.StatusUnauthorized)
+}
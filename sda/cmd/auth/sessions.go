@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// Every login to auth starts a session, whose ID is in the sid claim of the
+// access tokens and stored with the refresh tokens handed out for it. Users
+// can list their sessions at /sessions and revoke them, one at a time or
+// all at once to log out everywhere. Revoking a session deletes its refresh
+// tokens and puts its ID on the revoked tokens, that the api checks.
+
+// sessionInfo is a session as listed to the user
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Current is set for the session of the request
+	Current bool `json:"current"`
+}
+
+// startSession stores a new session of subject and returns its ID, or an
+// empty string when the session could not be stored. The session lasts as
+// long as the tokens handed out at the login.
+func (auth AuthHandler) startSession(ctx iris.Context, subject string) string {
+	if auth.Config.DB == nil {
+		return ""
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("failed to create session: %v", err)
+
+		return ""
+	}
+
+	session := database.Session{
+		ID:        base64.RawURLEncoding.EncodeToString(b),
+		Subject:   subject,
+		UserAgent: ctx.Request().UserAgent(),
+		ExpiresAt: time.Now().Add(auth.sessionTTL()),
+	}
+	if err := auth.Config.DB.AddSession(session); err != nil {
+		log.Errorf("failed to store session: %v", err)
+
+		return ""
+	}
+
+	return session.ID
+}
+
+// sessionTTL is how long the tokens of a login, or of a refresh, are valid
+func (auth AuthHandler) sessionTTL() time.Duration {
+	return max(time.Duration(auth.Config.JwtTTL)*time.Hour, auth.Config.RefreshTTL)
+}
+
+// getSessions lists the sessions of the user that is logged in
+func (auth AuthHandler) getSessions(ctx iris.Context) {
+	s := sessions.Get(ctx)
+	user := s.GetString("user")
+	if user == "" {
+		ctx.StopWithJSON(iris.StatusUnauthorized, iris.Map{"error": "not logged in"})
+
+		return
+	}
+
+	stored, err := auth.Config.DB.GetSessions(user)
+	if err != nil {
+		log.Errorf("failed to get the sessions of %s: %v", user, err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+
+	current := s.GetString("session_id")
+	infos := make([]sessionInfo, len(stored))
+	for i, session := range stored {
+		infos[i] = sessionInfo{
+			ID:        session.ID,
+			UserAgent: session.UserAgent,
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.ExpiresAt,
+			Current:   session.ID == current,
+		}
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	if err := ctx.JSON(infos); err != nil {
+		log.Error("Failed to write sessions: ", err)
+	}
+}
+
+// deleteSession revokes a session of the user that is logged in
+func (auth AuthHandler) deleteSession(ctx iris.Context) {
+	s := sessions.Get(ctx)
+	user := s.GetString("user")
+	if user == "" {
+		ctx.StopWithJSON(iris.StatusUnauthorized, iris.Map{"error": "not logged in"})
+
+		return
+	}
+
+	id := ctx.Params().Get("id")
+	if err := auth.Config.DB.RevokeSession(id, user); err != nil {
+		log.Errorf("failed to revoke session %s of %s: %v", id, user, err)
+		ctx.StopWithJSON(iris.StatusNotFound, iris.Map{"error": "no such session"})
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user, "session": id}).Info("Session was revoked")
+	auth.audit(ctx, "session_revoke", user, "", outcomeSuccess)
+
+	if id == s.GetString("session_id") {
+		auth.endBrowserSession(s)
+	}
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+// deleteSessions revokes all sessions of the user that is logged in, i.e.
+// logs the user out everywhere
+func (auth AuthHandler) deleteSessions(ctx iris.Context) {
+	s := sessions.Get(ctx)
+	user := s.GetString("user")
+	if user == "" {
+		ctx.StopWithJSON(iris.StatusUnauthorized, iris.Map{"error": "not logged in"})
+
+		return
+	}
+
+	if err := auth.Config.DB.RevokeSessions(user); err != nil {
+		log.Errorf("failed to revoke the sessions of %s: %v", user, err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user}).Info("All sessions were revoked")
+	auth.audit(ctx, "session_revoke", user, "", outcomeSuccess)
+
+	auth.endBrowserSession(s)
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+// endBrowserSession forgets the login in the browser of the user, once its
+// session has been revoked
+func (auth AuthHandler) endBrowserSession(s *sessions.Session) {
+	s.Delete("user")
+	s.Delete("refresh_token")
+	s.Delete("session_id")
+}
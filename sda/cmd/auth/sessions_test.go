@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SessionsTests struct {
+	suite.Suite
+}
+
+func TestSessionsTestSuite(t *testing.T) {
+	suite.Run(t, new(SessionsTests))
+}
+
+func (suite *SessionsTests) TestSessionTTL() {
+	auth := AuthHandler{Config: config.AuthConf{JwtTTL: 2}}
+	assert.Equal(suite.T(), 2*time.Hour, auth.sessionTTL())
+
+	auth.Config.RefreshTTL = 24 * time.Hour
+	assert.Equal(suite.T(), 24*time.Hour, auth.sessionTTL())
+}
+
+func (suite *SessionsTests) TestEndpointsNeedLogin() {
+	auth := AuthHandler{}
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Get("/sessions", auth.getSessions)
+	app.Delete("/sessions", auth.deleteSessions)
+	app.Delete("/sessions/{id}", auth.deleteSession)
+	e := httptest.New(suite.T(), app)
+
+	e.GET("/sessions").Expect().Status(iris.StatusUnauthorized)
+	e.DELETE("/sessions").Expect().Status(iris.StatusUnauthorized)
+	e.DELETE("/sessions/session-1").Expect().Status(iris.StatusUnauthorized)
+}
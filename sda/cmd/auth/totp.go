@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // #nosec G505 -- TOTP (RFC 6238) as supported by authenticator apps
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// Users that log in with a password can set up TOTP (RFC 6238), i.e. an
+// authenticator app, as a second factor at /totp, for deployments where the
+// upstream login does not ask for one. The user confirms the secret with a
+// code before it is used, and gets one-time recovery codes for when the
+// device is lost. Once set up, a code is asked for at every password login.
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many time steps before and after the current one
+	// codes are accepted from, for clocks that are a bit off
+	totpSkew = 1
+	// recoveryCodes is how many recovery codes a user gets at a time
+	recoveryCodes = 10
+	// maxTOTPAttempts is how many wrong codes can be entered before the
+	// login has to start over
+	maxTOTPAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a new random, base32 encoded, secret
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpStep returns the time step of t
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode returns the code of the time step made with key
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks the code against the secret at now, and returns the
+// time step that the code was made for
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	code = strings.ReplaceAll(code, " ", "")
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		step := totpStep(now) + d
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpURI returns the otpauth URI that authenticator apps are set up with
+func totpURI(issuer, user, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+user) + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns new recovery codes, such as abcd-efgh, and the
+// hashes they are stored by
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for range recoveryCodes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash of a recovery code as entered by the
+// user, case and dashes do not matter
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	return hashToken(code)
+}
+
+// totpRequired reports whether the user of a password login has set up
+// TOTP. When it can not be looked up a code is required.
+func (auth AuthHandler) totpRequired(login loginResult) bool {
+	if !auth.Config.TOTP.Enabled || login.AuthType != "ega" {
+		return false
+	}
+
+	totp, err := auth.Config.DB.GetTOTPSecret(login.User)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false
+	case err != nil:
+		log.Errorf("failed to get the TOTP secret of %s: %v", login.User, err)
+
+		return true
+	}
+
+	return totp.Confirmed
+}
+
+// checkTOTP checks a code of the user, a recovery code is accepted when
+// allowRecovery is set. Each code can only be used once.
+func (auth AuthHandler) checkTOTP(user, code string, allowRecovery bool) error {
+	totp, err := auth.Config.DB.GetTOTPSecret(user)
+	if err != nil {
+		return err
+	}
+	if !totp.Confirmed {
+		return errors.New("TOTP is not set up")
+	}
+
+	if step, ok := verifyTOTP(totp.Secret, code, time.Now()); ok {
+		return auth.Config.DB.UseTOTPStep(user, step)
+	}
+	if allowRecovery {
+		if err := auth.Config.DB.UseTOTPRecoveryCode(user, hashRecoveryCode(code)); err == nil {
+			log.WithFields(log.Fields{"user": user}).Warn("TOTP recovery code was used")
+
+			return nil
+		}
+	}
+
+	return errors.New("invalid code")
+}
+
+// totpManager returns the user that has logged in with a password and can
+// manage TOTP, or an empty string
+func totpManager(ctx iris.Context) string {
+	s := sessions.Get(ctx)
+	if s.GetString("auth_type") != "ega" {
+		return ""
+	}
+
+	return s.GetString("user")
+}
+
+// getTOTP returns the page where the user enters a code to finish logging
+// in, sets up TOTP or manages it
+func (auth AuthHandler) getTOTP(ctx iris.Context) {
+	if user, pending := pendingLogin(ctx, "totp"); pending {
+		auth.viewTOTP(ctx, user, iris.Map{"Mode": "login"})
+
+		return
+	}
+
+	user := totpManager(ctx)
+	if user == "" {
+		ctx.Redirect("/")
+
+		return
+	}
+
+	totp, err := auth.Config.DB.GetTOTPSecret(user)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && !totp.Confirmed):
+		auth.startTOTPEnrolment(ctx, user)
+	case err != nil:
+		log.Errorf("failed to get the TOTP secret of %s: %v", user, err)
+		auth.viewTOTP(ctx, user, iris.Map{"Reason": "The authenticator app settings could not be read, try again later"})
+	default:
+		auth.viewTOTP(ctx, user, iris.Map{"Mode": "manage", "RecoveryCodes": totp.RecoveryCodes})
+	}
+}
+
+// startTOTPEnrolment creates a new secret for the user and shows it, to be
+// added to an authenticator app
+func (auth AuthHandler) startTOTPEnrolment(ctx iris.Context, user string) {
+	secret, err := newTOTPSecret()
+	if err == nil {
+		err = auth.Config.DB.SetTOTPSecret(user, secret)
+	}
+	if err != nil {
+		log.Errorf("failed to create a TOTP secret for %s: %v", user, err)
+		auth.viewTOTP(ctx, user, iris.Map{"Reason": "The authenticator app could not be set up, try again later"})
+
+		return
+	}
+
+	auth.viewTOTP(ctx, user, iris.Map{"Mode": "enroll", "Secret": secret, "URI": totpURI(auth.Config.TOTP.Issuer, user, secret)})
+}
+
+// postTOTP checks the code of a login, the login has to start over after
+// too many wrong codes
+func (auth AuthHandler) postTOTP(ctx iris.Context) {
+	user, pending := pendingLogin(ctx, "totp")
+	if !pending {
+		ctx.Redirect("/", iris.StatusSeeOther)
+
+		return
+	}
+
+	s := sessions.Get(ctx)
+	logger := log.WithFields(log.Fields{"user": user})
+	if auth.loginLocked(ctx, user) {
+		logger.Warn("TOTP login refused, too many failed logins")
+		auth.observeSecondFactor(ctx, "totp", user, outcomeLocked)
+		s.Delete("pending_login")
+		s.Delete("pending_factor")
+		s.Delete("totp_attempts")
+		s.SetFlash("message", "Too many failed logins, try again later")
+		ctx.Redirect("/ega/login", iris.StatusSeeOther)
+
+		return
+	}
+	if err := auth.checkTOTP(user, ctx.FormValue("code"), true); err != nil {
+		attempts := s.GetIntDefault("totp_attempts", 0) + 1
+		logger.Errorf("TOTP login failed: %v", err)
+		auth.observeSecondFactor(ctx, "totp", user, outcomeFailure)
+		auth.loginFailed(ctx, "totp", user)
+		if attempts >= maxTOTPAttempts {
+			s.Delete("pending_login")
+			s.Delete("pending_factor")
+			s.Delete("totp_attempts")
+			s.SetFlash("message", "Too many invalid codes, log in again")
+			ctx.Redirect("/ega/login", iris.StatusSeeOther)
+
+			return
+		}
+		s.Set("totp_attempts", attempts)
+		auth.viewTOTP(ctx, user, iris.Map{"Mode": "login", "Reason": "The code is not valid"})
+
+		return
+	}
+	logger.Info("TOTP code was verified")
+	auth.observeSecondFactor(ctx, "totp", user, outcomeSuccess)
+
+	s.Delete("totp_attempts")
+	s.Set("second_factor", true)
+	ctx.Redirect("/totp/done", iris.StatusSeeOther)
+}
+
+// postTOTPEnroll turns TOTP on for the user, when the code was made with
+// the new secret, and shows the recovery codes
+func (auth AuthHandler) postTOTPEnroll(ctx iris.Context) {
+	user := totpManager(ctx)
+	if user == "" {
+		ctx.StopWithStatus(iris.StatusUnauthorized)
+
+		return
+	}
+
+	totp, err := auth.Config.DB.GetTOTPSecret(user)
+	if err != nil || totp.Confirmed {
+		ctx.Redirect("/totp", iris.StatusSeeOther)
+
+		return
+	}
+	step, ok := verifyTOTP(totp.Secret, ctx.FormValue("code"), time.Now())
+	if !ok {
+		auth.viewTOTP(ctx, user, iris.Map{
+			"Mode":   "enroll",
+			"Reason": "The code is not valid, check the time of your device",
+			"Secret": totp.Secret,
+			"URI":    totpURI(auth.Config.TOTP.Issuer, user, totp.Secret),
+		})
+
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = auth.Config.DB.WithTransaction(func(tx *database.Tx) error {
+			if err := tx.ConfirmTOTP(user, step); err != nil {
+				return err
+			}
+
+			return tx.SetTOTPRecoveryCodes(user, hashes)
+		})
+	}
+	if err != nil {
+		log.Errorf("failed to set up TOTP for %s: %v", user, err)
+		auth.viewTOTP(ctx, user, iris.Map{"Reason": "The authenticator app could not be set up, try again later"})
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user}).Info("TOTP was set up")
+
+	auth.viewTOTP(ctx, user, iris.Map{"Mode": "manage", "New": codes, "RecoveryCodes": len(codes)})
+}
+
+// postTOTPRecoveryCodes replaces the recovery codes of the user, when a
+// valid code is given
+func (auth AuthHandler) postTOTPRecoveryCodes(ctx iris.Context) {
+	user := totpManager(ctx)
+	if user == "" {
+		ctx.StopWithStatus(iris.StatusUnauthorized)
+
+		return
+	}
+
+	if err := auth.checkTOTP(user, ctx.FormValue("code"), false); err != nil {
+		log.WithFields(log.Fields{"user": user}).Errorf("TOTP check failed: %v", err)
+		auth.viewTOTPStatus(ctx, user, "The code is not valid")
+
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = auth.Config.DB.SetTOTPRecoveryCodes(user, hashes)
+	}
+	if err != nil {
+		log.Errorf("failed to replace the TOTP recovery codes of %s: %v", user, err)
+		auth.viewTOTPStatus(ctx, user, "The recovery codes could not be replaced, try again later")
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user}).Info("TOTP recovery codes were replaced")
+
+	auth.viewTOTP(ctx, user, iris.Map{"Mode": "manage", "New": codes, "RecoveryCodes": len(codes)})
+}
+
+// postTOTPDisable turns TOTP off for the user, when a valid code or
+// recovery code is given
+func (auth AuthHandler) postTOTPDisable(ctx iris.Context) {
+	user := totpManager(ctx)
+	if user == "" {
+		ctx.StopWithStatus(iris.StatusUnauthorized)
+
+		return
+	}
+
+	if err := auth.checkTOTP(user, ctx.FormValue("code"), true); err != nil {
+		log.WithFields(log.Fields{"user": user}).Errorf("TOTP check failed: %v", err)
+		auth.viewTOTPStatus(ctx, user, "The code is not valid")
+
+		return
+	}
+	if err := auth.Config.DB.DeleteTOTP(user); err != nil {
+		log.Errorf("failed to turn off TOTP for %s: %v", user, err)
+		auth.viewTOTPStatus(ctx, user, "The authenticator app could not be removed, try again later")
+
+		return
+	}
+	log.WithFields(log.Fields{"user": user}).Info("TOTP was turned off")
+
+	auth.viewTOTP(ctx, user, iris.Map{"Mode": "off"})
+}
+
+// viewTOTPStatus shows the TOTP settings of the user with an error
+func (auth AuthHandler) viewTOTPStatus(ctx iris.Context, user, reason string) {
+	data := iris.Map{"Mode": "manage", "Reason": reason}
+	if totp, err := auth.Config.DB.GetTOTPSecret(user); err == nil {
+		data["RecoveryCodes"] = totp.RecoveryCodes
+	}
+
+	auth.viewTOTP(ctx, user, data)
+}
+
+func (auth AuthHandler) viewTOTP(ctx iris.Context, user string, data iris.Map) {
+	if _, ok := data["Mode"]; !ok {
+		data["Mode"] = ""
+	}
+	data["infoUrl"] = auth.Config.InfoURL
+	data["infoText"] = auth.Config.InfoText
+	data["User"] = user
+	data["Issuer"] = auth.Config.TOTP.Issuer
+	if err := ctx.View("totp.html", data); err != nil {
+		log.Error("Failed to view TOTP page: ", err)
+	}
+}
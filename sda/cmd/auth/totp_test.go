@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TOTPTests struct {
+	suite.Suite
+}
+
+func TestTOTPTestSuite(t *testing.T) {
+	suite.Run(t, new(TOTPTests))
+}
+
+func (suite *TOTPTests) TestTOTPCode() {
+	// the SHA-1 test vectors of RFC 6238, truncated to six digits
+	key := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		assert.Equal(suite.T(), code, totpCode(key, totpStep(time.Unix(unix, 0))), unix)
+	}
+}
+
+func (suite *TOTPTests) TestVerifyTOTP() {
+	secret, err := newTOTPSecret()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), secret, 32)
+	key, err := totpEncoding.DecodeString(secret)
+	assert.NoError(suite.T(), err)
+
+	now := time.Now()
+	step, ok := verifyTOTP(secret, totpCode(key, totpStep(now)), now)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), totpStep(now), step)
+
+	// codes of the steps next to the current one are accepted
+	step, ok = verifyTOTP(secret, totpCode(key, totpStep(now)-1), now)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), totpStep(now)-1, step)
+
+	_, ok = verifyTOTP(secret, totpCode(key, totpStep(now)-2), now)
+	assert.False(suite.T(), ok)
+	_, ok = verifyTOTP(secret, "12345", now)
+	assert.False(suite.T(), ok)
+	_, ok = verifyTOTP("not base32!", "123456", now)
+	assert.False(suite.T(), ok)
+}
+
+func (suite *TOTPTests) TestTOTPURI() {
+	uri, err := url.Parse(totpURI("Example SDA", "dummy@example.org", "SECRET"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "otpauth", uri.Scheme)
+	assert.Equal(suite.T(), "totp", uri.Host)
+	assert.Equal(suite.T(), "/Example SDA:dummy@example.org", uri.Path)
+	assert.Equal(suite.T(), "SECRET", uri.Query().Get("secret"))
+	assert.Equal(suite.T(), "Example SDA", uri.Query().Get("issuer"))
+}
+
+func (suite *TOTPTests) TestRecoveryCodes() {
+	codes, hashes, err := newRecoveryCodes()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), codes, recoveryCodes)
+	assert.Len(suite.T(), hashes, recoveryCodes)
+	for i, code := range codes {
+		assert.Regexp(suite.T(), "^[a-z2-7]{4}-[a-z2-7]{4}$", code)
+		assert.Equal(suite.T(), hashes[i], hashRecoveryCode(code))
+	}
+
+	// case, dashes and spaces do not matter
+	assert.Equal(suite.T(), hashRecoveryCode("abcd-efgh"), hashRecoveryCode(" ABCDEFGH"))
+	assert.NotEqual(suite.T(), codes[0], codes[1])
+}
+
+func (suite *TOTPTests) TestEndpointsNeedLogin() {
+	auth := AuthHandler{}
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Post("/totp/enroll", auth.postTOTPEnroll)
+	app.Post("/totp/recovery-codes", auth.postTOTPRecoveryCodes)
+	app.Post("/totp/disable", auth.postTOTPDisable)
+	e := httptest.New(suite.T(), app)
+
+	e.POST("/totp/enroll").WithFormField("code", "123456").Expect().Status(iris.StatusUnauthorized)
+	e.POST("/totp/recovery-codes").WithFormField("code", "123456").Expect().Status(iris.StatusUnauthorized)
+	e.POST("/totp/disable").WithFormField("code", "123456").Expect().Status(iris.StatusUnauthorized)
+}
+
+func (suite *TOTPTests) TestTOTPNotRequired() {
+	// TOTP is only asked for at password logins when it is enabled
+	auth := AuthHandler{}
+	assert.False(suite.T(), auth.totpRequired(loginResult{AuthType: "ega", User: "dummy"}))
+	auth.Config.TOTP.Enabled = true
+	assert.False(suite.T(), auth.totpRequired(loginResult{AuthType: "oidc", User: "dummy"}))
+}
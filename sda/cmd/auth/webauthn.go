@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebAuthn (https://www.w3.org/TR/webauthn-2/) lets users log in with a
+// passkey or security key as a second factor. Users register a credential
+// after the first factor of a login, and have to sign a challenge with it
+// at every login from then on. Attestation is not requested, so it is not
+// checked which kind of authenticator a credential is on.
+
+// COSE key types and algorithms of RFC 9053 that credentials may use
+const (
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+	coseAlgES256   = -7
+	coseAlgRS256   = -257
+)
+
+// flags of the authenticator data
+const (
+	flagUserPresent        = 0x01
+	flagAttestedCredential = 0x40
+)
+
+// webAuthn verifies the WebAuthn ceremonies of the relying party, i.e. this
+// service
+type webAuthn struct {
+	rpID   string
+	origin string
+}
+
+func newWebAuthn(conf config.WebAuthnConfig) webAuthn {
+	return webAuthn{rpID: conf.RPID, origin: conf.Origin}
+}
+
+// authenticatorData is the parsed authenticator data of a ceremony
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// credentialID and publicKey, a COSE key, are only set when a
+	// credential is registered
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	authData := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.flags&flagAttestedCredential == 0 {
+		return authData, nil
+	}
+
+	// the attested credential data is the AAGUID of the authenticator, the
+	// length of the credential ID, the credential ID and the public key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return authenticatorData{}, errors.New("credential ID too short")
+	}
+	authData.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("invalid credential public key: %v", err)
+	}
+	authData.publicKey = rest[:len(rest)-len(after)]
+
+	return authData, nil
+}
+
+// checkAuthenticatorData checks that the ceremony was made for this service
+// with the user present
+func (w webAuthn) checkAuthenticatorData(authData authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(w.rpID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return errors.New("credential is for another relying party")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return errors.New("user was not present")
+	}
+
+	return nil
+}
+
+// checkClientData checks the client data of a ceremony of type, for
+// challenge, at the origin of this service
+func (w webAuthn) checkClientData(raw []byte, ceremony, challenge string) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return fmt.Errorf("invalid client data: %v", err)
+	}
+
+	switch {
+	case clientData.Type != ceremony:
+		return fmt.Errorf("unexpected ceremony %q", clientData.Type)
+	case challenge == "" || clientData.Challenge != challenge:
+		return errors.New("challenge does not match")
+	case clientData.Origin != w.origin:
+		return fmt.Errorf("unexpected origin %q", clientData.Origin)
+	}
+
+	return nil
+}
+
+// verifyRegistration verifies the response of navigator.credentials.create
+// and returns the registered credential
+func (w webAuthn) verifyRegistration(clientDataJSON, attestationObject []byte, challenge string) (database.WebAuthnCredential, error) {
+	if err := w.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return database.WebAuthnCredential{}, err
+	}
+
+	item, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return database.WebAuthnCredential{}, fmt.Errorf("invalid attestation object: %v", err)
+	}
+	attestation, ok := item.(map[any]any)
+	if !ok {
+		return database.WebAuthnCredential{}, errors.New("invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return database.WebAuthnCredential{}, errors.New("attestation object without authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return database.WebAuthnCredential{}, err
+	}
+	if err := w.checkAuthenticatorData(authData); err != nil {
+		return database.WebAuthnCredential{}, err
+	}
+	if authData.credentialID == nil {
+		return database.WebAuthnCredential{}, errors.New("no credential was registered")
+	}
+	if _, _, err := parseCOSEKey(authData.publicKey); err != nil {
+		return database.WebAuthnCredential{}, err
+	}
+
+	return database.WebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(authData.credentialID),
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// verifyAssertion verifies the response of navigator.credentials.get made
+// with cred, and returns the new signature counter of the credential
+func (w webAuthn) verifyAssertion(clientDataJSON, rawAuthData, signature []byte, challenge string, cred database.WebAuthnCredential) (uint32, error) {
+	if err := w.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.checkAuthenticatorData(authData); err != nil {
+		return 0, err
+	}
+
+	key, alg, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), rawAuthData...), clientDataHash[:]...))
+	if err := verifyCOSESignature(key, alg, signed[:], signature); err != nil {
+		return 0, err
+	}
+
+	// authenticators that count signatures always count up, a count that
+	// does not may come from a cloned authenticator
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return 0, errors.New("signature counter did not increase, the authenticator may be cloned")
+	}
+
+	return authData.signCount, nil
+}
+
+// parseCOSEKey returns the public key and algorithm of a COSE key, only
+// ES256 and RS256 keys are supported
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	item, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid public key: %v", err)
+	}
+	key, ok := item.(map[any]any)
+	if !ok {
+		return nil, 0, errors.New("invalid public key")
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	switch {
+	case kty == coseKeyTypeEC2 && alg == coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid P-256 public key")
+		}
+		// ecdh checks that the point is on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, 0, fmt.Errorf("invalid P-256 public key: %v", err)
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, alg, nil
+	case kty == coseKeyTypeRSA && alg == coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA public key, at least 2048 bits are needed")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported public key type %d with algorithm %d", kty, alg)
+	}
+}
+
+// verifyCOSESignature verifies the signature of the SHA-256 hash
+func verifyCOSESignature(key crypto.PublicKey, alg int64, hash, signature []byte) error {
+	switch alg {
+	case coseAlgES256:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hash, signature) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	case coseAlgRS256:
+		if err := rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %d", alg)
+	}
+}
+
+// getWebAuthn returns the page where the user registers a credential or
+// logs in with one
+func (auth AuthHandler) getWebAuthn(ctx iris.Context) {
+	user, pending := pendingLogin(ctx, "webauthn")
+	if user == "" {
+		ctx.Redirect("/")
+
+		return
+	}
+
+	register := !pending
+	if pending {
+		creds, err := auth.Config.DB.GetWebAuthnCredentials(user)
+		if err != nil {
+			log.Errorf("failed to get the WebAuthn credentials of %s: %v", user, err)
+			ctx.StopWithStatus(iris.StatusInternalServerError)
+
+			return
+		}
+		register = len(creds) == 0
+	}
+
+	ctx.ViewData("infoUrl", auth.Config.InfoURL)
+	ctx.ViewData("infoText", auth.Config.InfoText)
+	ctx.ViewData("User", user)
+	ctx.ViewData("Register", register)
+	ctx.ViewData("Pending", pending)
+	if err := ctx.View("webauthn.html"); err != nil {
+		log.Error("Failed to view WebAuthn page: ", err)
+	}
+}
+
+// postWebAuthnOptions returns the options of the ceremony for the browser,
+// for registering a credential when the user has none yet or when the user
+// has logged in and adds one
+func (auth AuthHandler) postWebAuthnOptions(ctx iris.Context) {
+	user, pending := pendingLogin(ctx, "webauthn")
+	if user == "" {
+		ctx.StopWithJSON(iris.StatusUnauthorized, iris.Map{"error": "log in first"})
+
+		return
+	}
+	creds, err := auth.Config.DB.GetWebAuthnCredentials(user)
+	if err != nil {
+		log.Errorf("failed to get the WebAuthn credentials of %s: %v", user, err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("failed to create WebAuthn challenge: %v", err)
+		ctx.StopWithStatus(iris.StatusInternalServerError)
+
+		return
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+
+	credentials := make([]iris.Map, 0, len(creds))
+	for _, cred := range creds {
+		credentials = append(credentials, iris.Map{"type": "public-key", "id": cred.ID})
+	}
+
+	// a user that has a credential must log in with it, the challenge can
+	// only be used for the ceremony it was made for
+	login := pending && len(creds) > 0
+	s := sessions.Get(ctx)
+	s.Set("webauthn_challenge", challenge)
+	s.Set("webauthn_register", !login)
+
+	if login {
+		err = ctx.JSON(iris.Map{"mode": "login", "publicKey": iris.Map{
+			"challenge":        challenge,
+			"rpId":             auth.Config.WebAuthn.RPID,
+			"allowCredentials": credentials,
+			"timeout":          120000,
+			"userVerification": "preferred",
+		}})
+	} else {
+		// the user handle is a hash, so that the user is not identified
+		// by the authenticator
+		userHandle := sha256.Sum256([]byte(user))
+		err = ctx.JSON(iris.Map{"mode": "register", "publicKey": iris.Map{
+			"challenge": challenge,
+			"rp":        iris.Map{"id": auth.Config.WebAuthn.RPID, "name": auth.Config.WebAuthn.RPName},
+			"user": iris.Map{
+				"id":          base64.RawURLEncoding.EncodeToString(userHandle[:]),
+				"name":        user,
+				"displayName": user,
+			},
+			"pubKeyCredParams": []iris.Map{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"excludeCredentials":     credentials,
+			"authenticatorSelection": iris.Map{"userVerification": "preferred"},
+			"attestation":            "none",
+			"timeout":                120000,
+		}})
+	}
+	if err != nil {
+		log.Error("Failed to write WebAuthn options: ", err)
+	}
+}
+
+// webAuthnResponse is the response of the authenticator, with the binary
+// values base64url encoded by the browser
+type webAuthnResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+}
+
+// decodeBase64URL decodes a value of the response, invalid values are
+// decoded as nil and fail the checks
+func decodeBase64URL(value string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+
+	return b
+}
+
+// postWebAuthnVerify verifies the response of the authenticator, and
+// tells the browser where to go next
+func (auth AuthHandler) postWebAuthnVerify(ctx iris.Context) {
+	user, pending := pendingLogin(ctx, "webauthn")
+	if user == "" {
+		ctx.StopWithJSON(iris.StatusUnauthorized, iris.Map{"error": "log in first"})
+
+		return
+	}
+
+	s := sessions.Get(ctx)
+	challenge := s.GetString("webauthn_challenge")
+	register := s.GetBooleanDefault("webauthn_register", false)
+	s.Delete("webauthn_challenge")
+	s.Delete("webauthn_register")
+
+	var res webAuthnResponse
+	if err := ctx.ReadJSON(&res); err != nil {
+		ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"error": "invalid response"})
+
+		return
+	}
+	w := newWebAuthn(auth.Config.WebAuthn)
+	logger := log.WithFields(log.Fields{"user": user})
+	if res.AttestationObject != "" {
+		// a passkey can only be registered instead of logging in with one
+		// when the user has none, or anyone knowing the password could
+		// register their own and pass the second factor
+		if pending && !auth.canRegisterAtLogin(user, register) {
+			logger.Error("WebAuthn registration refused, the user must log in with a registered passkey")
+			auth.observeSecondFactor(ctx, "webauthn", user, outcomeFailure)
+			ctx.StopWithJSON(iris.StatusUnauthorized, iris.Map{"error": "log in with a registered passkey"})
+
+			return
+		}
+		cred, err := w.verifyRegistration(decodeBase64URL(res.ClientDataJSON), decodeBase64URL(res.AttestationObject), challenge)
+		if err == nil {
+			cred.UserID = user
+			err = auth.Config.DB.AddWebAuthnCredential(cred)
+		}
+		if err != nil {
+			logger.Errorf("WebAuthn registration failed: %v", err)
+			ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"error": "the passkey could not be registered"})
+
+			return
+		}
+		logger.Info("WebAuthn credential was registered")
+	} else {
+		if err := auth.verifyWebAuthnLogin(w, user, res, challenge); err != nil {
+			logger.Errorf("WebAuthn login failed: %v", err)
+			if pending {
+				auth.observeSecondFactor(ctx, "webauthn", user, outcomeFailure)
+			}
+			ctx.StopWithJSON(iris.StatusUnauthorized, iris.Map{"error": "the passkey could not be verified"})
+
+			return
+		}
+		logger.Info("WebAuthn credential was verified")
+		if pending {
+			auth.observeSecondFactor(ctx, "webauthn", user, outcomeSuccess)
+		}
+	}
+
+	next := "/"
+	if pending {
+		s.Set("second_factor", true)
+		next = "/webauthn/done"
+	}
+	if err := ctx.JSON(iris.Map{"next": next}); err != nil {
+		log.Error("Failed to write WebAuthn response: ", err)
+	}
+}
+
+// canRegisterAtLogin reports whether the user may register a passkey while
+// logging in, which requires that the challenge was made for a
+// registration and that the user still has no credentials
+func (auth AuthHandler) canRegisterAtLogin(user string, register bool) bool {
+	if !register {
+		return false
+	}
+	creds, err := auth.Config.DB.GetWebAuthnCredentials(user)
+	if err != nil {
+		log.Errorf("failed to get the WebAuthn credentials of %s: %v", user, err)
+
+		return false
+	}
+
+	return len(creds) == 0
+}
+
+// verifyWebAuthnLogin verifies an assertion of one of the credentials of
+// the user
+func (auth AuthHandler) verifyWebAuthnLogin(w webAuthn, user string, res webAuthnResponse, challenge string) error {
+	creds, err := auth.Config.DB.GetWebAuthnCredentials(user)
+	if err != nil {
+		return err
+	}
+	for _, cred := range creds {
+		if cred.ID != res.ID {
+			continue
+		}
+		signCount, err := w.verifyAssertion(decodeBase64URL(res.ClientDataJSON), decodeBase64URL(res.AuthenticatorData), decodeBase64URL(res.Signature), challenge, cred)
+		if err != nil {
+			return err
+		}
+
+		return auth.Config.DB.UseWebAuthnCredential(cred.ID, signCount)
+	}
+
+	return errors.New("unknown credential")
+}
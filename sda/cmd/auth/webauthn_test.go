@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/kataras/iris/v12/sessions"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type WebAuthnTests struct {
+	suite.Suite
+	w   webAuthn
+	key *ecdsa.PrivateKey
+}
+
+func TestWebAuthnTestSuite(t *testing.T) {
+	suite.Run(t, new(WebAuthnTests))
+}
+
+func (suite *WebAuthnTests) SetupTest() {
+	suite.w = newWebAuthn(config.WebAuthnConfig{RPID: "auth.example.org", Origin: "https://auth.example.org"})
+
+	var err error
+	suite.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(suite.T(), err)
+}
+
+// encodeCBOR encodes the values used in the tests
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[any]any:
+		b := head(5, uint64(len(v)))
+		for key, value := range v {
+			b = append(b, encodeCBOR(key)...)
+			b = append(b, encodeCBOR(value)...)
+		}
+
+		return b
+	}
+	panic("unsupported type")
+}
+
+func (suite *WebAuthnTests) clientData(ceremony, challenge, origin string) []byte {
+	b, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": origin})
+	assert.NoError(suite.T(), err)
+
+	return b
+}
+
+func (suite *WebAuthnTests) authData(rpID string, flags byte, signCount uint32, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	b := append(rpIDHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, signCount)
+
+	return append(b, attested...)
+}
+
+// register makes a registration response for the key of the suite
+func (suite *WebAuthnTests) register(credentialID []byte, coseKey []byte) []byte {
+	attested := append(make([]byte, 16), binary.BigEndian.AppendUint16(nil, uint16(len(credentialID)))...)
+	attested = append(attested, credentialID...)
+	attested = append(attested, coseKey...)
+
+	return encodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": suite.authData("auth.example.org", flagUserPresent|flagAttestedCredential, 0, attested),
+	})
+}
+
+func (suite *WebAuthnTests) ecKey() []byte {
+	return encodeCBOR(map[any]any{
+		1:  coseKeyTypeEC2,
+		3:  coseAlgES256,
+		-1: 1,
+		-2: suite.key.X.FillBytes(make([]byte, 32)),
+		-3: suite.key.Y.FillBytes(make([]byte, 32)),
+	})
+}
+
+func (suite *WebAuthnTests) sign(authData, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, suite.key, hash[:])
+	assert.NoError(suite.T(), err)
+
+	return sig
+}
+
+func (suite *WebAuthnTests) TestRegistrationAndAssertion() {
+	clientData := suite.clientData("webauthn.create", "Y2hhbGxlbmdl", "https://auth.example.org")
+	cred, err := suite.w.verifyRegistration(clientData, suite.register([]byte("credential"), suite.ecKey()), "Y2hhbGxlbmdl")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), base64.RawURLEncoding.EncodeToString([]byte("credential")), cred.ID)
+	assert.Equal(suite.T(), suite.ecKey(), cred.PublicKey)
+
+	clientData = suite.clientData("webauthn.get", "b3RoZXI", "https://auth.example.org")
+	authData := suite.authData("auth.example.org", flagUserPresent, 1, nil)
+	signCount, err := suite.w.verifyAssertion(clientData, authData, suite.sign(authData, clientData), "b3RoZXI", cred)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), uint32(1), signCount)
+
+	// the signature counter has to increase
+	cred.SignCount = 1
+	_, err = suite.w.verifyAssertion(clientData, authData, suite.sign(authData, clientData), "b3RoZXI", cred)
+	assert.ErrorContains(suite.T(), err, "cloned")
+
+	// the signature must be made by the key of the credential
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(suite.T(), err)
+	suite.key = other
+	authData = suite.authData("auth.example.org", flagUserPresent, 2, nil)
+	_, err = suite.w.verifyAssertion(clientData, authData, suite.sign(authData, clientData), "b3RoZXI", cred)
+	assert.ErrorContains(suite.T(), err, "invalid signature")
+}
+
+func (suite *WebAuthnTests) TestRejectedCeremonies() {
+	cred := database.WebAuthnCredential{ID: "Y3JlZGVudGlhbA", PublicKey: suite.ecKey()}
+	for name, test := range map[string]struct {
+		clientData []byte
+		authData   []byte
+		challenge  string
+		expected   string
+	}{
+		"wrong challenge": {
+			suite.clientData("webauthn.get", "b3RoZXI", "https://auth.example.org"),
+			suite.authData("auth.example.org", flagUserPresent, 1, nil),
+			"Y2hhbGxlbmdl", "challenge does not match",
+		},
+		"no challenge in the session": {
+			suite.clientData("webauthn.get", "", "https://auth.example.org"),
+			suite.authData("auth.example.org", flagUserPresent, 1, nil),
+			"", "challenge does not match",
+		},
+		"wrong origin": {
+			suite.clientData("webauthn.get", "Y2hhbGxlbmdl", "https://evil.example.org"),
+			suite.authData("auth.example.org", flagUserPresent, 1, nil),
+			"Y2hhbGxlbmdl", "unexpected origin",
+		},
+		"wrong ceremony": {
+			suite.clientData("webauthn.create", "Y2hhbGxlbmdl", "https://auth.example.org"),
+			suite.authData("auth.example.org", flagUserPresent, 1, nil),
+			"Y2hhbGxlbmdl", "unexpected ceremony",
+		},
+		"wrong relying party": {
+			suite.clientData("webauthn.get", "Y2hhbGxlbmdl", "https://auth.example.org"),
+			suite.authData("evil.example.org", flagUserPresent, 1, nil),
+			"Y2hhbGxlbmdl", "another relying party",
+		},
+		"user not present": {
+			suite.clientData("webauthn.get", "Y2hhbGxlbmdl", "https://auth.example.org"),
+			suite.authData("auth.example.org", 0, 1, nil),
+			"Y2hhbGxlbmdl", "not present",
+		},
+	} {
+		_, err := suite.w.verifyAssertion(test.clientData, test.authData, suite.sign(test.authData, test.clientData), test.challenge, cred)
+		assert.ErrorContains(suite.T(), err, test.expected, name)
+	}
+}
+
+func (suite *WebAuthnTests) TestParseCOSEKey() {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(suite.T(), err)
+	key, alg, err := parseCOSEKey(encodeCBOR(map[any]any{
+		1:  coseKeyTypeRSA,
+		3:  coseAlgRS256,
+		-1: rsaKey.N.Bytes(),
+		-2: big.NewInt(int64(rsaKey.E)).Bytes(),
+	}))
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), rsaKey.PublicKey.Equal(key))
+
+	hash := sha256.Sum256([]byte("signed"))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), verifyCOSESignature(key, alg, hash[:], sig))
+
+	// a point that is not on the curve
+	_, _, err = parseCOSEKey(encodeCBOR(map[any]any{1: coseKeyTypeEC2, 3: coseAlgES256, -1: 1, -2: make([]byte, 32), -3: make([]byte, 32)}))
+	assert.Error(suite.T(), err)
+
+	// EdDSA keys are not supported
+	_, _, err = parseCOSEKey(encodeCBOR(map[any]any{1: 1, 3: -8, -1: 6, -2: make([]byte, 32)}))
+	assert.ErrorContains(suite.T(), err, "unsupported")
+}
+
+func (suite *WebAuthnTests) TestNoRegistrationAtLoginWithPasskey() {
+	// a user with a passkey is asked to log in with it, so a registration
+	// with that challenge must not pass the second factor
+	auth := AuthHandler{Config: config.AuthConf{WebAuthn: config.WebAuthnConfig{RPID: "auth.example.org", Origin: "https://auth.example.org"}}}
+	app := iris.New()
+	app.Use(sessions.New(sessions.Config{Cookie: "_session_id"}).Handler())
+	app.Get("/login", func(ctx iris.Context) {
+		s := sessions.Get(ctx)
+		s.Set("pending_login", loginResult{AuthType: "ega", User: "dummy"})
+		s.Set("pending_factor", "webauthn")
+		s.Set("webauthn_challenge", "Y2hhbGxlbmdl")
+		s.Set("webauthn_register", false)
+	})
+	app.Post("/webauthn/verify", auth.postWebAuthnVerify)
+	e := httptest.New(suite.T(), app)
+
+	e.GET("/login").Expect().Status(iris.StatusOK)
+	e.POST("/webauthn/verify").WithJSON(iris.Map{
+		"id":                "Y3JlZGVudGlhbA",
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(suite.clientData("webauthn.create", "Y2hhbGxlbmdl", "https://auth.example.org")),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(suite.register([]byte("credential"), suite.ecKey())),
+	}).Expect().Status(iris.StatusUnauthorized)
+}
@@ -3,13 +3,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	"github.com/neicnordic/sensitive-data-archive/internal/schema"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 
@@ -24,19 +27,10 @@ var err error
 var message schema.IngestionAccession
 
 func main() {
-	forever := make(chan bool)
 	conf, err = config.NewConfig("finalize")
 	if err != nil {
 		log.Fatal(err)
 	}
-	mq, err := broker.NewMQ(conf.Broker)
-	if err != nil {
-		log.Fatal(err)
-	}
-	db, err = database.NewSDAdb(conf.Database)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	if conf.Backup.Type != "" && conf.Archive.Type != "" {
 		log.Debugln("initiating storage backends")
@@ -50,151 +44,151 @@ func main() {
 		}
 	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
-	defer db.Close()
-
-	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
-
-	go func() {
-		connError := mq.ChannelWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
+	var mq *broker.AMQPBroker
+	conf.Database.RequiredVersion = 8
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("finalize", nil),
+		lifecycle.Database(conf.Database, &db),
+		lifecycle.Metrics(conf.Metrics.Address),
+		lifecycle.Tracing(conf.Tracing.Endpoint, conf.Tracing.Service),
+		lifecycle.Broker(conf.Broker, &mq),
+		lifecycle.Component{Name: "consumer", DependsOn: []string{"database", "broker"}, Run: func(ctx context.Context) error {
+			return consume(ctx, mq)
+		}},
+	)
+
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// consume handles the messages of the accession queue until ctx is
+// cancelled
+func consume(ctx context.Context, mq *broker.AMQPBroker) error {
 	log.Info("Starting finalize service")
-	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
-		if err != nil {
-			log.Fatal(err)
-		}
-		for delivered := range messages {
-			log.Debugf("Received a message (corr-id: %s, message: %s)", delivered.CorrelationId, delivered.Body)
-			err := schema.ValidateJSON(fmt.Sprintf("%s/ingestion-accession.json", conf.Broker.SchemasPath), delivered.Body)
-			if err != nil {
-				log.Errorf("validation of incoming message (ingestion-accession) failed, reason: %v ", err)
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: %v", err)
-				}
 
-				continue
+	lifecycle.QuarantineEvents(mq, db, "finalize")
+	lifecycle.Deduplicate(mq, db)
+	messages, err := mq.Subscribe(ctx, conf.Broker.Queue)
+	if err != nil {
+		return fmt.Errorf("failed to get messages from mq: %v", err)
+	}
+	for delivered := range messages {
+		traceCtx := broker.TraceContext(context.Background(), delivered)
+		db := db.WithContext(traceCtx)
+		log.Debugf("Received a message (corr-id: %s, message: %s)", delivered.CorrelationId, delivered.Body)
+		err := schema.ValidateJSON(fmt.Sprintf("%s/ingestion-accession.json", conf.Broker.SchemasPath), delivered.Body)
+		if err != nil {
+			log.Errorf("validation of incoming message (ingestion-accession) failed, reason: %v ", err)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: %v", err)
 			}
 
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &message)
-			// If the file has been canceled by the uploader, don't spend time working on it.
-			status, err := db.GetFileStatus(delivered.CorrelationId)
-			if err != nil {
-				log.Errorf("failed to get file status, reason: %v", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to Nack message, reason: (%v)", err)
-				}
+			continue
+		}
 
-				continue
+		// we unmarshal the message in the validation step so this is safe to do
+		_ = json.Unmarshal(delivered.Body, &message)
+		// If the file has been canceled by the uploader, don't spend time working on it.
+		status, err := db.GetFileStatus(delivered.CorrelationId)
+		if err != nil {
+			log.Errorf("failed to get file status, reason: %v", err)
+			if err := delivered.Nack(false, true); err != nil {
+				log.Errorf("failed to Nack message, reason: (%v)", err)
 			}
 
-			switch status {
-			case "disabled":
-				log.Infof("file with correlation ID: %s is disabled, stopping work", delivered.CorrelationId)
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: %v", err)
-				}
+			continue
+		}
 
-				continue
+		switch status {
+		case "disabled":
+			log.Infof("file with correlation ID: %s is disabled, stopping work", delivered.CorrelationId)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: %v", err)
+			}
 
-			case "verified":
-			case "enabled":
-			case "ready":
-				log.Infof("File with correlation ID %s is already marked as ready.", delivered.CorrelationId)
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking message, reason: %v", err)
-				}
+			continue
 
-				continue
-			default:
-				log.Warnf("file with correlation ID: %s is not verified yet, stopping work", delivered.CorrelationId)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("Failed acking canceled work, reason: %v", err)
-				}
+		case "verified":
+		case "enabled":
+		case "ready":
+			log.Infof("File with correlation ID %s is already marked as ready.", delivered.CorrelationId)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking message, reason: %v", err)
+			}
 
-				continue
+			continue
+		default:
+			log.Warnf("file with correlation ID: %s is not verified yet, stopping work", delivered.CorrelationId)
+			if err := delivered.Nack(false, true); err != nil {
+				log.Errorf("Failed acking canceled work, reason: %v", err)
 			}
 
-			fileID, err := db.GetFileID(delivered.CorrelationId)
-			if err != nil {
-				log.Errorf("failed to get ID for file, reason: %v", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to Nack message, reason: (%v)", err)
-				}
+			continue
+		}
 
-				continue
+		fileID, err := db.GetFileID(delivered.CorrelationId)
+		if err != nil {
+			log.Errorf("failed to get ID for file, reason: %v", err)
+			if err := delivered.Nack(false, true); err != nil {
+				log.Errorf("failed to Nack message, reason: (%v)", err)
 			}
 
-			c := schema.IngestionCompletion{
-				User:               message.User,
-				FilePath:           message.FilePath,
-				AccessionID:        message.AccessionID,
-				DecryptedChecksums: message.DecryptedChecksums,
-			}
-			completeMsg, _ := json.Marshal(&c)
-			err = schema.ValidateJSON(fmt.Sprintf("%s/ingestion-completion.json", conf.Broker.SchemasPath), completeMsg)
-			if err != nil {
-				log.Errorf("Validation of outgoing message failed, reason: (%v)", err)
+			continue
+		}
 
-				continue
-			}
+		c := schema.IngestionCompletion{
+			User:               message.User,
+			FilePath:           message.FilePath,
+			AccessionID:        message.AccessionID,
+			DecryptedChecksums: message.DecryptedChecksums,
+		}
+		completeMsg, _ := json.Marshal(&c)
+		err = schema.ValidateJSON(fmt.Sprintf("%s/ingestion-completion.json", conf.Broker.SchemasPath), completeMsg)
+		if err != nil {
+			log.Errorf("Validation of outgoing message failed, reason: (%v)", err)
 
-			accessionIDExists, err := db.CheckAccessionIDExists(message.AccessionID, fileID)
-			if err != nil {
-				log.Errorf("CheckAccessionIdExists failed, reason: %v ", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to Nack message, reason: (%v)", err)
-				}
+			continue
+		}
 
-				continue
+		accessionIDExists, err := db.CheckAccessionIDExists(message.AccessionID, fileID)
+		if err != nil {
+			log.Errorf("CheckAccessionIdExists failed, reason: %v ", err)
+			if err := delivered.Nack(false, true); err != nil {
+				log.Errorf("failed to Nack message, reason: (%v)", err)
 			}
 
-			switch accessionIDExists {
-			case "duplicate":
-				log.Debugf("Seems accession ID already exists (corr-id: %s, accessionid: %s", delivered.CorrelationId, message.AccessionID)
-				// Send the message to an error queue so it can be analyzed.
-				fileError := broker.InfoError{
-					Error:           "There is a conflict regarding the file accessionID",
-					Reason:          "The Accession ID already exists in the database, skipping marking it ready.",
-					OriginalMessage: message,
-				}
-				body, _ := json.Marshal(fileError)
+			continue
+		}
 
-				// Send the message to an error queue so it can be analyzed.
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); e != nil {
-					log.Errorf("failed to publish message, reason: (%v)", err)
-				}
+		switch accessionIDExists {
+		case "duplicate":
+			log.Debugf("Seems accession ID already exists (corr-id: %s, accessionid: %s", delivered.CorrelationId, message.AccessionID)
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.InfoError{
+				Error:           "There is a conflict regarding the file accessionID",
+				Reason:          "The Accession ID already exists in the database, skipping marking it ready.",
+				OriginalMessage: message,
+			}
+			body, _ := json.Marshal(fileError)
 
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("failed to Ack message, reason: (%v)", err)
-				}
+			// Send the message to an error queue so it can be analyzed.
+			if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); e != nil {
+				log.Errorf("failed to publish message, reason: (%v)", err)
+			}
 
-				continue
-			case "same":
-				log.Infoln("file already has a stable ID, marking it as ready")
-			default:
-				if conf.Backup.Type != "" && conf.Archive.Type != "" {
-					if err = backupFile(delivered); err != nil {
-						log.Errorf("Failed to backup file with corrID: %v, reason: %v", delivered.CorrelationId, err)
-						if err := delivered.Nack(false, true); err != nil {
-							log.Errorf("failed to Nack message, reason: (%v)", err)
-						}
-
-						continue
-					}
-				}
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("failed to Ack message, reason: (%v)", err)
+			}
 
-				if err := db.SetAccessionID(message.AccessionID, fileID); err != nil {
-					log.Errorf("Failed to set accessionID for file with corrID: %v, reason: %v", delivered.CorrelationId, err)
+			continue
+		case "same":
+			log.Infoln("file already has a stable ID, marking it as ready")
+		default:
+			if conf.Backup.Type != "" && conf.Archive.Type != "" {
+				if err = backupFile(delivered); err != nil {
+					log.Errorf("Failed to backup file with corrID: %v, reason: %v", delivered.CorrelationId, err)
 					if err := delivered.Nack(false, true); err != nil {
 						log.Errorf("failed to Nack message, reason: (%v)", err)
 					}
@@ -202,33 +196,46 @@ func main() {
 					continue
 				}
 			}
+		}
 
-			// Mark file as "ready"
-			if err := db.UpdateFileEventLog(fileID, "ready", delivered.CorrelationId, "finalize", "{}", string(delivered.Body)); err != nil {
-				log.Errorf("set status ready failed, reason: (%v)", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to Nack message, reason: (%v)", err)
+		// Set the accession ID and mark the file as "ready" in one go, so
+		// a file is never left with an accession ID but not ready
+		if err := db.WithTransaction(func(tx *database.Tx) error {
+			if accessionIDExists != "same" {
+				if err := tx.SetAccessionID(message.AccessionID, fileID); err != nil {
+					return fmt.Errorf("failed to set accessionID: %v", err)
 				}
+			}
 
-				continue
+			return tx.SetFileStatus(fileID, "", "ready", delivered.CorrelationId, "finalize", "{}", string(delivered.Body))
+		}); err != nil {
+			log.Errorf("Failed to mark file with corrID: %v as ready, reason: %v", delivered.CorrelationId, err)
+			// a file that can not become ready, e.g. since it was disabled
+			// in the meantime, will not become ready by retrying
+			var transitionErr *database.TransitionError
+			requeue := !errors.As(err, &transitionErr)
+			if err := delivered.Nack(false, requeue); err != nil {
+				log.Errorf("failed to Nack message, reason: (%v)", err)
 			}
 
-			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, completeMsg); err != nil {
-				log.Errorf("failed to publish message, reason: (%v)", err)
-				if err := delivered.Nack(false, true); err != nil {
-					log.Errorf("failed to Nack message, reason: (%v)", err)
-				}
+			continue
+		}
 
-				continue
+		if err := mq.SendMessageContext(traceCtx, delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, completeMsg); err != nil {
+			log.Errorf("failed to publish message, reason: (%v)", err)
+			if err := delivered.Nack(false, true); err != nil {
+				log.Errorf("failed to Nack message, reason: (%v)", err)
 			}
 
-			if err := delivered.Ack(false); err != nil {
-				log.Errorf("failed to Ack message, reason: (%v)", err)
-			}
+			continue
+		}
+
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("failed to Ack message, reason: (%v)", err)
 		}
-	}()
+	}
 
-	<-forever
+	return errors.New("delivery channel closed")
 }
 
 func backupFile(delivered amqp.Delivery) error {
@@ -272,8 +279,8 @@ func backupFile(delivered amqp.Delivery) error {
 	}
 
 	// Mark file as "backed up"
-	if err := db.UpdateFileEventLog(fileUUID, "backed up", delivered.CorrelationId, "finalize", "{}", string(delivered.Body)); err != nil {
-		return fmt.Errorf("UpdateFileEventLog failed, reason: (%v)", err)
+	if err := db.SetFileStatus(fileUUID, "", "backed up", delivered.CorrelationId, "finalize", "{}", string(delivered.Body)); err != nil {
+		return fmt.Errorf("SetFileStatus failed, reason: (%v)", err)
 	}
 
 	log.Debug("Backup completed")
@@ -3,11 +3,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -22,85 +25,81 @@ const (
 )
 
 func main() {
-	forever := make(chan bool)
 	conf, err := config.NewConfig("intercept")
 	if err != nil {
 		log.Fatal(err)
 	}
-	mq, err := broker.NewMQ(conf.Broker)
-	if err != nil {
+
+	var mq *broker.AMQPBroker
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("intercept", nil),
+		lifecycle.Broker(conf.Broker, &mq),
+		lifecycle.Component{Name: "consumer", DependsOn: []string{"broker"}, Run: func(ctx context.Context) error {
+			return consume(ctx, conf, mq)
+		}},
+	)
+
+	if err := app.Run(); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
-
-	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
-
-	go func() {
-		connError := mq.ChannelWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
-
+// consume relays the messages of the federated queue until ctx is
+// cancelled
+func consume(ctx context.Context, conf *config.Config, mq *broker.AMQPBroker) error {
 	log.Info("Starting intercept service")
 
-	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
-		if err != nil {
-			log.Fatal(err)
-		}
-		for delivered := range messages {
-			log.Debugf("Received a message: %s", delivered.Body)
-
-			msgType, err := typeFromMessage(delivered.Body)
-			if err != nil {
-				log.Errorf("Failed to get type for message (%v), reason: %v", msgType, err.Error())
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: (%v)", err)
-				}
-				// Restart on new message
-				continue
-			}
+	messages, err := mq.Subscribe(ctx, conf.Broker.Queue)
+	if err != nil {
+		return fmt.Errorf("failed to get messages from mq: %v", err)
+	}
+	for delivered := range messages {
+		log.Debugf("Received a message: %s", delivered.Body)
 
-			routing := map[string]string{
-				msgAccession: "accession",
-				msgCancel:    "ingest",
-				msgIngest:    "ingest",
-				msgMapping:   "mappings",
-				msgRelease:   "mappings",
-				msgDeprecate: "mappings",
+		msgType, err := typeFromMessage(delivered.Body)
+		if err != nil {
+			log.Errorf("Failed to get type for message (%v), reason: %v", msgType, err.Error())
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: (%v)", err)
 			}
+			// Restart on new message
+			continue
+		}
 
-			routingKey := routing[msgType]
-
-			if routingKey == "" {
-				log.Debugf("msg type: %s", msgType)
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "undeliverable", delivered.Body); err != nil {
-					log.Errorf("failed to publish message, reason: (%v)", err)
-				}
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("failed to ack message for reason: %v", err)
-				}
+		routing := map[string]string{
+			msgAccession: "accession",
+			msgCancel:    "ingest",
+			msgIngest:    "ingest",
+			msgMapping:   "mappings",
+			msgRelease:   "mappings",
+			msgDeprecate: "mappings",
+		}
 
-				continue
-			}
+		routingKey := routing[msgType]
 
-			log.Infof("Routing message (corr-id: %s, routingkey: %s)", delivered.CorrelationId, routingKey)
-			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, routingKey, delivered.Body); err != nil {
+		if routingKey == "" {
+			log.Debugf("msg type: %s", msgType)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "undeliverable", delivered.Body); err != nil {
 				log.Errorf("failed to publish message, reason: (%v)", err)
 			}
 			if err := delivered.Ack(false); err != nil {
 				log.Errorf("failed to ack message for reason: %v", err)
 			}
+
+			continue
+		}
+
+		log.Infof("Routing message (corr-id: %s, routingkey: %s)", delivered.CorrelationId, routingKey)
+		if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, routingKey, delivered.Body); err != nil {
+			log.Errorf("failed to publish message, reason: (%v)", err)
 		}
-	}()
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("failed to ack message for reason: %v", err)
+		}
+	}
 
-	<-forever
+	return errors.New("delivery channel closed")
 }
 
 // typeFromMessage returns the type value given a JSON structure for the message
@@ -3,12 +3,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	"github.com/neicnordic/sensitive-data-archive/internal/schema"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 
@@ -16,140 +19,146 @@ import (
 )
 
 func main() {
-	forever := make(chan bool)
 	conf, err := config.NewConfig("mapper")
 	if err != nil {
 		log.Fatal(err)
 	}
-	mq, err := broker.NewMQ(conf.Broker)
-	if err != nil {
-		log.Fatal(err)
-	}
-	db, err := database.NewSDAdb(conf.Database)
+	inbox, err := storage.NewBackend(conf.Inbox)
 	if err != nil {
 		log.Fatal(err)
 	}
-	inbox, err := storage.NewBackend(conf.Inbox)
-	if err != nil {
+
+	var mq *broker.AMQPBroker
+	var db *database.SDAdb
+	conf.Database.RequiredVersion = 7
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("mapper", nil),
+		lifecycle.Database(conf.Database, &db),
+		lifecycle.Metrics(conf.Metrics.Address),
+		lifecycle.Tracing(conf.Tracing.Endpoint, conf.Tracing.Service),
+		lifecycle.Broker(conf.Broker, &mq),
+		lifecycle.Component{Name: "consumer", DependsOn: []string{"database", "broker"}, Run: func(ctx context.Context) error {
+			return consume(ctx, conf, mq, db, inbox)
+		}},
+	)
+
+	if err := app.Run(); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
-	defer db.Close()
+// consume handles the messages of the mappings queue until ctx is
+// cancelled
+func consume(ctx context.Context, conf *config.Config, mq *broker.AMQPBroker, db *database.SDAdb, inbox storage.Backend) error {
+	log.Info("Starting mapper service")
+	var mappings schema.DatasetMapping
 
-	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
+	lifecycle.QuarantineEvents(mq, db, "mapper")
+	lifecycle.Deduplicate(mq, db)
+	messages, err := mq.Subscribe(ctx, conf.Broker.Queue)
+	if err != nil {
+		return fmt.Errorf("failed to get messages from mq: %v", err)
+	}
 
-	go func() {
-		connError := mq.ChannelWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
+	for delivered := range messages {
+		traceCtx := broker.TraceContext(context.Background(), delivered)
+		db := db.WithContext(traceCtx)
+		log.Debugf("received a message: %s", delivered.Body)
+		schemaType, err := schemaFromDatasetOperation(delivered.Body)
+		if err != nil {
+			log.Errorf("%s", err.Error())
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("failed to ack message: %v", err)
+			}
+			if err := mq.SendMessage(delivered.CorrelationId, mq.Conf.Exchange, "error", delivered.Body); err != nil {
+				log.Errorf("failed to send error message: %v", err)
+			}
 
-	log.Info("Starting mapper service")
-	var mappings schema.DatasetMapping
+			continue
+		}
 
-	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
+		err = schema.ValidateJSON(fmt.Sprintf("%s/%s.json", conf.Broker.SchemasPath, schemaType), delivered.Body)
 		if err != nil {
-			log.Fatalf("Failed to get message from mq (error: %v)", err)
+			log.Errorf("validation of incoming message (%s) failed, reason: %v ", schemaType, err)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: %v", err)
+			}
+
+			continue
 		}
 
-		for delivered := range messages {
-			log.Debugf("received a message: %s", delivered.Body)
-			schemaType, err := schemaFromDatasetOperation(delivered.Body)
-			if err != nil {
-				log.Errorf("%s", err.Error())
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("failed to ack message: %v", err)
-				}
-				if err := mq.SendMessage(delivered.CorrelationId, mq.Conf.Exchange, "error", delivered.Body); err != nil {
-					log.Errorf("failed to send error message: %v", err)
+		// we unmarshal the message in the validation step so this is safe to do,
+		// the optional fields are cleared first to not keep those of the last message
+		mappings = schema.DatasetMapping{}
+		_ = json.Unmarshal(delivered.Body, &mappings)
+
+		switch mappings.Type {
+		case "mapping":
+			log.Debug("Mapping type operation, mapping files to dataset")
+			if err := db.WithTransaction(func(tx *database.Tx) error {
+				provenance := database.MappingProvenance{Actor: mappings.Actor, Source: mappings.Source, CorrelationID: delivered.CorrelationId}
+				if err := tx.MapFilesToDatasetWithProvenance(mappings.DatasetID, mappings.AccessionIDs, provenance); err != nil {
+					return err
 				}
 
-				continue
-			}
+				return tx.UpdateDatasetEvent(mappings.DatasetID, "registered", string(delivered.Body))
+			}); err != nil {
+				log.Errorf("failed to map files to dataset, reason: %v", err)
 
-			err = schema.ValidateJSON(fmt.Sprintf("%s/%s.json", conf.Broker.SchemasPath, schemaType), delivered.Body)
-			if err != nil {
-				log.Errorf("validation of incoming message (%s) failed, reason: %v ", schemaType, err)
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: %v", err)
+				// Nack message so the server gets notified that something is wrong and requeue the message
+				if err := delivered.Nack(false, true); err != nil {
+					log.Errorf("failed to Nack message, reason: (%v)", err)
 				}
 
 				continue
 			}
 
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &mappings)
-
-			switch mappings.Type {
-			case "mapping":
-				log.Debug("Mapping type operation, mapping files to dataset")
-				if err := db.MapFilesToDataset(mappings.DatasetID, mappings.AccessionIDs); err != nil {
-					log.Errorf("failed to map files to dataset, reason: %v", err)
-
-					// Nack message so the server gets notified that something is wrong and requeue the message
-					if err := delivered.Nack(false, true); err != nil {
-						log.Errorf("failed to Nack message, reason: (%v)", err)
-					}
-
-					continue
+			for _, aID := range mappings.AccessionIDs {
+				log.Debugf("Mapped file to dataset (corr-id: %s, datasetid: %s, accessionid: %s)", delivered.CorrelationId, mappings.DatasetID, aID)
+				filePath, err := db.GetInboxPath(aID)
+				if err != nil {
+					log.Errorf("failed to get inbox path for file with stable ID: %s", aID)
 				}
-
-				for _, aID := range mappings.AccessionIDs {
-					log.Debugf("Mapped file to dataset (corr-id: %s, datasetid: %s, accessionid: %s)", delivered.CorrelationId, mappings.DatasetID, aID)
-					filePath, err := db.GetInboxPath(aID)
-					if err != nil {
-						log.Errorf("failed to get inbox path for file with stable ID: %s", aID)
-					}
-					err = inbox.RemoveFile(filePath)
-					if err != nil {
-						log.Errorf("Remove file from inbox failed, reason: %v", err)
-					}
+				err = inbox.RemoveFile(filePath)
+				if err != nil {
+					log.Errorf("Remove file from inbox failed, reason: %v", err)
+				}
+			}
+		case "release":
+			log.Debug("Release type operation, marking dataset as released")
+			if err := db.UpdateDatasetEvent(mappings.DatasetID, "released", string(delivered.Body)); err != nil {
+				log.Errorf("failed to set dataset status for dataset: %s", mappings.DatasetID)
+				if err = delivered.Nack(false, false); err != nil {
+					log.Errorf("Failed to Nack message, reason: (%s)", err.Error())
 				}
 
-				if err := db.UpdateDatasetEvent(mappings.DatasetID, "registered", string(delivered.Body)); err != nil {
-					log.Errorf("failed to set dataset status for dataset: %s", mappings.DatasetID)
-					if err = delivered.Nack(false, false); err != nil {
-						log.Errorf("Failed to Nack message, reason: (%s)", err.Error())
-					}
+				continue
+			}
 
-					continue
-				}
-			case "release":
-				log.Debug("Release type operation, marking dataset as released")
-				if err := db.UpdateDatasetEvent(mappings.DatasetID, "released", string(delivered.Body)); err != nil {
-					log.Errorf("failed to set dataset status for dataset: %s", mappings.DatasetID)
-					if err = delivered.Nack(false, false); err != nil {
-						log.Errorf("Failed to Nack message, reason: (%s)", err.Error())
-					}
-
-					continue
-				}
-			case "deprecate":
-				log.Debug("Deprecate type operation, marking dataset as deprecated")
-				if err := db.UpdateDatasetEvent(mappings.DatasetID, "deprecated", string(delivered.Body)); err != nil {
-					log.Errorf("failed to set dataset status for dataset: %s", mappings.DatasetID)
-					if err = delivered.Nack(false, false); err != nil {
-						log.Errorf("Failed to Nack message, reason: (%s)", err.Error())
-					}
-
-					continue
-				}
+			// subscribers are notified of the release through the notify service,
+			// the dataset is released even if this fails
+			if err := mq.SendMessageContext(traceCtx, delivered.CorrelationId, mq.Conf.Exchange, "released", delivered.Body); err != nil {
+				log.Errorf("failed to send release notification for dataset: %s, reason: %v", mappings.DatasetID, err)
 			}
+		case "deprecate":
+			log.Debug("Deprecate type operation, marking dataset as deprecated")
+			if err := db.UpdateDatasetEvent(mappings.DatasetID, "deprecated", string(delivered.Body)); err != nil {
+				log.Errorf("failed to set dataset status for dataset: %s", mappings.DatasetID)
+				if err = delivered.Nack(false, false); err != nil {
+					log.Errorf("Failed to Nack message, reason: (%s)", err.Error())
+				}
 
-			if err := delivered.Ack(false); err != nil {
-				log.Errorf("failed to Ack message, reason: (%v)", err)
+				continue
 			}
 		}
-	}()
 
-	<-forever
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("failed to Ack message, reason: (%v)", err)
+		}
+	}
+
+	return errors.New("delivery channel closed")
 }
 
 // schemaFromDatasetOperation returns the operation done with dataset supplied in body of the message
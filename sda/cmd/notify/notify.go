@@ -2,88 +2,124 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/smtp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
-	"github.com/neicnordic/sensitive-data-archive/internal/schema"
+	"github.com/neicnordic/sensitive-data-archive/internal/events"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
 	"github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
 )
 
 const err = "error"
 const ready = "ready"
+const quota = "quota"
+const released = "released"
+const missing = "missing"
 
 func main() {
-	forever := make(chan bool)
 	conf, err := config.NewConfig("notify")
 	if err != nil {
 		log.Fatal(err)
 	}
-	mq, err := broker.NewMQ(conf.Broker)
-	if err != nil {
+
+	var mq *broker.AMQPBroker
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("notify", nil),
+		lifecycle.Broker(conf.Broker, &mq),
+		lifecycle.Component{Name: "consumer", DependsOn: []string{"broker"}, Run: func(ctx context.Context) error {
+			return consume(ctx, conf, mq)
+		}},
+	)
+
+	if err := app.Run(); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+// consume sends notifications for the messages of the queue until ctx is
+// cancelled
+func consume(ctx context.Context, conf *config.Config, mq *broker.AMQPBroker) error {
+	log.Infof("Starting %s notify service", conf.Broker.Queue)
 
-	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
+	messages, err := mq.Subscribe(ctx, conf.Broker.Queue)
+	if err != nil {
+		return fmt.Errorf("failed to get messages from mq: %v", err)
+	}
 
-	go func() {
-		connError := mq.ChannelWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
+	for d := range messages {
+		log.Debugf("received a message: %s", d.Body)
 
-	log.Infof("Starting %s notify service", conf.Broker.Queue)
+		if err := validator(conf.Broker.Queue, conf.Broker.SchemasPath, d); err != nil {
+			log.Errorf("Failed to handle message, reason: %v", err)
 
-	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
-		if err != nil {
-			log.Fatalf("Failed to get message from mq (error: %v)", err)
+			continue
 		}
 
-		for d := range messages {
-			log.Debugf("received a message: %s", d.Body)
+		// releases are announced on the mailing lists, there is no user to notify
+		if conf.Broker.Queue == released {
+			for _, list := range conf.Notify.MailingLists {
+				if err := sendEmail(conf.Notify, setBody(released, d.Body), list, setSubject(released)); err != nil {
+					log.Errorf("Failed to send email to mailing list %s, error %v", list, err)
+				}
+			}
+			if err := d.Ack(false); err != nil {
+				log.Errorf("Failed to ack message, error %v", err)
+			}
 
-			if err := validator(conf.Broker.Queue, conf.Broker.SchemasPath, d); err != nil {
-				log.Errorf("Failed to handle message, reason: %v", err)
+			continue
+		}
 
-				continue
-			}
-			user := getUser(conf.Broker.Queue, d.Body)
-			if user == "" {
-				log.Errorln("No user in message, skipping")
+		user := getUser(conf.Broker.Queue, d.Body)
+		if user == "" {
+			log.Errorln("No user in message, skipping")
 
-				continue
+			continue
+		}
+
+		if err := sendEmail(conf.Notify, setBody(conf.Broker.Queue, d.Body), user, setSubject(conf.Broker.Queue)); err != nil {
+			log.Errorf("Failed to send email, error %v", err)
+
+			if e := d.Nack(false, false); e != nil {
+				log.Errorf("Failed to Nack message (corr-id: %s, errror: %v) ", d.CorrelationId, e)
 			}
 
-			if err := sendEmail(conf.Notify, "THIS SHOULD TAKE A TEMPLATE", user, setSubject(conf.Broker.Queue)); err != nil {
-				log.Errorf("Failed to send email, error %v", err)
+			continue
+		}
 
-				if e := d.Nack(false, false); e != nil {
-					log.Errorf("Failed to Nack message (corr-id: %s, errror: %v) ", d.CorrelationId, e)
+		// admins are kept informed about quota warnings, failures here
+		// should not cause the user to be notified twice
+		if conf.Broker.Queue == quota {
+			for _, admin := range conf.Notify.Admins {
+				if err := sendEmail(conf.Notify, setBody(quota, d.Body), admin, setSubject(quota)); err != nil {
+					log.Errorf("Failed to send email to admin %s, error %v", admin, err)
 				}
-
-				continue
 			}
-
-			if err := d.Ack(false); err != nil {
-				log.Errorf("Failed to ack message, error %v", err)
+			if conf.Notify.Webhook != "" {
+				if err := sendWebhook(conf.Notify.Webhook, d.Body); err != nil {
+					log.Errorf("Failed to call webhook, error %v", err)
+				}
 			}
 		}
-	}()
 
-	<-forever
+		if err := d.Ack(false); err != nil {
+			log.Errorf("Failed to ack message, error %v", err)
+		}
+	}
+
+	return errors.New("delivery channel closed")
 }
 
 func getUser(queue string, orgMsg []byte) string {
@@ -98,7 +134,17 @@ func getUser(queue string, orgMsg []byte) string {
 
 		return fmt.Sprint(message["user"])
 	case ready:
-		var notify schema.IngestionCompletion
+		var notify events.IngestionCompletion
+		_ = json.Unmarshal(orgMsg, &notify)
+
+		return notify.User
+	case quota:
+		var notify events.QuotaWarning
+		_ = json.Unmarshal(orgMsg, &notify)
+
+		return notify.User
+	case missing:
+		var notify events.MissingFiles
 		_ = json.Unmarshal(orgMsg, &notify)
 
 		return notify.User
@@ -107,6 +153,28 @@ func getUser(queue string, orgMsg []byte) string {
 	}
 }
 
+func setBody(queue string, orgMsg []byte) string {
+	switch queue {
+	case quota:
+		var notify events.QuotaWarning
+		_ = json.Unmarshal(orgMsg, &notify)
+
+		return fmt.Sprintf("User %s has used %d of %d bytes, more than %d%% of the storage quota.", notify.User, notify.Used, notify.Quota, notify.Threshold)
+	case missing:
+		var notify events.MissingFiles
+		_ = json.Unmarshal(orgMsg, &notify)
+
+		return fmt.Sprintf("User %s has not yet uploaded %d of the files registered for the submission: %s.", notify.User, len(notify.Files), strings.Join(notify.Files, ", "))
+	case released:
+		var notify events.DatasetRelease
+		_ = json.Unmarshal(orgMsg, &notify)
+
+		return fmt.Sprintf("Dataset %s has been released and is now available for access.", notify.DatasetID)
+	default:
+		return "THIS SHOULD TAKE A TEMPLATE"
+	}
+}
+
 func sendEmail(conf config.SMTPConf, emailBody, recipient, subject string) error {
 	// Receiver email address.
 	to := []string{recipient}
@@ -130,32 +198,55 @@ func sendEmail(conf config.SMTPConf, emailBody, recipient, subject string) error
 	return nil
 }
 
+// sendWebhook posts the message to the configured webhook
+func sendWebhook(url string, body []byte) error {
+	client := outbound.Client(30 * time.Second)
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
 func setSubject(queue string) string {
 	switch queue {
 	case err:
 		return "Error during ingestion"
 	case ready:
 		return "Ingestion completed"
+	case quota:
+		return "Storage quota warning"
+	case released:
+		return "New dataset released"
+	case missing:
+		return "Files missing from submission"
 	default:
 		return ""
 	}
 }
 
 func validator(queue, schemaPath string, delivery amqp091.Delivery) error {
+	var e error
 	switch queue {
 	case err:
-		if err := schema.ValidateJSON(fmt.Sprintf("%s/info-error.json", schemaPath), delivery.Body); err != nil {
-			return err
-		}
-
-		return nil
+		_, e = events.Unmarshal[events.InfoError](schemaPath, delivery.Body)
 	case ready:
-		if err := schema.ValidateJSON(fmt.Sprintf("%s/ingestion-completion.json", schemaPath), delivery.Body); err != nil {
-			return err
-		}
-
-		return nil
+		_, e = events.Unmarshal[events.IngestionCompletion](schemaPath, delivery.Body)
+	case quota:
+		_, e = events.Unmarshal[events.QuotaWarning](schemaPath, delivery.Body)
+	case released:
+		_, e = events.Unmarshal[events.DatasetRelease](schemaPath, delivery.Body)
+	case missing:
+		_, e = events.Unmarshal[events.MissingFiles](schemaPath, delivery.Body)
+	default:
+		return fmt.Errorf("Error")
 	}
 
-	return fmt.Errorf("Error")
+	return e
 }
@@ -3,6 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	smtpmock "github.com/mocktools/go-smtp-mock"
@@ -55,11 +58,20 @@ func TestGetUser(t *testing.T) {
 	orgUser := getUser("error", infoErrorBytes)
 	assert.Equal(t, "JohnDoe", orgUser)
 
+	quotaMsg, _ := json.Marshal(schema.QuotaWarning{User: "JohnDoe", Quota: 1000, Used: 850, Threshold: 80})
+	assert.Equal(t, "JohnDoe", getUser("quota", quotaMsg))
+
+	missingMsg, _ := json.Marshal(schema.MissingFiles{User: "JohnDoe", Files: []string{"/JohnDoe/a.c4gh"}})
+	assert.Equal(t, "JohnDoe", getUser("missing", missingMsg))
+
 }
 
 func TestSetSubject(t *testing.T) {
 	assert.Equal(t, "Error during ingestion", setSubject("error"))
 	assert.Equal(t, "Ingestion completed", setSubject("ready"))
+	assert.Equal(t, "Storage quota warning", setSubject("quota"))
+	assert.Equal(t, "New dataset released", setSubject("released"))
+	assert.Equal(t, "Files missing from submission", setSubject("missing"))
 	assert.Empty(t, setSubject("phail"))
 }
 
@@ -117,6 +129,46 @@ func TestValidator(t *testing.T) {
 	d.Body, _ = json.Marshal(finalizedMsg)
 	err = validator("ready", "../../schemas/federated", d)
 	assert.Nil(t, err)
+
+	d.Body, _ = json.Marshal(schema.QuotaWarning{User: "JohnDoe", Quota: 1000, Used: 850, Threshold: 80})
+	assert.NoError(t, validator("quota", "../../schemas/federated", d))
+	assert.Error(t, validator("ready", "../../schemas/federated", d))
+
+	d.Body, _ = json.Marshal(schema.DatasetRelease{Type: "release", DatasetID: "EGAD00123456789"})
+	assert.NoError(t, validator("released", "../../schemas/federated", d))
+	assert.Error(t, validator("quota", "../../schemas/federated", d))
+
+	d.Body, _ = json.Marshal(schema.MissingFiles{User: "JohnDoe", Files: []string{"/JohnDoe/a.c4gh"}})
+	assert.NoError(t, validator("missing", "../../schemas/federated", d))
+	assert.Error(t, validator("released", "../../schemas/federated", d))
+}
+
+func TestSetBody(t *testing.T) {
+	quotaMsg, _ := json.Marshal(schema.QuotaWarning{User: "JohnDoe", Quota: 1000, Used: 850, Threshold: 80})
+	assert.Equal(t, "User JohnDoe has used 850 of 1000 bytes, more than 80% of the storage quota.", setBody("quota", quotaMsg))
+
+	releaseMsg, _ := json.Marshal(schema.DatasetRelease{Type: "release", DatasetID: "EGAD00123456789"})
+	assert.Equal(t, "Dataset EGAD00123456789 has been released and is now available for access.", setBody("released", releaseMsg))
+
+	missingMsg, _ := json.Marshal(schema.MissingFiles{User: "JohnDoe", Files: []string{"/JohnDoe/a.c4gh", "/JohnDoe/b.c4gh"}})
+	assert.Equal(t, "User JohnDoe has not yet uploaded 2 of the files registered for the submission: /JohnDoe/a.c4gh, /JohnDoe/b.c4gh.", setBody("missing", missingMsg))
+}
+
+func TestSendWebhook(t *testing.T) {
+	var received []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	assert.NoError(t, sendWebhook(ts.URL, []byte(`{"user":"JohnDoe"}`)))
+	assert.Equal(t, `{"user":"JohnDoe"}`, string(received))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.EqualError(t, sendWebhook(failing.URL, []byte("{}")), "webhook returned status 500")
 }
 
 func TestSendEmail(t *testing.T) {
@@ -3,15 +3,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	uuid "github.com/google/uuid"
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	"github.com/neicnordic/sensitive-data-archive/internal/schema"
 	"github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
@@ -63,21 +64,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	mq, err := broker.NewMQ(conf.Broker)
-	if err != nil {
-		log.Fatal(err)
-	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
-
-	queues := []string{conf.Orchestrator.QueueInbox, conf.Orchestrator.QueueVerify, conf.Orchestrator.QueueComplete}
-
-	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		os.Exit(1)
-	}()
+	var mq *broker.AMQPBroker
+	app := lifecycle.New()
+	app.Add(lifecycle.Config("orchestrate", nil), lifecycle.Broker(conf.Broker, &mq))
 
 	routing := map[string]string{
 		conf.Orchestrator.QueueVerify:   conf.Orchestrator.QueueAccession,
@@ -85,23 +75,31 @@ func main() {
 		conf.Orchestrator.QueueComplete: conf.Orchestrator.QueueMapping,
 	}
 
-	forever := make(chan bool)
+	for _, queue := range []string{conf.Orchestrator.QueueInbox, conf.Orchestrator.QueueVerify, conf.Orchestrator.QueueComplete} {
+		routingKey := routing[queue]
+		app.Add(lifecycle.Component{
+			Name:      "consumer-" + queue,
+			DependsOn: []string{"broker"},
+			Run: func(ctx context.Context) error {
+				return processQueue(ctx, mq, queue, routingKey, conf)
+			},
+		})
+	}
 
 	log.Info("Starting orchestrate service")
-
-	for _, queue := range queues {
-		routingKey := routing[queue]
-		go processQueue(mq, queue, routingKey, conf)
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
 	}
-	<-forever
 }
 
-func processQueue(mq *broker.AMQPBroker, queue string, routingKey string, conf *config.Config) {
+// processQueue consumes the messages on queue and forwards them to
+// routingKey, it returns when ctx is cancelled
+func processQueue(ctx context.Context, mq *broker.AMQPBroker, queue string, routingKey string, conf *config.Config) error {
 	log.Infof("Monitoring queue: %s", queue)
 
-	messages, err := mq.GetMessages(queue)
+	messages, err := mq.Subscribe(ctx, queue)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to get messages from mq: %v", err)
 	}
 	for delivered := range messages {
 		log.Debugf("Received a message: %s", delivered.Body)
@@ -203,6 +201,8 @@ func processQueue(mq *broker.AMQPBroker, queue string, routingKey string, conf *
 		}
 
 	}
+
+	return errors.New("delivery channel closed")
 }
 
 // schemaNameFromQueue returns the schema to use for messages
@@ -382,7 +382,7 @@ func validateMsg(delivered *amqp091.Delivery, mq *broker.AMQPBroker, routingKey
 
 	log.Debugf("Routing message (corr-id: %s, routingkey: %s, message: %s)", delivered.CorrelationId, routingKey, publishMsg)
 
-	if err := mq.SendMessage(delivered.CorrelationId, mq.Conf.Exchange, routingKey, publishMsg); err != nil {
+	if err := mq.SendMessageContext(broker.TraceContext(context.Background(), *delivered), delivered.CorrelationId, mq.Conf.Exchange, routingKey, publishMsg); err != nil {
 		// TODO fix resend mechanism
 		log.Errorln("We need to fix this resend stuff ...")
 	}
@@ -10,13 +10,12 @@ import (
 	"math"
 	"net"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/neicnordic/crypt4gh/keys"
 	"github.com/neicnordic/crypt4gh/model/headers"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	re "github.com/neicnordic/sensitive-data-archive/internal/reencrypt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -156,21 +155,6 @@ func main() {
 		log.Fatalf("configuration loading failed, reason: %v", err)
 	}
 
-	sigc := make(chan os.Signal, 5)
-	signal.Notify(sigc, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	defer func() {
-		if err := recover(); err != nil {
-			log.Fatal("Could not recover, exiting")
-		}
-	}()
-
-	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", conf.ReEncrypt.Host, conf.ReEncrypt.Port))
-	if err != nil {
-		log.Errorf("failed to listen: %v", err)
-		sigc <- syscall.SIGINT
-		panic(err)
-	}
-
 	var (
 		opts       []grpc.ServerOption
 		serverCert tls.Certificate
@@ -181,22 +165,17 @@ func main() {
 		case conf.ReEncrypt.CACert != "":
 			caFile, err := os.ReadFile(conf.ReEncrypt.CACert)
 			if err != nil {
-				log.Errorf("Failed to read CA certificate: %v", err)
-				sigc <- syscall.SIGINT
-				panic(err)
+				log.Fatalf("Failed to read CA certificate: %v", err)
 			}
 
 			caCert = x509.NewCertPool()
 			if !caCert.AppendCertsFromPEM(caFile) {
-				sigc <- syscall.SIGINT
-				panic("Failed to append ca certificate")
+				log.Fatal("Failed to append ca certificate")
 			}
 
 			serverCert, err = tls.LoadX509KeyPair(conf.ReEncrypt.ServerCert, conf.ReEncrypt.ServerKey)
 			if err != nil {
-				log.Errorf("Failed to parse certificates: %v", err)
-				sigc <- syscall.SIGINT
-				panic(err)
+				log.Fatalf("Failed to parse certificates: %v", err)
 			}
 
 			creds := credentials.NewTLS(
@@ -211,9 +190,7 @@ func main() {
 		default:
 			creds, err := credentials.NewServerTLSFromFile(conf.ReEncrypt.ServerCert, conf.ReEncrypt.ServerKey)
 			if err != nil {
-				log.Errorf("Failed to generate tlsConfig: %v", err)
-				sigc <- syscall.SIGINT
-				panic(err)
+				log.Fatalf("Failed to generate tlsConfig: %v", err)
 			}
 			opts = []grpc.ServerOption{grpc.Creds(creds)}
 		}
@@ -229,30 +206,55 @@ func main() {
 	healthServer.SetServingStatus(re.Reencrypt_ServiceDesc.ServiceName, healthgrpc.HealthCheckResponse_SERVING)
 	healthgrpc.RegisterHealthServer(s, healthServer)
 
-	// Start proxy health server
+	// Proxy health server
 	p := grpc.NewServer()
 	healthgrpc.RegisterHealthServer(p, &hServer{srvCert: serverCert, srvCACert: caCert, srvPort: conf.ReEncrypt.Port})
 
-	healthServerListener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", conf.ReEncrypt.Host, conf.ReEncrypt.Port+1))
-	if err != nil {
-		log.Errorf("failed to listen: %v", err)
-		sigc <- syscall.SIGINT
-		panic(err)
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("reencrypt", nil),
+		grpcServer("server", s, fmt.Sprintf("%s:%d", conf.ReEncrypt.Host, conf.ReEncrypt.Port)),
+		grpcServer("health-server", p, fmt.Sprintf("%s:%d", conf.ReEncrypt.Host, conf.ReEncrypt.Port+1)),
+	)
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
 	}
-	go func() {
-		log.Debugf("health server listening at %v", healthServerListener.Addr())
-		if err := p.Serve(healthServerListener); err != nil {
-			log.Errorf("failed to serve: %v", err)
-			sigc <- syscall.SIGINT
-			panic(err)
-		}
-	}()
-
-	// Start reencrypt server
-	log.Printf("server listening at %v", lis.Addr())
-	if err := s.Serve(lis); err != nil {
-		log.Errorf("failed to serve: %v", err)
-		sigc <- syscall.SIGINT
-		panic(err)
+}
+
+// grpcServer returns a component that serves srv on addr and stops it
+// gracefully on shutdown, open calls are cancelled if they do not finish
+// within the shutdown timeout
+func grpcServer(name string, srv *grpc.Server, addr string) lifecycle.Component {
+	var lis net.Listener
+
+	return lifecycle.Component{
+		Name: name,
+		Start: func(context.Context) error {
+			var err error
+			lis, err = net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen: %v", err)
+			}
+			log.Infof("%s listening at %v", name, lis.Addr())
+
+			return nil
+		},
+		Run: func(context.Context) error {
+			return srv.Serve(lis)
+		},
+		Stop: func(ctx context.Context) error {
+			stopped := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				srv.Stop()
+			}
+
+			return nil
+		},
 	}
 }
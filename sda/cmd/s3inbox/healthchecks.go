@@ -33,7 +33,7 @@ func (p *Proxy) CheckHealth(w http.ResponseWriter, _ *http.Request) {
 		}
 	}
 
-	if p.messenger.Channel.IsClosed() {
+	if p.messenger.IsChannelClosed() {
 		log.Warning("channel is closed, recreating...")
 		err := p.messenger.CreateNewChannel()
 		if err != nil {
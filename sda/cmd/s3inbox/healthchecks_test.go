@@ -33,7 +33,8 @@ func (suite *HealthcheckTestSuite) TearDownTest() {
 }
 
 func (suite *HealthcheckTestSuite) TestHttpsGetCheck() {
-	p := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	p, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	url, _ := p.getS3ReadyPath()
 	assert.NoError(suite.T(), p.httpsGetCheck(url))
@@ -41,9 +42,10 @@ func (suite *HealthcheckTestSuite) TestHttpsGetCheck() {
 }
 
 func (suite *HealthcheckTestSuite) TestS3URL() {
-	p := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	p, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
-	_, err := p.getS3ReadyPath()
+	_, err = p.getS3ReadyPath()
 	assert.NoError(suite.T(), err)
 
 	p.s3.URL = "://badurl"
@@ -57,7 +59,8 @@ func (suite *HealthcheckTestSuite) TestHealthchecks() {
 	database, _ := database.NewSDAdb(suite.DBConf)
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
-	p := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	p, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	w := httptest.NewRecorder()
 	p.CheckHealth(w, httptest.NewRequest(http.MethodGet, "https://dummy/health", nil))
@@ -72,7 +75,8 @@ func (suite *HealthcheckTestSuite) TestClosedDBHealthchecks() {
 	database, _ := database.NewSDAdb(suite.DBConf)
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
-	p := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	p, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// Check that 200 is reported
 	w := httptest.NewRecorder()
@@ -95,7 +99,8 @@ func (suite *HealthcheckTestSuite) TestNoS3Healthchecks() {
 	database, _ := database.NewSDAdb(suite.DBConf)
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
-	p := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	p, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// S3 unavailable, check that 503 is reported
 	w := httptest.NewRecorder()
@@ -111,7 +116,8 @@ func (suite *HealthcheckTestSuite) TestNoMQHealthchecks() {
 	database, _ := database.NewSDAdb(suite.DBConf)
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
-	p := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	p, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// Messenger unavailable, check that 503 is reported
 	p.messenger.Conf.Port = 123456
@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -21,6 +22,7 @@ import (
 	"github.com/minio/minio-go/v6/pkg/signer"
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 	"github.com/neicnordic/sensitive-data-archive/internal/userauth"
 	log "github.com/sirupsen/logrus"
@@ -34,6 +36,7 @@ type Proxy struct {
 	database  *database.SDAdb
 	client    *http.Client
 	fileIds   map[string]string
+	creds     aws.CredentialsProvider
 }
 
 // The Event struct
@@ -74,12 +77,20 @@ const (
 	Other
 )
 
+// sessionIDPattern limits the upload session IDs that clients can set
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
 // NewProxy creates a new S3Proxy. This implements the ServerHTTP interface.
-func NewProxy(s3conf storage.S3Conf, auth userauth.Authenticator, messenger *broker.AMQPBroker, database *database.SDAdb, tls *tls.Config) *Proxy {
-	tr := &http.Transport{TLSClientConfig: tls}
+func NewProxy(s3conf storage.S3Conf, auth userauth.Authenticator, messenger *broker.AMQPBroker, database *database.SDAdb, tls *tls.Config) (*Proxy, error) {
+	tr := &http.Transport{TLSClientConfig: tls, Proxy: outbound.Proxy}
 	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
 
-	return &Proxy{s3conf, auth, messenger, database, client, make(map[string]string)}
+	creds, err := storage.NewCredentialsProvider(s3conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up S3 credentials, reason: %v", err)
+	}
+
+	return &Proxy{s3conf, auth, messenger, database, client, make(map[string]string), creds}, nil
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -130,7 +141,14 @@ func (p *Proxy) allowedResponse(w http.ResponseWriter, r *http.Request, token jw
 	}
 
 	path := strings.Split(str.Path, "/")
-	if strings.Contains(token.Subject(), "@") {
+	if prefixes := userauth.InboxPrefixes(token); prefixes != nil {
+		// users assigned to inbox prefixes may only use those
+		if !underPrefix(str.Path, prefixes) {
+			reportError(http.StatusForbidden, fmt.Sprintf("%s is not under any of the inbox prefixes of %s: %v", str.Path, token.Subject(), prefixes), w)
+
+			return
+		}
+	} else if strings.Contains(token.Subject(), "@") {
 		if strings.ReplaceAll(token.Subject(), "@", "_") != path[1] {
 			reportError(http.StatusBadRequest, fmt.Sprintf("token supplied username: %s, but URL had: %s", token.Subject(), path[1]), w)
 
@@ -158,6 +176,19 @@ func (p *Proxy) allowedResponse(w http.ResponseWriter, r *http.Request, token jw
 
 	// register file in database if it's the start of an upload
 	if p.detectRequestType(r) == Put && p.fileIds[r.URL.Path] == "" {
+		// new uploads are not allowed while submissions are frozen
+		frozen, err := p.database.GetSubmissionFreeze(username)
+		if err != nil {
+			p.internalServerError(w, r, fmt.Sprintf("failed to check submission freeze: %v", err))
+
+			return
+		}
+		if frozen != nil {
+			reportError(http.StatusForbidden, frozen.Message(), w)
+
+			return
+		}
+
 		log.Debugf("registering file %v in the database", r.URL.Path)
 		p.fileIds[r.URL.Path], err = p.database.RegisterFile(filepath, username)
 		log.Debugf("fileId: %v", p.fileIds[r.URL.Path])
@@ -166,6 +197,7 @@ func (p *Proxy) allowedResponse(w http.ResponseWriter, r *http.Request, token jw
 
 			return
 		}
+		p.addToUploadSession(r, token, p.fileIds[r.URL.Path])
 	}
 
 	log.Debug("Forwarding to backend")
@@ -200,13 +232,22 @@ func (p *Proxy) allowedResponse(w http.ResponseWriter, r *http.Request, token jw
 		}
 
 		log.Debugf("marking file %v as 'uploaded' in database", p.fileIds[r.URL.Path])
-		err = p.database.UpdateFileEventLog(p.fileIds[r.URL.Path], "uploaded", p.fileIds[r.URL.Path], "inbox", "{}", string(jsonMessage))
+		// the file was registered when the upload started
+		err = p.database.SetFileStatus(p.fileIds[r.URL.Path], "registered", "uploaded", p.fileIds[r.URL.Path], "inbox", "{}", string(jsonMessage))
 		if err != nil {
 			p.internalServerError(w, r, fmt.Sprintf("could not connect to db: %v", err))
 
 			return
 		}
 
+		// the uploaded size is used for quota accounting
+		err = p.database.SetSubmissionFileSize(p.fileIds[r.URL.Path], message.Filesize)
+		if err != nil {
+			p.internalServerError(w, r, fmt.Sprintf("failed to set file size in database: %v", err))
+
+			return
+		}
+
 		delete(p.fileIds, r.URL.Path)
 	}
 
@@ -240,6 +281,46 @@ func (p *Proxy) allowedResponse(w http.ResponseWriter, r *http.Request, token jw
 	_ = s3response.Body.Close()
 }
 
+// underPrefix reports whether the path, or the directory it lists, is under
+// one of the prefixes
+func underPrefix(filePath string, prefixes []string) bool {
+	filePath = strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" && (filePath == prefix || strings.HasPrefix(filePath, prefix+"/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addToUploadSession links the file to the upload session given by the
+// client in the X-Upload-Session header, falling back to the ID of the token.
+// Sessions are only used for reporting so failures do not stop the upload.
+func (p *Proxy) addToUploadSession(r *http.Request, token jwt.Token, fileID string) {
+	if p.database.Version < 22 {
+		return
+	}
+
+	sessionID := r.Header.Get("X-Upload-Session")
+	if sessionID == "" {
+		sessionID = token.JwtID()
+	}
+	if sessionID == "" {
+		return
+	}
+	if !sessionIDPattern.MatchString(sessionID) {
+		log.Warnf("ignoring invalid upload session ID from %s", token.Subject())
+
+		return
+	}
+
+	if err := p.database.AddFileToUploadSession(fileID, sessionID, token.Subject()); err != nil {
+		log.Warnf("failed to add file %s to upload session %s, reason: %v", fileID, sessionID, err)
+	}
+}
+
 // Renew the connection to MQ if necessary, then send message
 func (p *Proxy) checkAndSendMessage(jsonMessage []byte, r *http.Request) error {
 	var err error
@@ -254,7 +335,7 @@ func (p *Proxy) checkAndSendMessage(jsonMessage []byte, r *http.Request) error {
 		}
 	}
 
-	if p.messenger.Channel.IsClosed() {
+	if p.messenger.IsChannelClosed() {
 		log.Warning("channel is closed, recreating...")
 		err := p.messenger.CreateNewChannel()
 		if err != nil {
@@ -294,7 +375,16 @@ func (p *Proxy) uploadFinishedSuccessfully(req *http.Request, response *http.Res
 }
 
 func (p *Proxy) forwardToBackend(r *http.Request) (*http.Response, error) {
-	p.resignHeader(r, p.s3.AccessKey, p.s3.SecretKey, fmt.Sprintf("%s:%d", p.s3.URL, p.s3.Port))
+	if p.creds == nil {
+		return nil, fmt.Errorf("no S3 credentials available")
+	}
+	creds, err := p.creds.Retrieve(r.Context())
+	if err != nil {
+		log.Errorf("failed to retrieve S3 credentials, reason: %v", err)
+
+		return nil, err
+	}
+	p.resignHeader(r, creds, fmt.Sprintf("%s:%d", p.s3.URL, p.s3.Port))
 
 	// Redirect request
 	nr, err := http.NewRequest(r.Method, fmt.Sprintf("%s:%d", p.s3.URL, p.s3.Port)+r.URL.String(), r.Body)
@@ -370,7 +460,7 @@ func (p *Proxy) prependBucketToHostPath(r *http.Request) error {
 // Function for signing the headers of the s3 requests
 // Used for for creating a signature for with the default
 // credentials of the s3 service and the user's signature (authentication)
-func (p *Proxy) resignHeader(r *http.Request, accessKey string, secretKey string, backendURL string) *http.Request {
+func (p *Proxy) resignHeader(r *http.Request, creds aws.Credentials, backendURL string) *http.Request {
 	log.Debugf("Generating resigning header for %s", backendURL)
 	r.Header.Del("X-Amz-Security-Token")
 	r.Header.Del("X-Forwarded-Port")
@@ -386,7 +476,7 @@ func (p *Proxy) resignHeader(r *http.Request, accessKey string, secretKey string
 		r.Host = host[1]
 	}
 
-	return signer.SignV4(*r, accessKey, secretKey, "", p.s3.Region)
+	return signer.SignV4(*r, creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken, p.s3.Region)
 }
 
 // Not necessarily a function on the struct since it does not use any of the
@@ -173,7 +173,8 @@ func (m *MockMessenger) SendMessage(uuid string, body []byte) error {
 
 // nolint:bodyclose
 func (suite *ProxyTests) TestServeHTTP_disallowed() {
-	proxy := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	proxy, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	r, _ := http.NewRequest("", "", nil)
 	w := httptest.NewRecorder()
@@ -225,7 +226,8 @@ func (suite *ProxyTests) TestServeHTTP_disallowed() {
 	assert.Equal(suite.T(), false, suite.fakeServer.PingedAndRestore())
 
 	// Not authorized user get 401 response
-	proxy = NewProxy(suite.S3conf, &helper.AlwaysDeny{}, suite.messenger, suite.database, new(tls.Config))
+	proxy, err = NewProxy(suite.S3conf, &helper.AlwaysDeny{}, suite.messenger, suite.database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 	w = httptest.NewRecorder()
 	r.Method = "GET"
 	r.URL, _ = url.Parse("/username/file")
@@ -242,7 +244,8 @@ func (suite *ProxyTests) TestServeHTTPS3Unresponsive() {
 		Bucket:    "buckbuck",
 		Region:    "us-east-1",
 	}
-	proxy := NewProxy(s3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	proxy, err := NewProxy(s3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	r, _ := http.NewRequest("", "", nil)
 	w := httptest.NewRecorder()
@@ -254,12 +257,21 @@ func (suite *ProxyTests) TestServeHTTPS3Unresponsive() {
 	assert.Equal(suite.T(), 500, w.Result().StatusCode) // nolint:bodyclose
 }
 
+func (suite *ProxyTests) TestNewProxy_credentialsError() {
+	s3conf := suite.S3conf
+	s3conf.Credentials.Provider = storage.FileCredentials
+	proxy, err := NewProxy(s3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	assert.ErrorContains(suite.T(), err, "no credentials file given")
+	assert.Nil(suite.T(), proxy)
+}
+
 func (suite *ProxyTests) TestServeHTTP_MQConnectionClosed() {
 	// Set up
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
 	database, _ := database.NewSDAdb(suite.DBConf)
-	proxy := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	proxy, err := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// Test that the mq connection will be restored when needed
 	proxy.messenger.Connection.Close()
@@ -277,7 +289,8 @@ func (suite *ProxyTests) TestServeHTTP_MQChannelClosed() {
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
 	database, _ := database.NewSDAdb(suite.DBConf)
-	proxy := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	proxy, err := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// Test that the mq channel will be restored when needed
 	proxy.messenger.Channel.Close()
@@ -295,7 +308,8 @@ func (suite *ProxyTests) TestServeHTTP_MQ_Unavailable() {
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
 	database, _ := database.NewSDAdb(suite.DBConf)
-	proxy := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	proxy, err := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// Test that the correct status code is returned when mq connection can't be created
 	proxy.messenger.Conf.Port = 123456
@@ -313,7 +327,8 @@ func (suite *ProxyTests) TestServeHTTP_allowed() {
 	messenger, err := broker.NewMQ(suite.MQConf)
 	assert.NoError(suite.T(), err)
 	database, _ := database.NewSDAdb(suite.DBConf)
-	proxy := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	proxy, err := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// List files works
 	r, err := http.NewRequest("GET", "/dummy/file", nil)
@@ -419,7 +434,8 @@ func (suite *ProxyTests) TestMessageFormatting() {
 	assert.NoError(suite.T(), claims.Set("sub", "user@host.domain"))
 
 	// start proxy that denies everything
-	proxy := NewProxy(suite.S3conf, &helper.AlwaysDeny{}, suite.messenger, suite.database, new(tls.Config))
+	proxy, err := NewProxy(suite.S3conf, &helper.AlwaysDeny{}, suite.messenger, suite.database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 	suite.fakeServer.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>/user/new_file.txt</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>/user/new_file.txt</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>1234</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
 	msg, err := proxy.CreateMessageFromRequest(r, claims)
 	assert.Nil(suite.T(), err)
@@ -451,7 +467,8 @@ func (suite *ProxyTests) TestDatabaseConnection() {
 	assert.NoError(suite.T(), err)
 	defer messenger.Connection.Close()
 	// Start proxy that allows everything
-	proxy := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	proxy, err := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
 
 	// PUT a file into the system
 	filename := "/dummy/db-test-file"
@@ -484,6 +501,81 @@ func (suite *ProxyTests) TestDatabaseConnection() {
 		assert.Nil(suite.T(), err, "Failed to find '%v' event in database", status)
 		assert.Equal(suite.T(), exists, 1, "File '%v' event does not exist", status)
 	}
+
+	// Check that the uploaded size is recorded
+	var size int64
+	query = "SELECT submission_file_size FROM sda.files WHERE id = $1;"
+	err = db.QueryRow(query, fileID).Scan(&size)
+	assert.Nil(suite.T(), err, "Failed to query database")
+	assert.Equal(suite.T(), int64(5), size)
+}
+
+func (suite *ProxyTests) TestUploadOfChangedFile() {
+	database, err := database.NewSDAdb(suite.DBConf)
+	assert.NoError(suite.T(), err)
+	defer database.Close()
+	messenger, err := broker.NewMQ(suite.MQConf)
+	assert.NoError(suite.T(), err)
+	defer messenger.Connection.Close()
+	proxy, err := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
+
+	// the file is disabled while it is being uploaded
+	filename := "/dummy/changed-file"
+	fileID, err := database.RegisterFile(filename[1:], "dummy")
+	assert.NoError(suite.T(), err)
+	proxy.fileIds[filename] = fileID
+	assert.NoError(suite.T(), database.UpdateFileEventLog(fileID, "disabled", fileID, "api", "{}", "{}"))
+
+	r, _ := http.NewRequest("PUT", filename, nil)
+	w := httptest.NewRecorder()
+	suite.fakeServer.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>/elixirid/changed-file.txt</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>/elixirid/file.txt</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>5</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
+	proxy.allowedResponse(w, r, suite.token)
+	res := w.Result()
+	defer res.Body.Close()
+	assert.Equal(suite.T(), http.StatusInternalServerError, res.StatusCode)
+	suite.fakeServer.PingedAndRestore()
+
+	status, err := database.GetFileStatus(fileID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "disabled", status)
+}
+
+func (suite *ProxyTests) TestUploadSession() {
+	database, err := database.NewSDAdb(suite.DBConf)
+	assert.NoError(suite.T(), err)
+	defer database.Close()
+	messenger, err := broker.NewMQ(suite.MQConf)
+	assert.NoError(suite.T(), err)
+	defer messenger.Connection.Close()
+	proxy, err := NewProxy(suite.S3conf, helper.NewAlwaysAllow(), messenger, database, new(tls.Config))
+	assert.NoError(suite.T(), err)
+
+	filename := "/dummy/session-test-file"
+	r, _ := http.NewRequest("PUT", filename, nil)
+	r.Header.Set("X-Upload-Session", "session-0001")
+	w := httptest.NewRecorder()
+	suite.fakeServer.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>/elixirid/db-test-file.txt</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>/elixirid/file.txt</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>5</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
+	proxy.allowedResponse(w, r, suite.token)
+	res := w.Result()
+	defer res.Body.Close()
+	assert.Equal(suite.T(), 200, res.StatusCode)
+
+	session, err := database.GetUploadSession("session-0001")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), suite.token.Subject(), session.User)
+	assert.Equal(suite.T(), 1, len(session.Files))
+	assert.Equal(suite.T(), 1, session.Uploaded)
+	assert.Equal(suite.T(), filename[1:], session.Files[0].InboxPath)
+
+	// invalid session IDs are ignored without failing the upload
+	r, _ = http.NewRequest("PUT", "/dummy/session-test-file-2", nil)
+	r.Header.Set("X-Upload-Session", "not a valid/session")
+	w = httptest.NewRecorder()
+	proxy.allowedResponse(w, r, suite.token)
+	res2 := w.Result()
+	defer res2.Body.Close()
+	assert.Equal(suite.T(), 200, res2.StatusCode)
 }
 
 func (suite *ProxyTests) TestFormatUploadFilePath() {
@@ -503,3 +595,32 @@ func (suite *ProxyTests) TestFormatUploadFilePath() {
 	_, err = formatUploadFilePath(weirdPath)
 	assert.EqualError(suite.T(), err, "filepath contains disallowed characters: :, *, ?, \", <, >, |, !, ', (, ), ;, @, &, =, +, $, ,, #, [, ], %")
 }
+
+func (suite *ProxyTests) TestUnderPrefix() {
+	prefixes := []string{"project-a", "/shared/upload/"}
+	assert.True(suite.T(), underPrefix("/project-a/file.c4gh", prefixes))
+	assert.True(suite.T(), underPrefix("/project-a/dir/file.c4gh", prefixes))
+	assert.True(suite.T(), underPrefix("/project-a/", prefixes))
+	assert.True(suite.T(), underPrefix("/shared/upload/file.c4gh", prefixes))
+	assert.False(suite.T(), underPrefix("/project-ab/file.c4gh", prefixes))
+	assert.False(suite.T(), underPrefix("/shared/file.c4gh", prefixes))
+	assert.False(suite.T(), underPrefix("/project-a/../project-b/file.c4gh", prefixes))
+	assert.False(suite.T(), underPrefix("/dummy/file.c4gh", nil))
+}
+
+// nolint:bodyclose
+func (suite *ProxyTests) TestServeHTTP_inboxPrefixes() {
+	proxy, err := NewProxy(suite.S3conf, &helper.AlwaysAllow{}, suite.messenger, suite.database, new(tls.Config))
+	assert.NoError(suite.T(), err)
+
+	token := jwt.New()
+	assert.NoError(suite.T(), token.Set(jwt.SubjectKey, "dummy"))
+	assert.NoError(suite.T(), token.Set(userauth.InboxPrefixesClaim, []string{"project-a"}))
+
+	// users with inbox prefixes can not upload to their own directory
+	r, _ := http.NewRequest("PUT", "/dummy/file.c4gh", nil)
+	w := httptest.NewRecorder()
+	proxy.allowedResponse(w, r, token)
+	assert.Equal(suite.T(), 403, w.Result().StatusCode)
+	assert.Equal(suite.T(), false, suite.fakeServer.PingedAndRestore())
+}
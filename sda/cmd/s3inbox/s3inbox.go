@@ -1,10 +1,8 @@
 package main
 
 import (
+	"context"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -13,6 +11,7 @@ import (
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 	"github.com/neicnordic/sensitive-data-archive/internal/userauth"
 
@@ -23,90 +22,33 @@ import (
 var Conf *config.Config
 
 func main() {
-	sigc := make(chan os.Signal, 5)
-	signal.Notify(sigc, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	// Create a function to handle panic and exit gracefully
-	defer func() {
-		if err := recover(); err != nil {
-			log.Errorf("Could not recover from %v", err)
-			log.Fatal("Could not recover, exiting")
-		}
-	}()
-
 	Conf, err := config.NewConfig("s3inbox")
 	if err != nil {
-		log.Error(err)
-		sigc <- syscall.SIGINT
-		panic(err)
+		log.Fatal(err)
 	}
 
 	tlsProxy, err := config.TLSConfigProxy(Conf)
 	if err != nil {
-		log.Error(err)
-		sigc <- syscall.SIGINT
-		panic(err)
-	}
-
-	sdaDB, err := database.NewSDAdb(Conf.Database)
-	if err != nil {
-		log.Error(err)
-		sigc <- syscall.SIGINT
-		panic(err)
-	}
-	if sdaDB.Version < 4 {
-		log.Error("database schema v4 is required")
-		sigc <- syscall.SIGINT
-		panic(err)
+		log.Fatal(err)
 	}
 
-	log.Debugf("Connected to sda-db (v%v)", sdaDB.Version)
-
-	s3, err := storage.NewS3Client(Conf.Inbox.S3)
-	if err != nil {
-		log.Error(err)
-		sigc <- syscall.SIGINT
-		panic(err)
-	}
-
-	err = storage.CheckS3Bucket(Conf.Inbox.S3.Bucket, s3)
-	if err != nil {
-		log.Error(err)
-		sigc <- syscall.SIGINT
-		panic(err)
-	}
-
-	messenger, err := broker.NewMQ(Conf.Broker)
-	if err != nil {
-		log.Error(err)
-		sigc <- syscall.SIGINT
-		panic(err)
-	}
-
-	go func() {
-		<-sigc
-		sdaDB.Close()
-		messenger.Channel.Close()
-		messenger.Connection.Close()
-		os.Exit(1)
-	}()
 	auth := userauth.NewValidateFromToken(jwk.NewSet())
+	auth.Issuers = Conf.Server.JwtIssuers
+	auth.Audiences = Conf.Server.JwtAudiences
+	auth.Algorithms = Conf.Server.JwtAlgorithms
+	auth.ClockSkew = Conf.Server.JwtClockSkew
 	// Load keys for JWT verification
 	if Conf.Server.Jwtpubkeyurl != "" {
 		if err := auth.FetchJwtPubKeyURL(Conf.Server.Jwtpubkeyurl); err != nil {
-			log.Panicf("Error while getting key %s: %v", Conf.Server.Jwtpubkeyurl, err)
+			log.Fatalf("Error while getting key %s: %v", Conf.Server.Jwtpubkeyurl, err)
 		}
+		auth.RefreshJwtPubKeyURL(context.Background(), Conf.Server.JwksRefresh)
 	}
 	if Conf.Server.Jwtpubkeypath != "" {
 		if err := auth.ReadJwtPubKeyPath(Conf.Server.Jwtpubkeypath); err != nil {
-			log.Panicf("Error while getting key %s: %v", Conf.Server.Jwtpubkeypath, err)
+			log.Fatalf("Error while getting key %s: %v", Conf.Server.Jwtpubkeypath, err)
 		}
 	}
-	mux := mux.NewRouter()
-	proxy := NewProxy(Conf.Inbox.S3, auth, messenger, sdaDB, tlsProxy)
-	mux.HandleFunc("/", proxy.CheckHealth).Methods("HEAD")
-	mux.HandleFunc("/health", proxy.CheckHealth)
-	mux.PathPrefix("/").Handler(proxy)
 
 	server := &http.Server{
 		Addr:              ":8000",
@@ -114,16 +56,62 @@ func main() {
 		WriteTimeout:      30 * time.Second,
 		IdleTimeout:       30 * time.Second,
 		ReadHeaderTimeout: 30 * time.Second,
-		Handler:           mux,
 	}
 
-	if Conf.Server.Cert != "" && Conf.Server.Key != "" {
-		if err := server.ListenAndServeTLS(Conf.Server.Cert, Conf.Server.Key); err != nil {
-			panic(err)
-		}
-	} else {
-		if err := server.ListenAndServe(); err != nil {
-			panic(err)
-		}
+	var (
+		sdaDB     *database.SDAdb
+		messenger *broker.AMQPBroker
+	)
+	// The proxy re-establishes the broker connection when it is lost, so
+	// the service is not stopped for it.
+	mq := lifecycle.Broker(Conf.Broker, &messenger)
+	mq.Run = nil
+	inbox := lifecycle.HTTPServer("server", server, Conf.Server.Cert, Conf.Server.Key)
+	inbox.DependsOn = []string{"proxy"}
+
+	Conf.Database.RequiredVersion = 4
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("s3inbox", nil),
+		lifecycle.Database(Conf.Database, &sdaDB),
+		lifecycle.Metrics(Conf.Metrics.Address),
+		mq,
+		lifecycle.Component{
+			Name: "storage",
+			Start: func(context.Context) error {
+				s3, err := storage.NewS3Client(Conf.Inbox.S3)
+				if err != nil {
+					return err
+				}
+
+				return storage.CheckS3Bucket(Conf.Inbox.S3.Bucket, s3)
+			},
+		},
+		lifecycle.Component{
+			Name:      "proxy",
+			DependsOn: []string{"database", "broker", "storage"},
+			Start: func(context.Context) error {
+				log.Debugf("Connected to sda-db (v%v)", sdaDB.Version)
+
+				mux := mux.NewRouter()
+				// requests signed with the S3 credentials that users manage
+				// in auth are checked against the database, others need a token
+				proxy, err := NewProxy(Conf.Inbox.S3, userauth.NewValidateFromCredentials(sdaDB, auth), messenger, sdaDB, tlsProxy)
+				if err != nil {
+					return err
+				}
+				mux.HandleFunc("/", proxy.CheckHealth).Methods("HEAD")
+				mux.HandleFunc("/health", proxy.CheckHealth)
+				mux.PathPrefix("/").Handler(proxy)
+				server.Handler = mux
+
+				return nil
+			},
+		},
+		inbox,
+	)
+
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -4,7 +4,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,6 +18,8 @@ import (
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
 	"github.com/neicnordic/sensitive-data-archive/internal/schema"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 	log "github.com/sirupsen/logrus"
@@ -31,19 +35,10 @@ var (
 )
 
 func main() {
-	forever := make(chan bool)
 	conf, err = config.NewConfig("sync")
 	if err != nil {
 		log.Fatal(err)
 	}
-	mq, err := broker.NewMQ(conf.Broker)
-	if err != nil {
-		log.Fatal(err)
-	}
-	db, err = database.NewSDAdb(conf.Database)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	syncDestination, err = storage.NewBackend(conf.Sync.Destination)
 	if err != nil {
@@ -64,100 +59,103 @@ func main() {
 		log.Fatal(err)
 	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
-	defer db.Close()
-
-	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
-
-	go func() {
-		connError := mq.ChannelWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
+	var mq *broker.AMQPBroker
+	conf.Database.RequiredVersion = 8
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("sync", nil),
+		lifecycle.Database(conf.Database, &db),
+		lifecycle.Metrics(conf.Metrics.Address),
+		lifecycle.Broker(conf.Broker, &mq),
+		lifecycle.Component{Name: "consumer", DependsOn: []string{"database", "broker"}, Run: func(ctx context.Context) error {
+			return consume(ctx, mq)
+		}},
+	)
+
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// consume syncs the datasets of the mapping messages until ctx is
+// cancelled
+func consume(ctx context.Context, mq *broker.AMQPBroker) error {
 	log.Info("Starting sync service")
 	var message schema.DatasetMapping
 
-	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
-		if err != nil {
-			log.Fatal(err)
-		}
-		for delivered := range messages {
-			log.Debugf("Received a message (corr-id: %s, message: %s)",
-				delivered.CorrelationId,
-				delivered.Body)
-
-			err := schema.ValidateJSON(fmt.Sprintf("%s/dataset-mapping.json", conf.Broker.SchemasPath), delivered.Body)
-			if err != nil {
-				log.Errorf("validation of incoming message (dataset-mapping) failed, reason: (%s)", err.Error())
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Message validation failed in sync service",
-					Reason:          err.Error(),
-					OriginalMessage: string(delivered.Body),
-				}
+	messages, err := mq.Subscribe(ctx, conf.Broker.Queue)
+	if err != nil {
+		return fmt.Errorf("failed to get messages from mq: %v", err)
+	}
+	for delivered := range messages {
+		log.Debugf("Received a message (corr-id: %s, message: %s)",
+			delivered.CorrelationId,
+			delivered.Body)
 
-				body, _ := json.Marshal(infoErrorMessage)
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-					log.Errorf("failed to publish message, reason: (%s)", err.Error())
-				}
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("failed to Ack message, reason: (%s)", err.Error())
-				}
+		err := schema.ValidateJSON(fmt.Sprintf("%s/dataset-mapping.json", conf.Broker.SchemasPath), delivered.Body)
+		if err != nil {
+			log.Errorf("validation of incoming message (dataset-mapping) failed, reason: (%s)", err.Error())
+			// Send the message to an error queue so it can be analyzed.
+			infoErrorMessage := broker.InfoError{
+				Error:           "Message validation failed in sync service",
+				Reason:          err.Error(),
+				OriginalMessage: string(delivered.Body),
+			}
 
-				continue
+			body, _ := json.Marshal(infoErrorMessage)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("failed to publish message, reason: (%s)", err.Error())
+			}
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("failed to Ack message, reason: (%s)", err.Error())
 			}
 
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &message)
+			continue
+		}
 
-			if !strings.HasPrefix(message.DatasetID, conf.Sync.CenterPrefix) {
-				log.Infoln("external dataset")
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("failed to Ack message, reason: (%s)", err.Error())
-				}
+		// we unmarshal the message in the validation step so this is safe to do
+		_ = json.Unmarshal(delivered.Body, &message)
 
-				continue
+		if !strings.HasPrefix(message.DatasetID, conf.Sync.CenterPrefix) {
+			log.Infoln("external dataset")
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("failed to Ack message, reason: (%s)", err.Error())
 			}
 
-			for _, aID := range message.AccessionIDs {
-				if err := syncFiles(aID); err != nil {
-					log.Errorf("failed to sync archived file %s, reason: (%s)", aID, err.Error())
-					if err := delivered.Nack(false, false); err != nil {
-						log.Errorf("failed to nack following GetFileSize error message")
-					}
-
-					continue
-				}
-			}
+			continue
+		}
 
-			log.Infoln("buildSyncDatasetJSON")
-			blob, err := buildSyncDatasetJSON(delivered.Body)
-			if err != nil {
-				log.Errorf("failed to build SyncDatasetJSON, Reason: %v", err)
-			}
-			if err := sendPOST(blob); err != nil {
-				log.Errorf("failed to send POST, Reason: %v", err)
+		for _, aID := range message.AccessionIDs {
+			if err := syncFiles(aID); err != nil {
+				log.Errorf("failed to sync archived file %s, reason: (%s)", aID, err.Error())
 				if err := delivered.Nack(false, false); err != nil {
-					log.Errorf("failed to nack following sendPOST error message")
+					log.Errorf("failed to nack following GetFileSize error message")
 				}
 
 				continue
 			}
+		}
 
-			if err := delivered.Ack(false); err != nil {
-				log.Errorf("failed to Ack message, reason: (%s)", err.Error())
+		log.Infoln("buildSyncDatasetJSON")
+		blob, err := buildSyncDatasetJSON(delivered.Body)
+		if err != nil {
+			log.Errorf("failed to build SyncDatasetJSON, Reason: %v", err)
+		}
+		if err := sendPOST(blob); err != nil {
+			log.Errorf("failed to send POST, Reason: %v", err)
+			if err := delivered.Nack(false, false); err != nil {
+				log.Errorf("failed to nack following sendPOST error message")
 			}
+
+			continue
 		}
-	}()
 
-	<-forever
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("failed to Ack message, reason: (%s)", err.Error())
+		}
+	}
+
+	return errors.New("delivery channel closed")
 }
 
 func syncFiles(stableID string) error {
@@ -251,9 +249,7 @@ func buildSyncDatasetJSON(b []byte) ([]byte, error) {
 }
 
 func sendPOST(payload []byte) error {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	client := outbound.Client(30 * time.Second)
 
 	URL, err := createHostURL(conf.Sync.RemoteHost, conf.Sync.RemotePort)
 	if err != nil {
@@ -168,9 +168,10 @@ func (suite *SyncTest) TestBuildSyncDatasetJSON() {
 	fileInfo := database.FileInfo{Checksum: fmt.Sprintf("%x", sha256.New().Sum(nil)), Size: 1234, Path: "dummy.user/test/file1.c4gh", DecryptedChecksum: checksum, DecryptedSize: 999}
 	corrID := uuid.New().String()
 
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "failed to mark file as Archived")
-	err = db.SetVerified(fileInfo, fileID, corrID)
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 	assert.NoError(suite.T(), err, "failed to mark file as Verified")
 
 	accessions := []string{"ed6af454-d910-49e3-8cda-488a6f246e67"}
@@ -8,15 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	"github.com/neicnordic/sensitive-data-archive/internal/schema"
 
 	log "github.com/sirupsen/logrus"
@@ -42,33 +40,26 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	Conf.API.MQ, err = broker.NewMQ(Conf.Broker)
-	if err != nil {
-		log.Fatal(err)
-	}
 
-	sigc := make(chan os.Signal, 5)
-	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		<-sigc
-		shutdown()
-		os.Exit(0)
-	}()
+	// The broker connection is re-established by the readiness check, so
+	// the service is not stopped when it is lost.
+	mq := lifecycle.Broker(Conf.Broker, &Conf.API.MQ)
+	mq.Run = nil
 
 	srv := setup(Conf)
+	api := lifecycle.HTTPServer("server", srv, Conf.API.ServerCert, Conf.API.ServerKey)
+	api.DependsOn = []string{"broker"}
+
+	app := lifecycle.New()
+	app.Add(lifecycle.Config("sync-api", nil), mq, api)
 
 	if Conf.API.ServerCert != "" && Conf.API.ServerKey != "" {
 		log.Infof("Web server is ready to receive connections at https://%s:%d", Conf.API.Host, Conf.API.Port)
-		if err := srv.ListenAndServeTLS(Conf.API.ServerCert, Conf.API.ServerKey); err != nil {
-			shutdown()
-			log.Fatalln(err)
-		}
 	} else {
 		log.Infof("Web server is ready to receive connections at http://%s:%d", Conf.API.Host, Conf.API.Port)
-		if err := srv.ListenAndServe(); err != nil {
-			shutdown()
-			log.Fatalln(err)
-		}
+	}
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -96,14 +87,13 @@ func setup(config *config.Config) *http.Server {
 }
 
 func shutdown() {
-	defer Conf.API.MQ.Channel.Close()
-	defer Conf.API.MQ.Connection.Close()
+	defer Conf.API.MQ.Close()
 }
 
 func readinessResponse(w http.ResponseWriter, _ *http.Request) {
 	statusCocde := http.StatusOK
 
-	if Conf.API.MQ.Connection.IsClosed() {
+	if Conf.API.MQ.IsConnClosed() {
 		statusCocde = http.StatusServiceUnavailable
 		newConn, err := broker.NewMQ(Conf.Broker)
 		if err != nil {
@@ -113,9 +103,9 @@ func readinessResponse(w http.ResponseWriter, _ *http.Request) {
 		}
 	}
 
-	if Conf.API.MQ.Channel.IsClosed() {
+	if Conf.API.MQ.IsChannelClosed() {
 		statusCocde = http.StatusServiceUnavailable
-		Conf.API.MQ.Connection.Close()
+		Conf.API.MQ.Close()
 		newConn, err := broker.NewMQ(Conf.Broker)
 		if err != nil {
 			log.Errorf("failed to reconnect to MQ, reason: %v", err)
@@ -155,6 +145,9 @@ func parseDatasetMessage(msg []byte) error {
 	blob := syncDataset{}
 	_ = json.Unmarshal(msg, &blob)
 
+	// the messages of a dataset are published as one batch, since a dataset
+	// can have thousands of files
+	var messages []broker.Message
 	var accessionIDs []string
 	for _, files := range blob.DatasetFiles {
 		ingest := schema.IngestionTrigger{
@@ -167,9 +160,7 @@ func parseDatasetMessage(msg []byte) error {
 			return fmt.Errorf("failed to marshal json messge: Reason %v", err)
 		}
 		corrID := uuid.New().String()
-		if err := Conf.API.MQ.SendMessage(corrID, Conf.Broker.Exchange, Conf.SyncAPI.IngestRouting, ingestMsg); err != nil {
-			return fmt.Errorf("failed to send ingest messge: Reason %v", err)
-		}
+		messages = append(messages, broker.Message{CorrID: corrID, Exchange: Conf.Broker.Exchange, RoutingKey: Conf.SyncAPI.IngestRouting, Body: ingestMsg})
 
 		accessionIDs = append(accessionIDs, files.FileID)
 		finalize := schema.IngestionAccession{
@@ -183,24 +174,25 @@ func parseDatasetMessage(msg []byte) error {
 		if err != nil {
 			return fmt.Errorf("failed to marshal json messge: Reason %v", err)
 		}
-
-		if err := Conf.API.MQ.SendMessage(corrID, Conf.Broker.Exchange, Conf.SyncAPI.AccessionRouting, finalizeMsg); err != nil {
-			return fmt.Errorf("failed to send mapping messge: Reason %v", err)
-		}
+		messages = append(messages, broker.Message{CorrID: corrID, Exchange: Conf.Broker.Exchange, RoutingKey: Conf.SyncAPI.AccessionRouting, Body: finalizeMsg})
 	}
 
 	mappings := schema.DatasetMapping{
 		Type:         "mapping",
 		DatasetID:    blob.DatasetID,
 		AccessionIDs: accessionIDs,
+		Actor:        Conf.SyncAPI.APIUser,
+		Source:       "sync",
 	}
 	mappingMsg, err := json.Marshal(mappings)
 	if err != nil {
 		return fmt.Errorf("failed to marshal json messge: Reason %v", err)
 	}
 
-	if err := Conf.API.MQ.SendMessage(fmt.Sprintf("%v", time.Now().Unix()), Conf.Broker.Exchange, Conf.SyncAPI.MappingRouting, mappingMsg); err != nil {
-		return fmt.Errorf("failed to send mapping messge: Reason %v", err)
+	messages = append(messages, broker.Message{CorrID: fmt.Sprintf("%v", time.Now().Unix()), Exchange: Conf.Broker.Exchange, RoutingKey: Conf.SyncAPI.MappingRouting, Body: mappingMsg})
+
+	if err := Conf.API.MQ.SendMessages(messages); err != nil {
+		return fmt.Errorf("failed to send dataset messages: Reason %v", err)
 	}
 
 	return nil
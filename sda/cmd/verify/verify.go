@@ -4,9 +4,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5" // #nosec
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -16,26 +18,19 @@ import (
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/config"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/lifecycle"
 	"github.com/neicnordic/sensitive-data-archive/internal/schema"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
+	"github.com/neicnordic/sensitive-data-archive/internal/validator"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	forever := make(chan bool)
 	conf, err := config.NewConfig("verify")
 	if err != nil {
 		log.Fatal(err)
 	}
-	mq, err := broker.NewMQ(conf.Broker)
-	if err != nil {
-		log.Fatal(err)
-	}
-	db, err := database.NewSDAdb(conf.Database)
-	if err != nil {
-		log.Fatal(err)
-	}
 	archive, err := storage.NewBackend(conf.Archive)
 	if err != nil {
 		log.Fatal(err)
@@ -45,318 +40,388 @@ func main() {
 		log.Fatal(err)
 	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
-	defer db.Close()
-
-	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
-
-	go func() {
-		connError := mq.ChannelWatcher()
-		log.Error(connError)
-		forever <- false
-	}()
+	var mq *broker.AMQPBroker
+	var db *database.SDAdb
+	var validators *validator.Manager
+	conf.Database.RequiredVersion = 8
+	app := lifecycle.New()
+	app.Add(
+		lifecycle.Config("verify", nil),
+		lifecycle.Database(conf.Database, &db),
+		lifecycle.Metrics(conf.Metrics.Address),
+		lifecycle.Tracing(conf.Tracing.Endpoint, conf.Tracing.Service),
+		lifecycle.Broker(conf.Broker, &mq),
+		lifecycle.Component{
+			Name: "validators",
+			Start: func(context.Context) error {
+				validators, err = validator.NewManager(conf.Verify.Validators)
+
+				return err
+			},
+			Stop: func(context.Context) error {
+				validators.Close()
+
+				return nil
+			},
+		},
+		lifecycle.Component{Name: "consumer", DependsOn: []string{"database", "broker", "validators"}, Run: func(ctx context.Context) error {
+			return consume(ctx, conf, mq, db, archive, archiveKeyList, validators)
+		}},
+	)
+
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// consume verifies the archived files of the messages until ctx is
+// cancelled
+func consume(ctx context.Context, conf *config.Config, mq *broker.AMQPBroker, db *database.SDAdb, archive storage.Backend, archiveKeyList []*[32]byte, validators *validator.Manager) error {
 	log.Info("starting verify service")
 	var message schema.IngestionVerification
 
-	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
+	lifecycle.QuarantineEvents(mq, db, "verify")
+	messages, err := mq.Subscribe(ctx, conf.Broker.Queue)
+	if err != nil {
+		return fmt.Errorf("failed to get messages from mq: %v", err)
+	}
+	for delivered := range messages {
+		traceCtx := broker.TraceContext(context.Background(), delivered)
+		db := db.WithContext(traceCtx)
+		log.Debugf("received a message (corr-id: %s, message: %s)", delivered.CorrelationId, delivered.Body)
+		err := schema.ValidateJSON(fmt.Sprintf("%s/ingestion-verification.json", conf.Broker.SchemasPath), delivered.Body)
 		if err != nil {
-			log.Fatalf("Failed to get messages (error: %v) ",
-				err)
+			log.Errorf("validation of incoming message (ingestion-verifiation) failed, reason: (%s)", err.Error())
+			// Send the message to an error queue so it can be analyzed.
+			infoErrorMessage := broker.InfoError{
+				Error:           "Message validation failed",
+				Reason:          err.Error(),
+				OriginalMessage: message,
+			}
+
+			body, _ := json.Marshal(infoErrorMessage)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("failed to publish message, reason: (%s)", err.Error())
+			}
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to Ack message, reason: (%s)", err.Error())
+			}
+
+			// Restart on new message
+			continue
 		}
-		for delivered := range messages {
-			log.Debugf("received a message (corr-id: %s, message: %s)", delivered.CorrelationId, delivered.Body)
-			err := schema.ValidateJSON(fmt.Sprintf("%s/ingestion-verification.json", conf.Broker.SchemasPath), delivered.Body)
-			if err != nil {
-				log.Errorf("validation of incoming message (ingestion-verifiation) failed, reason: (%s)", err.Error())
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Message validation failed",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
+		// we unmarshal the message in the validation step so this is safe to do
+		_ = json.Unmarshal(delivered.Body, &message)
 
-				body, _ := json.Marshal(infoErrorMessage)
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-					log.Errorf("failed to publish message, reason: (%s)", err.Error())
-				}
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed to Ack message, reason: (%s)", err.Error())
-				}
+		log.Infof(
+			"Received work (corr-id: %s, filepath: %s, user: %s)",
+			delivered.CorrelationId, message.FilePath, message.User,
+		)
 
-				// Restart on new message
-				continue
+		// If the file has been canceled by the uploader, don't spend time working on it.
+		status, err := db.GetFileStatus(delivered.CorrelationId)
+		if err != nil {
+			log.Errorf("failed to get file status, reason: (%s)", err.Error())
+			// Send the message to an error queue so it can be analyzed.
+			infoErrorMessage := broker.InfoError{
+				Error:           "Getheader failed",
+				Reason:          err.Error(),
+				OriginalMessage: message,
 			}
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &message)
 
-			log.Infof(
-				"Received work (corr-id: %s, filepath: %s, user: %s)",
-				delivered.CorrelationId, message.FilePath, message.User,
-			)
+			body, _ := json.Marshal(infoErrorMessage)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("failed to publish message, reason: (%s)", err.Error())
+			}
 
-			// If the file has been canceled by the uploader, don't spend time working on it.
-			status, err := db.GetFileStatus(delivered.CorrelationId)
-			if err != nil {
-				log.Errorf("failed to get file status, reason: (%s)", err.Error())
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Getheader failed",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
+			}
 
-				body, _ := json.Marshal(infoErrorMessage)
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-					log.Errorf("failed to publish message, reason: (%s)", err.Error())
-				}
+			continue
+		}
+		if status == "disabled" {
+			log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
+			}
 
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
-				}
+			continue
+		}
+
+		header, err := db.GetHeader(message.FileID)
+		if err != nil {
+			log.Errorf("GetHeader failed for file with ID: %v, readon: %v", message.FileID, err.Error())
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to nack following getheader error message")
 
-				continue
 			}
-			if status == "disabled" {
-				log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
-				}
+			// store full message info in case we want to fix the db entry and retry
+			infoErrorMessage := broker.InfoError{
+				Error:           "Getheader failed",
+				Reason:          err.Error(),
+				OriginalMessage: message,
+			}
 
-				continue
+			body, _ := json.Marshal(infoErrorMessage)
+
+			// Send the message to an error queue so it can be analyzed.
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("failed to publish message, reason: (%s)", err.Error())
 			}
 
-			header, err := db.GetHeader(message.FileID)
-			if err != nil {
-				log.Errorf("GetHeader failed for file with ID: %v, readon: %v", message.FileID, err.Error())
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed to nack following getheader error message")
+			continue
+		}
 
+		var file database.FileInfo
+		file.Size, err = archive.GetFileSize(message.ArchivePath)
+		if err != nil { //nolint:nestif
+			log.Errorf("Failed to get archived file size, reson: (%s)", err.Error())
+			if strings.Contains(err.Error(), "no such file or directory") || strings.Contains(err.Error(), "NoSuchKey:") || strings.Contains(err.Error(), "NotFound:") {
+				jsonMsg, _ := json.Marshal(map[string]string{"error": err.Error()})
+				if err := db.SetFileStatus(message.FileID, "", "error", delivered.CorrelationId, "verify", string(jsonMsg), string(delivered.Body)); err != nil {
+					log.Errorf("failed to set ingestion status for file from message: %v", delivered.CorrelationId)
 				}
-				// store full message info in case we want to fix the db entry and retry
-				infoErrorMessage := broker.InfoError{
-					Error:           "Getheader failed",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
+			}
 
-				body, _ := json.Marshal(infoErrorMessage)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to Ack message, reason: (%s)", err.Error())
+			}
 
-				// Send the message to an error queue so it can be analyzed.
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-					log.Errorf("failed to publish message, reason: (%s)", err.Error())
-				}
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.InfoError{
+				Error:           "Failed to get archived file size",
+				Reason:          err.Error(),
+				OriginalMessage: message,
+			}
+			body, _ := json.Marshal(fileError)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("failed to publish message, reason: (%s)", err.Error())
+			}
 
-				continue
+			continue
+		}
+
+		archiveFileHash := sha256.New()
+		f, err := archive.NewFileReader(message.ArchivePath)
+		if err != nil {
+			log.Errorf("Failed to open archived file, reson: %v ", err.Error())
+			// Send the message to an error queue so it can be analyzed.
+			infoErrorMessage := broker.InfoError{
+				Error:           "Failed to open archived file",
+				Reason:          err.Error(),
+				OriginalMessage: message,
 			}
 
-			var file database.FileInfo
-			file.Size, err = archive.GetFileSize(message.ArchivePath)
-			if err != nil { //nolint:nestif
-				log.Errorf("Failed to get archived file size, reson: (%s)", err.Error())
-				if strings.Contains(err.Error(), "no such file or directory") || strings.Contains(err.Error(), "NoSuchKey:") || strings.Contains(err.Error(), "NotFound:") {
-					jsonMsg, _ := json.Marshal(map[string]string{"error": err.Error()})
-					if err := db.UpdateFileEventLog(message.FileID, "error", delivered.CorrelationId, "verify", string(jsonMsg), string(delivered.Body)); err != nil {
-						log.Errorf("failed to set ingestion status for file from message: %v", delivered.CorrelationId)
-					}
-				}
+			body, _ := json.Marshal(infoErrorMessage)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("failed to publish message, reason: (%s)", err.Error())
+			}
+			if err := mq.RetryLater(conf.Broker.Queue, delivered); err != nil {
+				log.Errorf("failed to retry message, reason: (%s)", err.Error())
+			}
 
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed to Ack message, reason: (%s)", err.Error())
-				}
+			// Restart on new message
+			continue
+		}
 
-				// Send the message to an error queue so it can be analyzed.
-				fileError := broker.InfoError{
-					Error:           "Failed to get archived file size",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
-				body, _ := json.Marshal(fileError)
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-					log.Errorf("failed to publish message, reason: (%s)", err.Error())
-				}
+		var key *[32]byte
+		for _, k := range archiveKeyList {
+			size, err := headers.EncryptedSegmentSize(header, *k)
+			if (err == nil) && (size != 0) {
+				key = k
 
-				continue
+				break
 			}
+		}
 
-			archiveFileHash := sha256.New()
-			f, err := archive.NewFileReader(message.ArchivePath)
-			if err != nil {
-				log.Errorf("Failed to open archived file, reson: %v ", err.Error())
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Failed to open archived file",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
+		if key == nil {
+			log.Errorf("no matching key found for file: %s.", message.ArchivePath)
 
-				body, _ := json.Marshal(infoErrorMessage)
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-					log.Errorf("failed to publish message, reason: (%s)", err.Error())
-				}
+			continue
+		}
 
-				// Restart on new message
-				continue
+		mr := io.MultiReader(bytes.NewReader(header), io.TeeReader(f, archiveFileHash))
+		c4ghr, err := streaming.NewCrypt4GHReader(mr, *key, nil)
+		if err != nil {
+			log.Errorf("failed to open c4gh decryptor stream, reson: %s", err.Error())
+
+			continue
+		}
+
+		md5hash := md5.New() // #nosec
+		sha256hash := sha256.New()
+		stream := io.TeeReader(c4ghr, md5hash)
+		session := validators.NewSession(context.Background(), &validator.FileContext{
+			FileId:   message.FileID,
+			User:     message.User,
+			Filepath: message.FilePath,
+			CorrId:   delivered.CorrelationId,
+		})
+
+		if file.DecryptedSize, err = io.Copy(io.MultiWriter(sha256hash, session), stream); err != nil {
+			session.Abort()
+			log.Errorf("failed to copy decrypted data, reson: (%s)", err.Error())
+
+			// Send the message to an error queue so it can be analyzed.
+			infoErrorMessage := broker.InfoError{
+				Error:           "Failed to verify archived file",
+				Reason:          err.Error(),
+				OriginalMessage: message,
 			}
 
-			var key *[32]byte
-			for _, k := range archiveKeyList {
-				size, err := headers.EncryptedSegmentSize(header, *k)
-				if (err == nil) && (size != 0) {
-					key = k
+			body, _ := json.Marshal(infoErrorMessage)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("Failed to publish error message: (%s)", err.Error())
+			}
 
-					break
-				}
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack message: (%s)", err.Error())
 			}
 
-			if key == nil {
-				log.Errorf("no matching key found for file: %s.", message.ArchivePath)
+			continue
+		}
 
-				continue
+		if err := session.Close(); err != nil {
+			log.Errorf("validation of file: %s failed, reason: (%s)", message.FilePath, err.Error())
+			jsonMsg, _ := json.Marshal(map[string]string{"error": err.Error()})
+			if err := db.SetFileStatus(message.FileID, "", "error", delivered.CorrelationId, "verify", string(jsonMsg), string(delivered.Body)); err != nil {
+				log.Errorf("failed to set error status for file from message: %v", delivered.CorrelationId)
 			}
 
-			mr := io.MultiReader(bytes.NewReader(header), io.TeeReader(f, archiveFileHash))
-			c4ghr, err := streaming.NewCrypt4GHReader(mr, *key, nil)
-			if err != nil {
-				log.Errorf("failed to open c4gh decryptor stream, reson: %s", err.Error())
+			// Send the message to an error queue so it can be analyzed.
+			infoErrorMessage := broker.InfoError{
+				Error:           "File rejected by validator plugins",
+				Reason:          err.Error(),
+				OriginalMessage: message,
+			}
 
-				continue
+			body, _ := json.Marshal(infoErrorMessage)
+			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+				log.Errorf("Failed to publish error message: (%s)", err.Error())
 			}
 
-			md5hash := md5.New() // #nosec
-			sha256hash := sha256.New()
-			stream := io.TeeReader(c4ghr, md5hash)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack message: (%s)", err.Error())
+			}
 
-			if file.DecryptedSize, err = io.Copy(sha256hash, stream); err != nil {
-				log.Errorf("failed to copy decrypted data, reson: (%s)", err.Error())
+			continue
+		}
 
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Failed to verify archived file",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
+		// At this point we should do checksum comparison
 
-				body, _ := json.Marshal(infoErrorMessage)
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-					log.Errorf("Failed to publish error message: (%s)", err.Error())
-				}
+		file.Checksum = fmt.Sprintf("%x", archiveFileHash.Sum(nil))
+		file.DecryptedChecksum = fmt.Sprintf("%x", sha256hash.Sum(nil))
+		file.DecryptedChecksums = map[string]string{"md5": fmt.Sprintf("%x", md5hash.Sum(nil))}
 
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed to ack message: (%s)", err.Error())
+		switch {
+		case message.ReVerify:
+			decrypted, err := db.GetDecryptedChecksum(message.FileID)
+			if err != nil {
+				log.Errorf("failed to get unencrypted checksum for file: %s, reson: %s", message.FilePath, err.Error())
+				if err := delivered.Nack(false, true); err != nil {
+					log.Errorf("failed to Nack message, reason: (%s)", err.Error())
 				}
 
 				continue
 			}
 
-			// At this point we should do checksum comparison
-
-			file.Checksum = fmt.Sprintf("%x", archiveFileHash.Sum(nil))
-			file.DecryptedChecksum = fmt.Sprintf("%x", sha256hash.Sum(nil))
-
-			switch {
-			case message.ReVerify:
-				decrypted, err := db.GetDecryptedChecksum(message.FileID)
-				if err != nil {
-					log.Errorf("failed to get unencrypted checksum for file: %s, reson: %s", message.FilePath, err.Error())
+			if file.DecryptedChecksum != decrypted {
+				log.Errorf("encrypted checksum don't match for file: %s", message.FilePath)
+				if err := db.SetFileStatus(message.FileID, "", "error", delivered.CorrelationId, "verify", `{"error":"decrypted checksum don't match"}`, string(delivered.Body)); err != nil {
+					log.Errorf("set status ready failed, reason: (%v)", err)
 					if err := delivered.Nack(false, true); err != nil {
-						log.Errorf("failed to Nack message, reason: (%s)", err.Error())
+						log.Errorf("failed to Nack message, reason: (%v)", err)
 					}
 
 					continue
 				}
+				if err := delivered.Ack(false); err != nil {
+					log.Errorf("Failed to ack message: (%s)", err.Error())
+				}
 
-				if file.DecryptedChecksum != decrypted {
-					log.Errorf("encrypted checksum don't match for file: %s", message.FilePath)
-					if err := db.UpdateFileEventLog(message.FileID, "error", delivered.CorrelationId, "verify", `{"error":"decrypted checksum don't match"}`, string(delivered.Body)); err != nil {
-						log.Errorf("set status ready failed, reason: (%v)", err)
-						if err := delivered.Nack(false, true); err != nil {
-							log.Errorf("failed to Nack message, reason: (%v)", err)
-						}
+				continue
+			}
 
-						continue
-					}
-					if err := delivered.Ack(false); err != nil {
-						log.Errorf("Failed to ack message: (%s)", err.Error())
+			if file.Checksum != message.EncryptedChecksums[0].Value {
+				log.Errorf("encrypted checksum don't match for file: %s, expected %s, got %s", message.FilePath, message.EncryptedChecksums[0].Value, file.Checksum)
+				if err := db.SetFileStatus(message.FileID, "", "error", delivered.CorrelationId, "verify", `{"error":"encrypted checksum don't match"}`, string(delivered.Body)); err != nil {
+					log.Errorf("set status ready failed, reason: (%v)", err)
+					if err := delivered.Nack(false, true); err != nil {
+						log.Errorf("failed to Nack message, reason: (%v)", err)
 					}
 
 					continue
 				}
+			}
 
-				if file.Checksum != message.EncryptedChecksums[0].Value {
-					log.Errorf("encrypted checksum don't match for file: %s, expected %s, got %s", message.FilePath, message.EncryptedChecksums[0].Value, file.Checksum)
-					if err := db.UpdateFileEventLog(message.FileID, "error", delivered.CorrelationId, "verify", `{"error":"encrypted checksum don't match"}`, string(delivered.Body)); err != nil {
-						log.Errorf("set status ready failed, reason: (%v)", err)
-						if err := delivered.Nack(false, true); err != nil {
-							log.Errorf("failed to Nack message, reason: (%v)", err)
-						}
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack message: (%s)", err.Error())
+			}
 
-						continue
-					}
-				}
+			continue
+		default:
+			c := schema.IngestionAccessionRequest{
+				User:     message.User,
+				FilePath: message.FilePath,
+				DecryptedChecksums: []schema.Checksums{
+					{Type: "sha256", Value: fmt.Sprintf("%x", sha256hash.Sum(nil))},
+					{Type: "md5", Value: fmt.Sprintf("%x", md5hash.Sum(nil))},
+				},
+			}
 
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed to ack message: (%s)", err.Error())
-				}
+			verifiedMessage, _ := json.Marshal(&c)
+			err = schema.ValidateJSON(fmt.Sprintf("%s/ingestion-accession-request.json", conf.Broker.SchemasPath), verifiedMessage)
+			if err != nil {
+				log.Errorf("Validation of outgoing (ingestion-accession-request) failed, reason: (%s)", err.Error())
 
+				// Logging is in ValidateJSON so just restart on new message
 				continue
-			default:
-				c := schema.IngestionAccessionRequest{
-					User:     message.User,
-					FilePath: message.FilePath,
-					DecryptedChecksums: []schema.Checksums{
-						{Type: "sha256", Value: fmt.Sprintf("%x", sha256hash.Sum(nil))},
-						{Type: "md5", Value: fmt.Sprintf("%x", md5hash.Sum(nil))},
-					},
+			}
+			status, err := db.GetFileStatus(delivered.CorrelationId)
+			if err != nil {
+				log.Errorf("failed to get file status, reason: (%s)", err.Error())
+				// Send the message to an error queue so it can be analyzed.
+				infoErrorMessage := broker.InfoError{
+					Error:           "Getheader failed",
+					Reason:          err.Error(),
+					OriginalMessage: message,
 				}
 
-				verifiedMessage, _ := json.Marshal(&c)
-				err = schema.ValidateJSON(fmt.Sprintf("%s/ingestion-accession-request.json", conf.Broker.SchemasPath), verifiedMessage)
-				if err != nil {
-					log.Errorf("Validation of outgoing (ingestion-accession-request) failed, reason: (%s)", err.Error())
+				body, _ := json.Marshal(infoErrorMessage)
+				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
+					log.Errorf("failed to publish message, reason: (%s)", err.Error())
+				}
 
-					// Logging is in ValidateJSON so just restart on new message
-					continue
+				if err := delivered.Ack(false); err != nil {
+					log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
 				}
-				status, err := db.GetFileStatus(delivered.CorrelationId)
-				if err != nil {
-					log.Errorf("failed to get file status, reason: (%s)", err.Error())
-					// Send the message to an error queue so it can be analyzed.
-					infoErrorMessage := broker.InfoError{
-						Error:           "Getheader failed",
-						Reason:          err.Error(),
-						OriginalMessage: message,
-					}
 
-					body, _ := json.Marshal(infoErrorMessage)
-					if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, "error", body); err != nil {
-						log.Errorf("failed to publish message, reason: (%s)", err.Error())
-					}
+				continue
+			}
+			switch status {
+			case "disabled":
+				log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
+				if err := delivered.Ack(false); err != nil {
+					log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
+				}
 
-					if err := delivered.Ack(false); err != nil {
-						log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
+				continue
+			case "enabled":
+				fileInfo, err := db.GetFileInfo(message.FileID)
+				if err != nil {
+					log.Errorf("failed to get info for file: %s", message.FileID)
+					if err := delivered.Nack(false, true); err != nil {
+						log.Errorf("failed to Nack message, reason: (%s)", err.Error())
 					}
 
 					continue
 				}
-				switch status {
-				case "disabled":
-					log.Infof("file with correlation ID: %s is disabled, stopping verification", delivered.CorrelationId)
-					if err := delivered.Ack(false); err != nil {
-						log.Errorf("Failed acking canceled work, reason: (%s)", err.Error())
-					}
 
-					continue
-				case "enabled":
-					fileInfo, err := db.GetFileInfo(message.FileID)
-					if err != nil {
-						log.Errorf("failed to get info for file: %s", message.FileID)
+				if fileInfo.DecryptedChecksum != "" {
+					log.Debugln("file already verified")
+					if err := mq.SendMessageContext(traceCtx, delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, verifiedMessage); err != nil {
+						log.Errorf("failed to publish message, reason: (%s)", err.Error())
 						if err := delivered.Nack(false, true); err != nil {
 							log.Errorf("failed to Nack message, reason: (%s)", err.Error())
 						}
@@ -364,48 +429,51 @@ func main() {
 						continue
 					}
 
-					if fileInfo.DecryptedChecksum != "" {
-						log.Debugln("file already verified")
-						if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, verifiedMessage); err != nil {
-							log.Errorf("failed to publish message, reason: (%s)", err.Error())
-							if err := delivered.Nack(false, true); err != nil {
-								log.Errorf("failed to Nack message, reason: (%s)", err.Error())
-							}
-
-							continue
-						}
-
-						if err := delivered.Ack(false); err != nil {
-							log.Errorf("failed to Ack message, reason: (%s)", err.Error())
-						}
-
-						continue
-					}
-				}
-
-				if err := db.SetVerified(file, message.FileID, delivered.CorrelationId); err != nil {
-					log.Errorf("SetVerified failed, reason: (%s)", err.Error())
-					if err := delivered.Nack(false, true); err != nil {
-						log.Errorf("failed to Nack message, reason: (%s)", err.Error())
+					if err := delivered.Ack(false); err != nil {
+						log.Errorf("failed to Ack message, reason: (%s)", err.Error())
 					}
 
 					continue
 				}
+			}
 
-				// Send message to verified queue
-				if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, verifiedMessage); err != nil {
-					// TODO fix resend mechanism
-					log.Errorf("failed to publish message, reason: (%s)", err.Error())
-
-					continue
+			// the duplicate event goes before the verified one, leaving the file status as verified
+			expected := status
+			duplicates, err := db.FlagDuplicateSubmission(message.FileID, file.DecryptedChecksum, delivered.CorrelationId)
+			if err != nil {
+				log.Errorf("failed to check for duplicate submissions, reason: (%s)", err.Error())
+			}
+			if len(duplicates) > 0 {
+				log.Warnf("file %s of user %s is identical to the already submitted files: %s", message.FilePath, message.User, strings.Join(duplicates, ", "))
+				if err == nil && db.Version >= 32 {
+					expected = "duplicate"
 				}
+			}
 
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("failed to Ack message, reason: (%s)", err.Error())
+			if err := db.SetVerified(file, message.FileID, expected, delivered.CorrelationId); err != nil {
+				log.Errorf("SetVerified failed, reason: (%s)", err.Error())
+				// a file whose status was changed, e.g. that was disabled, is not verified
+				var transitionErr *database.TransitionError
+				if err := delivered.Nack(false, !errors.As(err, &transitionErr)); err != nil {
+					log.Errorf("failed to Nack message, reason: (%s)", err.Error())
 				}
+
+				continue
+			}
+
+			// Send message to verified queue
+			if err := mq.SendMessageContext(traceCtx, delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, verifiedMessage); err != nil {
+				// TODO fix resend mechanism
+				log.Errorf("failed to publish message, reason: (%s)", err.Error())
+
+				continue
+			}
+
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("failed to Ack message, reason: (%s)", err.Error())
 			}
 		}
-	}()
+	}
 
-	<-forever
+	return errors.New("delivery channel closed")
 }
@@ -4,24 +4,72 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
 )
 
+// Broker publishes and consumes the messages between the services. The
+// deliveries of all implementations are amqp.Delivery values, so that they
+// are acknowledged the same way whichever message bus is used.
+type Broker interface {
+	SendMessage(corrID, exchange, routingKey string, body []byte) error
+	SendMessages(messages []Message) error
+	Subscribe(ctx context.Context, queue string) (<-chan amqp.Delivery, error)
+	Close()
+}
+
+var (
+	_ Broker = (*AMQPBroker)(nil)
+	_ Broker = (*JetStreamBroker)(nil)
+)
+
+// New connects to the message bus given by config.Type, RabbitMQ unless it
+// is "nats"
+func New(config MQConf) (Broker, error) {
+	if config.Type == "nats" {
+		return NewJetStream(config)
+	}
+
+	return NewMQ(config)
+}
+
 // AMQPBroker is a Broker that reads messages from an AMQP broker
 type AMQPBroker struct {
-	Connection   *amqp.Connection
-	Channel      *amqp.Channel
-	Conf         MQConf
-	confirmsChan <-chan amqp.Confirmation
+	// Connection and Channel are replaced when the broker reconnects, use
+	// Current to get them while the broker is in use
+	Connection *amqp.Connection
+	Channel    *amqp.Channel
+	Conf       MQConf
+	// endpoint is the index of the connected host in the list of endpoints
+	endpoint int
+	// mu guards Connection, Channel and endpoint
+	mu sync.RWMutex
+	// reconnecting serialises the replacement of the connection and channel
+	reconnecting sync.Mutex
+	// OnQuarantine is called with the queue and the message when a message
+	// has been quarantined, e.g. to record an error for the file
+	OnQuarantine func(queue string, delivery amqp.Delivery)
+	// Dedup makes Subscribe drop the messages that were processed before,
+	// a message counts as processed once it has been acknowledged
+	Dedup Deduplicator
 }
 
+// publishTimeout is how long a publish may wait for the broker to confirm
+// the message
+const publishTimeout = 30 * time.Second
+
 // MQConf stores information about the message broker
 type MQConf struct {
+	// Type is the message bus, "rabbitmq" or "nats" for NATS JetStream
+	Type          string
 	Host          string
 	Port          int
 	User          string
@@ -38,6 +86,86 @@ type MQConf struct {
 	ServerName    string
 	SchemasPath   string
 	PrefetchCount int
+	// ManagementURL is the base URL of the RabbitMQ management API
+	ManagementURL string
+	// StandbyHosts are connected to, in order, when Host can not be
+	// reached. Each one is given as host or host:port, Port is used when
+	// the port is left out.
+	StandbyHosts []string
+	// FailbackInterval is how often Host is checked while connected to a
+	// standby host, 0 disables the check
+	FailbackInterval time.Duration
+	// PublishRetries is how many times a message that is not confirmed by
+	// the broker is published again before giving up
+	PublishRetries int
+	// SpoolDir is where messages are kept when they can not be published,
+	// they are published again on the next connection. Unpublished messages
+	// are returned as errors when it is empty.
+	SpoolDir string
+	// DeadLetterExchange is the exchange that the queues declared by the
+	// service send rejected messages to, each queue gets a dead letter
+	// queue named after it with the ".dead" suffix
+	DeadLetterExchange string
+	// DeliveryLimit is how many times a message is delivered before it is
+	// dead-lettered, 0 means without limit. It needs quorum queues, since
+	// only they count deliveries.
+	DeliveryLimit int
+	// QuarantineAfter is how many times a message is delivered before it
+	// is parked in the quarantine queue of its queue, 0 means without
+	// limit. Unlike DeliveryLimit it works on classic queues as well.
+	QuarantineAfter int
+	// MaxPriority is the highest message priority of the classic queues
+	// declared by the service, 0 declares them without priorities. Existing
+	// queues keep the priorities they were declared with.
+	MaxPriority int
+	// QueueType is the type of the queues declared by the service,
+	// "classic" or "quorum". When it is empty the queues are quorum queues
+	// if DeliveryLimit is set and classic queues otherwise. Only an explicit
+	// "quorum" also declares the dead letter and quarantine queues as quorum
+	// queues, so that they are replicated in clusters.
+	QueueType string
+	// LazyQueues declares the classic queues in lazy mode, which keeps
+	// their messages on disk instead of in memory
+	LazyQueues bool
+	// MaxLength is how many messages the declared queues hold, 0 means
+	// without limit. Overflow decides what happens to further messages.
+	MaxLength int
+	// Overflow is "drop-head", "reject-publish" or "reject-publish-dlx",
+	// the broker default drop-head is used when it is empty
+	Overflow string
+	// Exchanges are exchanges by name, a message published to one of the
+	// names is published to the exchange with that name
+	Exchanges map[string]string
+	// Routes lists the named exchanges that the messages to Exchange are
+	// published to instead, by routing key, e.g. to publish the messages
+	// for CentralEGA to a local exchange as well
+	Routes map[string][]string
+	// Dedup is where the processed messages are remembered, "memory" or
+	// "database", so that redelivered messages are not processed again.
+	// Messages are not deduplicated when it is empty.
+	Dedup string
+	// DedupTTL is how long a processed message is remembered
+	DedupTTL time.Duration
+	// RetryDelay is how long RetryLater waits before a message is delivered
+	// again, 0 requeues it right away
+	RetryDelay time.Duration
+	// Stream is the JetStream stream holding the messages when Type is
+	// "nats"
+	Stream string
+}
+
+// endpoints returns the broker addresses in the order they are tried, the
+// primary host first
+func (config MQConf) endpoints() []string {
+	endpoints := []string{net.JoinHostPort(config.Host, strconv.Itoa(config.Port))}
+	for _, h := range config.StandbyHosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, strconv.Itoa(config.Port))
+		}
+		endpoints = append(endpoints, h)
+	}
+
+	return endpoints
 }
 
 // InfoError struct for sending detailed error messages to analysis.
@@ -114,35 +242,68 @@ func TLSConfigBroker(config MQConf) (*tls.Config, error) {
 }
 
 // NewMQ creates a new Broker that can communicate with a backend amqp server.
+// The hosts are tried in order, starting with the primary one, until a
+// connection is made.
 func NewMQ(config MQConf) (*AMQPBroker, error) {
-	brokerURI := buildMQURI(config.Host, config.User, config.Password, config.Vhost, config.Port, config.Ssl)
+	connection, channel, endpoint, err := connect(config)
+	if err != nil {
+		return nil, err
+	}
 
-	var connection *amqp.Connection
-	var err error
+	broker := &AMQPBroker{Connection: connection, Channel: channel, Conf: config, endpoint: endpoint}
+	if err := broker.RepublishSpooled(); err != nil {
+		log.Errorf("failed to publish spooled messages, reason: %v", err)
+	}
 
-	log.Debugf("Connecting to broker host: %s:%d vhost: %s with user: %s", config.Host, config.Port, config.Vhost, config.User)
-	if config.Ssl {
-		var tlsConfig *tls.Config
-		tlsConfig, err = TLSConfigBroker(config)
-		if err != nil {
-			return nil, err
+	return broker, nil
+}
+
+// connect connects to the first host that can be reached and opens a
+// channel on the connection
+func connect(config MQConf) (*amqp.Connection, *amqp.Channel, int, error) {
+	var connection *amqp.Connection
+	var endpoint int
+	var errs []error
+	for i, address := range config.endpoints() {
+		c, err := dial(config, address)
+		if err == nil {
+			connection, endpoint = c, i
+			if i > 0 {
+				log.Warnf("connected to standby broker %s", address)
+			}
+
+			break
 		}
-		connection, err = amqp.DialTLS(brokerURI, tlsConfig)
-	} else {
-		connection, err = amqp.Dial(brokerURI)
+		log.Warnf("failed to connect to broker %s, reason: %v", address, err)
+		errs = append(errs, err)
 	}
+	if connection == nil {
+		if len(errs) == 1 {
+			return nil, nil, 0, errs[0]
+		}
+
+		return nil, nil, 0, fmt.Errorf("no broker host could be reached: %w", errors.Join(errs...))
+	}
+
+	channel, err := openChannel(connection, config)
 	if err != nil {
-		return nil, err
+		connection.Close()
+
+		return nil, nil, 0, err
 	}
 
+	return connection, channel, endpoint, nil
+}
+
+// openChannel opens a channel in confirm mode with the configured prefetch
+// count
+func openChannel(connection *amqp.Connection, config MQConf) (*amqp.Channel, error) {
 	channel, err := connection.Channel()
 	if err != nil {
 		return nil, err
 	}
 
 	if e := channel.Confirm(false); e != nil {
-		fmt.Printf("channel could not be put into confirm mode: %s", e)
-
 		return nil, fmt.Errorf("channel could not be put into confirm mode: %s", e)
 	}
 
@@ -154,29 +315,98 @@ func NewMQ(config MQConf) (*AMQPBroker, error) {
 		}
 	}
 
-	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return channel, nil
+}
+
+// dial connects to the broker at address, given as host:port
+func dial(config MQConf, address string) (*amqp.Connection, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+	brokerURI := buildMQURI(host, config.User, config.Password, config.Vhost, port, config.Ssl)
+
+	log.Debugf("Connecting to broker host: %s:%d vhost: %s with user: %s", host, port, config.Vhost, config.User)
+	if !config.Ssl {
+		return amqp.Dial(brokerURI)
+	}
+
+	tlsConfig, err := TLSConfigBroker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return amqp.DialTLS(brokerURI, tlsConfig)
+}
+
+// Current returns the connection and the channel in use
+func (broker *AMQPBroker) Current() (*amqp.Connection, *amqp.Channel) {
+	broker.mu.RLock()
+	defer broker.mu.RUnlock()
+
+	return broker.Connection, broker.Channel
+}
+
+// channel returns the channel in use
+func (broker *AMQPBroker) channel() *amqp.Channel {
+	_, channel := broker.Current()
+
+	return channel
+}
+
+// replace puts a new connection and channel in use, connected to the host
+// of the endpoint, and returns the old connection
+func (broker *AMQPBroker) replace(connection *amqp.Connection, channel *amqp.Channel, endpoint int) *amqp.Connection {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	old := broker.Connection
+	broker.Connection, broker.Channel, broker.endpoint = connection, channel, endpoint
+
+	return old
+}
+
+// OnStandby reports whether the broker is connected to a standby host
+func (broker *AMQPBroker) OnStandby() bool {
+	broker.mu.RLock()
+	defer broker.mu.RUnlock()
+
+	return broker.endpoint > 0
+}
+
+// PrimaryAvailable reports whether the primary host accepts connections
+// again, it only checks that the port is open
+func (broker *AMQPBroker) PrimaryAvailable() bool {
+	conn, err := net.DialTimeout("tcp", broker.Conf.endpoints()[0], 5*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
 
-	return &AMQPBroker{connection, channel, config, confirms}, nil
+	return true
 }
 
 // ConnectionWatcher listens to events from the server
 func (broker *AMQPBroker) ConnectionWatcher() *amqp.Error {
-	amqpError := <-broker.Connection.NotifyClose(make(chan *amqp.Error))
+	connection, _ := broker.Current()
+	amqpError := <-connection.NotifyClose(make(chan *amqp.Error))
 
 	return amqpError
 }
 
 func (broker *AMQPBroker) ChannelWatcher() *amqp.Error {
-	amqpError := <-broker.Channel.NotifyClose(make(chan *amqp.Error))
+	amqpError := <-broker.channel().NotifyClose(make(chan *amqp.Error))
 
 	return amqpError
 }
 
 // GetMessages reads messages from the queue
 func (broker *AMQPBroker) GetMessages(queue string) (<-chan amqp.Delivery, error) {
-	ch := broker.Channel
-
-	return ch.Consume(
+	return broker.channel().Consume(
 		queue, // queue
 		"",    // consumer
 		false, // auto-ack
@@ -187,62 +417,221 @@ func (broker *AMQPBroker) GetMessages(queue string) (<-chan amqp.Delivery, error
 	)
 }
 
-// SendMessage sends a message to RabbitMQ
+// Message is a message to publish with SendMessages
+type Message struct {
+	CorrID     string `json:"correlationID"`
+	Exchange   string `json:"exchange"`
+	RoutingKey string `json:"routingKey"`
+	Body       []byte `json:"body"`
+	// Priority puts the message ahead of those with lower priorities on
+	// queues declared with priorities
+	Priority uint8 `json:"priority,omitempty"`
+	// Traceparent is the W3C trace context the message is published in
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+// SendMessage sends a message to RabbitMQ and waits for the broker to
+// confirm it. Messages that are not confirmed are published again, on a new
+// channel if the old one was closed, up to Conf.PublishRetries times. When
+// that fails as well the message is spooled to Conf.SpoolDir, if set, and
+// published when the broker is connected again.
 func (broker *AMQPBroker) SendMessage(corrID, exchange, routingKey string, body []byte) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	return broker.SendMessages([]Message{{CorrID: corrID, Exchange: exchange, RoutingKey: routingKey, Body: body}})
+}
 
-	err := broker.Channel.PublishWithContext(
-		ctx,
-		exchange,
-		routingKey,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentEncoding: "UTF-8",
-			ContentType:     "application/json",
-			DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
-			CorrelationId:   corrID,
-			Priority:        0, // 0-9
-			Body:            body,
-			Timestamp:       time.Now(),
-			// a bunch of application/implementation-specific fields
-		},
-	)
-	if err != nil {
+// SendPriorityMessage is SendMessageContext for a message with a priority,
+// which is ignored by queues declared without priorities
+func (broker *AMQPBroker) SendPriorityMessage(ctx context.Context, corrID, exchange, routingKey string, priority uint8, body []byte) error {
+	return broker.SendMessages([]Message{{CorrID: corrID, Exchange: exchange, RoutingKey: routingKey, Body: body, Priority: priority, Traceparent: traceparent(ctx)}})
+}
+
+// SendMessages publishes the messages, in order, on the channel of the
+// broker and waits once for the broker to confirm all of them, which is much
+// faster than sending them one by one. The messages are sent to the
+// exchanges given by Conf.Exchanges and Conf.Routes. The messages that are
+// not confirmed are retried and spooled like with SendMessage.
+func (broker *AMQPBroker) SendMessages(messages []Message) error {
+	messages = broker.Conf.route(messages)
+	failed, err := broker.publish(messages)
+	for attempt := 1; len(failed) > 0 && attempt <= broker.Conf.PublishRetries; attempt++ {
+		log.Warnf("failed to publish %d of %d messages, attempt %d of %d, reason: %v", len(failed), len(messages), attempt, broker.Conf.PublishRetries, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+
+		if broker.IsChannelClosed() && !broker.IsConnClosed() {
+			if e := broker.CreateNewChannel(); e != nil {
+				log.Errorf("failed to open a new channel, reason: %v", e)
+			}
+		}
+		failed, err = broker.publish(failed)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if broker.Conf.SpoolDir == "" {
 		return err
 	}
 
-	confirmed := <-broker.confirmsChan
-	if !confirmed.Ack {
-		return fmt.Errorf("failed delivery of delivery tag: %d", confirmed.DeliveryTag)
+	for i, msg := range failed {
+		if e := broker.spool(msg); e != nil {
+			return fmt.Errorf("failed to publish %d messages: %v, and to spool %d of them: %v", len(failed), err, len(failed)-i, e)
+		}
+		spooledTotal.Inc(msg.RoutingKey)
+		log.Warnf("spooled message with correlation ID %s until the broker can be reached, reason: %v", msg.CorrID, err)
 	}
-	log.Debugf("confirmed delivery with delivery tag: %d", confirmed.DeliveryTag)
 
 	return nil
 }
 
+// publish publishes the messages once and waits for them to be confirmed.
+// It returns the messages that were not confirmed, in order, and the first
+// error.
+func (broker *AMQPBroker) publish(messages []Message) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	var firstErr error
+	start := time.Now()
+	channel := broker.channel()
+	confirmations := make([]*amqp.DeferredConfirmation, 0, len(messages))
+	for _, msg := range messages {
+		headers := amqp.Table{}
+		if msg.Traceparent != "" {
+			headers[traceHeader] = msg.Traceparent
+		}
+		confirmation, err := channel.PublishWithDeferredConfirmWithContext(
+			ctx,
+			msg.Exchange,
+			msg.RoutingKey,
+			false, // mandatory
+			false, // immediate
+			amqp.Publishing{
+				Headers:         headers,
+				ContentEncoding: "UTF-8",
+				ContentType:     "application/json",
+				DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
+				CorrelationId:   msg.CorrID,
+				Priority:        msg.Priority, // 0-9
+				Body:            msg.Body,
+				Timestamp:       time.Now(),
+				// a bunch of application/implementation-specific fields
+			},
+		)
+		if err != nil {
+			firstErr = err
+
+			break
+		}
+		publishedTotal.Inc(msg.RoutingKey)
+		confirmations = append(confirmations, confirmation)
+	}
+
+	var failed []Message
+	for i, confirmation := range confirmations {
+		if confirmation == nil {
+			// the channel is not in confirm mode
+			continue
+		}
+
+		confirmed, err := confirmation.WaitContext(ctx)
+		observeConfirm(messages[i].RoutingKey, err == nil && confirmed, start)
+		switch {
+		case err != nil:
+			err = fmt.Errorf("no confirmation of delivery tag %d: %v", confirmation.DeliveryTag, err)
+		case !confirmed:
+			err = fmt.Errorf("failed delivery of delivery tag: %d", confirmation.DeliveryTag)
+		default:
+			log.Debugf("confirmed delivery with delivery tag: %d", confirmation.DeliveryTag)
+
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed = append(failed, messages[i])
+	}
+	// the messages after a failed publish were never sent
+	failed = append(failed, messages[len(confirmations):]...)
+
+	return failed, firstErr
+}
+
 func (broker *AMQPBroker) CreateNewChannel() error {
-	c, err := broker.Connection.Channel()
+	connection, _ := broker.Current()
+	c, err := openChannel(connection, broker.Conf)
 	if err != nil {
 		return err
 	}
 
-	confirmsChan := make(chan amqp.Confirmation, 1)
-	if err := c.Confirm(false); err != nil {
-		close(confirmsChan)
+	log.Debugln("reconnected to new channel")
+	broker.mu.Lock()
+	broker.Channel = c
+	broker.mu.Unlock()
+
+	return nil
+}
+
+// Reconnect replaces the connection or channel when they have been closed,
+// retrying with an increasing delay until it succeeds or ctx is cancelled.
+// The spooled messages are published once a new connection is made.
+func (broker *AMQPBroker) Reconnect(ctx context.Context) error {
+	for delay := time.Second; ; delay = min(2*delay, 30*time.Second) {
+		err := broker.reconnect()
+		if err == nil {
+			return nil
+		}
+		log.Warnf("failed to reconnect to the broker, retrying in %v, reason: %v", delay, err)
 
-		return fmt.Errorf("channel could not be put into confirm mode: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
 	}
+}
+func (broker *AMQPBroker) reconnect() error {
+	broker.reconnecting.Lock()
+	defer broker.reconnecting.Unlock()
 
-	log.Debugln("reconnected to new channel")
-	broker.Channel = c
-	broker.confirmsChan = c.NotifyPublish(confirmsChan)
+	if !broker.IsConnClosed() {
+		if !broker.IsChannelClosed() {
+			return nil
+		}
+
+		return broker.CreateNewChannel()
+	}
+
+	connection, channel, endpoint, err := connect(broker.Conf)
+	if err != nil {
+		return err
+	}
+	broker.replace(connection, channel, endpoint)
+	log.Info("reconnected to the broker")
+
+	if err := broker.RepublishSpooled(); err != nil {
+		log.Errorf("failed to publish spooled messages, reason: %v", err)
+	}
 
 	return nil
 }
 
 func (broker *AMQPBroker) IsConnClosed() bool {
-	return broker.Connection.IsClosed()
+	connection, _ := broker.Current()
+
+	return connection.IsClosed()
+}
+
+// IsChannelClosed reports whether the channel in use has been closed
+func (broker *AMQPBroker) IsChannelClosed() bool {
+	return broker.channel().IsClosed()
+}
+
+// Close closes the channel and the connection to the broker
+func (broker *AMQPBroker) Close() {
+	connection, channel := broker.Current()
+	if channel != nil {
+		channel.Close()
+	}
+	if connection != nil {
+		connection.Close()
+	}
 }
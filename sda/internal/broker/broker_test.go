@@ -6,12 +6,16 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/neicnordic/sensitive-data-archive/internal/helper"
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+	"github.com/neicnordic/sensitive-data-archive/internal/tracing"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
@@ -26,7 +30,7 @@ type BrokerTestSuite struct {
 	suite.Suite
 }
 
-var mqPort, tlsPort int
+var mqPort, tlsPort, natsPort int
 var certPath string
 var tMqconf = MQConf{}
 
@@ -96,12 +100,30 @@ func TestMain(m *testing.M) {
 		log.Panicf("Could not connect to rabbitmq: %s", err)
 	}
 
+	nats, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "nats",
+		Tag:        "2.10-alpine",
+		Cmd:        []string{"-js"},
+	}, func(config *docker.HostConfig) {
+		config.AutoRemove = true
+		config.RestartPolicy = docker.RestartPolicy{
+			Name: "no",
+		}
+	})
+	if err != nil {
+		log.Panicf("Could not start resource: %s", err)
+	}
+	natsPort, _ = strconv.Atoi(nats.GetPort("4222/tcp"))
+
 	code := m.Run()
 
 	log.Println("tests completed")
 	if err := pool.Purge(rabbitmq); err != nil {
 		log.Panicf("Could not purge resource: %s", err)
 	}
+	if err := pool.Purge(nats); err != nil {
+		log.Panicf("Could not purge resource: %s", err)
+	}
 
 	os.RemoveAll(certPath)
 	os.Exit(code)
@@ -109,22 +131,19 @@ func TestMain(m *testing.M) {
 
 func (suite *BrokerTestSuite) SetupTest() {
 	tMqconf = MQConf{
-		"127.0.0.1",
-		mqPort,
-		"guest",
-		"guest",
-		"/",
-		"ingest",
-		"amq.default",
-		"ingest",
-		false,
-		false,
-		certPath + "/ca.crt",
-		certPath + "/tls.crt",
-		certPath + "/tls.key",
-		"mq",
-		"",
-		2,
+		Host:          "127.0.0.1",
+		Port:          mqPort,
+		User:          "guest",
+		Password:      "guest",
+		Vhost:         "/",
+		Queue:         "ingest",
+		Exchange:      "amq.default",
+		RoutingKey:    "ingest",
+		CACert:        certPath + "/ca.crt",
+		ClientCert:    certPath + "/tls.crt",
+		ClientKey:     certPath + "/tls.key",
+		ServerName:    "mq",
+		PrefetchCount: 2,
 	}
 }
 
@@ -206,6 +225,39 @@ func (suite *BrokerTestSuite) TestNewMQNoTLS() {
 	b.Connection.Close()
 }
 
+func (suite *BrokerTestSuite) TestEndpoints() {
+	conf := MQConf{Host: "primary", Port: 5672, StandbyHosts: []string{"standby-1", "standby-2:5673"}}
+	assert.Equal(suite.T(), []string{"primary:5672", "standby-1:5672", "standby-2:5673"}, conf.endpoints())
+}
+
+func (suite *BrokerTestSuite) TestNewMQFailover() {
+	// nothing listens on the primary port, so the standby host is used
+	failover := tMqconf
+	failover.Port = 1
+	failover.StandbyHosts = []string{fmt.Sprintf("127.0.0.1:%d", mqPort)}
+
+	b, err := NewMQ(failover)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), b.OnStandby())
+	assert.False(suite.T(), b.PrimaryAvailable())
+	b.Channel.Close()
+	b.Connection.Close()
+
+	// the primary host is preferred when it can be reached
+	failover.Port = mqPort
+	failover.StandbyHosts = []string{"127.0.0.1:1"}
+	b, err = NewMQ(failover)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), b.OnStandby())
+	assert.True(suite.T(), b.PrimaryAvailable())
+	b.Channel.Close()
+	b.Connection.Close()
+
+	failover.Port = 1
+	_, err = NewMQ(failover)
+	assert.ErrorContains(suite.T(), err, "no broker host could be reached")
+}
+
 func (suite *BrokerTestSuite) TestNewMQTLS() {
 	SslConf := tMqconf
 	SslConf.Port = tlsPort
@@ -221,6 +273,40 @@ func (suite *BrokerTestSuite) TestNewMQTLS() {
 	b.Connection.Close()
 }
 
+func (suite *BrokerTestSuite) TestWatchCerts() {
+	assert.Empty(suite.T(), tMqconf.certFiles(), "no TLS files should be watched without ssl")
+
+	conf := tMqconf
+	conf.Port = tlsPort
+	conf.Ssl = true
+	conf.VerifyPeer = true
+	conf.CACert = suite.T().TempDir() + "/ca.crt"
+	ca, err := os.ReadFile(certPath + "/ca.crt")
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), os.WriteFile(conf.CACert, ca, 0o600))
+	assert.Len(suite.T(), conf.certFiles(), 3)
+
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+	old := b.Connection
+
+	interval := CertCheckInterval
+	CertCheckInterval = 10 * time.Millisecond
+	defer func() { CertCheckInterval = interval }()
+
+	// a rotated CA certificate
+	later := time.Now().Add(time.Minute)
+	assert.NoError(suite.T(), os.Chtimes(conf.CACert, later, later))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	b.WatchCerts(ctx)
+	assert.True(suite.T(), old.IsClosed(), "the old connection should be closed")
+	assert.False(suite.T(), b.Connection.IsClosed())
+	assert.NoError(suite.T(), b.SendMessage("certs", "", "ingest", []byte("sent on the new connection")))
+}
+
 func (suite *BrokerTestSuite) TestSendMessage() {
 	b, err := NewMQ(tMqconf)
 	assert.NoError(suite.T(), err)
@@ -234,6 +320,92 @@ func (suite *BrokerTestSuite) TestSendMessage() {
 	b.Connection.Close()
 }
 
+func (suite *BrokerTestSuite) TestSendMessage_Retry() {
+	conf := tMqconf
+	conf.PublishRetries = 1
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+
+	// the closed channel is replaced before the message is published again
+	b.Channel.Close()
+	assert.NoError(suite.T(), b.SendMessage("retry", "", "ingest", []byte("retried message")))
+	assert.False(suite.T(), b.Channel.IsClosed())
+
+	b.Channel.Close()
+	b.Connection.Close()
+}
+
+func (suite *BrokerTestSuite) TestSendMessage_Spool() {
+	conf := tMqconf
+	conf.SpoolDir = suite.T().TempDir()
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+
+	b.Channel.Close()
+	b.Connection.Close()
+	assert.NoError(suite.T(), b.SendMessage("spooled", "", "ingest", []byte("spooled message")))
+	spooled, _ := filepath.Glob(filepath.Join(conf.SpoolDir, "*.json"))
+	assert.Equal(suite.T(), 1, len(spooled))
+
+	// without a spool the failure is returned
+	b.Conf.SpoolDir = ""
+	assert.Error(suite.T(), b.SendMessage("spooled", "", "ingest", []byte("spooled message")))
+
+	// the spooled message is published on the next connection
+	b, err = NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	spooled, _ = filepath.Glob(filepath.Join(conf.SpoolDir, "*.json"))
+	assert.Empty(suite.T(), spooled)
+
+	d, err := b.GetMessages("ingest")
+	assert.NoError(suite.T(), err)
+	for message := range d {
+		assert.NoError(suite.T(), message.Ack(false))
+		if message.CorrelationId == "spooled" {
+			assert.Equal(suite.T(), "spooled message", string(message.Body))
+
+			break
+		}
+	}
+
+	b.Channel.Close()
+	b.Connection.Close()
+}
+
+func (suite *BrokerTestSuite) TestSendMessages() {
+	b, err := NewMQ(tMqconf)
+	assert.NoError(suite.T(), err)
+
+	var messages []Message
+	for i := range 100 {
+		messages = append(messages, Message{CorrID: "batch", RoutingKey: "ingest", Body: []byte(fmt.Sprintf("message %d", i))})
+	}
+	assert.NoError(suite.T(), b.SendMessages(messages))
+
+	// the messages arrive in the order they were given
+	d, err := b.GetMessages("ingest")
+	assert.NoError(suite.T(), err)
+	i := 0
+	for message := range d {
+		assert.NoError(suite.T(), message.Ack(false))
+		if message.CorrelationId != "batch" {
+			continue
+		}
+		assert.Equal(suite.T(), fmt.Sprintf("message %d", i), string(message.Body))
+		if i++; i == len(messages) {
+			break
+		}
+	}
+
+	// messages that can not be published are spooled
+	b.Conf.SpoolDir = suite.T().TempDir()
+	b.Channel.Close()
+	b.Connection.Close()
+	assert.NoError(suite.T(), b.SendMessages(messages[:10]))
+	spooled, _ := filepath.Glob(filepath.Join(b.Conf.SpoolDir, "*.json"))
+	assert.Equal(suite.T(), 10, len(spooled))
+}
+
 func (suite *BrokerTestSuite) TestGetMessages() {
 	b, err := NewMQ(tMqconf)
 	assert.NoError(suite.T(), err)
@@ -290,8 +462,405 @@ func (suite *BrokerTestSuite) TestCreateNewChannel() {
 
 }
 
+func (suite *BrokerTestSuite) TestReconnect() {
+	conf := tMqconf
+	conf.PrefetchCount = 5
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+
+	b.Channel.Close()
+	assert.NoError(suite.T(), b.Reconnect(context.Background()))
+	assert.False(suite.T(), b.Channel.IsClosed())
+
+	b.Connection.Close()
+	assert.NoError(suite.T(), b.Reconnect(context.Background()))
+	assert.False(suite.T(), b.Connection.IsClosed())
+	assert.NoError(suite.T(), b.SendMessage("reconnect", "", "ingest", []byte("after reconnect")))
+
+	b.Channel.Close()
+	b.Connection.Close()
+}
+
+func (suite *BrokerTestSuite) TestSubscribe() {
+	b, err := NewMQ(tMqconf)
+	assert.NoError(suite.T(), err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// the queue does not exist and is declared
+	messages, err := b.Subscribe(ctx, "subscribe")
+	assert.NoError(suite.T(), err)
+
+	assert.NoError(suite.T(), b.SendMessage("first", "", "subscribe", []byte("first message")))
+	message := <-messages
+	assert.Equal(suite.T(), "first", message.CorrelationId)
+	assert.NoError(suite.T(), message.Ack(false))
+
+	// the subscription survives the loss of the connection
+	b.Connection.Close()
+	assert.NoError(suite.T(), b.Reconnect(ctx))
+	assert.NoError(suite.T(), b.SendMessage("second", "", "subscribe", []byte("second message")))
+	message = <-messages
+	assert.Equal(suite.T(), "second", message.CorrelationId)
+	assert.NoError(suite.T(), message.Ack(false))
+
+	cancel()
+	_, ok := <-messages
+	assert.False(suite.T(), ok, "messages should be closed when the context is cancelled")
+
+	b.Channel.Close()
+	b.Connection.Close()
+}
+
+func (suite *BrokerTestSuite) TestDeadLetter() {
+	conf := tMqconf
+	conf.DeadLetterExchange = "sda.dlx"
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), b.DeclareQueue("poison"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// a rejected message ends up in the dead letter queue
+	messages, err := b.Subscribe(ctx, "poison")
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), b.SendMessage("poison", "", "poison", []byte("poison message")))
+	message := <-messages
+	assert.NoError(suite.T(), message.Nack(false, false))
+
+	letters := make(chan DeadLetter, 1)
+	consumer := DeadLetterConsumer{Broker: b, Queue: "poison", Handle: func(dl DeadLetter) error {
+		letters <- dl
+
+		return nil
+	}}
+	go func() { _ = consumer.Run(ctx) }()
+
+	dl := <-letters
+	assert.Equal(suite.T(), "poison", dl.CorrelationId)
+	assert.Equal(suite.T(), "poison", dl.Queue)
+	assert.Equal(suite.T(), "rejected", dl.Reason)
+	assert.Equal(suite.T(), []string{"poison"}, dl.RoutingKeys)
+	assert.Equal(suite.T(), int64(1), dl.Count)
+
+	// and can be published to the queue again
+	assert.NoError(suite.T(), b.Republish(dl))
+	message = <-messages
+	assert.Equal(suite.T(), "poison message", string(message.Body))
+	assert.NoError(suite.T(), message.Ack(false))
+
+	assert.Error(suite.T(), b.Republish(NewDeadLetter(amqp.Delivery{})))
+
+	cancel()
+	b.Channel.Close()
+	b.Connection.Close()
+}
+
 // Helper functions below this line
 
+func (suite *BrokerTestSuite) TestSendPriorityMessage() {
+	conf := tMqconf
+	conf.MaxPriority = 9
+	assert.Equal(suite.T(), 9, conf.queueArgs("priority")["x-max-priority"])
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), b.DeclareQueue("priority"))
+
+	assert.NoError(suite.T(), b.SendPriorityMessage(context.Background(), "low", "", "priority", 0, []byte("low priority")))
+	assert.NoError(suite.T(), b.SendPriorityMessage(context.Background(), "high", "", "priority", 5, []byte("high priority")))
+
+	// the message with the higher priority is consumed first
+	d, err := b.GetMessages("priority")
+	assert.NoError(suite.T(), err)
+	first := <-d
+	assert.Equal(suite.T(), "high", first.CorrelationId)
+	assert.Equal(suite.T(), uint8(5), first.Priority)
+	assert.NoError(suite.T(), first.Ack(false))
+	assert.Equal(suite.T(), "low", (<-d).CorrelationId)
+
+	b.Close()
+}
+
+func (suite *BrokerTestSuite) TestDeclareQueue_Options() {
+	conf := tMqconf
+	conf.LazyQueues = true
+	conf.MaxPriority = 9
+	args := conf.queueArgs("lazy")
+	assert.Equal(suite.T(), "lazy", args["x-queue-mode"])
+	assert.Equal(suite.T(), 9, args["x-max-priority"])
+	assert.Nil(suite.T(), args["x-queue-type"])
+	assert.Nil(suite.T(), conf.holdingQueueArgs())
+
+	conf = tMqconf
+	conf.QueueType = "quorum"
+	conf.MaxLength = 1
+	conf.Overflow = "reject-publish"
+	conf.PublishRetries = 1
+	args = conf.queueArgs("bounded")
+	assert.Equal(suite.T(), "quorum", args["x-queue-type"])
+	assert.Equal(suite.T(), 1, args["x-max-length"])
+	assert.Equal(suite.T(), "reject-publish", args["x-overflow"])
+	assert.Equal(suite.T(), amqp.Table{"x-queue-type": "quorum"}, conf.holdingQueueArgs())
+
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+	assert.NoError(suite.T(), b.DeclareQueue("bounded"))
+
+	// the full queue refuses further messages
+	assert.NoError(suite.T(), b.SendMessage("first", "", "bounded", []byte("first message")))
+	assert.Error(suite.T(), b.SendMessage("second", "", "bounded", []byte("second message")))
+}
+
+func (suite *BrokerTestSuite) TestPublishWithDelay() {
+	conf := tMqconf
+	conf.RetryDelay = time.Second
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+	assert.NoError(suite.T(), b.DeclareQueue("delayed"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d, err := b.Subscribe(ctx, "delayed")
+	assert.NoError(suite.T(), err)
+
+	start := time.Now()
+	assert.NoError(suite.T(), b.PublishWithDelay(Message{CorrID: "delayed", RoutingKey: "delayed", Body: []byte("delayed message")}, 2*time.Second))
+	message := <-d
+	assert.Equal(suite.T(), "delayed", message.CorrelationId)
+	assert.GreaterOrEqual(suite.T(), time.Since(start), 2*time.Second)
+
+	// a retried message comes back after the retry delay
+	start = time.Now()
+	assert.NoError(suite.T(), b.RetryLater("delayed", message))
+	message = <-d
+	assert.Equal(suite.T(), "delayed message", string(message.Body))
+	assert.GreaterOrEqual(suite.T(), time.Since(start), time.Second)
+	assert.NoError(suite.T(), message.Ack(false))
+}
+
+func (suite *BrokerTestSuite) TestRoutes() {
+	conf := tMqconf
+	conf.Exchange = "amq.direct"
+	conf.Exchanges = map[string]string{"local": "amq.direct", "cega": "amq.topic"}
+	conf.Routes = map[string][]string{"routed": {"local", "cega"}}
+
+	routed := conf.route([]Message{
+		{CorrID: "1", Exchange: "amq.direct", RoutingKey: "routed"},
+		{CorrID: "2", Exchange: "cega", RoutingKey: "other"},
+		{CorrID: "3", Exchange: "", RoutingKey: "routed"},
+	})
+	assert.Equal(suite.T(), []Message{
+		{CorrID: "1", Exchange: "amq.direct", RoutingKey: "routed"},
+		{CorrID: "1", Exchange: "amq.topic", RoutingKey: "routed"},
+		{CorrID: "2", Exchange: "amq.topic", RoutingKey: "other"},
+		{CorrID: "3", Exchange: "", RoutingKey: "routed"},
+	}, routed)
+
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+	assert.NoError(suite.T(), b.DeclareQueue("routed"))
+	assert.NoError(suite.T(), b.Channel.QueueBind("routed", "routed", "amq.direct", false, nil))
+	assert.NoError(suite.T(), b.Channel.QueueBind("routed", "routed", "amq.topic", false, nil))
+
+	// the message reaches the queue through both exchanges
+	assert.NoError(suite.T(), b.SendMessage("routed", conf.Exchange, "routed", []byte("routed message")))
+	d, err := b.GetMessages("routed")
+	assert.NoError(suite.T(), err)
+	for _, exchange := range []string{"amq.direct", "amq.topic"} {
+		message := <-d
+		assert.Equal(suite.T(), exchange, message.Exchange)
+		assert.NoError(suite.T(), message.Ack(false))
+	}
+}
+
+func (suite *BrokerTestSuite) TestDedup() {
+	b, err := NewMQ(tMqconf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+	b.Dedup = NewMemoryDeduplicator(time.Hour)
+	assert.NoError(suite.T(), b.DeclareQueue("dedup"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d, err := b.Subscribe(ctx, "dedup")
+	assert.NoError(suite.T(), err)
+
+	// a message that is not acknowledged is not processed
+	assert.NoError(suite.T(), b.SendMessage("dedup", "", "dedup", []byte("first")))
+	message := <-d
+	assert.NoError(suite.T(), message.Nack(false, true))
+	message = <-d
+	assert.Equal(suite.T(), "first", string(message.Body))
+	assert.NoError(suite.T(), message.Ack(false))
+
+	// the same message is dropped once processed, unlike a new one
+	assert.NoError(suite.T(), b.SendMessage("dedup", "", "dedup", []byte("first")))
+	assert.NoError(suite.T(), b.SendMessage("dedup", "", "dedup", []byte("second")))
+	message = <-d
+	assert.Equal(suite.T(), "second", string(message.Body))
+	assert.NoError(suite.T(), message.Ack(false))
+
+	processed, err := b.Dedup.Processed(dedupKey("dedup", message))
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), processed)
+
+	expiring := NewMemoryDeduplicator(time.Nanosecond)
+	assert.NoError(suite.T(), expiring.MarkProcessed("key"))
+	time.Sleep(time.Millisecond)
+	processed, _ = expiring.Processed("key")
+	assert.False(suite.T(), processed)
+}
+
+func (suite *BrokerTestSuite) TestMetrics() {
+	b, err := NewMQ(tMqconf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+
+	assert.NoError(suite.T(), b.DeclareQueue("metrics"))
+	assert.NoError(suite.T(), b.SendMessage("metrics", "", "metrics", []byte("counted message")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := b.Subscribe(ctx, "metrics")
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), (<-d).Nack(false, true))
+	assert.NoError(suite.T(), (<-d).Ack(false))
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	body := w.Body.String()
+	assert.Contains(suite.T(), body, `sda_broker_published_total{routing_key="metrics"} 1`)
+	assert.Contains(suite.T(), body, `sda_broker_confirmed_total{routing_key="metrics"} 1`)
+	assert.Contains(suite.T(), body, `sda_broker_confirm_duration_seconds_count{routing_key="metrics"} 1`)
+	assert.Contains(suite.T(), body, `sda_broker_consumed_total{queue="metrics"} 2`)
+	assert.Contains(suite.T(), body, `sda_broker_redelivered_total{queue="metrics"} 1`)
+}
+
+func (suite *BrokerTestSuite) TestQuarantine() {
+	conf := tMqconf
+	conf.QuarantineAfter = 2
+	b, err := NewMQ(conf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+	quarantined := make(chan string, 1)
+	b.OnQuarantine = func(queue string, d amqp.Delivery) { quarantined <- queue + ":" + d.CorrelationId }
+
+	assert.NoError(suite.T(), b.DeclareQueue("poison"))
+	assert.NoError(suite.T(), b.SendMessage("poison", "", "poison", []byte("poison message")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := b.Subscribe(ctx, "poison")
+	assert.NoError(suite.T(), err)
+
+	// the message is handed out twice and then parked
+	for range 2 {
+		select {
+		case message := <-d:
+			assert.Equal(suite.T(), "poison", message.CorrelationId)
+			assert.NoError(suite.T(), message.Nack(false, true))
+		case <-time.After(10 * time.Second):
+			suite.FailNow("message not delivered")
+		}
+	}
+	select {
+	case q := <-quarantined:
+		assert.Equal(suite.T(), "poison:poison", q)
+	case <-d:
+		suite.FailNow("message delivered after the quarantine limit")
+	case <-time.After(10 * time.Second):
+		suite.FailNow("message not quarantined")
+	}
+
+	parked, err := b.GetMessages(QuarantineQueue("poison"))
+	assert.NoError(suite.T(), err)
+	message := <-parked
+	assert.Equal(suite.T(), "poison message", string(message.Body))
+	assert.NoError(suite.T(), message.Ack(false))
+}
+
+func (suite *BrokerTestSuite) TestTraceContext() {
+	b, err := NewMQ(tMqconf)
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+
+	sc, _ := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := tracing.ContextWithRemote(context.Background(), sc)
+	assert.NoError(suite.T(), b.SendMessageContext(ctx, "traced", "", "ingest", []byte("traced message")))
+
+	d, err := b.GetMessages("ingest")
+	assert.NoError(suite.T(), err)
+	for message := range d {
+		assert.NoError(suite.T(), message.Ack(false))
+		if message.CorrelationId != "traced" {
+			continue
+		}
+		assert.Equal(suite.T(), sc.Traceparent(), message.Headers["traceparent"])
+		assert.Equal(suite.T(), sc, tracing.SpanContextFromContext(TraceContext(context.Background(), message)))
+
+		break
+	}
+
+	// messages without a trace continue the one of their correlation ID
+	corrID := "8ed4c3c1-5bb8-4f4d-a2a4-7b3f2f0d3c55"
+	ctx = TraceContext(context.Background(), amqp.Delivery{CorrelationId: corrID})
+	assert.Equal(suite.T(), "8ed4c3c15bb84f4da2a47b3f2f0d3c55", fmt.Sprintf("%x", tracing.SpanContextFromContext(ctx).TraceID))
+}
+
+func (suite *BrokerTestSuite) TestJetStream() {
+	conf := MQConf{Type: "nats", Host: "127.0.0.1", Port: natsPort, Stream: "sda", PrefetchCount: 2}
+	var b Broker
+	var err error
+	// the server may not be ready yet
+	for range 10 {
+		if b, err = New(conf); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	assert.NoError(suite.T(), err)
+	defer b.Close()
+
+	assert.NoError(suite.T(), b.SendMessages([]Message{
+		{CorrID: "first", RoutingKey: "ingest", Body: []byte("first message")},
+		{CorrID: "second", RoutingKey: "ingest", Body: []byte("second message")},
+		{CorrID: "other", RoutingKey: "archived", Body: []byte("other message")},
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d, err := b.Subscribe(ctx, "ingest")
+	assert.NoError(suite.T(), err)
+
+	// only the messages of the queue are delivered, in order
+	first := <-d
+	assert.Equal(suite.T(), "first", first.CorrelationId)
+	assert.Equal(suite.T(), "first message", string(first.Body))
+	assert.Equal(suite.T(), "ingest", first.RoutingKey)
+	assert.False(suite.T(), first.Redelivered)
+	second := <-d
+	assert.Equal(suite.T(), "second", second.CorrelationId)
+	assert.NoError(suite.T(), second.Ack(false))
+
+	// a requeued message is delivered again
+	assert.NoError(suite.T(), first.Nack(false, true))
+	again := <-d
+	assert.Equal(suite.T(), "first", again.CorrelationId)
+	assert.True(suite.T(), again.Redelivered)
+	assert.Equal(suite.T(), int64(1), again.Headers["x-delivery-count"])
+	assert.NoError(suite.T(), again.Ack(false))
+	assert.Error(suite.T(), again.Ack(false))
+
+	cancel()
+	for range d {
+		// the channel is closed once the subscription has stopped
+	}
+}
+
 func writeConf(dest string) error {
 	f, err := os.Create(dest + "/rabbitmq.conf")
 	if err != nil {
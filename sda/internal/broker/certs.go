@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CertCheckInterval is how often the TLS files of the broker connection are
+// checked for changes
+var CertCheckInterval = 30 * time.Second
+
+// WatchCerts reconnects to the broker when the CA certificate, client
+// certificate or key of the connection change on disk, e.g. when they are
+// rotated by cert-manager, so that the connection is made with the new
+// files. The new connection is opened before the old one is closed, and the
+// consumers started with Subscribe move over to it. Messages received on
+// the old connection can not be acknowledged afterwards, the broker
+// delivers them again. It returns when ctx is cancelled.
+func (broker *AMQPBroker) WatchCerts(ctx context.Context) {
+	files := broker.Conf.certFiles()
+	if len(files) == 0 {
+		<-ctx.Done()
+
+		return
+	}
+
+	ticker := time.NewTicker(CertCheckInterval)
+	defer ticker.Stop()
+
+	last := fileStamps(files)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := fileStamps(files)
+		if maps.Equal(current, last) {
+			continue
+		}
+		// the files are replaced one at a time, wait until they match
+		if _, err := TLSConfigBroker(broker.Conf); err != nil {
+			log.Warnf("broker TLS files changed but can not be loaded yet, reason: %v", err)
+
+			continue
+		}
+		if err := broker.renewConnection(); err != nil {
+			log.Warnf("broker TLS files changed but no new connection could be made, reason: %v", err)
+
+			continue
+		}
+		last = current
+		log.Info("broker TLS files changed, reconnected with the new certificates")
+	}
+}
+
+// certFiles returns the TLS files used by the connection
+func (config MQConf) certFiles() []string {
+	if !config.Ssl {
+		return nil
+	}
+
+	files := []string{}
+	if config.CACert != "" {
+		files = append(files, config.CACert)
+	}
+	if config.VerifyPeer {
+		files = append(files, config.ClientCert, config.ClientKey)
+	}
+
+	return files
+}
+
+// renewConnection replaces the connection and channel with new ones and
+// closes the old connection, whose watchers then find the new one in place
+func (broker *AMQPBroker) renewConnection() error {
+	connection, channel, endpoint, err := connect(broker.Conf)
+	if err != nil {
+		return err
+	}
+
+	broker.reconnecting.Lock()
+	old := broker.replace(connection, channel, endpoint)
+	broker.reconnecting.Unlock()
+
+	if old.IsClosed() {
+		return nil
+	}
+
+	return old.Close()
+}
+
+// fileStamps returns the modification time and size of the files, missing
+// files are left out
+func fileStamps(files []string) map[string]string {
+	stamps := map[string]string{}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			stamps[f] = fmt.Sprintf("%s/%d", info.ModTime(), info.Size())
+		}
+	}
+
+	return stamps
+}
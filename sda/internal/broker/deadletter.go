@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	deadLetterSuffix = ".dead"
+	// deadLetterRetryDelay is how long a dead letter that could not be
+	// handled is left before it is handled again
+	deadLetterRetryDelay = 10 * time.Second
+)
+
+// DeadLetterQueue returns the name of the queue that the rejected messages
+// of queue are sent to
+func DeadLetterQueue(queue string) string {
+	return queue + deadLetterSuffix
+}
+
+// queueType returns the type of the declared queues
+func (config MQConf) queueType() string {
+	switch {
+	case config.QueueType != "":
+		return config.QueueType
+	case config.DeliveryLimit > 0:
+		return "quorum"
+	default:
+		return "classic"
+	}
+}
+
+// queueArgs returns the arguments queue is declared with
+func (config MQConf) queueArgs(queue string) amqp.Table {
+	args := amqp.Table{}
+	if config.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = config.DeadLetterExchange
+		args["x-dead-letter-routing-key"] = queue
+	}
+	if config.queueType() == "quorum" {
+		args["x-queue-type"] = "quorum"
+		if config.DeliveryLimit > 0 {
+			args["x-delivery-limit"] = config.DeliveryLimit
+		}
+	} else {
+		// quorum queues have their own fixed priorities and are always
+		// kept on disk
+		if config.MaxPriority > 0 {
+			args["x-max-priority"] = config.MaxPriority
+		}
+		if config.LazyQueues {
+			args["x-queue-mode"] = "lazy"
+		}
+	}
+	if config.MaxLength > 0 {
+		args["x-max-length"] = config.MaxLength
+	}
+	if config.Overflow != "" {
+		args["x-overflow"] = config.Overflow
+	}
+
+	return args
+}
+
+// holdingQueueArgs returns the arguments of the dead letter and quarantine
+// queues, which are not limited in length since they hold the messages
+// that need attention
+func (config MQConf) holdingQueueArgs() amqp.Table {
+	if config.QueueType != "quorum" {
+		return nil
+	}
+
+	return amqp.Table{"x-queue-type": "quorum"}
+}
+
+// DeclareQueue declares a durable queue, together with its dead letter
+// queue when Conf.DeadLetterExchange is set. The dead letter queue is bound
+// to the exchange with the name of the queue as routing key. Declaring a
+// queue that exists with other arguments fails, the arguments of existing
+// queues are changed with policies on the broker.
+func (broker *AMQPBroker) DeclareQueue(queue string) error {
+	// dead letter queues do not dead-letter themselves
+	if strings.HasSuffix(queue, deadLetterSuffix) {
+		_, err := broker.channel().QueueDeclare(queue, true, false, false, false, broker.Conf.holdingQueueArgs())
+
+		return err
+	}
+
+	if err := broker.declareDeadLetterQueue(queue); err != nil {
+		return err
+	}
+	_, err := broker.channel().QueueDeclare(queue, true, false, false, false, broker.Conf.queueArgs(queue))
+
+	return err
+}
+
+// declareDeadLetterQueue declares the dead letter exchange and the dead
+// letter queue of queue, when Conf.DeadLetterExchange is set
+func (broker *AMQPBroker) declareDeadLetterQueue(queue string) error {
+	dlx := broker.Conf.DeadLetterExchange
+	if dlx == "" || strings.HasSuffix(queue, deadLetterSuffix) {
+		return nil
+	}
+
+	if err := broker.channel().ExchangeDeclare(dlx, "direct", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare dead letter exchange %s: %w", dlx, err)
+	}
+	if _, err := broker.channel().QueueDeclare(DeadLetterQueue(queue), true, false, false, false, broker.Conf.holdingQueueArgs()); err != nil {
+		return fmt.Errorf("failed to declare dead letter queue of %s: %w", queue, err)
+	}
+	if err := broker.channel().QueueBind(DeadLetterQueue(queue), queue, dlx, false, nil); err != nil {
+		return fmt.Errorf("failed to bind dead letter queue of %s: %w", queue, err)
+	}
+
+	return nil
+}
+
+// DeadLetter is a message from a dead letter queue, with the queue it was
+// dead-lettered from and why
+type DeadLetter struct {
+	amqp.Delivery
+	// Queue is the queue the message was dead-lettered from
+	Queue string
+	// Reason is rejected, expired, maxlen or delivery_limit
+	Reason string
+	// Exchange and RoutingKeys are those the message was first published with
+	Exchange    string
+	RoutingKeys []string
+	// Count is how many times the message has been dead-lettered from Queue
+	Count int64
+}
+
+// NewDeadLetter reads where and why a message was dead-lettered from its
+// x-death header, the latest dead-lettering first
+func NewDeadLetter(delivery amqp.Delivery) DeadLetter {
+	dl := DeadLetter{Delivery: delivery}
+
+	deaths, _ := delivery.Headers["x-death"].([]any)
+	if len(deaths) == 0 {
+		return dl
+	}
+	death, _ := deaths[0].(amqp.Table)
+	dl.Queue, _ = death["queue"].(string)
+	dl.Reason, _ = death["reason"].(string)
+	dl.Exchange, _ = death["exchange"].(string)
+	dl.Count, _ = death["count"].(int64)
+	keys, _ := death["routing-keys"].([]any)
+	for _, key := range keys {
+		if k, ok := key.(string); ok {
+			dl.RoutingKeys = append(dl.RoutingKeys, k)
+		}
+	}
+
+	return dl
+}
+
+// DeadLetterConsumer processes the messages of the dead letter queue of
+// Queue, e.g. to report them or to publish them again once the cause has
+// been fixed. Messages are acknowledged when Handle returns nil and are
+// kept in the dead letter queue otherwise.
+type DeadLetterConsumer struct {
+	Broker *AMQPBroker
+	Queue  string
+	Handle func(DeadLetter) error
+}
+
+// Run consumes the dead letter queue until ctx is cancelled
+func (c DeadLetterConsumer) Run(ctx context.Context) error {
+	messages, err := c.Broker.Subscribe(ctx, DeadLetterQueue(c.Queue))
+	if err != nil {
+		return fmt.Errorf("failed to consume dead letter queue of %s: %v", c.Queue, err)
+	}
+
+	for delivered := range messages {
+		dl := NewDeadLetter(delivered)
+		if err := c.Handle(dl); err != nil {
+			log.Errorf("failed to handle dead letter with correlation ID %s from %s, reason: %v", dl.CorrelationId, dl.Queue, err)
+			if err := delivered.Nack(false, true); err != nil {
+				log.Errorf("failed to Nack message, reason: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(deadLetterRetryDelay):
+			}
+
+			continue
+		}
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("failed to Ack message, reason: %v", err)
+		}
+	}
+
+	return errors.New("delivery channel closed")
+}
+
+// Republish publishes a dead letter again with the exchange and routing key
+// it was first published with
+func (broker *AMQPBroker) Republish(dl DeadLetter) error {
+	if len(dl.RoutingKeys) == 0 {
+		return errors.New("the message has no dead letter information")
+	}
+
+	return broker.SendMessage(dl.CorrelationId, dl.Exchange, dl.RoutingKeys[0], dl.Body)
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDedupKeys bounds the number of processed messages remembered by a
+// MemoryDeduplicator, the oldest are forgotten first when it is reached
+const maxDedupKeys = 100000
+
+// Deduplicator remembers which messages have been processed, by a key made
+// of the queue, the correlation ID and the body of the message
+type Deduplicator interface {
+	// Processed reports whether the message with the key was processed
+	Processed(key string) (bool, error)
+	// MarkProcessed records that the message with the key was processed
+	MarkProcessed(key string) error
+}
+
+// MemoryDeduplicator remembers the processed messages of the process for
+// a while, it does not see the messages processed by other replicas
+type MemoryDeduplicator struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	processed map[string]time.Time
+}
+
+// NewMemoryDeduplicator returns a Deduplicator that remembers processed
+// messages for ttl
+func NewMemoryDeduplicator(ttl time.Duration) *MemoryDeduplicator {
+	return &MemoryDeduplicator{ttl: ttl, processed: map[string]time.Time{}}
+}
+
+func (m *MemoryDeduplicator) Processed(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	at, ok := m.processed[key]
+
+	return ok && time.Since(at) < m.ttl, nil
+}
+
+func (m *MemoryDeduplicator) MarkProcessed(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.processed) >= maxDedupKeys {
+		m.forget()
+	}
+	m.processed[key] = time.Now()
+
+	return nil
+}
+
+// forget drops the expired keys, or the older half of the keys when none
+// have expired
+func (m *MemoryDeduplicator) forget() {
+	var times []time.Time
+	for key, at := range m.processed {
+		if time.Since(at) >= m.ttl {
+			delete(m.processed, key)
+		}
+		times = append(times, at)
+	}
+	if len(m.processed) < maxDedupKeys {
+		return
+	}
+
+	slices.SortFunc(times, time.Time.Compare)
+	median := times[len(times)/2]
+	for key, at := range m.processed {
+		if at.Before(median) {
+			delete(m.processed, key)
+		}
+	}
+}
+
+// dedupKey returns the key of a message of queue for the Deduplicator
+func dedupKey(queue string, d amqp.Delivery) string {
+	return queue + "/" + requeueKey(d)
+}
+
+// duplicate reports whether the message was processed before, in which
+// case it is acknowledged and dropped. Otherwise the message is recorded as
+// processed once it is acknowledged.
+func (broker *AMQPBroker) duplicate(queue string, d *amqp.Delivery) bool {
+	if broker.Dedup == nil || strings.HasSuffix(queue, deadLetterSuffix) || strings.HasSuffix(queue, quarantineSuffix) {
+		return false
+	}
+
+	key := dedupKey(queue, *d)
+	processed, err := broker.Dedup.Processed(key)
+	if err != nil {
+		log.Warnf("failed to check if the message with correlation ID %s was processed, reason: %v", d.CorrelationId, err)
+	}
+	if !processed {
+		d.Acknowledger = &dedupAcknowledger{Acknowledger: d.Acknowledger, dedup: broker.Dedup, key: key}
+
+		return false
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Errorf("failed to Ack duplicate message, reason: %v", err)
+	}
+	duplicatesTotal.Inc(queue)
+	log.Infof("dropped duplicate message with correlation ID %s from %s", d.CorrelationId, queue)
+
+	return true
+}
+
+// dedupAcknowledger records a delivery as processed when it is acknowledged
+type dedupAcknowledger struct {
+	amqp.Acknowledger
+	dedup Deduplicator
+	key   string
+}
+
+func (a *dedupAcknowledger) Ack(tag uint64, multiple bool) error {
+	if err := a.Acknowledger.Ack(tag, multiple); err != nil {
+		return err
+	}
+	if err := a.dedup.MarkProcessed(a.key); err != nil {
+		log.Warnf("failed to record the message as processed, reason: %v", err)
+	}
+
+	return nil
+}
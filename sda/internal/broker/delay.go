@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// delayQueuePrefix starts the names of the queues that hold delayed
+// messages
+const delayQueuePrefix = "sda.delay"
+
+// delayQueue returns the name of the queue that holds the messages to
+// exchange and routingKey for delay, the default exchange is left out
+func delayQueue(exchange, routingKey string, delay time.Duration) string {
+	if exchange == "" {
+		return fmt.Sprintf("%s.%d.%s", delayQueuePrefix, delay.Milliseconds(), routingKey)
+	}
+
+	return fmt.Sprintf("%s.%d.%s.%s", delayQueuePrefix, delay.Milliseconds(), exchange, routingKey)
+}
+
+// PublishWithDelay publishes a message that is delivered after delay. The
+// message waits in a queue of its own for the delay, exchange and routing
+// key, where it expires after delay and is dead-lettered to the exchange
+// with the routing key, so no broker plugin is needed. Messages with the
+// same delay are delivered in the order they were published.
+func (broker *AMQPBroker) PublishWithDelay(msg Message, delay time.Duration) error {
+	if delay <= 0 {
+		return broker.SendMessages([]Message{msg})
+	}
+
+	queue := delayQueue(msg.Exchange, msg.RoutingKey, delay)
+	args := amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    msg.Exchange,
+		"x-dead-letter-routing-key": msg.RoutingKey,
+	}
+	maps.Copy(args, broker.Conf.holdingQueueArgs())
+	if _, err := broker.channel().QueueDeclare(queue, true, false, false, false, args); err != nil {
+		return fmt.Errorf("failed to declare delay queue %s: %w", queue, err)
+	}
+
+	// the default exchange routes to the queue with the routing key as name
+	msg.Exchange = ""
+	msg.RoutingKey = queue
+
+	return broker.SendMessages([]Message{msg})
+}
+
+// RetryLater hands a delivery back to queue after Conf.RetryDelay, for
+// failures that are expected to pass, like a storage backend that can not
+// be reached for a moment. The message is published again with the delay
+// and the delivery is acknowledged, so the consumer goes on with the other
+// messages in the meantime. Without a retry delay the delivery is requeued
+// right away. Retries with a delay are new messages and are not counted
+// towards Conf.QuarantineAfter.
+func (broker *AMQPBroker) RetryLater(queue string, d amqp.Delivery) error {
+	if broker.Conf.RetryDelay <= 0 {
+		return d.Nack(false, true)
+	}
+	// the message is not processed yet
+	if a, ok := d.Acknowledger.(*dedupAcknowledger); ok {
+		d.Acknowledger = a.Acknowledger
+	}
+
+	traceparent, _ := d.Headers[traceHeader].(string)
+	msg := Message{CorrID: d.CorrelationId, RoutingKey: queue, Body: d.Body, Priority: d.Priority, Traceparent: traceparent}
+	if err := broker.PublishWithDelay(msg, broker.Conf.RetryDelay); err != nil {
+		if err := d.Nack(false, true); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("failed to delay message with correlation ID %s, requeued it: %w", d.CorrelationId, err)
+	}
+
+	return d.Ack(false)
+}
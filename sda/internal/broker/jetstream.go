@@ -0,0 +1,297 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// jetStreamAckWait is how long a delivered message may be left
+// unacknowledged before it is delivered again, the same as the consumer
+// timeout of RabbitMQ
+const jetStreamAckWait = 30 * time.Minute
+
+// JetStreamBroker is a Broker on NATS JetStream, for deployments where
+// RabbitMQ is too heavy. The messages are stored in one stream, on the
+// subject made of the stream name and the routing key, and each queue is a
+// durable consumer of the subject with the name of the queue. The routing
+// keys therefore name the queues, like the bindings of the sda exchange do,
+// and the exchange of a message is not used.
+type JetStreamBroker struct {
+	Connection *nats.Conn
+	JetStream  jetstream.JetStream
+	Conf       MQConf
+}
+
+// NewJetStream connects to a NATS server, trying the standby hosts when
+// the primary one can not be reached, and creates the stream of the
+// messages unless it exists
+func NewJetStream(config MQConf) (*JetStreamBroker, error) {
+	options := []nats.Option{nats.Name("sda"), nats.DontRandomize(), nats.MaxReconnects(-1)}
+	if config.User != "" {
+		options = append(options, nats.UserInfo(config.User, config.Password))
+	}
+
+	scheme := "nats"
+	if config.Ssl {
+		scheme = "tls"
+		tlsConfig, err := TLSConfigBroker(config)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, nats.Secure(tlsConfig))
+	}
+
+	var servers []string
+	for _, endpoint := range config.endpoints() {
+		servers = append(servers, scheme+"://"+endpoint)
+	}
+	connection, err := nats.Connect(strings.Join(servers, ","), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := jetstream.New(connection)
+	if err != nil {
+		connection.Close()
+
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      config.Stream,
+		Subjects:  []string{config.Stream + ".>"},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	}); err != nil {
+		connection.Close()
+
+		return nil, fmt.Errorf("failed to create stream %s: %w", config.Stream, err)
+	}
+
+	return &JetStreamBroker{Connection: connection, JetStream: js, Conf: config}, nil
+}
+
+// SendMessage publishes a message and waits for the server to store it
+func (broker *JetStreamBroker) SendMessage(corrID, exchange, routingKey string, body []byte) error {
+	return broker.SendMessages([]Message{{CorrID: corrID, Exchange: exchange, RoutingKey: routingKey, Body: body}})
+}
+
+// SendMessages publishes the messages, in order, and waits once for the
+// server to store all of them. Messages published while the server can not
+// be reached are buffered by the client until it has reconnected.
+func (broker *JetStreamBroker) SendMessages(messages []Message) error {
+	start := time.Now()
+	futures := make([]jetstream.PubAckFuture, 0, len(messages))
+	for _, m := range messages {
+		msg := nats.NewMsg(broker.subject(m.RoutingKey))
+		msg.Header.Set("Correlation-Id", m.CorrID)
+		msg.Header.Set("Content-Type", "application/json")
+		if m.Traceparent != "" {
+			msg.Header.Set(traceHeader, m.Traceparent)
+		}
+		msg.Data = m.Body
+
+		future, err := broker.JetStream.PublishMsgAsync(msg)
+		if err != nil {
+			return fmt.Errorf("failed to publish message with correlation ID %s: %w", m.CorrID, err)
+		}
+		publishedTotal.Inc(m.RoutingKey)
+		futures = append(futures, future)
+	}
+
+	timeout := time.After(publishTimeout)
+	for i, future := range futures {
+		select {
+		case ack := <-future.Ok():
+			observeConfirm(messages[i].RoutingKey, true, start)
+			log.Debugf("confirmed delivery with sequence %d in stream %s", ack.Sequence, ack.Stream)
+		case err := <-future.Err():
+			observeConfirm(messages[i].RoutingKey, false, start)
+
+			return fmt.Errorf("failed delivery of message with correlation ID %s: %w", messages[i].CorrID, err)
+		case <-timeout:
+			observeConfirm(messages[i].RoutingKey, false, start)
+
+			return fmt.Errorf("no confirmation of message with correlation ID %s", messages[i].CorrID)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe reads the messages of the queue through a durable consumer,
+// which is created unless it exists. At most Conf.PrefetchCount messages
+// are delivered without being acknowledged, and a message is dead after
+// Conf.DeliveryLimit deliveries when it is set. Messages that are nacked
+// with requeue are delivered again, other nacked messages are dropped. The
+// returned channel is closed when ctx is cancelled.
+func (broker *JetStreamBroker) Subscribe(ctx context.Context, queue string) (<-chan amqp.Delivery, error) {
+	config := jetstream.ConsumerConfig{
+		Durable:       consumerName(queue),
+		FilterSubject: broker.subject(queue),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       jetStreamAckWait,
+		MaxDeliver:    -1,
+	}
+	if broker.Conf.DeliveryLimit > 0 {
+		config.MaxDeliver = broker.Conf.DeliveryLimit
+	}
+	var options []jetstream.PullMessagesOpt
+	if broker.Conf.PrefetchCount > 0 {
+		config.MaxAckPending = broker.Conf.PrefetchCount
+		options = append(options, jetstream.PullMaxMessages(broker.Conf.PrefetchCount))
+	}
+
+	consumer, err := broker.JetStream.CreateOrUpdateConsumer(ctx, broker.Conf.Stream, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer of queue %s: %w", queue, err)
+	}
+	iter, err := consumer.Messages(options...)
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, iter.Stop)
+
+	acknowledger := &jetStreamAcknowledger{pending: map[uint64]jetstream.Msg{}}
+	deliveries := make(chan amqp.Delivery)
+	go func() {
+		defer close(deliveries)
+
+		var tag uint64
+		for {
+			msg, err := iter.Next()
+			if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+				return
+			}
+			if err != nil {
+				log.Warnf("failed to read from queue %s, reason: %v", queue, err)
+
+				continue
+			}
+
+			tag++
+			acknowledger.add(tag, msg)
+			delivery := broker.delivery(tag, msg, acknowledger)
+			observeDelivery(queue, delivery)
+			select {
+			case deliveries <- delivery:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+// Close closes the connection to the server
+func (broker *JetStreamBroker) Close() {
+	broker.Connection.Close()
+}
+
+// subject returns the subject of the messages with the routing key
+func (broker *JetStreamBroker) subject(routingKey string) string {
+	return broker.Conf.Stream + "." + routingKey
+}
+
+// delivery converts a JetStream message to a delivery, with the trace
+// context of the message and the number of earlier deliveries in the
+// x-delivery-count header like on quorum queues
+func (broker *JetStreamBroker) delivery(tag uint64, msg jetstream.Msg, acknowledger amqp.Acknowledger) amqp.Delivery {
+	delivery := amqp.Delivery{
+		Acknowledger:  acknowledger,
+		DeliveryTag:   tag,
+		Exchange:      broker.Conf.Stream,
+		RoutingKey:    strings.TrimPrefix(msg.Subject(), broker.Conf.Stream+"."),
+		CorrelationId: msg.Headers().Get("Correlation-Id"),
+		ContentType:   msg.Headers().Get("Content-Type"),
+		Body:          msg.Data(),
+		Headers:       amqp.Table{},
+	}
+	if value := msg.Headers().Get(traceHeader); value != "" {
+		delivery.Headers[traceHeader] = value
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		delivery.Redelivered = meta.NumDelivered > 1
+		delivery.Timestamp = meta.Timestamp
+		delivery.Headers["x-delivery-count"] = int64(meta.NumDelivered - 1)
+	}
+
+	return delivery
+}
+
+// consumerName returns a durable consumer name for the queue, which can
+// not contain the characters that have a meaning in subjects
+func consumerName(queue string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(queue)
+}
+
+// jetStreamAcknowledger settles the JetStream messages behind the
+// deliveries of a subscription
+type jetStreamAcknowledger struct {
+	mu      sync.Mutex
+	pending map[uint64]jetstream.Msg
+}
+
+func (a *jetStreamAcknowledger) add(tag uint64, msg jetstream.Msg) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pending[tag] = msg
+}
+
+func (a *jetStreamAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.settle(tag, multiple, jetstream.Msg.Ack)
+}
+
+// Nack makes the server deliver the message again when requeue is set and
+// terminates its delivery otherwise
+func (a *jetStreamAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		return a.settle(tag, multiple, jetstream.Msg.Nak)
+	}
+
+	return a.settle(tag, multiple, jetstream.Msg.Term)
+}
+
+func (a *jetStreamAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// settle settles the message with the delivery tag, or all messages up to
+// it when multiple is set
+func (a *jetStreamAcknowledger) settle(tag uint64, multiple bool, settle func(jetstream.Msg) error) error {
+	a.mu.Lock()
+	var msgs []jetstream.Msg
+	for t, msg := range a.pending {
+		if t == tag || (multiple && t < tag) {
+			msgs = append(msgs, msg)
+			delete(a.pending, t)
+		}
+	}
+	a.mu.Unlock()
+
+	if len(msgs) == 0 {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+
+	var errs []error
+	for _, msg := range msgs {
+		if err := settle(msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	publishedTotal = metrics.NewCounter("sda_broker_published_total",
+		"Messages published to the broker by routing key.", "routing_key")
+	confirmedTotal = metrics.NewCounter("sda_broker_confirmed_total",
+		"Published messages confirmed by the broker by routing key.", "routing_key")
+	nackedTotal = metrics.NewCounter("sda_broker_nacked_total",
+		"Published messages refused by the broker, or not confirmed in time, by routing key.", "routing_key")
+	confirmDuration = metrics.NewHistogram("sda_broker_confirm_duration_seconds",
+		"Time from publishing a message until the broker confirmed it.", metrics.DefaultBuckets, "routing_key")
+	spooledTotal = metrics.NewCounter("sda_broker_spooled_total",
+		"Messages spooled to disk since they could not be published, by routing key.", "routing_key")
+	consumedTotal = metrics.NewCounter("sda_broker_consumed_total",
+		"Messages delivered to the consumers by queue.", "queue")
+	redeliveredTotal = metrics.NewCounter("sda_broker_redelivered_total",
+		"Messages delivered to the consumers again by queue.", "queue")
+	quarantinedTotal = metrics.NewCounter("sda_broker_quarantined_total",
+		"Messages parked in a quarantine queue after too many deliveries.", "queue")
+	duplicatesTotal = metrics.NewCounter("sda_broker_duplicates_total",
+		"Messages dropped since they were processed before, by queue.", "queue")
+)
+
+// observeConfirm counts the outcome of publishing a message, timing the
+// confirmation of the messages that were confirmed
+func observeConfirm(routingKey string, confirmed bool, start time.Time) {
+	if !confirmed {
+		nackedTotal.Inc(routingKey)
+
+		return
+	}
+	confirmedTotal.Inc(routingKey)
+	confirmDuration.Observe(time.Since(start).Seconds(), routingKey)
+}
+
+// observeDelivery counts a message delivered from queue
+func observeDelivery(queue string, d amqp.Delivery) {
+	consumedTotal.Inc(queue)
+	if d.Redelivered {
+		redeliveredTotal.Inc(queue)
+	}
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// quarantineSuffix is added to the name of a queue to name the queue its
+	// poison messages are parked in
+	quarantineSuffix = ".quarantine"
+	// maxTrackedRedeliveries bounds the number of requeued messages whose
+	// deliveries are counted by a consumer, the counts start over when it
+	// is reached
+	maxTrackedRedeliveries = 10000
+)
+
+// QuarantineQueue returns the name of the queue that the messages of queue
+// are parked in after too many deliveries
+func QuarantineQueue(queue string) string {
+	return queue + quarantineSuffix
+}
+
+// redeliveries counts how many times the messages of a queue have been
+// delivered before
+type redeliveries struct {
+	queue string
+	// requeued counts the redeliveries of requeued messages on classic
+	// queues, which the broker does not count, by correlation ID and body
+	requeued map[string]int64
+}
+
+func newRedeliveries(queue string) *redeliveries {
+	return &redeliveries{queue: queue, requeued: map[string]int64{}}
+}
+
+// count returns the number of earlier deliveries of the message, as
+// counted by quorum queues in x-delivery-count, by the broker in x-death
+// when the message has been dead-lettered from the queue and published
+// again, or by the consumer itself when the message was requeued
+func (r *redeliveries) count(d amqp.Delivery) int64 {
+	if n, ok := d.Headers["x-delivery-count"].(int64); ok {
+		return n
+	}
+
+	var count int64
+	deaths, _ := d.Headers["x-death"].([]any)
+	for _, death := range deaths {
+		if t, ok := death.(amqp.Table); ok && t["queue"] == r.queue {
+			n, _ := t["count"].(int64)
+			count += n
+		}
+	}
+	if !d.Redelivered {
+		return count
+	}
+
+	if len(r.requeued) >= maxTrackedRedeliveries {
+		clear(r.requeued)
+	}
+	key := requeueKey(d)
+	r.requeued[key]++
+
+	return count + r.requeued[key]
+}
+
+// requeueKey identifies a requeued message by its correlation ID and body
+func requeueKey(d amqp.Delivery) string {
+	sum := sha256.Sum256(d.Body)
+
+	return d.CorrelationId + "/" + hex.EncodeToString(sum[:8])
+}
+
+// quarantined parks the message in the quarantine queue of queue when it has
+// been delivered Conf.QuarantineAfter times already, so that a message that
+// always fails is not retried for ever. It reports whether the message was
+// quarantined, the consumer must then leave it alone.
+func (broker *AMQPBroker) quarantined(queue string, d amqp.Delivery, r *redeliveries) bool {
+	if broker.Conf.QuarantineAfter <= 0 || strings.HasSuffix(queue, deadLetterSuffix) || strings.HasSuffix(queue, quarantineSuffix) {
+		return false
+	}
+	count := r.count(d)
+	if count < int64(broker.Conf.QuarantineAfter) {
+		return false
+	}
+
+	if err := broker.quarantine(queue, d); err != nil {
+		// the message is handled as usual and quarantined on a later delivery
+		log.Errorf("failed to quarantine message with correlation ID %s from %s, reason: %v", d.CorrelationId, queue, err)
+
+		return false
+	}
+	delete(r.requeued, requeueKey(d))
+	quarantinedTotal.Inc(queue)
+	log.Errorf("quarantined message with correlation ID %s from %s after %d deliveries", d.CorrelationId, queue, count)
+
+	if broker.OnQuarantine != nil {
+		broker.OnQuarantine(queue, d)
+	}
+
+	return true
+}
+
+// quarantine publishes the message to the quarantine queue of queue and
+// removes it from queue
+func (broker *AMQPBroker) quarantine(queue string, d amqp.Delivery) error {
+	if _, err := broker.channel().QueueDeclare(QuarantineQueue(queue), true, false, false, false, broker.Conf.holdingQueueArgs()); err != nil {
+		return fmt.Errorf("failed to declare quarantine queue: %w", err)
+	}
+
+	traceparent, _ := d.Headers[traceHeader].(string)
+	msg := Message{CorrID: d.CorrelationId, RoutingKey: QuarantineQueue(queue), Body: d.Body, Priority: d.Priority, Traceparent: traceparent}
+	if err := broker.SendMessages([]Message{msg}); err != nil {
+		return err
+	}
+
+	return d.Ack(false)
+}
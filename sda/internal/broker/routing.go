@@ -0,0 +1,38 @@
+package broker
+
+// exchange returns the exchange named name in Conf.Exchanges, or name itself
+// when it is not one of them
+func (config MQConf) exchange(name string) string {
+	if exchange, ok := config.Exchanges[name]; ok {
+		return exchange
+	}
+
+	return name
+}
+
+// route returns the messages as they are published. A message to a named
+// exchange goes to the exchange with that name, and a message to the
+// exchange of the service with a routing key in Conf.Routes goes to each
+// of the exchanges listed for the routing key.
+func (config MQConf) route(messages []Message) []Message {
+	if len(config.Exchanges) == 0 {
+		return messages
+	}
+
+	routed := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		names, ok := config.Routes[msg.RoutingKey]
+		if !ok || msg.Exchange != config.Exchange {
+			msg.Exchange = config.exchange(msg.Exchange)
+			routed = append(routed, msg)
+
+			continue
+		}
+		for _, name := range names {
+			msg.Exchange = config.exchange(name)
+			routed = append(routed, msg)
+		}
+	}
+
+	return routed
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spool writes a message that could not be published to the spool
+// directory, where it is kept until the broker can be reached again. The file is written under
+// a temporary name and renamed, so that a partly written message is never
+// published. The names sort in the order the messages were spooled.
+func (broker *AMQPBroker) spool(msg Message) error {
+	if err := os.MkdirAll(broker.Conf.SpoolDir, 0o700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(broker.Conf.SpoolDir, fmt.Sprintf("%020d-*.tmp", time.Now().UnixNano()))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+
+		return err
+	}
+
+	return os.Rename(f.Name(), strings.TrimSuffix(f.Name(), ".tmp")+".json")
+}
+
+// RepublishSpooled publishes the spooled messages, oldest first, and removes
+// them from the spool once the broker has confirmed them. It stops at the
+// first message that can not be published.
+func (broker *AMQPBroker) RepublishSpooled() error {
+	if broker.Conf.SpoolDir == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(broker.Conf.SpoolDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	slices.Sort(files)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			// published by another process sharing the spool
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Errorf("discarding unreadable spooled message %s, reason: %v", file, err)
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if _, err := broker.publish([]Message{msg}); err != nil {
+			return fmt.Errorf("failed to publish spooled message %s: %w", file, err)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		log.Infof("published spooled message with correlation ID %s", msg.CorrID)
+	}
+
+	return nil
+}
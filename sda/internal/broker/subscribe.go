@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"context"
+	"errors"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Subscribe reads messages from the queue like GetMessages, but keeps the
+// subscription across broker outages. When the channel or connection is
+// lost it reconnects, declares the queue again if the broker lost it, and
+// resumes consuming with the same prefetch count. Messages delivered more
+// than Conf.QuarantineAfter times are quarantined instead of passed on, and
+// messages that Dedup has seen processed are acknowledged and dropped. The
+// returned channel is closed when ctx is cancelled.
+//
+// Messages received before an outage can not be acknowledged afterwards,
+// the broker delivers them again.
+func (broker *AMQPBroker) Subscribe(ctx context.Context, queue string) (<-chan amqp.Delivery, error) {
+	deliveries, err := broker.subscribe(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(chan amqp.Delivery)
+	go func() {
+		defer close(messages)
+
+		r := newRedeliveries(queue)
+		skip := func(d *amqp.Delivery) bool {
+			observeDelivery(queue, *d)
+
+			return broker.quarantined(queue, *d, r) || broker.duplicate(queue, d)
+		}
+		for forward(ctx, deliveries, messages, skip) {
+			log.Warnf("consumer of queue %s stopped, resubscribing", queue)
+			for {
+				if err := broker.Reconnect(ctx); err != nil {
+					return
+				}
+				if deliveries, err = broker.subscribe(queue); err == nil {
+					break
+				}
+				log.Errorf("failed to resubscribe to queue %s, reason: %v", queue, err)
+			}
+			log.Infof("resubscribed to queue %s", queue)
+		}
+	}()
+
+	return messages, nil
+}
+
+// forward passes the deliveries, except those skipped, on to messages until
+// the deliveries end, it returns false when ctx is cancelled
+func forward(ctx context.Context, deliveries <-chan amqp.Delivery, messages chan<- amqp.Delivery, skip func(*amqp.Delivery) bool) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case d, ok := <-deliveries:
+			if !ok {
+				return true
+			}
+			if skip(&d) {
+				continue
+			}
+			select {
+			case messages <- d:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+}
+
+// subscribe starts consuming the queue, declaring it first if it does not
+// exist, e.g. after the broker was restarted without its definitions. The
+// dead letter queue of an existing queue is declared as well, the queue
+// itself is expected to dead-letter to it through a policy.
+func (broker *AMQPBroker) subscribe(queue string) (<-chan amqp.Delivery, error) {
+	_, err := broker.channel().QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err == nil {
+		err = broker.declareDeadLetterQueue(queue)
+	}
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		log.Warnf("queue %s does not exist, declaring it", queue)
+		// the failed check closed the channel
+		if err := broker.reconnect(); err != nil {
+			return nil, err
+		}
+		err = broker.DeclareQueue(queue)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return broker.GetMessages(queue)
+}
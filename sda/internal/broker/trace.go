@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// traceHeader is the message header carrying the W3C trace context
+const traceHeader = "traceparent"
+
+// TraceContext returns a context continuing the trace of the message, given
+// by its traceparent header. Messages without one, e.g. those published by
+// services that do not trace, continue the trace derived from their
+// correlation ID.
+func TraceContext(ctx context.Context, delivery amqp.Delivery) context.Context {
+	if value, ok := delivery.Headers[traceHeader].(string); ok {
+		if sc, ok := tracing.ParseTraceparent(value); ok {
+			ctx = tracing.ContextWithRemote(ctx, sc)
+		}
+	}
+
+	return tracing.WithCorrelationID(ctx, delivery.CorrelationId)
+}
+
+// traceparent returns the traceparent header value for the span in ctx,
+// empty when ctx is not part of a span
+func traceparent(ctx context.Context) string {
+	sc := tracing.SpanContextFromContext(ctx)
+	if !sc.IsValid() || sc.SpanID == [8]byte{} {
+		return ""
+	}
+
+	return sc.Traceparent()
+}
+
+// SendMessageContext is SendMessage for a message that continues the trace
+// in ctx, so that the work done by the consumer is part of the same trace
+func (broker *AMQPBroker) SendMessageContext(ctx context.Context, corrID, exchange, routingKey string, body []byte) error {
+	return broker.SendMessages([]Message{{CorrID: corrID, Exchange: exchange, RoutingKey: routingKey, Body: body, Traceparent: traceparent(ctx)}})
+}
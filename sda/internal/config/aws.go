@@ -0,0 +1,146 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Prefixes of config values that are fetched from AWS when the config is read
+const (
+	// SecretsManagerPrefix names a secret in AWS Secrets Manager, a key of a
+	// JSON secret is selected with #key, e.g. awssm://sda/db#password
+	SecretsManagerPrefix = "awssm://"
+	// ParameterStorePrefix names a parameter in the SSM Parameter Store,
+	// e.g. ssm:///sda/s3/secretkey
+	ParameterStorePrefix = "ssm://"
+)
+
+// resolveAWSValues replaces the config values, from the config file or the
+// environment, that point to AWS Secrets Manager or the SSM Parameter Store
+// with the values stored there. The AWS region and credentials are taken
+// from the default chain, i.e. AWS_REGION, IRSA or the instance profile, and
+// the endpoints can be changed with AWS_ENDPOINT_URL.
+func resolveAWSValues() error {
+	refs := map[string]string{}
+	for _, key := range viper.AllKeys() {
+		if value, ok := viper.Get(key).(string); ok && isAWSRef(value) {
+			refs[key] = value
+		}
+	}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if key, ok := envKey(name); ok && isAWSRef(value) {
+			refs[key] = value
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithHTTPClient(outbound.Client(30*time.Second)))
+	if err != nil {
+		return fmt.Errorf("failed to load the AWS config, reason: %v", err)
+	}
+	if cfg.Region == "" {
+		return fmt.Errorf("config values are stored in AWS but no AWS region is set")
+	}
+
+	fetched := map[string]string{}
+	for key, ref := range refs {
+		var value string
+		switch {
+		case strings.HasPrefix(ref, SecretsManagerPrefix):
+			name, field, _ := strings.Cut(strings.TrimPrefix(ref, SecretsManagerPrefix), "#")
+			secret, ok := fetched[SecretsManagerPrefix+name]
+			if !ok {
+				if secret, err = getSecretValue(ctx, cfg, name); err != nil {
+					return fmt.Errorf("failed to get %s for %s, reason: %v", ref, key, err)
+				}
+				fetched[SecretsManagerPrefix+name] = secret
+			}
+			if value, err = secretField(secret, field); err != nil {
+				return fmt.Errorf("failed to get %s for %s, reason: %v", ref, key, err)
+			}
+		default:
+			if value, err = getParameter(ctx, cfg, strings.TrimPrefix(ref, ParameterStorePrefix)); err != nil {
+				return fmt.Errorf("failed to get %s for %s, reason: %v", ref, key, err)
+			}
+		}
+		viper.Set(key, value)
+		awsRefs[key] = ref
+		log.Debugf("resolved %s from %s", key, ref)
+	}
+
+	return nil
+}
+
+func isAWSRef(value string) bool {
+	return strings.HasPrefix(value, SecretsManagerPrefix) || strings.HasPrefix(value, ParameterStorePrefix)
+}
+
+// getSecretValue returns the string value of the secret name
+func getSecretValue(ctx context.Context, cfg aws.Config, name string) (string, error) {
+	res, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	if aws.ToString(res.SecretString) == "" {
+		return "", fmt.Errorf("secret %s has no string value", name)
+	}
+
+	return aws.ToString(res.SecretString), nil
+}
+
+// secretField returns the field of a JSON secret, or the whole secret when
+// no field is given
+func secretField(secret, field string) (string, error) {
+	if field == "" {
+		return secret, nil
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object")
+	}
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %s", field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	return fmt.Sprint(value), nil
+}
+
+// getParameter returns the decrypted value of the parameter name
+func getParameter(ctx context.Context, cfg aws.Config, name string) (string, error) {
+	res, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if res.Parameter == nil {
+		return "", fmt.Errorf("parameter %s has no value", name)
+	}
+
+	return aws.ToString(res.Parameter.Value), nil
+}
@@ -4,16 +4,22 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/neicnordic/crypt4gh/keys"
 	"github.com/neicnordic/sensitive-data-archive/internal/broker"
 	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
+	"github.com/neicnordic/sensitive-data-archive/internal/schedule"
 	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -25,12 +31,27 @@ const (
 
 var requiredConfVars []string
 
+// MissingError lists the required settings that are not set, or that name
+// an unknown storage type
+type MissingError struct {
+	Keys []string
+}
+
+func (e *MissingError) Error() string {
+	return strings.Join(e.Keys, ", ") + " not set"
+}
+
 // ServerConfig stores general server information
 type ServerConfig struct {
 	Cert          string
 	Key           string
 	Jwtpubkeypath string
 	Jwtpubkeyurl  string
+	JwtIssuers    []string
+	JwtAudiences  []string
+	JwtAlgorithms []string
+	JwtClockSkew  time.Duration
+	JwksRefresh   time.Duration
 	CORS          CORSConfig
 }
 
@@ -49,6 +70,29 @@ type Config struct {
 	SyncAPI      SyncAPIConf
 	ReEncrypt    ReEncConfig
 	Auth         AuthConf
+	Verify       VerifyConf
+	Metrics      MetricsConf
+	Tracing      TracingConf
+	// SchemaType is the deployment flavour the message schemas are picked
+	// for, federated or isolated
+	SchemaType string
+	// Settings are the resolved settings the configuration was made from,
+	// with the secrets masked
+	Settings []Setting
+}
+
+// MetricsConf is where the metrics of the service are served, they are not
+// served when Address is empty
+type MetricsConf struct {
+	Address string
+}
+
+// TracingConf is where the spans of the service are exported to, they are
+// not recorded when Endpoint is empty. Service names the service in the
+// traces.
+type TracingConf struct {
+	Endpoint string
+	Service  string
 }
 
 type ReEncConfig struct {
@@ -74,16 +118,35 @@ type SyncAPIConf struct {
 }
 
 type APIConf struct {
-	RBACpolicy []byte
-	CACert     string
-	ServerCert string
-	ServerKey  string
-	Host       string
-	Port       int
-	Session    SessionConfig
-	DB         *database.SDAdb
-	MQ         *broker.AMQPBroker
-	INBOX      storage.Backend
+	RBACpolicy       []byte
+	CACert           string
+	ServerCert       string
+	ServerKey        string
+	Host             string
+	Port             int
+	RetryAfter       time.Duration
+	ProjectScoping   bool
+	ProjectClaim     string
+	QuotaWarnings    []int
+	MissingReminder  time.Duration
+	EventPurge       *schedule.Schedule
+	EventRetention   time.Duration
+	EventKeepLatest  bool
+	UsageSummary     *schedule.Schedule
+	StatsRefresh     *schedule.Schedule
+	DatasetPrefix    string
+	DatasetDigits    int
+	ReadOnly         bool
+	ReleaseFeed      bool
+	ReleaseFeedSize  int
+	RequestTimeout   time.Duration
+	EndpointTimeouts map[string]time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	Session          SessionConfig
+	DB               *database.SDAdb
+	MQ               *broker.AMQPBroker
+	INBOX            storage.Backend
 }
 
 type SessionConfig struct {
@@ -95,10 +158,13 @@ type SessionConfig struct {
 }
 
 type SMTPConf struct {
-	Password string
-	FromAddr string
-	Host     string
-	Port     int
+	Password     string
+	FromAddr     string
+	Host         string
+	Port         int
+	Admins       []string
+	MailingLists []string
+	Webhook      string
 }
 
 type OrchestratorConf struct {
@@ -114,10 +180,12 @@ type OrchestratorConf struct {
 }
 
 type AuthConf struct {
-	OIDC            OIDCConfig
-	DB              *database.SDAdb
-	Cega            CegaConfig
-	JwtIssuer       string
+	OIDC      OIDCConfig
+	DB        *database.SDAdb
+	Cega      CegaConfig
+	JwtIssuer string
+	// JwtPrivateKey and JwtSignatureAlg are those of the primary signing
+	// key, that new tokens are signed with
 	JwtPrivateKey   string
 	JwtSignatureAlg string
 	JwtTTL          int
@@ -127,9 +195,95 @@ type AuthConf struct {
 	InfoURL         string
 	InfoText        string
 	PublicFile      string
+	// PublicKeys are the crypt4gh public keys that clients encrypt their
+	// files with, the key in PublicFile comes first
+	PublicKeys []C4GHPublicKey
+	// DeviceCodeTTL is how long the user has to log in for a command line
+	// tool with the device flow, which polls every DevicePollInterval
+	DeviceCodeTTL      time.Duration
+	DevicePollInterval time.Duration
+	// DeviceCodeLimit is how many device codes an address may ask for per
+	// minute, there is no limit when it is 0
+	DeviceCodeLimit int
+	// PublicURL is the URL that users open auth at, that the device flow
+	// sends them to
+	PublicURL string
+	// RefreshTTL is how long the refresh tokens handed out with the
+	// access tokens are valid, none are handed out when it is 0
+	RefreshTTL time.Duration
+	// JwtAudience and JwtClaims are added to the tokens that auth signs,
+	// JwtGroupsClaim names the claim with the groups of the user, if any
+	JwtAudience    []string
+	JwtClaims      map[string]any
+	JwtGroupsClaim string
+	// JwtSigningKeys are all keys that the tokens of auth may be signed
+	// with, the key in JwtPrivateKey comes first
+	JwtSigningKeys []JwtSigningKey
+	// GroupMappings assign inbox prefixes and projects to the members of
+	// groups, that are added to the tokens
+	GroupMappings []GroupMapping
+	WebAuthn      WebAuthnConfig
+	TOTP          TOTPConfig
+	// AuditRetention is how long the audit log of the logins is kept in
+	// the database, it is kept forever when 0
+	AuditRetention time.Duration
+	// RemoteAddrHeaders are headers set by a proxy in front of auth that
+	// the address of the user is read from, e.g. X-Forwarded-For
+	RemoteAddrHeaders []string
+	LoginLimit        LoginLimitConfig
+}
+
+// LoginLimitConfig limits the failed logins with a password or a TOTP
+// code: an address or an account with too many failures within Window is
+// locked out for Lockout. A limit of 0 turns it off.
+type LoginLimitConfig struct {
+	AddressFailures int
+	AccountFailures int
+	Window          time.Duration
+	Lockout         time.Duration
+}
+
+// GroupMapping assigns inbox prefixes, under which the members of the group
+// may upload, and projects to the members of a group
+type GroupMapping struct {
+	Group         string   `mapstructure:"group"`
+	InboxPrefixes []string `mapstructure:"inboxPrefixes"`
+	Projects      []string `mapstructure:"projects"`
+}
+
+// JwtSigningKey is a key that auth signs tokens with, listed in
+// auth.jwt.signingKeys. Only the primary key signs new tokens, the others
+// are published until the tokens signed with them have expired.
+type JwtSigningKey struct {
+	FilePath     string `mapstructure:"filePath"`
+	SignatureAlg string `mapstructure:"signatureAlg"`
+	Primary      bool   `mapstructure:"primary"`
+}
+
+// WebAuthnConfig holds the settings of the WebAuthn (passkey) second factor
+type WebAuthnConfig struct {
+	Enabled bool
+	// RPID is the host name that the credentials are bound to, Origin the
+	// URL that users open auth at
+	RPID   string
+	RPName string
+	Origin string
+	// Roles are the groups whose members must log in with a second factor,
+	// "*" makes everyone do so
+	Roles []string
+}
+
+// TOTPConfig holds the settings of the TOTP (authenticator app) second
+// factor of the logins with a password
+type TOTPConfig struct {
+	Enabled bool
+	// Issuer is the name that authenticator apps show the codes under
+	Issuer string
 }
 
 type OIDCConfig struct {
+	// Enabled tells whether users can log in with OIDC
+	Enabled       bool
 	ID            string
 	Provider      string
 	RedirectURL   string
@@ -139,6 +293,8 @@ type OIDCConfig struct {
 }
 
 type CegaConfig struct {
+	// Enabled tells whether users can log in with their EGA credentials
+	Enabled bool
 	AuthURL string
 	ID      string
 	Secret  string
@@ -151,21 +307,149 @@ type CORSConfig struct {
 	AllowCredentials bool
 }
 
+// EndpointTimeoutConf sets the request timeout, in seconds, for a route
+type EndpointTimeoutConf struct {
+	Path    string `mapstructure:"path"`
+	Timeout int    `mapstructure:"timeout"`
+}
+
+// C4GHPublicKeyConf is a crypt4gh public key listed in auth.publicKeys, the
+// times are in RFC 3339 format
+type C4GHPublicKeyConf struct {
+	FilePath   string `mapstructure:"filePath"`
+	ValidFrom  string `mapstructure:"validFrom"`
+	ValidUntil string `mapstructure:"validUntil"`
+	Preferred  bool   `mapstructure:"preferred"`
+}
+
+// C4GHPublicKey is a crypt4gh public key that clients may encrypt with in
+// the period it is valid in, a zero time leaves that end of the period open.
+// The preferred key is the one to encrypt with while it is valid.
+type C4GHPublicKey struct {
+	FilePath   string
+	ValidFrom  time.Time
+	ValidUntil time.Time
+	Preferred  bool
+}
+
 type C4GHprivateKeyConf struct {
 	FilePath   string `mapstructure:"filePath"`
 	Passphrase string `mapstructure:"passphrase"`
 }
 
+type VerifyConf struct {
+	Validators []ValidatorConf
+}
+
+// ValidatorConf describes an external validator plugin, the policy decides
+// if a failed validation rejects the file (required), only gets logged
+// (advisory) or if the plugin is skipped altogether (disabled).
+type ValidatorConf struct {
+	Name    string `mapstructure:"name"`
+	Address string `mapstructure:"address"`
+	Policy  string `mapstructure:"policy"`
+	Timeout int    `mapstructure:"timeout"`
+	CACert  string `mapstructure:"cacert"`
+}
+
 // NewConfig initializes and parses the config file and/or environment using
-// the viper library.
+// the viper library. When the service is started with --validate the
+// configuration is checked with Validate, the problems are printed and the
+// service exits.
 func NewConfig(app string) (*Config, error) {
+	c, err := readConfig(app)
+	if err == nil {
+		c.Settings = Settings()
+		if viper.GetBool("log.dumpConfig") {
+			for _, s := range c.Settings {
+				log.Infof("config %s = %v (%s)", s.Key, s.Value, s.Source)
+			}
+		}
+	}
+	if !viper.GetBool("validate") {
+		return c, err
+	}
+
+	if err == nil {
+		err = c.Validate()
+	}
+	os.Exit(reportValidation(os.Stdout, app, err))
+
+	return nil, nil
+}
+
+// reportValidation prints the outcome of validating the configuration of app
+// to w, one problem per line, and returns the exit code of the service
+func reportValidation(w io.Writer, app string, err error) int {
+	if err == nil {
+		fmt.Fprintf(w, "the configuration of %s is valid\n", app)
+
+		return 0
+	}
+
+	fmt.Fprintf(w, "the configuration of %s is invalid:\n", app)
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(w, "  - %s\n", line)
+	}
+
+	return 1
+}
+
+// outboundConf returns the proxy and CA settings of the outbound clients,
+// the CA files are given as a list or separated by commas
+func outboundConf() outbound.Conf {
+	conf := outbound.Conf{
+		HTTPProxy:  viper.GetString("outbound.httpProxy"),
+		HTTPSProxy: viper.GetString("outbound.httpsProxy"),
+		NoProxy:    viper.GetString("outbound.noProxy"),
+	}
+	for _, files := range viper.GetStringSlice("outbound.caCerts") {
+		for _, file := range strings.Split(files, ",") {
+			if file = strings.TrimSpace(file); file != "" {
+				conf.CACerts = append(conf.CACerts, file)
+			}
+		}
+	}
+
+	return conf
+}
+
+// loginEnabled reports whether the login backend with the settings under
+// prefix is used. It is when its enabled setting says so or, when that is
+// not set, when its id and secret are set.
+func loginEnabled(prefix string) bool {
+	if viper.IsSet(prefix + ".enabled") {
+		return viper.GetBool(prefix + ".enabled")
+	}
+
+	return viper.GetString(prefix+".id") != "" && viper.GetString(prefix+".secret") != ""
+}
+
+// readConfig reads the configuration of app
+func readConfig(app string) (*Config, error) {
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	setEnvPrefix()
 	viper.SetConfigType("yaml")
 	viper.SetDefault("schema.type", "federated")
 
+	flags := pflag.NewFlagSet(app, pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.Bool("migrate", false, "apply the database schema migrations before starting")
+	flags.Bool("validate", false, "check the configuration and exit")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		log.Debugf("failed to parse command line flags: %v", err)
+	}
+	if err := viper.BindPFlag("db.migrate", flags.Lookup("migrate")); err != nil {
+		return nil, err
+	}
+	if err := viper.BindPFlag("validate", flags.Lookup("validate")); err != nil {
+		return nil, err
+	}
+	commandLine = flags
+
 	if viper.IsSet("configPath") {
 		cp := viper.GetString("configPath")
 		log.Infof("configPath: %s", cp)
@@ -189,6 +473,20 @@ func NewConfig(app string) (*Config, error) {
 		}
 	}
 
+	if err := resolveSecretFiles(); err != nil {
+		return nil, err
+	}
+	if err := outbound.Configure(outboundConf()); err != nil {
+		return nil, err
+	}
+	if err := readRemoteConfig(); err != nil {
+		return nil, err
+	}
+	resolveAliases()
+	if err := resolveAWSValues(); err != nil {
+		return nil, err
+	}
+
 	if viper.IsSet("log.format") {
 		if viper.GetString("log.format") == "json" {
 			log.SetFormatter(&log.JSONFormatter{})
@@ -207,6 +505,9 @@ func NewConfig(app string) (*Config, error) {
 		log.Infof("Setting log level to '%s'", stringLevel)
 	}
 
+	// the required settings that are not set are collected, so that they
+	// can be reported together
+	var missing []string
 	switch app {
 	case "api":
 		requiredConfVars = []string{
@@ -223,16 +524,15 @@ func NewConfig(app string) (*Config, error) {
 		}
 		switch viper.GetString("inbox.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"inbox.url", "inbox.accesskey", "inbox.secretkey", "inbox.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("inbox")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"inbox.location"}...)
 		default:
-			return nil, fmt.Errorf("inbox.type not set")
+			missing = append(missing, "inbox.type")
 		}
 	case "auth":
 		requiredConfVars = []string{
 			"auth.s3Inbox",
-			"auth.publicFile",
 			"db.host",
 			"db.port",
 			"db.user",
@@ -240,17 +540,28 @@ func NewConfig(app string) (*Config, error) {
 			"db.database",
 		}
 
-		if viper.GetString("auth.cega.id") != "" && viper.GetString("auth.cega.secret") != "" {
-			requiredConfVars = append(requiredConfVars, []string{"auth.cega.authUrl"}...)
+		if loginEnabled("auth.cega") {
+			requiredConfVars = append(requiredConfVars, []string{"auth.cega.authUrl", "auth.cega.id", "auth.cega.secret"}...)
 			viper.Set("auth.resignJwt", true)
 		}
 
-		if viper.GetString("oidc.id") != "" && viper.GetString("oidc.secret") != "" {
-			requiredConfVars = append(requiredConfVars, []string{"oidc.provider", "oidc.redirectUrl"}...)
+		if loginEnabled("oidc") {
+			requiredConfVars = append(requiredConfVars, []string{"oidc.id", "oidc.secret", "oidc.provider", "oidc.redirectUrl"}...)
+		}
+
+		if viper.GetBool("auth.webauthn.enabled") {
+			requiredConfVars = append(requiredConfVars, "auth.webauthn.origin")
+		}
+
+		if !viper.IsSet("auth.publicKeys") {
+			requiredConfVars = append(requiredConfVars, "auth.publicFile")
 		}
 
 		if viper.GetBool("auth.resignJwt") {
-			requiredConfVars = append(requiredConfVars, []string{"auth.jwt.issuer", "auth.jwt.privateKey", "auth.jwt.signatureAlg", "auth.jwt.tokenTTL"}...)
+			requiredConfVars = append(requiredConfVars, []string{"auth.jwt.issuer", "auth.jwt.tokenTTL"}...)
+			if !viper.IsSet("auth.jwt.signingKeys") {
+				requiredConfVars = append(requiredConfVars, []string{"auth.jwt.privateKey", "auth.jwt.signatureAlg"}...)
+			}
 		}
 	case "ingest":
 		requiredConfVars = []string{
@@ -269,20 +580,20 @@ func NewConfig(app string) (*Config, error) {
 
 		switch viper.GetString("archive.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"archive.url", "archive.accesskey", "archive.secretkey", "archive.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("archive")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"archive.location"}...)
 		default:
-			return nil, fmt.Errorf("archive.type not set")
+			missing = append(missing, "archive.type")
 		}
 
 		switch viper.GetString("inbox.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"inbox.url", "inbox.accesskey", "inbox.secretkey", "inbox.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("inbox")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"inbox.location"}...)
 		default:
-			return nil, fmt.Errorf("inbox.type not set")
+			missing = append(missing, "inbox.type")
 		}
 	case "finalize":
 		requiredConfVars = []string{
@@ -301,14 +612,14 @@ func NewConfig(app string) (*Config, error) {
 
 		switch viper.GetString("archive.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"archive.url", "archive.accesskey", "archive.secretkey", "archive.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("archive")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"archive.location"}...)
 		}
 
 		switch viper.GetString("backup.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"backup.url", "backup.accesskey", "backup.secretkey", "backup.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("backup")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"backup.location"}...)
 		}
@@ -337,7 +648,7 @@ func NewConfig(app string) (*Config, error) {
 
 		switch viper.GetString("inbox.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"inbox.url", "inbox.accesskey", "inbox.secretkey", "inbox.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("inbox")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"inbox.location"}...)
 		}
@@ -375,11 +686,8 @@ func NewConfig(app string) (*Config, error) {
 			"broker.user",
 			"broker.password",
 			"broker.routingkey",
-			"inbox.url",
-			"inbox.accesskey",
-			"inbox.secretkey",
-			"inbox.bucket",
 		}
+		requiredConfVars = append(requiredConfVars, s3RequiredConfVars("inbox")...)
 		viper.Set("inbox.type", S3)
 	case "sync":
 		requiredConfVars = []string{
@@ -404,22 +712,22 @@ func NewConfig(app string) (*Config, error) {
 
 		switch viper.GetString("archive.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"archive.url", "archive.accesskey", "archive.secretkey", "archive.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("archive")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"archive.location"}...)
 		default:
-			return nil, fmt.Errorf("archive.type not set")
+			missing = append(missing, "archive.type")
 		}
 
 		switch viper.GetString("sync.destination.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"sync.destination.url", "sync.destination.accesskey", "sync.destination.secretkey", "sync.destination.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("sync.destination")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"sync.destination.location"}...)
 		case SFTP:
 			requiredConfVars = append(requiredConfVars, []string{"sync.destination.sftp.host", "sync.destination.sftp.port", "sync.destination.sftp.userName", "sync.destination.sftp.pemKeyPath", "sync.destination.sftp.pemKeyPass"}...)
 		default:
-			return nil, fmt.Errorf("sync.destination.type not set")
+			missing = append(missing, "sync.destination.type")
 		}
 	case "sync-api":
 		requiredConfVars = []string{
@@ -448,11 +756,11 @@ func NewConfig(app string) (*Config, error) {
 
 		switch viper.GetString("archive.type") {
 		case S3:
-			requiredConfVars = append(requiredConfVars, []string{"archive.url", "archive.accesskey", "archive.secretkey", "archive.bucket"}...)
+			requiredConfVars = append(requiredConfVars, s3RequiredConfVars("archive")...)
 		case POSIX:
 			requiredConfVars = append(requiredConfVars, []string{"archive.location"}...)
 		default:
-			return nil, fmt.Errorf("archive.type not set")
+			missing = append(missing, "archive.type")
 		}
 
 	default:
@@ -460,12 +768,20 @@ func NewConfig(app string) (*Config, error) {
 	}
 
 	for _, s := range requiredConfVars {
-		if !viper.IsSet(s) {
-			return nil, fmt.Errorf("%s not set", s)
+		if !viper.IsSet(s) && !slices.Contains(missing, s) {
+			missing = append(missing, s)
 		}
 	}
+	if len(missing) > 0 {
+		return nil, &MissingError{Keys: missing}
+	}
+	if err := checkValues(); err != nil {
+		return nil, err
+	}
 
 	c := &Config{}
+	c.Metrics.Address = viper.GetString("metrics.address")
+	c.Tracing = TracingConf{Endpoint: viper.GetString("tracing.endpoint"), Service: app}
 	switch app {
 	case "api":
 		err := c.configBroker()
@@ -480,6 +796,11 @@ func NewConfig(app string) (*Config, error) {
 
 		c.configInbox()
 
+		// the archive is only used for health checks in the api
+		if viper.IsSet("archive.type") {
+			c.configArchive()
+		}
+
 		err = c.configAPI()
 		if err != nil {
 			return nil, err
@@ -495,10 +816,12 @@ func NewConfig(app string) (*Config, error) {
 		}
 		c.configSchemas()
 	case "auth":
+		c.Auth.Cega.Enabled = loginEnabled("auth.cega")
 		c.Auth.Cega.AuthURL = viper.GetString("auth.cega.authUrl")
 		c.Auth.Cega.ID = viper.GetString("auth.cega.id")
 		c.Auth.Cega.Secret = viper.GetString("auth.cega.secret")
 
+		c.Auth.OIDC.Enabled = loginEnabled("oidc")
 		c.Auth.OIDC.ID = viper.GetString("oidc.id")
 		c.Auth.OIDC.Provider = viper.GetString("oidc.provider")
 		c.Auth.OIDC.RedirectURL = viper.GetString("oidc.redirectUrl")
@@ -507,27 +830,109 @@ func NewConfig(app string) (*Config, error) {
 			c.Auth.OIDC.JwkURL = c.Auth.OIDC.Provider + viper.GetString("oidc.jwkPath")
 		}
 
-		if (c.Auth.OIDC.ID == "" || c.Auth.OIDC.Secret == "") && (c.Auth.Cega.ID == "" || c.Auth.Cega.Secret == "") {
+		if !c.Auth.OIDC.Enabled && !c.Auth.Cega.Enabled {
 			return nil, fmt.Errorf("neither cega or oidc login configured")
 		}
 
 		c.Auth.InfoURL = viper.GetString("auth.infoUrl")
 		c.Auth.InfoText = viper.GetString("auth.infoText")
 		c.Auth.PublicFile = viper.GetString("auth.publicFile")
-		if _, err := os.Stat(c.Auth.PublicFile); err != nil {
+		publicKeys, err := getC4GHPublicKeys()
+		if err != nil {
 			return nil, err
 		}
+		c.Auth.PublicKeys = publicKeys
+
+		c.Auth.DeviceCodeTTL = 10 * time.Minute
+		if viper.IsSet("auth.device.codeTTL") {
+			c.Auth.DeviceCodeTTL = time.Duration(viper.GetInt("auth.device.codeTTL")) * time.Second
+		}
+		c.Auth.DevicePollInterval = 5 * time.Second
+		if viper.IsSet("auth.device.pollInterval") {
+			c.Auth.DevicePollInterval = time.Duration(viper.GetInt("auth.device.pollInterval")) * time.Second
+		}
+		c.Auth.DeviceCodeLimit = 10
+		if viper.IsSet("auth.device.codeLimit") {
+			c.Auth.DeviceCodeLimit = viper.GetInt("auth.device.codeLimit")
+		}
 
 		if viper.GetBool("auth.resignJwt") {
 			c.Auth.ResignJwt = viper.GetBool("auth.resignJwt")
-			c.Auth.JwtPrivateKey = viper.GetString("auth.jwt.privateKey")
-			c.Auth.JwtSignatureAlg = viper.GetString("auth.jwt.signatureAlg")
+			if c.Auth.JwtSigningKeys, err = getJwtSigningKeys(); err != nil {
+				return nil, err
+			}
+			for _, key := range c.Auth.JwtSigningKeys {
+				if key.Primary {
+					c.Auth.JwtPrivateKey = key.FilePath
+					c.Auth.JwtSignatureAlg = key.SignatureAlg
+				}
+			}
 			c.Auth.JwtIssuer = viper.GetString("auth.jwt.issuer")
 			c.Auth.JwtTTL = viper.GetInt("auth.jwt.tokenTTL")
-
-			if _, err := os.Stat(c.Auth.JwtPrivateKey); err != nil {
+			c.Auth.JwtAudience = viper.GetStringSlice("auth.jwt.audience")
+			c.Auth.JwtClaims = viper.GetStringMap("auth.jwt.claims")
+			c.Auth.JwtGroupsClaim = viper.GetString("auth.jwt.groupsClaim")
+			if c.Auth.GroupMappings, err = getGroupMappings(); err != nil {
 				return nil, err
 			}
+			// claims given in the environment are a JSON object, that is
+			// empty when it can not be parsed
+			if raw, ok := viper.Get("auth.jwt.claims").(string); ok && len(c.Auth.JwtClaims) == 0 && strings.TrimSpace(raw) != "" && strings.TrimSpace(raw) != "{}" {
+				return nil, &InvalidValueError{Key: "auth.jwt.claims", Value: raw, Expected: `a JSON object such as {"project": "sda"}`}
+			}
+			c.Auth.RefreshTTL = 30 * 24 * time.Hour
+			if viper.IsSet("auth.jwt.refreshTTL") {
+				c.Auth.RefreshTTL = time.Duration(viper.GetInt("auth.jwt.refreshTTL")) * time.Hour
+			}
+		}
+
+		if viper.GetBool("auth.webauthn.enabled") {
+			c.Auth.WebAuthn = WebAuthnConfig{
+				Enabled: true,
+				RPID:    viper.GetString("auth.webauthn.rpID"),
+				RPName:  viper.GetString("auth.webauthn.rpName"),
+				Origin:  strings.TrimSuffix(viper.GetString("auth.webauthn.origin"), "/"),
+				Roles:   viper.GetStringSlice("auth.webauthn.roles"),
+			}
+			if c.Auth.WebAuthn.RPID == "" {
+				u, _ := url.Parse(c.Auth.WebAuthn.Origin)
+				c.Auth.WebAuthn.RPID = u.Hostname()
+			}
+			if c.Auth.WebAuthn.RPName == "" {
+				c.Auth.WebAuthn.RPName = "SDA"
+			}
+		}
+
+		c.Auth.PublicURL = strings.TrimSuffix(viper.GetString("auth.publicUrl"), "/")
+		if c.Auth.PublicURL == "" {
+			c.Auth.PublicURL = c.Auth.WebAuthn.Origin
+		}
+
+		if viper.GetBool("auth.totp.enabled") {
+			c.Auth.TOTP = TOTPConfig{Enabled: true, Issuer: viper.GetString("auth.totp.issuer")}
+			if c.Auth.TOTP.Issuer == "" {
+				c.Auth.TOTP.Issuer = "SDA"
+			}
+		}
+
+		c.Auth.AuditRetention = 90 * 24 * time.Hour
+		if viper.IsSet("auth.audit.retention") {
+			c.Auth.AuditRetention = time.Duration(viper.GetInt("auth.audit.retention")) * 24 * time.Hour
+		}
+		c.Auth.RemoteAddrHeaders = viper.GetStringSlice("auth.remoteAddrHeaders")
+
+		c.Auth.LoginLimit = LoginLimitConfig{AddressFailures: 20, AccountFailures: 5, Window: 15 * time.Minute, Lockout: 15 * time.Minute}
+		if viper.IsSet("auth.loginLimit.addressFailures") {
+			c.Auth.LoginLimit.AddressFailures = viper.GetInt("auth.loginLimit.addressFailures")
+		}
+		if viper.IsSet("auth.loginLimit.accountFailures") {
+			c.Auth.LoginLimit.AccountFailures = viper.GetInt("auth.loginLimit.accountFailures")
+		}
+		if viper.IsSet("auth.loginLimit.window") {
+			c.Auth.LoginLimit.Window = time.Duration(viper.GetInt("auth.loginLimit.window")) * time.Second
+		}
+		if viper.IsSet("auth.loginLimit.lockout") {
+			c.Auth.LoginLimit.Lockout = time.Duration(viper.GetInt("auth.loginLimit.lockout")) * time.Second
 		}
 
 		cors := CORSConfig{AllowCredentials: false}
@@ -553,7 +958,7 @@ func NewConfig(app string) (*Config, error) {
 		}
 
 		c.Auth.S3Inbox = viper.GetString("auth.s3Inbox")
-		err := c.configDatabase()
+		err = c.configDatabase()
 		if err != nil {
 			return nil, err
 		}
@@ -677,6 +1082,11 @@ func NewConfig(app string) (*Config, error) {
 			return nil, err
 		}
 
+		err = c.configVerify()
+		if err != nil {
+			return nil, err
+		}
+
 		c.configSchemas()
 	}
 
@@ -699,6 +1109,68 @@ func (c *Config) configAPI() error {
 	api.ServerKey = viper.GetString("api.serverKey")
 	api.ServerCert = viper.GetString("api.serverCert")
 	api.CACert = viper.GetString("api.CACert")
+	api.RetryAfter = time.Duration(viper.GetInt("api.retryAfter")) * time.Second
+	api.ProjectScoping = viper.GetBool("api.projectScoping")
+	api.ProjectClaim = viper.GetString("api.projectClaim")
+	api.DatasetPrefix = viper.GetString("api.datasetIDPrefix")
+	api.DatasetDigits = viper.GetInt("api.datasetIDDigits")
+	api.ReadOnly = viper.GetBool("api.readOnly")
+	api.ReleaseFeed = viper.GetBool("api.releaseFeed")
+	api.ReleaseFeedSize = viper.GetInt("api.releaseFeedSize")
+	if api.ReleaseFeedSize < 1 {
+		return fmt.Errorf("api.releaseFeedSize must be at least 1, got %d", api.ReleaseFeedSize)
+	}
+	api.RequestTimeout = time.Duration(viper.GetInt("api.requestTimeout")) * time.Second
+	api.BreakerThreshold = viper.GetInt("api.breakerThreshold")
+	api.BreakerCooldown = time.Duration(viper.GetInt("api.breakerCooldown")) * time.Second
+
+	var endpointTimeouts []EndpointTimeoutConf
+	if err := viper.UnmarshalKey("api.endpointTimeouts", &endpointTimeouts); err != nil {
+		return fmt.Errorf("failed to parse api.endpointTimeouts: %v", err)
+	}
+	api.EndpointTimeouts = map[string]time.Duration{}
+	for _, e := range endpointTimeouts {
+		if e.Path == "" || e.Timeout < 0 {
+			return fmt.Errorf("api.endpointTimeouts requires a path and a non negative timeout")
+		}
+		api.EndpointTimeouts[e.Path] = time.Duration(e.Timeout) * time.Second
+	}
+
+	api.QuotaWarnings = viper.GetIntSlice("api.quotaWarnings")
+	for _, t := range api.QuotaWarnings {
+		if t < 1 || t > 100 {
+			return fmt.Errorf("api.quotaWarnings must be percentages between 1 and 100, got %d", t)
+		}
+	}
+
+	api.MissingReminder = time.Duration(viper.GetInt("api.missingFilesReminder")) * time.Hour
+	if api.MissingReminder < 0 {
+		return fmt.Errorf("api.missingFilesReminder must not be negative, got %d", viper.GetInt("api.missingFilesReminder"))
+	}
+
+	if expr := viper.GetString("api.eventPurgeSchedule"); expr != "" {
+		var err error
+		if api.EventPurge, err = schedule.Parse(expr); err != nil {
+			return fmt.Errorf("api.eventPurgeSchedule: %v", err)
+		}
+	}
+	api.EventRetention = time.Duration(viper.GetInt("api.eventRetentionDays")) * 24 * time.Hour
+	if api.EventRetention <= 0 {
+		return fmt.Errorf("api.eventRetentionDays must be at least 1, got %d", viper.GetInt("api.eventRetentionDays"))
+	}
+	api.EventKeepLatest = viper.GetBool("api.eventPurgeKeepLatest")
+	if expr := viper.GetString("api.usageSummarySchedule"); expr != "" {
+		var err error
+		if api.UsageSummary, err = schedule.Parse(expr); err != nil {
+			return fmt.Errorf("api.usageSummarySchedule: %v", err)
+		}
+	}
+	if expr := viper.GetString("api.statsRefreshSchedule"); expr != "" {
+		var err error
+		if api.StatsRefresh, err = schedule.Parse(expr); err != nil {
+			return fmt.Errorf("api.statsRefreshSchedule: %v", err)
+		}
+	}
 
 	c.API = api
 
@@ -709,6 +1181,19 @@ func (c *Config) configAPI() error {
 func (c *Config) apiDefaults() {
 	viper.SetDefault("api.host", "0.0.0.0")
 	viper.SetDefault("api.port", 8080)
+	viper.SetDefault("api.retryAfter", 30)
+	viper.SetDefault("api.projectClaim", "projects")
+	viper.SetDefault("api.quotaWarnings", []int{80, 95})
+	viper.SetDefault("api.missingFilesReminder", 72)
+	viper.SetDefault("api.eventRetentionDays", 730)
+	viper.SetDefault("api.eventPurgeKeepLatest", true)
+	viper.SetDefault("api.usageSummarySchedule", "0 1 * * *")
+	viper.SetDefault("api.statsRefreshSchedule", "*/10 * * * *")
+	viper.SetDefault("api.datasetIDDigits", 8)
+	viper.SetDefault("api.releaseFeedSize", 50)
+	viper.SetDefault("api.requestTimeout", 60)
+	viper.SetDefault("api.breakerThreshold", 5)
+	viper.SetDefault("api.breakerCooldown", 30)
 	viper.SetDefault("api.session.expiration", -1)
 	viper.SetDefault("api.session.secure", true)
 	viper.SetDefault("api.session.httponly", true)
@@ -765,6 +1250,22 @@ func (c *Config) configBroker() error {
 		broker.Exchange = viper.GetString("broker.exchange")
 	}
 
+	if viper.IsSet("broker.exchanges") {
+		broker.Exchanges = viper.GetStringMapString("broker.exchanges")
+	}
+	if viper.IsSet("broker.routes") {
+		broker.Routes = viper.GetStringMapStringSlice("broker.routes")
+		// the names of the exchanges are keys, which viper lowercases
+		for key, names := range broker.Routes {
+			for i, name := range names {
+				names[i] = strings.ToLower(name)
+				if _, ok := broker.Exchanges[names[i]]; !ok {
+					return fmt.Errorf("broker.routes.%s names the unknown exchange %s", key, name)
+				}
+			}
+		}
+	}
+
 	if viper.IsSet("broker.vhost") {
 		if strings.HasPrefix(viper.GetString("broker.vhost"), "/") {
 			broker.Vhost = viper.GetString("broker.vhost")
@@ -793,11 +1294,127 @@ func (c *Config) configBroker() error {
 	if viper.IsSet("broker.cacert") {
 		broker.CACert = viper.GetString("broker.cacert")
 	}
+	if viper.IsSet("broker.managementURL") {
+		broker.ManagementURL = viper.GetString("broker.managementURL")
+	}
 
 	broker.PrefetchCount = 2
 	if viper.IsSet("broker.prefetchCount") {
 		broker.PrefetchCount = viper.GetInt("broker.prefetchCount")
+		if broker.PrefetchCount < 0 {
+			return errors.New("broker.prefetchCount can not be negative")
+		}
+	}
+
+	if viper.IsSet("broker.standbyHosts") {
+		broker.StandbyHosts = viper.GetStringSlice("broker.standbyHosts")
+	}
+
+	broker.FailbackInterval = time.Minute
+	if viper.IsSet("broker.failbackInterval") {
+		interval := viper.GetInt("broker.failbackInterval")
+		if interval < 0 {
+			return errors.New("broker.failbackInterval can not be negative")
+		}
+		broker.FailbackInterval = time.Duration(interval) * time.Second
+	}
+
+	broker.PublishRetries = 3
+	if viper.IsSet("broker.publishRetries") {
+		broker.PublishRetries = viper.GetInt("broker.publishRetries")
+		if broker.PublishRetries < 0 {
+			return errors.New("broker.publishRetries can not be negative")
+		}
+	}
+	broker.SpoolDir = viper.GetString("broker.spoolDir")
+
+	if viper.IsSet("broker.retryDelay") {
+		delay := viper.GetInt("broker.retryDelay")
+		if delay < 0 {
+			return errors.New("broker.retryDelay can not be negative")
+		}
+		broker.RetryDelay = time.Duration(delay) * time.Second
+	}
+
+	broker.DeadLetterExchange = viper.GetString("broker.deadLetterExchange")
+	if viper.IsSet("broker.deliveryLimit") {
+		broker.DeliveryLimit = viper.GetInt("broker.deliveryLimit")
+		if broker.DeliveryLimit < 0 {
+			return errors.New("broker.deliveryLimit can not be negative")
+		}
+	}
+
+	if viper.IsSet("broker.quarantineAfter") {
+		broker.QuarantineAfter = viper.GetInt("broker.quarantineAfter")
+		if broker.QuarantineAfter < 0 {
+			return errors.New("broker.quarantineAfter can not be negative")
+		}
+	}
+
+	broker.Dedup = viper.GetString("broker.dedup")
+	if broker.Dedup != "" && broker.Dedup != "memory" && broker.Dedup != "database" {
+		return errors.New("broker.dedup must be memory or database")
+	}
+	broker.DedupTTL = 24 * time.Hour
+	if viper.IsSet("broker.dedupTTL") {
+		ttl := viper.GetInt("broker.dedupTTL")
+		if ttl <= 0 {
+			return errors.New("broker.dedupTTL must be positive")
+		}
+		broker.DedupTTL = time.Duration(ttl) * time.Second
+	}
+
+	if viper.IsSet("broker.maxPriority") {
+		broker.MaxPriority = viper.GetInt("broker.maxPriority")
+		if broker.MaxPriority < 0 || broker.MaxPriority > 255 {
+			return errors.New("broker.maxPriority must be between 0 and 255")
+		}
+	}
+
+	broker.QueueType = viper.GetString("broker.queueType")
+	switch broker.QueueType {
+	case "", "quorum":
+	case "classic":
+		if broker.DeliveryLimit > 0 {
+			return errors.New("broker.deliveryLimit needs quorum queues")
+		}
+	default:
+		return errors.New("broker.queueType must be classic or quorum")
 	}
+	quorum := broker.QueueType == "quorum" || (broker.QueueType == "" && broker.DeliveryLimit > 0)
+
+	broker.LazyQueues = viper.GetBool("broker.lazyQueues")
+	if broker.LazyQueues && quorum {
+		return errors.New("broker.lazyQueues can not be used with quorum queues")
+	}
+
+	if viper.IsSet("broker.maxLength") {
+		broker.MaxLength = viper.GetInt("broker.maxLength")
+		if broker.MaxLength < 0 {
+			return errors.New("broker.maxLength can not be negative")
+		}
+	}
+
+	broker.Overflow = viper.GetString("broker.overflow")
+	switch broker.Overflow {
+	case "", "drop-head", "reject-publish":
+	case "reject-publish-dlx":
+		if quorum {
+			return errors.New("broker.overflow reject-publish-dlx can not be used with quorum queues")
+		}
+	default:
+		return errors.New("broker.overflow must be drop-head, reject-publish or reject-publish-dlx")
+	}
+
+	broker.Type = "rabbitmq"
+	if viper.IsSet("broker.type") {
+		broker.Type = viper.GetString("broker.type")
+		if broker.Type != "rabbitmq" && broker.Type != "nats" {
+			return errors.New("broker.type must be rabbitmq or nats")
+		}
+	}
+	viper.SetDefault("broker.stream", "sda")
+	broker.Stream = viper.GetString("broker.stream")
 
 	c.Broker = broker
 
@@ -833,6 +1450,38 @@ func (c *Config) configDatabase() error {
 		db.CACert = viper.GetString("db.cacert")
 	}
 
+	viper.SetDefault("db.retryTimes", 5)
+	viper.SetDefault("db.retryDelay", 500)
+	viper.SetDefault("db.retryMaxDelay", 30000)
+	viper.SetDefault("db.retryJitter", 0.2)
+	db.RetryTimes = viper.GetInt("db.retryTimes")
+	db.RetryDelay = time.Duration(viper.GetInt("db.retryDelay")) * time.Millisecond
+	db.RetryMaxDelay = time.Duration(viper.GetInt("db.retryMaxDelay")) * time.Millisecond
+	db.RetryJitter = viper.GetFloat64("db.retryJitter")
+	if db.RetryTimes < 1 || db.RetryDelay < 0 || db.RetryMaxDelay < 0 {
+		return errors.New("db.retryTimes must be at least 1 and the retry delays can not be negative")
+	}
+	if db.RetryJitter < 0 || db.RetryJitter > 1 {
+		return errors.New("db.retryJitter must be between 0 and 1")
+	}
+
+	viper.SetDefault("db.maxOpenConns", 25)
+	viper.SetDefault("db.maxIdleConns", 5)
+	viper.SetDefault("db.connMaxLifetime", 1800)
+	db.MaxOpenConns = viper.GetInt("db.maxOpenConns")
+	db.MaxIdleConns = viper.GetInt("db.maxIdleConns")
+	db.ConnMaxLifetime = time.Duration(viper.GetInt("db.connMaxLifetime")) * time.Second
+	if db.MaxOpenConns < 0 || db.MaxIdleConns < 0 || db.ConnMaxLifetime < 0 {
+		return errors.New("db.maxOpenConns, db.maxIdleConns and db.connMaxLifetime can not be negative")
+	}
+
+	db.Migrate = viper.GetBool("db.migrate")
+	db.SchemaWait = time.Duration(viper.GetInt("db.schemaWait")) * time.Second
+	if db.SchemaWait < 0 {
+		return errors.New("db.schemaWait can not be negative")
+	}
+	db.ReplicaDSN = viper.GetString("db.replicaDSN")
+
 	c.Database = db
 
 	return nil
@@ -930,10 +1579,38 @@ func (c *Config) configReEncryptServer() (err error) {
 	return nil
 }
 
+// configVerify provides configuration for the validator plugins used by verify
+func (c *Config) configVerify() error {
+	var validators []ValidatorConf
+	if err := viper.UnmarshalKey("verify.validators", &validators); err != nil {
+		return fmt.Errorf("failed to parse validator configurations: %v", err)
+	}
+
+	for i, v := range validators {
+		if v.Name == "" || v.Address == "" {
+			return errors.New("verify.validators require both name and address")
+		}
+		switch v.Policy {
+		case "":
+			validators[i].Policy = "required"
+		case "required", "advisory", "disabled":
+		default:
+			return fmt.Errorf("unknown policy %s for validator %s", v.Policy, v.Name)
+		}
+		if v.Timeout < 0 {
+			return fmt.Errorf("timeout for validator %s can not be negative", v.Name)
+		}
+	}
+	c.Verify.Validators = validators
+
+	return nil
+}
+
 // configSchemas configures the schemas to load depending on
 // the type IDs of connection Federated EGA or isolate (stand-alone)
 func (c *Config) configSchemas() {
-	if viper.GetString("schema.type") == "federated" {
+	c.SchemaType = viper.GetString("schema.type")
+	if c.SchemaType == "federated" {
 		c.Broker.SchemasPath = "/schemas/federated/"
 	} else {
 		c.Broker.SchemasPath = "/schemas/isolated/"
@@ -944,6 +1621,22 @@ func (c *Config) configSchemas() {
 	}
 }
 
+// s3RequiredConfVars returns the required settings for an S3 storage, the
+// keys are only required when they are not fetched from a credentials provider
+func s3RequiredConfVars(prefix string) []string {
+	required := []string{prefix + ".url", prefix + ".bucket"}
+	switch viper.GetString(prefix + ".credentials.provider") {
+	case "", storage.StaticCredentials:
+		required = append(required, prefix+".accesskey", prefix+".secretkey")
+	case storage.FileCredentials:
+		required = append(required, prefix+".credentials.file")
+	case storage.VaultCredentials:
+		required = append(required, prefix+".credentials.vault.address", prefix+".credentials.vault.path", prefix+".credentials.vault.tokenfile")
+	}
+
+	return required
+}
+
 // configS3Storage populates and returns a S3Conf from the
 // configuration
 func configS3Storage(prefix string) storage.S3Conf {
@@ -979,6 +1672,17 @@ func configS3Storage(prefix string) storage.S3Conf {
 		s3.CAcert = viper.GetString(prefix + ".cacert")
 	}
 
+	s3.Credentials = storage.CredentialsConf{
+		Provider: viper.GetString(prefix + ".credentials.provider"),
+		File:     viper.GetString(prefix + ".credentials.file"),
+		Refresh:  time.Duration(viper.GetInt(prefix+".credentials.refresh")) * time.Second,
+		Vault: storage.VaultConf{
+			Address:   viper.GetString(prefix + ".credentials.vault.address"),
+			Path:      viper.GetString(prefix + ".credentials.vault.path"),
+			TokenFile: viper.GetString(prefix + ".credentials.vault.tokenfile"),
+		},
+	}
+
 	return s3
 }
 
@@ -1007,6 +1711,9 @@ func (c *Config) configSMTP() {
 	c.Notify.Port = viper.GetInt("smtp.port")
 	c.Notify.Password = viper.GetString("smtp.password")
 	c.Notify.FromAddr = viper.GetString("smtp.from")
+	c.Notify.Admins = viper.GetStringSlice("notify.admins")
+	c.Notify.MailingLists = viper.GetStringSlice("notify.mailingLists")
+	c.Notify.Webhook = viper.GetString("notify.webhook")
 }
 
 // configSync provides configuration for the sync destination storage
@@ -1071,13 +1778,22 @@ func GetC4GHKey() (*[32]byte, error) {
 	return &key, nil
 }
 
-// GetC4GHprivateKeys reads and decrypts keys and returns a list of c4gh keys
+// GetC4GHprivateKeys reads and decrypts keys and returns a list of c4gh keys.
+// The key given by c4gh.filepath comes first, followed by the keys listed in
+// c4gh.privateKeys, so that files encrypted with an old key can still be
+// read while the keys are rotated.
 func GetC4GHprivateKeys() ([]*[32]byte, error) {
 	// Retrieve the list of key configurations from the YAML file
 	var keySet []C4GHprivateKeyConf
 	if err := viper.UnmarshalKey("c4gh.privateKeys", &keySet); err != nil {
 		return nil, fmt.Errorf("failed to parse key configurations: %v", err)
 	}
+	if viper.IsSet("c4gh.filepath") {
+		keySet = slices.Insert(keySet, 0, C4GHprivateKeyConf{FilePath: viper.GetString("c4gh.filepath"), Passphrase: viper.GetString("c4gh.passphrase")})
+	}
+	if len(keySet) == 0 {
+		return nil, errors.New("no c4gh private keys configured, set c4gh.filepath or c4gh.privateKeys")
+	}
 
 	var privateKeys []*[32]byte
 
@@ -1099,6 +1815,135 @@ func GetC4GHprivateKeys() ([]*[32]byte, error) {
 	return privateKeys, nil
 }
 
+// getGroupMappings returns the inbox prefixes and projects assigned to
+// groups in auth.groupMappings. Prefixes are paths in the inbox without
+// leading or trailing slashes.
+func getGroupMappings() ([]GroupMapping, error) {
+	var mappings []GroupMapping
+	if err := viper.UnmarshalKey("auth.groupMappings", &mappings); err != nil {
+		return nil, fmt.Errorf("failed to parse auth.groupMappings: %v", err)
+	}
+
+	for i, m := range mappings {
+		if m.Group == "" {
+			return nil, fmt.Errorf("auth.groupMappings: mapping %d has no group", i)
+		}
+		for j, prefix := range m.InboxPrefixes {
+			prefix = strings.Trim(prefix, "/")
+			if prefix == "" || slices.Contains(strings.Split(prefix, "/"), "..") {
+				return nil, &InvalidValueError{Key: "auth.groupMappings.inboxPrefixes", Value: m.InboxPrefixes[j], Expected: "a path in the inbox such as project1/raw"}
+			}
+			mappings[i].InboxPrefixes[j] = prefix
+		}
+	}
+
+	return mappings, nil
+}
+
+// getJwtSigningKeys returns the keys that auth signs tokens with, the key
+// given by auth.jwt.privateKey followed by the keys listed in
+// auth.jwt.signingKeys. Keys without an algorithm get the one in
+// auth.jwt.signatureAlg. At most one key can be primary, the first key is
+// primary when none is.
+func getJwtSigningKeys() ([]JwtSigningKey, error) {
+	var keys []JwtSigningKey
+	if err := viper.UnmarshalKey("auth.jwt.signingKeys", &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse auth.jwt.signingKeys: %v", err)
+	}
+	if viper.GetString("auth.jwt.privateKey") != "" {
+		keys = slices.Insert(keys, 0, JwtSigningKey{FilePath: viper.GetString("auth.jwt.privateKey")})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no JWT signing keys configured, set auth.jwt.privateKey or auth.jwt.signingKeys")
+	}
+
+	primary := 0
+	for i := range keys {
+		if keys[i].FilePath == "" {
+			return nil, fmt.Errorf("auth.jwt.signingKeys: key %d has no filePath", i)
+		}
+		if _, err := os.Stat(keys[i].FilePath); err != nil {
+			return nil, err
+		}
+		if keys[i].SignatureAlg == "" {
+			keys[i].SignatureAlg = viper.GetString("auth.jwt.signatureAlg")
+		}
+		if keys[i].SignatureAlg == "" {
+			return nil, fmt.Errorf("auth.jwt.signingKeys: the key in %s has no signatureAlg", keys[i].FilePath)
+		}
+		if keys[i].Primary {
+			primary++
+		}
+	}
+	switch {
+	case primary > 1:
+		return nil, errors.New("auth.jwt.signingKeys: only one key can be primary")
+	case primary == 0:
+		keys[0].Primary = true
+	}
+
+	return keys, nil
+}
+
+// getC4GHPublicKeys returns the crypt4gh public keys of auth, the key given
+// by auth.publicFile, valid at all times, followed by the keys listed in
+// auth.publicKeys. At most one key can be preferred.
+func getC4GHPublicKeys() ([]C4GHPublicKey, error) {
+	var keySet []C4GHPublicKeyConf
+	if err := viper.UnmarshalKey("auth.publicKeys", &keySet); err != nil {
+		return nil, fmt.Errorf("failed to parse auth.publicKeys: %v", err)
+	}
+	if viper.GetString("auth.publicFile") != "" {
+		keySet = slices.Insert(keySet, 0, C4GHPublicKeyConf{FilePath: viper.GetString("auth.publicFile")})
+	}
+	if len(keySet) == 0 {
+		return nil, errors.New("no crypt4gh public keys configured, set auth.publicFile or auth.publicKeys")
+	}
+
+	parseTime := func(key, value string) (time.Time, error) {
+		if value == "" {
+			return time.Time{}, nil
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, &InvalidValueError{Key: key, Value: value, Expected: "a time such as 2025-01-31T00:00:00Z"}
+		}
+
+		return t, nil
+	}
+
+	publicKeys := make([]C4GHPublicKey, 0, len(keySet))
+	preferred := 0
+	for i, entry := range keySet {
+		if entry.FilePath == "" {
+			return nil, fmt.Errorf("auth.publicKeys: key %d has no filePath", i)
+		}
+		if _, err := os.Stat(entry.FilePath); err != nil {
+			return nil, err
+		}
+		key := C4GHPublicKey{FilePath: entry.FilePath, Preferred: entry.Preferred}
+		var err error
+		if key.ValidFrom, err = parseTime("auth.publicKeys.validFrom", entry.ValidFrom); err != nil {
+			return nil, err
+		}
+		if key.ValidUntil, err = parseTime("auth.publicKeys.validUntil", entry.ValidUntil); err != nil {
+			return nil, err
+		}
+		if !key.ValidFrom.IsZero() && !key.ValidUntil.IsZero() && !key.ValidUntil.After(key.ValidFrom) {
+			return nil, fmt.Errorf("auth.publicKeys: the key in %s is valid until before it is valid from", entry.FilePath)
+		}
+		if key.Preferred {
+			preferred++
+		}
+		publicKeys = append(publicKeys, key)
+	}
+	if preferred > 1 {
+		return nil, errors.New("auth.publicKeys: only one key can be preferred")
+	}
+
+	return publicKeys, nil
+}
+
 // GetC4GHPublicKey reads the c4gh public key
 func GetC4GHPublicKey() (*[32]byte, error) {
 	keyPath := viper.GetString("c4gh.syncPubKeyPath")
@@ -1134,6 +1979,17 @@ func (c *Config) configServer() error {
 		s.Jwtpubkeyurl = viper.GetString("server.jwtpubkeyurl")
 	}
 
+	s.JwksRefresh = time.Hour
+	if viper.IsSet("server.jwksrefresh") {
+		s.JwksRefresh = time.Duration(viper.GetInt("server.jwksrefresh")) * time.Second
+	}
+
+	// Token claim validation
+	s.JwtIssuers = viper.GetStringSlice("server.jwtissuers")
+	s.JwtAudiences = viper.GetStringSlice("server.jwtaudiences")
+	s.JwtAlgorithms = viper.GetStringSlice("server.jwtalgorithms")
+	s.JwtClockSkew = time.Duration(viper.GetInt("server.jwtclockskew")) * time.Second
+
 	if viper.IsSet("server.cert") {
 		s.Cert = viper.GetString("server.cert")
 	}
@@ -1200,12 +2056,15 @@ func TLSConfigProxy(c *Config) (*tls.Config, error) {
 
 	log.Debug("setting up TLS for S3 connection")
 
-	// Read system CAs
-	systemCAs, err := x509.SystemCertPool()
-	if err != nil {
-		log.Errorf("failed to read system CAs: %v", err)
+	// Read system CAs, with the extra trusted CAs of the outbound clients
+	systemCAs := outbound.RootCAs()
+	if systemCAs == nil {
+		var err error
+		if systemCAs, err = x509.SystemCertPool(); err != nil {
+			log.Errorf("failed to read system CAs: %v", err)
 
-		return nil, err
+			return nil, err
+		}
 	}
 
 	cfg.RootCAs = systemCAs
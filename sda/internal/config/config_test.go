@@ -1,17 +1,24 @@
 package config
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/neicnordic/crypt4gh/keys"
 	"github.com/neicnordic/sensitive-data-archive/internal/helper"
+	"github.com/neicnordic/sensitive-data-archive/internal/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -59,7 +66,7 @@ func (suite *ConfigTestSuite) SetupTest() {
 	viper.Set("db.user", "test")
 	viper.Set("db.password", "test")
 	viper.Set("db.database", "test")
-	viper.Set("inbox.url", "testurl")
+	viper.Set("inbox.url", "http://testurl")
 	viper.Set("inbox.accesskey", "testaccess")
 	viper.Set("inbox.secretkey", "testsecret")
 	viper.Set("inbox.bucket", "testbucket")
@@ -129,23 +136,56 @@ func (suite *ConfigTestSuite) TestMissingRequiredConfVar() {
 		config, err := NewConfig("s3inbox")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
 }
 
+func (suite *ConfigTestSuite) TestMissingRequiredConfVars() {
+	viper.Set("broker.host", nil)
+	viper.Set("db.user", nil)
+	viper.Set("inbox.type", nil)
+	_, err := NewConfig("api")
+	assert.EqualError(suite.T(), err, "inbox.type, broker.host, db.user not set")
+
+	var missing *MissingError
+	if assert.ErrorAs(suite.T(), err, &missing) {
+		assert.Equal(suite.T(), []string{"inbox.type", "broker.host", "db.user"}, missing.Keys)
+	}
+}
+
 func (suite *ConfigTestSuite) TestConfigS3Storage() {
 	config, err := NewConfig("s3inbox")
 	assert.NotNil(suite.T(), config)
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), config.Inbox.S3)
-	assert.Equal(suite.T(), "testurl", config.Inbox.S3.URL)
+	assert.Equal(suite.T(), "http://testurl", config.Inbox.S3.URL)
 	assert.Equal(suite.T(), "testaccess", config.Inbox.S3.AccessKey)
 	assert.Equal(suite.T(), "testsecret", config.Inbox.S3.SecretKey)
 	assert.Equal(suite.T(), "testbucket", config.Inbox.S3.Bucket)
 }
 
+func (suite *ConfigTestSuite) TestConfigS3Storage_CredentialsProvider() {
+	viper.Set("inbox.accesskey", nil)
+	viper.Set("inbox.secretkey", nil)
+	viper.Set("inbox.credentials.provider", "file")
+	_, err := NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "inbox.credentials.file not set")
+
+	viper.Set("inbox.credentials.file", "/run/secrets/inbox.json")
+	viper.Set("inbox.credentials.refresh", 60)
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), storage.FileCredentials, config.Inbox.S3.Credentials.Provider)
+	assert.Equal(suite.T(), "/run/secrets/inbox.json", config.Inbox.S3.Credentials.File)
+	assert.Equal(suite.T(), time.Minute, config.Inbox.S3.Credentials.Refresh)
+
+	viper.Set("inbox.credentials.provider", "default")
+	_, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+}
+
 func (suite *ConfigTestSuite) TestConfigBroker() {
 	config, err := NewConfig("s3inbox")
 	assert.NotNil(suite.T(), config)
@@ -170,6 +210,211 @@ func (suite *ConfigTestSuite) TestConfigBroker() {
 	assert.Equal(suite.T(), "/", config.Broker.Vhost)
 }
 
+func (suite *ConfigTestSuite) TestConfigBroker_Standby() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Broker.StandbyHosts)
+	assert.Equal(suite.T(), time.Minute, config.Broker.FailbackInterval)
+
+	viper.Set("broker.standbyHosts", []string{"standby-1", "standby-2:5673"})
+	viper.Set("broker.failbackInterval", 10)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"standby-1", "standby-2:5673"}, config.Broker.StandbyHosts)
+	assert.Equal(suite.T(), 10*time.Second, config.Broker.FailbackInterval)
+
+	viper.Set("broker.failbackInterval", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.failbackInterval can not be negative")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_Prefetch() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, config.Broker.PrefetchCount)
+
+	viper.Set("broker.prefetchCount", 50)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 50, config.Broker.PrefetchCount)
+
+	viper.Set("broker.prefetchCount", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.prefetchCount can not be negative")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_Type() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "rabbitmq", config.Broker.Type)
+	assert.Equal(suite.T(), "sda", config.Broker.Stream)
+
+	viper.Set("broker.type", "nats")
+	viper.Set("broker.stream", "messages")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "nats", config.Broker.Type)
+	assert.Equal(suite.T(), "messages", config.Broker.Stream)
+
+	viper.Set("broker.type", "kafka")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.type must be rabbitmq or nats")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_Quarantine() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, config.Broker.QuarantineAfter)
+
+	viper.Set("broker.quarantineAfter", 5)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5, config.Broker.QuarantineAfter)
+
+	viper.Set("broker.quarantineAfter", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.quarantineAfter can not be negative")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_Routes() {
+	viper.Set("broker.exchanges", map[string]string{"local": "sda", "cega": "localega.v1"})
+	viper.Set("broker.routes", map[string][]string{"completed": {"Local", "cega"}})
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), map[string]string{"local": "sda", "cega": "localega.v1"}, config.Broker.Exchanges)
+	assert.Equal(suite.T(), map[string][]string{"completed": {"local", "cega"}}, config.Broker.Routes)
+
+	viper.Set("broker.routes", map[string][]string{"completed": {"central"}})
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.routes.completed names the unknown exchange central")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_RetryDelay() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), time.Duration(0), config.Broker.RetryDelay)
+
+	viper.Set("broker.retryDelay", 30)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 30*time.Second, config.Broker.RetryDelay)
+
+	viper.Set("broker.retryDelay", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.retryDelay can not be negative")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_QueueOptions() {
+	viper.Set("broker.queueType", "quorum")
+	viper.Set("broker.maxLength", 1000)
+	viper.Set("broker.overflow", "reject-publish")
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "quorum", config.Broker.QueueType)
+	assert.Equal(suite.T(), 1000, config.Broker.MaxLength)
+	assert.Equal(suite.T(), "reject-publish", config.Broker.Overflow)
+
+	viper.Set("broker.lazyQueues", true)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.lazyQueues can not be used with quorum queues")
+
+	viper.Set("broker.queueType", "classic")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), config.Broker.LazyQueues)
+
+	viper.Set("broker.deliveryLimit", 5)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.deliveryLimit needs quorum queues")
+
+	viper.Set("broker.queueType", "stream")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.queueType must be classic or quorum")
+
+	viper.Set("broker.queueType", "classic")
+	viper.Set("broker.deliveryLimit", 0)
+	viper.Set("broker.overflow", "drop-tail")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.overflow must be drop-head, reject-publish or reject-publish-dlx")
+
+	viper.Set("broker.maxLength", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.maxLength can not be negative")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_Dedup() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", config.Broker.Dedup)
+	assert.Equal(suite.T(), 24*time.Hour, config.Broker.DedupTTL)
+
+	viper.Set("broker.dedup", "database")
+	viper.Set("broker.dedupTTL", 3600)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "database", config.Broker.Dedup)
+	assert.Equal(suite.T(), time.Hour, config.Broker.DedupTTL)
+
+	viper.Set("broker.dedupTTL", 0)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.dedupTTL must be positive")
+
+	viper.Set("broker.dedup", "redis")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.dedup must be memory or database")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_Priority() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, config.Broker.MaxPriority)
+
+	viper.Set("broker.maxPriority", 9)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 9, config.Broker.MaxPriority)
+
+	viper.Set("broker.maxPriority", 256)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.maxPriority must be between 0 and 255")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_Publish() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3, config.Broker.PublishRetries)
+	assert.Empty(suite.T(), config.Broker.SpoolDir)
+
+	viper.Set("broker.publishRetries", 0)
+	viper.Set("broker.spoolDir", "/var/spool/sda")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, config.Broker.PublishRetries)
+	assert.Equal(suite.T(), "/var/spool/sda", config.Broker.SpoolDir)
+
+	viper.Set("broker.publishRetries", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.publishRetries can not be negative")
+}
+
+func (suite *ConfigTestSuite) TestConfigBroker_DeadLetter() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Broker.DeadLetterExchange)
+	assert.Equal(suite.T(), 0, config.Broker.DeliveryLimit)
+
+	viper.Set("broker.deadLetterExchange", "sda.dlx")
+	viper.Set("broker.deliveryLimit", 5)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "sda.dlx", config.Broker.DeadLetterExchange)
+	assert.Equal(suite.T(), 5, config.Broker.DeliveryLimit)
+
+	viper.Set("broker.deliveryLimit", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "broker.deliveryLimit can not be negative")
+}
+
 func (suite *ConfigTestSuite) TestTLSConfigBroker() {
 	viper.Set("broker.serverName", "broker")
 	viper.Set("broker.ssl", true)
@@ -238,6 +483,19 @@ func (suite *ConfigTestSuite) TestAPIConfiguration() {
 	assert.Equal(suite.T(), true, config.API.Session.HTTPOnly)
 	assert.Equal(suite.T(), "api_session_key", config.API.Session.Name)
 	assert.Equal(suite.T(), -1*time.Second, config.API.Session.Expiration)
+	assert.Equal(suite.T(), 30*time.Second, config.API.RetryAfter)
+	assert.False(suite.T(), config.API.ProjectScoping)
+	assert.Equal(suite.T(), "projects", config.API.ProjectClaim)
+	assert.Equal(suite.T(), []int{80, 95}, config.API.QuotaWarnings)
+	assert.Empty(suite.T(), config.API.DatasetPrefix)
+	assert.Equal(suite.T(), 8, config.API.DatasetDigits)
+	assert.Equal(suite.T(), 60*time.Second, config.API.RequestTimeout)
+	assert.Equal(suite.T(), 5, config.API.BreakerThreshold)
+	assert.Equal(suite.T(), 30*time.Second, config.API.BreakerCooldown)
+	assert.False(suite.T(), config.API.ReadOnly)
+	assert.False(suite.T(), config.API.ReleaseFeed)
+	assert.Equal(suite.T(), 50, config.API.ReleaseFeedSize)
+	assert.Equal(suite.T(), 72*time.Hour, config.API.MissingReminder)
 	rbac, _ := os.ReadFile(viper.GetString("api.rbacFile"))
 	assert.Equal(suite.T(), rbac, config.API.RBACpolicy)
 
@@ -248,6 +506,19 @@ func (suite *ConfigTestSuite) TestAPIConfiguration() {
 	viper.Set("api.session.secure", false)
 	viper.Set("api.session.domain", "test")
 	viper.Set("api.session.expiration", 60)
+	viper.Set("api.retryAfter", 120)
+	viper.Set("api.projectScoping", true)
+	viper.Set("api.datasetIDPrefix", "DS-")
+	viper.Set("api.readOnly", true)
+	viper.Set("api.releaseFeed", true)
+	viper.Set("api.releaseFeedSize", 20)
+	viper.Set("api.missingFilesReminder", 24)
+	viper.Set("api.eventPurgeSchedule", "30 2 * * 0")
+	viper.Set("api.eventRetentionDays", 365)
+	viper.Set("api.endpointTimeouts", []map[string]any{{"path": "/datasets/list", "timeout": 120}})
+	viper.Set("server.jwtissuers", []string{"https://login.example.org"})
+	viper.Set("server.jwtaudiences", "sda-api")
+	viper.Set("server.jwtclockskew", 30)
 
 	config, err = NewConfig("api")
 	assert.NotNil(suite.T(), config)
@@ -258,6 +529,58 @@ func (suite *ConfigTestSuite) TestAPIConfiguration() {
 	assert.Equal(suite.T(), false, config.API.Session.Secure)
 	assert.Equal(suite.T(), "test", config.API.Session.Domain)
 	assert.Equal(suite.T(), 60*time.Second, config.API.Session.Expiration)
+	assert.Equal(suite.T(), 120*time.Second, config.API.RetryAfter)
+	assert.True(suite.T(), config.API.ProjectScoping)
+	assert.Equal(suite.T(), "DS-", config.API.DatasetPrefix)
+	assert.True(suite.T(), config.API.ReadOnly)
+	assert.True(suite.T(), config.API.ReleaseFeed)
+	assert.Equal(suite.T(), 20, config.API.ReleaseFeedSize)
+	assert.Equal(suite.T(), 24*time.Hour, config.API.MissingReminder)
+	assert.NotNil(suite.T(), config.API.EventPurge)
+	assert.Equal(suite.T(), 365*24*time.Hour, config.API.EventRetention)
+	assert.True(suite.T(), config.API.EventKeepLatest)
+	assert.NotNil(suite.T(), config.API.UsageSummary)
+	assert.NotNil(suite.T(), config.API.StatsRefresh)
+	assert.Equal(suite.T(), 120*time.Second, config.API.EndpointTimeouts["/datasets/list"])
+	assert.Equal(suite.T(), []string{"https://login.example.org"}, config.Server.JwtIssuers)
+	assert.Equal(suite.T(), []string{"sda-api"}, config.Server.JwtAudiences)
+	assert.Empty(suite.T(), config.Server.JwtAlgorithms)
+	assert.Equal(suite.T(), 30*time.Second, config.Server.JwtClockSkew)
+	assert.Equal(suite.T(), time.Hour, config.Server.JwksRefresh)
+
+	viper.Set("api.quotaWarnings", []int{80, 120})
+	_, err = NewConfig("api")
+	assert.ErrorContains(suite.T(), err, "api.quotaWarnings")
+
+	viper.Set("api.quotaWarnings", []int{80})
+	viper.Set("api.releaseFeedSize", 0)
+	_, err = NewConfig("api")
+	assert.ErrorContains(suite.T(), err, "api.releaseFeedSize")
+
+	viper.Set("api.releaseFeedSize", 20)
+	viper.Set("api.missingFilesReminder", -1)
+	_, err = NewConfig("api")
+	assert.ErrorContains(suite.T(), err, "api.missingFilesReminder")
+
+	viper.Set("api.missingFilesReminder", 24)
+	viper.Set("api.eventPurgeSchedule", "every sunday")
+	_, err = NewConfig("api")
+	assert.ErrorContains(suite.T(), err, "api.eventPurgeSchedule")
+
+	viper.Set("api.eventPurgeSchedule", "30 2 * * 0")
+	viper.Set("api.eventRetentionDays", 0)
+	_, err = NewConfig("api")
+	assert.ErrorContains(suite.T(), err, "api.eventRetentionDays")
+
+	viper.Set("api.eventRetentionDays", 365)
+	viper.Set("api.usageSummarySchedule", "0 25 * * *")
+	_, err = NewConfig("api")
+	assert.ErrorContains(suite.T(), err, "api.usageSummarySchedule")
+
+	viper.Set("api.usageSummarySchedule", "0 1 * * *")
+	viper.Set("api.statsRefreshSchedule", "*/0 * * * *")
+	_, err = NewConfig("api")
+	assert.ErrorContains(suite.T(), err, "api.statsRefreshSchedule")
 }
 
 func (suite *ConfigTestSuite) TestNotifyConfiguration() {
@@ -278,10 +601,15 @@ func (suite *ConfigTestSuite) TestNotifyConfiguration() {
 	viper.Set("smtp.port", 456)
 	viper.Set("smtp.password", "test")
 	viper.Set("smtp.from", "noreply")
+	viper.Set("notify.admins", []string{"admin@example.org"})
+	viper.Set("notify.mailingLists", []string{"announce@example.org"})
 
 	config, err = NewConfig("notify")
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), config)
+	assert.Equal(suite.T(), []string{"admin@example.org"}, config.Notify.Admins)
+	assert.Equal(suite.T(), []string{"announce@example.org"}, config.Notify.MailingLists)
+	assert.Empty(suite.T(), config.Notify.Webhook)
 }
 
 func (suite *ConfigTestSuite) TestSyncConfig() {
@@ -384,6 +712,29 @@ func (suite *ConfigTestSuite) TestGetC4GHprivateKeys_AllOK() {
 	defer os.RemoveAll(keyPath)
 }
 
+func (suite *ConfigTestSuite) TestGetC4GHprivateKeys_Rotation() {
+	keyPath := suite.T().TempDir()
+	oldKey := keyPath + "/old.key"
+	newKey := keyPath + "/new.key"
+
+	newPub, err := helper.CreatePrivateKeyFile(newKey, "new")
+	assert.NoError(suite.T(), err)
+	_, err = helper.CreatePrivateKeyFile(oldKey, "old")
+	assert.NoError(suite.T(), err)
+
+	_, err = GetC4GHprivateKeys()
+	assert.EqualError(suite.T(), err, "no c4gh private keys configured, set c4gh.filepath or c4gh.privateKeys")
+
+	// the current key comes first, the old one is still used for decryption
+	viper.Set("c4gh.filepath", newKey)
+	viper.Set("c4gh.passphrase", "new")
+	viper.Set("c4gh.privateKeys", []C4GHprivateKeyConf{{FilePath: oldKey, Passphrase: "old"}})
+	privateKeys, err := GetC4GHprivateKeys()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), privateKeys, 2)
+	assert.Equal(suite.T(), newPub, keys.DerivePublicKey(*privateKeys[0]))
+}
+
 func (suite *ConfigTestSuite) TestGetC4GHprivateKeys_MissingKeyPath() {
 	viper.Set("c4gh.privateKeys", []C4GHprivateKeyConf{
 		{FilePath: "/non/existent/path1", Passphrase: "test"},
@@ -511,7 +862,38 @@ func (suite *ConfigTestSuite) TestConfigAuth_CEGA() {
 	c, err := NewConfig("auth")
 	assert.Equal(suite.T(), c.Auth.JwtPrivateKey, fmt.Sprintf("%s/ec", ECPath))
 	assert.Equal(suite.T(), c.Auth.JwtTTL, 168)
+	assert.Equal(suite.T(), 30*24*time.Hour, c.Auth.RefreshTTL)
 	assert.NoError(suite.T(), err, "unexpected failure")
+
+	viper.Set("auth.jwt.refreshTTL", 0)
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), c.Auth.RefreshTTL)
+
+	viper.Set("auth.jwt.audience", []string{"s3inbox", "api"})
+	viper.Set("auth.jwt.claims", `{"project": "sda"}`)
+	viper.Set("auth.jwt.groupsClaim", "groups")
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"s3inbox", "api"}, c.Auth.JwtAudience)
+	assert.Equal(suite.T(), map[string]any{"project": "sda"}, c.Auth.JwtClaims)
+	assert.Equal(suite.T(), "groups", c.Auth.JwtGroupsClaim)
+
+	viper.Set("auth.groupMappings", []map[string]any{
+		{"group": "project1-submitters", "inboxPrefixes": []string{"/project1/"}, "projects": []string{"project1"}},
+	})
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []GroupMapping{{Group: "project1-submitters", InboxPrefixes: []string{"project1"}, Projects: []string{"project1"}}}, c.Auth.GroupMappings)
+
+	viper.Set("auth.groupMappings", []map[string]any{{"group": "project1-submitters", "inboxPrefixes": []string{"../other"}}})
+	_, err = NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "auth.groupMappings.inboxPrefixes")
+	viper.Set("auth.groupMappings", []map[string]any{})
+
+	viper.Set("auth.jwt.claims", `{"project": `)
+	_, err = NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "auth.jwt.claims")
 }
 
 func (suite *ConfigTestSuite) TestConfigAuth_OIDC() {
@@ -539,3 +921,755 @@ func (suite *ConfigTestSuite) TestConfigAuth_OIDC() {
 	_, err = NewConfig("auth")
 	assert.NoError(suite.T(), err, "unexpected failure")
 }
+
+func (suite *ConfigTestSuite) TestConfigAuth_Enabled() {
+	suite.SetupTest()
+
+	ECPath, _ := os.MkdirTemp("", "EC")
+	if err := helper.CreateECkeys(ECPath, ECPath); err != nil {
+		suite.T().FailNow()
+	}
+	defer os.RemoveAll(ECPath)
+
+	viper.Set("auth.s3Inbox", "http://inbox:8000")
+	viper.Set("auth.publicFile", ECPath+"/ec.pub")
+	viper.Set("oidc.id", "oidcTestID")
+	viper.Set("oidc.secret", "oidcTestIssuer")
+	viper.Set("oidc.provider", "http://provider:9000")
+	viper.Set("oidc.redirectUrl", "http://auth/oidc/login")
+
+	// an enabled login needs its settings
+	viper.Set("auth.cega.enabled", true)
+	_, err := NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "auth.cega.id")
+
+	// the EGA login is turned off even though it has its settings
+	viper.Set("auth.cega.authURL", "http://cega/auth")
+	viper.Set("auth.cega.id", "CegaID")
+	viper.Set("auth.cega.secret", "CegaSecret")
+	viper.Set("auth.cega.enabled", false)
+	c, err := NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), c.Auth.Cega.Enabled)
+	assert.True(suite.T(), c.Auth.OIDC.Enabled)
+
+	viper.Set("oidc.enabled", false)
+	_, err = NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "neither cega or oidc login configured")
+}
+
+func (suite *ConfigTestSuite) TestConfigAuth_WebAuthn() {
+	suite.SetupTest()
+
+	ECPath, _ := os.MkdirTemp("", "EC")
+	if err := helper.CreateECkeys(ECPath, ECPath); err != nil {
+		suite.T().FailNow()
+	}
+	defer os.RemoveAll(ECPath)
+
+	viper.Set("auth.s3Inbox", "http://inbox:8000")
+	viper.Set("auth.publicFile", ECPath+"/ec.pub")
+	viper.Set("oidc.id", "oidcTestID")
+	viper.Set("oidc.secret", "oidcTestIssuer")
+	viper.Set("oidc.provider", "http://provider:9000")
+	viper.Set("oidc.redirectUrl", "http://auth/oidc/login")
+
+	c, err := NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), c.Auth.WebAuthn.Enabled)
+	assert.Empty(suite.T(), c.Auth.PublicURL)
+
+	viper.Set("auth.webauthn.enabled", true)
+	_, err = NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "auth.webauthn.origin")
+
+	viper.Set("auth.webauthn.origin", "https://login.example.org/")
+	viper.Set("auth.webauthn.roles", []string{"admins"})
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), WebAuthnConfig{
+		Enabled: true,
+		RPID:    "login.example.org",
+		RPName:  "SDA",
+		Origin:  "https://login.example.org",
+		Roles:   []string{"admins"},
+	}, c.Auth.WebAuthn)
+	// auth is opened at the origin of the passkeys unless told otherwise
+	assert.Equal(suite.T(), "https://login.example.org", c.Auth.PublicURL)
+
+	viper.Set("auth.publicUrl", "https://auth.example.org/")
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "https://auth.example.org", c.Auth.PublicURL)
+}
+
+func (suite *ConfigTestSuite) TestConfigAuth_TOTP() {
+	suite.SetupTest()
+
+	ECPath, _ := os.MkdirTemp("", "EC")
+	if err := helper.CreateECkeys(ECPath, ECPath); err != nil {
+		suite.T().FailNow()
+	}
+	defer os.RemoveAll(ECPath)
+
+	viper.Set("auth.s3Inbox", "http://inbox:8000")
+	viper.Set("auth.publicFile", ECPath+"/ec.pub")
+	viper.Set("oidc.id", "oidcTestID")
+	viper.Set("oidc.secret", "oidcTestIssuer")
+	viper.Set("oidc.provider", "http://provider:9000")
+	viper.Set("oidc.redirectUrl", "http://auth/oidc/login")
+
+	c, err := NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), c.Auth.TOTP.Enabled)
+
+	viper.Set("auth.totp.enabled", true)
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), TOTPConfig{Enabled: true, Issuer: "SDA"}, c.Auth.TOTP)
+
+	viper.Set("auth.totp.issuer", "Example SDA")
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "Example SDA", c.Auth.TOTP.Issuer)
+}
+
+func (suite *ConfigTestSuite) TestConfigAuth_Audit() {
+	suite.SetupTest()
+
+	ECPath, _ := os.MkdirTemp("", "EC")
+	if err := helper.CreateECkeys(ECPath, ECPath); err != nil {
+		suite.T().FailNow()
+	}
+	defer os.RemoveAll(ECPath)
+
+	viper.Set("auth.s3Inbox", "http://inbox:8000")
+	viper.Set("auth.publicFile", ECPath+"/ec.pub")
+	viper.Set("oidc.id", "oidcTestID")
+	viper.Set("oidc.secret", "oidcTestIssuer")
+	viper.Set("oidc.provider", "http://provider:9000")
+	viper.Set("oidc.redirectUrl", "http://auth/oidc/login")
+
+	c, err := NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 90*24*time.Hour, c.Auth.AuditRetention)
+	assert.Empty(suite.T(), c.Auth.RemoteAddrHeaders)
+
+	viper.Set("auth.audit.retention", 0)
+	viper.Set("auth.remoteAddrHeaders", []string{"X-Forwarded-For"})
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), c.Auth.AuditRetention)
+	assert.Equal(suite.T(), []string{"X-Forwarded-For"}, c.Auth.RemoteAddrHeaders)
+
+	viper.Set("auth.audit.retention", "a month")
+	_, err = NewConfig("auth")
+	var invalid *InvalidValueError
+	assert.ErrorAs(suite.T(), err, &invalid)
+}
+
+func (suite *ConfigTestSuite) TestConfigAuth_LoginLimit() {
+	suite.SetupTest()
+
+	ECPath, _ := os.MkdirTemp("", "EC")
+	if err := helper.CreateECkeys(ECPath, ECPath); err != nil {
+		suite.T().FailNow()
+	}
+	defer os.RemoveAll(ECPath)
+
+	viper.Set("auth.s3Inbox", "http://inbox:8000")
+	viper.Set("auth.publicFile", ECPath+"/ec.pub")
+	viper.Set("oidc.id", "oidcTestID")
+	viper.Set("oidc.secret", "oidcTestIssuer")
+	viper.Set("oidc.provider", "http://provider:9000")
+	viper.Set("oidc.redirectUrl", "http://auth/oidc/login")
+
+	c, err := NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), LoginLimitConfig{AddressFailures: 20, AccountFailures: 5, Window: 15 * time.Minute, Lockout: 15 * time.Minute}, c.Auth.LoginLimit)
+
+	viper.Set("auth.loginLimit.addressFailures", 0)
+	viper.Set("auth.loginLimit.accountFailures", 3)
+	viper.Set("auth.loginLimit.window", 60)
+	viper.Set("auth.loginLimit.lockout", 300)
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), LoginLimitConfig{AddressFailures: 0, AccountFailures: 3, Window: time.Minute, Lockout: 5 * time.Minute}, c.Auth.LoginLimit)
+
+	viper.Set("auth.loginLimit.window", 0)
+	_, err = NewConfig("auth")
+	var invalid *InvalidValueError
+	assert.ErrorAs(suite.T(), err, &invalid)
+}
+
+func (suite *ConfigTestSuite) TestConfigAuth_PublicKeys() {
+	suite.SetupTest()
+
+	ECPath, _ := os.MkdirTemp("", "EC")
+	if err := helper.CreateECkeys(ECPath, ECPath); err != nil {
+		suite.T().FailNow()
+	}
+	defer os.RemoveAll(ECPath)
+
+	viper.Set("auth.s3Inbox", "http://inbox:8000")
+	viper.Set("oidc.id", "oidcTestID")
+	viper.Set("oidc.secret", "oidcTestIssuer")
+	viper.Set("oidc.provider", "http://provider:9000")
+	viper.Set("oidc.redirectUrl", "http://auth/oidc/login")
+
+	_, err := NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "auth.publicFile")
+
+	viper.Set("auth.publicKeys", []map[string]any{
+		{"filePath": ECPath + "/ec.pub", "validUntil": "2026-02-01T00:00:00Z"},
+		{"filePath": ECPath + "/ec.pub", "validFrom": "2026-01-01T00:00:00Z", "preferred": true},
+	})
+	c, err := NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []C4GHPublicKey{
+		{FilePath: ECPath + "/ec.pub", ValidUntil: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{FilePath: ECPath + "/ec.pub", ValidFrom: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Preferred: true},
+	}, c.Auth.PublicKeys)
+
+	// the key in auth.publicFile comes first
+	viper.Set("auth.publicFile", ECPath+"/ec.pub")
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), c.Auth.PublicKeys, 3)
+	assert.Equal(suite.T(), C4GHPublicKey{FilePath: ECPath + "/ec.pub"}, c.Auth.PublicKeys[0])
+
+	viper.Set("auth.publicKeys", []map[string]any{{"filePath": ECPath + "/ec.pub", "validFrom": "2026-01-01"}})
+	_, err = NewConfig("auth")
+	var invalid *InvalidValueError
+	assert.ErrorAs(suite.T(), err, &invalid)
+
+	viper.Set("auth.publicKeys", []map[string]any{
+		{"filePath": ECPath + "/ec.pub", "preferred": true},
+		{"filePath": ECPath + "/ec.pub", "preferred": true},
+	})
+	_, err = NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "only one key can be preferred")
+}
+
+func (suite *ConfigTestSuite) TestConfigAuth_SigningKeys() {
+	suite.SetupTest()
+
+	ECPath, _ := os.MkdirTemp("", "EC")
+	if err := helper.CreateECkeys(ECPath, ECPath); err != nil {
+		suite.T().FailNow()
+	}
+	defer os.RemoveAll(ECPath)
+
+	viper.Set("auth.s3Inbox", "http://inbox:8000")
+	viper.Set("auth.publicFile", ECPath+"/ec.pub")
+	viper.Set("auth.resignJwt", true)
+	viper.Set("auth.jwt.issuer", "http://auth:8080")
+	viper.Set("auth.jwt.tokenTTL", 168)
+
+	_, err := NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "auth.jwt.privateKey")
+
+	// the listed keys are enough, the first one is primary
+	viper.Set("auth.jwt.signingKeys", []map[string]any{
+		{"filePath": ECPath + "/ec", "signatureAlg": "ES256"},
+		{"filePath": ECPath + "/ec", "signatureAlg": "ES256"},
+	})
+	c, err := NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), ECPath+"/ec", c.Auth.JwtPrivateKey)
+	assert.True(suite.T(), c.Auth.JwtSigningKeys[0].Primary)
+
+	// the key in auth.jwt.privateKey comes first, and gets the algorithm in
+	// auth.jwt.signatureAlg as do the listed keys without one
+	viper.Set("auth.jwt.privateKey", ECPath+"/ec")
+	viper.Set("auth.jwt.signatureAlg", "ES256")
+	viper.Set("auth.jwt.signingKeys", []map[string]any{
+		{"filePath": ECPath + "/ec.pub", "signatureAlg": "RS256", "primary": true},
+		{"filePath": ECPath + "/ec"},
+	})
+	c, err = NewConfig("auth")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []JwtSigningKey{
+		{FilePath: ECPath + "/ec", SignatureAlg: "ES256"},
+		{FilePath: ECPath + "/ec.pub", SignatureAlg: "RS256", Primary: true},
+		{FilePath: ECPath + "/ec", SignatureAlg: "ES256"},
+	}, c.Auth.JwtSigningKeys)
+	assert.Equal(suite.T(), ECPath+"/ec.pub", c.Auth.JwtPrivateKey)
+	assert.Equal(suite.T(), "RS256", c.Auth.JwtSignatureAlg)
+
+	viper.Set("auth.jwt.signingKeys", []map[string]any{
+		{"filePath": ECPath + "/ec", "primary": true},
+		{"filePath": ECPath + "/ec", "primary": true},
+	})
+	_, err = NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "only one key can be primary")
+
+	viper.Set("auth.jwt.signingKeys", []map[string]any{{"filePath": ECPath + "/missing"}})
+	_, err = NewConfig("auth")
+	assert.ErrorContains(suite.T(), err, "no such file or directory")
+}
+
+func (suite *ConfigTestSuite) TestConfigVerify_Validators() {
+	suite.SetupTest()
+	viper.Set("archive.type", POSIX)
+	viper.Set("archive.location", "/archive")
+
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Verify.Validators)
+
+	viper.Set("verify.validators", []map[string]any{
+		{"name": "clamav", "address": "clamav:50051", "timeout": 600},
+		{"name": "format", "address": "format:50051", "policy": "advisory"},
+	})
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), config.Verify.Validators, 2)
+	assert.Equal(suite.T(), "required", config.Verify.Validators[0].Policy)
+	assert.Equal(suite.T(), 600, config.Verify.Validators[0].Timeout)
+	assert.Equal(suite.T(), "advisory", config.Verify.Validators[1].Policy)
+
+	viper.Set("verify.validators", []map[string]any{{"name": "clamav", "address": "clamav:50051", "policy": "sometimes"}})
+	_, err = NewConfig("verify")
+	assert.ErrorContains(suite.T(), err, "unknown policy sometimes")
+
+	viper.Set("verify.validators", []map[string]any{{"name": "clamav"}})
+	_, err = NewConfig("verify")
+	assert.ErrorContains(suite.T(), err, "require both name and address")
+}
+
+func (suite *ConfigTestSuite) TestConfigDatabase_Retry() {
+	c := &Config{}
+	assert.NoError(suite.T(), c.configDatabase())
+	assert.Equal(suite.T(), 5, c.Database.RetryTimes)
+	assert.Equal(suite.T(), 500*time.Millisecond, c.Database.RetryDelay)
+	assert.Equal(suite.T(), 30*time.Second, c.Database.RetryMaxDelay)
+	assert.Equal(suite.T(), 0.2, c.Database.RetryJitter)
+
+	viper.Set("db.retryTimes", 3)
+	viper.Set("db.retryDelay", 100)
+	viper.Set("db.retryJitter", 0)
+	assert.NoError(suite.T(), c.configDatabase())
+	assert.Equal(suite.T(), 3, c.Database.RetryTimes)
+	assert.Equal(suite.T(), 100*time.Millisecond, c.Database.RetryDelay)
+	assert.Equal(suite.T(), 0.0, c.Database.RetryJitter)
+
+	viper.Set("db.retryJitter", 1.5)
+	assert.ErrorContains(suite.T(), c.configDatabase(), "db.retryJitter")
+
+	viper.Set("db.retryJitter", 0)
+	viper.Set("db.retryTimes", 0)
+	assert.ErrorContains(suite.T(), c.configDatabase(), "db.retryTimes")
+}
+
+func (suite *ConfigTestSuite) TestConfigDatabase_Pool() {
+	c := &Config{}
+	assert.NoError(suite.T(), c.configDatabase())
+	assert.Equal(suite.T(), 25, c.Database.MaxOpenConns)
+	assert.Equal(suite.T(), 5, c.Database.MaxIdleConns)
+	assert.Equal(suite.T(), 30*time.Minute, c.Database.ConnMaxLifetime)
+
+	viper.Set("db.maxOpenConns", 50)
+	viper.Set("db.maxIdleConns", 0)
+	viper.Set("db.connMaxLifetime", 300)
+	assert.NoError(suite.T(), c.configDatabase())
+	assert.Equal(suite.T(), 50, c.Database.MaxOpenConns)
+	assert.Equal(suite.T(), 0, c.Database.MaxIdleConns)
+	assert.Equal(suite.T(), 5*time.Minute, c.Database.ConnMaxLifetime)
+
+	viper.Set("db.maxOpenConns", -1)
+	assert.ErrorContains(suite.T(), c.configDatabase(), "db.maxOpenConns")
+}
+
+func (suite *ConfigTestSuite) TestConfigDatabase_Migrate() {
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), config.Database.Migrate)
+
+	os.Args = []string{"s3inbox", "--migrate"}
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), config.Database.Migrate)
+
+	os.Args = []string{"s3inbox"}
+	suite.T().Setenv("DB_MIGRATE", "true")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), config.Database.Migrate)
+}
+
+func (suite *ConfigTestSuite) TestConfigDatabase_SchemaWait() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), config.Database.SchemaWait)
+
+	viper.Set("db.schemaWait", 300)
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5*time.Minute, config.Database.SchemaWait)
+
+	viper.Set("db.schemaWait", -1)
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "db.schemaWait")
+}
+
+func (suite *ConfigTestSuite) TestConfigDatabase_Replica() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Database.ReplicaDSN)
+
+	viper.Set("db.replicaDSN", "host=replica port=5432 user=api password=secret dbname=sda sslmode=disable")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "host=replica port=5432 user=api password=secret dbname=sda sslmode=disable", config.Database.ReplicaDSN)
+}
+
+func (suite *ConfigTestSuite) TestConfigMetrics() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Metrics.Address)
+
+	viper.Set("metrics.address", ":9090")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), ":9090", config.Metrics.Address)
+}
+
+func (suite *ConfigTestSuite) TestConfigTracing() {
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Tracing.Endpoint)
+
+	viper.Set("tracing.endpoint", "http://collector:4318/v1/traces")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "http://collector:4318/v1/traces", config.Tracing.Endpoint)
+	assert.Equal(suite.T(), "s3inbox", config.Tracing.Service)
+}
+
+func (suite *ConfigTestSuite) TestConfigAWSValues() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case r.Header.Get("X-Amz-Target") == "secretsmanager.GetSecretValue" && req["SecretId"] == "sda/db":
+			fmt.Fprint(w, `{"SecretString":"{\"user\":\"lego\",\"password\":\"dbsecret\"}"}`)
+		case r.Header.Get("X-Amz-Target") == "AmazonSSM.GetParameter" && req["Name"] == "/sda/inbox/secretkey":
+			fmt.Fprint(w, `{"Parameter":{"Value":"s3secret"}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"ResourceNotFoundException","Message":"not found"}`)
+		}
+	}))
+	defer server.Close()
+
+	suite.T().Setenv("AWS_REGION", "eu-north-1")
+	suite.T().Setenv("AWS_ENDPOINT_URL", server.URL)
+	suite.T().Setenv("AWS_ACCESS_KEY_ID", "access")
+	suite.T().Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	suite.T().Setenv("DB_PASSWORD", "awssm://sda/db#password")
+	viper.Set("db.user", "awssm://sda/db#user")
+	viper.Set("inbox.secretkey", "ssm:///sda/inbox/secretkey")
+
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "lego", config.Database.User)
+	assert.Equal(suite.T(), "dbsecret", config.Database.Password)
+	assert.Equal(suite.T(), "s3secret", config.Inbox.S3.SecretKey)
+
+	viper.Set("inbox.secretkey", "ssm:///sda/missing")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "ResourceNotFoundException")
+
+	viper.Set("inbox.secretkey", "awssm://sda/db#accesskey")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "secret has no key accesskey")
+}
+
+func (suite *ConfigTestSuite) TestValidate() {
+	viper.Set("server.jwtpubkeypath", certPath)
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), config.Validate())
+
+	config.Broker.Port = 70000
+	config.Server.Cert = filepath.Join(certPath, "missing.pem")
+	config.Archive = storage.Conf{Type: POSIX, Posix: config.Archive.Posix}
+	config.Archive.Posix.Location = filepath.Join(certPath, "tls.crt")
+	config.Broker.SchemasPath = certPath
+	err = config.Validate()
+	assert.ErrorContains(suite.T(), err, "broker.port: 70000 is not a valid port")
+	assert.ErrorContains(suite.T(), err, "server.cert: open "+config.Server.Cert)
+	assert.ErrorContains(suite.T(), err, "archive.location: "+config.Archive.Posix.Location+" is not a directory")
+	assert.ErrorContains(suite.T(), err, "schema.path: no schemas found in "+certPath)
+
+	var out strings.Builder
+	assert.Equal(suite.T(), 1, reportValidation(&out, "s3inbox", err))
+	assert.Contains(suite.T(), out.String(), "the configuration of s3inbox is invalid:\n  - broker.port: 70000 is not a valid port\n")
+
+	out.Reset()
+	assert.Equal(suite.T(), 0, reportValidation(&out, "s3inbox", nil))
+	assert.Equal(suite.T(), "the configuration of s3inbox is valid\n", out.String())
+}
+
+func (suite *ConfigTestSuite) TestSettings() {
+	configFile := filepath.Join(certPath, "config.yaml")
+	assert.NoError(suite.T(), os.WriteFile(configFile, []byte("broker:\n  exchange: fileexchange\n"), 0600))
+	viper.Set("configFile", configFile)
+	viper.Set("broker.exchange", nil)
+	viper.Set("broker.vhost", nil)
+	suite.T().Setenv("BROKER_VHOST", "envvhost")
+	suite.T().Setenv("DB_CLIENTCERT", "/certs/client.pem")
+
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+
+	settings := map[string]Setting{}
+	for _, s := range config.Settings {
+		settings[s.Key] = s
+	}
+	assert.Equal(suite.T(), Setting{Key: "broker.exchange", Value: "fileexchange", Source: "file"}, settings["broker.exchange"])
+	assert.Equal(suite.T(), Setting{Key: "broker.vhost", Value: "envvhost", Source: "env"}, settings["broker.vhost"])
+	assert.Equal(suite.T(), Setting{Key: "db.clientcert", Value: "/certs/client.pem", Source: "env"}, settings["db.clientcert"])
+	assert.Equal(suite.T(), Setting{Key: "broker.host", Value: "testhost", Source: "default"}, settings["broker.host"])
+	assert.Equal(suite.T(), "***", settings["broker.password"].Value)
+	assert.Equal(suite.T(), "***", settings["inbox.secretkey"].Value)
+
+	// passwords in connection strings and URLs are masked as well
+	viper.Set("db.replicaDSN", "host=replica port=5432 user=lega_in password='s3cr et' dbname=lega")
+	viper.Set("broker.managementURL", "https://admin:s3cret@mq:15671/api")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	for _, s := range config.Settings {
+		settings[s.Key] = s
+	}
+	assert.Equal(suite.T(), "host=replica port=5432 user=lega_in password=*** dbname=lega", settings["db.replicadsn"].Value)
+	assert.Equal(suite.T(), "https://admin:***@mq:15671/api", settings["broker.managementurl"].Value)
+}
+
+func (suite *ConfigTestSuite) TestSecretFiles() {
+	brokerFile := filepath.Join(certPath, "broker-password")
+	dbFile := filepath.Join(certPath, "db-password")
+	assert.NoError(suite.T(), os.WriteFile(brokerFile, []byte("brokersecret\n"), 0600))
+	assert.NoError(suite.T(), os.WriteFile(dbFile, []byte("dbsecret"), 0600))
+	suite.T().Setenv("BROKER_PASSWORD_FILE", brokerFile)
+	viper.Set("db.password", nil)
+	viper.Set("db.password_file", dbFile)
+
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "brokersecret", config.Broker.Password)
+	assert.Equal(suite.T(), "dbsecret", config.Database.Password)
+	assert.Equal(suite.T(), []string{brokerFile, dbFile}, SecretFiles())
+	assert.Contains(suite.T(), config.Settings, Setting{Key: "broker.password", Value: "***", Source: "secretfile, " + brokerFile})
+
+	viper.Set("db.password_file", filepath.Join(certPath, "missing"))
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "for db.password")
+}
+
+func (suite *ConfigTestSuite) TestWatchSecretFiles() {
+	secretFile := filepath.Join(certPath, "broker-password")
+	assert.NoError(suite.T(), os.WriteFile(secretFile, []byte("old"), 0600))
+	viper.Set("broker.password_file", secretFile)
+	_, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+
+	interval := SecretCheckInterval
+	defer func() { SecretCheckInterval = interval }()
+	SecretCheckInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go WatchSecretFiles(ctx, func() { changed <- struct{}{} })
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(suite.T(), os.WriteFile(secretFile, []byte("new"), 0600))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		suite.T().Error("change of the secret file was not noticed")
+	}
+}
+
+func (suite *ConfigTestSuite) TestRemoteConfig() {
+	remote := []byte("broker:\n  prefetchCount: 10\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/sda/config":
+			assert.Equal(suite.T(), "consul-token", r.Header.Get("X-Consul-Token"))
+			w.Header().Set("X-Consul-Index", "7")
+			_, _ = w.Write(remote)
+		case "/v3/auth/authenticate":
+			var req map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if req["name"] != "sda" || req["password"] != "etcdpass" {
+				w.WriteHeader(http.StatusUnauthorized)
+
+				return
+			}
+			fmt.Fprint(w, `{"token":"etcd-token"}`)
+		case "/v3/kv/range":
+			if viper.GetString("remote.username") != "" && r.Header.Get("Authorization") != "etcd-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+
+				return
+			}
+			var req map[string][]byte
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if string(req["key"]) != "/sda/config" {
+				fmt.Fprint(w, `{"header":{"revision":"3"}}`)
+
+				return
+			}
+			fmt.Fprintf(w, `{"header":{"revision":"3"},"kvs":[{"value":"%s","mod_revision":"2"}]}`, base64.StdEncoding.EncodeToString(remote))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	viper.Set("remote.provider", "consul")
+	viper.Set("remote.endpoint", strings.TrimPrefix(server.URL, "http://"))
+	viper.Set("remote.path", "sda/config")
+	viper.Set("remote.token", "consul-token")
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 10, config.Broker.PrefetchCount)
+	assert.Contains(suite.T(), config.Settings, Setting{Key: "broker.prefetchcount", Value: 10, Source: "remote"})
+
+	viper.Set("remote.provider", "etcd3")
+	viper.Set("remote.endpoint", server.URL)
+	viper.Set("remote.path", "/sda/config")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 10, config.Broker.PrefetchCount)
+
+	viper.Set("remote.username", "sda")
+	viper.Set("remote.password", "etcdpass")
+	config, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 10, config.Broker.PrefetchCount)
+
+	viper.Set("remote.password", "wrong")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "failed to authenticate to etcd as sda")
+	viper.Set("remote.username", nil)
+
+	viper.Set("remote.path", "/sda/missing")
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "key /sda/missing not found")
+
+	viper.Set("remote.provider", "nats")
+	_, err = NewConfig("s3inbox")
+	assert.EqualError(suite.T(), err, "remote.provider must be consul or etcd3")
+}
+
+func (suite *ConfigTestSuite) TestWatchRemoteConfig() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+			w.Header().Set("X-Consul-Index", "1")
+			fmt.Fprint(w, "broker:\n  prefetchCount: 10\n")
+		case "1":
+			w.Header().Set("X-Consul-Index", "2")
+			fmt.Fprint(w, "broker:\n  prefetchCount: 20\n")
+		default:
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	viper.Set("remote.provider", "consul")
+	viper.Set("remote.endpoint", server.URL)
+	viper.Set("remote.path", "sda/config")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan struct{}, 1)
+	go WatchRemoteConfig(ctx, func() { changed <- struct{}{} })
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		suite.T().Error("change of the remote configuration was not noticed")
+	}
+	cancel()
+}
+
+func (suite *ConfigTestSuite) TestEnvPrefix() {
+	suite.T().Setenv(EnvPrefixVar, "SDA")
+	suite.T().Setenv("SDA_BROKER_PREFETCHCOUNT", "7")
+	suite.T().Setenv("BROKER_PREFETCHCOUNT", "5")
+
+	config, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 7, config.Broker.PrefetchCount)
+	assert.Contains(suite.T(), config.Settings, Setting{Key: "broker.prefetchcount", Value: "7", Source: "env"})
+
+	key, ok := envKey("SDA_DB_PASSWORD")
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "db.password", key)
+	_, ok = envKey("DB_PASSWORD")
+	assert.False(suite.T(), ok)
+}
+
+func (suite *ConfigTestSuite) TestAliases() {
+	suite.T().Setenv("ELIXIR_ID", "elixir-id")
+	suite.T().Setenv("ELIXIR_SECRET", "elixir-secret")
+	suite.T().Setenv("OIDC_SECRET", "oidc-secret")
+	_, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), "elixir-id", viper.GetString("oidc.id"))
+	assert.Equal(suite.T(), "oidc-secret", viper.GetString("oidc.secret"))
+	assert.Equal(suite.T(), "env, deprecated elixir.id", settingSource("oidc.id"))
+	assert.Equal(suite.T(), "env", settingSource("oidc.secret"))
+}
+
+func (suite *ConfigTestSuite) TestOutboundConf() {
+	suite.T().Setenv("OUTBOUND_HTTPSPROXY", "http://proxy:3128")
+	suite.T().Setenv("OUTBOUND_CACERTS", filepath.Join(certPath, "ca.crt")+", "+filepath.Join(certPath, "tls.crt"))
+	_, err := NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+
+	conf := outboundConf()
+	assert.Equal(suite.T(), "http://proxy:3128", conf.HTTPSProxy)
+	assert.Equal(suite.T(), []string{filepath.Join(certPath, "ca.crt"), filepath.Join(certPath, "tls.crt")}, conf.CACerts)
+
+	suite.T().Setenv("OUTBOUND_CACERTS", filepath.Join(certPath, "missing.pem"))
+	_, err = NewConfig("s3inbox")
+	assert.ErrorContains(suite.T(), err, "failed to read CA file "+filepath.Join(certPath, "missing.pem"))
+}
+
+func (suite *ConfigTestSuite) TestInvalidValues() {
+	viper.Set("inbox.url", "s3.example.org")
+	viper.Set("broker.port", "amqps")
+	viper.Set("api.session.expiration", -60)
+	suite.T().Setenv("SERVER_JWTCLOCKSKEW", "30s")
+
+	_, err := NewConfig("s3inbox")
+	assert.EqualError(suite.T(), err, `api.session.expiration: "-60" is not valid, expected a whole number of seconds, or -1 to end the session when the browser is closed
+broker.port: "amqps" is not valid, expected a port number between 1 and 65535
+inbox.url: "s3.example.org" is not valid, expected an http or https URL such as https://host.example.org
+server.jwtclockskew: "30s" is not valid, expected a whole number of seconds, 0 or more`)
+
+	var invalid *InvalidValueError
+	assert.True(suite.T(), errors.As(err, &invalid))
+	assert.Equal(suite.T(), "api.session.expiration", invalid.Key)
+
+	viper.Set("inbox.url", "https://s3.example.org")
+	viper.Set("broker.port", 5671)
+	viper.Set("api.session.expiration", -1)
+	suite.T().Setenv("SERVER_JWTCLOCKSKEW", "30")
+	_, err = NewConfig("s3inbox")
+	assert.NoError(suite.T(), err)
+}
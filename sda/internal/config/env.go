@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefixVar names the environment variable that holds the prefix of the
+// environment variables of the settings, e.g. with ENVPREFIX=SDA the broker
+// host is read from SDA_BROKER_HOST instead of BROKER_HOST
+const EnvPrefixVar = "ENVPREFIX"
+
+// envPrefix is the prefix of the environment variables, including the
+// trailing underscore, or empty when none is set
+var envPrefix string
+
+// aliases are the former names of renamed settings, mapped to their
+// current names. They are still read, with a warning.
+var aliases = map[string]string{
+	"elixir.id":          "oidc.id",
+	"elixir.secret":      "oidc.secret",
+	"elixir.provider":    "oidc.provider",
+	"elixir.jwkpath":     "oidc.jwkpath",
+	"elixir.redirecturl": "oidc.redirecturl",
+}
+
+// aliasedKeys are the settings that were taken from a former name, by key
+var aliasedKeys = map[string]string{}
+
+// setEnvPrefix makes viper read the environment variables of the settings
+// with the prefix given in EnvPrefixVar, if any
+func setEnvPrefix() {
+	envPrefix = ""
+	if prefix := strings.TrimSuffix(os.Getenv(EnvPrefixVar), "_"); prefix != "" {
+		viper.SetEnvPrefix(prefix)
+		envPrefix = strings.ToUpper(prefix) + "_"
+	}
+}
+
+// envName returns the environment variable of the setting key
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// envKey returns the setting of the environment variable name, ok is false
+// when name does not have the env prefix
+func envKey(name string) (key string, ok bool) {
+	name, ok = strings.CutPrefix(name, envPrefix)
+	if !ok || name == "" {
+		return "", false
+	}
+
+	return strings.ToLower(strings.ReplaceAll(name, "_", ".")), true
+}
+
+// resolveAliases sets the renamed settings that are only given by their
+// former names, and warns about the use of the former names
+func resolveAliases() {
+	aliasedKeys = map[string]string{}
+	for alias, key := range aliases {
+		if !viper.IsSet(alias) {
+			continue
+		}
+
+		_, inEnv := os.LookupEnv(envName(key))
+		if inEnv || viper.InConfig(key) || isRemote(key) {
+			log.Warnf("%s is deprecated and ignored since %s is set", alias, key)
+
+			continue
+		}
+
+		log.Warnf("%s is deprecated, use %s instead", alias, key)
+		viper.Set(key, viper.Get(alias))
+		aliasedKeys[key] = alias
+	}
+}
@@ -0,0 +1,492 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Remote providers that the configuration can be read from, set with
+// remote.provider together with remote.endpoint and remote.path. Consul is
+// given an ACL token with remote.token, etcd a user with remote.username and
+// remote.password.
+const (
+	ConsulProvider = "consul"
+	EtcdProvider   = "etcd3"
+)
+
+// RemoteRetryInterval is how long WatchRemoteConfig waits before watching
+// the remote configuration again after a failure
+var RemoteRetryInterval = 10 * time.Second
+
+// remoteWait is how long a watch of the remote configuration is held open
+// by the remote store before it is made again
+const remoteWait = 5 * time.Minute
+
+// remoteKeys are the settings that were read from the remote store
+var remoteKeys = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: map[string]bool{}}
+
+// remoteProvider is a location of the configuration in a remote store
+type remoteProvider struct {
+	provider string
+	endpoint string
+	path     string
+	token    string
+	username string
+	password string
+}
+
+func (rp remoteProvider) Provider() string      { return rp.provider }
+func (rp remoteProvider) Endpoint() string      { return rp.endpoint }
+func (rp remoteProvider) Path() string          { return rp.path }
+func (rp remoteProvider) SecretKeyring() string { return "" }
+
+// remoteStore reads the configuration from Consul KV or the etcd v3 JSON
+// gateway for viper, so that no client libraries of the stores are needed
+type remoteStore struct {
+	mu      sync.Mutex
+	client  *http.Client
+	current remoteProvider
+	read    map[string]remoteRead
+}
+
+// remoteRead is the last read of a configuration in the remote store
+type remoteRead struct {
+	data  []byte
+	index uint64
+	err   error
+}
+
+var store = &remoteStore{read: map[string]remoteRead{}}
+
+// readRemoteConfig reads the configuration from the remote store given by
+// remote.provider, remote.endpoint and remote.path, if any. Settings in the
+// config file or the environment take precedence over the remote ones.
+func readRemoteConfig() error {
+	rp, ok, err := remoteSettings()
+	if err != nil || !ok {
+		remoteKeys.Lock()
+		remoteKeys.keys = map[string]bool{}
+		remoteKeys.Unlock()
+
+		return err
+	}
+
+	store.mu.Lock()
+	store.current = rp
+	store.client = outbound.Client(0)
+	store.mu.Unlock()
+	viper.RemoteConfig = store
+	if err := viper.AddRemoteProvider(rp.provider, rp.endpoint, rp.path); err != nil {
+		return err
+	}
+
+	if err := viper.ReadRemoteConfig(); err != nil {
+		if read := store.lastRead(rp); read.err != nil {
+			err = read.err
+		}
+
+		return fmt.Errorf("failed to read %s from %s, reason: %v", rp.path, rp.endpoint, err)
+	}
+
+	remote := viper.New()
+	remote.SetConfigType("yaml")
+	if err := remote.ReadConfig(bytes.NewReader(store.lastRead(rp).data)); err != nil {
+		return fmt.Errorf("failed to parse %s from %s, reason: %v", rp.path, rp.endpoint, err)
+	}
+	keys := map[string]bool{}
+	for _, key := range remote.AllKeys() {
+		keys[key] = true
+	}
+	remoteKeys.Lock()
+	remoteKeys.keys = keys
+	remoteKeys.Unlock()
+	log.Infof("read the configuration from %s %s", rp.provider, rp.path)
+
+	return nil
+}
+
+// remoteSettings returns the remote store to read the configuration from,
+// ok is false when none is set
+func remoteSettings() (rp remoteProvider, ok bool, err error) {
+	rp = remoteProvider{
+		provider: viper.GetString("remote.provider"),
+		endpoint: viper.GetString("remote.endpoint"),
+		path:     viper.GetString("remote.path"),
+		token:    viper.GetString("remote.token"),
+		username: viper.GetString("remote.username"),
+		password: viper.GetString("remote.password"),
+	}
+	switch {
+	case rp.provider == "":
+		return rp, false, nil
+	case rp.provider != ConsulProvider && rp.provider != EtcdProvider:
+		return rp, false, fmt.Errorf("remote.provider must be %s or %s", ConsulProvider, EtcdProvider)
+	case rp.endpoint == "" || rp.path == "":
+		return rp, false, fmt.Errorf("remote.endpoint and remote.path must be set when remote.provider is set")
+	}
+
+	return rp, true, nil
+}
+
+// isRemote reports whether the setting key was read from the remote store
+func isRemote(key string) bool {
+	remoteKeys.Lock()
+	defer remoteKeys.Unlock()
+
+	return remoteKeys.keys[key]
+}
+
+// WatchRemoteConfig calls changed when the configuration in the remote store
+// changes, so that a fleet of services can be re-tuned in one place. It
+// returns when ctx is cancelled, or at once when no remote store is set.
+func WatchRemoteConfig(ctx context.Context, changed func()) {
+	var last []byte
+	var index uint64
+	watched := false
+	for ctx.Err() == nil {
+		rp, ok, err := remoteSettings()
+		if !ok {
+			if err != nil {
+				log.Errorf("failed to watch the remote configuration, reason: %v", err)
+			}
+
+			return
+		}
+
+		data, next, err := store.watch(ctx, rp, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("failed to watch %s at %s, reason: %v", rp.path, rp.endpoint, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(RemoteRetryInterval):
+			}
+
+			continue
+		}
+
+		if watched && !bytes.Equal(data, last) {
+			log.Info("remote configuration changed, reading the configuration again")
+			changed()
+		}
+		last, index, watched = data, next, true
+		if index == 0 {
+			// the store gave no index to wait on
+			select {
+			case <-ctx.Done():
+			case <-time.After(RemoteRetryInterval):
+			}
+		}
+	}
+}
+
+// Get returns the configuration stored at rp
+func (s *remoteStore) Get(rp viper.RemoteProvider) (io.Reader, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	current, err := s.provider(rp)
+	if err != nil {
+		return nil, err
+	}
+	data, index, err := s.watch(ctx, current, 0)
+	s.setRead(rp, remoteRead{data: data, index: index, err: err})
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// Watch returns the configuration stored at rp once it has changed since it
+// was last read
+func (s *remoteStore) Watch(rp viper.RemoteProvider) (io.Reader, error) {
+	current, err := s.provider(rp)
+	if err != nil {
+		return nil, err
+	}
+	data, index, err := s.watch(context.Background(), current, s.lastRead(rp).index)
+	if err != nil {
+		return nil, err
+	}
+	s.setRead(rp, remoteRead{data: data, index: index})
+
+	return bytes.NewReader(data), nil
+}
+
+// WatchChannel sends the configuration stored at rp every time it changes,
+// until true is sent on the returned quit channel
+func (s *remoteStore) WatchChannel(rp viper.RemoteProvider) (<-chan *viper.RemoteResponse, chan bool) {
+	responses := make(chan *viper.RemoteResponse)
+	quit := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	go func() {
+		var index uint64
+		for ctx.Err() == nil {
+			current, err := s.provider(rp)
+			var data []byte
+			if err == nil {
+				data, index, err = s.watch(ctx, current, index)
+			}
+			select {
+			case responses <- &viper.RemoteResponse{Value: data, Error: err}:
+			case <-ctx.Done():
+			}
+			if err != nil {
+				select {
+				case <-ctx.Done():
+				case <-time.After(RemoteRetryInterval):
+				}
+			}
+		}
+	}()
+
+	return responses, quit
+}
+
+// provider returns the current remote settings when rp is the store they
+// name. Viper keeps the providers of earlier reads, e.g. before remote.path
+// was changed, and skips them on these errors.
+func (s *remoteStore) provider(rp viper.RemoteProvider) (remoteProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rp.Provider() != s.current.provider || rp.Endpoint() != s.current.endpoint || rp.Path() != s.current.path {
+		return remoteProvider{}, fmt.Errorf("%s %s is no longer configured", rp.Provider(), rp.Path())
+	}
+
+	return s.current, nil
+}
+
+func (s *remoteStore) httpClient() *http.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client
+}
+
+func (s *remoteStore) lastRead(rp viper.RemoteProvider) remoteRead {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read[rp.Endpoint()+rp.Path()]
+}
+
+func (s *remoteStore) setRead(rp viper.RemoteProvider, read remoteRead) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.read[rp.Endpoint()+rp.Path()] = read
+}
+
+// watch returns the configuration stored at rp and its index in the store.
+// When index is not 0 the call blocks until the configuration has a newer
+// index, or the store gives up waiting.
+func (s *remoteStore) watch(ctx context.Context, rp remoteProvider, index uint64) ([]byte, uint64, error) {
+	endpoint := rp.endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	if rp.provider == ConsulProvider {
+		return s.watchConsul(ctx, endpoint, rp, index)
+	}
+	if rp.username != "" {
+		token, err := s.authenticateEtcd(ctx, endpoint, rp)
+		if err != nil {
+			return nil, 0, err
+		}
+		rp.token = token
+	}
+	if index == 0 {
+		return s.rangeEtcd(ctx, endpoint, rp)
+	}
+
+	return s.watchEtcd(ctx, endpoint, rp, index)
+}
+
+// watchConsul reads a key from Consul KV, using a blocking query when index
+// is set
+func (s *remoteStore) watchConsul(ctx context.Context, endpoint string, rp remoteProvider, index uint64) ([]byte, uint64, error) {
+	query := url.Values{"raw": {""}}
+	if index != 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", remoteWait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v1/kv/"+strings.TrimPrefix(rp.path, "/")+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rp.token != "" {
+		req.Header.Set("X-Consul-Token", rp.token)
+	}
+
+	res, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, 0, fmt.Errorf("key %s not found", rp.path)
+	default:
+		return nil, 0, fmt.Errorf("consul returned status %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	next, _ := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if next < index {
+		// the index went backwards, e.g. after a restore of the store
+		next = 0
+	}
+
+	return data, next, nil
+}
+
+// etcdKV is a key-value pair in the responses of the etcd v3 JSON gateway
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision uint64 `json:"mod_revision,string"`
+}
+
+// rangeEtcd reads a key from etcd
+func (s *remoteStore) rangeEtcd(ctx context.Context, endpoint string, rp remoteProvider) ([]byte, uint64, error) {
+	var res struct {
+		Header struct {
+			Revision uint64 `json:"revision,string"`
+		} `json:"header"`
+		KVs []etcdKV `json:"kvs"`
+	}
+	body, err := s.callEtcd(ctx, endpoint+"/v3/kv/range", rp.token, map[string]any{"key": []byte(rp.path)})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&res); err != nil {
+		return nil, 0, err
+	}
+	if len(res.KVs) == 0 {
+		return nil, 0, fmt.Errorf("key %s not found", rp.path)
+	}
+
+	return res.KVs[0].Value, res.Header.Revision, nil
+}
+
+// watchEtcd waits for a change of a key in etcd after revision, and returns
+// its new value
+func (s *remoteStore) watchEtcd(ctx context.Context, endpoint string, rp remoteProvider, revision uint64) ([]byte, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteWait)
+	defer cancel()
+
+	body, err := s.callEtcd(ctx, endpoint+"/v3/watch", rp.token, map[string]any{
+		"create_request": map[string]any{"key": []byte(rp.path), "start_revision": strconv.FormatUint(revision+1, 10)},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var res struct {
+			Result struct {
+				Events []struct {
+					Type string `json:"type"`
+					KV   etcdKV `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := decoder.Decode(&res); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				// nothing changed while waiting
+				return s.rangeEtcd(context.Background(), endpoint, rp)
+			}
+
+			return nil, 0, err
+		}
+		if n := len(res.Result.Events); n > 0 {
+			event := res.Result.Events[n-1]
+			if event.Type == "DELETE" {
+				return nil, 0, fmt.Errorf("key %s was deleted", rp.path)
+			}
+
+			return event.KV.Value, event.KV.ModRevision, nil
+		}
+	}
+}
+
+// authenticateEtcd logs in to etcd as the user of rp and returns the token
+// to make the requests with
+func (s *remoteStore) authenticateEtcd(ctx context.Context, endpoint string, rp remoteProvider) (string, error) {
+	var res struct {
+		Token string `json:"token"`
+	}
+	body, err := s.callEtcd(ctx, endpoint+"/v3/auth/authenticate", "", map[string]any{"name": rp.username, "password": rp.password})
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate to etcd as %s, reason: %v", rp.username, err)
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&res); err != nil {
+		return "", err
+	}
+
+	return res.Token, nil
+}
+
+// callEtcd posts a request to the etcd v3 JSON gateway, with the token of
+// an authenticated user if any, and returns the body of the response
+func (s *remoteStore) callEtcd(ctx context.Context, url, token string, in any) (io.ReadCloser, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	res, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+
+		return nil, fmt.Errorf("etcd returned status %d", res.StatusCode)
+	}
+
+	return res.Body, nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SecretFileSuffix marks a setting naming the file that the value of a
+// secret setting is read from, e.g. broker.password_file or
+// BROKER_PASSWORD_FILE, as with Kubernetes and Docker secrets
+const SecretFileSuffix = "_file"
+
+// SecretCheckInterval is how often WatchSecretFiles checks the secret files
+// for changes
+var SecretCheckInterval = 30 * time.Second
+
+// secretFiles are the files the secret settings were read from, by key
+var secretFiles = struct {
+	sync.Mutex
+	files map[string]string
+}{files: map[string]string{}}
+
+// resolveSecretFiles sets the secret settings that are given as files to
+// the content of the files, without the trailing newline. A file takes
+// precedence over a value given for the setting itself.
+func resolveSecretFiles() error {
+	files := map[string]string{}
+	for _, key := range viper.AllKeys() {
+		if base, ok := strings.CutSuffix(key, SecretFileSuffix); ok && isSecret(base) {
+			files[base] = viper.GetString(key)
+		}
+	}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if base, ok := strings.CutSuffix(name, strings.ToUpper(SecretFileSuffix)); ok {
+			if key, ok := envKey(base); ok && isSecret(key) {
+				files[key] = value
+			}
+		}
+	}
+
+	for key, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s for %s, reason: %v", file, key, err)
+		}
+		viper.Set(key, strings.TrimRight(string(data), "\r\n"))
+	}
+
+	secretFiles.Lock()
+	secretFiles.files = files
+	secretFiles.Unlock()
+
+	return nil
+}
+
+// SecretFiles returns the files the secret settings were read from
+func SecretFiles() []string {
+	secretFiles.Lock()
+	defer secretFiles.Unlock()
+
+	files := slices.Collect(maps.Values(secretFiles.files))
+	slices.Sort(files)
+
+	return slices.Compact(files)
+}
+
+// secretFile returns the file the setting key was read from, if any
+func secretFile(key string) (string, bool) {
+	secretFiles.Lock()
+	defer secretFiles.Unlock()
+
+	file, ok := secretFiles.files[key]
+
+	return file, ok
+}
+
+// WatchSecretFiles calls changed when the content of one of the secret
+// files changes, e.g. when a mounted secret is updated. It returns when ctx
+// is cancelled.
+func WatchSecretFiles(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(SecretCheckInterval)
+	defer ticker.Stop()
+
+	last := fileContents(SecretFiles())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := fileContents(SecretFiles())
+		if maps.Equal(current, last) {
+			continue
+		}
+		last = current
+		log.Info("secret files changed, reading the configuration again")
+		changed()
+	}
+}
+
+// fileContents returns the content of the files, missing files are left
+// out
+func fileContents(files []string) map[string]string {
+	contents := map[string]string{}
+	for _, f := range files {
+		if data, err := os.ReadFile(f); err == nil {
+			contents[f] = string(data)
+		}
+	}
+
+	return contents
+}
+
+// isSecret reports whether the setting key holds a password, key or other
+// secret
+func isSecret(key string) bool {
+	name := strings.ToLower(key[strings.LastIndex(key, ".")+1:])
+
+	return slices.ContainsFunc(secretWords, func(word string) bool { return strings.Contains(name, word) })
+}
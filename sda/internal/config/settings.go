@@ -0,0 +1,124 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Setting is a resolved setting of the configuration and where its value
+// was taken from: flag, env, file, remote, secretfile or default. Settings read from
+// a secret file or fetched from AWS name the file, secret or parameter as
+// well, and settings given by a former name name that.
+type Setting struct {
+	Key    string `json:"key"`
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// commandLine holds the flags parsed by NewConfig, and flagKeys the
+// settings they are bound to
+var (
+	commandLine *pflag.FlagSet
+	flagKeys    = map[string]string{"db.migrate": "migrate", "validate": "validate"}
+)
+
+// awsRefs are the references to AWS of the settings resolved by
+// resolveAWSValues, by key
+var awsRefs = map[string]string{}
+
+// secretWords mark the settings whose values are masked in Settings
+var secretWords = []string{"password", "passphrase", "secret", "accesskey", "pemkeypass", "token"}
+
+// Settings returns the resolved settings sorted by key, with the values of
+// passwords, keys and other secrets masked. Settings only given in the
+// environment are found by the sections of the known settings.
+func Settings() []Setting {
+	keys := viper.AllKeys()
+	sections := map[string]bool{}
+	for _, key := range append(slices.Clone(keys), requiredConfVars...) {
+		section, _, _ := strings.Cut(strings.ToLower(key), ".")
+		sections[section] = true
+	}
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		key, ok := envKey(name)
+		section, _, found := strings.Cut(key, ".")
+		if ok && found && sections[section] && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	settings := make([]Setting, 0, len(keys))
+	for _, key := range keys {
+		settings = append(settings, Setting{Key: key, Value: maskSecret(key, viper.Get(key)), Source: settingSource(key)})
+	}
+
+	return settings
+}
+
+// settingSource tells where the value of key was taken from
+func settingSource(key string) string {
+	if alias, ok := aliasedKeys[key]; ok {
+		return settingSource(alias) + ", deprecated " + alias
+	}
+
+	source := "default"
+	_, inEnv := os.LookupEnv(envName(key))
+	switch {
+	case commandLine != nil && flagKeys[key] != "" && commandLine.Changed(flagKeys[key]):
+		source = "flag"
+	case inEnv:
+		source = "env"
+	case viper.InConfig(key):
+		source = "file"
+	case isRemote(key):
+		source = "remote"
+	}
+	if file, ok := secretFile(key); ok {
+		source = "secretfile, " + file
+	}
+	if ref, ok := awsRefs[key]; ok {
+		source += ", " + ref
+	}
+
+	return source
+}
+
+// dsnPassword matches the password of a connection string, e.g. that of
+// db.replicaDSN, quoted or not, and the sslpassword of its client key
+var dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&]+)`)
+
+// maskSecret hides the value of key if it is a secret, and the passwords
+// in connection strings and URLs of the other settings
+func maskSecret(key string, value any) any {
+	if value == nil || value == "" {
+		return value
+	}
+	if isSecret(key) {
+		return "***"
+	}
+	if s, ok := value.(string); ok {
+		return maskCredentials(s)
+	}
+
+	return value
+}
+
+// maskCredentials hides the password of the user info of a URL, and the
+// password given in a connection string
+func maskCredentials(value string) string {
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			value = strings.Replace(u.Redacted(), ":xxxxx@", ":***@", 1)
+		}
+	}
+
+	return dsnPassword.ReplaceAllString(value, "${1}***")
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/storage"
+	"github.com/spf13/viper"
+)
+
+// Validate checks what can be checked in the configuration without
+// connecting to anything: that the files and directories it names can be
+// read, that the ports are valid and that the message schemas can be read.
+// All problems are returned together.
+func (c *Config) Validate() error {
+	v := &validation{}
+
+	v.port("broker.port", c.Broker.Port)
+	if c.Broker.Ssl {
+		v.file("broker.cacert", c.Broker.CACert)
+		v.file("broker.clientCert", c.Broker.ClientCert)
+		v.file("broker.clientKey", c.Broker.ClientKey)
+	}
+	if c.Broker.SchemasPath != "" {
+		v.schemas("schema.path", c.Broker.SchemasPath)
+	}
+
+	v.port("db.port", c.Database.Port)
+	v.file("db.cacert", c.Database.CACert)
+	v.file("db.clientCert", c.Database.ClientCert)
+	v.file("db.clientKey", c.Database.ClientKey)
+
+	v.storage("inbox", c.Inbox)
+	v.storage("archive", c.Archive)
+	v.storage("backup", c.Backup)
+	v.storage("sync.destination", c.Sync.Destination)
+
+	v.file("server.cert", c.Server.Cert)
+	v.file("server.key", c.Server.Key)
+	v.path("server.jwtpubkeypath", c.Server.Jwtpubkeypath)
+
+	v.port("api.port", c.API.Port)
+	v.file("api.serverCert", c.API.ServerCert)
+	v.file("api.serverKey", c.API.ServerKey)
+	v.file("api.CACert", c.API.CACert)
+
+	v.port("grpc.port", c.ReEncrypt.Port)
+	v.file("grpc.cacert", c.ReEncrypt.CACert)
+	v.file("grpc.servercert", c.ReEncrypt.ServerCert)
+	v.file("grpc.serverkey", c.ReEncrypt.ServerKey)
+
+	v.port("smtp.port", c.Notify.Port)
+	v.port("sync.remote.port", c.Sync.RemotePort)
+
+	for _, key := range c.Auth.JwtSigningKeys {
+		v.file("auth.jwt.signingKeys", key.FilePath)
+	}
+	v.file("c4gh.filepath", viper.GetString("c4gh.filepath"))
+	var keySet []C4GHprivateKeyConf
+	if err := viper.UnmarshalKey("c4gh.privateKeys", &keySet); err != nil {
+		v.errs = append(v.errs, fmt.Errorf("c4gh.privateKeys: %w", err))
+	}
+	for _, key := range keySet {
+		v.file("c4gh.privateKeys", key.FilePath)
+	}
+	v.file("c4gh.syncPubKeyPath", viper.GetString("c4gh.syncPubKeyPath"))
+
+	return errors.Join(v.errs...)
+}
+
+// validation collects the problems found by Validate, empty settings are
+// not checked since the required ones are checked by NewConfig
+type validation struct {
+	errs []error
+}
+
+// file checks that the file can be read
+func (v *validation) file(key, name string) {
+	if name == "" {
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		v.errs = append(v.errs, fmt.Errorf("%s: %w", key, err))
+
+		return
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		v.errs = append(v.errs, fmt.Errorf("%s: %s is a directory", key, name))
+	}
+}
+
+// path checks that the file or directory exists
+func (v *validation) path(key, name string) {
+	if name == "" {
+		return
+	}
+
+	if _, err := os.Stat(name); err != nil {
+		v.errs = append(v.errs, fmt.Errorf("%s: %w", key, err))
+	}
+}
+
+// dir checks that the directory exists
+func (v *validation) dir(key, name string) {
+	if name == "" {
+		return
+	}
+
+	info, err := os.Stat(name)
+	switch {
+	case err != nil:
+		v.errs = append(v.errs, fmt.Errorf("%s: %w", key, err))
+	case !info.IsDir():
+		v.errs = append(v.errs, fmt.Errorf("%s: %s is not a directory", key, name))
+	}
+}
+
+// port checks that the port is a valid TCP port
+func (v *validation) port(key string, port int) {
+	if port < 0 || port > 65535 {
+		v.errs = append(v.errs, fmt.Errorf("%s: %d is not a valid port", key, port))
+	}
+}
+
+// schemas checks that the message schemas in dir can be read
+func (v *validation) schemas(key, dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		v.errs = append(v.errs, fmt.Errorf("%s: %w", key, err))
+
+		return
+	}
+	if len(files) == 0 {
+		v.errs = append(v.errs, fmt.Errorf("%s: no schemas found in %s", key, dir))
+
+		return
+	}
+	for _, file := range files {
+		v.file(key, file)
+	}
+}
+
+// storage checks the settings of the storage configured under prefix
+func (v *validation) storage(prefix string, conf storage.Conf) {
+	switch conf.Type {
+	case S3:
+		v.port(prefix+".port", conf.S3.Port)
+		v.file(prefix+".cacert", conf.S3.CAcert)
+		switch conf.S3.Credentials.Provider {
+		case storage.FileCredentials:
+			v.file(prefix+".credentials.file", conf.S3.Credentials.File)
+		case storage.VaultCredentials:
+			v.file(prefix+".credentials.vault.tokenfile", conf.S3.Credentials.Vault.TokenFile)
+		}
+	case SFTP:
+		if conf.SFTP.Port != "" {
+			port, err := strconv.Atoi(conf.SFTP.Port)
+			if err != nil {
+				v.errs = append(v.errs, fmt.Errorf("%s.sftp.port: %s is not a valid port", prefix, conf.SFTP.Port))
+			} else {
+				v.port(prefix+".sftp.port", port)
+			}
+		}
+		v.file(prefix+".sftp.pemKeyPath", conf.SFTP.PemKeyPath)
+	case POSIX:
+		v.dir(prefix+".location", conf.Posix.Location)
+	}
+}
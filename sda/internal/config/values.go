@@ -0,0 +1,139 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// InvalidValueError tells that a setting has a value that is not in the
+// expected format, e.g. a URL without a scheme or a negative timeout
+type InvalidValueError struct {
+	Key      string
+	Value    string
+	Expected string
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("%s: %q is not valid, expected %s", e.Key, e.Value, e.Expected)
+}
+
+// format is the expected format of the value of a setting
+type format struct {
+	expected string
+	valid    func(value string) bool
+}
+
+var (
+	httpURL = format{"an http or https URL such as https://host.example.org", func(value string) bool {
+		u, err := url.Parse(value)
+
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	}}
+	port            = format{"a port number between 1 and 65535", intBetween(1, 65535)}
+	seconds         = format{"a whole number of seconds, 0 or more", intBetween(0, math.MaxInt)}
+	positiveSeconds = format{"a whole number of seconds, 1 or more", intBetween(1, math.MaxInt)}
+	hours           = format{"a whole number of hours, 0 or more", intBetween(0, math.MaxInt)}
+	positiveHours   = format{"a whole number of hours, 1 or more", intBetween(1, math.MaxInt)}
+	milliseconds    = format{"a whole number of milliseconds, 0 or more", intBetween(0, math.MaxInt)}
+	days            = format{"a whole number of days, 0 or more", intBetween(0, math.MaxInt)}
+	count           = format{"a whole number, 0 or more", intBetween(0, math.MaxInt)}
+	// sessionSeconds allows -1 for a session cookie that ends when the
+	// browser is closed
+	sessionSeconds = format{"a whole number of seconds, or -1 to end the session when the browser is closed", intBetween(-1, math.MaxInt)}
+)
+
+// formats are the expected formats of the settings whose values are checked
+// when the configuration is read
+var formats = map[string]format{
+	"api.breakerCooldown":             seconds,
+	"api.port":                        port,
+	"api.requestTimeout":              seconds,
+	"api.retryAfter":                  seconds,
+	"api.session.expiration":          sessionSeconds,
+	"auth.audit.retention":            days,
+	"auth.cega.authUrl":               httpURL,
+	"auth.device.codeLimit":           count,
+	"auth.device.codeTTL":             positiveSeconds,
+	"auth.device.pollInterval":        seconds,
+	"auth.jwt.refreshTTL":             hours,
+	"auth.jwt.tokenTTL":               positiveHours,
+	"auth.loginLimit.accountFailures": count,
+	"auth.loginLimit.addressFailures": count,
+	"auth.loginLimit.lockout":         seconds,
+	"auth.loginLimit.window":          positiveSeconds,
+	"auth.publicUrl":                  httpURL,
+	"auth.webauthn.origin":            httpURL,
+	"broker.managementURL":            httpURL,
+	"broker.port":                     port,
+	"db.connMaxLifetime":              seconds,
+	"db.port":                         port,
+	"db.retryDelay":                   milliseconds,
+	"db.retryMaxDelay":                milliseconds,
+	"db.schemaWait":                   seconds,
+	"grpc.port":                       port,
+	"oidc.provider":                   httpURL,
+	"oidc.redirectUrl":                httpURL,
+	"server.jwksrefresh":              seconds,
+	"server.jwtclockskew":             seconds,
+	"server.jwtpubkeyurl":             httpURL,
+	"smtp.port":                       port,
+	"sync.remote.port":                port,
+	"tracing.endpoint":                httpURL,
+}
+
+// storagePrefixes are the settings of the storages, whose values are
+// checked as well
+var storagePrefixes = []string{"inbox", "archive", "backup", "sync.destination"}
+
+func init() {
+	for _, prefix := range storagePrefixes {
+		formats[prefix+".url"] = httpURL
+		formats[prefix+".port"] = port
+		formats[prefix+".sftp.port"] = port
+		formats[prefix+".credentials.refresh"] = seconds
+		formats[prefix+".credentials.vault.address"] = httpURL
+	}
+}
+
+// checkValues checks the values of the settings that have an expected
+// format, settings that are not set are not checked. All invalid values are
+// returned together, as InvalidValueErrors sorted by key.
+func checkValues() error {
+	var invalid []*InvalidValueError
+	for key, f := range formats {
+		if !viper.IsSet(key) {
+			continue
+		}
+		value := strings.TrimSpace(fmt.Sprint(viper.Get(key)))
+		if value == "" || f.valid(value) {
+			continue
+		}
+		invalid = append(invalid, &InvalidValueError{Key: key, Value: value, Expected: f.expected})
+	}
+	slices.SortFunc(invalid, func(a, b *InvalidValueError) int { return cmp.Compare(a.Key, b.Key) })
+
+	errs := make([]error, 0, len(invalid))
+	for _, e := range invalid {
+		errs = append(errs, e)
+	}
+
+	return errors.Join(errs...)
+}
+
+// intBetween returns a check that the value is a whole number between
+// lowest and highest
+func intBetween(lowest, highest int) func(string) bool {
+	return func(value string) bool {
+		n, err := strconv.Atoi(value)
+
+		return err == nil && n >= lowest && n <= highest
+	}
+}
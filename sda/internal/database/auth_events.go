@@ -0,0 +1,42 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// AuthEvent is an entry of the audit log of auth, e.g. a login with the
+// provider that the user logged in with and where the user came from
+type AuthEvent struct {
+	Event      string
+	Subject    string
+	Provider   string
+	Outcome    string
+	RemoteAddr string
+	UserAgent  string
+}
+
+// AddAuthEvent adds an entry to the audit log of auth, and deletes the
+// entries older than retention unless it is 0
+func (dbs *SDAdb) AddAuthEvent(event AuthEvent, retention time.Duration) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		if dbs.Version < 46 {
+			return errors.New("database schema v46 required for AddAuthEvent()")
+		}
+
+		if retention > 0 {
+			const purge = "DELETE FROM sda.auth_events WHERE created_at < clock_timestamp() - $1 * INTERVAL '1 second';"
+			if _, err := dbs.DB.Exec(purge, int64(retention.Seconds())); err != nil {
+				return err
+			}
+		}
+
+		const query = "INSERT INTO sda.auth_events(event, subject, provider, outcome, remote_addr, user_agent) " +
+			"VALUES($1, NULLIF($2, ''), NULLIF($3, ''), $4, NULLIF($5, ''), NULLIF($6, ''));"
+		_, err := dbs.DB.Exec(query, event.Event, event.Subject, event.Provider, event.Outcome, event.RemoteAddr, event.UserAgent)
+
+		return err
+	})
+}
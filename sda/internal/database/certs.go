@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CertCheckInterval is how often the TLS files of the database connection
+// are checked for changes
+var CertCheckInterval = 30 * time.Second
+
+// CertRecycleLifetime is the lifetime of the pooled connections after the
+// TLS files changed, connections in use are closed when they are returned
+// once they are older than this
+var CertRecycleLifetime = time.Second
+
+// defaultMaxIdleConns is the database/sql default for idle connections,
+// restored after the pool has been emptied when no limit is configured
+const defaultMaxIdleConns = 2
+
+// WatchCerts recycles the pooled connections when the client certificate,
+// key or CA certificate of the connection change on disk, e.g. when they are
+// rotated by cert-manager, so that new connections are made with the new
+// files. Idle connections are closed at once, connections in use are closed
+// when they are returned. The configured connection lifetime is restored at
+// the first check where no connection is in use. It returns when ctx is
+// cancelled.
+func (dbs *SDAdb) WatchCerts(ctx context.Context) {
+	files := dbs.Config.certFiles()
+	if len(files) == 0 {
+		<-ctx.Done()
+
+		return
+	}
+
+	ticker := time.NewTicker(CertCheckInterval)
+	defer ticker.Stop()
+
+	last := fileStamps(files)
+	recycling := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if recycling && dbs.Config.recycled(dbs.DB) && (dbs.Replica == nil || dbs.Config.recycled(dbs.Replica)) {
+			log.Info("connections with the old database TLS files are closed")
+			recycling = false
+		}
+
+		current := fileStamps(files)
+		if maps.Equal(current, last) {
+			continue
+		}
+		// the files are replaced one at a time, wait until they match
+		if err := dbs.Config.loadCerts(); err != nil {
+			log.Warnf("database TLS files changed but can not be loaded yet, reason: %v", err)
+
+			continue
+		}
+		last = current
+
+		log.Info("database TLS files changed, reconnecting with the new certificates")
+		dbs.Config.recyclePool(dbs.DB)
+		if dbs.Replica != nil {
+			dbs.Config.recyclePool(dbs.Replica)
+		}
+		recycling = true
+	}
+}
+
+// certFiles returns the TLS files used by the connection
+func (config *DBConf) certFiles() []string {
+	if config.SslMode == "disable" {
+		return nil
+	}
+
+	var files []string
+	for _, f := range []string{config.CACert, config.ClientCert, config.ClientKey} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+// loadCerts checks that the TLS files can be used for a connection
+func (config *DBConf) loadCerts() error {
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if _, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey); err != nil {
+			return err
+		}
+	}
+	if config.CACert != "" {
+		pem, err := os.ReadFile(config.CACert)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + config.CACert)
+		}
+	}
+
+	return nil
+}
+
+// recyclePool closes the idle connections and shortens the lifetime of the
+// connections in use, the pool then opens new connections as needed
+func (config *DBConf) recyclePool(db *sql.DB) {
+	db.SetConnMaxLifetime(CertRecycleLifetime)
+	config.dropIdle(db)
+}
+
+// recycled restores the configured connection lifetime once no connection
+// is in use, all connections made before the recycle are closed by then
+func (config *DBConf) recycled(db *sql.DB) bool {
+	if db.Stats().InUse > 0 {
+		return false
+	}
+	config.dropIdle(db)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	return true
+}
+
+// dropIdle closes the idle connections of the pool
+func (config *DBConf) dropIdle(db *sql.DB) {
+	db.SetMaxIdleConns(0)
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	} else {
+		db.SetMaxIdleConns(defaultMaxIdleConns)
+	}
+}
+
+// fileStamps returns the modification time and size of the files, missing
+// files are left out
+func fileStamps(files []string) map[string]string {
+	stamps := map[string]string{}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			stamps[f] = fmt.Sprintf("%s/%d", info.ModTime(), info.Size())
+		}
+	}
+
+	return stamps
+}
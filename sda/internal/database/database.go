@@ -3,8 +3,10 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,6 +23,32 @@ type DBConf struct {
 	SslMode    string
 	ClientCert string
 	ClientKey  string
+	// RetryTimes is how many times an operation is attempted, RetryDelay is
+	// the wait after the first failed attempt, which is doubled for each
+	// following attempt up to RetryMaxDelay. RetryJitter randomizes the wait
+	// by up to the given fraction.
+	RetryTimes    int
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+	RetryJitter   float64
+	// Connection pool limits, zero leaves the database/sql default in place,
+	// i.e. no limit on open connections or connection lifetime and two idle
+	// connections.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// Migrate makes the service apply the embedded schema migrations when
+	// it connects
+	Migrate bool
+	// ReplicaDSN is the data source name of a read-only replica, queries
+	// that only read data are sent to it when set
+	ReplicaDSN string
+	// RequiredVersion is the lowest schema version the service works with,
+	// it is set by the service and checked when connecting
+	RequiredVersion int
+	// SchemaWait is how long to wait at startup for the schema to be
+	// migrated to RequiredVersion before giving up
+	SchemaWait time.Duration
 }
 
 // SDAdb struct that acts as a receiver for the DB update methods
@@ -28,8 +56,40 @@ type SDAdb struct {
 	DB      *sql.DB
 	Version int
 	Config  DBConf
+	// Replica is the connection to the read-only replica, nil when none is
+	// configured
+	Replica *sql.DB
+	// replicaUp tells whether the replica responded to the latest ping, it
+	// is kept up to date by watchReplica
+	replicaUp *atomic.Bool
+	// stopReplica ends the pings of the replica
+	stopReplica context.CancelFunc
+	// ctx is the context the calls are traced in, set with WithContext
+	ctx context.Context
 }
 
+// WithContext returns a copy of dbs whose calls to the database functions
+// are traced as part of the trace in ctx, e.g. that of a request or of the
+// submission a message belongs to
+func (dbs *SDAdb) WithContext(ctx context.Context) *SDAdb {
+	traced := *dbs
+	traced.ctx = ctx
+
+	return &traced
+}
+
+// traceContext returns the context the calls are traced in
+func (dbs *SDAdb) traceContext() context.Context {
+	if dbs.ctx == nil {
+		return context.Background()
+	}
+
+	return dbs.ctx
+}
+
+// ChecksumAlgorithms are the algorithms that checksums can be stored with
+var ChecksumAlgorithms = []string{"md5", "sha256", "sha384", "sha512", "sha3-256", "crc32c"}
+
 // FileInfo is used by ingest for file metadata (path, size, checksum)
 type FileInfo struct {
 	Checksum          string
@@ -37,6 +97,11 @@ type FileInfo struct {
 	Path              string
 	DecryptedChecksum string
 	DecryptedSize     int64
+	// ArchivedChecksums and DecryptedChecksums hold the checksums of the
+	// archived and the decrypted file keyed by algorithm, the SHA256 ones
+	// are also found in Checksum and DecryptedChecksum
+	ArchivedChecksums  map[string]string
+	DecryptedChecksums map[string]string
 }
 
 type SyncData struct {
@@ -50,6 +115,53 @@ type SubmissionFileInfo struct {
 	InboxPath string `json:"inboxPath"`
 	Status    string `json:"fileStatus"`
 	CreateAt  string `json:"createAt"`
+	// DuplicateOf lists the other files of the user with the same decrypted
+	// content, known once the file has been verified
+	DuplicateOf []string `json:"duplicateOf,omitempty"`
+}
+
+// FileMatch is a file found by SearchFiles, Status is the latest event of
+// the file
+type FileMatch struct {
+	FileID      string `json:"fileID"`
+	AccessionID string `json:"accessionID,omitempty"`
+	User        string `json:"user"`
+	InboxPath   string `json:"inboxPath"`
+	Status      string `json:"fileStatus"`
+	CreateAt    string `json:"createAt"`
+}
+
+// ActiveUser is a user with files not yet assigned to a dataset, with the
+// number and total submitted size of those files and when the latest of
+// them was uploaded
+type ActiveUser struct {
+	User       string `json:"user"`
+	Files      int64  `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	LastUpload string `json:"lastUpload"`
+}
+
+// DatasetFile is a file of a dataset together with its locations, sizes and
+// verification status. Status is the latest event of the file and Verified
+// tells whether the file has ever been verified.
+type DatasetFile struct {
+	AccessionID   string `json:"accessionID"`
+	InboxPath     string `json:"inboxPath"`
+	ArchivePath   string `json:"archivePath"`
+	ArchiveSize   int64  `json:"archiveSize"`
+	DecryptedSize int64  `json:"decryptedSize"`
+	Status        string `json:"status"`
+	Verified      bool   `json:"verified"`
+}
+
+// KeyHashFile is a file encrypted with a given crypt4gh key, Status is the
+// latest event of the file
+type KeyHashFile struct {
+	FileID      string `json:"fileID"`
+	AccessionID string `json:"accessionID,omitempty"`
+	User        string `json:"user"`
+	ArchivePath string `json:"archivePath"`
+	Status      string `json:"fileStatus"`
 }
 
 type DatasetInfo struct {
@@ -58,6 +170,271 @@ type DatasetInfo struct {
 	Timestamp string `json:"timeStamp"`
 }
 
+// DatasetEvent is an entry in the event log of a dataset, Message is the
+// message that initiated the event
+type DatasetEvent struct {
+	Event     string `json:"event"`
+	Message   string `json:"message,omitempty"`
+	Timestamp string `json:"timeStamp"`
+}
+
+// MappingProvenance tells who asked for files to be mapped to a dataset,
+// through which service ("api" or "sync") and with which message
+type MappingProvenance struct {
+	Actor         string
+	Source        string
+	CorrelationID string
+}
+
+// FileMapping is the mapping of a file to a dataset and its provenance, the
+// provenance is empty for mappings made before schema v38. Source and
+// CorrelationID are those of the latest change of the mapping.
+type FileMapping struct {
+	AccessionID   string `json:"accessionID"`
+	MappedBy      string `json:"mappedBy,omitempty"`
+	MappedAt      string `json:"mappedAt,omitempty"`
+	Source        string `json:"source,omitempty"`
+	CorrelationID string `json:"correlationID,omitempty"`
+	ModifiedBy    string `json:"modifiedBy,omitempty"`
+	ModifiedAt    string `json:"modifiedAt,omitempty"`
+}
+
+// FileEvent is an entry in the event log of a file, Details holds the JSON
+// details recorded with the event
+type FileEvent struct {
+	Event         string `json:"event"`
+	CorrelationID string `json:"correlationID"`
+	User          string `json:"user"`
+	Details       string `json:"details,omitempty"`
+	Timestamp     string `json:"timeStamp"`
+}
+
+// FileEventRecord is a file event to be inserted with InsertFileEvents
+type FileEventRecord struct {
+	FileID        string
+	Event         string
+	CorrelationID string
+	User          string
+	Details       string
+	Message       string
+}
+
+// SubmissionFreeze describes an admin controlled block on new submissions
+// for either a single user or a project
+type SubmissionFreeze struct {
+	Scope    string `json:"scope"`
+	Name     string `json:"name"`
+	Reason   string `json:"reason"`
+	FrozenBy string `json:"frozenBy"`
+	FrozenAt string `json:"frozenAt"`
+}
+
+// Message returns the error message presented to users whose submissions
+// are blocked by the freeze
+func (f *SubmissionFreeze) Message() string {
+	msg := fmt.Sprintf("submissions for %s %s are frozen", f.Scope, f.Name)
+	if f.Reason != "" {
+		msg += ": " + f.Reason
+	}
+
+	return msg
+}
+
+// DeletionRequest is a request from a submitter to delete one of their
+// files, which is carried out once an admin approves it
+type DeletionRequest struct {
+	ID           int    `json:"id"`
+	FileID       string `json:"fileID"`
+	User         string `json:"user"`
+	FilePath     string `json:"filePath"`
+	Reason       string `json:"reason"`
+	RequestedAt  string `json:"requestedAt"`
+	Status       string `json:"status"`
+	ReviewedBy   string `json:"reviewedBy,omitempty"`
+	ReviewedAt   string `json:"reviewedAt,omitempty"`
+	ReviewReason string `json:"reviewReason,omitempty"`
+}
+
+// FileGrant gives a user access to a single file outside of dataset permissions
+type FileGrant struct {
+	User        string `json:"user"`
+	AccessionID string `json:"accessionID"`
+	GrantedBy   string `json:"grantedBy"`
+	GrantedAt   string `json:"grantedAt"`
+}
+
+// Replica is a copy of an archived file kept by an external long-term
+// preservation service
+type Replica struct {
+	AccessionID  string `json:"accessionID"`
+	Service      string `json:"service"`
+	Location     string `json:"location"`
+	Checksum     string `json:"checksum,omitempty"`
+	ChecksumType string `json:"checksumType,omitempty"`
+	RegisteredBy string `json:"registeredBy"`
+	RegisteredAt string `json:"registeredAt"`
+}
+
+// CorrelationIDIssue describes a file whose events do not all carry its
+// canonical correlation ID, Missing counts the events without one and
+// Conflicting lists the other IDs in use
+type CorrelationIDIssue struct {
+	FileID        string   `json:"fileID"`
+	User          string   `json:"user"`
+	FilePath      string   `json:"filePath"`
+	CorrelationID string   `json:"correlationID"`
+	Missing       int      `json:"missing"`
+	Conflicting   []string `json:"conflicting"`
+}
+
+// UserQuota holds the storage quota of a submission user together with the
+// number of bytes currently used, a quota of 0 means no limit
+type UserQuota struct {
+	User     string `json:"user"`
+	Quota    int64  `json:"quota"`
+	Uploaded int64  `json:"uploadedBytes"`
+	Archived int64  `json:"archivedBytes"`
+	Used     int64  `json:"usedBytes"`
+	// Warned is the highest warning threshold, in percent of the quota,
+	// that the user has been notified about
+	Warned int `json:"-"`
+}
+
+// Exceeded reports whether the user uses more storage than allowed
+func (q *UserQuota) Exceeded() bool {
+	return q.Quota > 0 && q.Used > q.Quota
+}
+
+// UsagePercent returns the used storage in percent of the quota, 0 when
+// there is no limit
+func (q *UserQuota) UsagePercent() float64 {
+	if q.Quota <= 0 {
+		return 0
+	}
+
+	return float64(q.Used) * 100 / float64(q.Quota)
+}
+
+// WarningThreshold returns the highest of the thresholds, in percent of the
+// quota, that the usage has reached, or 0 if none has been reached
+func (q *UserQuota) WarningThreshold(thresholds []int) int {
+	usage := q.UsagePercent()
+	reached := 0
+	for _, t := range thresholds {
+		if t > reached && usage >= float64(t) {
+			reached = t
+		}
+	}
+
+	return reached
+}
+
+// UserUsage holds the number of files and bytes of a submission user. All
+// files count as uploaded, archived files also as archived and files mapped
+// to a dataset also as in a dataset, by their archived size. SummarisedAt is
+// when the totals were stored and empty for totals computed on request.
+type UserUsage struct {
+	User          string `json:"user"`
+	UploadedFiles int64  `json:"uploadedFiles"`
+	UploadedBytes int64  `json:"uploadedBytes"`
+	ArchivedFiles int64  `json:"archivedFiles"`
+	ArchivedBytes int64  `json:"archivedBytes"`
+	DatasetFiles  int64  `json:"datasetFiles"`
+	DatasetBytes  int64  `json:"datasetBytes"`
+	SummarisedAt  string `json:"summarisedAt,omitempty"`
+}
+
+// Stats holds the number of files and datasets by their latest status, as
+// stored by the latest RefreshStats
+type Stats struct {
+	Files        []FileStats    `json:"files"`
+	Datasets     []DatasetStats `json:"datasets"`
+	SummarisedAt string         `json:"summarisedAt,omitempty"`
+}
+
+// FileStats holds the number and sizes of the files with a status, deleted
+// files are not counted
+type FileStats struct {
+	Status        string `json:"status"`
+	Files         int64  `json:"files"`
+	UploadedBytes int64  `json:"uploadedBytes"`
+	ArchivedBytes int64  `json:"archivedBytes"`
+}
+
+// DatasetStats holds the number of datasets with a status and the number
+// of files mapped to them
+type DatasetStats struct {
+	Status   string `json:"status"`
+	Datasets int64  `json:"datasets"`
+	Files    int64  `json:"files"`
+}
+
+// ExpectedFile is a file that a submitter is expected to upload. Status is
+// "missing" until a file is uploaded to the path, "mismatch" when the
+// uploaded file differs in size or checksum and "arrived" otherwise.
+type ExpectedFile struct {
+	FilePath     string `json:"filePath"`
+	Size         int64  `json:"size,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+	ChecksumType string `json:"checksumType,omitempty"`
+	RegisteredBy string `json:"registeredBy,omitempty"`
+	RegisteredAt string `json:"registeredAt,omitempty"`
+	FileID       string `json:"fileID,omitempty"`
+	Status       string `json:"status,omitempty"`
+}
+
+// SubmissionStatus compares the files that a user is expected to upload
+// with the files found in the inbox, Unexpected lists the inbox paths that
+// were not pre-registered
+type SubmissionStatus struct {
+	User       string         `json:"user"`
+	Expected   int            `json:"expected"`
+	Arrived    int            `json:"arrived"`
+	Files      []ExpectedFile `json:"files"`
+	Unexpected []string       `json:"unexpected"`
+}
+
+// Completeness returns the arrived files in percent of the expected ones,
+// 100 when no files are expected
+func (s *SubmissionStatus) Completeness() float64 {
+	if s.Expected == 0 {
+		return 100
+	}
+
+	return float64(s.Arrived) * 100 / float64(s.Expected)
+}
+
+// MissingFiles lists the expected files that a user has not uploaded
+type MissingFiles struct {
+	User      string
+	FilePaths []string
+}
+
+// UploadSession follows the files uploaded in one session from the inbox to
+// the datasets they end up in
+type UploadSession struct {
+	ID           string         `json:"sessionID"`
+	User         string         `json:"user"`
+	StartedAt    string         `json:"startedAt"`
+	LastActivity string         `json:"lastActivity"`
+	Uploaded     int            `json:"uploaded"`
+	Ingested     int            `json:"ingested"`
+	Failed       int            `json:"failed"`
+	Accessioned  int            `json:"accessioned"`
+	Datasets     []string       `json:"datasets"`
+	Files        []*SessionFile `json:"files"`
+}
+
+// SessionFile is the state of a file in an upload session
+type SessionFile struct {
+	FileID      string `json:"fileID"`
+	InboxPath   string `json:"inboxPath"`
+	Status      string `json:"fileStatus"`
+	AccessionID string `json:"accessionID,omitempty"`
+	DatasetID   string `json:"datasetID,omitempty"`
+	CreateAt    string `json:"createAt"`
+}
+
 // SchemaName is the name of the remote database schema to query
 var SchemaName = "sda"
 
@@ -77,9 +454,13 @@ var FastConnectRate = 5 * time.Second
 // database during the after FastConnectTimeout.
 var SlowConnectRate = 1 * time.Minute
 
-// dbRetryTimes is the number of times to retry the same function if it fails
+// RetryTimes is the number of times to retry the same function if it fails,
+// used when DBConf.RetryTimes is not set
 var RetryTimes = 5
 
+// ReplicaCheckRate is how long to wait between pings of the read replica
+var ReplicaCheckRate = 10 * time.Second
+
 // NewSDAdb creates a new DB connection from the given DBConf variables.
 // Currently, only postgresql connections are supported.
 func NewSDAdb(config DBConf) (*SDAdb, error) {
@@ -96,6 +477,23 @@ func NewSDAdb(config DBConf) (*SDAdb, error) {
 		return nil, fmt.Errorf("failed to fetch database schema version: %v", err)
 	}
 
+	if config.ReplicaDSN != "" {
+		dbs.Replica, err = sql.Open("postgres", config.ReplicaDSN)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open read replica: %v", err)
+		}
+		config.configurePool(dbs.Replica)
+		dbs.replicaUp = &atomic.Bool{}
+		if err := dbs.Replica.Ping(); err != nil {
+			log.Warnf("read replica is unavailable, reading from the primary until it responds: %v", err)
+		} else {
+			dbs.replicaUp.Store(true)
+		}
+		var ctx context.Context
+		ctx, dbs.stopReplica = context.WithCancel(context.Background())
+		go watchReplica(ctx, dbs.Replica, dbs.replicaUp)
+	}
+
 	return &dbs, nil
 }
 
@@ -124,6 +522,7 @@ func (dbs *SDAdb) Connect() error {
 	for ConnectTimeout <= 0 || ConnectTimeout > time.Since(start) {
 		dbs.DB, err = sql.Open(dbs.Config.PgDataSource())
 		if err == nil {
+			dbs.Config.configurePool(dbs.DB)
 			log.Infoln("Connected to database")
 			// Open may just validate its arguments without creating a
 			// connection to the database. To verify that the data source name
@@ -168,6 +567,19 @@ func (config *DBConf) PgDataSource() (string, string) {
 	return "postgres", connInfo
 }
 
+// configurePool applies the configured connection pool limits
+func (config *DBConf) configurePool(db *sql.DB) {
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+}
+
 // getVersion fetches the database schema version. This function return -1 when
 // the version could not be fetched.
 func (dbs *SDAdb) getVersion() (int, error) {
@@ -194,9 +606,47 @@ func (dbs *SDAdb) checkAndReconnectIfNeeded() {
 	}
 }
 
+// reader returns the connection for queries that only read data, which is
+// the read replica when one is configured and responded to the latest ping
+func (dbs *SDAdb) reader() *sql.DB {
+	if dbs.Replica == nil || dbs.replicaUp == nil || !dbs.replicaUp.Load() {
+		return dbs.DB
+	}
+
+	return dbs.Replica
+}
+
+// watchReplica pings the read replica every ReplicaCheckRate until ctx is
+// done, and records in up whether it responded
+func watchReplica(ctx context.Context, replica *sql.DB, up *atomic.Bool) {
+	ticker := time.NewTicker(ReplicaCheckRate)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, ReplicaCheckRate)
+		err := replica.PingContext(pingCtx)
+		cancel()
+		switch {
+		case err != nil && up.Swap(false):
+			log.Warnf("read replica problem, reading from the primary: %v", err)
+		case err == nil && !up.Swap(true):
+			log.Info("read replica responds again, reading from it")
+		}
+	}
+}
+
 func (dbs *SDAdb) Reconnect() {
 	dbs.DB.Close()
 	dbs.DB, _ = sql.Open(dbs.Config.PgDataSource())
+	if dbs.DB != nil {
+		dbs.Config.configurePool(dbs.DB)
+	}
 }
 
 // Close terminates the connection to the database
@@ -204,6 +654,12 @@ func (dbs *SDAdb) Close() {
 	if dbs.DB == nil {
 		return
 	}
+	if dbs.Replica != nil {
+		if dbs.stopReplica != nil {
+			dbs.stopReplica()
+		}
+		dbs.Replica.Close()
+	}
 	err := dbs.DB.Ping()
 	if err == nil {
 		log.Info("Closing database connection")
@@ -5,9 +5,10 @@ package database
 import (
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
+	"slices"
 	"strings"
 	"time"
 
@@ -20,35 +21,80 @@ import (
 // event. If the file already exists in the database, the entry is updated, but
 // a new file event is always inserted.
 func (dbs *SDAdb) RegisterFile(uploadPath, uploadUser string) (string, error) {
-
-	dbs.checkAndReconnectIfNeeded()
-
 	if dbs.Version < 4 {
 		return "", errors.New("database schema v4 required for RegisterFile()")
 	}
 
-	query := "SELECT sda.register_file($1, $2);"
+	// the file and its project are registered together, so that no file
+	// is left without the project it belongs to
+	var fileIDs []string
+	err := dbs.withTransaction(func(tx *Tx) error {
+		var err error
+		fileIDs, err = registerFiles(tx.tx, []string{uploadPath}, uploadUser, dbs.Version)
 
-	var fileID string
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
 
-	err := dbs.DB.QueryRow(query, uploadPath, uploadUser).Scan(&fileID)
+	return fileIDs[0], nil
+}
+
+// RegisterFiles registers several files uploaded by the same user in one
+// transaction and returns their IDs in the order of the given paths. It
+// behaves as RegisterFile for each file but avoids a round trip per file.
+func (dbs *SDAdb) RegisterFiles(uploadPaths []string, uploadUser string) ([]string, error) {
+	if dbs.Version < 4 {
+		return nil, errors.New("database schema v4 required for RegisterFiles()")
+	}
+
+	var fileIDs []string
+	err := dbs.WithTransaction(func(tx *Tx) error {
+		var err error
+		fileIDs, err = registerFiles(tx.tx, uploadPaths, uploadUser, dbs.Version)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return fileID, err
+	return fileIDs, nil
 }
+func registerFiles(tx *sql.Tx, uploadPaths []string, uploadUser string, version int) ([]string, error) {
+	const query = "SELECT sda.register_file(p, $2) FROM unnest($1::TEXT[]) WITH ORDINALITY AS t(p, n) ORDER BY n;"
 
-func (dbs *SDAdb) GetFileID(corrID string) (string, error) {
-	var (
-		err   error
-		count int
-		ID    string
-	)
+	rows, err := tx.Query(query, pq.Array(uploadPaths), uploadUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	for count == 0 || (err != nil && count < RetryTimes) {
-		ID, err = dbs.getFileID(corrID)
-		count++
+	fileIDs := make([]string, 0, len(uploadPaths))
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err != nil {
+			return nil, err
+		}
+		fileIDs = append(fileIDs, fileID)
 	}
+	if err := rows.Err(); err != nil || version < 20 {
+		return fileIDs, err
+	}
+
+	// Files from users belonging to a single group are assigned to that project
+	const setProject = "UPDATE sda.files f SET project = u.groups[1] FROM sda.userinfo u " +
+		"WHERE f.id = ANY($1::UUID[]) AND f.submission_user = u.id AND cardinality(u.groups) = 1 AND f.project IS NULL;"
+	_, err = tx.Exec(setProject, pq.Array(fileIDs))
+
+	return fileIDs, err
+}
 
-	return ID, err
+func (dbs *SDAdb) GetFileID(corrID string) (string, error) {
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getFileID(corrID)
+	})
 }
 func (dbs *SDAdb) getFileID(corrID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -67,18 +113,9 @@ func (dbs *SDAdb) getFileID(corrID string) (string, error) {
 // GetInboxFilePathFromID checks if a file exists in the database for a given user and fileID
 // and that is not yet archived
 func (dbs *SDAdb) GetInboxFilePathFromID(submissionUser, fileID string) (string, error) {
-	var (
-		err      error
-		count    int
-		filePath string
-	)
-
-	for count == 0 || (err != nil && count < RetryTimes) {
-		filePath, err = dbs.getInboxFilePathFromID(submissionUser, fileID)
-		count++
-	}
-
-	return filePath, err
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getInboxFilePathFromID(submissionUser, fileID)
+	})
 }
 
 func (dbs *SDAdb) getInboxFilePathFromID(submissionUser, fileID string) (string, error) {
@@ -101,50 +138,103 @@ func (dbs *SDAdb) getInboxFilePathFromID(submissionUser, fileID string) (string,
 }
 
 // UpdateFileEventLog updates the status in of the file in the database.
-// The message parameter is the rabbitmq message sent on file upload.
+// The message parameter is the rabbitmq message sent on file upload. It is
+// SetFileStatus without an expected status, so the transition from the
+// current status is checked.
 func (dbs *SDAdb) UpdateFileEventLog(fileUUID, event, corrID, user, details, message string) error {
-	var (
-		err   error
-		count int
-	)
+	return dbs.SetFileStatus(fileUUID, "", event, corrID, user, details, message)
+}
+func insertFileEvent(db execer, fileUUID, event, corrID, user, details, message string) error {
+	const query = "INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id, details, message) VALUES($1, $2, $3, $4, $5, $6);"
 
-	for count == 0 || (err != nil && count < RetryTimes) {
-		err = dbs.updateFileEventLog(fileUUID, event, corrID, user, details, message)
-		count++
+	result, err := db.Exec(query, fileUUID, event, corrID, user, details, message)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
 	}
 
-	return err
+	return nil
+}
+
+// InsertFileEvents inserts several file events with a single statement,
+// either all events are inserted or none of them
+func (dbs *SDAdb) InsertFileEvents(events []FileEventRecord) error {
+	return dbs.retry(func() error {
+		return dbs.insertFileEvents(events)
+	})
 }
-func (dbs *SDAdb) updateFileEventLog(fileUUID, event, corrID, user, details, message string) error {
+func (dbs *SDAdb) insertFileEvents(events []FileEventRecord) error {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
-	const query = "INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id, details, message) VALUES($1, $2, $3, $4, $5, $6);"
+	if len(events) == 0 {
+		return nil
+	}
 
-	result, err := db.Exec(query, fileUUID, event, corrID, user, details, message)
+	const query = "INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id, details, message) " +
+		"SELECT * FROM unnest($1::UUID[], $2::TEXT[], $3::UUID[], $4::TEXT[], $5::JSONB[], $6::JSONB[]);"
+
+	var fileIDs, names, corrIDs, users, details, messages []string
+	for _, e := range events {
+		fileIDs = append(fileIDs, e.FileID)
+		names = append(names, e.Event)
+		corrIDs = append(corrIDs, e.CorrelationID)
+		users = append(users, e.User)
+		details = append(details, e.Details)
+		messages = append(messages, e.Message)
+	}
+
+	result, err := dbs.DB.Exec(query, pq.Array(fileIDs), pq.Array(names), pq.Array(corrIDs), pq.Array(users), pq.Array(details), pq.Array(messages))
 	if err != nil {
 		return err
 	}
-	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
-		return errors.New("something went wrong with the query zero rows were changed")
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected != int64(len(events)) {
+		return permanent(fmt.Errorf("inserted %d of %d file events", rowsAffected, len(events)))
 	}
 
 	return nil
 }
 
-// StoreHeader stores the file header in the database
-func (dbs *SDAdb) StoreHeader(header []byte, id string) error {
-	var (
-		err   error
-		count int
-	)
+// GetFileEvents returns all events of a file, oldest event first. No events
+// are returned when the file does not exist.
+func (dbs *SDAdb) GetFileEvents(fileID string) ([]FileEvent, error) {
+	return retryValue(dbs, func() ([]FileEvent, error) {
+		return dbs.getFileEvents(fileID)
+	})
+}
+func (dbs *SDAdb) getFileEvents(fileID string) ([]FileEvent, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.reader()
+	const query = "SELECT event, COALESCE(correlation_id::TEXT, ''), COALESCE(user_id, ''), COALESCE(details::TEXT, ''), started_at " +
+		"FROM sda.file_event_log WHERE file_id = $1 ORDER BY id ASC;"
 
-	for count == 0 || (err != nil && count < RetryTimes) {
-		err = dbs.storeHeader(header, id)
-		count++
+	rows, err := db.Query(query, fileID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return err
+	var events []FileEvent
+	for rows.Next() {
+		var e FileEvent
+		var startedAt time.Time
+		if err := rows.Scan(&e.Event, &e.CorrelationID, &e.User, &e.Details, &startedAt); err != nil {
+			return nil, err
+		}
+		e.Timestamp = startedAt.UTC().Format(time.RFC3339Nano)
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// StoreHeader stores the file header in the database
+func (dbs *SDAdb) StoreHeader(header []byte, id string) error {
+	return dbs.retry(func() error {
+		return dbs.storeHeader(header, id)
+	})
 }
 func (dbs *SDAdb) storeHeader(header []byte, id string) error {
 	dbs.checkAndReconnectIfNeeded()
@@ -162,19 +252,13 @@ func (dbs *SDAdb) storeHeader(header []byte, id string) error {
 	return nil
 }
 
-// SetArchived marks the file as 'ARCHIVED'
+// SetArchived marks the file as 'ARCHIVED', files are archived once they
+// have been submitted. From schema v47 a file with any other status is
+// refused with a *TransitionError.
 func (dbs *SDAdb) SetArchived(file FileInfo, fileID, corrID string) error {
-	var (
-		err   error
-		count int
-	)
-
-	for count == 0 || (err != nil && count < RetryTimes) {
-		err = dbs.setArchived(file, fileID, corrID)
-		count++
-	}
-
-	return err
+	return dbs.retry(func() error {
+		return dbs.setArchived(file, fileID, corrID)
+	})
 }
 func (dbs *SDAdb) setArchived(file FileInfo, fileID, corrID string) error {
 	dbs.checkAndReconnectIfNeeded()
@@ -190,22 +274,13 @@ func (dbs *SDAdb) setArchived(file FileInfo, fileID, corrID string) error {
 		"SHA256",
 	)
 
-	return err
+	return transitionError(err, fileID, "archived")
 }
 
 func (dbs *SDAdb) GetFileStatus(corrID string) (string, error) {
-	var (
-		err    error
-		count  int
-		status string
-	)
-
-	for count == 0 || (err != nil && count < RetryTimes) {
-		status, err = dbs.getFileStatus(corrID)
-		count++
-	}
-
-	return status, err
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getFileStatus(corrID)
+	})
 }
 func (dbs *SDAdb) getFileStatus(corrID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -223,18 +298,9 @@ func (dbs *SDAdb) getFileStatus(corrID string) (string, error) {
 
 // GetHeader retrieves the file header
 func (dbs *SDAdb) GetHeader(fileID string) ([]byte, error) {
-	var (
-		r     []byte
-		err   error
-		count int
-	)
-
-	for count == 0 || (err != nil && count < RetryTimes) {
-		r, err = dbs.getHeader(fileID)
-		count++
-	}
-
-	return r, err
+	return retryValue(dbs, func() ([]byte, error) {
+		return dbs.getHeader(fileID)
+	})
 }
 func (dbs *SDAdb) getHeader(fileID string) ([]byte, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -255,36 +321,93 @@ func (dbs *SDAdb) getHeader(fileID string) ([]byte, error) {
 	return header, nil
 }
 
-// MarkCompleted marks the file as "COMPLETED"
-func (dbs *SDAdb) SetVerified(file FileInfo, fileID, corrID string) error {
-	var (
-		err   error
-		count int
-	)
+// MarkCompleted marks the file as "COMPLETED", the checksums with other
+// algorithms in ArchivedChecksums and DecryptedChecksums are stored as well.
+// From schema v47 the file must have the expected status, e.g. "archived",
+// and may otherwise be refused with a *TransitionError.
+func (dbs *SDAdb) SetVerified(file FileInfo, fileID, expected, corrID string) error {
+	return dbs.WithTransaction(func(tx *Tx) error {
+		return setVerified(tx.tx, tx.version, file, fileID, expected, corrID)
+	})
+}
+func setVerified(db execer, version int, file FileInfo, fileID, expected, corrID string) error {
+	args := []any{fileID, corrID, file.Checksum, "SHA256", file.DecryptedSize, file.DecryptedChecksum, "SHA256"}
+	completed := "SELECT sda.set_verified($1, $2, $3, $4, $5, $6, $7);"
+	if version >= 47 {
+		completed = "SELECT sda.set_verified($1, $2, $3, $4, $5, $6, $7, $8);"
+		args = append(args, expected)
+	}
+	if _, err := db.Exec(completed, args...); err != nil {
+		return transitionError(err, fileID, "verified")
+	}
 
-	for count == 0 || (err != nil && count < RetryTimes) {
-		err = dbs.setVerified(file, fileID, corrID)
-		count++
+	if err := setChecksums(db, fileID, "ARCHIVED", file.ArchivedChecksums); err != nil {
+		return err
 	}
 
-	return err
+	return setChecksums(db, fileID, "UNENCRYPTED", file.DecryptedChecksums)
+}
+
+// SetChecksums stores checksums of a file keyed by algorithm, the source is
+// one of uploaded, archived or unencrypted. Existing checksums of the same
+// algorithm and source are replaced.
+func (dbs *SDAdb) SetChecksums(fileID, source string, checksums map[string]string) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		return setChecksums(dbs.DB, fileID, source, checksums)
+	})
+}
+func setChecksums(db execer, fileID, source string, checksums map[string]string) error {
+	const query = "INSERT INTO sda.checksums(file_id, checksum, type, source) " +
+		"VALUES($1, $2, UPPER($3)::sda.checksum_algorithm, UPPER($4)::sda.checksum_source) " +
+		"ON CONFLICT ON CONSTRAINT unique_checksum DO UPDATE SET checksum = EXCLUDED.checksum;"
+
+	algorithms := make([]string, 0, len(checksums))
+	for algorithm := range checksums {
+		algorithms = append(algorithms, algorithm)
+	}
+	slices.Sort(algorithms)
+
+	for _, algorithm := range algorithms {
+		if !slices.Contains(ChecksumAlgorithms, strings.ToLower(algorithm)) {
+			return fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+		}
+		if _, err := db.Exec(query, fileID, checksums[algorithm], algorithm, source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetChecksums returns the checksums of a file keyed by algorithm, the
+// source is one of uploaded, archived or unencrypted
+func (dbs *SDAdb) GetChecksums(fileID, source string) (map[string]string, error) {
+	return retryValue(dbs, func() (map[string]string, error) {
+		return dbs.getChecksums(fileID, source)
+	})
 }
-func (dbs *SDAdb) setVerified(file FileInfo, fileID, corrID string) error {
+func (dbs *SDAdb) getChecksums(fileID, source string) (map[string]string, error) {
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
-	const completed = "SELECT sda.set_verified($1, $2, $3, $4, $5, $6, $7);"
-	_, err := db.Exec(completed,
-		fileID,
-		corrID,
-		file.Checksum,
-		"SHA256",
-		file.DecryptedSize,
-		file.DecryptedChecksum,
-		"SHA256",
-	)
+	const query = "SELECT LOWER(type::TEXT), checksum FROM sda.checksums WHERE file_id = $1 AND source = UPPER($2)::sda.checksum_source;"
+	rows, err := dbs.DB.Query(query, fileID, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return err
+	checksums := map[string]string{}
+	for rows.Next() {
+		var algorithm, checksum string
+		if err := rows.Scan(&algorithm, &checksum); err != nil {
+			return nil, err
+		}
+		checksums[algorithm] = checksum
+	}
+
+	return checksums, rows.Err()
 }
 
 // GetArchived retrieves the location and size of archive
@@ -292,14 +415,13 @@ func (dbs *SDAdb) GetArchived(corrID string) (string, int, error) {
 	var (
 		filePath string
 		fileSize int
-		err      error
-		count    int
 	)
-
-	for count == 0 || (err != nil && count < RetryTimes) {
+	err := dbs.retry(func() error {
+		var err error
 		filePath, fileSize, err = dbs.getArchived(corrID)
-		count++
-	}
+
+		return err
+	})
 
 	return filePath, fileSize, err
 }
@@ -320,18 +442,9 @@ func (dbs *SDAdb) getArchived(corrID string) (string, int, error) {
 
 // CheckAccessionIdExists validates if an accessionID exists in the db
 func (dbs *SDAdb) CheckAccessionIDExists(accessionID, fileID string) (string, error) {
-	var err error
-	var exists string
-	// 2, 4, 8, 16, 32 seconds between each retry event.
-	for count := 1; count <= RetryTimes; count++ {
-		exists, err = dbs.checkAccessionIDExists(accessionID, fileID)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
-	}
-
-	return exists, err
+	return retryValue(dbs, func() (string, error) {
+		return dbs.checkAccessionIDExists(accessionID, fileID)
+	})
 }
 func (dbs *SDAdb) checkAccessionIDExists(accessionID, fileID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -363,23 +476,18 @@ func (dbs *SDAdb) checkAccessionIDExists(accessionID, fileID string) (string, er
 // SetAccessionID adds a stable id to a file
 // identified by the user submitting it, inbox path and decrypted checksum
 func (dbs *SDAdb) SetAccessionID(accessionID, fileID string) error {
-	var err error
-	// 2, 4, 8, 16, 32 seconds between each retry event.
-	for count := 1; count <= RetryTimes; count++ {
-		err = dbs.setAccessionID(accessionID, fileID)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
-	}
-
-	return err
+	return dbs.retry(func() error {
+		return dbs.setAccessionID(accessionID, fileID)
+	})
 }
 func (dbs *SDAdb) setAccessionID(accessionID, fileID string) error {
 	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
-	const setStableID = "UPDATE sda.files SET stable_id = $1 WHERE id = $2;"
-	result, err := db.Exec(setStableID, accessionID, fileID)
+
+	return setStableID(dbs.DB, accessionID, fileID)
+}
+func setStableID(db execer, accessionID, fileID string) error {
+	const query = "UPDATE sda.files SET stable_id = $1 WHERE id = $2;"
+	result, err := db.Exec(query, accessionID, fileID)
 	if err != nil {
 		return err
 	}
@@ -393,71 +501,120 @@ func (dbs *SDAdb) setAccessionID(accessionID, fileID string) error {
 
 // MapFilesToDataset maps a set of files to a dataset in the database
 func (dbs *SDAdb) MapFilesToDataset(datasetID string, accessionIDs []string) error {
-	var err error
-	// 2, 4, 8, 16, 32 seconds between each retry event.
-	for count := 1; count <= RetryTimes; count++ {
-		err = dbs.mapFilesToDataset(datasetID, accessionIDs)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
-	}
-
-	return err
+	return dbs.retry(func() error {
+		return dbs.mapFilesToDataset(datasetID, accessionIDs)
+	})
 }
 func (dbs *SDAdb) mapFilesToDataset(datasetID string, accessionIDs []string) error {
-	dbs.checkAndReconnectIfNeeded()
+	return dbs.withTransaction(func(tx *Tx) error {
+		return tx.MapFilesToDataset(datasetID, accessionIDs)
+	})
+}
+
+// MapFilesToDatasetWithProvenance maps a set of files to a dataset like
+// MapFilesToDataset, recording who asked for it and how. Files that are
+// already mapped get the actor recorded as the one who last modified the
+// mapping. The provenance is only recorded from schema v38.
+func (dbs *SDAdb) MapFilesToDatasetWithProvenance(datasetID string, accessionIDs []string, provenance MappingProvenance) error {
+	return dbs.retry(func() error {
+		return dbs.mapFilesToDatasetWithProvenance(datasetID, accessionIDs, provenance)
+	})
+}
+func (dbs *SDAdb) mapFilesToDatasetWithProvenance(datasetID string, accessionIDs []string, provenance MappingProvenance) error {
+	return dbs.withTransaction(func(tx *Tx) error {
+		return tx.MapFilesToDatasetWithProvenance(datasetID, accessionIDs, provenance)
+	})
+}
 
+// mapFiles maps the files to the dataset, recording the provenance of the
+// mappings unless it is nil
+func mapFiles(db execer, datasetID string, accessionIDs []string, provenance *MappingProvenance) error {
 	const getID = "SELECT id FROM sda.files WHERE stable_id = $1;"
 	const dataset = "INSERT INTO sda.datasets (stable_id) VALUES ($1) ON CONFLICT DO NOTHING;"
 	const mapping = "INSERT INTO sda.file_dataset (file_id, dataset_id) SELECT $1, id FROM sda.datasets WHERE stable_id = $2 ON CONFLICT DO NOTHING;"
+	const recorded = "INSERT INTO sda.file_dataset (file_id, dataset_id, mapped_by, mapped_at, source, correlation_id) " +
+		"SELECT $1, id, NULLIF($3, ''), now(), NULLIF($4, ''), NULLIF($5, '') FROM sda.datasets WHERE stable_id = $2 " +
+		"ON CONFLICT ON CONSTRAINT unique_file_dataset DO UPDATE SET modified_by = EXCLUDED.mapped_by, modified_at = EXCLUDED.mapped_at, " +
+		"source = EXCLUDED.source, correlation_id = EXCLUDED.correlation_id;"
 	var fileID string
 
-	db := dbs.DB
-	_, err := db.Exec(dataset, datasetID)
-	if err != nil {
+	if _, err := db.Exec(dataset, datasetID); err != nil {
 		return err
 	}
 
-	transaction, _ := db.Begin()
 	for _, accessionID := range accessionIDs {
 		err := db.QueryRow(getID, accessionID).Scan(&fileID)
 		if err != nil {
 			log.Errorf("something went wrong with the DB query: %s", err.Error())
-			if err := transaction.Rollback(); err != nil {
-				log.Errorf("failed to rollback the transaction: %s", err.Error())
-			}
 
 			return err
 		}
-		_, err = transaction.Exec(mapping, fileID, datasetID)
+		if provenance == nil {
+			_, err = db.Exec(mapping, fileID, datasetID)
+		} else {
+			_, err = db.Exec(recorded, fileID, datasetID, provenance.Actor, provenance.Source, provenance.CorrelationID)
+		}
 		if err != nil {
 			log.Errorf("something went wrong with the DB transaction: %s", err.Error())
-			if err := transaction.Rollback(); err != nil {
-				log.Errorf("failed to rollback the transaction: %s", err.Error())
-			}
 
 			return err
 		}
 	}
 
-	return transaction.Commit()
+	return nil
 }
 
-// GetInboxPath retrieves the submission_fie_path for a file with a given accessionID
-func (dbs *SDAdb) GetInboxPath(stableID string) (string, error) {
-	var (
-		err       error
-		count     int
-		inboxPath string
-	)
+// GetDatasetMappings returns the files mapped to a dataset, ordered by
+// accession ID, with the provenance of their mappings. No files are returned
+// when the dataset does not exist.
+func (dbs *SDAdb) GetDatasetMappings(datasetID string) ([]FileMapping, error) {
+	return retryValue(dbs, func() ([]FileMapping, error) {
+		return dbs.getDatasetMappings(datasetID)
+	})
+}
+func (dbs *SDAdb) getDatasetMappings(datasetID string) ([]FileMapping, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 38 {
+		return nil, errors.New("database schema v38 required for GetDatasetMappings()")
+	}
+
+	const query = "SELECT f.stable_id, COALESCE(fd.mapped_by, ''), fd.mapped_at, COALESCE(fd.source, ''), " +
+		"COALESCE(fd.correlation_id, ''), COALESCE(fd.modified_by, ''), fd.modified_at " +
+		"FROM sda.file_dataset fd JOIN sda.datasets d ON d.id = fd.dataset_id JOIN sda.files f ON f.id = fd.file_id " +
+		"WHERE d.stable_id = $1 ORDER BY f.stable_id;"
+
+	rows, err := dbs.reader().Query(query, datasetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mappings []FileMapping
+	for rows.Next() {
+		var m FileMapping
+		var mappedAt, modifiedAt sql.NullTime
+		if err := rows.Scan(&m.AccessionID, &m.MappedBy, &mappedAt, &m.Source, &m.CorrelationID, &m.ModifiedBy, &modifiedAt); err != nil {
+			return nil, err
+		}
+		if mappedAt.Valid {
+			m.MappedAt = mappedAt.Time.UTC().Format(time.RFC3339Nano)
+		}
+		if modifiedAt.Valid {
+			m.ModifiedAt = modifiedAt.Time.UTC().Format(time.RFC3339Nano)
+		}
 
-	for count == 0 || (err != nil && count < RetryTimes) {
-		inboxPath, err = dbs.getInboxPath(stableID)
-		count++
+		mappings = append(mappings, m)
 	}
 
-	return inboxPath, err
+	return mappings, rows.Err()
+}
+
+// GetInboxPath retrieves the submission_fie_path for a file with a given accessionID
+func (dbs *SDAdb) GetInboxPath(stableID string) (string, error) {
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getInboxPath(stableID)
+	})
 }
 func (dbs *SDAdb) getInboxPath(stableID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -475,22 +632,16 @@ func (dbs *SDAdb) getInboxPath(stableID string) (string, error) {
 
 // UpdateDatasetEvent marks the files in a dataset as "registered","released" or "deprecated"
 func (dbs *SDAdb) UpdateDatasetEvent(datasetID, status, message string) error {
-	var err error
-	// 2, 4, 8, 16, 32 seconds between each retry event.
-	for count := 1; count <= RetryTimes; count++ {
-		err = dbs.updateDatasetEvent(datasetID, status, message)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
-	}
-
-	return err
+	return dbs.retry(func() error {
+		return dbs.updateDatasetEvent(datasetID, status, message)
+	})
 }
 func (dbs *SDAdb) updateDatasetEvent(datasetID, status, message string) error {
 	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
 
+	return insertDatasetEvent(dbs.DB, datasetID, status, message)
+}
+func insertDatasetEvent(db execer, datasetID, status, message string) error {
 	const setStatus = "INSERT INTO sda.dataset_event_log(dataset_id, event, message) VALUES($1, $2, $3);"
 	result, err := db.Exec(setStatus, datasetID, status, message)
 	if err != nil {
@@ -507,18 +658,9 @@ func (dbs *SDAdb) updateDatasetEvent(datasetID, status, message string) error {
 
 // GetFileInfo returns info on a ingested file
 func (dbs *SDAdb) GetFileInfo(id string) (FileInfo, error) {
-	var (
-		err   error
-		count int
-		info  FileInfo
-	)
-
-	for count == 0 || (err != nil && count < RetryTimes) {
-		info, err = dbs.getFileInfo(id)
-		count++
-	}
-
-	return info, err
+	return retryValue(dbs, func() (FileInfo, error) {
+		return dbs.getFileInfo(id)
+	})
 }
 func (dbs *SDAdb) getFileInfo(id string) (FileInfo, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -534,9 +676,35 @@ func (dbs *SDAdb) getFileInfo(id string) (FileInfo, error) {
 		return FileInfo{}, err
 	}
 
+	var err error
+	if info.ArchivedChecksums, err = dbs.getChecksums(id, "ARCHIVED"); err != nil {
+		return FileInfo{}, err
+	}
+	if info.DecryptedChecksums, err = dbs.getChecksums(id, "UNENCRYPTED"); err != nil {
+		return FileInfo{}, err
+	}
+
 	return info, nil
 }
 
+// GetFileInfoByStableID returns info on the file with the given accession ID
+func (dbs *SDAdb) GetFileInfoByStableID(stableID string) (FileInfo, error) {
+	return retryValue(dbs, func() (FileInfo, error) {
+		return dbs.getFileInfoByStableID(stableID)
+	})
+}
+func (dbs *SDAdb) getFileInfoByStableID(stableID string) (FileInfo, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT id FROM sda.files WHERE stable_id = $1;"
+	var fileID string
+	if err := dbs.DB.QueryRow(query, stableID).Scan(&fileID); err != nil {
+		return FileInfo{}, err
+	}
+
+	return dbs.getFileInfo(fileID)
+}
+
 // GetHeaderForStableID retrieves the file header by using stable id
 func (dbs *SDAdb) GetHeaderForStableID(stableID string) ([]byte, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -556,20 +724,9 @@ func (dbs *SDAdb) GetHeaderForStableID(stableID string) ([]byte, error) {
 
 // GetSyncData retrieves the file information needed to sync a dataset
 func (dbs *SDAdb) GetSyncData(accessionID string) (SyncData, error) {
-	var (
-		s   SyncData
-		err error
-	)
-
-	for count := 1; count <= RetryTimes; count++ {
-		s, err = dbs.getSyncData(accessionID)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(3, float64(count))) * time.Second)
-	}
-
-	return s, err
+	return retryValue(dbs, func() (SyncData, error) {
+		return dbs.getSyncData(accessionID)
+	})
 }
 
 // getSyncData is the actual function performing work for GetSyncData
@@ -592,20 +749,9 @@ func (dbs *SDAdb) getSyncData(accessionID string) (SyncData, error) {
 
 // CheckIfDatasetExists checks if a dataset already is registered
 func (dbs *SDAdb) CheckIfDatasetExists(datasetID string) (bool, error) {
-	var (
-		ds  bool
-		err error
-	)
-
-	for count := 1; count <= RetryTimes; count++ {
-		ds, err = dbs.checkIfDatasetExists(datasetID)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(3, float64(count))) * time.Second)
-	}
-
-	return ds, err
+	return retryValue(dbs, func() (bool, error) {
+		return dbs.checkIfDatasetExists(datasetID)
+	})
 }
 
 // getSyncData is the actual function performing work for GetSyncData
@@ -623,18 +769,9 @@ func (dbs *SDAdb) checkIfDatasetExists(datasetID string) (bool, error) {
 
 // GetInboxPath retrieves the submission_fie_path for a file with a given accessionID
 func (dbs *SDAdb) GetArchivePath(stableID string) (string, error) {
-	var (
-		err         error
-		count       int
-		archivePath string
-	)
-
-	for count == 0 || (err != nil && count < RetryTimes) {
-		archivePath, err = dbs.getArchivePath(stableID)
-		count++
-	}
-
-	return archivePath, err
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getArchivePath(stableID)
+	})
 }
 func (dbs *SDAdb) getArchivePath(stableID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -650,40 +787,73 @@ func (dbs *SDAdb) getArchivePath(stableID string) (string, error) {
 	return archivePath, nil
 }
 
-// GetUserFiles retrieves all the files a user submitted
-func (dbs *SDAdb) GetUserFiles(userID string) ([]*SubmissionFileInfo, error) {
-	var err error
+// notDeleted is the condition leaving out soft deleted files, given the name
+// of sda.files in the query. deleted_at is only available from schema v28.
+func (dbs *SDAdb) notDeleted(files string) string {
+	if dbs.Version < 28 {
+		return "TRUE"
+	}
 
-	files := []*SubmissionFileInfo{}
+	return files + ".deleted_at IS NULL"
+}
 
-	// 2, 4, 8, 16, 32 seconds between each retry event.
-	for count := 1; count <= RetryTimes; count++ {
-		files, err = dbs.getUserFiles(userID)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
-	}
+// GetUserFiles retrieves all the files a user submitted
+func (dbs *SDAdb) GetUserFiles(userID string) ([]*SubmissionFileInfo, error) {
+	files, _, err := dbs.GetUserFilesPage(userID, Page{})
 
 	return files, err
 }
 
-// getUserFiles is the actual function performing work for GetUserFiles
-func (dbs *SDAdb) getUserFiles(userID string) ([]*SubmissionFileInfo, error) {
+// GetUserFilesPage retrieves a page of the files a user submitted, ordered
+// by when they were registered. The returned cursor selects the next page
+// and is empty when there are no more files.
+func (dbs *SDAdb) GetUserFilesPage(userID string, page Page) ([]*SubmissionFileInfo, string, error) {
+	var next string
+	files, err := retryValue(dbs, func() ([]*SubmissionFileInfo, error) {
+		var (
+			files []*SubmissionFileInfo
+			err   error
+		)
+		files, next, err = dbs.getUserFiles(userID, page)
+
+		return files, err
+	})
+
+	return files, next, err
+}
+
+// getUserFiles is the actual function performing work for GetUserFilesPage
+func (dbs *SDAdb) getUserFiles(userID string, page Page) ([]*SubmissionFileInfo, string, error) {
 	dbs.checkAndReconnectIfNeeded()
 
 	files := []*SubmissionFileInfo{}
-	db := dbs.DB
+	db := dbs.reader()
 
 	// select all files (that are not part of a dataset) of the user, each one annotated with its latest event
-	const query = "SELECT f.id, f.submission_file_path, e.event, f.created_at FROM sda.files f " +
+	query := "SELECT f.id, f.submission_file_path, e.event, f.created_at, " + dbs.duplicatesOf("f") + " FROM sda.files f " +
 		"LEFT JOIN (SELECT DISTINCT ON (file_id) file_id, started_at, event FROM sda.file_event_log ORDER BY file_id, started_at DESC) e ON f.id = e.file_id WHERE f.submission_user = $1 " +
-		"AND f.id NOT IN (SELECT f.id FROM sda.files f RIGHT JOIN sda.file_dataset d ON f.id = d.file_id); "
+		"AND " + dbs.notDeleted("f") + " AND f.id NOT IN (SELECT f.id FROM sda.files f RIGHT JOIN sda.file_dataset d ON f.id = d.file_id) " +
+		"AND e.event IS DISTINCT FROM 'disabled'"
+	args := []any{userID}
+	if page.After != "" {
+		createdAt, fileID, err := fileCursor(page.After)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, createdAt, fileID)
+		query += fmt.Sprintf(" AND (f.created_at, f.id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	query += " ORDER BY f.created_at, f.id"
+	if page.Limit > 0 {
+		// one extra row tells if there is a next page
+		args = append(args, page.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
 
 	// nolint:rowserrcheck
-	rows, err := db.Query(query, userID)
+	rows, err := db.Query(query+";", args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
@@ -691,36 +861,37 @@ func (dbs *SDAdb) getUserFiles(userID string) ([]*SubmissionFileInfo, error) {
 	for rows.Next() {
 		// Read rows into struct
 		fi := &SubmissionFileInfo{}
-		err := rows.Scan(&fi.FileID, &fi.InboxPath, &fi.Status, &fi.CreateAt)
+		err := rows.Scan(&fi.FileID, &fi.InboxPath, &fi.Status, &fi.CreateAt, pq.Array(&fi.DuplicateOf))
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
-		// Add instance of struct (file) to array if the status is not disabled
-		if fi.Status != "disabled" {
-			files = append(files, fi)
-		}
+		files = append(files, fi)
+	}
+
+	var next string
+	if page.Limit > 0 && len(files) > page.Limit {
+		files = files[:page.Limit]
+		last := files[len(files)-1]
+		next = encodeCursor(last.CreateAt, last.FileID)
 	}
 
-	return files, nil
+	return files, next, nil
 }
 
 // get the correlation ID for a user-inbox_path combination
-func (dbs *SDAdb) GetCorrID(user, path, accession string) (string, error) {
-	var (
-		corrID string
-		err    error
-	)
-	// 2, 4, 8, 16, 32 seconds between each retry event.
-	for count := 1; count <= RetryTimes; count++ {
-		corrID, err = dbs.getCorrID(user, path, accession)
-		if err == nil || strings.Contains(err.Error(), "sql: no rows in result set") {
-			break
-		}
-		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
-	}
+// duplicatesOf returns an expression listing the other files of the owner of
+// the file with the same decrypted SHA256 checksum
+func (dbs *SDAdb) duplicatesOf(files string) string {
+	return "ARRAY(SELECT o.id::TEXT FROM sda.checksums c JOIN sda.checksums oc ON oc.checksum = c.checksum AND oc.type = c.type AND oc.source = c.source " +
+		"JOIN sda.files o ON o.id = oc.file_id WHERE c.file_id = " + files + ".id AND c.source = 'UNENCRYPTED' AND c.type = 'SHA256' " +
+		"AND o.id <> " + files + ".id AND o.submission_user = " + files + ".submission_user AND " + dbs.notDeleted("o") + " ORDER BY o.created_at)"
+}
 
-	return corrID, err
+func (dbs *SDAdb) GetCorrID(user, path, accession string) (string, error) {
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getCorrID(user, path, accession)
+	})
 }
 func (dbs *SDAdb) getCorrID(user, path, accession string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
@@ -748,54 +919,227 @@ func (dbs *SDAdb) getCorrID(user, path, accession string) (string, error) {
 		return "", rows.Err()
 	}
 
-	return "", fmt.Errorf("sql: no rows in result set")
+	return "", sql.ErrNoRows
 }
 
 // list all users with files not yet assigned to a dataset
 func (dbs *SDAdb) ListActiveUsers() ([]string, error) {
-	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
+	users, _, err := dbs.ListActiveUsersPage(Page{})
+
+	return users, err
+}
+
+// ListActiveUsersPage lists a page of the users with files not yet assigned
+// to a dataset, ordered by name. The returned cursor selects the next page
+// and is empty when there are no more users.
+func (dbs *SDAdb) ListActiveUsersPage(page Page) ([]string, string, error) {
+	active, next, err := dbs.listActiveUsers(page)
+	if err != nil {
+		return nil, "", err
+	}
 
 	var users []string
-	rows, err := db.Query("SELECT DISTINCT submission_user FROM sda.files WHERE id NOT IN (SELECT f.id FROM sda.files f RIGHT JOIN sda.file_dataset d ON f.id = d.file_id) ORDER BY submission_user ASC;")
+	for _, u := range active {
+		users = append(users, u.User)
+	}
+
+	return users, next, nil
+}
+
+// ListActiveUsersDetailedPage is ListActiveUsersPage with the number of
+// files, total bytes and last upload of each user
+func (dbs *SDAdb) ListActiveUsersDetailedPage(page Page) ([]*ActiveUser, string, error) {
+	var next string
+	users, err := retryValue(dbs, func() ([]*ActiveUser, error) {
+		var (
+			users []*ActiveUser
+			err   error
+		)
+		users, next, err = dbs.listActiveUsers(page)
+
+		return users, err
+	})
+
+	return users, next, err
+}
+
+// listActiveUsers is the actual function performing work for
+// ListActiveUsersPage and ListActiveUsersDetailedPage
+func (dbs *SDAdb) listActiveUsers(page Page) ([]*ActiveUser, string, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.reader()
+
+	query := "SELECT submission_user, count(*), COALESCE(sum(submission_file_size), 0), max(created_at) FROM sda.files WHERE " + dbs.notDeleted("files") + " AND id NOT IN (SELECT f.id FROM sda.files f RIGHT JOIN sda.file_dataset d ON f.id = d.file_id)"
+	args := []any{}
+	if page.After != "" {
+		keys, err := decodeCursor(page.After, 1)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, keys[0])
+		query += " AND submission_user > $1"
+	}
+	query += " GROUP BY submission_user ORDER BY submission_user ASC"
+	if page.Limit > 0 {
+		// one extra row tells if there is a next page
+		args = append(args, page.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	users := []*ActiveUser{}
+	rows, err := db.Query(query+";", args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if rows.Err() != nil {
-		return nil, rows.Err()
+		return nil, "", rows.Err()
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var user string
-		err := rows.Scan(&user)
+		u := &ActiveUser{}
+		err := rows.Scan(&u.User, &u.Files, &u.Bytes, &u.LastUpload)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
-		users = append(users, user)
+		users = append(users, u)
+	}
+
+	var next string
+	if page.Limit > 0 && len(users) > page.Limit {
+		users = users[:page.Limit]
+		next = encodeCursor(users[len(users)-1].User)
 	}
 
-	return users, nil
+	return users, next, nil
 }
 
-func (dbs *SDAdb) GetDatasetStatus(datasetID string) (string, error) {
-	var (
-		err    error
-		count  int
-		status string
-	)
+// SearchFiles lists a page of the files whose submission user and inbox
+// path match the glob patterns, where "*" matches any characters and "?" a
+// single one, ignoring case. An empty pattern or status matches all files,
+// otherwise only files whose latest event is status are listed. Files are
+// listed in the order they were uploaded, and the cursor of the next page is
+// returned unless this is the last one.
+func (dbs *SDAdb) SearchFiles(userGlob, pathGlob, status string, page Page) ([]*FileMatch, string, error) {
+	var next string
+	files, err := retryValue(dbs, func() ([]*FileMatch, error) {
+		var (
+			files []*FileMatch
+			err   error
+		)
+		files, next, err = dbs.searchFiles(userGlob, pathGlob, status, page)
+
+		return files, err
+	})
+
+	return files, next, err
+}
+
+// searchFiles is the actual function performing work for SearchFiles
+func (dbs *SDAdb) searchFiles(userGlob, pathGlob, status string, page Page) ([]*FileMatch, string, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.reader()
+
+	from, args := dbs.searchFilter(userGlob, pathGlob, status)
+	query := "SELECT f.id, COALESCE(f.stable_id, ''), f.submission_user, f.submission_file_path, COALESCE(e.event, ''), f.created_at " + from
+	if page.After != "" {
+		createdAt, fileID, err := fileCursor(page.After)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, createdAt, fileID)
+		query += fmt.Sprintf(" AND (f.created_at, f.id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	query += " ORDER BY f.created_at, f.id"
+	if page.Limit > 0 {
+		// one extra row tells if there is a next page
+		args = append(args, page.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.Query(query+";", args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	files := []*FileMatch{}
+	for rows.Next() {
+		f := &FileMatch{}
+		if err := rows.Scan(&f.FileID, &f.AccessionID, &f.User, &f.InboxPath, &f.Status, &f.CreateAt); err != nil {
+			return nil, "", err
+		}
+		files = append(files, f)
+	}
+	if rows.Err() != nil {
+		return nil, "", rows.Err()
+	}
+
+	var next string
+	if page.Limit > 0 && len(files) > page.Limit {
+		files = files[:page.Limit]
+		last := files[len(files)-1]
+		next = encodeCursor(last.CreateAt, last.FileID)
+	}
 
-	for count == 0 || (err != nil && count < RetryTimes) {
-		status, err = dbs.getDatasetStatus(datasetID)
-		count++
+	return files, next, nil
+}
+
+// CountSearchFiles returns the number of files matching a search of
+// SearchFiles
+func (dbs *SDAdb) CountSearchFiles(userGlob, pathGlob, status string) (int, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.reader()
+
+	from, args := dbs.searchFilter(userGlob, pathGlob, status)
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) "+from+";", args...).Scan(&total); err != nil {
+		return 0, err
 	}
 
-	return status, err
+	return total, nil
+}
+
+// searchFilter returns the FROM and WHERE clauses selecting the files that
+// match a search, and their arguments
+func (dbs *SDAdb) searchFilter(userGlob, pathGlob, status string) (string, []any) {
+	// the patterns are matched with ILIKE, which the trigram indexes of the
+	// user and path columns support
+	query := "FROM sda.files f " +
+		"LEFT JOIN LATERAL (SELECT event FROM sda.file_event_log WHERE file_id = f.id ORDER BY started_at DESC LIMIT 1) e ON true " +
+		"WHERE " + dbs.notDeleted("f")
+	args := []any{}
+	if userGlob != "" {
+		args = append(args, globToLike(userGlob))
+		query += fmt.Sprintf(" AND f.submission_user ILIKE $%d", len(args))
+	}
+	if pathGlob != "" {
+		args = append(args, globToLike(pathGlob))
+		query += fmt.Sprintf(" AND f.submission_file_path ILIKE $%d", len(args))
+	}
+	if status != "" {
+		args = append(args, status)
+		query += fmt.Sprintf(" AND e.event = $%d", len(args))
+	}
+
+	return query, args
+}
+
+// globToLike converts a glob pattern to a LIKE pattern, escaping the
+// characters that LIKE treats as wildcards
+func globToLike(glob string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%", "?", "_").Replace(glob)
+}
+
+func (dbs *SDAdb) GetDatasetStatus(datasetID string) (string, error) {
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getDatasetStatus(datasetID)
+	})
 }
 func (dbs *SDAdb) getDatasetStatus(datasetID string) (string, error) {
 	dbs.checkAndReconnectIfNeeded()
-	db := dbs.DB
+	db := dbs.reader()
 	const getDatasetEvent = "SELECT event from sda.dataset_event_log WHERE dataset_id = $1 ORDER BY id DESC LIMIT 1;"
 
 	var status string
@@ -807,19 +1151,44 @@ func (dbs *SDAdb) getDatasetStatus(datasetID string) (string, error) {
 	return status, nil
 }
 
-// AddKeyHash adds a key hash and key description in the encryption_keys table
-func (dbs *SDAdb) AddKeyHash(keyHash, keyDescription string) error {
-	var err error
-	// 2, 4, 8, 16, 32 seconds between each retry event.
-	for count := 1; count <= RetryTimes; count++ {
-		err = dbs.addKeyHash(keyHash, keyDescription)
-		if err == nil || strings.Contains(err.Error(), "key hash already exists") {
-			break
+// GetDatasetEvents returns the full event log of a dataset, oldest event
+// first. No events are returned when the dataset does not exist.
+func (dbs *SDAdb) GetDatasetEvents(datasetID string) ([]DatasetEvent, error) {
+	return retryValue(dbs, func() ([]DatasetEvent, error) {
+		return dbs.getDatasetEvents(datasetID)
+	})
+}
+func (dbs *SDAdb) getDatasetEvents(datasetID string) ([]DatasetEvent, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.reader()
+	const query = "SELECT event, COALESCE(message::TEXT, ''), event_date FROM sda.dataset_event_log WHERE dataset_id = $1 ORDER BY id ASC;"
+
+	rows, err := db.Query(query, datasetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []DatasetEvent
+	for rows.Next() {
+		var e DatasetEvent
+		var eventDate time.Time
+		if err := rows.Scan(&e.Event, &e.Message, &eventDate); err != nil {
+			return nil, err
 		}
-		time.Sleep(time.Duration(math.Pow(2, float64(count))) * time.Second)
+		e.Timestamp = eventDate.UTC().Format(time.RFC3339Nano)
+
+		events = append(events, e)
 	}
 
-	return err
+	return events, rows.Err()
+}
+
+// AddKeyHash adds a key hash and key description in the encryption_keys table
+func (dbs *SDAdb) AddKeyHash(keyHash, keyDescription string) error {
+	return dbs.retry(func() error {
+		return dbs.addKeyHash(keyHash, keyDescription)
+	})
 }
 
 func (dbs *SDAdb) addKeyHash(keyHash, keyDescription string) error {
@@ -834,7 +1203,7 @@ func (dbs *SDAdb) addKeyHash(keyHash, keyDescription string) error {
 	}
 
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
-		return errors.New("key hash already exists or no rows were updated")
+		return permanent(errors.New("key hash already exists or no rows were updated"))
 	}
 
 	return nil
@@ -897,6 +1266,39 @@ func (dbs *SDAdb) ListKeyHashes() ([]C4ghKeyHash, error) {
 	return hashList, nil
 }
 
+// GetFilesByKeyHash lists the files encrypted with the key with the given
+// hash, e.g. to find the files to re-encrypt when the key is rotated
+func (dbs *SDAdb) GetFilesByKeyHash(keyHash string) ([]KeyHashFile, error) {
+	return retryValue(dbs, func() ([]KeyHashFile, error) {
+		return dbs.getFilesByKeyHash(keyHash)
+	})
+}
+func (dbs *SDAdb) getFilesByKeyHash(keyHash string) ([]KeyHashFile, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	query := "SELECT f.id, COALESCE(f.stable_id, ''), f.submission_user, f.archive_file_path, COALESCE(e.event, '') FROM sda.files f " +
+		"LEFT JOIN LATERAL (SELECT event FROM sda.file_event_log WHERE file_id = f.id ORDER BY id DESC LIMIT 1) e ON TRUE " +
+		"WHERE f.key_hash = $1 AND " + dbs.notDeleted("f") + " ORDER BY f.created_at, f.id;"
+
+	rows, err := dbs.reader().Query(query, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []KeyHashFile{}
+	for rows.Next() {
+		var f KeyHashFile
+		if err := rows.Scan(&f.FileID, &f.AccessionID, &f.User, &f.ArchivePath, &f.Status); err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
 func (dbs *SDAdb) DeprecateKeyHash(keyHash string) error {
 	dbs.checkAndReconnectIfNeeded()
 	db := dbs.DB
@@ -984,18 +1386,43 @@ func (dbs *SDAdb) ListUserDatasets(submissionUser string) ([]DatasetInfo, error)
 	return datasets, nil
 }
 
-func (dbs *SDAdb) UpdateUserInfo(userID, name, email string, groups []string) error {
-	var (
-		err   error
-		count int
-	)
+// ListReleasedDatasets lists the datasets that are currently released, most
+// recently released first, limited to the given number of datasets.
+func (dbs *SDAdb) ListReleasedDatasets(limit int) ([]DatasetInfo, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.DB
+
+	const query = `SELECT dataset_id,event,event_date FROM sda.dataset_event_log WHERE
+		(dataset_id, event_date) IN (
+			SELECT dataset_id,max(event_date) FROM sda.dataset_event_log GROUP BY dataset_id
+		) AND event = 'released'
+		ORDER BY event_date DESC LIMIT $1;`
 
-	for count == 0 || (err != nil && count < RetryTimes) {
-		err = dbs.updateUserInfo(userID, name, email, groups)
-		count++
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return err
+	var datasets []DatasetInfo
+	for rows.Next() {
+		var di DatasetInfo
+		var released time.Time
+		if err := rows.Scan(&di.DatasetID, &di.Status, &released); err != nil {
+			return nil, err
+		}
+		di.Timestamp = released.UTC().Format(time.RFC3339)
+
+		datasets = append(datasets, di)
+	}
+
+	return datasets, rows.Err()
+}
+
+func (dbs *SDAdb) UpdateUserInfo(userID, name, email string, groups []string) error {
+	return dbs.retry(func() error {
+		return dbs.updateUserInfo(userID, name, email, groups)
+	})
 }
 func (dbs *SDAdb) updateUserInfo(userID, name, email string, groups []string) error {
 	dbs.checkAndReconnectIfNeeded()
@@ -1052,12 +1479,183 @@ func (dbs *SDAdb) GetDecryptedChecksum(id string) (string, error) {
 	return unencryptedChecksum, nil
 }
 
-func (dbs *SDAdb) GetDatasetFiles(dataset string) ([]string, error) {
+// GetDatasetFiles returns the files of a dataset, ordered by accession ID,
+// with their locations, sizes and verification status. No files are returned
+// when the dataset does not exist.
+func (dbs *SDAdb) GetDatasetFiles(dataset string) ([]DatasetFile, error) {
+	return retryValue(dbs, func() ([]DatasetFile, error) {
+		return dbs.getDatasetFiles(dataset)
+	})
+}
+func (dbs *SDAdb) getDatasetFiles(dataset string) ([]DatasetFile, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT f.stable_id, f.submission_file_path, f.archive_file_path, " +
+		"COALESCE(f.archive_file_size, 0), COALESCE(f.decrypted_file_size, 0), COALESCE(e.event, ''), " +
+		"EXISTS(SELECT 1 FROM sda.file_event_log WHERE file_id = f.id AND event = 'verified') " +
+		"FROM sda.file_dataset fd JOIN sda.datasets d ON d.id = fd.dataset_id JOIN sda.files f ON f.id = fd.file_id " +
+		"LEFT JOIN LATERAL (SELECT event FROM sda.file_event_log WHERE file_id = f.id ORDER BY id DESC LIMIT 1) e ON TRUE " +
+		"WHERE d.stable_id = $1 ORDER BY f.stable_id;"
+
+	var files []DatasetFile
+	rows, err := dbs.DB.Query(query, dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f DatasetFile
+		err := rows.Scan(&f.AccessionID, &f.InboxPath, &f.ArchivePath, &f.ArchiveSize, &f.DecryptedSize, &f.Status, &f.Verified)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// FreezeSubmission blocks new uploads and ingestion for a user or project,
+// scope is either "user" or "project".
+func (dbs *SDAdb) FreezeSubmission(scope, name, reason, adminUser string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 17 {
+		return errors.New("database schema v17 required for FreezeSubmission()")
+	}
+
+	if scope != "user" && scope != "project" {
+		return fmt.Errorf("unknown freeze scope: %s", scope)
+	}
+
+	const query = "INSERT INTO sda.submission_freeze(scope, name, reason, frozen_by) VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING;"
+	result, err := dbs.DB.Exec(query, scope, name, reason, adminUser)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("submissions already frozen")
+	}
+
+	return nil
+}
+
+// UnfreezeSubmission lifts an active freeze, the freeze itself is kept for
+// auditing purposes.
+func (dbs *SDAdb) UnfreezeSubmission(scope, name, adminUser string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 17 {
+		return errors.New("database schema v17 required for UnfreezeSubmission()")
+	}
+
+	const query = "UPDATE sda.submission_freeze SET lifted_by = $3, lifted_at = clock_timestamp() WHERE scope = $1 AND name = $2 AND lifted_at IS NULL;"
+	result, err := dbs.DB.Exec(query, scope, name, adminUser)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("no active freeze found")
+	}
+
+	return nil
+}
+
+// GetSubmissionFreeze returns the active freeze that applies to a user, either
+// directly or through one of the groups (projects) the user belongs to.
+// A nil freeze is returned when submissions are allowed.
+func (dbs *SDAdb) GetSubmissionFreeze(user string) (*SubmissionFreeze, error) {
+	return retryValue(dbs, func() (*SubmissionFreeze, error) {
+		return dbs.getSubmissionFreeze(user)
+	})
+}
+func (dbs *SDAdb) getSubmissionFreeze(user string) (*SubmissionFreeze, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 17 {
+		return nil, errors.New("database schema v17 required for GetSubmissionFreeze()")
+	}
+
+	const query = "SELECT scope, name, COALESCE(reason, ''), frozen_by, frozen_at FROM sda.submission_freeze " +
+		"WHERE lifted_at IS NULL AND ((scope = 'user' AND name = $1) " +
+		"OR (scope = 'project' AND name = ANY(SELECT unnest(groups) FROM sda.userinfo WHERE id = $1))) " +
+		"ORDER BY frozen_at ASC LIMIT 1;"
+
+	freeze := &SubmissionFreeze{}
+	err := dbs.DB.QueryRow(query, user).Scan(&freeze.Scope, &freeze.Name, &freeze.Reason, &freeze.FrozenBy, &freeze.FrozenAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return freeze, nil
+}
+
+// ListSubmissionFreezes lists all active freezes
+func (dbs *SDAdb) ListSubmissionFreezes() ([]SubmissionFreeze, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.DB
+
+	const query = "SELECT scope, name, COALESCE(reason, ''), frozen_by, frozen_at FROM sda.submission_freeze WHERE lifted_at IS NULL ORDER BY frozen_at ASC;"
+
+	freezes := []SubmissionFreeze{}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f SubmissionFreeze
+		err := rows.Scan(&f.Scope, &f.Name, &f.Reason, &f.FrozenBy, &f.FrozenAt)
+		if err != nil {
+			return nil, err
+		}
+
+		freezes = append(freezes, f)
+	}
+
+	return freezes, nil
+}
+
+// GetFileStatusByStableID returns the latest event for the file with the given accessionID
+func (dbs *SDAdb) GetFileStatusByStableID(stableID string) (string, error) {
+	return retryValue(dbs, func() (string, error) {
+		return dbs.getFileStatusByStableID(stableID)
+	})
+}
+func (dbs *SDAdb) getFileStatusByStableID(stableID string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.DB
+	const query = "SELECT event from sda.file_event_log WHERE file_id = (SELECT id FROM sda.files WHERE stable_id = $1) ORDER BY id DESC LIMIT 1;"
+
+	var status string
+	err := db.QueryRow(query, stableID).Scan(&status)
+	if err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+// GetFileDatasets lists the datasets a file with the given accessionID is part of
+func (dbs *SDAdb) GetFileDatasets(stableID string) ([]string, error) {
 	dbs.checkAndReconnectIfNeeded()
 	db := dbs.DB
 
-	var accessions []string
-	rows, err := db.Query("SELECT stable_id FROM sda.files WHERE id IN (SELECT file_id FROM sda.file_dataset WHERE dataset_id = (SELECT id FROM sda.datasets WHERE stable_id = $1));", dataset)
+	const query = "SELECT d.stable_id FROM sda.datasets d JOIN sda.file_dataset fd ON d.id = fd.dataset_id JOIN sda.files f ON fd.file_id = f.id WHERE f.stable_id = $1 ORDER BY d.stable_id;"
+
+	datasets := []string{}
+	rows, err := db.Query(query, stableID)
 	if err != nil {
 		return nil, err
 	}
@@ -1067,14 +1665,1324 @@ func (dbs *SDAdb) GetDatasetFiles(dataset string) ([]string, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var accession string
-		err := rows.Scan(&accession)
+		var dataset string
+		err := rows.Scan(&dataset)
 		if err != nil {
 			return nil, err
 		}
 
-		accessions = append(accessions, accession)
+		datasets = append(datasets, dataset)
+	}
+
+	return datasets, nil
+}
+
+// SetSubmissionFileSize records the size of an uploaded file
+func (dbs *SDAdb) SetSubmissionFileSize(fileID string, size int64) error {
+	return dbs.retry(func() error {
+		return dbs.setSubmissionFileSize(fileID, size)
+	})
+}
+func (dbs *SDAdb) setSubmissionFileSize(fileID string, size int64) error {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.DB
+
+	const query = "UPDATE sda.files SET submission_file_size = $2 WHERE id = $1;"
+	result, err := db.Exec(query, fileID, size)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	return nil
+}
+
+// SetUserQuota sets the storage quota in bytes for a user, 0 removes the limit
+func (dbs *SDAdb) SetUserQuota(user string, quota int64, adminUser string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 18 {
+		return errors.New("database schema v18 required for SetUserQuota()")
+	}
+
+	if quota < 0 {
+		return errors.New("quota can not be negative")
+	}
+
+	const query = "INSERT INTO sda.user_quota(user_id, quota_bytes, set_by) VALUES($1, $2, $3) " +
+		"ON CONFLICT (user_id) DO UPDATE SET quota_bytes = excluded.quota_bytes, set_by = excluded.set_by, last_modified = clock_timestamp();"
+	_, err := dbs.DB.Exec(query, user, quota, adminUser)
+
+	return err
+}
+
+// GetUserQuota returns the quota of a user together with the storage used by
+// the files the user has submitted. Archived files are accounted by their
+// archived size, files still in the inbox by their uploaded size. Files that
+// have been disabled are not counted.
+func (dbs *SDAdb) GetUserQuota(user string) (UserQuota, error) {
+	return retryValue(dbs, func() (UserQuota, error) {
+		return dbs.getUserQuota(user)
+	})
+}
+func (dbs *SDAdb) getUserQuota(user string) (UserQuota, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 18 {
+		return UserQuota{}, errors.New("database schema v18 required for GetUserQuota()")
+	}
+
+	// warned_at is only available from schema v21
+	warned := "0"
+	if dbs.Version >= 21 {
+		warned = "COALESCE((SELECT warned_at FROM sda.user_quota WHERE user_id = $1), 0)"
+	}
+
+	query := "SELECT COALESCE((SELECT quota_bytes FROM sda.user_quota WHERE user_id = $1), 0), " +
+		"COALESCE(SUM(f.submission_file_size), 0), COALESCE(SUM(f.archive_file_size), 0), " +
+		"COALESCE(SUM(COALESCE(f.archive_file_size, f.submission_file_size)), 0), " + warned + " " +
+		"FROM sda.files f WHERE f.submission_user = $1 AND " + dbs.notDeleted("f") + " " +
+		"AND (SELECT event FROM sda.file_event_log e WHERE e.file_id = f.id ORDER BY e.id DESC LIMIT 1) IS DISTINCT FROM 'disabled';"
+
+	quota := UserQuota{User: user}
+	err := dbs.DB.QueryRow(query, user).Scan(&quota.Quota, &quota.Uploaded, &quota.Archived, &quota.Used, &quota.Warned)
+	if err != nil {
+		return UserQuota{}, err
+	}
+
+	return quota, nil
+}
+
+// SetQuotaWarning records the highest warning threshold, in percent of the
+// quota, that a user has been notified about. Setting a lower threshold when
+// the usage has dropped lets the user be warned again.
+func (dbs *SDAdb) SetQuotaWarning(user string, threshold int) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 21 {
+		return errors.New("database schema v21 required for SetQuotaWarning()")
+	}
+
+	const query = "UPDATE sda.user_quota SET warned_at = $2 WHERE user_id = $1;"
+	result, err := dbs.DB.Exec(query, user, threshold)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("no quota set for user %s", user)
+	}
+
+	return nil
+}
+
+// usageTotals selects the UserUsage totals of the files f in usageFrom
+const usageTotals = "count(*), COALESCE(SUM(f.submission_file_size), 0), count(f.archive_file_size), COALESCE(SUM(f.archive_file_size), 0), " +
+	"count(*) FILTER (WHERE d.mapped), COALESCE(SUM(f.archive_file_size) FILTER (WHERE d.mapped), 0)"
+
+// usageFrom lists the files that count towards the usage of their user, the
+// same files as for the quota
+func (dbs *SDAdb) usageFrom() string {
+	return "FROM sda.files f CROSS JOIN LATERAL (SELECT EXISTS (SELECT 1 FROM sda.file_dataset fd WHERE fd.file_id = f.id) AS mapped) d " +
+		"WHERE " + dbs.notDeleted("f") + " " +
+		"AND (SELECT event FROM sda.file_event_log e WHERE e.file_id = f.id ORDER BY e.id DESC LIMIT 1) IS DISTINCT FROM 'disabled'"
+}
+
+// ComputeUserUsage returns the current totals of the files of a user
+func (dbs *SDAdb) ComputeUserUsage(user string) (UserUsage, error) {
+	return retryValue(dbs, func() (UserUsage, error) {
+		return dbs.computeUserUsage(user)
+	})
+}
+func (dbs *SDAdb) computeUserUsage(user string) (UserUsage, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	query := "SELECT " + usageTotals + " " + dbs.usageFrom() + " AND f.submission_user = $1;"
+	usage := UserUsage{User: user}
+	err := dbs.reader().QueryRow(query, user).Scan(&usage.UploadedFiles, &usage.UploadedBytes,
+		&usage.ArchivedFiles, &usage.ArchivedBytes, &usage.DatasetFiles, &usage.DatasetBytes)
+	if err != nil {
+		return UserUsage{}, err
+	}
+
+	return usage, nil
+}
+
+// SummariseUserUsage computes the totals of all users and stores them for
+// GetUserUsageSummaries, replacing the earlier summary. The number of users
+// with files is returned.
+func (dbs *SDAdb) SummariseUserUsage() (int64, error) {
+	if dbs.Version < 34 {
+		return 0, errors.New("database schema v34 required for SummariseUserUsage()")
+	}
+
+	var users int64
+	err := dbs.WithTransaction(func(tx *Tx) error {
+		if _, err := tx.tx.Exec("DELETE FROM sda.user_usage;"); err != nil {
+			return err
+		}
+
+		query := "INSERT INTO sda.user_usage(user_id, uploaded_files, uploaded_bytes, archived_files, archived_bytes, dataset_files, dataset_bytes) " +
+			"SELECT f.submission_user, " + usageTotals + " " + dbs.usageFrom() + " GROUP BY f.submission_user;"
+		result, err := tx.tx.Exec(query)
+		if err != nil {
+			return err
+		}
+		users, err = result.RowsAffected()
+
+		return err
+	})
+
+	return users, err
+}
+
+// GetUserUsageSummaries returns the totals of all users as stored by the
+// latest SummariseUserUsage
+func (dbs *SDAdb) GetUserUsageSummaries() ([]UserUsage, error) {
+	return retryValue(dbs, func() ([]UserUsage, error) {
+		return dbs.getUserUsageSummaries()
+	})
+}
+func (dbs *SDAdb) getUserUsageSummaries() ([]UserUsage, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 34 {
+		return nil, permanent(errors.New("database schema v34 required for GetUserUsageSummaries()"))
+	}
+
+	const query = "SELECT user_id, uploaded_files, uploaded_bytes, archived_files, archived_bytes, dataset_files, dataset_bytes, summarised_at " +
+		"FROM sda.user_usage ORDER BY user_id;"
+	rows, err := dbs.reader().Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []UserUsage{}
+	for rows.Next() {
+		var u UserUsage
+		var summarisedAt time.Time
+		if err := rows.Scan(&u.User, &u.UploadedFiles, &u.UploadedBytes, &u.ArchivedFiles, &u.ArchivedBytes,
+			&u.DatasetFiles, &u.DatasetBytes, &summarisedAt); err != nil {
+			return nil, err
+		}
+		u.SummarisedAt = summarisedAt.UTC().Format(time.RFC3339Nano)
+
+		summaries = append(summaries, u)
+	}
+
+	return summaries, rows.Err()
+}
+
+// RefreshStats counts the files and datasets by their latest status and
+// stores the counts for GetStats, replacing the earlier ones
+func (dbs *SDAdb) RefreshStats() error {
+	if dbs.Version < 36 {
+		return errors.New("database schema v36 required for RefreshStats()")
+	}
+
+	fileStats := "INSERT INTO sda.file_stats(status, files, uploaded_bytes, archived_bytes) " +
+		"SELECT COALESCE(e.event, 'registered'), count(*), COALESCE(SUM(f.submission_file_size), 0), COALESCE(SUM(f.archive_file_size), 0) FROM sda.files f " +
+		"LEFT JOIN LATERAL (SELECT event FROM sda.file_event_log WHERE file_id = f.id ORDER BY id DESC LIMIT 1) e ON true " +
+		"WHERE " + dbs.notDeleted("f") + " GROUP BY 1;"
+	const datasetStats = "INSERT INTO sda.dataset_stats(status, datasets, files) " +
+		"SELECT COALESCE(e.event, 'registered'), count(*), COALESCE(SUM(m.files), 0) FROM sda.datasets d " +
+		"LEFT JOIN LATERAL (SELECT event FROM sda.dataset_event_log WHERE dataset_id = d.stable_id ORDER BY id DESC LIMIT 1) e ON true " +
+		"CROSS JOIN LATERAL (SELECT count(*) AS files FROM sda.file_dataset WHERE dataset_id = d.id) m GROUP BY 1;"
+
+	return dbs.WithTransaction(func(tx *Tx) error {
+		for _, query := range []string{"DELETE FROM sda.file_stats;", "DELETE FROM sda.dataset_stats;", fileStats, datasetStats} {
+			if _, err := tx.tx.Exec(query); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetStats returns the counts stored by the latest RefreshStats
+func (dbs *SDAdb) GetStats() (*Stats, error) {
+	return retryValue(dbs, func() (*Stats, error) {
+		return dbs.getStats()
+	})
+}
+func (dbs *SDAdb) getStats() (*Stats, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 36 {
+		return nil, permanent(errors.New("database schema v36 required for GetStats()"))
+	}
+
+	db := dbs.reader()
+	stats := &Stats{Files: []FileStats{}, Datasets: []DatasetStats{}}
+	var summarisedAt sql.NullTime
+
+	rows, err := db.Query("SELECT status, files, uploaded_bytes, archived_bytes, summarised_at FROM sda.file_stats ORDER BY status;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f FileStats
+		if err := rows.Scan(&f.Status, &f.Files, &f.UploadedBytes, &f.ArchivedBytes, &summarisedAt); err != nil {
+			return nil, err
+		}
+		stats.Files = append(stats.Files, f)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	rows, err = db.Query("SELECT status, datasets, files, summarised_at FROM sda.dataset_stats ORDER BY status;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DatasetStats
+		if err := rows.Scan(&d.Status, &d.Datasets, &d.Files, &summarisedAt); err != nil {
+			return nil, err
+		}
+		stats.Datasets = append(stats.Datasets, d)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	if summarisedAt.Valid {
+		stats.SummarisedAt = summarisedAt.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	return stats, nil
+}
+
+// GrantFileAccess gives a user access to a set of files, identified by their
+// accession IDs, without granting access to the datasets they belong to.
+func (dbs *SDAdb) GrantFileAccess(user string, accessionIDs []string, adminUser string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 19 {
+		return errors.New("database schema v19 required for GrantFileAccess()")
+	}
+
+	const getID = "SELECT id FROM sda.files WHERE stable_id = $1;"
+	const grant = "INSERT INTO sda.file_access_grants(user_id, file_id, granted_by) VALUES($1, $2, $3) ON CONFLICT DO NOTHING;"
+	var fileID string
+
+	db := dbs.DB
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, accessionID := range accessionIDs {
+		err := transaction.QueryRow(getID, accessionID).Scan(&fileID)
+		if err != nil {
+			if err := transaction.Rollback(); err != nil {
+				log.Errorf("failed to rollback the transaction: %s", err.Error())
+			}
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("accession ID %s not found", accessionID)
+			}
+
+			return err
+		}
+		_, err = transaction.Exec(grant, user, fileID, adminUser)
+		if err != nil {
+			log.Errorf("something went wrong with the DB transaction: %s", err.Error())
+			if err := transaction.Rollback(); err != nil {
+				log.Errorf("failed to rollback the transaction: %s", err.Error())
+			}
+
+			return err
+		}
+	}
+
+	return transaction.Commit()
+}
+
+// RevokeFileAccess revokes an active file grant, the grant itself is kept
+// for auditing purposes.
+func (dbs *SDAdb) RevokeFileAccess(user, accessionID, adminUser string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 19 {
+		return errors.New("database schema v19 required for RevokeFileAccess()")
+	}
+
+	const query = "UPDATE sda.file_access_grants SET revoked_by = $3, revoked_at = clock_timestamp() " +
+		"WHERE user_id = $1 AND file_id = (SELECT id FROM sda.files WHERE stable_id = $2) AND revoked_at IS NULL;"
+	result, err := dbs.DB.Exec(query, user, accessionID, adminUser)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("no active grant found")
+	}
+
+	return nil
+}
+
+// ListFileGrants lists the active file grants for a user
+func (dbs *SDAdb) ListFileGrants(user string) ([]FileGrant, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.DB
+
+	const query = "SELECT g.user_id, f.stable_id, g.granted_by, g.granted_at FROM sda.file_access_grants g " +
+		"JOIN sda.files f ON g.file_id = f.id WHERE g.user_id = $1 AND g.revoked_at IS NULL ORDER BY f.stable_id;"
+
+	grants := []FileGrant{}
+	rows, err := db.Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g FileGrant
+		err := rows.Scan(&g.User, &g.AccessionID, &g.GrantedBy, &g.GrantedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		grants = append(grants, g)
+	}
+
+	return grants, nil
+}
+
+// RegisterReplicas records where external preservation services keep copies
+// of archived files, registering a file again at the same service replaces
+// the earlier record.
+func (dbs *SDAdb) RegisterReplicas(replicas []Replica, registeredBy string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 24 {
+		return errors.New("database schema v24 required for RegisterReplicas()")
+	}
+
+	const getID = "SELECT id FROM sda.files WHERE stable_id = $1;"
+	const register = "INSERT INTO sda.replicas(file_id, service, location, checksum, checksum_type, registered_by) " +
+		"VALUES($1, $2, $3, NULLIF($4, ''), NULLIF(UPPER($5), '')::sda.checksum_algorithm, $6) " +
+		"ON CONFLICT (file_id, service) DO UPDATE SET location = excluded.location, checksum = excluded.checksum, " +
+		"checksum_type = excluded.checksum_type, registered_by = excluded.registered_by, registered_at = clock_timestamp();"
+	var fileID string
+
+	db := dbs.DB
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		err := transaction.QueryRow(getID, r.AccessionID).Scan(&fileID)
+		if err != nil {
+			if err := transaction.Rollback(); err != nil {
+				log.Errorf("failed to rollback the transaction: %s", err.Error())
+			}
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("accession ID %s not found", r.AccessionID)
+			}
+
+			return err
+		}
+		_, err = transaction.Exec(register, fileID, r.Service, r.Location, r.Checksum, r.ChecksumType, registeredBy)
+		if err != nil {
+			log.Errorf("something went wrong with the DB transaction: %s", err.Error())
+			if err := transaction.Rollback(); err != nil {
+				log.Errorf("failed to rollback the transaction: %s", err.Error())
+			}
+
+			return err
+		}
+	}
+
+	return transaction.Commit()
+}
+
+// GetFileReplicas lists the external replicas of a file
+func (dbs *SDAdb) GetFileReplicas(accessionID string) ([]Replica, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 24 {
+		return nil, errors.New("database schema v24 required for GetFileReplicas()")
+	}
+
+	const query = "SELECT f.stable_id, r.service, r.location, COALESCE(r.checksum, ''), COALESCE(r.checksum_type::text, ''), r.registered_by, r.registered_at " +
+		"FROM sda.replicas r JOIN sda.files f ON r.file_id = f.id WHERE f.stable_id = $1 ORDER BY r.service;"
+
+	replicas := []Replica{}
+	rows, err := dbs.DB.Query(query, accessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Replica
+		if err := rows.Scan(&r.AccessionID, &r.Service, &r.Location, &r.Checksum, &r.ChecksumType, &r.RegisteredBy, &r.RegisteredAt); err != nil {
+			return nil, err
+		}
+		r.ChecksumType = strings.ToLower(r.ChecksumType)
+
+		replicas = append(replicas, r)
+	}
+
+	return replicas, rows.Err()
+}
+
+// RemoveReplica removes the record of a replica, e.g. when the external
+// service no longer keeps the copy
+func (dbs *SDAdb) RemoveReplica(service, accessionID string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 24 {
+		return errors.New("database schema v24 required for RemoveReplica()")
+	}
+
+	const query = "DELETE FROM sda.replicas WHERE service = $1 AND file_id = (SELECT id FROM sda.files WHERE stable_id = $2);"
+	result, err := dbs.DB.Exec(query, service, accessionID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("no replica of %s found at %s", accessionID, service)
+	}
+
+	return nil
+}
+
+// CountUserFiles returns the number of files, not yet part of a dataset, that
+// a user has submitted. Disabled files are not counted.
+func (dbs *SDAdb) CountUserFiles(userID string) (int, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.reader()
+
+	query := "SELECT COUNT(*) FROM sda.files f " +
+		"LEFT JOIN (SELECT DISTINCT ON (file_id) file_id, started_at, event FROM sda.file_event_log ORDER BY file_id, started_at DESC) e ON f.id = e.file_id WHERE f.submission_user = $1 " +
+		"AND " + dbs.notDeleted("f") + " AND f.id NOT IN (SELECT f.id FROM sda.files f RIGHT JOIN sda.file_dataset d ON f.id = d.file_id) " +
+		"AND e.event IS DISTINCT FROM 'disabled';"
+
+	var total int
+	if err := db.QueryRow(query, userID).Scan(&total); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// CountActiveUsers returns the number of users with files not yet assigned to a dataset
+func (dbs *SDAdb) CountActiveUsers() (int, error) {
+	dbs.checkAndReconnectIfNeeded()
+	db := dbs.reader()
+
+	query := "SELECT COUNT(DISTINCT submission_user) FROM sda.files WHERE " + dbs.notDeleted("files") + " AND id NOT IN (SELECT f.id FROM sda.files f RIGHT JOIN sda.file_dataset d ON f.id = d.file_id);"
+
+	var total int
+	if err := db.QueryRow(query).Scan(&total); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// AddProjectAdmin lets a user administer files and datasets of a project
+func (dbs *SDAdb) AddProjectAdmin(project, user, addedBy string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 20 {
+		return errors.New("database schema v20 required for AddProjectAdmin()")
+	}
+
+	const query = "INSERT INTO sda.project_admins(project, user_id, added_by) VALUES($1, $2, $3) ON CONFLICT DO NOTHING;"
+	_, err := dbs.DB.Exec(query, project, user, addedBy)
+
+	return err
+}
+
+// RemoveProjectAdmin removes a user from the admins of a project
+func (dbs *SDAdb) RemoveProjectAdmin(project, user string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 20 {
+		return errors.New("database schema v20 required for RemoveProjectAdmin()")
+	}
+
+	const query = "DELETE FROM sda.project_admins WHERE project = $1 AND user_id = $2;"
+	result, err := dbs.DB.Exec(query, project, user)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("%s is not an admin of project %s", user, project)
+	}
+
+	return nil
+}
+
+// ListProjectAdmins returns the admins of a project
+func (dbs *SDAdb) ListProjectAdmins(project string) ([]string, error) {
+	const query = "SELECT user_id FROM sda.project_admins WHERE project = $1 ORDER BY user_id;"
+
+	return dbs.queryStrings(query, project)
+}
+
+// GetAdminProjects returns the projects a user is admin of
+func (dbs *SDAdb) GetAdminProjects(user string) ([]string, error) {
+	if dbs.Version < 20 {
+		return []string{}, nil
+	}
+
+	const query = "SELECT project FROM sda.project_admins WHERE user_id = $1 ORDER BY project;"
+
+	return dbs.queryStrings(query, user)
+}
+
+// GetUserProjects returns the projects of a submission user, i.e. the
+// projects of the user's files together with the user's groups. Files not
+// assigned to a project are listed as an empty project.
+func (dbs *SDAdb) GetUserProjects(user string) ([]string, error) {
+	const query = "SELECT COALESCE(project, '') FROM sda.files WHERE submission_user = $1 " +
+		"UNION SELECT unnest(groups) FROM sda.userinfo WHERE id = $1 ORDER BY 1;"
+
+	return dbs.queryStrings(query, user)
+}
+
+// GetFileProject returns the project of the file with the given accession
+// ID, the project is empty for files not assigned to a project
+func (dbs *SDAdb) GetFileProject(stableID string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT COALESCE(project, '') FROM sda.files WHERE stable_id = $1;"
+
+	var project string
+	err := dbs.DB.QueryRow(query, stableID).Scan(&project)
+
+	return project, err
+}
+
+// GetSubmissionFileProject returns the project of the file that the user
+// uploaded to the path, the project is empty for files not assigned to a
+// project. sql.ErrNoRows is returned when there is no such file.
+func (dbs *SDAdb) GetSubmissionFileProject(user, filePath string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT COALESCE(project, '') FROM sda.files WHERE submission_user = $1 AND submission_file_path = $2 " +
+		"ORDER BY created_at DESC LIMIT 1;"
+
+	var project string
+	err := dbs.DB.QueryRow(query, user, filePath).Scan(&project)
+
+	return project, err
+}
+
+// GetFileProjectByID returns the project of the file of the user with the
+// given file ID, the project is empty for files not assigned to a project.
+// sql.ErrNoRows is returned when there is no such file.
+func (dbs *SDAdb) GetFileProjectByID(user, fileID string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = "SELECT COALESCE(project, '') FROM sda.files WHERE submission_user = $1 AND id = $2;"
+
+	var project string
+	err := dbs.DB.QueryRow(query, user, fileID).Scan(&project)
+
+	return project, err
+}
+
+// GetDatasetProjects returns the projects of the files in a dataset, files
+// not assigned to a project are listed as an empty project
+func (dbs *SDAdb) GetDatasetProjects(datasetID string) ([]string, error) {
+	const query = "SELECT DISTINCT COALESCE(f.project, '') FROM sda.files f " +
+		"JOIN sda.file_dataset fd ON f.id = fd.file_id JOIN sda.datasets d ON fd.dataset_id = d.id " +
+		"WHERE d.stable_id = $1 ORDER BY 1;"
+
+	return dbs.queryStrings(query, datasetID)
+}
+
+// queryStrings runs a query returning a single text column
+func (dbs *SDAdb) queryStrings(query string, args ...any) ([]string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	values := []string{}
+	rows, err := dbs.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// AddFileToUploadSession links a file to the upload session it was uploaded
+// in, the session is created on its first file. Sessions can only hold files
+// of a single user.
+func (dbs *SDAdb) AddFileToUploadSession(fileID, sessionID, user string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 22 {
+		return errors.New("database schema v22 required for AddFileToUploadSession()")
+	}
+
+	const session = "INSERT INTO sda.upload_sessions(id, user_id) VALUES($1, $2) " +
+		"ON CONFLICT (id) DO UPDATE SET last_activity = clock_timestamp() WHERE upload_sessions.user_id = excluded.user_id;"
+	result, err := dbs.DB.Exec(session, sessionID, user)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("upload session %s belongs to another user", sessionID)
+	}
+
+	const file = "UPDATE sda.files SET session_id = $1 WHERE id = $2;"
+	result, err = dbs.DB.Exec(file, sessionID, fileID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	return nil
+}
+
+// GetUploadSession returns the files of an upload session together with
+// how many of them have been uploaded, ingested, failed or been given an
+// accession ID, and the datasets they belong to.
+func (dbs *SDAdb) GetUploadSession(sessionID string) (*UploadSession, error) {
+	return retryValue(dbs, func() (*UploadSession, error) {
+		return dbs.getUploadSession(sessionID)
+	})
+}
+func (dbs *SDAdb) getUploadSession(sessionID string) (*UploadSession, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 22 {
+		return nil, errors.New("database schema v22 required for GetUploadSession()")
+	}
+
+	session := &UploadSession{ID: sessionID, Datasets: []string{}, Files: []*SessionFile{}}
+	const getSession = "SELECT user_id, started_at, last_activity FROM sda.upload_sessions WHERE id = $1;"
+	if err := dbs.DB.QueryRow(getSession, sessionID).Scan(&session.User, &session.StartedAt, &session.LastActivity); err != nil {
+		return nil, err
+	}
+
+	// each file annotated with its latest event, the dataset it was last added
+	// to and whether it has been uploaded and archived
+	const getFiles = "SELECT f.id, f.submission_file_path, COALESCE(e.event, ''), COALESCE(f.stable_id, ''), f.created_at, " +
+		"COALESCE((SELECT d.stable_id FROM sda.file_dataset fd JOIN sda.datasets d ON fd.dataset_id = d.id WHERE fd.file_id = f.id ORDER BY fd.id DESC LIMIT 1), ''), " +
+		"EXISTS (SELECT 1 FROM sda.file_event_log l WHERE l.file_id = f.id AND l.event = 'uploaded'), " +
+		"EXISTS (SELECT 1 FROM sda.file_event_log l WHERE l.file_id = f.id AND l.event = 'archived') " +
+		"FROM sda.files f " +
+		"LEFT JOIN (SELECT DISTINCT ON (file_id) file_id, event FROM sda.file_event_log ORDER BY file_id, started_at DESC, id DESC) e ON f.id = e.file_id " +
+		"WHERE f.session_id = $1 ORDER BY f.created_at;"
+
+	rows, err := dbs.DB.Query(getFiles, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uploaded, archived bool
+		file := &SessionFile{}
+		if err := rows.Scan(&file.FileID, &file.InboxPath, &file.Status, &file.AccessionID, &file.CreateAt, &file.DatasetID, &uploaded, &archived); err != nil {
+			return nil, err
+		}
+
+		if uploaded {
+			session.Uploaded++
+		}
+		if archived {
+			session.Ingested++
+		}
+		if file.Status == "error" {
+			session.Failed++
+		}
+		if file.AccessionID != "" {
+			session.Accessioned++
+		}
+		if file.DatasetID != "" && !slices.Contains(session.Datasets, file.DatasetID) {
+			session.Datasets = append(session.Datasets, file.DatasetID)
+		}
+
+		session.Files = append(session.Files, file)
+	}
+
+	return session, nil
+}
+
+// MintDatasetID returns a new dataset ID made up of the prefix and the next
+// number in the database sequence, zero padded to the given number of digits.
+// Since the number is taken from a sequence concurrent calls never get the
+// same ID, numbers already used by datasets named by hand are skipped.
+func (dbs *SDAdb) MintDatasetID(prefix string, digits int) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 23 {
+		return "", errors.New("database schema v23 required for MintDatasetID()")
+	}
+
+	const query = "SELECT nextval('sda.dataset_stable_id_seq');"
+	for {
+		var next int64
+		if err := dbs.DB.QueryRow(query).Scan(&next); err != nil {
+			return "", err
+		}
+
+		datasetID := fmt.Sprintf("%s%0*d", prefix, digits, next)
+		exists, err := dbs.checkIfDatasetExists(datasetID)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return datasetID, nil
+		}
+		log.Debugf("dataset ID %s already in use, minting a new one", datasetID)
+	}
+}
+
+// canonicalCorrIDs is a common table expression holding the canonical
+// correlation ID of every file: the one of its first event that has one, or
+// the file ID, which is what the inbox uses, when no event has one
+const canonicalCorrIDs = "WITH canonical AS (SELECT f.id AS file_id, COALESCE((SELECT e.correlation_id FROM sda.file_event_log e " +
+	"WHERE e.file_id = f.id AND e.correlation_id IS NOT NULL ORDER BY e.id LIMIT 1), f.id) AS correlation_id FROM sda.files f) "
+
+// wrongCorrID matches the events of a file that are missing the canonical
+// correlation ID or carry a different one. Registrations are written before
+// any message exists and are not expected to have one.
+const wrongCorrID = "((e.correlation_id IS NULL AND e.event <> 'registered') OR e.correlation_id <> c.correlation_id)"
+
+// CheckCorrelationIDs lists up to limit files with events that are missing
+// their canonical correlation ID or carry a different one
+func (dbs *SDAdb) CheckCorrelationIDs(limit int) ([]CorrelationIDIssue, error) {
+	return retryValue(dbs, func() ([]CorrelationIDIssue, error) {
+		return dbs.checkCorrelationIDs(limit)
+	})
+}
+func (dbs *SDAdb) checkCorrelationIDs(limit int) ([]CorrelationIDIssue, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	const query = canonicalCorrIDs +
+		"SELECT c.file_id, f.submission_user, f.submission_file_path, c.correlation_id, " +
+		"COUNT(*) FILTER (WHERE e.correlation_id IS NULL AND e.event <> 'registered'), " +
+		"COALESCE(ARRAY_AGG(DISTINCT e.correlation_id::text) FILTER (WHERE e.correlation_id <> c.correlation_id), '{}') " +
+		"FROM canonical c JOIN sda.files f ON f.id = c.file_id JOIN sda.file_event_log e ON e.file_id = c.file_id " +
+		"GROUP BY c.file_id, f.submission_user, f.submission_file_path, c.correlation_id " +
+		"HAVING COUNT(*) FILTER (WHERE " + wrongCorrID + ") > 0 " +
+		"ORDER BY f.submission_user, f.submission_file_path LIMIT $1;"
+
+	issues := []CorrelationIDIssue{}
+	rows, err := dbs.DB.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i CorrelationIDIssue
+		if err := rows.Scan(&i.FileID, &i.User, &i.FilePath, &i.CorrelationID, &i.Missing, pq.Array(&i.Conflicting)); err != nil {
+			return nil, err
+		}
+
+		issues = append(issues, i)
+	}
+
+	return issues, rows.Err()
+}
+
+// BackfillCorrelationIDs sets the canonical correlation ID on all events
+// that are missing it or carry a different one, and returns the number of
+// events changed
+func (dbs *SDAdb) BackfillCorrelationIDs() (int64, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 25 {
+		return 0, errors.New("database schema v25 required for BackfillCorrelationIDs()")
+	}
+
+	const query = canonicalCorrIDs +
+		"UPDATE sda.file_event_log e SET correlation_id = c.correlation_id FROM canonical c " +
+		"WHERE e.file_id = c.file_id AND " + wrongCorrID + ";"
+
+	return retryValue(dbs, func() (int64, error) {
+		result, err := dbs.DB.Exec(query)
+		if err != nil {
+			return 0, err
+		}
+
+		return result.RowsAffected()
+	})
+}
+
+// RegisterExpectedFiles records the files that a user is expected to upload,
+// registering a path again replaces the earlier record
+func (dbs *SDAdb) RegisterExpectedFiles(user string, files []ExpectedFile, registeredBy string) error {
+	if dbs.Version < 27 {
+		return errors.New("database schema v27 required for RegisterExpectedFiles()")
+	}
+
+	const query = "INSERT INTO sda.expected_files(submission_user, submission_file_path, file_size, checksum, checksum_type, registered_by) " +
+		"VALUES($1, $2, NULLIF($3, 0), NULLIF($4, ''), NULLIF(UPPER($5), '')::sda.checksum_algorithm, $6) " +
+		"ON CONFLICT (submission_user, submission_file_path) DO UPDATE SET file_size = excluded.file_size, checksum = excluded.checksum, " +
+		"checksum_type = excluded.checksum_type, registered_by = excluded.registered_by, registered_at = clock_timestamp(), reminded_at = NULL;"
+
+	return dbs.WithTransaction(func(tx *Tx) error {
+		for _, f := range files {
+			if _, err := tx.tx.Exec(query, user, f.FilePath, f.Size, f.Checksum, f.ChecksumType, registeredBy); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// RemoveExpectedFile removes a file from the files that a user is expected
+// to upload
+func (dbs *SDAdb) RemoveExpectedFile(user, filePath string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 27 {
+		return errors.New("database schema v27 required for RemoveExpectedFile()")
+	}
+
+	const query = "DELETE FROM sda.expected_files WHERE submission_user = $1 AND submission_file_path = $2;"
+	result, err := dbs.DB.Exec(query, user, filePath)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("no expected file %s found for %s", filePath, user)
+	}
+
+	return nil
+}
+
+// GetSubmissionStatus compares the files that a user is expected to upload
+// with the files in the inbox. A file has arrived when a file that is not
+// disabled has been uploaded to its path, the size and checksum are compared
+// when both sides are known.
+func (dbs *SDAdb) GetSubmissionStatus(user string) (*SubmissionStatus, error) {
+	if dbs.Version < 27 {
+		return nil, errors.New("database schema v27 required for GetSubmissionStatus()")
+	}
+
+	return retryValue(dbs, func() (*SubmissionStatus, error) {
+		return dbs.getSubmissionStatus(user)
+	})
+}
+func (dbs *SDAdb) getSubmissionStatus(user string) (*SubmissionStatus, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	// the latest upload to each expected path, with the uploaded checksum of the expected type
+	query := "SELECT x.submission_file_path, COALESCE(x.file_size, 0), COALESCE(x.checksum, ''), COALESCE(x.checksum_type::text, ''), " +
+		"x.registered_by, x.registered_at, COALESCE(f.id::text, ''), COALESCE(f.submission_file_size, 0), COALESCE(c.checksum, '') " +
+		"FROM sda.expected_files x " +
+		"LEFT JOIN LATERAL (SELECT u.id, u.submission_file_size FROM sda.files u " +
+		"WHERE u.submission_user = x.submission_user AND u.submission_file_path = x.submission_file_path AND " + dbs.notDeleted("u") + " " +
+		"AND (SELECT event FROM sda.file_event_log WHERE file_id = u.id ORDER BY started_at DESC LIMIT 1) IS DISTINCT FROM 'disabled' " +
+		"ORDER BY u.created_at DESC LIMIT 1) f ON true " +
+		"LEFT JOIN sda.checksums c ON c.file_id = f.id AND c.source = 'UPLOADED' AND c.type = x.checksum_type " +
+		"WHERE x.submission_user = $1 ORDER BY x.submission_file_path;"
+
+	rows, err := dbs.DB.Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	status := &SubmissionStatus{User: user, Files: []ExpectedFile{}, Unexpected: []string{}}
+	expected := map[string]bool{}
+	for rows.Next() {
+		var f ExpectedFile
+		var uploadedSize int64
+		var uploadedChecksum string
+		if err := rows.Scan(&f.FilePath, &f.Size, &f.Checksum, &f.ChecksumType, &f.RegisteredBy, &f.RegisteredAt, &f.FileID, &uploadedSize, &uploadedChecksum); err != nil {
+			return nil, err
+		}
+		f.ChecksumType = strings.ToLower(f.ChecksumType)
+
+		switch {
+		case f.FileID == "":
+			f.Status = "missing"
+		case f.Size > 0 && uploadedSize > 0 && f.Size != uploadedSize,
+			f.Checksum != "" && uploadedChecksum != "" && !strings.EqualFold(f.Checksum, uploadedChecksum):
+			f.Status = "mismatch"
+		default:
+			f.Status = "arrived"
+			status.Arrived++
+		}
+
+		expected[f.FilePath] = true
+		status.Files = append(status.Files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	status.Expected = len(status.Files)
+	if status.Expected == 0 {
+		return status, nil
+	}
+
+	files, _, err := dbs.getUserFiles(user, Page{})
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !expected[f.InboxPath] {
+			status.Unexpected = append(status.Unexpected, f.InboxPath)
+		}
+	}
+
+	return status, nil
+}
+
+// GetOverdueExpectedFiles lists, per user, the expected files that have not
+// been uploaded although they were registered, or last reminded about, more
+// than after ago
+func (dbs *SDAdb) GetOverdueExpectedFiles(after time.Duration) ([]MissingFiles, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 27 {
+		return nil, errors.New("database schema v27 required for GetOverdueExpectedFiles()")
+	}
+
+	query := "SELECT x.submission_user, x.submission_file_path FROM sda.expected_files x " +
+		"WHERE COALESCE(x.reminded_at, x.registered_at) < now() - $1::interval " +
+		"AND NOT EXISTS (SELECT 1 FROM sda.files f WHERE f.submission_user = x.submission_user AND f.submission_file_path = x.submission_file_path AND " + dbs.notDeleted("f") + ") " +
+		"ORDER BY x.submission_user, x.submission_file_path;"
+
+	rows, err := dbs.DB.Query(query, fmt.Sprintf("%d seconds", int64(after.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	missing := []MissingFiles{}
+	for rows.Next() {
+		var user, filePath string
+		if err := rows.Scan(&user, &filePath); err != nil {
+			return nil, err
+		}
+		if len(missing) == 0 || missing[len(missing)-1].User != user {
+			missing = append(missing, MissingFiles{User: user})
+		}
+		missing[len(missing)-1].FilePaths = append(missing[len(missing)-1].FilePaths, filePath)
+	}
+
+	return missing, rows.Err()
+}
+
+// SetExpectedFilesReminded records that the user has been reminded about
+// the given expected files
+func (dbs *SDAdb) SetExpectedFilesReminded(user string, filePaths []string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 27 {
+		return errors.New("database schema v27 required for SetExpectedFilesReminded()")
+	}
+
+	const query = "UPDATE sda.expected_files SET reminded_at = clock_timestamp() WHERE submission_user = $1 AND submission_file_path = ANY($2);"
+	_, err := dbs.DB.Exec(query, user, pq.Array(filePaths))
+
+	return err
+}
+
+// SetFileDeleted soft deletes a file, it is left out of the file lists from
+// then on while its records are kept for the audit trail. The file is also
+// disabled, with the user recorded in the event log.
+func (dbs *SDAdb) SetFileDeleted(fileID, user string) error {
+	if dbs.Version < 28 {
+		return errors.New("database schema v28 required for SetFileDeleted()")
+	}
+
+	const query = "UPDATE sda.files SET deleted_at = clock_timestamp() WHERE id = $1 AND deleted_at IS NULL;"
+
+	return dbs.WithTransaction(func(tx *Tx) error {
+		result, err := tx.tx.Exec(query, fileID)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return fmt.Errorf("file %s not found or already deleted", fileID)
+		}
+
+		return changeFileStatus(tx.tx, tx.version, fileID, "", "disabled", fileID, user, "{}", "{}")
+	})
+}
+
+// RequestDeletion queues a request from a user to delete one of their files.
+// Only files that are still in the inbox can be requested for deletion, and
+// a file can have one pending request at a time.
+func (dbs *SDAdb) RequestDeletion(fileID, user, reason string) (int, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 30 {
+		return 0, errors.New("database schema v30 required for RequestDeletion()")
+	}
+
+	const query = "INSERT INTO sda.deletion_requests(file_id, submission_user, reason) " +
+		"SELECT f.id, f.submission_user, NULLIF($3, '') FROM sda.files f " +
+		"WHERE f.id = $1 AND f.submission_user = $2 AND f.deleted_at IS NULL " +
+		"AND (SELECT event FROM sda.file_event_log WHERE file_id = f.id ORDER BY started_at DESC LIMIT 1) = 'uploaded' " +
+		"ON CONFLICT DO NOTHING RETURNING id;"
+
+	var id int
+	err := dbs.DB.QueryRow(query, fileID, user, reason).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	// nothing was inserted, find out why
+	var pending bool
+	if err := dbs.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM sda.deletion_requests WHERE file_id = $1 AND submission_user = $2 AND status = 'pending');", fileID, user).Scan(&pending); err != nil {
+		return 0, err
+	}
+	if pending {
+		return 0, errors.New("deletion already requested")
+	}
+
+	return 0, fmt.Errorf("file %s not found in the inbox", fileID)
+}
+
+// ListDeletionRequests lists the deletion requests of a user, or of all users
+// when user is empty, optionally filtered on status.
+func (dbs *SDAdb) ListDeletionRequests(user, status string) ([]DeletionRequest, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 30 {
+		return nil, errors.New("database schema v30 required for ListDeletionRequests()")
+	}
+
+	const query = "SELECT r.id, r.file_id, r.submission_user, f.submission_file_path, COALESCE(r.reason, ''), r.requested_at, r.status, " +
+		"COALESCE(r.reviewed_by, ''), r.reviewed_at, COALESCE(r.review_reason, '') " +
+		"FROM sda.deletion_requests r JOIN sda.files f ON f.id = r.file_id " +
+		"WHERE ($1 = '' OR r.submission_user = $1) AND ($2 = '' OR r.status = $2) " +
+		"ORDER BY r.id ASC;"
+
+	requests := []DeletionRequest{}
+	rows, err := dbs.reader().Query(query, user, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r DeletionRequest
+		var reviewedAt sql.NullString
+		err := rows.Scan(&r.ID, &r.FileID, &r.User, &r.FilePath, &r.Reason, &r.RequestedAt, &r.Status, &r.ReviewedBy, &reviewedAt, &r.ReviewReason)
+		if err != nil {
+			return nil, err
+		}
+		r.ReviewedAt = reviewedAt.String
+
+		requests = append(requests, r)
+	}
+
+	return requests, rows.Err()
+}
+
+// GetDeletionRequest returns a deletion request by its id
+func (dbs *SDAdb) GetDeletionRequest(id int) (*DeletionRequest, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 30 {
+		return nil, errors.New("database schema v30 required for GetDeletionRequest()")
+	}
+
+	const query = "SELECT r.id, r.file_id, r.submission_user, f.submission_file_path, COALESCE(r.reason, ''), r.requested_at, r.status, " +
+		"COALESCE(r.reviewed_by, ''), r.reviewed_at, COALESCE(r.review_reason, '') " +
+		"FROM sda.deletion_requests r JOIN sda.files f ON f.id = r.file_id WHERE r.id = $1;"
+
+	r := &DeletionRequest{}
+	var reviewedAt sql.NullString
+	err := dbs.DB.QueryRow(query, id).Scan(&r.ID, &r.FileID, &r.User, &r.FilePath, &r.Reason, &r.RequestedAt, &r.Status, &r.ReviewedBy, &reviewedAt, &r.ReviewReason)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errors.New("deletion request not found")
+	case err != nil:
+		return nil, err
+	}
+	r.ReviewedAt = reviewedAt.String
+
+	return r, nil
+}
+
+// ReviewDeletionRequest approves or rejects a pending deletion request, the
+// request is returned so that the caller can carry out an approved deletion.
+func (dbs *SDAdb) ReviewDeletionRequest(id int, approve bool, reviewer, reason string) (*DeletionRequest, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 30 {
+		return nil, errors.New("database schema v30 required for ReviewDeletionRequest()")
+	}
+
+	status := "rejected"
+	if approve {
+		status = "approved"
+	}
+
+	const query = "UPDATE sda.deletion_requests r SET status = $2, reviewed_by = $3, reviewed_at = clock_timestamp(), review_reason = NULLIF($4, '') " +
+		"FROM sda.files f WHERE r.id = $1 AND r.status = 'pending' AND f.id = r.file_id " +
+		"RETURNING r.id, r.file_id, r.submission_user, f.submission_file_path, COALESCE(r.reason, ''), r.requested_at, r.status, " +
+		"r.reviewed_by, r.reviewed_at, COALESCE(r.review_reason, '');"
+
+	r := &DeletionRequest{}
+	err := dbs.DB.QueryRow(query, id, status, reviewer, reason).Scan(&r.ID, &r.FileID, &r.User, &r.FilePath, &r.Reason, &r.RequestedAt, &r.Status, &r.ReviewedBy, &r.ReviewedAt, &r.ReviewReason)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errors.New("no pending deletion request")
+	case err != nil:
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// SetFileMetadata stores submission metadata, a JSON object, for the file
+// with the accession ID, replacing any metadata stored earlier
+func (dbs *SDAdb) SetFileMetadata(accessionID string, metadata json.RawMessage) error {
+	return dbs.setMetadata("files", accessionID, metadata)
+}
+
+// GetFileMetadata returns the submission metadata of the file with the
+// accession ID, an empty object when none has been stored
+func (dbs *SDAdb) GetFileMetadata(accessionID string) (json.RawMessage, error) {
+	return dbs.getMetadata("files", accessionID)
+}
+
+// SetDatasetMetadata stores submission metadata, a JSON object, for the
+// dataset, replacing any metadata stored earlier
+func (dbs *SDAdb) SetDatasetMetadata(datasetID string, metadata json.RawMessage) error {
+	return dbs.setMetadata("datasets", datasetID, metadata)
+}
+
+// GetDatasetMetadata returns the submission metadata of the dataset, an
+// empty object when none has been stored
+func (dbs *SDAdb) GetDatasetMetadata(datasetID string) (json.RawMessage, error) {
+	return dbs.getMetadata("datasets", datasetID)
+}
+
+// setMetadata sets the metadata column of the files or datasets table for
+// the row with the stable ID, sql.ErrNoRows is returned if there is none
+func (dbs *SDAdb) setMetadata(table, stableID string, metadata json.RawMessage) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 31 {
+		return errors.New("database schema v31 required for storing metadata")
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal(metadata, &object); err != nil || object == nil {
+		return errors.New("metadata must be a JSON object")
+	}
+
+	query := "UPDATE sda." + table + " SET metadata = $2 WHERE stable_id = $1;"
+	result, err := dbs.DB.Exec(query, stableID, string(metadata))
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// getMetadata returns the metadata column of the files or datasets table
+// for the row with the stable ID
+func (dbs *SDAdb) getMetadata(table, stableID string) (json.RawMessage, error) {
+	return retryValue(dbs, func() (json.RawMessage, error) {
+		dbs.checkAndReconnectIfNeeded()
+
+		if dbs.Version < 31 {
+			return nil, permanent(errors.New("database schema v31 required for reading metadata"))
+		}
+
+		query := "SELECT COALESCE(metadata, '{}'::JSONB)::TEXT FROM sda." + table + " WHERE stable_id = $1;"
+		var metadata string
+		if err := dbs.DB.QueryRow(query, stableID).Scan(&metadata); err != nil {
+			return nil, err
+		}
+
+		return json.RawMessage(metadata), nil
+	})
+}
+
+// FlagDuplicateSubmission looks for other files of the owner of the file
+// with the same decrypted SHA256 checksum, to catch files that are submitted
+// twice. When there are any, a "duplicate" event listing them is added to the
+// event log of the file. The IDs of the other files are returned.
+func (dbs *SDAdb) FlagDuplicateSubmission(fileID, decryptedChecksum, corrID string) ([]string, error) {
+	return retryValue(dbs, func() ([]string, error) {
+		return dbs.flagDuplicateSubmission(fileID, decryptedChecksum, corrID)
+	})
+}
+func (dbs *SDAdb) flagDuplicateSubmission(fileID, decryptedChecksum, corrID string) ([]string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	query := "SELECT o.id FROM sda.files f JOIN sda.files o ON o.submission_user = f.submission_user AND o.id <> f.id " +
+		"JOIN sda.checksums c ON c.file_id = o.id WHERE f.id = $1 AND c.source = 'UNENCRYPTED' AND c.type = 'SHA256' AND c.checksum = $2 " +
+		"AND " + dbs.notDeleted("o") + " ORDER BY o.created_at;"
+	duplicates, err := dbs.queryStrings(query, fileID, decryptedChecksum)
+	if err != nil || len(duplicates) == 0 || dbs.Version < 32 {
+		return duplicates, err
+	}
+
+	details, err := json.Marshal(map[string][]string{"duplicateOf": duplicates})
+	if err != nil {
+		return nil, err
+	}
+
+	return duplicates, changeFileStatus(dbs.DB, dbs.Version, fileID, "", "duplicate", corrID, "verify", string(details), "{}")
+}
+
+// PurgeEvents deletes file events that are older than olderThan and returns
+// the number of deleted events. With keepLatestPerFile the latest event of
+// each file is kept regardless of its age, so that the current state of all
+// files can still be found.
+func (dbs *SDAdb) PurgeEvents(olderThan time.Duration, keepLatestPerFile bool) (int64, error) {
+	return retryValue(dbs, func() (int64, error) {
+		return dbs.purgeEvents(olderThan, keepLatestPerFile)
+	})
+}
+func (dbs *SDAdb) purgeEvents(olderThan time.Duration, keepLatestPerFile bool) (int64, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if olderThan <= 0 {
+		return 0, permanent(fmt.Errorf("retention must be positive, got %v", olderThan))
+	}
+
+	const query = "DELETE FROM sda.file_event_log l WHERE l.started_at < $1 " +
+		"AND (NOT $2 OR l.id <> (SELECT max(id) FROM sda.file_event_log WHERE file_id = l.file_id));"
+	result, err := dbs.DB.Exec(query, time.Now().Add(-olderThan), keepLatestPerFile)
+	if err != nil {
+		return 0, err
 	}
 
-	return accessions, nil
+	return result.RowsAffected()
 }
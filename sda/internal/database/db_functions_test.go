@@ -2,8 +2,11 @@ package database
 
 import (
 	"crypto/sha256"
+	"database/sql"
+	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -81,6 +84,84 @@ func (suite *DatabaseTests) TestUpdateFileEventLog() {
 	assert.True(suite.T(), exists, "UpdateFileEventLog() did not insert a row into sda.file_event_log with id: "+fileID)
 }
 
+func (suite *DatabaseTests) TestRegisterFiles() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got %v when creating new connection", err)
+
+	paths := []string{"/testuser/TestRegisterFiles-1.c4gh", "/testuser/TestRegisterFiles-2.c4gh", "/testuser/TestRegisterFiles-3.c4gh"}
+	fileIDs, err := db.RegisterFiles(paths, "testuser")
+	assert.NoError(suite.T(), err, "failed to register files in database")
+	assert.Equal(suite.T(), len(paths), len(fileIDs))
+
+	for i, fileID := range fileIDs {
+		path, err := db.GetInboxFilePathFromID("testuser", fileID)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), paths[i], path)
+	}
+
+	// registering an already registered file returns the same ID
+	again, err := db.RegisterFiles(paths[:1], "testuser")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), fileIDs[:1], again)
+}
+
+func (suite *DatabaseTests) TestInsertFileEvents() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got %v when creating new connection", err)
+
+	fileIDs, err := db.RegisterFiles([]string{"/testuser/TestInsertFileEvents-1.c4gh", "/testuser/TestInsertFileEvents-2.c4gh"}, "testuser")
+	assert.NoError(suite.T(), err, "failed to register files in database")
+
+	var events []FileEventRecord
+	for _, fileID := range fileIDs {
+		events = append(events, FileEventRecord{FileID: fileID, Event: "uploaded", CorrelationID: fileID, User: "testuser", Details: "{}", Message: "{}"})
+	}
+	assert.NoError(suite.T(), db.InsertFileEvents(events), "failed to insert file events")
+
+	for _, fileID := range fileIDs {
+		status, err := db.GetFileStatus(fileID)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), "uploaded", status)
+	}
+
+	// no event is inserted when one of them refers to an unknown file
+	events = []FileEventRecord{
+		{FileID: fileIDs[0], Event: "archived", CorrelationID: fileIDs[0], User: "testuser", Details: "{}", Message: "{}"},
+		{FileID: "00000000-0000-0000-0000-000000000000", Event: "archived", CorrelationID: fileIDs[0], User: "testuser", Details: "{}", Message: "{}"},
+	}
+	assert.Error(suite.T(), db.InsertFileEvents(events))
+	status, err := db.GetFileStatus(fileIDs[0])
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "uploaded", status)
+}
+
+func (suite *DatabaseTests) TestGetFileEvents() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got %v when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/testuser/TestGetFileEvents.c4gh", "testuser")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+
+	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "uploaded", corrID, "testuser", "{\"size\": 10}", "{}"))
+
+	events, err := db.GetFileEvents(fileID)
+	assert.NoError(suite.T(), err, "failed to get file events")
+	assert.Equal(suite.T(), 2, len(events))
+	assert.Equal(suite.T(), "registered", events[0].Event)
+	assert.Equal(suite.T(), "", events[0].CorrelationID)
+	assert.Equal(suite.T(), "testuser", events[0].User)
+	assert.Equal(suite.T(), "uploaded", events[1].Event)
+	assert.Equal(suite.T(), corrID, events[1].CorrelationID)
+	assert.JSONEq(suite.T(), "{\"size\": 10}", events[1].Details)
+	_, err = time.Parse(time.RFC3339Nano, events[1].Timestamp)
+	assert.NoError(suite.T(), err)
+
+	events, err = db.GetFileEvents("00000000-0000-0000-0000-000000000000")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), events)
+}
+
 func (suite *DatabaseTests) TestStoreHeader() {
 	db, err := NewSDAdb(suite.dbConf)
 	assert.NoError(suite.T(), err, "got %v when creating new connection", err)
@@ -105,14 +186,20 @@ func (suite *DatabaseTests) TestSetArchived() {
 	fileID, err := db.RegisterFile("/testuser/TestSetArchived.c4gh", "testuser")
 	assert.NoError(suite.T(), err, "failed to register file in database")
 
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New()), 1000, "/tmp/TestSetArchived.c4gh", fmt.Sprintf("%x", sha256.New()), -1}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New()), Size: 1000, Path: "/tmp/TestSetArchived.c4gh", DecryptedChecksum: fmt.Sprintf("%x", sha256.New()), DecryptedSize: -1}
 	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "failed to mark file as Archived")
 
 	err = db.SetArchived(fileInfo, "00000000-0000-0000-0000-000000000000", corrID)
-	assert.ErrorContains(suite.T(), err, "violates foreign key constraint")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+
+	// the file is archived already
+	err = db.SetArchived(fileInfo, fileID, corrID)
+	assert.ErrorIs(suite.T(), err, ErrStatusConflict)
 
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", "00000000-0000-0000-0000-000000000000", "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, "00000000-0000-0000-0000-000000000000")
 	assert.ErrorContains(suite.T(), err, "duplicate key value violates unique constraint")
 }
@@ -126,12 +213,12 @@ func (suite *DatabaseTests) TestGetFileStatus() {
 	assert.NoError(suite.T(), err, "failed to register file in database")
 
 	corrID := uuid.New().String()
-	err = db.UpdateFileEventLog(fileID, "downloaded", corrID, "testuser", "{}", "{}")
-	assert.NoError(suite.T(), err, "failed to set file as downloaded in database")
+	err = db.UpdateFileEventLog(fileID, "uploaded", corrID, "testuser", "{}", "{}")
+	assert.NoError(suite.T(), err, "failed to set file as uploaded in database")
 
 	status, err := db.GetFileStatus(corrID)
 	assert.NoError(suite.T(), err, "failed to get file status")
-	assert.Equal(suite.T(), "downloaded", status)
+	assert.Equal(suite.T(), "uploaded", status)
 }
 
 func (suite *DatabaseTests) TestGetHeader() {
@@ -159,8 +246,14 @@ func (suite *DatabaseTests) TestSetVerified() {
 	assert.NoError(suite.T(), err, "failed to register file in database")
 
 	corrID := uuid.New().String()
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New()), 1000, "/testuser/TestSetVerified.c4gh", fmt.Sprintf("%x", sha256.New()), 948}
-	err = db.SetVerified(fileInfo, fileID, corrID)
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New()), Size: 1000, Path: "/testuser/TestSetVerified.c4gh", DecryptedChecksum: fmt.Sprintf("%x", sha256.New()), DecryptedSize: 948}
+	// the file is not archived yet
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
+	assert.ErrorIs(suite.T(), err, ErrStatusConflict)
+
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(fileInfo, fileID, corrID), "failed to mark file as archived")
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as verified", err)
 }
 
@@ -172,11 +265,12 @@ func (suite *DatabaseTests) TestGetArchived() {
 	fileID, err := db.RegisterFile("/testuser/TestGetArchived.c4gh", "testuser")
 	assert.NoError(suite.T(), err, "failed to register file in database")
 
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New()), 1000, "/tmp/TestGetArchived.c4gh", fmt.Sprintf("%x", sha256.New()), 987}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New()), Size: 1000, Path: "/tmp/TestGetArchived.c4gh", DecryptedChecksum: fmt.Sprintf("%x", sha256.New()), DecryptedSize: 987}
 	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as Archived")
-	err = db.SetVerified(fileInfo, fileID, corrID)
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as verified", err)
 
 	filePath, fileSize, err := db.GetArchived(fileID)
@@ -192,11 +286,12 @@ func (suite *DatabaseTests) TestSetAccessionID() {
 	// register a file in the database
 	fileID, err := db.RegisterFile("/testuser/TestSetAccessionID.c4gh", "testuser")
 	assert.NoError(suite.T(), err, "failed to register file in database")
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New()), 1000, "/tmp/TestSetAccessionID.c4gh", fmt.Sprintf("%x", sha256.New()), 987}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New()), Size: 1000, Path: "/tmp/TestSetAccessionID.c4gh", DecryptedChecksum: fmt.Sprintf("%x", sha256.New()), DecryptedSize: 987}
 	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as Archived")
-	err = db.SetVerified(fileInfo, fileID, corrID)
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as verified", err)
 	stableID := "TEST:000-1234-4567"
 	err = db.SetAccessionID(stableID, fileID)
@@ -210,11 +305,12 @@ func (suite *DatabaseTests) TestCheckAccessionIDExists() {
 	// register a file in the database
 	fileID, err := db.RegisterFile("/testuser/TestCheckAccessionIDExists.c4gh", "testuser")
 	assert.NoError(suite.T(), err, "failed to register file in database")
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New()), 1000, "/tmp/TestCheckAccessionIDExists.c4gh", fmt.Sprintf("%x", sha256.New()), 987}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New()), Size: 1000, Path: "/tmp/TestCheckAccessionIDExists.c4gh", DecryptedChecksum: fmt.Sprintf("%x", sha256.New()), DecryptedSize: 987}
 	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as Archived")
-	err = db.SetVerified(fileInfo, fileID, corrID)
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as verified", err)
 	stableID := "TEST:111-1234-4567"
 	err = db.SetAccessionID(stableID, fileID)
@@ -245,11 +341,12 @@ func (suite *DatabaseTests) TestGetFileInfo() {
 	_, err = decSha.Write([]byte("DecryptedChecksum"))
 	assert.NoError(suite.T(), err)
 
-	fileInfo := FileInfo{fmt.Sprintf("%x", encSha.Sum(nil)), 2000, "/tmp/TestGetFileInfo.c4gh", fmt.Sprintf("%x", decSha.Sum(nil)), 1987}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", encSha.Sum(nil)), Size: 2000, Path: "/tmp/TestGetFileInfo.c4gh", DecryptedChecksum: fmt.Sprintf("%x", decSha.Sum(nil)), DecryptedSize: 1987}
 	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as Archived")
-	err = db.SetVerified(fileInfo, fileID, corrID)
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 	assert.NoError(suite.T(), err, "got (%v) when marking file as verified", err)
 
 	info, err := db.GetFileInfo(fileID)
@@ -258,6 +355,61 @@ func (suite *DatabaseTests) TestGetFileInfo() {
 	assert.Equal(suite.T(), "/tmp/TestGetFileInfo.c4gh", info.Path)
 	assert.Equal(suite.T(), "11c94bc7fb13afeb2b3fb16c1dbe9206dc09560f1b31420f2d46210ca4ded0a8", info.Checksum)
 	assert.Equal(suite.T(), "a671218c2418aa51adf97e33c5c91a720289ba3c9fd0d36f6f4bf9610730749f", info.DecryptedChecksum)
+
+	assert.NoError(suite.T(), db.SetAccessionID("accession_TestGetFileInfo", fileID))
+	byStableID, err := db.GetFileInfoByStableID("accession_TestGetFileInfo")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), info, byStableID)
+	status, err := db.GetFileStatusByStableID("accession_TestGetFileInfo")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "verified", status)
+
+	_, err = db.GetFileInfoByStableID("accession_TestGetFileInfo_missing")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+}
+
+func (suite *DatabaseTests) TestSetChecksums() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/testuser/TestSetChecksums.c4gh", "testuser")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+
+	corrID := uuid.New().String()
+	fileInfo := FileInfo{
+		Checksum:           "11c94bc7fb13afeb2b3fb16c1dbe9206dc09560f1b31420f2d46210ca4ded0a8",
+		Size:               2000,
+		Path:               "/tmp/TestSetChecksums.c4gh",
+		DecryptedChecksum:  "a671218c2418aa51adf97e33c5c91a720289ba3c9fd0d36f6f4bf9610730749f",
+		DecryptedSize:      1987,
+		DecryptedChecksums: map[string]string{"md5": "7ac236b1a8dce2dac89e7cf45d2b48bd"},
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(fileInfo, fileID, corrID))
+	assert.NoError(suite.T(), db.SetVerified(fileInfo, fileID, "archived", corrID))
+
+	info, err := db.GetFileInfo(fileID)
+	assert.NoError(suite.T(), err, "got (%v) when getting file archive information", err)
+	assert.Equal(suite.T(), map[string]string{"sha256": fileInfo.Checksum}, info.ArchivedChecksums)
+	assert.Equal(suite.T(), map[string]string{"sha256": fileInfo.DecryptedChecksum, "md5": "7ac236b1a8dce2dac89e7cf45d2b48bd"}, info.DecryptedChecksums)
+
+	err = db.SetChecksums(fileID, "unencrypted", map[string]string{"SHA3-256": "e6a2d3d8", "crc32c": "e3069283", "md5": "00000000000000000000000000000000"})
+	assert.NoError(suite.T(), err, "failed to set checksums")
+	checksums, err := db.GetChecksums(fileID, "unencrypted")
+	assert.NoError(suite.T(), err, "failed to get checksums")
+	assert.Equal(suite.T(), map[string]string{
+		"sha256":   fileInfo.DecryptedChecksum,
+		"md5":      "00000000000000000000000000000000",
+		"sha3-256": "e6a2d3d8",
+		"crc32c":   "e3069283",
+	}, checksums)
+
+	err = db.SetChecksums(fileID, "unencrypted", map[string]string{"sha1": "a9993e36"})
+	assert.ErrorContains(suite.T(), err, "unsupported checksum algorithm sha1")
+
+	checksums, err = db.GetChecksums(fileID, "uploaded")
+	assert.NoError(suite.T(), err, "failed to get checksums")
+	assert.Equal(suite.T(), map[string]string{"sha256": fileInfo.Checksum}, checksums)
 }
 
 func (suite *DatabaseTests) TestMapFilesToDataset() {
@@ -372,12 +524,13 @@ func (suite *DatabaseTests) TestGetSyncData() {
 	assert.NoError(suite.T(), err, "failed to register file in database")
 
 	checksum := fmt.Sprintf("%x", sha256.New().Sum(nil))
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New().Sum(nil)), 1234, "/tmp/TestGetGetSyncData.c4gh", checksum, 999}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New().Sum(nil)), Size: 1234, Path: "/tmp/TestGetGetSyncData.c4gh", DecryptedChecksum: checksum, DecryptedSize: 999}
 	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "failed to mark file as Archived")
 
-	err = db.SetVerified(fileInfo, fileID, corrID)
+	err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 	assert.NoError(suite.T(), err, "failed to mark file as Verified")
 
 	stableID := "TEST:000-1111-2222"
@@ -433,7 +586,8 @@ func (suite *DatabaseTests) TestGetArchivePath() {
 
 	checksum := fmt.Sprintf("%x", sha256.New())
 	corrID := uuid.New().String()
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New()), 1234, corrID, checksum, 999}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New()), Size: 1234, Path: corrID, DecryptedChecksum: checksum, DecryptedSize: 999}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 	err = db.SetArchived(fileInfo, fileID, corrID)
 	assert.NoError(suite.T(), err, "failed to mark file as Archived")
 
@@ -456,7 +610,7 @@ func (suite *DatabaseTests) TestGetUserFiles() {
 		assert.NoError(suite.T(), err, "failed to register file in database")
 		err = db.UpdateFileEventLog(fileID, "uploaded", fileID, testUser, "{}", "{}")
 		assert.NoError(suite.T(), err, "failed to update satus of file in database")
-		err = db.UpdateFileEventLog(fileID, "ready", fileID, testUser, "{}", "{}")
+		err = db.UpdateFileEventLog(fileID, "submitted", fileID, testUser, "{}", "{}")
 		assert.NoError(suite.T(), err, "failed to update satus of file in database")
 	}
 	filelist, err := db.GetUserFiles("unknownuser")
@@ -468,8 +622,164 @@ func (suite *DatabaseTests) TestGetUserFiles() {
 	assert.Equal(suite.T(), testCases, len(filelist), "file list is of incorrect length")
 
 	for _, fileInfo := range filelist {
-		assert.Equal(suite.T(), "ready", fileInfo.Status, "incorrect file status")
+		assert.Equal(suite.T(), "submitted", fileInfo.Status, "incorrect file status")
+	}
+}
+
+func (suite *DatabaseTests) TestGetUserFilesPage() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	testUser := "GetFilesPageUser"
+
+	for i := 0; i < 5; i++ {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/%v/TestGetUserFilesPage-00%d.c4gh", testUser, i), testUser)
+		assert.NoError(suite.T(), err, "failed to register file in database")
+		err = db.UpdateFileEventLog(fileID, "uploaded", fileID, testUser, "{}", "{}")
+		assert.NoError(suite.T(), err, "failed to update satus of file in database")
+		if i == 2 {
+			err = db.UpdateFileEventLog(fileID, "disabled", fileID, testUser, "{}", "{}")
+			assert.NoError(suite.T(), err, "failed to disable file in database")
+		}
+	}
+
+	var paths []string
+	files, next, err := db.GetUserFilesPage(testUser, Page{Limit: 2})
+	assert.NoError(suite.T(), err, "failed to get first page")
+	assert.Len(suite.T(), files, 2)
+	assert.NotEmpty(suite.T(), next)
+	for _, f := range files {
+		paths = append(paths, f.InboxPath)
+	}
+
+	files, next, err = db.GetUserFilesPage(testUser, Page{Limit: 2, After: next})
+	assert.NoError(suite.T(), err, "failed to get last page")
+	assert.Len(suite.T(), files, 2)
+	assert.Empty(suite.T(), next, "the disabled file should not give another page")
+	for _, f := range files {
+		paths = append(paths, f.InboxPath)
+	}
+	assert.Equal(suite.T(), []string{
+		"/GetFilesPageUser/TestGetUserFilesPage-000.c4gh",
+		"/GetFilesPageUser/TestGetUserFilesPage-001.c4gh",
+		"/GetFilesPageUser/TestGetUserFilesPage-003.c4gh",
+		"/GetFilesPageUser/TestGetUserFilesPage-004.c4gh",
+	}, paths)
+
+	_, _, err = db.GetUserFilesPage(testUser, Page{Limit: 2, After: "not-a-cursor"})
+	assert.ErrorIs(suite.T(), err, ErrInvalidCursor)
+}
+
+func (suite *DatabaseTests) TestListActiveUsersPage() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	for _, user := range []string{"Page-A", "Page-B", "Page-C"} {
+		_, err := db.RegisterFile(fmt.Sprintf("/%v/TestListActiveUsersPage.c4gh", user), user)
+		assert.NoError(suite.T(), err, "failed to register file in database")
+	}
+
+	users, next, err := db.ListActiveUsersPage(Page{Limit: 2})
+	assert.NoError(suite.T(), err, "failed to list first page of users")
+	assert.Equal(suite.T(), []string{"Page-A", "Page-B"}, users)
+
+	users, next, err = db.ListActiveUsersPage(Page{Limit: 2, After: next})
+	assert.NoError(suite.T(), err, "failed to list last page of users")
+	assert.Equal(suite.T(), []string{"Page-C"}, users)
+	assert.Empty(suite.T(), next)
+}
+
+func (suite *DatabaseTests) TestListActiveUsersDetailedPage() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	var last string
+	for i, user := range []string{"Detail-A", "Detail-A", "Detail-B"} {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/%v/TestListActiveUsersDetailedPage-%d.c4gh", user, i), user)
+		assert.NoError(suite.T(), err, "failed to register file in database")
+		assert.NoError(suite.T(), db.SetSubmissionFileSize(fileID, int64(100*(i+1))))
+		assert.NoError(suite.T(), db.DB.QueryRow("SELECT created_at FROM sda.files WHERE id = $1;", fileID).Scan(&last))
+	}
+
+	users, next, err := db.ListActiveUsersDetailedPage(Page{Limit: 1})
+	assert.NoError(suite.T(), err, "failed to list first page of users")
+	assert.Len(suite.T(), users, 1)
+	assert.Equal(suite.T(), "Detail-A", users[0].User)
+	assert.Equal(suite.T(), int64(2), users[0].Files)
+	assert.Equal(suite.T(), int64(300), users[0].Bytes)
+	assert.NotEmpty(suite.T(), users[0].LastUpload)
+
+	users, next, err = db.ListActiveUsersDetailedPage(Page{Limit: 1, After: next})
+	assert.NoError(suite.T(), err, "failed to list last page of users")
+	assert.Equal(suite.T(), []*ActiveUser{{User: "Detail-B", Files: 1, Bytes: 300, LastUpload: last}}, users)
+	assert.Empty(suite.T(), next)
+}
+
+func (suite *DatabaseTests) TestSearchFiles() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	ids := map[string]string{}
+	for _, f := range []struct{ user, path string }{
+		{"search-a@example.org", "/run1/Sample_01.bam.c4gh"},
+		{"search-a@example.org", "/run1/sample_02.bam.c4gh"},
+		{"search-b@example.org", "/run2/sample%03.bam.c4gh"},
+		{"search-b@example.org", "/run2/notes.txt.c4gh"},
+	} {
+		fileID, err := db.RegisterFile(f.path, f.user)
+		assert.NoError(suite.T(), err, "failed to register file in database")
+		ids[f.path] = fileID
 	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(ids["/run1/sample_02.bam.c4gh"], "uploaded", ids["/run1/sample_02.bam.c4gh"], "search-a@example.org", "{}", "{}"))
+
+	paths := func(files []*FileMatch) []string {
+		p := []string{}
+		for _, f := range files {
+			p = append(p, f.InboxPath)
+		}
+
+		return p
+	}
+
+	files, _, err := db.SearchFiles("", "*sample_0?.bam*", "", Page{})
+	assert.NoError(suite.T(), err, "failed to search files")
+	assert.Equal(suite.T(), []string{"/run1/Sample_01.bam.c4gh", "/run1/sample_02.bam.c4gh"}, paths(files), "_ should only match itself")
+
+	files, _, err = db.SearchFiles("SEARCH-B*", "", "", Page{})
+	assert.NoError(suite.T(), err, "failed to search files")
+	assert.Equal(suite.T(), []string{"/run2/sample%03.bam.c4gh", "/run2/notes.txt.c4gh"}, paths(files))
+
+	files, _, err = db.SearchFiles("search-?@example.org", "*%*", "", Page{})
+	assert.NoError(suite.T(), err, "failed to search files")
+	assert.Equal(suite.T(), []string{"/run2/sample%03.bam.c4gh"}, paths(files), "% should only match itself")
+
+	files, _, err = db.SearchFiles("search-*", "*.bam.c4gh", "uploaded", Page{})
+	assert.NoError(suite.T(), err, "failed to search files")
+	assert.Len(suite.T(), files, 1)
+	assert.Equal(suite.T(), ids["/run1/sample_02.bam.c4gh"], files[0].FileID)
+	assert.Equal(suite.T(), "search-a@example.org", files[0].User)
+	assert.Equal(suite.T(), "uploaded", files[0].Status)
+
+	// the matches are paged in the order they were uploaded
+	files, next, err := db.SearchFiles("search-*", "", "", Page{Limit: 3})
+	assert.NoError(suite.T(), err, "failed to search files")
+	assert.Equal(suite.T(), []string{"/run1/Sample_01.bam.c4gh", "/run1/sample_02.bam.c4gh", "/run2/sample%03.bam.c4gh"}, paths(files))
+	assert.NotEmpty(suite.T(), next)
+	files, next, err = db.SearchFiles("search-*", "", "", Page{Limit: 3, After: next})
+	assert.NoError(suite.T(), err, "failed to search files")
+	assert.Equal(suite.T(), []string{"/run2/notes.txt.c4gh"}, paths(files))
+	assert.Empty(suite.T(), next)
+	total, err := db.CountSearchFiles("search-*", "", "")
+	assert.NoError(suite.T(), err, "failed to count files")
+	assert.Equal(suite.T(), 4, total)
+	_, _, err = db.SearchFiles("search-*", "", "", Page{After: "garbage"})
+	assert.ErrorIs(suite.T(), err, ErrInvalidCursor)
+
+	assert.NoError(suite.T(), db.SetFileDeleted(ids["/run1/sample_02.bam.c4gh"], "admin"))
+	files, _, err = db.SearchFiles("search-a*", "", "", Page{})
+	assert.NoError(suite.T(), err, "failed to search files")
+	assert.Equal(suite.T(), []string{"/run1/Sample_01.bam.c4gh"}, paths(files), "deleted files should not be found")
+
+	db.Close()
 }
 
 func (suite *DatabaseTests) TestGetCorrID() {
@@ -500,12 +810,12 @@ func (suite *DatabaseTests) TestGetCorrID_sameFilePath() {
 	if err != nil {
 		suite.FailNow("failed to register file in database")
 	}
-	if err := db.UpdateFileEventLog(fileID, "archived", fileID, user, "{}", "{}"); err != nil {
+	if err := db.UpdateFileEventLog(fileID, "submitted", fileID, user, "{}", "{}"); err != nil {
 		suite.FailNow("failed to update satus of file in database")
 	}
 
 	checksum := fmt.Sprintf("%x", sha256.New().Sum(nil))
-	fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New().Sum(nil)), 1234, fileID, checksum, 999}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New().Sum(nil)), Size: 1234, Path: fileID, DecryptedChecksum: checksum, DecryptedSize: 999}
 	if err := db.SetArchived(fileInfo, fileID, fileID); err != nil {
 		suite.FailNow("failed to mark file as archived")
 	}
@@ -592,13 +902,14 @@ func (suite *DatabaseTests) TestListActiveUsers() {
 			assert.Equal(suite.T(), fileID, corrID)
 
 			checksum := fmt.Sprintf("%x", sha256.New().Sum(nil))
-			fileInfo := FileInfo{fmt.Sprintf("%x", sha256.New().Sum(nil)), 1234, filePath, checksum, 999}
+			fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", sha256.New().Sum(nil)), Size: 1234, Path: filePath, DecryptedChecksum: checksum, DecryptedSize: 999}
+			assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 			err = db.SetArchived(fileInfo, fileID, corrID)
 			if err != nil {
 				suite.FailNow("failed to mark file as Archived")
 			}
 
-			err = db.SetVerified(fileInfo, fileID, corrID)
+			err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 			if err != nil {
 				suite.FailNow("failed to mark file as Verified")
 			}
@@ -650,18 +961,19 @@ func (suite *DatabaseTests) TestGetDatasetStatus() {
 
 		checksum := fmt.Sprintf("%x", sha256.New().Sum(nil))
 		fileInfo := FileInfo{
-			fmt.Sprintf("%x", sha256.New().Sum(nil)),
-			1234,
-			filePath,
-			checksum,
-			999,
+			Checksum:          fmt.Sprintf("%x", sha256.New().Sum(nil)),
+			Size:              1234,
+			Path:              filePath,
+			DecryptedChecksum: checksum,
+			DecryptedSize:     999,
 		}
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 		err = db.SetArchived(fileInfo, fileID, corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Archived")
 		}
 
-		err = db.SetVerified(fileInfo, fileID, corrID)
+		err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Verified")
 		}
@@ -697,6 +1009,41 @@ func (suite *DatabaseTests) TestGetDatasetStatus() {
 	assert.Equal(suite.T(), "deprecated", status)
 }
 
+func (suite *DatabaseTests) TestGetDatasetEvents() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/User-Q/TestGetDatasetEvents.c4gh", "User-Q")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	if err := db.SetAccessionID("accession_TestGetDatasetEvents", fileID); err != nil {
+		suite.FailNow("failed to set stable ID")
+	}
+
+	dID := "test-get-dataset-events-01"
+	if err := db.MapFilesToDataset(dID, []string{"accession_TestGetDatasetEvents"}); err != nil {
+		suite.FailNow("failed to map files to dataset")
+	}
+	for _, event := range []string{"registered", "released", "deprecated"} {
+		assert.NoError(suite.T(), db.UpdateDatasetEvent(dID, event, "{\"type\": \"mapping\"}"))
+	}
+
+	events, err := db.GetDatasetEvents(dID)
+	assert.NoError(suite.T(), err, "got (%v) when getting dataset events", err)
+	assert.Equal(suite.T(), 3, len(events))
+	for i, event := range []string{"registered", "released", "deprecated"} {
+		assert.Equal(suite.T(), event, events[i].Event)
+		assert.JSONEq(suite.T(), "{\"type\": \"mapping\"}", events[i].Message)
+		_, err := time.Parse(time.RFC3339Nano, events[i].Timestamp)
+		assert.NoError(suite.T(), err)
+	}
+
+	events, err = db.GetDatasetEvents("unknown-dataset")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), events)
+}
+
 func (suite *DatabaseTests) TestAddKeyHash() {
 	db, err := NewSDAdb(suite.dbConf)
 	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
@@ -810,6 +1157,33 @@ func (suite *DatabaseTests) TestSetKeyHash_wrongHash() {
 	assert.ErrorContains(suite.T(), err, "violates foreign key constraint")
 }
 
+func (suite *DatabaseTests) TestGetFilesByKeyHash() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	keyHex := "6af1407abc74656b8913a7d323c4bfd30bf7c8ca359f74ae35357acef29dc5aa"
+	assert.NoError(suite.T(), db.AddKeyHash(keyHex, "key to rotate"), "failed to register key in database")
+
+	fileID, err := db.RegisterFile("/testuser/TestGetFilesByKeyHash.c4gh", "testuser")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+	assert.NoError(suite.T(), db.SetKeyHash(keyHex, fileID))
+	assert.NoError(suite.T(), db.SetAccessionID("accession_TestGetFilesByKeyHash", fileID))
+	other, err := db.RegisterFile("/testuser/TestGetFilesByKeyHash-other.c4gh", "testuser")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+
+	files, err := db.GetFilesByKeyHash(keyHex)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(files))
+	assert.Equal(suite.T(), fileID, files[0].FileID)
+	assert.Equal(suite.T(), "accession_TestGetFilesByKeyHash", files[0].AccessionID)
+	assert.Equal(suite.T(), "testuser", files[0].User)
+	assert.Equal(suite.T(), "registered", files[0].Status)
+	assert.NotEqual(suite.T(), other, files[0].FileID)
+
+	files, err = db.GetFilesByKeyHash("unknown")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), files)
+}
+
 func (suite *DatabaseTests) TestListDatasets() {
 	db, err := NewSDAdb(suite.dbConf)
 	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
@@ -834,18 +1208,19 @@ func (suite *DatabaseTests) TestListDatasets() {
 
 		checksum := fmt.Sprintf("%x", sha256.New().Sum(nil))
 		fileInfo := FileInfo{
-			fmt.Sprintf("%x", sha256.New().Sum(nil)),
-			1234,
-			filePath,
-			checksum,
-			999,
+			Checksum:          fmt.Sprintf("%x", sha256.New().Sum(nil)),
+			Size:              1234,
+			Path:              filePath,
+			DecryptedChecksum: checksum,
+			DecryptedSize:     999,
 		}
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 		err = db.SetArchived(fileInfo, fileID, corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Archived")
 		}
 
-		err = db.SetVerified(fileInfo, fileID, corrID)
+		err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Verified")
 		}
@@ -893,6 +1268,62 @@ func (suite *DatabaseTests) TestListDatasets() {
 	assert.Equal(suite.T(), "registered", datasets[1].Status)
 }
 
+func (suite *DatabaseTests) TestListReleasedDatasets() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	for i := 0; i < 3; i++ {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/User-R/TestListReleasedDatasets-00%d.c4gh", i), "User-R")
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		if err := db.SetAccessionID(fmt.Sprintf("accession_User-R_0%d", i), fileID); err != nil {
+			suite.FailNow("failed to set stable ID")
+		}
+	}
+
+	for i, status := range []string{"released", "registered", "deprecated"} {
+		datasetID := fmt.Sprintf("test-released-dataset-0%d", i)
+		if err := db.MapFilesToDataset(datasetID, []string{fmt.Sprintf("accession_User-R_0%d", i)}); err != nil {
+			suite.FailNow("failed to map files to dataset")
+		}
+		if err := db.UpdateDatasetEvent(datasetID, "registered", "{\"type\": \"mapping\"}"); err != nil {
+			suite.FailNow("failed to update dataset event")
+		}
+		if status == "registered" {
+			continue
+		}
+		if err := db.UpdateDatasetEvent(datasetID, "released", "{\"type\": \"release\"}"); err != nil {
+			suite.FailNow("failed to update dataset event")
+		}
+		if status == "deprecated" {
+			if err := db.UpdateDatasetEvent(datasetID, "deprecated", "{\"type\": \"deprecate\"}"); err != nil {
+				suite.FailNow("failed to update dataset event")
+			}
+		}
+	}
+
+	datasets, err := db.ListReleasedDatasets(100)
+	assert.NoError(suite.T(), err, "got (%v) when listing released datasets", err)
+
+	// datasets from other tests are not removed between tests
+	var released []DatasetInfo
+	for _, d := range datasets {
+		assert.Equal(suite.T(), "released", d.Status)
+		if strings.HasPrefix(d.DatasetID, "test-released-dataset-") {
+			released = append(released, d)
+		}
+	}
+	assert.Equal(suite.T(), 1, len(released))
+	assert.Equal(suite.T(), "test-released-dataset-00", released[0].DatasetID)
+	_, err = time.Parse(time.RFC3339, released[0].Timestamp)
+	assert.NoError(suite.T(), err)
+
+	datasets, err = db.ListReleasedDatasets(0)
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), datasets)
+}
+
 func (suite *DatabaseTests) TestListUserDatasets() {
 	db, err := NewSDAdb(suite.dbConf)
 	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
@@ -917,18 +1348,19 @@ func (suite *DatabaseTests) TestListUserDatasets() {
 
 		checksum := fmt.Sprintf("%x", sha256.New().Sum(nil))
 		fileInfo := FileInfo{
-			fmt.Sprintf("%x", sha256.New().Sum(nil)),
-			1234,
-			filePath,
-			checksum,
-			999,
+			Checksum:          fmt.Sprintf("%x", sha256.New().Sum(nil)),
+			Size:              1234,
+			Path:              filePath,
+			DecryptedChecksum: checksum,
+			DecryptedSize:     999,
 		}
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 		err = db.SetArchived(fileInfo, fileID, corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Archived")
 		}
 
-		err = db.SetVerified(fileInfo, fileID, corrID)
+		err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Verified")
 		}
@@ -1056,12 +1488,15 @@ func (suite *DatabaseTests) TestGetReVerificationData() {
 		suite.FailNow("failed to generate checksum")
 	}
 
-	fileInfo := FileInfo{fmt.Sprintf("%x", encSha.Sum(nil)), 2000, "/archive/TestGetReVerificationData.c4gh", fmt.Sprintf("%x", decSha.Sum(nil)), 1987}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", encSha.Sum(nil)), Size: 2000, Path: "/archive/TestGetReVerificationData.c4gh", DecryptedChecksum: fmt.Sprintf("%x", decSha.Sum(nil)), DecryptedSize: 1987}
 	corrID := uuid.New().String()
+	if err = db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"); err != nil {
+		suite.FailNow("failed to mark file as submitted")
+	}
 	if err = db.SetArchived(fileInfo, fileID, corrID); err != nil {
 		suite.FailNow("failed to archive file")
 	}
-	if err = db.SetVerified(fileInfo, fileID, corrID); err != nil {
+	if err = db.SetVerified(fileInfo, fileID, "archived", corrID); err != nil {
 		suite.FailNow("failed to mark file as verified")
 	}
 	accession := "acession-001"
@@ -1095,12 +1530,15 @@ func (suite *DatabaseTests) TestGetReVerificationData_wrongAccessionID() {
 		suite.FailNow("failed to generate checksum")
 	}
 
-	fileInfo := FileInfo{fmt.Sprintf("%x", encSha.Sum(nil)), 2000, "/archive/TestGetReVerificationData.c4gh", fmt.Sprintf("%x", decSha.Sum(nil)), 1987}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", encSha.Sum(nil)), Size: 2000, Path: "/archive/TestGetReVerificationData.c4gh", DecryptedChecksum: fmt.Sprintf("%x", decSha.Sum(nil)), DecryptedSize: 1987}
 	corrID := uuid.New().String()
+	if err = db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"); err != nil {
+		suite.FailNow("failed to mark file as submitted")
+	}
 	if err = db.SetArchived(fileInfo, fileID, corrID); err != nil {
 		suite.FailNow("failed to archive file")
 	}
-	if err = db.SetVerified(fileInfo, fileID, corrID); err != nil {
+	if err = db.SetVerified(fileInfo, fileID, "archived", corrID); err != nil {
 		suite.FailNow("failed to mark file as verified")
 	}
 	accession := "acession-001"
@@ -1134,12 +1572,15 @@ func (suite *DatabaseTests) TestGetDecryptedChecksum() {
 		suite.FailNow("failed to generate checksum")
 	}
 
-	fileInfo := FileInfo{fmt.Sprintf("%x", encSha.Sum(nil)), 2000, "/archive/TestGetDecryptedChecksum.c4gh", fmt.Sprintf("%x", decSha.Sum(nil)), 1987}
+	fileInfo := FileInfo{Checksum: fmt.Sprintf("%x", encSha.Sum(nil)), Size: 2000, Path: "/archive/TestGetDecryptedChecksum.c4gh", DecryptedChecksum: fmt.Sprintf("%x", decSha.Sum(nil)), DecryptedSize: 1987}
 	corrID := uuid.New().String()
+	if err = db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"); err != nil {
+		suite.FailNow("failed to mark file as submitted")
+	}
 	if err = db.SetArchived(fileInfo, fileID, corrID); err != nil {
 		suite.FailNow("failed to archive file")
 	}
-	if err = db.SetVerified(fileInfo, fileID, corrID); err != nil {
+	if err = db.SetVerified(fileInfo, fileID, "archived", corrID); err != nil {
 		suite.FailNow("failed to mark file as verified")
 	}
 
@@ -1172,21 +1613,25 @@ func (suite *DatabaseTests) TestGetDsatasetFiles() {
 
 		checksum := fmt.Sprintf("%x", sha256.New().Sum(nil))
 		fileInfo := FileInfo{
-			fmt.Sprintf("%x", sha256.New().Sum(nil)),
-			1234,
-			filePath,
-			checksum,
-			999,
+			Checksum:          fmt.Sprintf("%x", sha256.New().Sum(nil)),
+			Size:              1234,
+			Path:              filePath,
+			DecryptedChecksum: checksum,
+			DecryptedSize:     999,
 		}
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", corrID, "ingest", "{}", "{}"))
 		err = db.SetArchived(fileInfo, fileID, corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Archived")
 		}
 
-		err = db.SetVerified(fileInfo, fileID, corrID)
+		err = db.SetVerified(fileInfo, fileID, "archived", corrID)
 		if err != nil {
 			suite.FailNow("failed to mark file as Verified")
 		}
+		if i == 0 {
+			assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "verified", corrID, "verify", "{}", "{}"))
+		}
 
 		stableID := fmt.Sprintf("accession_%s_0%d", "User-Q", i)
 		err = db.SetAccessionID(stableID, fileID)
@@ -1200,9 +1645,25 @@ func (suite *DatabaseTests) TestGetDsatasetFiles() {
 		suite.FailNow("failed to map files to dataset")
 	}
 
-	accessions, err := db.GetDatasetFiles(dID)
+	files, err := db.GetDatasetFiles(dID)
 	assert.NoError(suite.T(), err, "failed to get accessions for a dataset")
+	var accessions []string
+	for _, f := range files {
+		accessions = append(accessions, f.AccessionID)
+	}
 	assert.Equal(suite.T(), []string{"accession_User-Q_00", "accession_User-Q_01", "accession_User-Q_02"}, accessions)
+	assert.Equal(suite.T(), "/User-Q/TestGetDsatasetFiles-000.c4gh", files[0].InboxPath)
+	assert.Equal(suite.T(), files[0].InboxPath, files[0].ArchivePath)
+	assert.Equal(suite.T(), int64(1234), files[0].ArchiveSize)
+	assert.Equal(suite.T(), int64(999), files[0].DecryptedSize)
+	assert.Equal(suite.T(), "verified", files[0].Status)
+	assert.True(suite.T(), files[0].Verified)
+	assert.Equal(suite.T(), "uploaded", files[1].Status)
+	assert.False(suite.T(), files[1].Verified)
+
+	files, err = db.GetDatasetFiles("unknown-dataset")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), files)
 }
 
 func (suite *DatabaseTests) TestGetInboxFilePathFromID() {
@@ -1223,8 +1684,1291 @@ func (suite *DatabaseTests) TestGetInboxFilePathFromID() {
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), path, filePath)
 
-	err = db.UpdateFileEventLog(fileID, "archived", fileID, user, "{}", "{}")
+	err = db.UpdateFileEventLog(fileID, "submitted", fileID, user, "{}", "{}")
 	assert.NoError(suite.T(), err)
 	_, err = db.getInboxFilePathFromID(user, fileID)
 	assert.Error(suite.T(), err)
 }
+
+func (suite *DatabaseTests) TestProjects() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	assert.NoError(suite.T(), db.UpdateUserInfo("project-user", "Project User", "project@example.org", []string{"project-a"}))
+	fileID, err := db.RegisterFile("/project-user/file1.c4gh", "project-user")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+	assert.NoError(suite.T(), db.SetAccessionID("project-file-01", fileID))
+	assert.NoError(suite.T(), db.MapFilesToDataset("project-dataset", []string{"project-file-01"}))
+
+	project, err := db.GetFileProject("project-file-01")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "project-a", project)
+
+	project, err = db.GetSubmissionFileProject("project-user", "/project-user/file1.c4gh")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "project-a", project)
+	project, err = db.GetFileProjectByID("project-user", fileID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "project-a", project)
+	_, err = db.GetSubmissionFileProject("other-user", "/project-user/file1.c4gh")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+
+	projects, err := db.GetUserProjects("project-user")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"project-a"}, projects)
+
+	projects, err = db.GetDatasetProjects("project-dataset")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"project-a"}, projects)
+
+	// users without a single group get files without a project
+	fileID, err = db.RegisterFile("/other-user/file1.c4gh", "other-user")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+	assert.NoError(suite.T(), db.SetAccessionID("project-file-02", fileID))
+	project, err = db.GetFileProject("project-file-02")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", project)
+
+	assert.NoError(suite.T(), db.AddProjectAdmin("project-a", "admin", "root"))
+	assert.NoError(suite.T(), db.AddProjectAdmin("project-a", "admin", "root"), "adding an admin twice should not fail")
+	projects, err = db.GetAdminProjects("admin")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"project-a"}, projects)
+
+	admins, err := db.ListProjectAdmins("project-a")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"admin"}, admins)
+
+	assert.NoError(suite.T(), db.RemoveProjectAdmin("project-a", "admin"))
+	assert.EqualError(suite.T(), db.RemoveProjectAdmin("project-a", "admin"), "admin is not an admin of project project-a")
+}
+
+func (suite *DatabaseTests) TestSubmissionFreeze() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	assert.NoError(suite.T(), db.UpdateUserInfo("frozen-user", "Frozen User", "frozen@example.org", []string{"project-freeze"}))
+
+	freeze, err := db.GetSubmissionFreeze("frozen-user")
+	assert.NoError(suite.T(), err)
+	assert.Nil(suite.T(), freeze)
+
+	assert.Error(suite.T(), db.FreezeSubmission("dataset", "frozen-user", "", "admin"), "unknown scope should fail")
+
+	// freeze on project level
+	assert.NoError(suite.T(), db.FreezeSubmission("project", "project-freeze", "pending agreement", "admin"))
+	assert.EqualError(suite.T(), db.FreezeSubmission("project", "project-freeze", "", "admin"), "submissions already frozen")
+
+	freeze, err = db.GetSubmissionFreeze("frozen-user")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "project", freeze.Scope)
+	assert.Equal(suite.T(), "admin", freeze.FrozenBy)
+	assert.Equal(suite.T(), "submissions for project project-freeze are frozen: pending agreement", freeze.Message())
+
+	// other users are not affected
+	freeze, err = db.GetSubmissionFreeze("other-user")
+	assert.NoError(suite.T(), err)
+	assert.Nil(suite.T(), freeze)
+
+	freezes, err := db.ListSubmissionFreezes()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(freezes))
+
+	assert.NoError(suite.T(), db.UnfreezeSubmission("project", "project-freeze", "admin"))
+	assert.EqualError(suite.T(), db.UnfreezeSubmission("project", "project-freeze", "admin"), "no active freeze found")
+
+	freeze, err = db.GetSubmissionFreeze("frozen-user")
+	assert.NoError(suite.T(), err)
+	assert.Nil(suite.T(), freeze)
+
+	// the lifted freeze is kept for auditing
+	var lifted string
+	err = db.DB.QueryRow("SELECT lifted_by FROM sda.submission_freeze WHERE scope = 'project' AND name = 'project-freeze';").Scan(&lifted)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "admin", lifted)
+}
+
+func (suite *DatabaseTests) TestGetFileDatasetsAndStatus() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/UserY/TestGetFileDatasets.c4gh", "UserY")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	err = db.UpdateFileEventLog(fileID, "uploaded", fileID, "UserY", "{}", "{}")
+	if err != nil {
+		suite.FailNow("Failed to update file event log")
+	}
+	err = db.SetAccessionID("accession_UserY_01", fileID)
+	if err != nil {
+		suite.FailNow("Failed to set accession ID")
+	}
+
+	datasets, err := db.GetFileDatasets("accession_UserY_01")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{}, datasets)
+
+	for _, dID := range []string{"test-file-datasets-02", "test-file-datasets-01"} {
+		if err := db.MapFilesToDataset(dID, []string{"accession_UserY_01"}); err != nil {
+			suite.FailNow("failed to map file to dataset")
+		}
+	}
+
+	datasets, err = db.GetFileDatasets("accession_UserY_01")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"test-file-datasets-01", "test-file-datasets-02"}, datasets)
+
+	status, err := db.GetFileStatusByStableID("accession_UserY_01")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "uploaded", status)
+
+	_, err = db.GetFileStatusByStableID("accession_UserY_99")
+	assert.Error(suite.T(), err)
+}
+
+func (suite *DatabaseTests) TestUserQuota() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "quota-user"
+	userQuota, err := db.GetUserQuota(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), UserQuota{User: user}, userQuota)
+	assert.False(suite.T(), userQuota.Exceeded(), "no quota should never be exceeded")
+
+	// one file still in the inbox, one archived and one disabled
+	sizes := []int64{100, 200, 400}
+	fileIDs := []string{}
+	for i, size := range sizes {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/%s/quota-file-%d.c4gh", user, i), user)
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		assert.NoError(suite.T(), db.SetSubmissionFileSize(fileID, size))
+		fileIDs = append(fileIDs, fileID)
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[1], "submitted", fileIDs[1], "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(FileInfo{Checksum: "123", Size: 150, Path: fileIDs[1]}, fileIDs[1], fileIDs[1]))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[2], "disabled", fileIDs[2], user, "{}", "{}"))
+
+	assert.NoError(suite.T(), db.SetUserQuota(user, 200, "admin"))
+	assert.Error(suite.T(), db.SetUserQuota(user, -1, "admin"))
+
+	userQuota, err = db.GetUserQuota(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(200), userQuota.Quota)
+	assert.Equal(suite.T(), int64(300), userQuota.Uploaded)
+	assert.Equal(suite.T(), int64(150), userQuota.Archived)
+	assert.Equal(suite.T(), int64(250), userQuota.Used)
+	assert.True(suite.T(), userQuota.Exceeded())
+
+	// raising the quota lifts the block
+	assert.NoError(suite.T(), db.SetUserQuota(user, 1000, "admin"))
+	userQuota, err = db.GetUserQuota(user)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), userQuota.Exceeded())
+
+	assert.Error(suite.T(), db.SetSubmissionFileSize("00000000-0000-0000-0000-000000000000", 10))
+}
+
+func (suite *DatabaseTests) TestQuotaWarning() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "warned-user"
+	fileID, err := db.RegisterFile(fmt.Sprintf("/%s/quota-file.c4gh", user), user)
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.NoError(suite.T(), db.SetSubmissionFileSize(fileID, 850))
+
+	assert.EqualError(suite.T(), db.SetQuotaWarning(user, 80), "no quota set for user warned-user")
+
+	assert.NoError(suite.T(), db.SetUserQuota(user, 1000, "admin"))
+	userQuota, err := db.GetUserQuota(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, userQuota.Warned)
+	assert.Equal(suite.T(), 85.0, userQuota.UsagePercent())
+	assert.Equal(suite.T(), 80, userQuota.WarningThreshold([]int{95, 80}))
+	assert.Equal(suite.T(), 0, userQuota.WarningThreshold([]int{90}))
+
+	assert.NoError(suite.T(), db.SetQuotaWarning(user, 80))
+	userQuota, err = db.GetUserQuota(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 80, userQuota.Warned)
+}
+
+func (suite *DatabaseTests) TestUploadSession() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "session-user"
+	_, err = db.GetUploadSession("session-01")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+
+	fileIDs := []string{}
+	for i := 0; i < 3; i++ {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/%s/session-file-%d.c4gh", user, i), user)
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		assert.NoError(suite.T(), db.AddFileToUploadSession(fileID, "session-01", user))
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "uploaded", fileID, user, "{}", "{}"))
+		fileIDs = append(fileIDs, fileID)
+	}
+
+	// one file in a dataset, one archived and one failed
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[0], "submitted", fileIDs[0], user, "{}", "{}"))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[0], "archived", fileIDs[0], user, "{}", "{}"))
+	assert.NoError(suite.T(), db.SetAccessionID("session-accession-01", fileIDs[0]))
+	assert.NoError(suite.T(), db.MapFilesToDataset("session-dataset-01", []string{"session-accession-01"}))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[1], "submitted", fileIDs[1], user, "{}", "{}"))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[1], "archived", fileIDs[1], user, "{}", "{}"))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[2], "error", fileIDs[2], user, "{}", "{}"))
+
+	session, err := db.GetUploadSession("session-01")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), user, session.User)
+	assert.Equal(suite.T(), 3, len(session.Files))
+	assert.Equal(suite.T(), 3, session.Uploaded)
+	assert.Equal(suite.T(), 2, session.Ingested)
+	assert.Equal(suite.T(), 1, session.Failed)
+	assert.Equal(suite.T(), 1, session.Accessioned)
+	assert.Equal(suite.T(), []string{"session-dataset-01"}, session.Datasets)
+	assert.Equal(suite.T(), "session-accession-01", session.Files[0].AccessionID)
+	assert.Equal(suite.T(), "session-dataset-01", session.Files[0].DatasetID)
+
+	// sessions belong to a single user
+	fileID, err := db.RegisterFile("/other-user/session-file.c4gh", "other-user")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.EqualError(suite.T(), db.AddFileToUploadSession(fileID, "session-01", "other-user"), "upload session session-01 belongs to another user")
+}
+
+func (suite *DatabaseTests) TestMintDatasetID() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	first, err := db.MintDatasetID("mint-", 6)
+	assert.NoError(suite.T(), err)
+	assert.Regexp(suite.T(), `^mint-\d{6}$`, first)
+
+	// IDs already in use are skipped
+	var next int
+	assert.NoError(suite.T(), db.DB.QueryRow("SELECT last_value FROM sda.dataset_stable_id_seq;").Scan(&next))
+	taken := fmt.Sprintf("mint-%06d", next+1)
+	fileID, err := db.RegisterFile("/mint-user/file.c4gh", "mint-user")
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), db.SetAccessionID("mint-accession", fileID))
+	assert.NoError(suite.T(), db.MapFilesToDataset(taken, []string{"mint-accession"}))
+
+	second, err := db.MintDatasetID("mint-", 6)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), fmt.Sprintf("mint-%06d", next+2), second)
+}
+
+func (suite *DatabaseTests) TestFileAccessGrants() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	for i := 0; i < 2; i++ {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/UserG/grant-file-%d.c4gh", i), "UserG")
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		if err := db.SetAccessionID(fmt.Sprintf("accession_UserG_0%d", i), fileID); err != nil {
+			suite.FailNow("Failed to set accession ID")
+		}
+	}
+
+	assert.EqualError(suite.T(), db.GrantFileAccess("requester", []string{"accession_UserG_00", "accession_UserG_99"}, "admin"), "accession ID accession_UserG_99 not found")
+	grants, err := db.ListFileGrants("requester")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, len(grants), "failed grant should be rolled back")
+
+	assert.NoError(suite.T(), db.GrantFileAccess("requester", []string{"accession_UserG_00", "accession_UserG_01"}, "admin"))
+	// granting twice is a no-op
+	assert.NoError(suite.T(), db.GrantFileAccess("requester", []string{"accession_UserG_00"}, "admin"))
+
+	grants, err = db.ListFileGrants("requester")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(grants))
+	assert.Equal(suite.T(), "accession_UserG_00", grants[0].AccessionID)
+	assert.Equal(suite.T(), "admin", grants[0].GrantedBy)
+
+	assert.NoError(suite.T(), db.RevokeFileAccess("requester", "accession_UserG_00", "admin"))
+	assert.EqualError(suite.T(), db.RevokeFileAccess("requester", "accession_UserG_00", "admin"), "no active grant found")
+
+	grants, err = db.ListFileGrants("requester")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(grants))
+	assert.Equal(suite.T(), "accession_UserG_01", grants[0].AccessionID)
+}
+
+func (suite *DatabaseTests) TestReplicas() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/UserR/replica-file.c4gh", "UserR")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	if err := db.SetAccessionID("accession_UserR_00", fileID); err != nil {
+		suite.FailNow("Failed to set accession ID")
+	}
+
+	assert.EqualError(suite.T(), db.RegisterReplicas([]Replica{
+		{AccessionID: "accession_UserR_00", Service: "tape", Location: "/tape/00"},
+		{AccessionID: "accession_UserR_99", Service: "tape", Location: "/tape/99"},
+	}, "admin"), "accession ID accession_UserR_99 not found")
+	replicas, err := db.GetFileReplicas("accession_UserR_00")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, len(replicas), "failed registration should be rolled back")
+
+	assert.NoError(suite.T(), db.RegisterReplicas([]Replica{
+		{AccessionID: "accession_UserR_00", Service: "tape", Location: "/tape/00"},
+		{AccessionID: "accession_UserR_00", Service: "cloud", Location: "s3://bucket/00", Checksum: "abc123", ChecksumType: "sha256"},
+	}, "admin"))
+	// registering again at the same service replaces the record
+	assert.NoError(suite.T(), db.RegisterReplicas([]Replica{{AccessionID: "accession_UserR_00", Service: "tape", Location: "/tape/01"}}, "other-admin"))
+
+	replicas, err = db.GetFileReplicas("accession_UserR_00")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(replicas))
+	assert.Equal(suite.T(), "cloud", replicas[0].Service)
+	assert.Equal(suite.T(), "abc123", replicas[0].Checksum)
+	assert.Equal(suite.T(), "sha256", replicas[0].ChecksumType)
+	assert.Equal(suite.T(), "/tape/01", replicas[1].Location)
+	assert.Empty(suite.T(), replicas[1].Checksum)
+	assert.Equal(suite.T(), "other-admin", replicas[1].RegisteredBy)
+
+	assert.NoError(suite.T(), db.RemoveReplica("tape", "accession_UserR_00"))
+	assert.EqualError(suite.T(), db.RemoveReplica("tape", "accession_UserR_00"), "no replica of accession_UserR_00 found at tape")
+
+	replicas, err = db.GetFileReplicas("accession_UserR_00")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(replicas))
+}
+
+func (suite *DatabaseTests) TestExpectedFiles() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "UserExpected"
+	assert.NoError(suite.T(), db.RegisterExpectedFiles(user, []ExpectedFile{
+		{FilePath: "/UserExpected/arrived.c4gh", Size: 100, Checksum: "ABC123", ChecksumType: "sha256"},
+		{FilePath: "/UserExpected/resized.c4gh", Size: 100},
+		{FilePath: "/UserExpected/missing.c4gh"},
+		{FilePath: "/UserExpected/removed.c4gh"},
+	}, "portal"))
+	assert.NoError(suite.T(), db.RemoveExpectedFile(user, "/UserExpected/removed.c4gh"))
+	assert.EqualError(suite.T(), db.RemoveExpectedFile(user, "/UserExpected/removed.c4gh"), "no expected file /UserExpected/removed.c4gh found for UserExpected")
+
+	arrived, err := db.RegisterFile("/UserExpected/arrived.c4gh", user)
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.NoError(suite.T(), db.SetSubmissionFileSize(arrived, 100))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(arrived, "submitted", arrived, "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(FileInfo{Checksum: "abc123", Size: 80, Path: arrived}, arrived, arrived))
+	resized, err := db.RegisterFile("/UserExpected/resized.c4gh", user)
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.NoError(suite.T(), db.SetSubmissionFileSize(resized, 200))
+	if _, err := db.RegisterFile("/UserExpected/extra.c4gh", user); err != nil {
+		suite.FailNow("Failed to register file")
+	}
+
+	status, err := db.GetSubmissionStatus(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3, status.Expected)
+	assert.Equal(suite.T(), 1, status.Arrived)
+	assert.InDelta(suite.T(), 33.33, status.Completeness(), 0.01)
+	assert.Equal(suite.T(), []string{"/UserExpected/extra.c4gh"}, status.Unexpected)
+	assert.Equal(suite.T(), "arrived", status.Files[0].Status)
+	assert.Equal(suite.T(), arrived, status.Files[0].FileID)
+	assert.Equal(suite.T(), "sha256", status.Files[0].ChecksumType)
+	assert.Equal(suite.T(), "missing", status.Files[1].Status)
+	assert.Equal(suite.T(), "mismatch", status.Files[2].Status)
+
+	// nothing is overdue until the reminder delay has passed
+	overdue, err := db.GetOverdueExpectedFiles(time.Hour)
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), overdue)
+
+	_, err = db.DB.Exec("UPDATE sda.expected_files SET registered_at = now() - interval '2 hours' WHERE submission_user = $1;", user)
+	assert.NoError(suite.T(), err)
+	overdue, err = db.GetOverdueExpectedFiles(time.Hour)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []MissingFiles{{User: user, FilePaths: []string{"/UserExpected/missing.c4gh"}}}, overdue)
+
+	assert.NoError(suite.T(), db.SetExpectedFilesReminded(user, overdue[0].FilePaths))
+	overdue, err = db.GetOverdueExpectedFiles(time.Hour)
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), overdue)
+
+	status, err = db.GetSubmissionStatus("UserWithoutExpectations")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, status.Expected)
+	assert.Equal(suite.T(), 100.0, status.Completeness())
+}
+
+func (suite *DatabaseTests) TestSetFileDeleted() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "UserDeleted"
+	fileID, err := db.RegisterFile("/UserDeleted/deleted.c4gh", user)
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "uploaded", fileID, user, "{}", "{}"))
+	if _, err := db.RegisterFile("/UserDeleted/kept.c4gh", user); err != nil {
+		suite.FailNow("Failed to register file")
+	}
+
+	assert.NoError(suite.T(), db.SetFileDeleted(fileID, "admin"))
+	assert.EqualError(suite.T(), db.SetFileDeleted(fileID, "admin"), fmt.Sprintf("file %s not found or already deleted", fileID))
+
+	files, err := db.GetUserFiles(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(files))
+	assert.Equal(suite.T(), "/UserDeleted/kept.c4gh", files[0].InboxPath)
+	total, err := db.CountUserFiles(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, total)
+
+	// the records are kept for the audit trail
+	status, err := db.GetFileStatus(fileID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "disabled", status)
+	var deleted bool
+	assert.NoError(suite.T(), db.DB.QueryRow("SELECT deleted_at IS NOT NULL FROM sda.files WHERE id = $1;", fileID).Scan(&deleted))
+	assert.True(suite.T(), deleted)
+}
+
+func (suite *DatabaseTests) TestCorrelationIDs() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	var fileIDs []string
+	for _, name := range []string{"consistent", "conflicting", "missing"} {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/UserC/%s.c4gh", name), "UserC")
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[0], "uploaded", fileIDs[0], "UserC", "{}", "{}"))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[0], "submitted", fileIDs[0], "UserC", "{}", "{}"))
+
+	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[1], "uploaded", corrID, "UserC", "{}", "{}"))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[1], "submitted", fileIDs[1], "UserC", "{}", "{}"))
+
+	_, err = db.DB.Exec("INSERT INTO sda.file_event_log(file_id, event, user_id) VALUES($1, 'uploaded', 'UserC');", fileIDs[2])
+	assert.NoError(suite.T(), err)
+
+	issues, err := db.CheckCorrelationIDs(10)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(issues))
+	assert.Equal(suite.T(), "/UserC/conflicting.c4gh", issues[0].FilePath)
+	assert.Equal(suite.T(), corrID, issues[0].CorrelationID)
+	assert.Equal(suite.T(), []string{fileIDs[1]}, issues[0].Conflicting)
+	assert.Equal(suite.T(), 0, issues[0].Missing)
+	assert.Equal(suite.T(), "/UserC/missing.c4gh", issues[1].FilePath)
+	assert.Equal(suite.T(), fileIDs[2], issues[1].CorrelationID, "file ID should be used when no event has a correlation ID")
+	assert.Equal(suite.T(), 1, issues[1].Missing)
+	assert.Empty(suite.T(), issues[1].Conflicting)
+
+	issues, err = db.CheckCorrelationIDs(1)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(issues))
+
+	updated, err := db.BackfillCorrelationIDs()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), updated)
+
+	issues, err = db.CheckCorrelationIDs(10)
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), issues)
+	fileID, err := db.GetFileID(corrID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), fileIDs[1], fileID)
+}
+
+func (suite *DatabaseTests) TestWithTransaction() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/UserT/transaction.c4gh", "UserT")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	// the file is verified before it is finalized
+	for _, status := range []string{"submitted", "archived", "verified"} {
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, status, fileID, "UserT", "{}", "{}"))
+	}
+	corrID := uuid.New().String()
+
+	// a failing step rolls back the ones before it
+	assert.Error(suite.T(), db.WithTransaction(func(tx *Tx) error {
+		if err := tx.SetAccessionID("accession_UserT_00", fileID); err != nil {
+			return err
+		}
+
+		return tx.UpdateFileEventLog(fileID, "no such event", corrID, "finalize", "{}", "{}")
+	}))
+	exists, err := db.CheckAccessionIDExists("accession_UserT_00", fileID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", exists)
+
+	assert.Panics(suite.T(), func() {
+		_ = db.WithTransaction(func(tx *Tx) error {
+			_ = tx.SetAccessionID("accession_UserT_00", fileID)
+
+			panic("failure")
+		})
+	})
+	exists, err = db.CheckAccessionIDExists("accession_UserT_00", fileID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", exists)
+
+	assert.NoError(suite.T(), db.WithTransaction(func(tx *Tx) error {
+		if err := tx.SetAccessionID("accession_UserT_00", fileID); err != nil {
+			return err
+		}
+
+		return tx.UpdateFileEventLog(fileID, "ready", corrID, "finalize", "{}", "{}")
+	}))
+	exists, err = db.CheckAccessionIDExists("accession_UserT_00", fileID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "same", exists)
+	status, err := db.GetFileStatus(corrID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "ready", status)
+
+	// the dataset is not created when a file can not be mapped
+	assert.Error(suite.T(), db.WithTransaction(func(tx *Tx) error {
+		if err := tx.MapFilesToDataset("transaction-dataset", []string{"accession_UserT_00", "accession_UserT_99"}); err != nil {
+			return err
+		}
+
+		return tx.UpdateDatasetEvent("transaction-dataset", "registered", "{}")
+	}))
+	_, err = db.GetDatasetStatus("transaction-dataset")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+
+	assert.NoError(suite.T(), db.WithTransaction(func(tx *Tx) error {
+		if err := tx.MapFilesToDataset("transaction-dataset", []string{"accession_UserT_00"}); err != nil {
+			return err
+		}
+
+		return tx.UpdateDatasetEvent("transaction-dataset", "registered", "{}")
+	}))
+	status, err = db.GetDatasetStatus("transaction-dataset")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "registered", status)
+}
+
+func (suite *DatabaseTests) TestSubscribe() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	sub, err := db.Subscribe(FileEventsChannel, DatasetEventsChannel)
+	if err != nil {
+		suite.FailNow("failed to subscribe to events", err)
+	}
+	defer sub.Close()
+
+	next := func() Event {
+		select {
+		case e := <-sub.Events():
+			return e
+		case <-time.After(5 * time.Second):
+			suite.FailNow("no event received")
+		}
+
+		return Event{}
+	}
+
+	fileID, err := db.RegisterFile("/UserE/event.c4gh", "UserE")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	e := next()
+	assert.Equal(suite.T(), FileEventsChannel, e.Channel)
+	assert.Equal(suite.T(), fileID, e.FileID)
+	assert.Equal(suite.T(), "registered", e.Event)
+	assert.Equal(suite.T(), "UserE", e.User)
+	assert.NotEmpty(suite.T(), e.Timestamp)
+
+	corrID := uuid.New().String()
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "uploaded", corrID, "inbox", "{}", "{}"))
+	e = next()
+	assert.Equal(suite.T(), "uploaded", e.Event)
+	assert.Equal(suite.T(), corrID, e.CorrelationID)
+
+	assert.NoError(suite.T(), db.SetAccessionID("accession_UserE_00", fileID))
+	assert.NoError(suite.T(), db.MapFilesToDataset("event-dataset", []string{"accession_UserE_00"}))
+	assert.NoError(suite.T(), db.UpdateDatasetEvent("event-dataset", "registered", "{}"))
+	e = next()
+	assert.Equal(suite.T(), DatasetEventsChannel, e.Channel)
+	assert.Equal(suite.T(), "event-dataset", e.DatasetID)
+	assert.Equal(suite.T(), "registered", e.Event)
+
+	// events in rolled back transactions are never announced
+	assert.Error(suite.T(), db.WithTransaction(func(tx *Tx) error {
+		if err := tx.UpdateFileEventLog(fileID, "submitted", corrID, "UserE", "{}", "{}"); err != nil {
+			return err
+		}
+
+		return errors.New("failure")
+	}))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "disabled", corrID, "admin", "{}", "{}"))
+	assert.Equal(suite.T(), "disabled", next().Event)
+
+	assert.NoError(suite.T(), sub.Close())
+	_, open := <-sub.Events()
+	assert.False(suite.T(), open, "events should be closed with the subscriber")
+}
+
+func (suite *DatabaseTests) TestDeletionRequests() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "UserDeletionRequest"
+	fileID, err := db.RegisterFile("/UserDeletionRequest/wrong.c4gh", user)
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "uploaded", fileID, user, "{}", "{}"))
+	archivedID, err := db.RegisterFile("/UserDeletionRequest/archived.c4gh", user)
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(archivedID, "submitted", archivedID, user, "{}", "{}"))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(archivedID, "archived", archivedID, user, "{}", "{}"))
+
+	// only the owner can request deletion of files in the inbox
+	_, err = db.RequestDeletion(fileID, "OtherUser", "")
+	assert.EqualError(suite.T(), err, fmt.Sprintf("file %s not found in the inbox", fileID))
+	_, err = db.RequestDeletion(archivedID, user, "")
+	assert.EqualError(suite.T(), err, fmt.Sprintf("file %s not found in the inbox", archivedID))
+
+	id, err := db.RequestDeletion(fileID, user, "uploaded the wrong file")
+	assert.NoError(suite.T(), err)
+	_, err = db.RequestDeletion(fileID, user, "")
+	assert.EqualError(suite.T(), err, "deletion already requested")
+
+	requests, err := db.ListDeletionRequests(user, "pending")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(requests))
+	assert.Equal(suite.T(), id, requests[0].ID)
+	assert.Equal(suite.T(), fileID, requests[0].FileID)
+	assert.Equal(suite.T(), "/UserDeletionRequest/wrong.c4gh", requests[0].FilePath)
+	assert.Equal(suite.T(), "uploaded the wrong file", requests[0].Reason)
+	assert.Empty(suite.T(), requests[0].ReviewedAt)
+
+	request, err := db.GetDeletionRequest(id)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "pending", request.Status)
+	assert.Equal(suite.T(), user, request.User)
+	_, err = db.GetDeletionRequest(id + 100)
+	assert.EqualError(suite.T(), err, "deletion request not found")
+
+	request, err = db.ReviewDeletionRequest(id, false, "admin", "file is needed")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "rejected", request.Status)
+	assert.Equal(suite.T(), "admin", request.ReviewedBy)
+	assert.Equal(suite.T(), "file is needed", request.ReviewReason)
+	assert.NotEmpty(suite.T(), request.ReviewedAt)
+	_, err = db.ReviewDeletionRequest(id, true, "admin", "")
+	assert.EqualError(suite.T(), err, "no pending deletion request")
+
+	// a rejected request does not block a new one
+	id, err = db.RequestDeletion(fileID, user, "")
+	assert.NoError(suite.T(), err)
+	request, err = db.ReviewDeletionRequest(id, true, "admin", "")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "approved", request.Status)
+	assert.Equal(suite.T(), user, request.User)
+
+	requests, err = db.ListDeletionRequests("", "")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(requests))
+	requests, err = db.ListDeletionRequests("", "pending")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), requests)
+}
+
+func (suite *DatabaseTests) TestMetadata() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/testuser/TestMetadata.c4gh", "testuser")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	if err := db.SetAccessionID("accession_TestMetadata", fileID); err != nil {
+		suite.FailNow("failed to set stable ID")
+	}
+	if err := db.MapFilesToDataset("test-metadata-01", []string{"accession_TestMetadata"}); err != nil {
+		suite.FailNow("failed to map files to dataset")
+	}
+
+	metadata, err := db.GetFileMetadata("accession_TestMetadata")
+	assert.NoError(suite.T(), err)
+	assert.JSONEq(suite.T(), "{}", string(metadata))
+
+	assert.NoError(suite.T(), db.SetFileMetadata("accession_TestMetadata", []byte(`{"instrument": "NovaSeq", "samples": ["S1", "S2"]}`)))
+	metadata, err = db.GetFileMetadata("accession_TestMetadata")
+	assert.NoError(suite.T(), err)
+	assert.JSONEq(suite.T(), `{"instrument": "NovaSeq", "samples": ["S1", "S2"]}`, string(metadata))
+
+	assert.NoError(suite.T(), db.SetDatasetMetadata("test-metadata-01", []byte(`{"study": "S-01"}`)))
+	metadata, err = db.GetDatasetMetadata("test-metadata-01")
+	assert.NoError(suite.T(), err)
+	assert.JSONEq(suite.T(), `{"study": "S-01"}`, string(metadata))
+
+	assert.EqualError(suite.T(), db.SetFileMetadata("accession_TestMetadata", []byte(`["not", "an", "object"]`)), "metadata must be a JSON object")
+	assert.EqualError(suite.T(), db.SetDatasetMetadata("test-metadata-01", []byte(`{"broken"`)), "metadata must be a JSON object")
+	assert.ErrorIs(suite.T(), db.SetFileMetadata("unknown-accession", []byte(`{}`)), sql.ErrNoRows)
+	_, err = db.GetDatasetMetadata("unknown-dataset")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+}
+
+func (suite *DatabaseTests) TestFlagDuplicateSubmission() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "TestFlagDuplicateSubmission"
+	fileInfo := FileInfo{Checksum: "abc", Size: 1234, DecryptedChecksum: "c0ffee", DecryptedSize: 999}
+	var fileIDs []string
+	for _, name := range []string{"first", "second"} {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/%s/%s.c4gh", user, name), user)
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		fileInfo.Path = fileID
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "submitted", fileID, "ingest", "{}", "{}"))
+		assert.NoError(suite.T(), db.SetArchived(fileInfo, fileID, fileID))
+		fileIDs = append(fileIDs, fileID)
+	}
+	other, err := db.RegisterFile("/OtherUser/first.c4gh", "OtherUser")
+	if err != nil {
+		suite.FailNow("Failed to register file")
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(other, "submitted", other, "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(fileInfo, other, other))
+	assert.NoError(suite.T(), db.SetVerified(fileInfo, other, "archived", other))
+
+	// files of other users are not duplicates
+	duplicates, err := db.FlagDuplicateSubmission(fileIDs[0], fileInfo.DecryptedChecksum, fileIDs[0])
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), duplicates)
+	assert.NoError(suite.T(), db.SetVerified(fileInfo, fileIDs[0], "archived", fileIDs[0]))
+
+	duplicates, err = db.FlagDuplicateSubmission(fileIDs[1], fileInfo.DecryptedChecksum, fileIDs[1])
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{fileIDs[0]}, duplicates)
+	assert.NoError(suite.T(), db.SetVerified(fileInfo, fileIDs[1], "duplicate", fileIDs[1]))
+
+	events, err := db.GetFileEvents(fileIDs[1])
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "duplicate", events[len(events)-2].Event)
+	assert.JSONEq(suite.T(), fmt.Sprintf(`{"duplicateOf": ["%s"]}`, fileIDs[0]), events[len(events)-2].Details)
+	status, err := db.GetFileStatus(fileIDs[1])
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "verified", status)
+
+	files, err := db.GetUserFiles(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(files))
+	for i, f := range files {
+		assert.Equal(suite.T(), []string{fileIDs[1-i]}, f.DuplicateOf)
+	}
+}
+
+func (suite *DatabaseTests) TestPurgeEvents() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	var fileIDs []string
+	for _, name := range []string{"kept", "purged"} {
+		fileID, err := db.RegisterFile("/TestPurgeEvents/"+name+".c4gh", "TestPurgeEvents")
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "uploaded", fileID, "TestPurgeEvents", "{}", "{}"))
+		fileIDs = append(fileIDs, fileID)
+	}
+	_, err = db.DB.Exec("UPDATE sda.file_event_log SET started_at = now() - interval '10 years' WHERE file_id = ANY($1::UUID[]);", pq.Array(fileIDs))
+	assert.NoError(suite.T(), err)
+
+	_, err = db.PurgeEvents(0, true)
+	assert.Error(suite.T(), err)
+
+	// events newer than the retention are left alone
+	purged, err := db.PurgeEvents(20*365*24*time.Hour, false)
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), purged)
+
+	purged, err = db.PurgeEvents(5*365*24*time.Hour, true)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), purged)
+	events, err := db.GetFileEvents(fileIDs[0])
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(events))
+	assert.Equal(suite.T(), "uploaded", events[0].Event)
+	status, err := db.GetFileStatus(fileIDs[0])
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "uploaded", status)
+
+	purged, err = db.PurgeEvents(5*365*24*time.Hour, false)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), purged)
+	events, err = db.GetFileEvents(fileIDs[1])
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), events)
+}
+
+func (suite *DatabaseTests) TestUserUsage() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	user := "usage-user"
+	// one file still in the inbox, two archived of which one is in a
+	// dataset, and one disabled
+	sizes := []int64{100, 200, 300, 400}
+	fileIDs := []string{}
+	for i, size := range sizes {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/%s/usage-file-%d.c4gh", user, i), user)
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		assert.NoError(suite.T(), db.SetSubmissionFileSize(fileID, size))
+		fileIDs = append(fileIDs, fileID)
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[1], "submitted", fileIDs[1], "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(FileInfo{Checksum: "123", Size: 150, Path: fileIDs[1]}, fileIDs[1], fileIDs[1]))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[2], "submitted", fileIDs[2], "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(FileInfo{Checksum: "456", Size: 250, Path: fileIDs[2]}, fileIDs[2], fileIDs[2]))
+	assert.NoError(suite.T(), db.SetAccessionID("accession-usage-user", fileIDs[2]))
+	assert.NoError(suite.T(), db.MapFilesToDataset("dataset-usage-user", []string{"accession-usage-user"}))
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[3], "disabled", fileIDs[3], user, "{}", "{}"))
+
+	want := UserUsage{
+		User:          user,
+		UploadedFiles: 3,
+		UploadedBytes: 600,
+		ArchivedFiles: 2,
+		ArchivedBytes: 400,
+		DatasetFiles:  1,
+		DatasetBytes:  250,
+	}
+	usage, err := db.ComputeUserUsage(user)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), want, usage)
+
+	users, err := db.SummariseUserUsage()
+	assert.NoError(suite.T(), err)
+	assert.GreaterOrEqual(suite.T(), users, int64(1))
+
+	summaries, err := db.GetUserUsageSummaries()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int(users), len(summaries))
+	for _, s := range summaries {
+		if s.User != user {
+			continue
+		}
+		assert.NotEmpty(suite.T(), s.SummarisedAt)
+		s.SummarisedAt = ""
+		assert.Equal(suite.T(), want, s)
+	}
+}
+
+func (suite *DatabaseTests) TestRefreshStats() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	// one file still in the inbox, one archived and mapped to a released
+	// dataset, and one deleted
+	fileIDs := []string{}
+	for i, size := range []int64{100, 200, 300} {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/stats-user/stats-file-%d.c4gh", i), "stats-user")
+		if err != nil {
+			suite.FailNow("Failed to register file")
+		}
+		assert.NoError(suite.T(), db.SetSubmissionFileSize(fileID, size))
+		fileIDs = append(fileIDs, fileID)
+	}
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileIDs[1], "submitted", fileIDs[1], "ingest", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetArchived(FileInfo{Checksum: "123", Size: 150, Path: fileIDs[1]}, fileIDs[1], fileIDs[1]))
+	assert.NoError(suite.T(), db.SetAccessionID("accession-stats", fileIDs[1]))
+	assert.NoError(suite.T(), db.MapFilesToDataset("dataset-stats", []string{"accession-stats"}))
+	assert.NoError(suite.T(), db.UpdateDatasetEvent("dataset-stats", "released", "{}"))
+	assert.NoError(suite.T(), db.SetFileDeleted(fileIDs[2], "admin"))
+
+	assert.NoError(suite.T(), db.RefreshStats())
+	stats, err := db.GetStats()
+	assert.NoError(suite.T(), err)
+	assert.NotEmpty(suite.T(), stats.SummarisedAt)
+	assert.Equal(suite.T(), []FileStats{
+		{Status: "archived", Files: 1, UploadedBytes: 200, ArchivedBytes: 150},
+		{Status: "registered", Files: 1, UploadedBytes: 100, ArchivedBytes: 0},
+	}, stats.Files)
+	// datasets of other tests are kept, but not their files
+	released := false
+	for _, d := range stats.Datasets {
+		if d.Status == "released" {
+			released = true
+			assert.GreaterOrEqual(suite.T(), d.Datasets, int64(1))
+			assert.Equal(suite.T(), int64(1), d.Files)
+		}
+	}
+	assert.True(suite.T(), released, "released datasets missing from the statistics")
+
+	// the stored counts are only replaced by the next refresh
+	assert.NoError(suite.T(), db.SetFileDeleted(fileIDs[0], "admin"))
+	stats, err = db.GetStats()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), stats.Files, 2)
+
+	assert.NoError(suite.T(), db.RefreshStats())
+	stats, err = db.GetStats()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []FileStats{{Status: "archived", Files: 1, UploadedBytes: 200, ArchivedBytes: 150}}, stats.Files)
+
+	db.Close()
+}
+
+func (suite *DatabaseTests) TestSetFileStatus() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	fileID, err := db.RegisterFile("/testuser/TestSetFileStatus.c4gh", "testuser")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+
+	assert.NoError(suite.T(), db.SetFileStatus(fileID, "registered", "uploaded", fileID, "testuser", "{}", "{}"))
+	assert.NoError(suite.T(), db.SetFileStatus(fileID, "", "submitted", fileID, "testuser", "{}", "{}"))
+
+	// the status is no longer "uploaded"
+	err = db.SetFileStatus(fileID, "uploaded", "archived", fileID, "ingest", "{}", "{}")
+	assert.ErrorIs(suite.T(), err, ErrStatusConflict)
+	var transitionErr *TransitionError
+	assert.ErrorAs(suite.T(), err, &transitionErr)
+	assert.Equal(suite.T(), "submitted", transitionErr.Current)
+
+	// a submitted file has not been verified
+	err = db.SetFileStatus(fileID, "", "ready", fileID, "finalize", "{}", "{}")
+	assert.ErrorIs(suite.T(), err, ErrIllegalTransition)
+	assert.ErrorIs(suite.T(), db.CheckFileStatus(fileID, "ready"), ErrIllegalTransition)
+	assert.NoError(suite.T(), db.CheckFileStatus(fileID, "archived"))
+
+	status, err := db.GetFileStatus(fileID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "submitted", status, "refused changes should not be logged")
+
+	// disabled files must be enabled before anything else
+	assert.NoError(suite.T(), db.SetFileStatus(fileID, "", "disabled", fileID, "api", "{}", "{}"))
+	assert.ErrorIs(suite.T(), db.SetFileStatus(fileID, "", "error", fileID, "ingest", "{}", "{}"), ErrIllegalTransition)
+	assert.NoError(suite.T(), db.SetFileStatus(fileID, "disabled", "enabled", fileID, "ingest", "{}", "{}"))
+
+	err = db.WithTransaction(func(tx *Tx) error {
+		return tx.SetFileStatus(fileID, "", "uploaded", fileID, "inbox", "{}", "{}")
+	})
+	assert.NoError(suite.T(), err)
+
+	err = db.SetFileStatus("00000000-0000-0000-0000-000000000000", "", "uploaded", fileID, "inbox", "{}", "{}")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+}
+
+func (suite *DatabaseTests) TestMapFilesToDatasetWithProvenance() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	var accessions []string
+	for i := range 2 {
+		fileID, err := db.RegisterFile(fmt.Sprintf("/provenance/file-%d.c4gh", i), "provenance-user")
+		if err != nil {
+			suite.FailNow("failed to register file")
+		}
+		accession := fmt.Sprintf("accession_provenance_%d", i)
+		if err := db.SetAccessionID(accession, fileID); err != nil {
+			suite.FailNow("failed to set stable ID")
+		}
+		accessions = append(accessions, accession)
+	}
+
+	dID := "test-mapping-provenance"
+	first := MappingProvenance{Actor: "admin@example.org", Source: "api", CorrelationID: "corr-1"}
+	assert.NoError(suite.T(), db.MapFilesToDatasetWithProvenance(dID, accessions[:1], first))
+	second := MappingProvenance{Actor: "sync-user", Source: "sync", CorrelationID: "corr-2"}
+	assert.NoError(suite.T(), db.MapFilesToDatasetWithProvenance(dID, accessions, second))
+
+	mappings, err := db.GetDatasetMappings(dID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(mappings))
+
+	// the first file was mapped through the API and then mapped again by sync
+	assert.Equal(suite.T(), accessions[0], mappings[0].AccessionID)
+	assert.Equal(suite.T(), "admin@example.org", mappings[0].MappedBy)
+	assert.Equal(suite.T(), "sync-user", mappings[0].ModifiedBy)
+	assert.Equal(suite.T(), "sync", mappings[0].Source)
+	assert.Equal(suite.T(), "corr-2", mappings[0].CorrelationID)
+	_, err = time.Parse(time.RFC3339Nano, mappings[0].ModifiedAt)
+	assert.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), accessions[1], mappings[1].AccessionID)
+	assert.Equal(suite.T(), "sync-user", mappings[1].MappedBy)
+	assert.Empty(suite.T(), mappings[1].ModifiedBy)
+	assert.Empty(suite.T(), mappings[1].ModifiedAt)
+	_, err = time.Parse(time.RFC3339Nano, mappings[1].MappedAt)
+	assert.NoError(suite.T(), err)
+
+	// mappings made without provenance are listed without it
+	assert.NoError(suite.T(), db.MapFilesToDataset("test-mapping-no-provenance", accessions[:1]))
+	mappings, err = db.GetDatasetMappings("test-mapping-no-provenance")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []FileMapping{{AccessionID: accessions[0]}}, mappings)
+
+	mappings, err = db.GetDatasetMappings("unknown-dataset")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), mappings)
+}
+
+func (suite *DatabaseTests) TestMessageLog() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	messages := db.MessageLog(time.Hour)
+	processed, err := messages.Processed("finalize/corr-1/0123456789abcdef")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), processed)
+
+	assert.NoError(suite.T(), messages.MarkProcessed("finalize/corr-1/0123456789abcdef"))
+	assert.NoError(suite.T(), messages.MarkProcessed("finalize/corr-1/0123456789abcdef"), "marking a message again should work")
+	processed, err = messages.Processed("finalize/corr-1/0123456789abcdef")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), processed)
+
+	// the message is forgotten once it has expired
+	expired := db.MessageLog(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	processed, err = expired.Processed("finalize/corr-1/0123456789abcdef")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), processed)
+}
+
+func (suite *DatabaseTests) TestRefreshTokens() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	token := RefreshToken{Subject: "dummy@example.org", SessionID: "session-1", Claims: map[string]any{"groups": []string{"group-a"}}}
+	assert.NoError(suite.T(), db.AddRefreshToken("token-hash", token, time.Now().Add(time.Hour)))
+	used, err := db.UseRefreshToken("token-hash")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "dummy@example.org", used.Subject)
+	assert.Equal(suite.T(), "session-1", used.SessionID)
+	assert.Equal(suite.T(), map[string]any{"groups": []any{"group-a"}}, used.Claims)
+
+	// a refresh token can only be used once
+	_, err = db.UseRefreshToken("token-hash")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+
+	assert.NoError(suite.T(), db.AddRefreshToken("no-claims-hash", RefreshToken{Subject: "dummy@example.org"}, time.Now().Add(time.Hour)))
+	used, err = db.UseRefreshToken("no-claims-hash")
+	assert.NoError(suite.T(), err)
+	assert.Nil(suite.T(), used.Claims)
+	assert.Empty(suite.T(), used.SessionID)
+
+	assert.NoError(suite.T(), db.AddRefreshToken("expired-hash", RefreshToken{Subject: "dummy@example.org"}, time.Now().Add(-time.Second)))
+	_, err = db.UseRefreshToken("expired-hash")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+}
+
+func (suite *DatabaseTests) TestWebAuthnCredentials() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	creds, err := db.GetWebAuthnCredentials("webauthn-user")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), creds)
+
+	cred := WebAuthnCredential{ID: "Y3JlZGVudGlhbA", UserID: "webauthn-user", PublicKey: []byte{0xa5, 0x01, 0x02}, SignCount: 1}
+	assert.NoError(suite.T(), db.AddWebAuthnCredential(cred))
+	assert.Error(suite.T(), db.AddWebAuthnCredential(cred), "a credential can only be registered once")
+
+	assert.NoError(suite.T(), db.UseWebAuthnCredential(cred.ID, 5))
+	creds, err = db.GetWebAuthnCredentials("webauthn-user")
+	assert.NoError(suite.T(), err)
+	cred.SignCount = 5
+	assert.Equal(suite.T(), []WebAuthnCredential{cred}, creds)
+
+	assert.Error(suite.T(), db.UseWebAuthnCredential("unknown", 1))
+}
+
+func (suite *DatabaseTests) TestS3Credentials() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	_, err = db.GetS3Credential("UNKNOWN")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+
+	cred := S3Credential{AccessKey: "ACCESSKEY", SecretKey: "secret", UserID: "s3-user"}
+	assert.NoError(suite.T(), db.AddS3Credential(cred))
+	assert.Error(suite.T(), db.AddS3Credential(cred), "an access key can only be used once")
+
+	stored, err := db.GetS3Credential("ACCESSKEY")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "secret", stored.SecretKey)
+	assert.Equal(suite.T(), "s3-user", stored.UserID)
+
+	// regenerating replaces the credential
+	err = db.WithTransaction(func(tx *Tx) error {
+		if err := tx.RevokeS3Credential("ACCESSKEY", "s3-user"); err != nil {
+			return err
+		}
+
+		return tx.AddS3Credential(S3Credential{AccessKey: "NEWACCESSKEY", SecretKey: "new-secret", UserID: "s3-user"})
+	})
+	assert.NoError(suite.T(), err)
+	creds, err := db.GetS3Credentials("s3-user")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), creds, 1)
+	assert.Equal(suite.T(), "NEWACCESSKEY", creds[0].AccessKey)
+	assert.Empty(suite.T(), creds[0].SecretKey)
+
+	assert.Error(suite.T(), db.RevokeS3Credential("NEWACCESSKEY", "other-user"), "only the user can revoke a credential")
+	assert.NoError(suite.T(), db.RevokeS3Credential("NEWACCESSKEY", "s3-user"))
+	_, err = db.GetS3Credential("NEWACCESSKEY")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+}
+
+func (suite *DatabaseTests) TestSessions() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for _, id := range []string{"session-a", "session-b", "session-c"} {
+		assert.NoError(suite.T(), db.AddSession(Session{ID: id, Subject: "session-user", UserAgent: "sda-cli", ExpiresAt: expires}))
+	}
+	assert.NoError(suite.T(), db.AddSession(Session{ID: "other-session", Subject: "other-user", ExpiresAt: expires}))
+	assert.NoError(suite.T(), db.AddRefreshToken("session-a-hash", RefreshToken{Subject: "session-user", SessionID: "session-a"}, expires))
+
+	sessions, err := db.GetSessions("session-user")
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), sessions, 3)
+	assert.Equal(suite.T(), "session-a", sessions[0].ID)
+	assert.Equal(suite.T(), "sda-cli", sessions[0].UserAgent)
+
+	assert.NoError(suite.T(), db.ExtendSession("session-a", expires.Add(time.Hour)))
+	sessions, err = db.GetSessions("session-user")
+	assert.NoError(suite.T(), err)
+	assert.WithinDuration(suite.T(), expires.Add(time.Hour), sessions[0].ExpiresAt, time.Second)
+
+	revoked, err := db.IsTokenRevoked("token-id", "session-a")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), revoked)
+
+	// the refresh tokens of a revoked session can not be used
+	assert.Error(suite.T(), db.RevokeSession("session-a", "other-user"), "only the user can revoke a session")
+	assert.NoError(suite.T(), db.RevokeSession("session-a", "session-user"))
+	revoked, err = db.IsTokenRevoked("token-id", "session-a")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), revoked)
+	_, err = db.UseRefreshToken("session-a-hash")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+	assert.Error(suite.T(), db.RevokeSession("session-a", "session-user"))
+
+	// logging out everywhere leaves the sessions of others
+	assert.NoError(suite.T(), db.RevokeSessions("session-user"))
+	sessions, err = db.GetSessions("session-user")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), sessions)
+	revoked, err = db.IsTokenRevoked("session-c")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), revoked)
+	revoked, err = db.IsTokenRevoked("other-session")
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), revoked)
+}
+
+func (suite *DatabaseTests) TestTOTP() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	_, err = db.GetTOTPSecret("totp-user")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+
+	// a pending secret can be replaced until it is confirmed
+	assert.NoError(suite.T(), db.SetTOTPSecret("totp-user", "FIRSTSECRET"))
+	assert.NoError(suite.T(), db.SetTOTPSecret("totp-user", "SECONDSECRET"))
+	totp, err := db.GetTOTPSecret("totp-user")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), TOTPSecret{UserID: "totp-user", Secret: "SECONDSECRET"}, totp)
+	assert.Error(suite.T(), db.UseTOTPStep("totp-user", 100), "codes are not accepted before the secret is confirmed")
+
+	err = db.WithTransaction(func(tx *Tx) error {
+		if err := tx.ConfirmTOTP("totp-user", 100); err != nil {
+			return err
+		}
+
+		return tx.SetTOTPRecoveryCodes("totp-user", []string{"hash-1", "hash-2"})
+	})
+	assert.NoError(suite.T(), err)
+	totp, err = db.GetTOTPSecret("totp-user")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), TOTPSecret{UserID: "totp-user", Secret: "SECONDSECRET", Confirmed: true, LastStep: 100, RecoveryCodes: 2}, totp)
+	assert.Error(suite.T(), db.SetTOTPSecret("totp-user", "THIRDSECRET"), "a confirmed secret can not be replaced")
+
+	// codes can only be used once
+	assert.Error(suite.T(), db.UseTOTPStep("totp-user", 100))
+	assert.NoError(suite.T(), db.UseTOTPStep("totp-user", 101))
+	assert.ErrorIs(suite.T(), db.UseTOTPRecoveryCode("other-user", "hash-1"), sql.ErrNoRows)
+	assert.NoError(suite.T(), db.UseTOTPRecoveryCode("totp-user", "hash-1"))
+	assert.ErrorIs(suite.T(), db.UseTOTPRecoveryCode("totp-user", "hash-1"), sql.ErrNoRows)
+
+	assert.NoError(suite.T(), db.SetTOTPRecoveryCodes("totp-user", []string{"hash-3"}))
+	assert.ErrorIs(suite.T(), db.UseTOTPRecoveryCode("totp-user", "hash-2"), sql.ErrNoRows)
+
+	assert.NoError(suite.T(), db.DeleteTOTP("totp-user"))
+	_, err = db.GetTOTPSecret("totp-user")
+	assert.ErrorIs(suite.T(), err, sql.ErrNoRows)
+	assert.ErrorIs(suite.T(), db.UseTOTPRecoveryCode("totp-user", "hash-3"), sql.ErrNoRows)
+}
+
+func (suite *DatabaseTests) TestAddAuthEvent() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	defer db.Close()
+
+	event := AuthEvent{Event: "login", Subject: "audit-user", Provider: "ega", Outcome: "success", RemoteAddr: "192.0.2.1"}
+	assert.NoError(suite.T(), db.AddAuthEvent(event, 0))
+	_, err = db.DB.Exec("UPDATE sda.auth_events SET created_at = now() - INTERVAL '2 days' WHERE subject = 'audit-user';")
+	assert.NoError(suite.T(), err)
+
+	// entries older than the retention are deleted
+	event.Outcome = "failure"
+	assert.NoError(suite.T(), db.AddAuthEvent(event, 24*time.Hour))
+
+	var outcome, userAgent sql.NullString
+	var count int
+	assert.NoError(suite.T(), db.DB.QueryRow("SELECT count(*) FROM sda.auth_events WHERE subject = 'audit-user';").Scan(&count))
+	assert.Equal(suite.T(), 1, count)
+	assert.NoError(suite.T(), db.DB.QueryRow("SELECT outcome, user_agent FROM sda.auth_events WHERE subject = 'audit-user';").Scan(&outcome, &userAgent))
+	assert.Equal(suite.T(), "failure", outcome.String)
+	assert.False(suite.T(), userAgent.Valid)
+}
@@ -1,7 +1,10 @@
 package database
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -12,6 +15,9 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/lib/pq"
+	"github.com/neicnordic/sensitive-data-archive/internal/helper"
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 	"github.com/stretchr/testify/assert"
@@ -154,6 +160,43 @@ func (suite *DatabaseTests) TestNewSDAdb() {
 
 }
 
+// TestReplica tests that reads go to the replica, and to the primary when
+// the replica does not respond
+func (suite *DatabaseTests) TestReplica() {
+	defer func(rate time.Duration) { ReplicaCheckRate = rate }(ReplicaCheckRate)
+	ReplicaCheckRate = 100 * time.Millisecond
+
+	conf := suite.dbConf
+	_, conf.ReplicaDSN = suite.dbConf.PgDataSource()
+	db, err := NewSDAdb(conf)
+	assert.NoError(suite.T(), err, "got %v when creating new connection", err)
+	defer db.Close()
+
+	assert.NotNil(suite.T(), db.Replica)
+	assert.Same(suite.T(), db.Replica, db.reader())
+
+	// reads go back to the replica once it responds to the background pings
+	db.replicaUp.Store(false)
+	assert.Same(suite.T(), db.DB, db.reader())
+	assert.Eventually(suite.T(), func() bool { return db.reader() == db.Replica }, 5*time.Second, 50*time.Millisecond)
+
+	_, err = db.RegisterFile("/testuser/TestReplica.c4gh", "testuser")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+	files, err := db.GetUserFiles("testuser")
+	assert.NoError(suite.T(), err, "failed to read files from the replica")
+	assert.Len(suite.T(), files, 1)
+
+	conf.ReplicaDSN = fmt.Sprintf("host=localhost port=1 user=%s password=%s dbname=%s sslmode=disable connect_timeout=1", conf.User, conf.Password, conf.Database)
+	db, err = NewSDAdb(conf)
+	assert.NoError(suite.T(), err, "an unavailable replica should not fail the connection")
+	defer db.Close()
+
+	assert.Same(suite.T(), db.DB, db.reader())
+	files, err = db.GetUserFiles("testuser")
+	assert.NoError(suite.T(), err, "failed to read files from the primary")
+	assert.Len(suite.T(), files, 1)
+}
+
 // TestConnect tests creation of new database connections
 func (suite *DatabaseTests) TestConnect() {
 
@@ -200,6 +243,24 @@ func (suite *DatabaseTests) TestConnect() {
 
 }
 
+// TestConnectPool tests that the connection pool limits are applied
+func (suite *DatabaseTests) TestConnectPool() {
+	conf := suite.dbConf
+	conf.MaxOpenConns = 7
+	db, err := NewSDAdb(conf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	assert.Equal(suite.T(), 7, db.DB.Stats().MaxOpenConnections)
+
+	db.Reconnect()
+	assert.Equal(suite.T(), 7, db.DB.Stats().MaxOpenConnections)
+	db.Close()
+
+	db, err = NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+	assert.Equal(suite.T(), 0, db.DB.Stats().MaxOpenConnections, "pool should be unlimited when not configured")
+	db.Close()
+}
+
 // TestClose tests that the connection is properly closed
 func (suite *DatabaseTests) TestClose() {
 
@@ -220,3 +281,194 @@ func (suite *DatabaseTests) TestClose() {
 	assert.NotPanics(suite.T(), db.Close,
 		"Close paniced when called on closed connection")
 }
+
+// TestMigrate tests that the embedded migrations match the ones shipped with
+// the database container and leave an up to date schema as it is
+func (suite *DatabaseTests) TestMigrate() {
+	_, b, _, _ := runtime.Caller(0)
+	shipped, err := os.ReadDir(path.Join(path.Dir(b), "../../../postgresql/migratedb.d"))
+	assert.NoError(suite.T(), err)
+	embedded, err := migrationScripts()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), len(shipped), len(embedded))
+	for _, f := range shipped {
+		want, err := os.ReadFile(path.Join(path.Dir(b), "../../../postgresql/migratedb.d", f.Name()))
+		assert.NoError(suite.T(), err)
+		got, err := migrations.ReadFile("migrations/" + f.Name())
+		assert.NoError(suite.T(), err, "migration %s is not embedded", f.Name())
+		assert.Equal(suite.T(), string(want), string(got), "embedded migration %s differs from postgresql/migratedb.d", f.Name())
+	}
+
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), SchemaVersion(), db.Version)
+
+	assert.NoError(suite.T(), db.Migrate())
+	assert.Equal(suite.T(), SchemaVersion(), db.Version)
+
+	db.Close()
+}
+
+func (suite *DatabaseTests) TestWaitForVersion() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	assert.NoError(suite.T(), db.WaitForVersion(SchemaVersion(), 0))
+
+	pollRate := SchemaPollRate
+	SchemaPollRate = 10 * time.Millisecond
+	defer func() { SchemaPollRate = pollRate }()
+
+	start := time.Now()
+	err = db.WaitForVersion(SchemaVersion()+1, 50*time.Millisecond)
+	assert.ErrorContains(suite.T(), err, fmt.Sprintf("v%d is required", SchemaVersion()+1))
+	assert.GreaterOrEqual(suite.T(), time.Since(start), 50*time.Millisecond)
+	assert.Equal(suite.T(), SchemaVersion(), db.Version)
+}
+
+func (suite *DatabaseTests) TestWatchCerts() {
+	certPath := suite.T().TempDir()
+	helper.MakeCerts(certPath)
+
+	conf := suite.dbConf
+	assert.Empty(suite.T(), conf.certFiles(), "no TLS files should be watched with sslmode disable")
+
+	conf.SslMode = "verify-full"
+	conf.CACert = certPath + "/ca.crt"
+	conf.ClientCert = certPath + "/tls.crt"
+	conf.ClientKey = certPath + "/tls.key"
+	assert.Len(suite.T(), conf.certFiles(), 3)
+	assert.NoError(suite.T(), conf.loadCerts())
+
+	before := fileStamps(conf.certFiles())
+	assert.Len(suite.T(), before, 3)
+
+	// a key that does not match the certificate, as in the middle of a rotation
+	assert.NoError(suite.T(), os.Rename(certPath+"/tls.key", certPath+"/old.key"))
+	helper.MakeCerts(certPath)
+	assert.NoError(suite.T(), os.Rename(certPath+"/old.key", certPath+"/tls.key"))
+	assert.NotEqual(suite.T(), before, fileStamps(conf.certFiles()))
+	assert.Error(suite.T(), conf.loadCerts())
+
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err)
+	defer db.Close()
+
+	interval, lifetime := CertCheckInterval, CertRecycleLifetime
+	CertCheckInterval, CertRecycleLifetime = 10*time.Millisecond, 20*time.Millisecond
+	defer func() { CertCheckInterval, CertRecycleLifetime = interval, lifetime }()
+
+	// the connection uses sslmode disable, only the watched files matter here
+	db.Config.SslMode = conf.SslMode
+	db.Config.CACert, db.Config.ClientCert, db.Config.ClientKey = conf.CACert, conf.ClientCert, conf.ClientKey
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go db.WatchCerts(ctx)
+
+	inUse, err := db.DB.Conn(ctx)
+	assert.NoError(suite.T(), err)
+	idle, err := db.DB.Conn(ctx)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), idle.Close())
+
+	// let the watcher read the current files before they are rotated
+	time.Sleep(2 * CertCheckInterval)
+	helper.MakeCerts(certPath)
+	assert.Eventually(suite.T(), func() bool { return db.DB.Stats().MaxIdleClosed > 0 }, time.Second, 10*time.Millisecond, "idle connections should be closed after the rotation")
+
+	time.Sleep(2 * CertRecycleLifetime)
+	assert.NoError(suite.T(), inUse.Close())
+	assert.Equal(suite.T(), int64(1), db.DB.Stats().MaxLifetimeClosed, "the connection in use should be closed when returned")
+
+	// the configured lifetime is restored once no connection is in use
+	time.Sleep(5 * CertCheckInterval)
+	conn, err := db.DB.Conn(ctx)
+	assert.NoError(suite.T(), err)
+	time.Sleep(2 * CertRecycleLifetime)
+	assert.NoError(suite.T(), conn.Close())
+	assert.Equal(suite.T(), int64(1), db.DB.Stats().MaxLifetimeClosed)
+	assert.NoError(suite.T(), db.DB.Ping())
+}
+
+// TestRetry tests that operations are retried according to the retry policy
+func (suite *DatabaseTests) TestRetry() {
+	db := &SDAdb{Config: DBConf{RetryTimes: 3, RetryDelay: time.Millisecond, RetryMaxDelay: 2 * time.Millisecond}}
+
+	attempts := 0
+	err := db.retry(func() error {
+		attempts++
+
+		return errors.New("connection reset")
+	})
+	assert.EqualError(suite.T(), err, "connection reset")
+	assert.Equal(suite.T(), 3, attempts)
+
+	attempts = 0
+	v, err := retryValue(db, func() (string, error) {
+		attempts++
+		if attempts < 2 {
+			return "", &pq.Error{Code: "08006"}
+		}
+
+		return "ok", nil
+	})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "ok", v)
+	assert.Equal(suite.T(), 2, attempts)
+
+	// errors that will not go away are not retried
+	for _, e := range []error{sql.ErrNoRows, &pq.Error{Code: "23505"}, permanent(errors.New("exists"))} {
+		attempts = 0
+		err = db.retry(func() error {
+			attempts++
+
+			return e
+		})
+		assert.ErrorIs(suite.T(), err, e)
+		assert.Equal(suite.T(), 1, attempts)
+	}
+}
+
+// TestMetrics tests that the calls to the database functions are counted
+// and timed by function and outcome
+func (suite *DatabaseTests) TestMetrics() {
+	db, err := NewSDAdb(suite.dbConf)
+	assert.NoError(suite.T(), err, "got (%v) when creating new connection", err)
+
+	fileID, err := db.RegisterFile("/testuser/metrics.c4gh", "testuser")
+	assert.NoError(suite.T(), err, "failed to register file in database")
+	assert.NoError(suite.T(), db.UpdateFileEventLog(fileID, "uploaded", fileID, "testuser", "{}", "{}"))
+	_, err = db.GetFileStatus(fileID)
+	assert.NoError(suite.T(), err)
+	_, err = db.GetFileStatus("00000000-0000-0000-0000-000000000000")
+	assert.Error(suite.T(), err)
+
+	var buf bytes.Buffer
+	assert.NoError(suite.T(), metrics.Write(&buf))
+	assert.Contains(suite.T(), buf.String(), `sda_db_calls_total{function="UpdateFileEventLog",outcome="success"}`)
+	assert.Contains(suite.T(), buf.String(), `sda_db_calls_total{function="GetFileStatus",outcome="success"}`)
+	assert.Contains(suite.T(), buf.String(), `sda_db_calls_total{function="GetFileStatus",outcome="error"}`)
+	assert.Contains(suite.T(), buf.String(), `sda_db_call_duration_seconds_count{function="GetFileStatus",outcome="success"}`)
+
+	db.Close()
+}
+
+// TestRetryDelay tests the exponential backoff of the retry policy
+func (suite *DatabaseTests) TestRetryDelay() {
+	conf := DBConf{RetryDelay: 100 * time.Millisecond, RetryMaxDelay: time.Second}
+	assert.Equal(suite.T(), 100*time.Millisecond, conf.retryDelay(1))
+	assert.Equal(suite.T(), 400*time.Millisecond, conf.retryDelay(3))
+	assert.Equal(suite.T(), time.Second, conf.retryDelay(5))
+	assert.Equal(suite.T(), time.Second, conf.retryDelay(80))
+
+	conf.RetryJitter = 0.5
+	for range 10 {
+		d := conf.retryDelay(2)
+		assert.GreaterOrEqual(suite.T(), d, 100*time.Millisecond)
+		assert.LessOrEqual(suite.T(), d, 300*time.Millisecond)
+	}
+
+	assert.Equal(suite.T(), time.Duration(0), DBConf{}.retryDelay(3))
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Channels on which the database announces new rows in sda.file_event_log
+// and sda.dataset_event_log
+const (
+	FileEventsChannel    = "sda_file_events"
+	DatasetEventsChannel = "sda_dataset_events"
+)
+
+// Event is a file or dataset event announced by the database
+type Event struct {
+	Channel       string `json:"-"`
+	ID            int64  `json:"id"`
+	FileID        string `json:"fileID,omitempty"`
+	DatasetID     string `json:"datasetID,omitempty"`
+	Event         string `json:"event"`
+	CorrelationID string `json:"correlationID,omitempty"`
+	User          string `json:"user,omitempty"`
+	Timestamp     string `json:"timestamp"`
+}
+
+// Subscriber receives the events announced on the channels it listens to
+type Subscriber struct {
+	listener *pq.Listener
+	events   chan Event
+	resync   chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Subscribe listens for the events announced on the given channels, using a
+// connection of its own that is re-established if it is lost
+func (dbs *SDAdb) Subscribe(channels ...string) (*Subscriber, error) {
+	if dbs.Version < 26 {
+		return nil, errors.New("database schema v26 required for Subscribe()")
+	}
+
+	_, dataSource := dbs.Config.PgDataSource()
+	s := &Subscriber{
+		events: make(chan Event, 100),
+		resync: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	s.listener = pq.NewListener(dataSource, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Warnf("database event listener: %v", err)
+		}
+	})
+
+	for _, channel := range channels {
+		if err := s.listener.Listen(channel); err != nil {
+			s.listener.Close()
+
+			return nil, fmt.Errorf("failed to listen on %s: %v", channel, err)
+		}
+	}
+
+	go s.forward()
+
+	return s, nil
+}
+
+// Events returns the announced events, the channel is closed when the
+// subscriber is closed
+func (s *Subscriber) Events() <-chan Event {
+	return s.events
+}
+
+// Resync gets a value when the connection to the database has been
+// re-established. Events announced while it was down are lost, so anything
+// derived from them should be refreshed.
+func (s *Subscriber) Resync() <-chan struct{} {
+	return s.resync
+}
+
+// Close stops listening
+func (s *Subscriber) Close() error {
+	s.once.Do(func() { close(s.done) })
+
+	return s.listener.Close()
+}
+
+func (s *Subscriber) forward() {
+	defer close(s.events)
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case n, ok := <-s.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				log.Warn("database event listener reconnected, events may have been missed")
+				select {
+				case s.resync <- struct{}{}:
+				default:
+				}
+
+				continue
+			}
+
+			var e Event
+			if err := json.Unmarshal([]byte(n.Extra), &e); err != nil {
+				log.Errorf("failed to decode event from %s, reason: %v", n.Channel, err)
+
+				continue
+			}
+			e.Channel = n.Channel
+
+			select {
+			case s.events <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+)
+
+var (
+	callsTotal = metrics.NewCounter("sda_db_calls_total",
+		"Calls to the database functions by function and outcome.", "function", "outcome")
+	callDuration = metrics.NewHistogram("sda_db_call_duration_seconds",
+		"Duration of the calls to the database functions, including retries.", metrics.DefaultBuckets, "function", "outcome")
+	retriesTotal = metrics.NewCounter("sda_db_retries_total",
+		"Failed attempts of database functions that were retried.", "function")
+)
+
+// observe records the outcome and duration of a call to a database function
+func observe(function string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	callsTotal.Inc(function, outcome)
+	callDuration.Observe(time.Since(start).Seconds(), function, outcome)
+}
+
+// caller returns the name of the SDAdb method that called the retry
+// wrapper, calls from outside of the package are named after the wrapper
+func caller() string {
+	pcs := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	wrapper := ""
+	for {
+		frame, more := frames.Next()
+		pkg, name, _ := strings.Cut(frame.Function[strings.LastIndex(frame.Function, "/")+1:], ".")
+		// closures are named after the method they are defined in
+		name, _, _ = strings.Cut(strings.TrimPrefix(name, "(*SDAdb)."), ".")
+		if pkg != "database" {
+			return wrapper
+		}
+		switch {
+		case name == "retry", strings.HasPrefix(name, "retryValue["):
+		case name == "WithTransaction":
+			wrapper = name
+		default:
+			return name
+		}
+		if !more {
+			return wrapper
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrations holds a copy of the schema migrations in postgresql/migratedb.d,
+// named after the schema version they migrate to.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// SchemaPollRate is how often the schema version is checked while waiting
+// for the database to be migrated
+var SchemaPollRate = 5 * time.Second
+
+// SchemaVersion returns the database schema version the embedded migrations
+// migrate to, i.e. the version this binary is built for.
+func SchemaVersion() int {
+	scripts, err := migrationScripts()
+	if err != nil || len(scripts) == 0 {
+		return -1
+	}
+	version, _ := strconv.Atoi(strings.TrimSuffix(path.Base(scripts[len(scripts)-1]), ".sql"))
+
+	return version
+}
+
+// migrationScripts returns the embedded migrations in the order they apply
+func migrationScripts() ([]string, error) {
+	scripts, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(scripts)
+
+	return scripts, nil
+}
+
+// Migrate brings the database schema up to date using the migrations
+// embedded in the binary. Each migration only applies to the schema version
+// it migrates from, so like the database container the scripts are run until
+// the version no longer changes. The connection must be made as a user
+// allowed to change the schema.
+func (dbs *SDAdb) Migrate() error {
+	dbs.checkAndReconnectIfNeeded()
+
+	scripts, err := migrationScripts()
+	if err != nil {
+		return fmt.Errorf("failed to list schema migrations: %v", err)
+	}
+
+	for {
+		current := dbs.Version
+		for _, script := range scripts {
+			query, err := migrations.ReadFile(script)
+			if err != nil {
+				return fmt.Errorf("failed to read schema migration %s: %v", path.Base(script), err)
+			}
+			if _, err := dbs.DB.Exec(string(query)); err != nil {
+				return fmt.Errorf("schema migration %s failed: %v", path.Base(script), err)
+			}
+		}
+
+		dbs.Version, err = dbs.getVersion()
+		if err != nil {
+			return fmt.Errorf("failed to fetch database schema version: %v", err)
+		}
+		if dbs.Version == current {
+			break
+		}
+		log.Infof("Migrated database schema from v%d to v%d", current, dbs.Version)
+	}
+
+	if dbs.Version < SchemaVersion() {
+		return fmt.Errorf("database schema is at v%d after migrating, v%d is expected", dbs.Version, SchemaVersion())
+	}
+
+	return nil
+}
+
+// WaitForVersion checks that the database schema is at least at the
+// required version. When it is not, the version is checked again every
+// SchemaPollRate until wait has passed, to give a migration running
+// elsewhere time to finish.
+func (dbs *SDAdb) WaitForVersion(required int, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for dbs.Version < required {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("database schema is at v%d but v%d is required, "+
+				"apply the migrations in postgresql/migratedb.d or start the service with --migrate", dbs.Version, required)
+		}
+		log.Infof("Waiting for the database schema to be migrated from v%d to v%d", dbs.Version, required)
+		time.Sleep(min(SchemaPollRate, time.Until(deadline)))
+
+		version, err := dbs.getVersion()
+		if err != nil {
+			return fmt.Errorf("failed to fetch database schema version: %v", err)
+		}
+		dbs.Version = version
+	}
+
+	return nil
+}
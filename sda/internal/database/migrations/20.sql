@@ -0,0 +1,37 @@
+
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 19;
+  changes VARCHAR := 'Add projects to files and project scoped admins';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    ALTER TABLE sda.files ADD COLUMN IF NOT EXISTS project TEXT;
+    CREATE INDEX IF NOT EXISTS files_project_idx ON sda.files(project);
+
+    -- Files from users belonging to a single group are assigned to that project
+    UPDATE sda.files f SET project = u.groups[1] FROM sda.userinfo u
+        WHERE f.submission_user = u.id AND cardinality(u.groups) = 1 AND f.project IS NULL;
+
+    CREATE TABLE IF NOT EXISTS sda.project_admins (
+        project     TEXT NOT NULL,
+        user_id     TEXT NOT NULL,
+        added_by    TEXT NOT NULL,
+        added_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        PRIMARY KEY (project, user_id)
+    );
+
+    GRANT SELECT, INSERT, DELETE ON sda.project_admins TO api;
+    GRANT SELECT ON sda.userinfo TO ingest;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,31 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 21;
+  changes VARCHAR := 'Add upload sessions';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.upload_sessions (
+        id            TEXT PRIMARY KEY,
+        user_id       TEXT NOT NULL,
+        started_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        last_activity TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+    );
+
+    ALTER TABLE sda.files ADD COLUMN IF NOT EXISTS session_id TEXT REFERENCES sda.upload_sessions(id);
+    CREATE INDEX IF NOT EXISTS files_session_idx ON sda.files(session_id);
+
+    GRANT SELECT, INSERT, UPDATE ON sda.upload_sessions TO inbox;
+    GRANT SELECT ON sda.upload_sessions TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,34 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 26;
+  changes VARCHAR := 'Add expected files for pre-registered submissions';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.expected_files (
+        id                    SERIAL PRIMARY KEY,
+        submission_user       TEXT NOT NULL,
+        submission_file_path  TEXT NOT NULL,
+        file_size             BIGINT,
+        checksum              TEXT,
+        checksum_type         sda.checksum_algorithm,
+        registered_by         TEXT NOT NULL,
+        registered_at         TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        reminded_at           TIMESTAMP WITH TIME ZONE,
+        UNIQUE (submission_user, submission_file_path)
+    );
+
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.expected_files TO api;
+    GRANT USAGE, SELECT ON SEQUENCE sda.expected_files_id_seq TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,21 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 28;
+  changes VARCHAR := 'Add SHA3-256 and CRC32C checksums';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    ALTER TYPE sda.checksum_algorithm ADD VALUE IF NOT EXISTS 'SHA3-256';
+    ALTER TYPE sda.checksum_algorithm ADD VALUE IF NOT EXISTS 'CRC32C';
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
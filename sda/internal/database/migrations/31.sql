@@ -0,0 +1,24 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 30;
+  changes VARCHAR := 'Add submission metadata to files and datasets';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    ALTER TABLE sda.files ADD COLUMN IF NOT EXISTS metadata JSONB;
+    ALTER TABLE sda.datasets ADD COLUMN IF NOT EXISTS metadata JSONB;
+
+    GRANT UPDATE (metadata) ON sda.files TO api;
+    GRANT UPDATE (metadata) ON sda.datasets TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
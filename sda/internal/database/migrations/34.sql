@@ -0,0 +1,31 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 33;
+  changes VARCHAR := 'Add user usage accounting';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.user_usage (
+        user_id        TEXT PRIMARY KEY,
+        uploaded_files BIGINT NOT NULL,
+        uploaded_bytes BIGINT NOT NULL,
+        archived_files BIGINT NOT NULL,
+        archived_bytes BIGINT NOT NULL,
+        dataset_files  BIGINT NOT NULL,
+        dataset_bytes  BIGINT NOT NULL,
+        summarised_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+    );
+
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.user_usage TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
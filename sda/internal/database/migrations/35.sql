@@ -0,0 +1,22 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 34;
+  changes VARCHAR := 'Add trigram indexes for file search';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE EXTENSION IF NOT EXISTS pg_trgm WITH SCHEMA sda;
+    CREATE INDEX IF NOT EXISTS files_submission_user_trgm ON sda.files USING gin (submission_user sda.gin_trgm_ops);
+    CREATE INDEX IF NOT EXISTS files_submission_file_path_trgm ON sda.files USING gin (submission_file_path sda.gin_trgm_ops);
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,80 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 36;
+  changes VARCHAR := 'Add file status transitions';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.file_event_transitions (
+        from_event TEXT REFERENCES sda.file_events(title),
+        to_event   TEXT REFERENCES sda.file_events(title),
+        PRIMARY KEY (from_event, to_event)
+    );
+
+    INSERT INTO sda.file_event_transitions(from_event, to_event)
+    VALUES ('registered', 'registered'), ('registered', 'uploaded'), ('registered', 'submitted'),
+           ('uploaded', 'registered'), ('uploaded', 'uploaded'), ('uploaded', 'submitted'),
+           ('submitted', 'submitted'), ('submitted', 'ingested'), ('submitted', 'archived'),
+           ('ingested', 'archived'),
+           ('archived', 'submitted'), ('archived', 'archived'), ('archived', 'verified'), ('archived', 'duplicate'),
+           ('verified', 'verified'), ('verified', 'duplicate'), ('verified', 'backed up'), ('verified', 'ready'),
+           ('duplicate', 'verified'), ('duplicate', 'duplicate'), ('duplicate', 'backed up'), ('duplicate', 'ready'),
+           ('backed up', 'verified'), ('backed up', 'backed up'), ('backed up', 'ready'),
+           ('ready', 'verified'), ('ready', 'backed up'), ('ready', 'ready'), ('ready', 'downloaded'),
+           ('downloaded', 'verified'), ('downloaded', 'ready'), ('downloaded', 'downloaded'),
+           ('error', 'registered'), ('error', 'uploaded'), ('error', 'submitted'), ('error', 'archived'), ('error', 'verified'),
+           ('enabled', 'registered'), ('enabled', 'uploaded'), ('enabled', 'submitted'), ('enabled', 'archived'), ('enabled', 'verified'), ('enabled', 'backed up'), ('enabled', 'ready'),
+           ('disabled', 'enabled');
+
+    -- any file can be disabled, and get an error unless it is disabled
+    INSERT INTO sda.file_event_transitions(from_event, to_event)
+    SELECT title, 'disabled' FROM sda.file_events
+    UNION SELECT title, 'error' FROM sda.file_events WHERE title <> 'disabled'
+    ON CONFLICT DO NOTHING;
+
+    CREATE OR REPLACE FUNCTION sda.set_file_status(file_uuid UUID, expected_status TEXT, new_status TEXT, corr_id UUID, user_name TEXT, event_details JSONB, event_message JSONB)
+    RETURNS void AS $set_file_status$
+    DECLARE
+        current_status TEXT;
+    BEGIN
+        -- the status of a file is changed by one caller at a time
+        PERFORM pg_advisory_xact_lock(hashtext(file_uuid::TEXT));
+        PERFORM 1 FROM sda.files WHERE id = file_uuid;
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'file % not found', file_uuid USING ERRCODE = 'no_data_found';
+        END IF;
+
+        SELECT event INTO current_status FROM sda.file_event_log WHERE file_id = file_uuid ORDER BY id DESC LIMIT 1;
+        IF expected_status <> '' AND current_status IS DISTINCT FROM expected_status THEN
+            RAISE EXCEPTION 'file % is %, not %', file_uuid, current_status, expected_status
+                USING ERRCODE = 'SD001', DETAIL = COALESCE(current_status, '');
+        END IF;
+        IF current_status IS NOT NULL AND NOT EXISTS (
+            SELECT 1 FROM sda.file_event_transitions WHERE from_event = current_status AND to_event = new_status
+        ) THEN
+            RAISE EXCEPTION 'file % can not go from % to %', file_uuid, current_status, new_status
+                USING ERRCODE = 'SD002', DETAIL = current_status;
+        END IF;
+
+        INSERT INTO sda.file_event_log(file_id, event, correlation_id, user_id, details, message)
+        VALUES(file_uuid, new_status, corr_id, user_name, event_details, event_message);
+    END;
+    $set_file_status$ LANGUAGE plpgsql;
+
+    GRANT SELECT ON sda.file_event_transitions TO ingest;
+    GRANT SELECT ON sda.file_event_transitions TO verify;
+    GRANT SELECT ON sda.file_event_transitions TO finalize;
+    GRANT SELECT ON sda.file_event_transitions TO api;
+    GRANT SELECT ON sda.file_event_transitions TO inbox;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,30 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 37;
+  changes VARCHAR := 'Add dataset mapping provenance';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    -- mappings made before this migration have no known provenance
+    ALTER TABLE sda.file_dataset
+        ADD COLUMN IF NOT EXISTS mapped_by      TEXT,
+        ADD COLUMN IF NOT EXISTS mapped_at      TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS source         TEXT CHECK (source IN ('api', 'sync')),
+        ADD COLUMN IF NOT EXISTS correlation_id TEXT,
+        ADD COLUMN IF NOT EXISTS modified_by    TEXT,
+        ADD COLUMN IF NOT EXISTS modified_at    TIMESTAMP WITH TIME ZONE;
+
+    -- repeated mappings update the provenance of the existing ones
+    GRANT SELECT, UPDATE ON sda.file_dataset TO mapper;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
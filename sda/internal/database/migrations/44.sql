@@ -0,0 +1,41 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 43;
+  changes VARCHAR := 'Add login sessions and revoked tokens';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.sessions (
+        id          TEXT PRIMARY KEY,
+        subject     TEXT NOT NULL,
+        user_agent  TEXT,
+        created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        expires_at  TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS sessions_subject_idx ON sda.sessions(subject);
+
+    -- the session that a refresh token belongs to
+    ALTER TABLE sda.refresh_tokens ADD COLUMN IF NOT EXISTS session_id TEXT;
+
+    CREATE TABLE IF NOT EXISTS sda.revoked_tokens (
+        token_id    TEXT PRIMARY KEY,
+        subject     TEXT NOT NULL,
+        revoked_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+        expires_at  TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+
+    GRANT SELECT, INSERT, UPDATE, DELETE ON sda.sessions TO auth;
+    GRANT SELECT, INSERT, DELETE ON sda.revoked_tokens TO auth;
+    GRANT SELECT ON sda.revoked_tokens TO api;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
@@ -0,0 +1,32 @@
+DO
+$$
+DECLARE
+-- The version we know how to do migration from, at the end of a successful migration
+-- we will no longer be at this version.
+  sourcever INTEGER := 45;
+  changes VARCHAR := 'Add audit log of auth';
+BEGIN
+  IF (select max(version) from sda.dbschema_version) = sourcever then
+    RAISE NOTICE 'Doing migration from schema version % to %', sourcever, sourcever+1;
+    RAISE NOTICE 'Changes: %', changes;
+    INSERT INTO sda.dbschema_version VALUES(sourcever+1, now(), changes);
+
+    CREATE TABLE IF NOT EXISTS sda.auth_events (
+        event        TEXT NOT NULL,
+        subject      TEXT,
+        provider     TEXT,
+        outcome      TEXT NOT NULL,
+        remote_addr  TEXT,
+        user_agent   TEXT,
+        created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+    );
+    CREATE INDEX IF NOT EXISTS auth_events_subject_idx ON sda.auth_events(subject, created_at);
+    CREATE INDEX IF NOT EXISTS auth_events_created_at_idx ON sda.auth_events(created_at);
+
+    GRANT SELECT, INSERT, DELETE ON sda.auth_events TO auth;
+
+  ELSE
+    RAISE NOTICE 'Schema migration from % to % does not apply now, skipping', sourcever, sourcever+1;
+  END IF;
+END
+$$
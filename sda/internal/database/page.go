@@ -0,0 +1,57 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidCursor is returned when the cursor of a page can not be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page selects a part of a list. After is the cursor returned together with
+// the previous page, and a Limit of 0 selects the rest of the list.
+type Page struct {
+	Limit int
+	After string
+}
+
+// encodeCursor joins the keys of the last row of a page into an opaque cursor
+func encodeCursor(keys ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(keys, "\x00")))
+}
+
+// decodeCursor splits a cursor into the given number of keys
+func decodeCursor(cursor string, keys int) ([]string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != keys {
+		return nil, ErrInvalidCursor
+	}
+
+	return parts, nil
+}
+
+// fileCursor decodes a cursor over files, which are ordered by creation time
+// and id
+func fileCursor(cursor string) (time.Time, string, error) {
+	keys, err := decodeCursor(cursor, 2)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, keys[0])
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(keys[1]); err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	return createdAt, keys[1], nil
+}
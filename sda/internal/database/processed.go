@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// processedPurgeInterval is how often the expired processed messages are
+// deleted by a MessageLog
+const processedPurgeInterval = time.Hour
+
+// MessageLog remembers the processed messages in the database, so that all
+// replicas of a service see them. It is a broker.Deduplicator.
+type MessageLog struct {
+	dbs *SDAdb
+	ttl time.Duration
+
+	mu     sync.Mutex
+	purged time.Time
+}
+
+// MessageLog returns a MessageLog that remembers processed messages for ttl,
+// it needs schema v39
+func (dbs *SDAdb) MessageLog(ttl time.Duration) *MessageLog {
+	return &MessageLog{dbs: dbs, ttl: ttl}
+}
+
+// Processed reports whether the message with the key was processed within
+// the time it is remembered
+func (l *MessageLog) Processed(key string) (bool, error) {
+	return retryValue(l.dbs, func() (bool, error) {
+		return l.processed(key)
+	})
+}
+func (l *MessageLog) processed(key string) (bool, error) {
+	l.dbs.checkAndReconnectIfNeeded()
+
+	if l.dbs.Version < 39 {
+		return false, errors.New("database schema v39 required for Processed()")
+	}
+
+	const query = "SELECT EXISTS (SELECT 1 FROM sda.processed_messages " +
+		"WHERE message_key = $1 AND processed_at > clock_timestamp() - make_interval(secs => $2));"
+	var processed bool
+	err := l.dbs.DB.QueryRow(query, key, l.ttl.Seconds()).Scan(&processed)
+
+	return processed, err
+}
+
+// MarkProcessed records that the message with the key was processed, and
+// deletes the messages that have expired now and then
+func (l *MessageLog) MarkProcessed(key string) error {
+	return l.dbs.retry(func() error {
+		return l.markProcessed(key)
+	})
+}
+func (l *MessageLog) markProcessed(key string) error {
+	l.dbs.checkAndReconnectIfNeeded()
+
+	if l.dbs.Version < 39 {
+		return errors.New("database schema v39 required for MarkProcessed()")
+	}
+
+	const query = "INSERT INTO sda.processed_messages (message_key) VALUES ($1) " +
+		"ON CONFLICT (message_key) DO UPDATE SET processed_at = clock_timestamp();"
+	if _, err := l.dbs.DB.Exec(query, key); err != nil {
+		return err
+	}
+	l.purge()
+
+	return nil
+}
+
+// purge deletes the expired messages, at most once per
+// processedPurgeInterval
+func (l *MessageLog) purge() {
+	l.mu.Lock()
+	if time.Since(l.purged) < processedPurgeInterval {
+		l.mu.Unlock()
+
+		return
+	}
+	l.purged = time.Now()
+	l.mu.Unlock()
+
+	const query = "DELETE FROM sda.processed_messages WHERE processed_at < clock_timestamp() - make_interval(secs => $1);"
+	if _, err := l.dbs.DB.Exec(query, l.ttl.Seconds()); err != nil {
+		log.Warnf("failed to delete expired processed messages, reason: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/neicnordic/sensitive-data-archive/internal/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+// permanentError marks an error that will not go away by retrying the operation
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryable reports whether a failed database operation is worth retrying.
+// Missing rows and errors reported by postgres, other than connection
+// problems, serialization failures and lack of resources, are not retried.
+func retryable(err error) bool {
+	var pe *permanentError
+	if errors.Is(err, sql.ErrNoRows) || errors.As(err, &pe) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57", "58":
+			return true
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// retryDelay returns the time to wait before the next attempt, doubling the
+// base delay for each failed attempt up to the max delay, with jitter applied.
+func (c DBConf) retryDelay(attempt int) time.Duration {
+	if c.RetryDelay <= 0 {
+		return 0
+	}
+
+	delay := c.RetryDelay << (attempt - 1)
+	if delay <= 0 || (c.RetryMaxDelay > 0 && delay > c.RetryMaxDelay) {
+		delay = c.RetryMaxDelay
+	}
+	if c.RetryJitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * c.RetryJitter * float64(delay)) // #nosec G404
+	}
+
+	return delay
+}
+
+// retry runs op until it succeeds, fails with an error that is not worth
+// retrying, or the configured number of attempts has been used.
+func (dbs *SDAdb) retry(op func() error) error {
+	start := time.Now()
+	function := caller()
+	_, span := tracing.Start(dbs.traceContext(), tracing.Internal, function)
+	span.SetAttribute("db.system", "postgresql")
+
+	attempts := dbs.Config.RetryTimes
+	if attempts <= 0 {
+		attempts = RetryTimes
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = op()
+		if err == nil || !retryable(err) || attempt == attempts {
+			break
+		}
+
+		delay := dbs.Config.retryDelay(attempt)
+		log.Debugf("database operation failed (attempt %d of %d), retrying in %s, reason: %v", attempt, attempts, delay, err)
+		retriesTotal.Inc(function)
+		span.SetAttribute("sda.db.attempts", strconv.Itoa(attempt+1))
+		time.Sleep(delay)
+	}
+	observe(function, start, err)
+	span.End(err)
+
+	return err
+}
+
+// retryValue is retry for operations that return a value
+func retryValue[T any](dbs *SDAdb, op func() (T, error)) (T, error) {
+	var v T
+	err := dbs.retry(func() error {
+		var err error
+		v, err = op()
+
+		return err
+	})
+
+	return v, err
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// S3Credential is an access and secret key pair that a user uploads to the
+// inbox with
+type S3Credential struct {
+	AccessKey string
+	// SecretKey is only returned by GetS3Credential, for checking the
+	// signatures of the requests
+	SecretKey string
+	UserID    string
+	CreatedAt time.Time
+}
+
+// AddS3Credential stores a credential that a user has created
+func (dbs *SDAdb) AddS3Credential(cred S3Credential) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		return addS3Credential(dbs.DB, dbs.Version, cred)
+	})
+}
+
+// AddS3Credential is the transactional variant of SDAdb.AddS3Credential
+func (tx *Tx) AddS3Credential(cred S3Credential) error {
+	return addS3Credential(tx.tx, tx.version, cred)
+}
+
+func addS3Credential(db execer, version int, cred S3Credential) error {
+	if version < 43 {
+		return errors.New("database schema v43 required for AddS3Credential()")
+	}
+
+	const query = "INSERT INTO sda.s3_credentials(access_key, secret_key, user_id) VALUES($1, $2, $3);"
+	_, err := db.Exec(query, cred.AccessKey, cred.SecretKey, cred.UserID)
+
+	return err
+}
+
+// GetS3Credential returns the credential with the access key, or
+// sql.ErrNoRows when there is no such credential
+func (dbs *SDAdb) GetS3Credential(accessKey string) (S3Credential, error) {
+	return retryValue(dbs, func() (S3Credential, error) {
+		return dbs.getS3Credential(accessKey)
+	})
+}
+func (dbs *SDAdb) getS3Credential(accessKey string) (S3Credential, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 43 {
+		return S3Credential{}, errors.New("database schema v43 required for GetS3Credential()")
+	}
+
+	cred := S3Credential{AccessKey: accessKey}
+	const query = "SELECT secret_key, user_id, created_at FROM sda.s3_credentials WHERE access_key = $1;"
+	if err := dbs.DB.QueryRow(query, accessKey).Scan(&cred.SecretKey, &cred.UserID, &cred.CreatedAt); err != nil {
+		return S3Credential{}, err
+	}
+
+	return cred, nil
+}
+
+// GetS3Credentials returns the credentials of the user, oldest first and
+// without their secret keys
+func (dbs *SDAdb) GetS3Credentials(userID string) ([]S3Credential, error) {
+	return retryValue(dbs, func() ([]S3Credential, error) {
+		return dbs.getS3Credentials(userID)
+	})
+}
+func (dbs *SDAdb) getS3Credentials(userID string) ([]S3Credential, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 43 {
+		return nil, errors.New("database schema v43 required for GetS3Credentials()")
+	}
+
+	const query = "SELECT access_key, user_id, created_at FROM sda.s3_credentials WHERE user_id = $1 ORDER BY created_at;"
+	rows, err := dbs.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []S3Credential
+	for rows.Next() {
+		var cred S3Credential
+		if err := rows.Scan(&cred.AccessKey, &cred.UserID, &cred.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		creds = append(creds, cred)
+	}
+
+	return creds, rows.Err()
+}
+
+// RevokeS3Credential removes the credential with the access key of the user,
+// the inbox does not accept it from then on
+func (dbs *SDAdb) RevokeS3Credential(accessKey, userID string) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		return revokeS3Credential(dbs.DB, dbs.Version, accessKey, userID)
+	})
+}
+
+// RevokeS3Credential is the transactional variant of
+// SDAdb.RevokeS3Credential
+func (tx *Tx) RevokeS3Credential(accessKey, userID string) error {
+	return revokeS3Credential(tx.tx, tx.version, accessKey, userID)
+}
+
+func revokeS3Credential(db execer, version int, accessKey, userID string) error {
+	if version < 43 {
+		return errors.New("database schema v43 required for RevokeS3Credential()")
+	}
+
+	const query = "DELETE FROM sda.s3_credentials WHERE access_key = $1 AND user_id = $2;"
+	result, err := db.Exec(query, accessKey, userID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return permanent(errors.New("no such credential"))
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Session is a login to auth, that the tokens handed out at the login and
+// when they are refreshed belong to
+type Session struct {
+	ID        string
+	Subject   string
+	UserAgent string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// AddSession stores a new session, and deletes the sessions and revoked
+// tokens that have expired
+func (dbs *SDAdb) AddSession(session Session) error {
+	return dbs.retry(func() error {
+		return dbs.addSession(session)
+	})
+}
+func (dbs *SDAdb) addSession(session Session) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 44 {
+		return errors.New("database schema v44 required for AddSession()")
+	}
+
+	for _, purge := range []string{
+		"DELETE FROM sda.sessions WHERE expires_at < clock_timestamp();",
+		"DELETE FROM sda.revoked_tokens WHERE expires_at < clock_timestamp();",
+	} {
+		if _, err := dbs.DB.Exec(purge); err != nil {
+			return err
+		}
+	}
+
+	const query = "INSERT INTO sda.sessions(id, subject, user_agent, expires_at) VALUES($1, $2, NULLIF($3, ''), $4);"
+	_, err := dbs.DB.Exec(query, session.ID, session.Subject, session.UserAgent, session.ExpiresAt)
+
+	return err
+}
+
+// ExtendSession moves the expiry of the session to expires, when a token
+// that lives longer than the session has been handed out for it
+func (dbs *SDAdb) ExtendSession(id string, expires time.Time) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		if dbs.Version < 44 {
+			return errors.New("database schema v44 required for ExtendSession()")
+		}
+
+		const query = "UPDATE sda.sessions SET expires_at = $2 WHERE id = $1 AND expires_at < $2;"
+		_, err := dbs.DB.Exec(query, id, expires)
+
+		return err
+	})
+}
+
+// GetSessions returns the sessions of the subject that have not expired,
+// oldest first
+func (dbs *SDAdb) GetSessions(subject string) ([]Session, error) {
+	return retryValue(dbs, func() ([]Session, error) {
+		return dbs.getSessions(subject)
+	})
+}
+func (dbs *SDAdb) getSessions(subject string) ([]Session, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 44 {
+		return nil, errors.New("database schema v44 required for GetSessions()")
+	}
+
+	const query = "SELECT id, subject, COALESCE(user_agent, ''), created_at, expires_at FROM sda.sessions WHERE subject = $1 AND expires_at > clock_timestamp() ORDER BY created_at;"
+	rows, err := dbs.DB.Query(query, subject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.Subject, &s.UserAgent, &s.CreatedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends the session of the subject: its refresh tokens are
+// deleted and the session ID is added to the revoked tokens, so that the
+// access tokens of the session are refused until they expire
+func (dbs *SDAdb) RevokeSession(id, subject string) error {
+	return dbs.retry(func() error {
+		revoked, err := dbs.revokeSessions(subject, id)
+		if err == nil && revoked == 0 {
+			return permanent(errors.New("no such session"))
+		}
+
+		return err
+	})
+}
+
+// RevokeSessions ends all sessions of the subject, see RevokeSession
+func (dbs *SDAdb) RevokeSessions(subject string) error {
+	return dbs.retry(func() error {
+		_, err := dbs.revokeSessions(subject, "")
+
+		return err
+	})
+}
+
+// revokeSessions revokes the session with the id, or all sessions of the
+// subject when id is empty, and returns how many were revoked
+func (dbs *SDAdb) revokeSessions(subject, id string) (int64, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 44 {
+		return 0, errors.New("database schema v44 required for RevokeSession()")
+	}
+
+	const query = `WITH revoked AS (
+			DELETE FROM sda.sessions WHERE subject = $1 AND ($2 = '' OR id = $2) RETURNING id, subject, expires_at
+		), refresh AS (
+			DELETE FROM sda.refresh_tokens WHERE session_id IN (SELECT id FROM revoked)
+		)
+		INSERT INTO sda.revoked_tokens(token_id, subject, expires_at)
+		SELECT id, subject, expires_at FROM revoked WHERE expires_at > clock_timestamp()
+		ON CONFLICT DO NOTHING;`
+	result, err := dbs.DB.Exec(query, subject, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// IsTokenRevoked reports whether any of the IDs, i.e. the jti and sid
+// claims of a token, has been revoked
+func (dbs *SDAdb) IsTokenRevoked(tokenIDs ...string) (bool, error) {
+	return retryValue(dbs, func() (bool, error) {
+		return dbs.isTokenRevoked(tokenIDs)
+	})
+}
+func (dbs *SDAdb) isTokenRevoked(tokenIDs []string) (bool, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 44 {
+		return false, errors.New("database schema v44 required for IsTokenRevoked()")
+	}
+
+	const query = "SELECT EXISTS(SELECT 1 FROM sda.revoked_tokens WHERE token_id = ANY($1) AND expires_at > clock_timestamp());"
+	var revoked bool
+	if err := dbs.DB.QueryRow(query, pq.Array(tokenIDs)).Scan(&revoked); err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
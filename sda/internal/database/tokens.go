@@ -0,0 +1,85 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// RefreshToken is what a refresh token stands for: the subject and the
+// session of the tokens handed out for it, and the claims of the user that
+// the access tokens get
+type RefreshToken struct {
+	Subject   string
+	SessionID string
+	Claims    map[string]any
+}
+
+// AddRefreshToken stores a refresh token by the hash of the token, and
+// deletes the refresh tokens that have expired
+func (dbs *SDAdb) AddRefreshToken(tokenHash string, token RefreshToken, expires time.Time) error {
+	return dbs.retry(func() error {
+		return dbs.addRefreshToken(tokenHash, token, expires)
+	})
+}
+func (dbs *SDAdb) addRefreshToken(tokenHash string, token RefreshToken, expires time.Time) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 44 {
+		return errors.New("database schema v44 required for AddRefreshToken()")
+	}
+
+	// claims and sessions are stored as NULL when there are none
+	var rawClaims, sessionID any
+	if len(token.Claims) > 0 {
+		b, err := json.Marshal(token.Claims)
+		if err != nil {
+			return permanent(err)
+		}
+		rawClaims = string(b)
+	}
+	if token.SessionID != "" {
+		sessionID = token.SessionID
+	}
+
+	const purge = "DELETE FROM sda.refresh_tokens WHERE expires_at < clock_timestamp();"
+	if _, err := dbs.DB.Exec(purge); err != nil {
+		return err
+	}
+
+	const query = "INSERT INTO sda.refresh_tokens(token_hash, subject, claims, session_id, expires_at) VALUES($1, $2, $3, $4, $5);"
+	_, err := dbs.DB.Exec(query, tokenHash, token.Subject, rawClaims, sessionID, expires)
+
+	return err
+}
+
+// UseRefreshToken deletes the refresh token with the hash, so that it can
+// only be used once, and returns what it stands for. sql.ErrNoRows is
+// returned when there is no such token or it has expired.
+func (dbs *SDAdb) UseRefreshToken(tokenHash string) (RefreshToken, error) {
+	return retryValue(dbs, func() (RefreshToken, error) {
+		return dbs.useRefreshToken(tokenHash)
+	})
+}
+func (dbs *SDAdb) useRefreshToken(tokenHash string) (RefreshToken, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 44 {
+		return RefreshToken{}, errors.New("database schema v44 required for UseRefreshToken()")
+	}
+
+	const query = "DELETE FROM sda.refresh_tokens WHERE token_hash = $1 AND expires_at > clock_timestamp() RETURNING subject, COALESCE(session_id, ''), claims;"
+	var token RefreshToken
+	var rawClaims []byte
+	if err := dbs.DB.QueryRow(query, tokenHash).Scan(&token.Subject, &token.SessionID, &rawClaims); err != nil {
+		return RefreshToken{}, err
+	}
+
+	if len(rawClaims) > 0 {
+		if err := json.Unmarshal(rawClaims, &token.Claims); err != nil {
+			return RefreshToken{}, permanent(err)
+		}
+	}
+
+	return token, nil
+}
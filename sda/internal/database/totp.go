@@ -0,0 +1,184 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// TOTPSecret is the TOTP (authenticator app) secret of a user
+type TOTPSecret struct {
+	UserID string
+	// Secret is the base32 encoded shared secret
+	Secret string
+	// Confirmed is set once the user has entered a code made with the
+	// secret, codes are only asked for at login from then on
+	Confirmed bool
+	// LastStep is the time step of the last code that was used
+	LastStep int64
+	// RecoveryCodes is how many unused recovery codes the user has
+	RecoveryCodes int
+}
+
+// SetTOTPSecret stores a new secret for the user, that is not used until
+// it is confirmed. A confirmed secret can not be replaced, it has to be
+// deleted first.
+func (dbs *SDAdb) SetTOTPSecret(userID, secret string) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		if dbs.Version < 45 {
+			return errors.New("database schema v45 required for SetTOTPSecret()")
+		}
+
+		const query = "INSERT INTO sda.totp_secrets(user_id, secret) VALUES($1, $2) " +
+			"ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_step = 0, created_at = clock_timestamp() " +
+			"WHERE sda.totp_secrets.confirmed_at IS NULL;"
+		result, err := dbs.DB.Exec(query, userID, secret)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return permanent(errors.New("TOTP is already enabled"))
+		}
+
+		return nil
+	})
+}
+
+// GetTOTPSecret returns the secret of the user, or sql.ErrNoRows when the
+// user has none
+func (dbs *SDAdb) GetTOTPSecret(userID string) (TOTPSecret, error) {
+	return retryValue(dbs, func() (TOTPSecret, error) {
+		return dbs.getTOTPSecret(userID)
+	})
+}
+func (dbs *SDAdb) getTOTPSecret(userID string) (TOTPSecret, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 45 {
+		return TOTPSecret{}, errors.New("database schema v45 required for GetTOTPSecret()")
+	}
+
+	const query = "SELECT secret, confirmed_at IS NOT NULL, last_step, " +
+		"(SELECT count(*) FROM sda.totp_recovery_codes c WHERE c.user_id = s.user_id) " +
+		"FROM sda.totp_secrets s WHERE user_id = $1;"
+	totp := TOTPSecret{UserID: userID}
+	if err := dbs.DB.QueryRow(query, userID).Scan(&totp.Secret, &totp.Confirmed, &totp.LastStep, &totp.RecoveryCodes); err != nil {
+		return TOTPSecret{}, err
+	}
+
+	return totp, nil
+}
+
+// ConfirmTOTP enables the secret of the user, that a code of the time
+// step was made with
+func (tx *Tx) ConfirmTOTP(userID string, step int64) error {
+	if tx.version < 45 {
+		return errors.New("database schema v45 required for ConfirmTOTP()")
+	}
+
+	const query = "UPDATE sda.totp_secrets SET confirmed_at = clock_timestamp(), last_step = $2 WHERE user_id = $1 AND confirmed_at IS NULL;"
+	result, err := tx.tx.Exec(query, userID, step)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return permanent(errors.New("no TOTP secret to confirm"))
+	}
+
+	return nil
+}
+
+// UseTOTPStep records that a code of the time step was used by the user,
+// codes of the same or earlier steps are refused so that a code can only
+// be used once
+func (dbs *SDAdb) UseTOTPStep(userID string, step int64) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		if dbs.Version < 45 {
+			return errors.New("database schema v45 required for UseTOTPStep()")
+		}
+
+		const query = "UPDATE sda.totp_secrets SET last_step = $2 WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_step < $2;"
+		result, err := dbs.DB.Exec(query, userID, step)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return permanent(errors.New("the code has already been used"))
+		}
+
+		return nil
+	})
+}
+
+// SetTOTPRecoveryCodes replaces the recovery codes of the user, given by
+// their hashes
+func (dbs *SDAdb) SetTOTPRecoveryCodes(userID string, codeHashes []string) error {
+	return dbs.WithTransaction(func(tx *Tx) error {
+		return tx.SetTOTPRecoveryCodes(userID, codeHashes)
+	})
+}
+
+// SetTOTPRecoveryCodes is the transactional variant of
+// SDAdb.SetTOTPRecoveryCodes
+func (tx *Tx) SetTOTPRecoveryCodes(userID string, codeHashes []string) error {
+	if tx.version < 45 {
+		return errors.New("database schema v45 required for SetTOTPRecoveryCodes()")
+	}
+
+	if _, err := tx.tx.Exec("DELETE FROM sda.totp_recovery_codes WHERE user_id = $1;", userID); err != nil {
+		return err
+	}
+	const query = "INSERT INTO sda.totp_recovery_codes(code_hash, user_id) SELECT unnest($2::TEXT[]), $1;"
+	_, err := tx.tx.Exec(query, userID, pq.Array(codeHashes))
+
+	return err
+}
+
+// UseTOTPRecoveryCode deletes the recovery code of the user with the hash,
+// so that it can only be used once. sql.ErrNoRows is returned when the
+// user has no such code.
+func (dbs *SDAdb) UseTOTPRecoveryCode(userID, codeHash string) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		if dbs.Version < 45 {
+			return errors.New("database schema v45 required for UseTOTPRecoveryCode()")
+		}
+
+		const query = "DELETE FROM sda.totp_recovery_codes WHERE user_id = $1 AND code_hash = $2;"
+		result, err := dbs.DB.Exec(query, userID, codeHash)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// DeleteTOTP turns TOTP off for the user, by deleting the secret and the
+// recovery codes
+func (dbs *SDAdb) DeleteTOTP(userID string) error {
+	return dbs.retry(func() error {
+		dbs.checkAndReconnectIfNeeded()
+
+		if dbs.Version < 45 {
+			return errors.New("database schema v45 required for DeleteTOTP()")
+		}
+
+		const query = `WITH codes AS (
+				DELETE FROM sda.totp_recovery_codes WHERE user_id = $1
+			)
+			DELETE FROM sda.totp_secrets WHERE user_id = $1;`
+		_, err := dbs.DB.Exec(query, userID)
+
+		return err
+	})
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"database/sql"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// execer is the part of sql.DB and sql.Tx used by the updates that can be
+// made both on their own and as part of a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Tx is a transaction started by WithTransaction, the updates made through
+// it are committed together or not at all
+type Tx struct {
+	tx      *sql.Tx
+	version int
+}
+
+// WithTransaction runs fn in a transaction that is committed when fn returns
+// nil and rolled back otherwise. The transaction is retried from the start on
+// connection errors, so fn should not have side effects outside of it.
+func (dbs *SDAdb) WithTransaction(fn func(tx *Tx) error) error {
+	return dbs.retry(func() error {
+		return dbs.withTransaction(fn)
+	})
+}
+func (dbs *SDAdb) withTransaction(fn func(tx *Tx) error) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = transaction.Rollback()
+
+			panic(p)
+		}
+	}()
+
+	if err := fn(&Tx{tx: transaction, version: dbs.Version}); err != nil {
+		if err := transaction.Rollback(); err != nil {
+			log.Errorf("failed to rollback the transaction: %s", err.Error())
+		}
+
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+// UpdateFileEventLog is the transactional variant of SDAdb.UpdateFileEventLog
+func (tx *Tx) UpdateFileEventLog(fileUUID, event, corrID, user, details, message string) error {
+	return tx.SetFileStatus(fileUUID, "", event, corrID, user, details, message)
+}
+
+// SetFileStatus is the transactional variant of SDAdb.SetFileStatus
+func (tx *Tx) SetFileStatus(fileID, expected, status, corrID, user, details, message string) error {
+	return changeFileStatus(tx.tx, tx.version, fileID, expected, status, corrID, user, details, message)
+}
+
+// SetAccessionID is the transactional variant of SDAdb.SetAccessionID
+func (tx *Tx) SetAccessionID(accessionID, fileID string) error {
+	return setStableID(tx.tx, accessionID, fileID)
+}
+
+// MapFilesToDataset is the transactional variant of SDAdb.MapFilesToDataset
+func (tx *Tx) MapFilesToDataset(datasetID string, accessionIDs []string) error {
+	return mapFiles(tx.tx, datasetID, accessionIDs, nil)
+}
+
+// MapFilesToDatasetWithProvenance is the transactional variant of
+// SDAdb.MapFilesToDatasetWithProvenance
+func (tx *Tx) MapFilesToDatasetWithProvenance(datasetID string, accessionIDs []string, provenance MappingProvenance) error {
+	if tx.version < 38 {
+		return mapFiles(tx.tx, datasetID, accessionIDs, nil)
+	}
+
+	return mapFiles(tx.tx, datasetID, accessionIDs, &provenance)
+}
+
+// UpdateDatasetEvent is the transactional variant of SDAdb.UpdateDatasetEvent
+func (tx *Tx) UpdateDatasetEvent(datasetID, status, message string) error {
+	return insertDatasetEvent(tx.tx, datasetID, status, message)
+}
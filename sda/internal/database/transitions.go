@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrIllegalTransition is returned when a file can not go from its
+	// current status to the requested one, e.g. from "ready" to "uploaded"
+	ErrIllegalTransition = errors.New("illegal file status transition")
+	// ErrStatusConflict is returned when the status of a file is not the
+	// expected one, because it was changed by someone else in the meantime
+	ErrStatusConflict = errors.New("file status changed concurrently")
+)
+
+// TransitionError describes a refused change of the status of a file, it
+// matches ErrIllegalTransition or ErrStatusConflict with errors.Is
+type TransitionError struct {
+	FileID  string
+	Current string
+	Status  string
+	err     error
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%v: file %s is %q, can not set %q", e.err, e.FileID, e.Current, e.Status)
+}
+
+func (e *TransitionError) Unwrap() error { return e.err }
+
+// SetFileStatus logs the event that changes the status of a file, like
+// UpdateFileEventLog, but only when the transition from the current status
+// is allowed and, unless expected is empty, the current status is expected.
+// A refused change returns a *TransitionError. Transitions are only checked
+// from schema v37, on earlier schemas the event is logged unconditionally.
+func (dbs *SDAdb) SetFileStatus(fileID, expected, status, corrID, user, details, message string) error {
+	return dbs.retry(func() error {
+		return dbs.setFileStatus(fileID, expected, status, corrID, user, details, message)
+	})
+}
+func (dbs *SDAdb) setFileStatus(fileID, expected, status, corrID, user, details, message string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	return changeFileStatus(dbs.DB, dbs.Version, fileID, expected, status, corrID, user, details, message)
+}
+
+// changeFileStatus sets the status of a file on its own or as part of a
+// transaction, mapping the refusals of sda.set_file_status to errors
+func changeFileStatus(db execer, version int, fileID, expected, status, corrID, user, details, message string) error {
+	if version < 37 {
+		return insertFileEvent(db, fileID, status, corrID, user, details, message)
+	}
+
+	const query = "SELECT sda.set_file_status($1, $2, $3, $4, $5, $6, $7);"
+	_, err := db.Exec(query, fileID, expected, status, corrID, user, details, message)
+
+	return transitionError(err, fileID, status)
+}
+
+// transitionError maps the refusals of sda.set_file_status, also when it is
+// called by other database functions, to errors
+func transitionError(err error, fileID, status string) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code {
+	case "SD001":
+		return permanent(&TransitionError{FileID: fileID, Current: pqErr.Detail, Status: status, err: ErrStatusConflict})
+	case "SD002":
+		return permanent(&TransitionError{FileID: fileID, Current: pqErr.Detail, Status: status, err: ErrIllegalTransition})
+	case "P0002":
+		return sql.ErrNoRows
+	default:
+		return err
+	}
+}
+
+// CheckFileStatus tells whether the status of a file can be set to status,
+// without changing it. It returns a *TransitionError when it can not.
+func (dbs *SDAdb) CheckFileStatus(fileID, status string) error {
+	return dbs.retry(func() error {
+		return dbs.checkFileStatus(fileID, status)
+	})
+}
+func (dbs *SDAdb) checkFileStatus(fileID, status string) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 37 {
+		return nil
+	}
+
+	const query = "SELECT e.event, EXISTS (SELECT 1 FROM sda.file_event_transitions t WHERE t.from_event = e.event AND t.to_event = $2) " +
+		"FROM sda.file_event_log e WHERE e.file_id = $1 ORDER BY e.id DESC LIMIT 1;"
+	var current string
+	var allowed bool
+	err := dbs.DB.QueryRow(query, fileID, status).Scan(&current, &allowed)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	case !allowed:
+		return permanent(&TransitionError{FileID: fileID, Current: current, Status: status, err: ErrIllegalTransition})
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"errors"
+)
+
+// WebAuthnCredential is a WebAuthn credential, e.g. a passkey or security
+// key, that a user logs in with as a second factor
+type WebAuthnCredential struct {
+	// ID is the base64url encoded credential ID
+	ID     string
+	UserID string
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte
+	SignCount uint32
+}
+
+// AddWebAuthnCredential stores a credential that a user has registered
+func (dbs *SDAdb) AddWebAuthnCredential(cred WebAuthnCredential) error {
+	return dbs.retry(func() error {
+		return dbs.addWebAuthnCredential(cred)
+	})
+}
+func (dbs *SDAdb) addWebAuthnCredential(cred WebAuthnCredential) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 42 {
+		return errors.New("database schema v42 required for AddWebAuthnCredential()")
+	}
+
+	const query = "INSERT INTO sda.webauthn_credentials(id, user_id, public_key, sign_count) VALUES($1, $2, $3, $4);"
+	_, err := dbs.DB.Exec(query, cred.ID, cred.UserID, cred.PublicKey, int64(cred.SignCount))
+
+	return err
+}
+
+// GetWebAuthnCredentials returns the credentials that the user has
+// registered, oldest first
+func (dbs *SDAdb) GetWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+	return retryValue(dbs, func() ([]WebAuthnCredential, error) {
+		return dbs.getWebAuthnCredentials(userID)
+	})
+}
+func (dbs *SDAdb) getWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 42 {
+		return nil, errors.New("database schema v42 required for GetWebAuthnCredentials()")
+	}
+
+	const query = "SELECT id, user_id, public_key, sign_count FROM sda.webauthn_credentials WHERE user_id = $1 ORDER BY created_at;"
+	rows, err := dbs.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []WebAuthnCredential
+	for rows.Next() {
+		var cred WebAuthnCredential
+		var signCount int64
+		if err := rows.Scan(&cred.ID, &cred.UserID, &cred.PublicKey, &signCount); err != nil {
+			return nil, err
+		}
+		cred.SignCount = uint32(signCount) //nolint:gosec // the count is stored from an uint32
+
+		creds = append(creds, cred)
+	}
+
+	return creds, rows.Err()
+}
+
+// UseWebAuthnCredential records that the credential was used to log in,
+// with the signature counter reported by the authenticator
+func (dbs *SDAdb) UseWebAuthnCredential(id string, signCount uint32) error {
+	return dbs.retry(func() error {
+		return dbs.useWebAuthnCredential(id, signCount)
+	})
+}
+func (dbs *SDAdb) useWebAuthnCredential(id string, signCount uint32) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	if dbs.Version < 42 {
+		return errors.New("database schema v42 required for UseWebAuthnCredential()")
+	}
+
+	const query = "UPDATE sda.webauthn_credentials SET sign_count = $2, last_used = clock_timestamp() WHERE id = $1;"
+	result, err := dbs.DB.Exec(query, id, int64(signCount))
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return permanent(errors.New("no such credential"))
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+// Package events provides typed payloads for the messages sent between the
+// services. The payloads are the structs of the schema package, and are
+// validated against their JSON schema when they are marshaled and
+// unmarshaled, so that producers and consumers agree on the message format.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/schema"
+)
+
+type (
+	DatasetDeprecate          = schema.DatasetDeprecate
+	DatasetMapping            = schema.DatasetMapping
+	DatasetRelease            = schema.DatasetRelease
+	InboxRemove               = schema.InboxRemove
+	InboxRename               = schema.InboxRename
+	InboxUpload               = schema.InboxUpload
+	InfoError                 = schema.InfoError
+	IngestionAccession        = schema.IngestionAccession
+	IngestionAccessionRequest = schema.IngestionAccessionRequest
+	IngestionCompletion       = schema.IngestionCompletion
+	IngestionTrigger          = schema.IngestionTrigger
+	IngestionUserError        = schema.IngestionUserError
+	IngestionVerification     = schema.IngestionVerification
+	MissingFiles              = schema.MissingFiles
+	QuotaWarning              = schema.QuotaWarning
+	SyncDataset               = schema.SyncDataset
+	SyncMetadata              = schema.SyncMetadata
+)
+
+// Event is the set of message payloads that have a JSON schema
+type Event interface {
+	DatasetDeprecate | DatasetMapping | DatasetRelease |
+		InboxRemove | InboxRename | InboxUpload | InfoError |
+		IngestionAccession | IngestionAccessionRequest | IngestionCompletion |
+		IngestionTrigger | IngestionUserError | IngestionVerification |
+		MissingFiles | QuotaWarning | SyncDataset | SyncMetadata
+}
+
+// SchemaName returns the name of the JSON schema of an event, the schema is
+// found as <name>.json in the schemas folder of the deployment flavour
+func SchemaName[T Event]() string {
+	var event T
+	switch any(event).(type) {
+	case DatasetDeprecate:
+		return "dataset-deprecate"
+	case DatasetMapping:
+		return "dataset-mapping"
+	case DatasetRelease:
+		return "dataset-release"
+	case InboxRemove:
+		return "inbox-remove"
+	case InboxRename:
+		return "inbox-rename"
+	case InboxUpload:
+		return "inbox-upload"
+	case InfoError:
+		return "info-error"
+	case IngestionAccession:
+		return "ingestion-accession"
+	case IngestionAccessionRequest:
+		return "ingestion-accession-request"
+	case IngestionCompletion:
+		return "ingestion-completion"
+	case IngestionTrigger:
+		return "ingestion-trigger"
+	case IngestionUserError:
+		return "ingestion-user-error"
+	case IngestionVerification:
+		return "ingestion-verification"
+	case MissingFiles:
+		return "missing-files"
+	case QuotaWarning:
+		return "quota-warning"
+	case SyncDataset:
+		return "file-sync"
+	case SyncMetadata:
+		return "metadata-sync"
+	}
+
+	// not reached, every type of Event has a case above
+	panic(fmt.Sprintf("no schema for event %T", event))
+}
+
+// Marshal encodes an event as a message body, the body is validated against
+// the schema of the event in schemasPath
+func Marshal[T Event](schemasPath string, event T) ([]byte, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	if err := schema.ValidateJSON(schemaFile[T](schemasPath), body); err != nil {
+		return nil, fmt.Errorf("%s message failed validation: %w", SchemaName[T](), err)
+	}
+
+	return body, nil
+}
+
+// Unmarshal validates a message body against the schema of the event in
+// schemasPath and decodes it
+func Unmarshal[T Event](schemasPath string, body []byte) (T, error) {
+	var event T
+	if err := schema.ValidateJSON(schemaFile[T](schemasPath), body); err != nil {
+		return event, fmt.Errorf("%s message failed validation: %w", SchemaName[T](), err)
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return event, err
+	}
+
+	return event, nil
+}
+
+func schemaFile[T Event](schemasPath string) string {
+	return fmt.Sprintf("%s/%s.json", schemasPath, SchemaName[T]())
+}
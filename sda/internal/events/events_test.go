@@ -0,0 +1,129 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const schemasPath = "../../schemas"
+
+type event struct {
+	name string
+	typ  reflect.Type
+}
+
+// entry only compiles for the types in the Event type set
+func entry[T Event]() event {
+	return event{SchemaName[T](), reflect.TypeFor[T]()}
+}
+
+var allEvents = []event{
+	entry[DatasetDeprecate](),
+	entry[DatasetMapping](),
+	entry[DatasetRelease](),
+	entry[InboxRemove](),
+	entry[InboxRename](),
+	entry[InboxUpload](),
+	entry[InfoError](),
+	entry[IngestionAccession](),
+	entry[IngestionAccessionRequest](),
+	entry[IngestionCompletion](),
+	entry[IngestionTrigger](),
+	entry[IngestionUserError](),
+	entry[IngestionVerification](),
+	entry[MissingFiles](),
+	entry[QuotaWarning](),
+	entry[SyncDataset](),
+	entry[SyncMetadata](),
+}
+
+// jsonFields returns the names of the top level fields of a struct as they
+// are encoded
+func jsonFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		fields = append(fields, name)
+	}
+
+	return fields
+}
+
+// TestSchemaCoverage checks that every schema has an event and that every
+// event has a schema in at least one of the flavours
+func TestSchemaCoverage(t *testing.T) {
+	names := map[string]bool{}
+	for _, e := range allEvents {
+		assert.False(t, names[e.name], "schema %s is used by more than one event", e.name)
+		names[e.name] = true
+	}
+
+	files, err := filepath.Glob(schemasPath + "/*/*.json")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+
+	found := map[string]bool{}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".json")
+		assert.True(t, names[name], "schema %s has no event", f)
+		found[name] = true
+	}
+	for name := range names {
+		assert.True(t, found[name], "event %s has no schema", name)
+	}
+}
+
+// TestSchemaFields checks that the fields of the events agree with the
+// properties of their schemas
+func TestSchemaFields(t *testing.T) {
+	for _, e := range allEvents {
+		files, err := filepath.Glob(schemasPath + "/*/" + e.name + ".json")
+		assert.NoError(t, err)
+
+		fields := jsonFields(e.typ)
+		for _, f := range files {
+			raw, err := os.ReadFile(f)
+			assert.NoError(t, err)
+
+			var s struct {
+				Required   []string                   `json:"required"`
+				Properties map[string]json.RawMessage `json:"properties"`
+			}
+			assert.NoError(t, json.Unmarshal(raw, &s), "failed to decode %s", f)
+
+			for _, required := range s.Required {
+				assert.Contains(t, fields, required, "%s requires a field that %s lacks", f, e.typ.Name())
+			}
+			for _, field := range fields {
+				assert.Contains(t, s.Properties, field, "%s has a field that %s lacks", e.typ.Name(), f)
+			}
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	body, err := Marshal(schemasPath+"/isolated", MissingFiles{User: "submitter@example.org", Files: []string{"dir/file.c4gh"}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"user": "submitter@example.org", "files": ["dir/file.c4gh"]}`, string(body))
+
+	_, err = Marshal(schemasPath+"/isolated", MissingFiles{User: "submitter@example.org"})
+	assert.ErrorContains(t, err, "missing-files message failed validation")
+}
+
+func TestUnmarshal(t *testing.T) {
+	trigger, err := Unmarshal[IngestionTrigger](schemasPath+"/federated", []byte(`{"type": "ingest", "user": "submitter@example.org", "filepath": "dir/file.c4gh"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, IngestionTrigger{Type: "ingest", User: "submitter@example.org", FilePath: "dir/file.c4gh"}, trigger)
+
+	_, err = Unmarshal[IngestionTrigger](schemasPath+"/federated", []byte(`{"type": "ingest", "user": "submitter@example.org"}`))
+	assert.ErrorContains(t, err, "ingestion-trigger message failed validation")
+}
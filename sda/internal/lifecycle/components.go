@@ -0,0 +1,278 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/broker"
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/neicnordic/sensitive-data-archive/internal/metrics"
+	"github.com/neicnordic/sensitive-data-archive/internal/schema"
+	"github.com/neicnordic/sensitive-data-archive/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Database returns a component named "database" that connects to the
+// database when started and sets db to the connection. The schema
+// migrations are applied first when conf.Migrate is set, and the start
+// fails unless the schema reaches conf.RequiredVersion within
+// conf.SchemaWait. While running, the connections are renewed when the TLS
+// files of the connection change.
+func Database(conf database.DBConf, db **database.SDAdb) Component {
+	return Component{
+		Name: "database",
+		Start: func(context.Context) error {
+			var err error
+			*db, err = database.NewSDAdb(conf)
+			if err != nil {
+				return err
+			}
+			if conf.Migrate {
+				if err := (*db).Migrate(); err != nil {
+					return err
+				}
+			}
+
+			return (*db).WaitForVersion(conf.RequiredVersion, conf.SchemaWait)
+		},
+		Run: func(ctx context.Context) error {
+			(*db).WatchCerts(ctx)
+
+			return nil
+		},
+		Stop: func(context.Context) error {
+			(*db).Close()
+
+			return nil
+		},
+		Health: func() error {
+			return (*db).DB.Ping()
+		},
+	}
+}
+
+// Broker returns a component named "broker" that compiles the message
+// schemas in conf.SchemasPath and connects to the message broker when
+// started, and sets mq to the connection. When the server closes the
+// connection or the channel they are replaced, so that publishing and the
+// consumers started with Subscribe resume once the broker is back. The
+// connection is also replaced when its TLS files change. The service is
+// shut down when the primary host is back while connected to a standby
+// host, so that the restarted service connects to the primary again.
+func Broker(conf broker.MQConf, mq **broker.AMQPBroker) Component {
+	return Component{
+		Name: "broker",
+		Start: func(context.Context) error {
+			if conf.SchemasPath != "" {
+				if err := schema.Load(conf.SchemasPath); err != nil {
+					return err
+				}
+			}
+
+			var err error
+			*mq, err = broker.NewMQ(conf)
+
+			return err
+		},
+		Run: func(ctx context.Context) error {
+			go (*mq).WatchCerts(ctx)
+
+			var failback <-chan time.Time
+			if conf.FailbackInterval > 0 {
+				ticker := time.NewTicker(conf.FailbackInterval)
+				defer ticker.Stop()
+				failback = ticker.C
+			}
+
+			closed := watchBroker(*mq)
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case err := <-closed:
+					log.Warnf("lost the broker connection, reconnecting, reason: %v", err)
+					if err := (*mq).Reconnect(ctx); err != nil {
+						return nil
+					}
+					closed = watchBroker(*mq)
+				case <-failback:
+					if (*mq).OnStandby() && (*mq).PrimaryAvailable() {
+						return errors.New("primary broker is available again")
+					}
+				}
+			}
+		},
+		Stop: func(context.Context) error {
+			connection, channel := (*mq).Current()
+
+			return errors.Join(channel.Close(), connection.Close())
+		},
+		Health: func() error {
+			if (*mq).IsConnClosed() {
+				return errors.New("connection closed")
+			}
+
+			return nil
+		},
+	}
+}
+
+// QuarantineEvents makes mq record an error event for the file of each
+// message that it quarantines, the file is found by the correlation ID of
+// the message. Quarantined messages of no file are only logged.
+func QuarantineEvents(mq *broker.AMQPBroker, db *database.SDAdb, service string) {
+	mq.OnQuarantine = func(queue string, delivery amqp.Delivery) {
+		fileID, err := db.GetFileID(delivery.CorrelationId)
+		if err != nil {
+			log.Warnf("no file found for the quarantined message with correlation ID %s, reason: %v", delivery.CorrelationId, err)
+
+			return
+		}
+
+		details, _ := json.Marshal(map[string]string{
+			"error": "the message was delivered too many times and has been quarantined",
+			"queue": broker.QuarantineQueue(queue),
+		})
+		if err := db.SetFileStatus(fileID, "", "error", delivery.CorrelationId, service, string(details), string(delivery.Body)); err != nil {
+			log.Errorf("failed to record the quarantine of file %s, reason: %v", fileID, err)
+		}
+	}
+}
+
+// Deduplicate makes mq drop the messages that it has seen processed before,
+// remembering them in memory or in the database as set by mq.Conf.Dedup
+func Deduplicate(mq *broker.AMQPBroker, db *database.SDAdb) {
+	switch mq.Conf.Dedup {
+	case "memory":
+		mq.Dedup = broker.NewMemoryDeduplicator(mq.Conf.DedupTTL)
+	case "database":
+		mq.Dedup = db.MessageLog(mq.Conf.DedupTTL)
+	}
+}
+
+// watchBroker returns a channel that receives the reason the connection or
+// channel of mq was closed
+func watchBroker(mq *broker.AMQPBroker) <-chan error {
+	closed := make(chan error, 2)
+	go func() {
+		if err := mq.ConnectionWatcher(); err != nil {
+			closed <- err
+
+			return
+		}
+		closed <- errors.New("connection closed")
+	}()
+	go func() {
+		if err := mq.ChannelWatcher(); err != nil {
+			closed <- err
+
+			return
+		}
+		closed <- errors.New("channel closed")
+	}()
+
+	return closed
+}
+
+// HTTPServer returns a component that serves srv, over TLS when a
+// certificate and key are given, and shuts it down gracefully.
+func HTTPServer(name string, srv *http.Server, certFile, keyFile string) Component {
+	return Component{
+		Name: name,
+		Run: func(context.Context) error {
+			var err error
+			if certFile != "" && keyFile != "" {
+				err = srv.ListenAndServeTLS(certFile, keyFile)
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+
+			return err
+		},
+		Stop: func(ctx context.Context) error {
+			return srv.Shutdown(ctx)
+		},
+	}
+}
+
+// Metrics returns a component named "metrics" that serves the metrics of the
+// service at /metrics on address. Nothing is served when address is empty.
+func Metrics(address string) Component {
+	if address == "" {
+		return Component{Name: "metrics"}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	return HTTPServer("metrics", &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 20 * time.Second}, "", "")
+}
+
+// Tracing returns a component named "tracing" that exports the spans of the
+// service to the OTLP/HTTP endpoint of a collector, and the spans still
+// queued when the service stops. Nothing is recorded when endpoint is empty.
+func Tracing(endpoint, service string) Component {
+	if endpoint == "" {
+		return Component{Name: "tracing"}
+	}
+
+	return Component{
+		Name: "tracing",
+		Start: func(context.Context) error {
+			tracing.Configure(endpoint, service)
+
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			return tracing.Shutdown(ctx)
+		},
+	}
+}
+
+// Config returns a component named "config" that reads the configuration of
+// app again when the service is reloaded, or when one of the secret files it
+// was read from or the remote configuration changes, which applies the log
+// level, and passes it to apply. The running service keeps its
+// configuration when the new one is invalid.
+func Config(app string, apply func(*config.Config) error) Component {
+	var mu sync.Mutex
+	reload := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		conf, err := config.NewConfig(app)
+		if err != nil {
+			return err
+		}
+		if apply == nil {
+			return nil
+		}
+
+		return apply(conf)
+	}
+
+	return Component{
+		Name:   "config",
+		Reload: reload,
+		Run: func(ctx context.Context) error {
+			changed := func() {
+				if err := reload(); err != nil {
+					log.Errorf("failed to reload the configuration, reason: %v", err)
+				}
+			}
+			go config.WatchRemoteConfig(ctx, changed)
+			config.WatchSecretFiles(ctx, changed)
+
+			return ctx.Err()
+		},
+	}
+}
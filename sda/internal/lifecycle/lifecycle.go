@@ -0,0 +1,271 @@
+// Package lifecycle starts the components of a service, such as database and
+// broker connections, message consumers and HTTP servers, in dependency order
+// and stops them in the reverse order when the service shuts down.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultShutdownTimeout is how long the components are given to stop
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Component is a part of a service managed by the lifecycle Manager. All
+// functions are optional.
+type Component struct {
+	// Name identifies the component in dependency declarations and logs
+	Name string
+	// DependsOn lists the components that must be started before, and
+	// stopped after, this component
+	DependsOn []string
+	// Start is called in dependency order, the service is stopped if it fails
+	Start func(ctx context.Context) error
+	// Run is started in the background once the component has started. The
+	// service shuts down if Run returns before the shutdown has begun, the
+	// context is cancelled when the shutdown begins.
+	Run func(ctx context.Context) error
+	// Stop is called in reverse dependency order during shutdown
+	Stop func(ctx context.Context) error
+	// Health reports whether the component is working
+	Health func() error
+	// Reload applies the parts of the configuration that can change while
+	// the service runs, it is called when the service receives SIGHUP
+	Reload func() error
+}
+
+// Manager runs the components of a service
+type Manager struct {
+	ShutdownTimeout time.Duration
+
+	mu         sync.Mutex
+	components []*Component
+	started    map[string]bool
+	shutdown   chan struct{}
+	once       sync.Once
+	reloading  sync.Mutex
+}
+
+// New returns a Manager without any components
+func New() *Manager {
+	return &Manager{
+		ShutdownTimeout: DefaultShutdownTimeout,
+		started:         map[string]bool{},
+		shutdown:        make(chan struct{}),
+	}
+}
+
+// Add registers a component, components must be added before Run is called
+func (m *Manager) Add(components ...Component) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range components {
+		m.components = append(m.components, &components[i])
+	}
+}
+
+// Shutdown makes Run stop the components and return
+func (m *Manager) Shutdown() {
+	m.once.Do(func() { close(m.shutdown) })
+}
+
+// Reload calls Reload of the started components, one reload runs at a
+// time. The errors of all components are returned together.
+func (m *Manager) Reload() error {
+	m.reloading.Lock()
+	defer m.reloading.Unlock()
+
+	m.mu.Lock()
+	var components []*Component
+	for _, c := range m.components {
+		if c.Reload != nil && m.started[c.Name] {
+			components = append(components, c)
+		}
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, c := range components {
+		log.Debugf("reloading %s", c.Name)
+		if err := c.Reload(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Health returns the health of the started components that report it,
+// keyed by component name
+func (m *Manager) Health() map[string]error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	health := map[string]error{}
+	for _, c := range m.components {
+		if c.Health != nil && m.started[c.Name] {
+			health[c.Name] = c.Health()
+		}
+	}
+
+	return health
+}
+
+// Run starts the components in dependency order and blocks until the
+// service receives a termination signal, a component stops running or
+// Shutdown is called. The started components are then stopped in reverse
+// order, SIGHUP reloads the components instead. The returned error tells
+// why the service stopped, it is nil when the service was asked to stop.
+func (m *Manager) Run() error {
+	order, err := m.order()
+	if err != nil {
+		return err
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sigc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, len(order))
+	var started []*Component
+	var runErr error
+	for _, c := range order {
+		if c.Start != nil {
+			log.Debugf("starting %s", c.Name)
+			if err := c.Start(ctx); err != nil {
+				runErr = fmt.Errorf("failed to start %s: %w", c.Name, err)
+
+				break
+			}
+		}
+		started = append(started, c)
+		m.mu.Lock()
+		m.started[c.Name] = true
+		m.mu.Unlock()
+
+		if c.Run != nil {
+			go func(c *Component) {
+				err := c.Run(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				if err == nil {
+					err = errors.New("stopped unexpectedly")
+				}
+				errc <- fmt.Errorf("%s: %w", c.Name, err)
+			}(c)
+		}
+	}
+
+	if runErr == nil {
+		log.Info("all components started")
+		for {
+			select {
+			case s := <-sigc:
+				if s == syscall.SIGHUP {
+					log.Info("received SIGHUP, reloading")
+					if err := m.Reload(); err != nil {
+						log.Errorf("failed to reload, reason: %v", err)
+					}
+
+					continue
+				}
+				log.Infof("received %s, shutting down", s)
+			case runErr = <-errc:
+				log.Errorf("shutting down, reason: %v", runErr)
+			case <-m.shutdown:
+				log.Info("shutting down")
+			}
+
+			break
+		}
+	}
+	cancel()
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), m.ShutdownTimeout)
+	defer stopCancel()
+	for i := len(started) - 1; i >= 0; i-- {
+		c := started[i]
+		m.mu.Lock()
+		m.started[c.Name] = false
+		m.mu.Unlock()
+		if c.Stop == nil {
+			continue
+		}
+		log.Debugf("stopping %s", c.Name)
+		if err := c.Stop(stopCtx); err != nil {
+			log.Errorf("failed to stop %s, reason: %v", c.Name, err)
+		}
+	}
+
+	return runErr
+}
+
+// order sorts the components so that every component comes after its
+// dependencies, keeping the order they were added in where possible
+func (m *Manager) order() ([]*Component, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byName := map[string]*Component{}
+	for _, c := range m.components {
+		if c.Name == "" {
+			return nil, errors.New("component without a name")
+		}
+		if _, ok := byName[c.Name]; ok {
+			return nil, fmt.Errorf("component %s added twice", c.Name)
+		}
+		byName[c.Name] = c
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	order := make([]*Component, 0, len(m.components))
+
+	var visit func(c *Component) error
+	visit = func(c *Component) error {
+		switch state[c.Name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle at component %s", c.Name)
+		}
+		state[c.Name] = visiting
+		for _, dep := range c.DependsOn {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("component %s depends on unknown component %s", c.Name, dep)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[c.Name] = done
+		order = append(order, c)
+
+		return nil
+	}
+
+	for _, c := range m.components {
+		if err := visit(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
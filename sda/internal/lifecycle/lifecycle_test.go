@@ -0,0 +1,226 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder returns a component that records when it is started and stopped
+func recorder(name string, events *[]string, deps ...string) Component {
+	return Component{
+		Name:      name,
+		DependsOn: deps,
+		Start: func(context.Context) error {
+			*events = append(*events, "start "+name)
+
+			return nil
+		},
+		Stop: func(context.Context) error {
+			*events = append(*events, "stop "+name)
+
+			return nil
+		},
+	}
+}
+
+func TestRun_Order(t *testing.T) {
+	var events []string
+	m := New()
+	m.Add(
+		recorder("consumer", &events, "database", "broker"),
+		recorder("database", &events),
+		recorder("broker", &events),
+	)
+
+	go m.Shutdown()
+	assert.NoError(t, m.Run())
+	assert.Equal(t, []string{"start database", "start broker", "start consumer", "stop consumer", "stop broker", "stop database"}, events)
+}
+
+func TestRun_StartFailure(t *testing.T) {
+	var events []string
+	m := New()
+	failing := recorder("broker", &events, "database")
+	failing.Start = func(context.Context) error { return errors.New("connection refused") }
+	m.Add(recorder("database", &events), failing, recorder("consumer", &events, "broker"))
+
+	assert.EqualError(t, m.Run(), "failed to start broker: connection refused")
+	assert.Equal(t, []string{"start database", "stop database"}, events)
+}
+
+func TestRun_ComponentStops(t *testing.T) {
+	var events []string
+	m := New()
+	consumer := recorder("consumer", &events)
+	consumer.Run = func(context.Context) error { return errors.New("channel closed") }
+	m.Add(consumer)
+
+	assert.EqualError(t, m.Run(), "consumer: channel closed")
+	assert.Equal(t, []string{"start consumer", "stop consumer"}, events)
+
+	m = New()
+	m.Add(Component{Name: "consumer", Run: func(context.Context) error { return nil }})
+	assert.EqualError(t, m.Run(), "consumer: stopped unexpectedly")
+}
+
+func TestRun_ContextCancelledOnShutdown(t *testing.T) {
+	stopped := make(chan struct{})
+	m := New()
+	m.Add(Component{Name: "scheduler", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+
+		return ctx.Err()
+	}})
+
+	go m.Shutdown()
+	assert.NoError(t, m.Run())
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("run context was not cancelled")
+	}
+}
+
+func TestRun_InvalidDependencies(t *testing.T) {
+	var events []string
+	m := New()
+	m.Add(recorder("a", &events, "b"), recorder("b", &events, "a"))
+	assert.ErrorContains(t, m.Run(), "dependency cycle")
+
+	m = New()
+	m.Add(recorder("a", &events, "missing"))
+	assert.EqualError(t, m.Run(), "component a depends on unknown component missing")
+
+	m = New()
+	m.Add(recorder("a", &events), recorder("a", &events))
+	assert.EqualError(t, m.Run(), "component a added twice")
+	assert.Empty(t, events)
+}
+
+func TestHealth(t *testing.T) {
+	m := New()
+	m.Add(
+		Component{Name: "database", Health: func() error { return nil }},
+		Component{Name: "broker", Health: func() error { return errors.New("connection closed") }},
+		Component{Name: "consumer", DependsOn: []string{"database", "broker"}, Start: func(context.Context) error {
+			health := m.Health()
+			assert.NoError(t, health["database"])
+			assert.EqualError(t, health["broker"], "connection closed")
+			m.Shutdown()
+
+			return nil
+		}},
+	)
+	assert.Empty(t, m.Health(), "components that are not started should not report health")
+	assert.NoError(t, m.Run())
+	assert.Empty(t, m.Health())
+}
+
+func TestHTTPServer(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	srv := &http.Server{Addr: addr, ReadHeaderTimeout: time.Second, Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})}
+
+	m := New()
+	m.Add(HTTPServer("api", srv, "", ""), Component{Name: "check", DependsOn: []string{"api"}, Start: func(context.Context) error {
+		go func() {
+			defer m.Shutdown()
+			for i := 0; i < 50; i++ {
+				res, err := http.Get(fmt.Sprintf("http://%s/", addr))
+				if err != nil {
+					time.Sleep(20 * time.Millisecond)
+
+					continue
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusTeapot, res.StatusCode)
+
+				return
+			}
+			t.Error("server did not start")
+		}()
+
+		return nil
+	}})
+	assert.NoError(t, m.Run())
+
+	_, err = http.Get(fmt.Sprintf("http://%s/", addr))
+	assert.Error(t, err, "server should be shut down")
+}
+
+func TestMetrics(t *testing.T) {
+	disabled := Metrics("")
+	assert.Equal(t, "metrics", disabled.Name)
+	assert.Nil(t, disabled.Run)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	m := New()
+	m.Add(Metrics(addr), Component{Name: "check", DependsOn: []string{"metrics"}, Start: func(context.Context) error {
+		go func() {
+			defer m.Shutdown()
+			for i := 0; i < 50; i++ {
+				res, err := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+				if err != nil {
+					time.Sleep(20 * time.Millisecond)
+
+					continue
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				assert.Contains(t, res.Header.Get("Content-Type"), "text/plain")
+
+				return
+			}
+			t.Error("metrics server did not start")
+		}()
+
+		return nil
+	}})
+	assert.NoError(t, m.Run())
+}
+
+func TestReload(t *testing.T) {
+	var reloads []string
+	m := New()
+	m.Add(
+		Component{Name: "config", Reload: func() error {
+			reloads = append(reloads, "config")
+
+			return nil
+		}},
+		Component{Name: "server", DependsOn: []string{"config"}, Reload: func() error {
+			reloads = append(reloads, "server")
+
+			return errors.New("bad policy")
+		}},
+	)
+	assert.NoError(t, m.Reload(), "components that are not started should not be reloaded")
+	assert.Empty(t, reloads)
+
+	m.Add(Component{Name: "consumer", DependsOn: []string{"server"}, Start: func(context.Context) error {
+		assert.EqualError(t, m.Reload(), "server: bad policy")
+		m.Shutdown()
+
+		return nil
+	}})
+	assert.NoError(t, m.Run())
+	assert.Equal(t, []string{"config", "server"}, reloads)
+}
@@ -0,0 +1,236 @@
+// Package metrics collects counters and histograms of a service and serves
+// them in the Prometheus text exposition format, so that they can be scraped
+// from the metrics endpoint of each service.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of
+// histograms timing calls to other services
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric that can be written in the exposition format
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	collectors map[string]collector
+}{collectors: map[string]collector{}}
+
+// register adds a metric to the ones that are served, metrics are created
+// once when the package using them is initialised so a name used twice is
+// a programming error
+func register(name string, c collector) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.collectors[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	registry.collectors[name] = c
+}
+
+// Counter is a set of counters that only go up, one for each combination of
+// label values
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(name, c)
+
+	return c
+}
+
+// Inc adds one to the counter with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter with the given
+// label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := seriesKey(c.labels, labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, escapeHelp(c.help), c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(key, len(c.labels))), formatValue(c.values[key]))
+	}
+}
+
+// Histogram is a set of histograms, one for each combination of label values
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket
+// upper bounds, in increasing order, and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	register(name, h)
+
+	return h
+}
+
+// Observe adds a value to the histogram with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := seriesKey(h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeHelp(h.help), h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		values := splitKey(key, len(h.labels))
+		labels := append(slices.Clone(h.labels), "le")
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(slices.Clone(values), formatValue(bound))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(slices.Clone(values), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+// Write writes all registered metrics in the Prometheus text exposition
+// format, ordered by name
+func Write(w io.Writer) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, name := range sortedKeys(registry.collectors) {
+		registry.collectors[name].write(buf)
+	}
+
+	return buf.Flush()
+}
+
+// Handler serves the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			log.Debugf("failed to write metrics, reason: %v", err)
+		}
+	})
+}
+
+// seriesKey joins the label values into the key of a series, a wrong
+// number of values is a programming error
+func seriesKey(labels, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(labels), len(values)))
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+// splitKey returns the label values of a series
+func splitKey(key string, labels int) []string {
+	if labels == 0 {
+		return nil
+	}
+
+	return strings.Split(key, "\x00")
+}
+
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + `="` + escapeValue(values[i]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
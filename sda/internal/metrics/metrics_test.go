@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests by outcome", "path", "outcome")
+	c.Inc("/files", "success")
+	c.Inc("/files", "success")
+	c.Add(3, `/"quoted"`, "error")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	assert.Equal(t, "# HELP test_requests_total Requests by outcome\n"+
+		"# TYPE test_requests_total counter\n"+
+		`test_requests_total{path="/\"quoted\"",outcome="error"} 3`+"\n"+
+		`test_requests_total{path="/files",outcome="success"} 2`+"\n", buf.String())
+
+	assert.Panics(t, func() { c.Inc("/files") })
+	assert.Panics(t, func() { NewCounter("test_requests_total", "again") })
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Durations", []float64{0.1, 1}, "function")
+	h.Observe(0.05, "GetFile")
+	h.Observe(0.5, "GetFile")
+	h.Observe(2, "GetFile")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	assert.Equal(t, "# HELP test_duration_seconds Durations\n"+
+		"# TYPE test_duration_seconds histogram\n"+
+		`test_duration_seconds_bucket{function="GetFile",le="0.1"} 1`+"\n"+
+		`test_duration_seconds_bucket{function="GetFile",le="1"} 2`+"\n"+
+		`test_duration_seconds_bucket{function="GetFile",le="+Inf"} 3`+"\n"+
+		`test_duration_seconds_sum{function="GetFile"} 2.55`+"\n"+
+		`test_duration_seconds_count{function="GetFile"} 3`+"\n", buf.String())
+
+	unlabelled := NewHistogram("test_unlabelled_seconds", "Durations", []float64{1})
+	unlabelled.Observe(0.5)
+	buf.Reset()
+	unlabelled.write(&buf)
+	assert.Contains(t, buf.String(), `test_unlabelled_seconds_bucket{le="1"} 1`+"\n")
+	assert.Contains(t, buf.String(), "test_unlabelled_seconds_count 1\n")
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Handled").Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, w.Body.String(), "test_handler_total 1\n")
+}
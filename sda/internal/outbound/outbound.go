@@ -0,0 +1,133 @@
+// Package outbound sets up the HTTP clients that the services use to reach
+// other systems, such as OIDC providers, S3 and remote sync sites, with the
+// configured proxy and extra trusted CAs. This is needed in networks where
+// all traffic passes a TLS-intercepting proxy.
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Conf holds the proxy and CA settings of the outbound clients. Proxies that
+// are not set are taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+type Conf struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+	// CACerts are PEM files with CAs that are trusted in addition to the
+	// system CAs
+	CACerts []string
+}
+
+var current = struct {
+	sync.RWMutex
+	proxy   func(*url.URL) (*url.URL, error)
+	rootCAs *x509.CertPool
+}{}
+
+// Configure applies conf to the clients made by this package from now on
+func Configure(conf Conf) error {
+	env := httpproxy.FromEnvironment()
+	proxy := httpproxy.Config{HTTPProxy: conf.HTTPProxy, HTTPSProxy: conf.HTTPSProxy, NoProxy: conf.NoProxy}
+	if proxy.HTTPProxy == "" {
+		proxy.HTTPProxy = env.HTTPProxy
+	}
+	if proxy.HTTPSProxy == "" {
+		proxy.HTTPSProxy = env.HTTPSProxy
+	}
+	if proxy.NoProxy == "" {
+		proxy.NoProxy = env.NoProxy
+	}
+	for _, p := range []string{proxy.HTTPProxy, proxy.HTTPSProxy} {
+		if p == "" {
+			continue
+		}
+		if u, err := url.Parse(p); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy %q, expected a URL such as http://proxy:3128", p)
+		}
+	}
+
+	var rootCAs *x509.CertPool
+	if len(conf.CACerts) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			log.Errorf("failed to read system CAs: %v, using an empty pool as base", err)
+			pool = x509.NewCertPool()
+		}
+		for _, file := range conf.CACerts {
+			pem, err := os.ReadFile(file) // #nosec this file comes from our configuration
+			if err != nil {
+				return fmt.Errorf("failed to read CA file %s, reason: %v", file, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", file)
+			}
+		}
+		rootCAs = pool
+	}
+
+	current.Lock()
+	current.proxy = proxy.ProxyFunc()
+	current.rootCAs = rootCAs
+	current.Unlock()
+
+	return nil
+}
+
+// Proxy returns the proxy to use for req, or nil when it is sent directly.
+// It can be used as the Proxy of an http.Transport.
+func Proxy(req *http.Request) (*url.URL, error) {
+	current.RLock()
+	proxy := current.proxy
+	current.RUnlock()
+	if proxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	return proxy(req.URL)
+}
+
+// RootCAs returns the system CAs together with the extra trusted CAs, or
+// nil when no extra CAs are configured so that the system CAs are used
+func RootCAs() *x509.CertPool {
+	current.RLock()
+	defer current.RUnlock()
+
+	if current.rootCAs == nil {
+		return nil
+	}
+
+	return current.rootCAs.Clone()
+}
+
+// TLSConfig returns a TLS config that trusts the system CAs and the extra
+// trusted CAs
+func TLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: RootCAs(), MinVersion: tls.VersionTLS12}
+}
+
+// Transport returns a transport that goes through the configured proxy and
+// trusts the extra CAs
+func Transport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = Proxy
+	tr.TLSClientConfig = TLSConfig()
+
+	return tr
+}
+
+// Client returns a client using Transport, with the given timeout or none
+// when timeout is 0
+func Client(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: Transport(), Timeout: timeout}
+}
@@ -0,0 +1,54 @@
+package outbound
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy(t *testing.T) {
+	defer func() { _ = Configure(Conf{}) }()
+
+	assert.NoError(t, Configure(Conf{HTTPSProxy: "http://proxy:3128", NoProxy: "s3.internal"}))
+	req := httptest.NewRequest(http.MethodGet, "https://login.example.org/.well-known/openid-configuration", nil)
+	proxy, err := Proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy:3128", proxy.String())
+
+	req = httptest.NewRequest(http.MethodGet, "https://s3.internal/inbox", nil)
+	proxy, err = Proxy(req)
+	assert.NoError(t, err)
+	assert.Nil(t, proxy)
+
+	assert.ErrorContains(t, Configure(Conf{HTTPProxy: "proxy:3128:x"}), "invalid proxy")
+}
+
+func TestCACerts(t *testing.T) {
+	defer func() { _ = Configure(Conf{}) }()
+	certPath := t.TempDir()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer server.Close()
+
+	assert.NoError(t, Configure(Conf{}))
+	assert.Nil(t, RootCAs())
+	_, err := Client(0).Get(server.URL)
+	assert.ErrorContains(t, err, "certificate")
+
+	caFile := filepath.Join(certPath, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	assert.NoError(t, Configure(Conf{CACerts: []string{caFile}}))
+	res, err := Client(0).Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	assert.ErrorContains(t, Configure(Conf{CACerts: []string{filepath.Join(certPath, "missing.pem")}}), "failed to read CA file")
+	notPEM := filepath.Join(certPath, "ca.txt")
+	assert.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0600))
+	assert.EqualError(t, Configure(Conf{CACerts: []string{notPEM}}), "no certificates found in "+notPEM)
+}
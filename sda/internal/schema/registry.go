@@ -0,0 +1,89 @@
+package schema
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// CheckInterval is how often a compiled schema is checked against its file,
+// it is compiled again when the content of the file has changed
+var CheckInterval = time.Minute
+
+// compiled is a schema compiled from a file, with the checksum of the file
+type compiled struct {
+	schema  *jsonschema.Schema
+	sum     [sha256.Size]byte
+	checked time.Time
+}
+
+// registry caches the compiled schemas by file, so that the messages are
+// not validated against a schema that is read and compiled each time
+var registry = struct {
+	sync.RWMutex
+	schemas map[string]compiled
+}{schemas: map[string]compiled{}}
+
+// Load compiles the known schemas in dir ahead of their use, so that broken
+// schema files are found when the service starts
+func Load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if getStructName(file) == "" {
+			continue
+		}
+		if _, err := compiledSchema(file); err != nil {
+			return fmt.Errorf("failed to compile schema %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// compiledSchema returns the schema in file from the registry, compiling it
+// when it is not cached yet or when the file has changed since it was
+// compiled
+func compiledSchema(file string) (*jsonschema.Schema, error) {
+	file = filepath.Clean(file)
+
+	registry.RLock()
+	cached, ok := registry.schemas[file]
+	registry.RUnlock()
+	if ok && time.Since(cached.checked) < CheckInterval {
+		return cached.schema, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if !ok || sum != cached.sum {
+		compiler := jsonschema.NewCompiler()
+		compiler.Draft = jsonschema.Draft7
+		if err := compiler.AddResource(file, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		if cached.schema, err = compiler.Compile(file); err != nil {
+			return nil, err
+		}
+		cached.sum = sum
+	}
+	cached.checked = time.Now()
+
+	registry.Lock()
+	registry.schemas[file] = cached
+	registry.Unlock()
+
+	return cached.schema, nil
+}
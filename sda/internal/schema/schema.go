@@ -5,19 +5,16 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
-
-	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
+// ValidateJSON validates a message body against the schema in the reference
+// file, the compiled schema is cached
 func ValidateJSON(reference string, body []byte) error {
 	dest := getStructName(reference)
 	if dest == "" {
 		return fmt.Errorf("unknown reference schema")
 	}
-	compiler := jsonschema.NewCompiler()
-	compiler.Draft = jsonschema.Draft7
-
-	schema, err := compiler.Compile(reference)
+	schema, err := compiledSchema(reference)
 	if err != nil {
 		return err
 	}
@@ -62,6 +59,10 @@ func getStructName(path string) interface{} {
 		return new(IngestionUserError)
 	case "ingestion-verification":
 		return new(IngestionVerification)
+	case "quota-warning":
+		return new(QuotaWarning)
+	case "missing-files":
+		return new(MissingFiles)
 	case "file-sync":
 		return new(SyncDataset)
 	case "metadata-sync":
@@ -85,6 +86,8 @@ type DatasetMapping struct {
 	Type         string   `json:"type"`
 	DatasetID    string   `json:"dataset_id"`
 	AccessionIDs []string `json:"accession_ids"`
+	Actor        string   `json:"actor,omitempty"`
+	Source       string   `json:"source,omitempty"`
 }
 
 type DatasetRelease struct {
@@ -159,6 +162,18 @@ type IngestionVerification struct {
 	ReVerify           bool        `json:"re_verify"`
 }
 
+type QuotaWarning struct {
+	User      string `json:"user"`
+	Quota     int64  `json:"quota"`
+	Used      int64  `json:"used"`
+	Threshold int    `json:"threshold"`
+}
+
+type MissingFiles struct {
+	User  string   `json:"user"`
+	Files []string `json:"files"`
+}
+
 type SyncDataset struct {
 	DatasetID    string         `json:"dataset_id"`
 	DatasetFiles []DatasetFiles `json:"dataset_files"`
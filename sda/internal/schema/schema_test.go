@@ -3,6 +3,7 @@ package schema
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,6 +26,26 @@ func TestDefaultResponse(t *testing.T) {
 	assert.Equal(t, "unknown reference schema", err.Error())
 }
 
+func TestLoad(t *testing.T) {
+	assert.NoError(t, Load(schemaPath+"/federated"))
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dir+"/inbox-remove.json", []byte(`{"type": "object", "required": ["user"]}`), 0o600))
+	assert.NoError(t, Load(dir))
+	assert.Error(t, ValidateJSON(dir+"/inbox-remove.json", []byte(`{}`)))
+
+	// the cached schema is used until the file is checked again
+	interval := CheckInterval
+	defer func() { CheckInterval = interval }()
+	assert.NoError(t, os.WriteFile(dir+"/inbox-remove.json", []byte(`{"type": "object"}`), 0o600))
+	assert.Error(t, ValidateJSON(dir+"/inbox-remove.json", []byte(`{}`)))
+	CheckInterval = 0
+	assert.NoError(t, ValidateJSON(dir+"/inbox-remove.json", []byte(`{}`)))
+
+	assert.NoError(t, os.WriteFile(dir+"/inbox-rename.json", []byte(`{"type": 1}`), 0o600))
+	assert.ErrorContains(t, Load(dir), "failed to compile schema")
+}
+
 func TestValidateJSONDatasetDeprecate(t *testing.T) {
 	okMsg := DatasetMapping{
 		Type:      "deprecate",
@@ -339,6 +360,50 @@ func TestValidateJSONIngestionVerification(t *testing.T) {
 
 // test for isolated schemas
 
+func TestValidateJSONQuotaWarning(t *testing.T) {
+	okMsg := QuotaWarning{
+		User:      "JohnDoe",
+		Quota:     1000,
+		Used:      850,
+		Threshold: 80,
+	}
+
+	msg, _ := json.Marshal(okMsg)
+	assert.Nil(t, ValidateJSON(fmt.Sprintf("%s/federated/quota-warning.json", schemaPath), msg))
+	assert.Nil(t, ValidateJSON(fmt.Sprintf("%s/isolated/quota-warning.json", schemaPath), msg))
+
+	badMsg := QuotaWarning{
+		User:      "JohnDoe",
+		Quota:     1000,
+		Used:      850,
+		Threshold: 180,
+	}
+
+	msg, _ = json.Marshal(badMsg)
+	assert.Error(t, ValidateJSON(fmt.Sprintf("%s/federated/quota-warning.json", schemaPath), msg))
+	assert.Error(t, ValidateJSON(fmt.Sprintf("%s/isolated/quota-warning.json", schemaPath), msg))
+}
+
+func TestValidateJSONMissingFiles(t *testing.T) {
+	okMsg := MissingFiles{
+		User:  "JohnDoe",
+		Files: []string{"/JohnDoe/sample-01.bam.c4gh"},
+	}
+
+	msg, _ := json.Marshal(okMsg)
+	assert.Nil(t, ValidateJSON(fmt.Sprintf("%s/federated/missing-files.json", schemaPath), msg))
+	assert.Nil(t, ValidateJSON(fmt.Sprintf("%s/isolated/missing-files.json", schemaPath), msg))
+
+	badMsg := MissingFiles{
+		User:  "JohnDoe",
+		Files: []string{},
+	}
+
+	msg, _ = json.Marshal(badMsg)
+	assert.Error(t, ValidateJSON(fmt.Sprintf("%s/federated/missing-files.json", schemaPath), msg))
+	assert.Error(t, ValidateJSON(fmt.Sprintf("%s/isolated/missing-files.json", schemaPath), msg))
+}
+
 func TestValidateJSONIsloatedDatasetMapping(t *testing.T) {
 	okMsg := DatasetMapping{
 		Type:      "mapping",
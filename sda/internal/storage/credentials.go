@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported S3 credential providers
+const (
+	// StaticCredentials uses the access and secret key from the config
+	StaticCredentials = "static"
+	// FileCredentials re-reads the keys from a file, e.g. a mounted secret
+	FileCredentials = "file"
+	// DefaultCredentials uses the AWS default chain, which covers
+	// environment variables, IRSA web identity tokens and instance profiles
+	DefaultCredentials = "default"
+	// VaultCredentials requests dynamic credentials from a Vault AWS secrets engine
+	VaultCredentials = "vault"
+)
+
+// CredentialsConf configures where S3 credentials are fetched from
+type CredentialsConf struct {
+	Provider string
+	// File holds the keys for the file provider
+	File string
+	// Refresh is how often the file provider re-reads the file
+	Refresh time.Duration
+	Vault   VaultConf
+}
+
+// VaultConf configures the Vault credential provider
+type VaultConf struct {
+	Address string
+	// Path is the path of the credentials endpoint, e.g. aws/creds/inbox
+	Path string
+	// TokenFile holds the Vault token, it is re-read on every request so
+	// that it can be renewed by a Vault agent
+	TokenFile string
+}
+
+// credentialsFile is the format of both the credentials file and the data
+// returned by the Vault AWS secrets engine
+type credentialsFile struct {
+	AccessKey     string `json:"access_key"`
+	SecretKey     string `json:"secret_key"`
+	SecurityToken string `json:"security_token"`
+}
+
+// NewCredentialsProvider returns the credentials provider configured for the
+// S3 storage. Credentials that can expire are cached and refreshed
+// automatically before they expire.
+func NewCredentialsProvider(conf S3Conf) (aws.CredentialsProvider, error) {
+	switch conf.Credentials.Provider {
+	case "", StaticCredentials:
+		return credentials.NewStaticCredentialsProvider(conf.AccessKey, conf.SecretKey, ""), nil
+	case FileCredentials:
+		if conf.Credentials.File == "" {
+			return nil, fmt.Errorf("no credentials file given")
+		}
+		refresh := conf.Credentials.Refresh
+		if refresh <= 0 {
+			refresh = 5 * time.Minute
+		}
+
+		return aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(_ context.Context) (aws.Credentials, error) {
+			return readCredentialsFile(conf.Credentials.File, refresh)
+		})), nil
+	case DefaultCredentials:
+		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(conf.Region), config.WithHTTPClient(outbound.Client(30*time.Second)))
+		if err != nil {
+			return nil, err
+		}
+
+		return cfg.Credentials, nil
+	case VaultCredentials:
+		if conf.Credentials.Vault.Address == "" || conf.Credentials.Vault.Path == "" {
+			return nil, fmt.Errorf("vault address and path are required")
+		}
+		client := outbound.Client(30 * time.Second)
+
+		return aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return fetchVaultCredentials(ctx, client, conf.Credentials.Vault)
+		}), func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = time.Minute
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown credentials provider: %s", conf.Credentials.Provider)
+	}
+}
+
+// readCredentialsFile reads the keys from file, the credentials are marked
+// to expire after refresh so that the file is read again.
+func readCredentialsFile(path string, refresh time.Duration) (aws.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials file, reason: %v", err)
+	}
+
+	var c credentialsFile
+	if err := json.Unmarshal(data, &c); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to parse credentials file, reason: %v", err)
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return aws.Credentials{}, fmt.Errorf("credentials file %s is missing access_key or secret_key", path)
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     c.AccessKey,
+		SecretAccessKey: c.SecretKey,
+		SessionToken:    c.SecurityToken,
+		Source:          "file",
+		CanExpire:       true,
+		Expires:         time.Now().Add(refresh),
+	}, nil
+}
+
+// fetchVaultCredentials requests new credentials from Vault, they expire
+// when the lease runs out.
+func fetchVaultCredentials(ctx context.Context, client *http.Client, conf VaultConf) (aws.Credentials, error) {
+	token, err := os.ReadFile(conf.TokenFile)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read vault token, reason: %v", err)
+	}
+
+	url := strings.TrimSuffix(conf.Address, "/") + "/v1/" + strings.TrimPrefix(conf.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to get credentials from vault, reason: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return aws.Credentials{}, fmt.Errorf("vault returned status %d", res.StatusCode)
+	}
+
+	var secret struct {
+		LeaseDuration int             `json:"lease_duration"`
+		Data          credentialsFile `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to parse vault response, reason: %v", err)
+	}
+	if secret.Data.AccessKey == "" || secret.Data.SecretKey == "" {
+		return aws.Credentials{}, fmt.Errorf("vault response is missing access_key or secret_key")
+	}
+
+	log.Debugf("fetched S3 credentials from vault, lease duration %ds", secret.LeaseDuration)
+
+	return aws.Credentials{
+		AccessKeyID:     secret.Data.AccessKey,
+		SecretAccessKey: secret.Data.SecretKey,
+		SessionToken:    secret.Data.SecurityToken,
+		Source:          "vault",
+		CanExpire:       secret.LeaseDuration > 0,
+		Expires:         time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second),
+	}, nil
+}
@@ -18,11 +18,11 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 
@@ -165,6 +165,7 @@ type S3Conf struct {
 	CAcert            string
 	NonExistRetryTime time.Duration
 	Readypath         string
+	Credentials       CredentialsConf
 }
 
 func newS3Backend(conf S3Conf) (*s3Backend, error) {
@@ -192,9 +193,14 @@ func newS3Backend(conf S3Conf) (*s3Backend, error) {
 	return sb, nil
 }
 func NewS3Client(conf S3Conf) (*s3.Client, error) {
+	creds, err := NewCredentialsProvider(conf)
+	if err != nil {
+		return nil, err
+	}
+
 	s3cfg, err := config.LoadDefaultConfig(
 		context.TODO(),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(conf.AccessKey, conf.SecretKey, "")),
+		config.WithCredentialsProvider(creds),
 		config.WithHTTPClient(&http.Client{Transport: transportConfigS3(conf)}),
 	)
 	if err != nil {
@@ -340,11 +346,14 @@ func (sb *s3Backend) RemoveFile(filePath string) error {
 func transportConfigS3(conf S3Conf) http.RoundTripper {
 	cfg := new(tls.Config)
 
-	// Read system CAs
-	systemCAs, err := x509.SystemCertPool()
-	if err != nil {
-		log.Errorf("failed to read system CAs: %v, using an empty pool as base", err)
-		systemCAs = x509.NewCertPool()
+	// Read system CAs, with the extra trusted CAs of the outbound clients
+	systemCAs := outbound.RootCAs()
+	if systemCAs == nil {
+		var err error
+		if systemCAs, err = x509.SystemCertPool(); err != nil {
+			log.Errorf("failed to read system CAs: %v, using an empty pool as base", err)
+			systemCAs = x509.NewCertPool()
+		}
 	}
 
 	cfg.RootCAs = systemCAs
@@ -359,7 +368,7 @@ func transportConfigS3(conf S3Conf) http.RoundTripper {
 		}
 	}
 
-	return &http.Transport{TLSClientConfig: cfg, ForceAttemptHTTP2: true}
+	return &http.Transport{TLSClientConfig: cfg, Proxy: outbound.Proxy, ForceAttemptHTTP2: true}
 }
 
 type sftpBackend struct {
@@ -2,10 +2,13 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -153,6 +156,7 @@ func (suite *StorageTestSuite) SetupTest() {
 		"",
 		2 * time.Second,
 		"",
+		CredentialsConf{},
 	}
 
 	testSftpConf := SftpConf{
@@ -205,6 +209,63 @@ func (suite *StorageTestSuite) TestNewS3Client() {
 	assert.NotNil(suite.T(), c)
 }
 
+func (suite *StorageTestSuite) TestNewCredentialsProvider_File() {
+	credsFile := filepath.Join(suite.T().TempDir(), "credentials.json")
+	assert.NoError(suite.T(), os.WriteFile(credsFile, []byte(`{"access_key": "key1", "secret_key": "secret1"}`), 0600))
+
+	conf := S3Conf{Credentials: CredentialsConf{Provider: FileCredentials, File: credsFile, Refresh: time.Millisecond}}
+	provider, err := NewCredentialsProvider(conf)
+	assert.NoError(suite.T(), err)
+
+	creds, err := provider.Retrieve(context.TODO())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "key1", creds.AccessKeyID)
+
+	// Rotated keys are picked up once the cached credentials expire
+	assert.NoError(suite.T(), os.WriteFile(credsFile, []byte(`{"access_key": "key2", "secret_key": "secret2"}`), 0600))
+	time.Sleep(10 * time.Millisecond)
+	creds, err = provider.Retrieve(context.TODO())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "key2", creds.AccessKeyID)
+	assert.Equal(suite.T(), "secret2", creds.SecretAccessKey)
+
+	_, err = NewCredentialsProvider(S3Conf{Credentials: CredentialsConf{Provider: FileCredentials}})
+	assert.Error(suite.T(), err)
+	_, err = NewCredentialsProvider(S3Conf{Credentials: CredentialsConf{Provider: "unknown"}})
+	assert.Error(suite.T(), err)
+}
+
+func (suite *StorageTestSuite) TestNewCredentialsProvider_Vault() {
+	tokenFile := filepath.Join(suite.T().TempDir(), "token")
+	assert.NoError(suite.T(), os.WriteFile(tokenFile, []byte("vault-token\n"), 0600))
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" || r.URL.Path != "/v1/aws/creds/inbox" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		_, _ = w.Write([]byte(`{"lease_duration": 3600, "data": {"access_key": "vaultkey", "secret_key": "vaultsecret", "security_token": "session"}}`))
+	}))
+	defer vault.Close()
+
+	conf := S3Conf{Credentials: CredentialsConf{Provider: VaultCredentials, Vault: VaultConf{Address: vault.URL, Path: "aws/creds/inbox", TokenFile: tokenFile}}}
+	provider, err := NewCredentialsProvider(conf)
+	assert.NoError(suite.T(), err)
+
+	creds, err := provider.Retrieve(context.TODO())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "vaultkey", creds.AccessKeyID)
+	assert.Equal(suite.T(), "session", creds.SessionToken)
+	assert.True(suite.T(), creds.CanExpire)
+
+	conf.Credentials.Vault.Path = "aws/creds/archive"
+	provider, err = NewCredentialsProvider(conf)
+	assert.NoError(suite.T(), err)
+	_, err = provider.Retrieve(context.TODO())
+	assert.ErrorContains(suite.T(), err, "vault returned status 403")
+}
+
 func (suite *StorageTestSuite) TestCheckS3Bucket() {
 	s3, err := newS3Backend(testConf.S3)
 	assert.NoError(suite.T(), err)
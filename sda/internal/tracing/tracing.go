@@ -0,0 +1,357 @@
+// Package tracing records spans of the work done by a service, such as the
+// calls to the database functions, and exports them to an OpenTelemetry
+// collector with OTLP over HTTP in the JSON encoding. Traces are continued
+// from the W3C traceparent header of incoming requests, and the spans of a
+// submission share a trace through its correlation ID.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// batchSize is the largest number of spans exported in one request
+	batchSize = 512
+	// queueSize is the number of ended spans waiting for export, spans
+	// ended while the queue is full are dropped
+	queueSize = 4096
+	// exportInterval is how often the queued spans are exported
+	exportInterval = 5 * time.Second
+)
+
+// Kind tells how a span relates to other services, with the values of the
+// OTLP SpanKind
+type Kind int
+
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Consumer Kind = 5
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether the span context belongs to a trace
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{}
+}
+
+// Traceparent formats the span context as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	if !sc.IsValid() || sc.SpanID == [8]byte{} {
+		return SpanContext{}, false
+	}
+
+	return sc, true
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	correlationKey
+)
+
+// ContextWithRemote returns a context continuing the trace of a span in
+// another service
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey, sc)
+}
+
+// SpanContextFromContext returns the span the context is part of, the zero
+// span context when there is none
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanKey).(SpanContext)
+
+	return sc
+}
+
+// WithCorrelationID returns a context whose spans carry the correlation ID
+// of a submission. When the context is not part of a trace yet the trace ID
+// is taken from the correlation ID, so that the spans of all services
+// working on the submission end up in the same trace.
+func WithCorrelationID(ctx context.Context, corrID string) context.Context {
+	ctx = context.WithValue(ctx, correlationKey, corrID)
+	if SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	id, err := uuid.Parse(corrID)
+	if err != nil {
+		return ctx
+	}
+
+	return ContextWithRemote(ctx, SpanContext{TraceID: id})
+}
+
+// Span is a unit of work in a trace. A nil span is not recorded, so the
+// methods can be called whether tracing is enabled or not.
+type Span struct {
+	name       string
+	kind       Kind
+	sc         SpanContext
+	parent     [8]byte
+	start      time.Time
+	attributes map[string]string
+}
+
+// Start starts a span as a child of the span in ctx, or in a new trace, and
+// returns a context holding the new span. Nothing is recorded unless an
+// exporter has been configured.
+func Start(ctx context.Context, kind Kind, name string) (context.Context, *Span) {
+	if exporter.Load() == nil {
+		return ctx, nil
+	}
+
+	parent := SpanContextFromContext(ctx)
+	s := &Span{name: name, kind: kind, parent: parent.SpanID, start: time.Now(), attributes: map[string]string{}}
+	s.sc.TraceID = parent.TraceID
+	if !parent.IsValid() {
+		_, _ = rand.Read(s.sc.TraceID[:])
+	}
+	_, _ = rand.Read(s.sc.SpanID[:])
+	if corrID, ok := ctx.Value(correlationKey).(string); ok {
+		s.attributes["sda.correlation_id"] = corrID
+	}
+
+	return context.WithValue(ctx, spanKey, s.sc), s
+}
+
+// SetAttribute sets an attribute of the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// End ends the span, marking it as failed when err is not nil, and queues
+// it for export
+func (s *Span) End(err error) {
+	e := exporter.Load()
+	if s == nil || e == nil {
+		return
+	}
+
+	span := otlpSpan{
+		TraceID:   hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:    hex.EncodeToString(s.sc.SpanID[:]),
+		Name:      s.name,
+		Kind:      s.kind,
+		StartTime: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTime:   strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for key, value := range s.attributes {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+	}
+	if err != nil {
+		span.Status = otlpStatus{Code: 2, Message: err.Error()}
+	}
+
+	select {
+	case e.spans <- span:
+	default:
+		log.Debugf("span queue is full, dropping span %s", s.name)
+	}
+}
+
+var exporter atomic.Pointer[otlpExporter]
+
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	spans    chan otlpSpan
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Configure starts exporting the spans of the service to the OTLP/HTTP
+// traces endpoint of a collector, e.g. http://collector:4318/v1/traces
+func Configure(endpoint, service string) {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan otlpSpan, queueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if old := exporter.Swap(e); old != nil {
+		_ = old.shutdown(context.Background())
+	}
+	go e.run()
+}
+
+// Shutdown stops recording spans and exports the ones already ended
+func Shutdown(ctx context.Context) error {
+	e := exporter.Swap(nil)
+	if e == nil {
+		return nil
+	}
+
+	return e.shutdown(ctx)
+}
+
+func (e *otlpExporter) shutdown(ctx context.Context) error {
+	close(e.stop)
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := []otlpSpan{}
+	for {
+		select {
+		case span := <-e.spans:
+			if batch = append(batch, span); len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					e.export(batch)
+
+					return
+				}
+			}
+		}
+		e.export(batch)
+		batch = []otlpSpan{}
+	}
+}
+
+// export sends the spans to the collector, failures are only logged since
+// tracing must not affect the service
+func (e *otlpExporter) export(spans []otlpSpan) {
+	for len(spans) > 0 {
+		n := min(len(spans), batchSize)
+		if err := e.post(spans[:n]); err != nil {
+			log.Debugf("failed to export %d spans, reason: %v", n, err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (e *otlpExporter) post(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: e.service}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/neicnordic/sensitive-data-archive"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// The OTLP/JSON request, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         Kind            `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
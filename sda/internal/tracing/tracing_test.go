@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		assert.False(t, ok, "%q should not parse", invalid)
+	}
+}
+
+func TestWithCorrelationID(t *testing.T) {
+	ctx := WithCorrelationID(context.Background(), "4bf92f35-77b3-4da6-a3ce-929d0e0e4736")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", SpanContextFromContext(ctx).Traceparent()[3:35])
+
+	// an ongoing trace is kept
+	remote, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	ctx = WithCorrelationID(ContextWithRemote(context.Background(), remote), "4bf92f35-77b3-4da6-a3ce-929d0e0e4736")
+	assert.Equal(t, remote, SpanContextFromContext(ctx))
+
+	ctx = WithCorrelationID(context.Background(), "not-a-uuid")
+	assert.False(t, SpanContextFromContext(ctx).IsValid())
+}
+
+func TestExport(t *testing.T) {
+	// spans are not recorded without an exporter
+	_, span := Start(context.Background(), Internal, "unrecorded")
+	assert.Nil(t, span)
+	span.SetAttribute("key", "value")
+	span.End(nil)
+
+	received := make(chan otlpRequest, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		received <- req
+	}))
+	defer ts.Close()
+
+	Configure(ts.URL, "test")
+	remote, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	ctx, parent := Start(WithCorrelationID(ContextWithRemote(context.Background(), remote), "corr-id"), Server, "GET /files")
+	_, child := Start(ctx, Internal, "GetUserFiles")
+	child.SetAttribute("db.system", "postgresql")
+	child.End(errors.New("connection refused"))
+	parent.End(nil)
+	assert.NoError(t, Shutdown(context.Background()))
+
+	req := <-received
+	assert.Equal(t, "test", req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, 2, len(spans))
+
+	assert.Equal(t, "GetUserFiles", spans[0].Name)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[0].TraceID)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, 2, spans[0].Status.Code)
+	assert.Contains(t, spans[0].Attributes, otlpAttribute{Key: "sda.correlation_id", Value: otlpValue{StringValue: "corr-id"}})
+	assert.Contains(t, spans[0].Attributes, otlpAttribute{Key: "db.system", Value: otlpValue{StringValue: "postgresql"}})
+
+	assert.Equal(t, "GET /files", spans[1].Name)
+	assert.Equal(t, "b7ad6b7169203331", spans[1].ParentSpanID)
+	assert.Equal(t, Server, spans[1].Kind)
+	assert.Zero(t, spans[1].Status.Code)
+}
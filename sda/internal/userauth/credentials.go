@@ -0,0 +1,254 @@
+package userauth
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+)
+
+// sigV4Algorithm is the only request signing algorithm that is accepted
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+// maxRequestAge is how far the time that a request was signed at may be
+// from now, as for S3
+const maxRequestAge = 15 * time.Minute
+
+// CredentialStore holds the S3 credentials that users manage themselves
+type CredentialStore interface {
+	GetS3Credential(accessKey string) (database.S3Credential, error)
+}
+
+// ValidateFromCredentials is an Authenticator for requests signed with S3
+// credentials from a CredentialStore. Requests carrying a token are passed
+// on to Tokens, so that both kinds of clients can use the inbox.
+type ValidateFromCredentials struct {
+	Store  CredentialStore
+	Tokens Authenticator
+}
+
+// NewValidateFromCredentials returns a new ValidateFromCredentials
+func NewValidateFromCredentials(store CredentialStore, tokens Authenticator) *ValidateFromCredentials {
+	return &ValidateFromCredentials{Store: store, Tokens: tokens}
+}
+
+// Authenticate verifies the signature of the request with the secret key of
+// its access key, and returns a token with the owner of the credential as
+// subject. Since credentials are looked up for every request, revoked
+// credentials are refused at once.
+func (v *ValidateFromCredentials) Authenticate(r *http.Request) (jwt.Token, error) {
+	authStr := r.Header.Get("Authorization")
+	if r.Header.Get("X-Amz-Security-Token") != "" || !strings.HasPrefix(authStr, sigV4Algorithm+" ") {
+		return v.Tokens.Authenticate(r)
+	}
+
+	sig, err := parseSigV4Header(authStr)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := v.Store.GetS3Credential(sig.accessKey)
+	if err != nil {
+		return nil, fmt.Errorf("unknown access key %s", sig.accessKey)
+	}
+	if err := verifySigV4(r, sig, cred.SecretKey, time.Now()); err != nil {
+		return nil, err
+	}
+
+	token := jwt.New()
+	if err := token.Set(jwt.SubjectKey, cred.UserID); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// sigV4 is the parsed Authorization header of a signed request
+type sigV4 struct {
+	accessKey string
+	// scope is date/region/service/aws4_request
+	scope         string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     []byte
+}
+
+// parseSigV4Header parses an Authorization header such as
+// AWS4-HMAC-SHA256 Credential=AKID/20240101/eu-west-1/s3/aws4_request,
+// SignedHeaders=host;x-amz-date, Signature=abcdef
+func parseSigV4Header(authStr string) (sigV4, error) {
+	var sig sigV4
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(authStr, sigV4Algorithm+" "), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[0] == "" || scope[4] != "aws4_request" {
+		return sig, errors.New("malformed credential in the authorization header")
+	}
+	sig.accessKey = scope[0]
+	sig.scope = strings.Join(scope[1:], "/")
+	sig.date, sig.region, sig.service = scope[1], scope[2], scope[3]
+
+	if signedHeaders == "" {
+		return sig, errors.New("no signed headers in the authorization header")
+	}
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+	if !slices.Contains(sig.signedHeaders, "host") {
+		return sig, errors.New("the host header must be signed")
+	}
+
+	var err error
+	if sig.signature, err = hex.DecodeString(signature); err != nil || len(sig.signature) != sha256.Size {
+		return sig, errors.New("malformed signature in the authorization header")
+	}
+
+	return sig, nil
+}
+
+// verifySigV4 verifies the signature of the request made with secretKey, as
+// described in
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+// The chunk signatures of streaming uploads are not checked, the body is
+// protected by TLS.
+func verifySigV4(r *http.Request, sig sigV4, secretKey string, now time.Time) error {
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return errors.New("missing or malformed X-Amz-Date header")
+	}
+	if signedAt.Format("20060102") != sig.date {
+		return errors.New("the date of the credential scope does not match X-Amz-Date")
+	}
+	if signedAt.Before(now.Add(-maxRequestAge)) || signedAt.After(now.Add(maxRequestAge)) {
+		return errors.New("the request was not signed recently")
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return errors.New("missing X-Amz-Content-Sha256 header")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL.Path),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, sig.signedHeaders),
+		strings.Join(sig.signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, sig.scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), sig.date)
+	for _, part := range []string{sig.region, sig.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	if !hmac.Equal(hmacSHA256(key, stringToSign), sig.signature) {
+		return errors.New("the request signature does not match")
+	}
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// canonicalHeaders returns the signed headers of the request, one per line
+// with their values trimmed and joined by commas
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		// the server moves these headers out of the header map
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		default:
+			values = r.Header.Values(name)
+		}
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	return b.String()
+}
+
+// canonicalURI returns the encoded path of the request
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	return uriEncode(path, false)
+}
+
+// canonicalQuery returns the query parameters encoded and sorted by name and
+// value
+func canonicalQuery(query url.Values) string {
+	type param struct{ name, value string }
+	params := make([]param, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, param{uriEncode(name, true), uriEncode(value, true)})
+		}
+	}
+	slices.SortFunc(params, func(a, b param) int {
+		return cmp.Or(strings.Compare(a.name, b.name), strings.Compare(a.value, b.value))
+	})
+
+	encoded := make([]string, len(params))
+	for i, p := range params {
+		encoded[i] = p.name + "=" + p.value
+	}
+
+	return strings.Join(encoded, "&")
+}
+
+// uriEncode percent-encodes all but the unreserved characters, and slashes
+// unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
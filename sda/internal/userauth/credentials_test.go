@@ -0,0 +1,124 @@
+package userauth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neicnordic/sensitive-data-archive/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// emptyPayload is the SHA-256 hash of an empty body
+const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type CredentialsTest struct {
+	suite.Suite
+	auth *ValidateFromCredentials
+}
+
+// credentialStore is a CredentialStore in memory
+type credentialStore map[string]database.S3Credential
+
+func (s credentialStore) GetS3Credential(accessKey string) (database.S3Credential, error) {
+	cred, ok := s[accessKey]
+	if !ok {
+		return database.S3Credential{}, sql.ErrNoRows
+	}
+
+	return cred, nil
+}
+
+// tokenAuthenticator accepts all requests as the same user
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) Authenticate(_ *http.Request) (jwt.Token, error) {
+	token := jwt.New()
+	err := token.Set(jwt.SubjectKey, "token-user")
+
+	return token, err
+}
+
+func TestCredentialsTestSuite(t *testing.T) {
+	suite.Run(t, new(CredentialsTest))
+}
+
+func (suite *CredentialsTest) SetupTest() {
+	store := credentialStore{"ACCESSKEY": {AccessKey: "ACCESSKEY", SecretKey: "secret/key+1", UserID: "dummy@example.org"}}
+	suite.auth = NewValidateFromCredentials(store, tokenAuthenticator{})
+}
+
+// signedRequest returns a request to the inbox signed like S3 clients do
+func (suite *CredentialsTest) signedRequest(method, target, accessKey, secretKey string, signedAt time.Time) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("X-Amz-Content-Sha256", emptyPayload)
+	creds := aws.Credentials{AccessKeyID: accessKey, SecretAccessKey: secretKey}
+	// S3 paths are encoded once, by the client
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	err := signer.SignHTTP(context.Background(), creds, r, emptyPayload, "s3", "us-east-1", signedAt)
+	assert.NoError(suite.T(), err)
+
+	return r
+}
+
+func (suite *CredentialsTest) TestSignedRequest() {
+	for _, target := range []string{
+		"https://inbox.example.org/dummy_example.org/file.c4gh",
+		"https://inbox.example.org/dummy_example.org/dir%20with%20spaces/file%2B%21.c4gh",
+		"https://inbox.example.org/dummy_example.org/file.c4gh?uploads",
+		"https://inbox.example.org/dummy_example.org/file.c4gh?uploadId=a%2Fb&partNumber=2",
+		"https://inbox.example.org/?list-type=2&prefix=dummy_example.org%2F&delimiter=%2F",
+	} {
+		token, err := suite.auth.Authenticate(suite.signedRequest(http.MethodPut, target, "ACCESSKEY", "secret/key+1", time.Now()))
+		assert.NoError(suite.T(), err, target)
+		if err == nil {
+			assert.Equal(suite.T(), "dummy@example.org", token.Subject())
+		}
+	}
+}
+
+func (suite *CredentialsTest) TestRejectedRequest() {
+	target := "https://inbox.example.org/dummy_example.org/file.c4gh"
+
+	_, err := suite.auth.Authenticate(suite.signedRequest(http.MethodPut, target, "ACCESSKEY", "wrong", time.Now()))
+	assert.ErrorContains(suite.T(), err, "signature does not match")
+
+	_, err = suite.auth.Authenticate(suite.signedRequest(http.MethodPut, target, "REVOKED", "secret/key+1", time.Now()))
+	assert.ErrorContains(suite.T(), err, "unknown access key")
+
+	_, err = suite.auth.Authenticate(suite.signedRequest(http.MethodPut, target, "ACCESSKEY", "secret/key+1", time.Now().Add(-time.Hour)))
+	assert.ErrorContains(suite.T(), err, "not signed recently")
+
+	// the request is changed after it was signed
+	r := suite.signedRequest(http.MethodPut, target, "ACCESSKEY", "secret/key+1", time.Now())
+	r.URL.Path = "/other_user/file.c4gh"
+	_, err = suite.auth.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "signature does not match")
+
+	r = suite.signedRequest(http.MethodPut, target, "ACCESSKEY", "secret/key+1", time.Now())
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=ACCESSKEY/20240101/us-east-1/s3/aws4_request, SignedHeaders=x-amz-date, Signature=00")
+	_, err = suite.auth.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "host header must be signed")
+}
+
+func (suite *CredentialsTest) TestTokenRequest() {
+	// requests with a token are left to the token authenticator
+	r := suite.signedRequest(http.MethodPut, "https://inbox.example.org/token-user/file.c4gh", "token-user", "token-user", time.Now())
+	r.Header.Set("X-Amz-Security-Token", "token")
+	token, err := suite.auth.Authenticate(r)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "token-user", token.Subject())
+
+	r = httptest.NewRequest(http.MethodGet, "https://inbox.example.org/", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	token, err = suite.auth.Authenticate(r)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "token-user", token.Subject())
+}
@@ -2,16 +2,21 @@ package userauth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neicnordic/sensitive-data-archive/internal/outbound"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -23,16 +28,81 @@ type Authenticator interface {
 	Authenticate(r *http.Request) (jwt.Token, error)
 }
 
+// InboxPrefixesClaim is the claim of the tokens signed by auth that lists
+// the paths in the inbox that the user may upload under, assigned by the
+// groups of the user
+const InboxPrefixesClaim = "inbox_prefixes"
+
+// InboxPrefixes returns the inbox prefixes of the token, or nil when the
+// token has none
+func InboxPrefixes(token jwt.Token) []string {
+	claim, ok := token.Get(InboxPrefixesClaim)
+	if !ok {
+		return nil
+	}
+
+	var prefixes []string
+	switch claim := claim.(type) {
+	case []string:
+		prefixes = claim
+	case []any:
+		for _, prefix := range claim {
+			if prefix, ok := prefix.(string); ok {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	case string:
+		prefixes = []string{claim}
+	}
+
+	return prefixes
+}
+
+// SessionIDClaim is the claim of the tokens signed by auth with the ID of
+// the login session that the token was handed out for
+const SessionIDClaim = "sid"
+
+// RevocationList holds the IDs of the tokens and sessions that users have
+// revoked before the tokens expired
+type RevocationList interface {
+	IsTokenRevoked(tokenIDs ...string) (bool, error)
+}
+
 // ValidateFromToken is an Authenticator that reads the public key from
 // supplied file
 type ValidateFromToken struct {
 	Keyset jwk.Set
+	// Issuers lists the accepted values of the iss claim, any issuer is
+	// accepted when empty
+	Issuers []string
+	// Audiences lists the accepted values of the aud claim, the token must
+	// contain at least one of them. The audience is not checked when empty.
+	Audiences []string
+	// Algorithms lists the accepted signing algorithms, any algorithm
+	// matching the key is accepted when empty
+	Algorithms []string
+	// ClockSkew is the tolerance used when validating exp, iat and nbf
+	ClockSkew time.Duration
+	// MinRefreshInterval limits how often the JWKS endpoint is re-fetched
+	// when a token is signed with an unknown key
+	MinRefreshInterval time.Duration
+	// Revocations, when set, is asked whether the token or its session has
+	// been revoked, tokens are refused when it can not be asked
+	Revocations RevocationList
+
+	// jwksURL is the endpoint the keys were fetched from, if any
+	jwksURL string
+	// localKeys are the keys read from disk, they are kept when the keys
+	// from jwksURL are refreshed
+	localKeys []jwk.Key
+	lastFetch time.Time
+	mu        sync.RWMutex
 }
 
 // NewValidateFromToken returns a new ValidateFromToken, reading the key from
 // the supplied file.
 func NewValidateFromToken(keyset jwk.Set) *ValidateFromToken {
-	return &ValidateFromToken{keyset}
+	return &ValidateFromToken{Keyset: keyset, MinRefreshInterval: time.Minute}
 }
 
 // Authenticate verifies that the token included in the http.Request is valid
@@ -48,7 +118,7 @@ func (u *ValidateFromToken) Authenticate(r *http.Request) (jwt.Token, error) {
 		if tokenStr == "" {
 			return nil, fmt.Errorf("no access token supplied")
 		}
-		token, err := jwt.Parse([]byte(tokenStr), jwt.WithKeySet(u.Keyset, jws.WithInferAlgorithmFromKey(true)), jwt.WithValidate(true))
+		token, err := u.parseToken(tokenStr)
 		if err != nil {
 			return nil, err
 		}
@@ -66,7 +136,7 @@ func (u *ValidateFromToken) Authenticate(r *http.Request) (jwt.Token, error) {
 		if err != nil {
 			return nil, fmt.Errorf("auth header not valid: %s, (header was %s)", err.Error(), authStr)
 		}
-		token, err := jwt.Parse([]byte(tokenStr), jwt.WithKeySet(u.Keyset, jws.WithInferAlgorithmFromKey(true)), jwt.WithValidate(true))
+		token, err := u.parseToken(tokenStr)
 		if err != nil {
 			return nil, fmt.Errorf("signed token not valid: %s, (token was %s)", err.Error(), tokenStr)
 		}
@@ -84,6 +154,195 @@ func (u *ValidateFromToken) Authenticate(r *http.Request) (jwt.Token, error) {
 	}
 }
 
+// parseToken verifies the signature of the token and validates its claims
+// against the configured issuers, audiences, algorithms and clock skew
+func (u *ValidateFromToken) parseToken(tokenStr string) (jwt.Token, error) {
+	u.mu.RLock()
+	issuers, audiences, algorithms := u.Issuers, u.Audiences, u.Algorithms
+	u.mu.RUnlock()
+
+	if len(algorithms) > 0 {
+		msg, err := jws.Parse([]byte(tokenStr))
+		if err != nil {
+			return nil, err
+		}
+		for _, sig := range msg.Signatures() {
+			alg := sig.ProtectedHeaders().Algorithm().String()
+			if !slices.Contains(algorithms, alg) {
+				return nil, fmt.Errorf("signing algorithm %s is not allowed", alg)
+			}
+		}
+	}
+
+	token, err := u.verifyToken(tokenStr)
+	if err != nil && u.unknownKey(tokenStr) {
+		// The provider may have rotated its keys, fetch them again and retry
+		if refreshErr := u.refreshKeys(false); refreshErr != nil {
+			log.Warnf("failed to refresh keys from %s, reason: %v", u.jwksURL, refreshErr)
+		} else {
+			token, err = u.verifyToken(tokenStr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(issuers) > 0 && !slices.Contains(issuers, token.Issuer()) {
+		return nil, fmt.Errorf("issuer %s is not allowed", token.Issuer())
+	}
+
+	if len(audiences) > 0 && !slices.ContainsFunc(token.Audience(), func(aud string) bool { return slices.Contains(audiences, aud) }) {
+		return nil, fmt.Errorf("token audience %v does not match any of %v", token.Audience(), audiences)
+	}
+
+	if err := u.checkRevoked(token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// checkRevoked returns an error when the token, by its jti claim, or its
+// session, by the sid claim, has been revoked
+func (u *ValidateFromToken) checkRevoked(token jwt.Token) error {
+	if u.Revocations == nil {
+		return nil
+	}
+
+	var ids []string
+	if token.JwtID() != "" {
+		ids = append(ids, token.JwtID())
+	}
+	if sid, ok := token.Get(SessionIDClaim); ok {
+		if sid, ok := sid.(string); ok && sid != "" {
+			ids = append(ids, sid)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	revoked, err := u.Revocations.IsTokenRevoked(ids...)
+	if err != nil {
+		return fmt.Errorf("failed to check if the token has been revoked: %v", err)
+	}
+	if revoked {
+		return errors.New("the token has been revoked")
+	}
+
+	return nil
+}
+
+func (u *ValidateFromToken) verifyToken(tokenStr string) (jwt.Token, error) {
+	u.mu.RLock()
+	keyset, clockSkew := u.Keyset, u.ClockSkew
+	u.mu.RUnlock()
+
+	return jwt.Parse([]byte(tokenStr), jwt.WithKeySet(keyset, jws.WithInferAlgorithmFromKey(true)), jwt.WithValidate(true), jwt.WithAcceptableSkew(clockSkew))
+}
+
+// SetClaimsPolicy replaces the accepted issuers, audiences, algorithms and
+// the clock skew, tokens may be validated meanwhile
+func (u *ValidateFromToken) SetClaimsPolicy(issuers, audiences, algorithms []string, clockSkew time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.Issuers, u.Audiences, u.Algorithms, u.ClockSkew = issuers, audiences, algorithms, clockSkew
+}
+
+// unknownKey reports whether the token is signed with a key id that is not
+// in the key set while the keys can be re-fetched from a JWKS endpoint
+func (u *ValidateFromToken) unknownKey(tokenStr string) bool {
+	if u.jwksURL == "" {
+		return false
+	}
+
+	msg, err := jws.Parse([]byte(tokenStr))
+	if err != nil {
+		return false
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, sig := range msg.Signatures() {
+		kid := sig.ProtectedHeaders().KeyID()
+		if _, found := u.Keyset.LookupKeyID(kid); kid != "" && !found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RefreshJwtPubKeyURL periodically re-fetches the keys from the JWKS endpoint
+// until the context is cancelled, so that rotated keys are picked up.
+func (u *ValidateFromToken) RefreshJwtPubKeyURL(ctx context.Context, interval time.Duration) {
+	if u.jwksURL == "" || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := u.refreshKeys(true); err != nil {
+					log.Warnf("failed to refresh keys from %s, reason: %v", u.jwksURL, err)
+				}
+			}
+		}
+	}()
+}
+
+// refreshKeys fetches the keys from the JWKS endpoint and replaces the key
+// set, keeping the keys read from disk. Unless forced, the keys are not
+// fetched again within MinRefreshInterval.
+func (u *ValidateFromToken) refreshKeys(force bool) error {
+	// the keys are fetched without holding the lock, so that tokens can be
+	// verified with the current keys in the meantime
+	u.mu.Lock()
+	if !force && time.Since(u.lastFetch) < u.MinRefreshInterval {
+		u.mu.Unlock()
+
+		return fmt.Errorf("keys were refreshed less than %s ago", u.MinRefreshInterval)
+	}
+	u.lastFetch = time.Now()
+	u.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	keyset, err := jwk.Fetch(ctx, u.jwksURL, jwk.WithHTTPClient(outbound.Client(0)))
+	if err != nil {
+		return fmt.Errorf("jwk.Fetch failed (%v) for %s", err, u.jwksURL)
+	}
+
+	for it := keyset.Keys(ctx); it.Next(ctx); {
+		pair := it.Pair()
+		key := pair.Value.(jwk.Key)
+		if err := jwk.AssignKeyID(key); err != nil {
+			return fmt.Errorf("AssignKeyID failed: %v", err)
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, key := range u.localKeys {
+		if err := keyset.AddKey(key); err != nil {
+			return fmt.Errorf("failed to add key to set: %v", err)
+		}
+	}
+
+	log.Debugf("fetched %d keys from %s", keyset.Len(), u.jwksURL)
+	u.Keyset = keyset
+
+	return nil
+}
+
 // Function for reading the ega key in []byte
 func (u *ValidateFromToken) ReadJwtPubKeyPath(jwtpubkeypath string) error {
 	err := filepath.Walk(jwtpubkeypath,
@@ -107,9 +366,12 @@ func (u *ValidateFromToken) ReadJwtPubKeyPath(jwtpubkeypath string) error {
 					return fmt.Errorf("assignKeyID failed: %v", err)
 				}
 
+				u.mu.Lock()
+				defer u.mu.Unlock()
 				if err := u.Keyset.AddKey(key); err != nil {
 					return fmt.Errorf("failed to add key to set: %v", err)
 				}
+				u.localKeys = append(u.localKeys, key)
 			}
 
 			return nil
@@ -132,24 +394,9 @@ func (u *ValidateFromToken) FetchJwtPubKeyURL(jwtpubkeyurl string) error {
 		return fmt.Errorf("jwtpubkeyurl is not a proper URL (%s)", jwkURL)
 	}
 	log.Info("jwkURL: ", jwtpubkeyurl)
+	u.jwksURL = jwtpubkeyurl
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	u.Keyset, err = jwk.Fetch(ctx, jwtpubkeyurl)
-	if err != nil {
-		return fmt.Errorf("jwk.Fetch failed (%v) for %s", err, jwtpubkeyurl)
-	}
-
-	for it := u.Keyset.Keys(context.Background()); it.Next(context.Background()); {
-		pair := it.Pair()
-		key := pair.Value.(jwk.Key)
-		if err := jwk.AssignKeyID(key); err != nil {
-			return fmt.Errorf("AssignKeyID failed: %v", err)
-		}
-	}
-
-	return nil
+	return u.refreshKeys(true)
 }
 
 func readTokenFromHeader(authStr string) (string, error) {
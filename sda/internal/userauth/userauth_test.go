@@ -1,13 +1,21 @@
 package userauth
 
 import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"runtime"
+	"slices"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,7 +25,9 @@ import (
 
 	"crypto/rand"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/minio/minio-go/v6/pkg/signer"
 	"github.com/neicnordic/sensitive-data-archive/internal/helper"
 	"github.com/stretchr/testify/assert"
@@ -174,6 +184,82 @@ func (suite *UserAuthTest) TestUserTokenAuthenticator_GoodURL() {
 	assert.Equal(suite.T(), 3, a.Keyset.Len())
 }
 
+func (suite *UserAuthTest) TestUserTokenAuthenticator_KeyRotation() {
+	newKey := func(kid string) (jwk.Key, jwk.Key) {
+		raw, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(suite.T(), err)
+		private, err := jwk.FromRaw(raw)
+		assert.NoError(suite.T(), err)
+		assert.NoError(suite.T(), private.Set(jwk.KeyIDKey, kid))
+		assert.NoError(suite.T(), private.Set(jwk.AlgorithmKey, jwa.RS256))
+		public, err := private.PublicKey()
+		assert.NoError(suite.T(), err)
+
+		return private, public
+	}
+	oldPrivate, oldPublic := newKey("old")
+	newPrivate, newPublic := newKey("new")
+
+	var mu sync.Mutex
+	served := jwk.NewSet()
+	assert.NoError(suite.T(), served.AddKey(oldPublic))
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = json.NewEncoder(w).Encode(served)
+	}))
+	defer jwks.Close()
+
+	a := NewValidateFromToken(jwk.NewSet())
+	assert.NoError(suite.T(), a.FetchJwtPubKeyURL(jwks.URL))
+
+	sign := func(key jwk.Key) *http.Request {
+		token := jwt.New()
+		assert.NoError(suite.T(), token.Set(jwt.IssuerKey, "https://dummy.ega.nbis.se"))
+		assert.NoError(suite.T(), token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour)))
+		signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, key))
+		assert.NoError(suite.T(), err)
+		r, _ := http.NewRequest("", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+string(signed))
+
+		return r
+	}
+
+	_, err := a.Authenticate(sign(oldPrivate))
+	assert.NoError(suite.T(), err)
+
+	// The provider rotates its keys
+	mu.Lock()
+	served = jwk.NewSet()
+	assert.NoError(suite.T(), served.AddKey(newPublic))
+	mu.Unlock()
+
+	// Refresh is rate limited
+	_, err = a.Authenticate(sign(newPrivate))
+	assert.Error(suite.T(), err)
+
+	// Unknown key id triggers a refresh
+	a.MinRefreshInterval = 0
+	_, err = a.Authenticate(sign(newPrivate))
+	assert.NoError(suite.T(), err)
+	_, err = a.Authenticate(sign(oldPrivate))
+	assert.Error(suite.T(), err)
+
+	// Periodic refresh
+	mu.Lock()
+	assert.NoError(suite.T(), served.AddKey(oldPublic))
+	mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.RefreshJwtPubKeyURL(ctx, 10*time.Millisecond)
+	assert.Eventually(suite.T(), func() bool {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+
+		return a.Keyset.Len() == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
 func (suite *UserAuthTest) TestUserTokenAuthenticator_ValidateSignature_RSA() {
 	// These tests should be possible to reuse with all correct authenticators somehow
 
@@ -271,6 +357,61 @@ func (suite *UserAuthTest) TestUserTokenAuthenticator_ValidateSignature_RSA() {
 	defer os.RemoveAll(demoKeysPath)
 }
 
+func (suite *UserAuthTest) TestUserTokenAuthenticator_ValidateClaims() {
+	demoKeysPath := "demo-rsa-keys"
+	prKeyPath, pubKeyPath, err := helper.MakeFolder(demoKeysPath)
+	assert.NoError(suite.T(), err)
+	defer os.RemoveAll(demoKeysPath)
+
+	err = helper.CreateRSAkeys(prKeyPath, pubKeyPath)
+	assert.NoError(suite.T(), err)
+
+	a := NewValidateFromToken(jwk.NewSet())
+	assert.NoError(suite.T(), a.ReadJwtPubKeyPath(demoKeysPath+"/public-key/"))
+
+	prKeyParsed, err := helper.ParsePrivateRSAKey(prKeyPath, "/rsa")
+	assert.NoError(suite.T(), err)
+
+	token, err := helper.CreateRSAToken(prKeyParsed, "RS256", helper.WrongUserClaims)
+	assert.NoError(suite.T(), err)
+
+	r, _ := http.NewRequest("", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	// Matching issuer, audience and algorithm
+	a.Issuers = []string{"https://other.example.org", "https://dummy.ega.nbis.se"}
+	a.Audiences = []string{"15137645-3153-4d49-9ddb-594027cd4ca7"}
+	a.Algorithms = []string{"RS256", "ES256"}
+	_, err = a.Authenticate(r)
+	assert.NoError(suite.T(), err)
+
+	a.Issuers = []string{"https://other.example.org"}
+	_, err = a.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "issuer https://dummy.ega.nbis.se is not allowed")
+
+	a.Issuers = nil
+	a.Audiences = []string{"other-client"}
+	_, err = a.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "does not match any of [other-client]")
+
+	a.Audiences = nil
+	a.Algorithms = []string{"ES256"}
+	_, err = a.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "signing algorithm RS256 is not allowed")
+
+	// Token issued in the future is accepted within the clock skew
+	a.Algorithms = nil
+	future, err := helper.CreateRSAToken(prKeyParsed, "RS256", helper.NonValidClaims)
+	assert.NoError(suite.T(), err)
+	r.Header.Set("Authorization", "Bearer "+future)
+	_, err = a.Authenticate(r)
+	assert.Error(suite.T(), err)
+
+	a.ClockSkew = 3 * time.Hour
+	_, err = a.Authenticate(r)
+	assert.NoError(suite.T(), err)
+}
+
 func (suite *UserAuthTest) TestUserTokenAuthenticator_ValidateSignature_EC() {
 	// Create temp demo ec key pair
 	demoKeysPath := "demo-ec-keys"
@@ -436,3 +577,73 @@ func TestGetBearerToken(t *testing.T) {
 	_, err = readTokenFromHeader(authHeader)
 	assert.EqualError(t, err, "authorization scheme must be bearer")
 }
+
+func (suite *UserAuthTest) TestInboxPrefixes() {
+	token := jwt.New()
+	assert.Nil(suite.T(), InboxPrefixes(token))
+
+	assert.NoError(suite.T(), token.Set(InboxPrefixesClaim, []string{"project-a", "project-b"}))
+	assert.Equal(suite.T(), []string{"project-a", "project-b"}, InboxPrefixes(token))
+
+	// parsed tokens have the claim as a list of any
+	assert.NoError(suite.T(), token.Set(InboxPrefixesClaim, []any{"project-a", 1}))
+	assert.Equal(suite.T(), []string{"project-a"}, InboxPrefixes(token))
+}
+
+// revocationList is a RevocationList in memory
+type revocationList struct {
+	revoked []string
+	err     error
+}
+
+func (l revocationList) IsTokenRevoked(tokenIDs ...string) (bool, error) {
+	for _, id := range tokenIDs {
+		if slices.Contains(l.revoked, id) {
+			return true, l.err
+		}
+	}
+
+	return false, l.err
+}
+
+func (suite *UserAuthTest) TestUserTokenAuthenticator_Revoked() {
+	demoKeysPath := "demo-rsa-keys"
+	prKeyPath, pubKeyPath, err := helper.MakeFolder(demoKeysPath)
+	assert.NoError(suite.T(), err)
+	defer os.RemoveAll(demoKeysPath)
+
+	err = helper.CreateRSAkeys(prKeyPath, pubKeyPath)
+	assert.NoError(suite.T(), err)
+
+	a := NewValidateFromToken(jwk.NewSet())
+	assert.NoError(suite.T(), a.ReadJwtPubKeyPath(demoKeysPath+"/public-key/"))
+
+	prKeyParsed, err := helper.ParsePrivateRSAKey(prKeyPath, "/rsa")
+	assert.NoError(suite.T(), err)
+
+	claims := maps.Clone(helper.DefaultTokenClaims)
+	claims["jti"] = "token-1"
+	claims[SessionIDClaim] = "session-1"
+	token, err := helper.CreateRSAToken(prKeyParsed, "RS256", claims)
+	assert.NoError(suite.T(), err)
+
+	r, _ := http.NewRequest("", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	a.Revocations = revocationList{revoked: []string{"token-2", "session-2"}}
+	_, err = a.Authenticate(r)
+	assert.NoError(suite.T(), err)
+
+	a.Revocations = revocationList{revoked: []string{"token-1"}}
+	_, err = a.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "revoked")
+
+	a.Revocations = revocationList{revoked: []string{"session-1"}}
+	_, err = a.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "revoked")
+
+	// tokens are refused when the revocations can not be checked
+	a.Revocations = revocationList{err: errors.New("database down")}
+	_, err = a.Authenticate(r)
+	assert.ErrorContains(suite.T(), err, "failed to check")
+}
@@ -0,0 +1,171 @@
+// Package validator runs external validator plugins, like antivirus scanners
+// or format checkers, against the decrypted content of ingested files.
+package validator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	PolicyRequired = "required"
+	PolicyAdvisory = "advisory"
+	PolicyDisabled = "disabled"
+)
+
+type plugin struct {
+	conf   config.ValidatorConf
+	conn   *grpc.ClientConn
+	client ValidatorClient
+}
+
+// Manager holds the connections to the configured validator plugins
+type Manager struct {
+	plugins []*plugin
+}
+
+// NewManager connects to all plugins that are not disabled
+func NewManager(confs []config.ValidatorConf) (*Manager, error) {
+	m := &Manager{}
+	for _, c := range confs {
+		if c.Policy == PolicyDisabled {
+			log.Infof("validator plugin %s is disabled", c.Name)
+
+			continue
+		}
+
+		creds := insecure.NewCredentials()
+		if c.CACert != "" {
+			tlsCreds, err := credentials.NewClientTLSFromFile(c.CACert, "")
+			if err != nil {
+				m.Close()
+
+				return nil, fmt.Errorf("failed to load CA certificate for validator %s: %v", c.Name, err)
+			}
+			creds = tlsCreds
+		}
+
+		conn, err := grpc.NewClient(c.Address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			m.Close()
+
+			return nil, fmt.Errorf("failed to create client for validator %s: %v", c.Name, err)
+		}
+
+		m.plugins = append(m.plugins, &plugin{conf: c, conn: conn, client: NewValidatorClient(conn)})
+	}
+
+	return m, nil
+}
+
+// Close closes the connections to all plugins
+func (m *Manager) Close() {
+	for _, p := range m.plugins {
+		p.conn.Close()
+	}
+}
+
+type pluginStream struct {
+	plugin *plugin
+	stream Validator_ValidateClient
+	cancel context.CancelFunc
+	err    error
+}
+
+// Session streams the content of one file to all plugins, it implements
+// io.Writer so it can be attached to the decryption stream.
+type Session struct {
+	streams []*pluginStream
+}
+
+// NewSession opens a validation stream to each plugin and sends the file context.
+// Plugins that can not be reached are recorded as failed and evaluated on Close.
+func (m *Manager) NewSession(ctx context.Context, fileContext *FileContext) *Session {
+	s := &Session{}
+	for _, p := range m.plugins {
+		ps := &pluginStream{plugin: p}
+		var pctx context.Context
+		if p.conf.Timeout > 0 {
+			pctx, ps.cancel = context.WithTimeout(ctx, time.Duration(p.conf.Timeout)*time.Second)
+		} else {
+			pctx, ps.cancel = context.WithCancel(ctx)
+		}
+
+		ps.stream, ps.err = p.client.Validate(pctx)
+		if ps.err == nil {
+			ps.err = ps.stream.Send(&ValidateRequest{Context: fileContext})
+		}
+		s.streams = append(s.streams, ps)
+	}
+
+	return s
+}
+
+// Write sends a chunk of decrypted data to every plugin that is still healthy.
+// Plugin errors never stop the decryption, they are evaluated on Close.
+func (s *Session) Write(chunk []byte) (int, error) {
+	for _, ps := range s.streams {
+		if ps.err != nil {
+			continue
+		}
+		ps.err = ps.stream.Send(&ValidateRequest{Chunk: chunk})
+	}
+
+	return len(chunk), nil
+}
+
+// Close ends the streams and collects the verdicts, an error is returned
+// if any plugin with a required policy rejected the file or could not
+// complete the validation. Advisory failures are only logged.
+func (s *Session) Close() error {
+	var rejections []string
+	for _, ps := range s.streams {
+		name := ps.plugin.conf.Name
+		reason := ""
+		if ps.err == nil {
+			res, err := ps.stream.CloseAndRecv()
+			switch {
+			case err != nil:
+				reason = fmt.Sprintf("validation failed: %v", err)
+			case !res.GetPassed():
+				reason = fmt.Sprintf("rejected: %s", res.GetMessage())
+			default:
+				log.Debugf("validator plugin %s passed the file", name)
+			}
+		} else {
+			reason = fmt.Sprintf("validation failed: %v", ps.err)
+		}
+		ps.cancel()
+
+		if reason == "" {
+			continue
+		}
+		if ps.plugin.conf.Policy == PolicyAdvisory {
+			log.Warnf("advisory validator plugin %s %s", name, reason)
+
+			continue
+		}
+		rejections = append(rejections, fmt.Sprintf("%s %s", name, reason))
+	}
+
+	if len(rejections) > 0 {
+		return fmt.Errorf("file rejected by validator plugins: %s", strings.Join(rejections, "; "))
+	}
+
+	return nil
+}
+
+// Abort cancels all streams without waiting for a verdict
+func (s *Session) Abort() {
+	for _, ps := range s.streams {
+		ps.cancel()
+	}
+}
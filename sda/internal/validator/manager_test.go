@@ -0,0 +1,117 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/neicnordic/sensitive-data-archive/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+)
+
+type ValidatorTestSuite struct {
+	suite.Suite
+	address string
+	server  *grpc.Server
+	plugin  *testPlugin
+}
+
+// testPlugin rejects files containing the word "virus"
+type testPlugin struct {
+	UnimplementedValidatorServer
+	context *FileContext
+	size    int
+}
+
+func (p *testPlugin) Validate(stream Validator_ValidateServer) error {
+	var content bytes.Buffer
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if req.GetContext() != nil {
+			p.context = req.GetContext()
+		}
+		content.Write(req.GetChunk())
+	}
+	p.size = content.Len()
+
+	if strings.Contains(content.String(), "virus") {
+		return stream.SendAndClose(&ValidateResponse{Passed: false, Message: "virus found"})
+	}
+
+	return stream.SendAndClose(&ValidateResponse{Passed: true})
+}
+
+func TestValidatorTestSuite(t *testing.T) {
+	suite.Run(t, new(ValidatorTestSuite))
+}
+
+func (suite *ValidatorTestSuite) SetupTest() {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		suite.T().FailNow()
+	}
+	suite.address = lis.Addr().String()
+	suite.plugin = &testPlugin{}
+	suite.server = grpc.NewServer()
+	RegisterValidatorServer(suite.server, suite.plugin)
+	go func() { _ = suite.server.Serve(lis) }()
+}
+
+func (suite *ValidatorTestSuite) TearDownTest() {
+	suite.server.Stop()
+}
+
+func (suite *ValidatorTestSuite) validate(policy, content string) error {
+	m, err := NewManager([]config.ValidatorConf{{Name: "test", Address: suite.address, Policy: policy, Timeout: 5}})
+	assert.NoError(suite.T(), err)
+	defer m.Close()
+
+	s := m.NewSession(context.Background(), &FileContext{FileId: "file-id", User: "dummy", Filepath: "dummy/file.c4gh"})
+	_, err = io.Copy(s, strings.NewReader(content))
+	assert.NoError(suite.T(), err)
+
+	return s.Close()
+}
+
+func (suite *ValidatorTestSuite) TestValidate_Passed() {
+	assert.NoError(suite.T(), suite.validate(PolicyRequired, "harmless content"))
+	assert.Equal(suite.T(), "file-id", suite.plugin.context.GetFileId())
+	assert.Equal(suite.T(), "dummy", suite.plugin.context.GetUser())
+	assert.Equal(suite.T(), 16, suite.plugin.size)
+}
+
+func (suite *ValidatorTestSuite) TestValidate_RequiredRejects() {
+	err := suite.validate(PolicyRequired, "this file contains a virus")
+	assert.ErrorContains(suite.T(), err, "test rejected: virus found")
+}
+
+func (suite *ValidatorTestSuite) TestValidate_AdvisoryOnlyLogs() {
+	assert.NoError(suite.T(), suite.validate(PolicyAdvisory, "this file contains a virus"))
+}
+
+func (suite *ValidatorTestSuite) TestValidate_DisabledIsSkipped() {
+	m, err := NewManager([]config.ValidatorConf{{Name: "test", Address: suite.address, Policy: PolicyDisabled}})
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), m.plugins)
+}
+
+func (suite *ValidatorTestSuite) TestValidate_Unreachable() {
+	suite.server.Stop()
+
+	err := suite.validate(PolicyRequired, "harmless content")
+	assert.ErrorContains(suite.T(), err, "test validation failed")
+
+	assert.NoError(suite.T(), suite.validate(PolicyAdvisory, "harmless content"))
+}
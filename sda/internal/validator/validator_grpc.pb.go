@@ -0,0 +1,147 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v5.26.1
+// source: internal/validator/validator.proto
+
+package validator
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Validator_Validate_FullMethodName = "/validator.Validator/Validate"
+)
+
+// ValidatorClient is the client API for Validator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ValidatorClient interface {
+	// Receives the file context followed by the decrypted file content
+	// in chunks, and returns the verdict once the stream is closed.
+	Validate(ctx context.Context, opts ...grpc.CallOption) (Validator_ValidateClient, error)
+}
+
+type validatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewValidatorClient(cc grpc.ClientConnInterface) ValidatorClient {
+	return &validatorClient{cc}
+}
+
+func (c *validatorClient) Validate(ctx context.Context, opts ...grpc.CallOption) (Validator_ValidateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Validator_ServiceDesc.Streams[0], Validator_Validate_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &validatorValidateClient{stream}
+	return x, nil
+}
+
+type Validator_ValidateClient interface {
+	Send(*ValidateRequest) error
+	CloseAndRecv() (*ValidateResponse, error)
+	grpc.ClientStream
+}
+
+type validatorValidateClient struct {
+	grpc.ClientStream
+}
+
+func (x *validatorValidateClient) Send(m *ValidateRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *validatorValidateClient) CloseAndRecv() (*ValidateResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ValidateResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ValidatorServer is the server API for Validator service.
+// All implementations must embed UnimplementedValidatorServer
+// for forward compatibility
+type ValidatorServer interface {
+	// Receives the file context followed by the decrypted file content
+	// in chunks, and returns the verdict once the stream is closed.
+	Validate(Validator_ValidateServer) error
+	mustEmbedUnimplementedValidatorServer()
+}
+
+// UnimplementedValidatorServer must be embedded to have forward compatible implementations.
+type UnimplementedValidatorServer struct {
+}
+
+func (UnimplementedValidatorServer) Validate(Validator_ValidateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Validate not implemented")
+}
+func (UnimplementedValidatorServer) mustEmbedUnimplementedValidatorServer() {}
+
+// UnsafeValidatorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ValidatorServer will
+// result in compilation errors.
+type UnsafeValidatorServer interface {
+	mustEmbedUnimplementedValidatorServer()
+}
+
+func RegisterValidatorServer(s grpc.ServiceRegistrar, srv ValidatorServer) {
+	s.RegisterService(&Validator_ServiceDesc, srv)
+}
+
+func _Validator_Validate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ValidatorServer).Validate(&validatorValidateServer{stream})
+}
+
+type Validator_ValidateServer interface {
+	SendAndClose(*ValidateResponse) error
+	Recv() (*ValidateRequest, error)
+	grpc.ServerStream
+}
+
+type validatorValidateServer struct {
+	grpc.ServerStream
+}
+
+func (x *validatorValidateServer) SendAndClose(m *ValidateResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *validatorValidateServer) Recv() (*ValidateRequest, error) {
+	m := new(ValidateRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Validator_ServiceDesc is the grpc.ServiceDesc for Validator service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Validator_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "validator.Validator",
+	HandlerType: (*ValidatorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Validate",
+			Handler:       _Validator_Validate_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "internal/validator/validator.proto",
+}